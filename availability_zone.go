@@ -0,0 +1,150 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// defaultAvailabilityZoneTag is the key metrics are tagged with the
+// availability zone under, unless availability_zone_tag is set.
+const defaultAvailabilityZoneTag = "az"
+
+// azLookupTimeout bounds how long looking up the availability zone in a
+// cloud's metadata can hold up startup.
+const azLookupTimeout = 2 * time.Second
+
+// the metadata servers of the clouds that availability zones can be looked
+// up in, as they are reached from their instances
+const (
+	awsMetadataEndpoint = "http://169.254.169.254"
+	gcpMetadataEndpoint = "http://metadata.google.internal"
+)
+
+// An azResolver looks up the availability zone that veneur is running in.
+type azResolver interface {
+	AvailabilityZone(ctx context.Context) (string, error)
+}
+
+// azResolvers are the resolvers for each availability_zone_source.
+var azResolvers = map[string]func(c Config) azResolver{
+	"static": func(c Config) azResolver { return staticAZ(c.AvailabilityZone) },
+	"aws": func(c Config) azResolver {
+		return awsMetadataAZ{endpoint: awsMetadataEndpoint, client: http.DefaultClient}
+	},
+	"gcp": func(c Config) azResolver {
+		return gcpMetadataAZ{endpoint: gcpMetadataEndpoint, client: http.DefaultClient}
+	},
+}
+
+// resolveAvailabilityZone returns the tag to add to every metric for the
+// availability zone, from availability_zone_source, or "" if there's no
+// source or it doesn't know. If the lookup fails, availability_zone is used
+// instead, so that an unreachable metadata server never stops veneur from
+// starting.
+func resolveAvailabilityZone(c Config) (string, error) {
+	if c.AvailabilityZoneSource == "" {
+		return "", nil
+	}
+	newResolver, ok := azResolvers[c.AvailabilityZoneSource]
+	if !ok {
+		return "", fmt.Errorf("unknown availability_zone_source %q", c.AvailabilityZoneSource)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), azLookupTimeout)
+	defer cancel()
+	zone, err := newResolver(c).AvailabilityZone(ctx)
+	if err != nil {
+		log.WithError(err).WithFields(logrus.Fields{
+			"source":   c.AvailabilityZoneSource,
+			"fallback": c.AvailabilityZone,
+		}).Warn("Could not look up the availability zone")
+		zone = c.AvailabilityZone
+	}
+	if zone == "" {
+		return "", nil
+	}
+	key := c.AvailabilityZoneTag
+	if key == "" {
+		key = defaultAvailabilityZoneTag
+	}
+	return key + ":" + zone, nil
+}
+
+// staticAZ is an availability zone from the config.
+type staticAZ string
+
+func (z staticAZ) AvailabilityZone(ctx context.Context) (string, error) {
+	return string(z), nil
+}
+
+// awsMetadataAZ looks up the availability zone in the EC2 instance metadata
+// service. A session token is asked for first, as instances that require
+// IMDSv2 demand, but if that fails the zone is asked for without one.
+type awsMetadataAZ struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (r awsMetadataAZ) AvailabilityZone(ctx context.Context) (string, error) {
+	req, err := http.NewRequest(http.MethodPut, r.endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "60")
+	token, err := metadataGet(ctx, r.client, req)
+	if err != nil {
+		token = ""
+	}
+
+	req, err = http.NewRequest(http.MethodGet, r.endpoint+"/latest/meta-data/placement/availability-zone", nil)
+	if err != nil {
+		return "", err
+	}
+	if token != "" {
+		req.Header.Set("X-aws-ec2-metadata-token", token)
+	}
+	return metadataGet(ctx, r.client, req)
+}
+
+// gcpMetadataAZ looks up the zone in the GCE metadata server.
+type gcpMetadataAZ struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (r gcpMetadataAZ) AvailabilityZone(ctx context.Context) (string, error) {
+	req, err := http.NewRequest(http.MethodGet, r.endpoint+"/computeMetadata/v1/instance/zone", nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	zone, err := metadataGet(ctx, r.client, req)
+	if err != nil {
+		return "", err
+	}
+	// it's the zone's full name, projects/<number>/zones/<zone>
+	return zone[strings.LastIndex(zone, "/")+1:], nil
+}
+
+// metadataGet makes a request to a metadata server and returns the body of
+// its response, which must be successful.
+func metadataGet(ctx context.Context, client *http.Client, req *http.Request) (string, error) {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("%s %s: %s", req.Method, req.URL, resp.Status)
+	}
+	return strings.TrimSpace(string(body)), nil
+}
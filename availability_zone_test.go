@@ -0,0 +1,105 @@
+package veneur
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAWSMetadataAZ(t *testing.T) {
+	requireToken := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			if !requireToken {
+				// like an old metadata service, without IMDSv2
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			assert.Equal(t, "60", r.Header.Get("X-aws-ec2-metadata-token-ttl-seconds"))
+			w.Write([]byte("secret"))
+		case r.Method == http.MethodGet && r.URL.Path == "/latest/meta-data/placement/availability-zone":
+			if requireToken && r.Header.Get("X-aws-ec2-metadata-token") != "secret" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte("us-east-1a"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	resolver := awsMetadataAZ{endpoint: server.URL, client: server.Client()}
+	zone, err := resolver.AvailabilityZone(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "us-east-1a", zone)
+
+	requireToken = false
+	zone, err = resolver.AvailabilityZone(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "us-east-1a", zone, "the zone is asked for without a token if there isn't one")
+}
+
+func TestGCPMetadataAZ(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computeMetadata/v1/instance/zone" || r.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("projects/123456/zones/us-central1-b\n"))
+	}))
+	defer server.Close()
+
+	zone, err := gcpMetadataAZ{endpoint: server.URL, client: server.Client()}.AvailabilityZone(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, "us-central1-b", zone)
+}
+
+type failingAZ struct{}
+
+func (failingAZ) AvailabilityZone(ctx context.Context) (string, error) {
+	return "", errors.New("no metadata here")
+}
+
+func TestResolveAvailabilityZone(t *testing.T) {
+	azResolvers["failing"] = func(Config) azResolver { return failingAZ{} }
+	defer delete(azResolvers, "failing")
+
+	for _, test := range []struct {
+		name string
+		conf Config
+		tag  string
+	}{
+		{"unset", Config{AvailabilityZone: "us-east-1a"}, ""},
+		{"static", Config{AvailabilityZoneSource: "static", AvailabilityZone: "us-east-1a"}, "az:us-east-1a"},
+		{"custom key", Config{AvailabilityZoneSource: "static", AvailabilityZone: "us-east-1a", AvailabilityZoneTag: "zone"}, "zone:us-east-1a"},
+		{"static but empty", Config{AvailabilityZoneSource: "static"}, ""},
+		{"failed lookup falls back", Config{AvailabilityZoneSource: "failing", AvailabilityZone: "us-east-1b"}, "az:us-east-1b"},
+		{"failed lookup without a fallback", Config{AvailabilityZoneSource: "failing"}, ""},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			tag, err := resolveAvailabilityZone(test.conf)
+			assert.NoError(t, err)
+			assert.Equal(t, test.tag, tag)
+		})
+	}
+
+	_, err := resolveAvailabilityZone(Config{AvailabilityZoneSource: "azure"})
+	assert.Error(t, err)
+}
+
+func TestServerTagsAvailabilityZone(t *testing.T) {
+	config := localConfig()
+	config.Tags = []string{"env:test"}
+	config.AvailabilityZoneSource = "static"
+	config.AvailabilityZone = "us-east-1a"
+	server, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"env:test", "az:us-east-1a"}, server.Tags)
+	assert.Equal(t, []string{"env:test"}, config.Tags, "the configured tags are left alone")
+}
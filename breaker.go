@@ -0,0 +1,277 @@
+package veneur
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// defaultSinkBreakerCooldown is how long a sink's circuit stays open, if
+// sink_breaker_cooldown is not set.
+const defaultSinkBreakerCooldown = time.Minute
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (bs breakerState) String() string {
+	switch bs {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+// circuitBreaker stops flushing to a sink that keeps failing. After threshold
+// consecutive failures the circuit opens, and flushes to the sink are skipped
+// until cooldown has passed. Then it is half-open: the next flush is let
+// through as a probe, which closes the circuit again if it succeeds and
+// reopens it for another cooldown if it fails.
+//
+// A nil circuitBreaker lets every flush through.
+type circuitBreaker struct {
+	mtx       sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     breakerState
+	openedAt  time.Time
+
+	// swapped out by tests
+	now func() time.Time
+}
+
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+	}
+}
+
+// Allow reports whether a flush to the sink should be attempted. Every
+// attempt it allows must be followed by a call to Record.
+func (b *circuitBreaker) Allow() bool {
+	if b == nil {
+		return true
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// the probe is still in flight
+		return false
+	default:
+		return true
+	}
+}
+
+// Record reports the outcome of a flush that Allow let through. It returns
+// the new state if the circuit changed state.
+func (b *circuitBreaker) Record(err error) (breakerState, bool) {
+	if b == nil {
+		return breakerClosed, false
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+
+	previous := b.state
+	if err == nil {
+		b.failures = 0
+		b.state = breakerClosed
+	} else {
+		b.failures++
+		if b.state == breakerHalfOpen || b.failures >= b.threshold {
+			b.state = breakerOpen
+			b.openedAt = b.now()
+		}
+	}
+	return b.state, b.state != previous
+}
+
+// State returns the current state of the circuit.
+func (b *circuitBreaker) State() breakerState {
+	if b == nil {
+		return breakerClosed
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.state
+}
+
+// sinkBreakers holds a circuitBreaker for each sink, created the first time
+// the sink is flushed to. A nil sinkBreakers means circuit breaking is
+// disabled.
+type sinkBreakers struct {
+	mtx       sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	breakers  map[string]*circuitBreaker
+}
+
+func newSinkBreakers(threshold int, cooldown time.Duration) *sinkBreakers {
+	return &sinkBreakers{
+		threshold: threshold,
+		cooldown:  cooldown,
+		breakers:  map[string]*circuitBreaker{},
+	}
+}
+
+func (sb *sinkBreakers) get(sink string) *circuitBreaker {
+	if sb == nil {
+		return nil
+	}
+	sb.mtx.Lock()
+	defer sb.mtx.Unlock()
+	b, ok := sb.breakers[sink]
+	if !ok {
+		b = newCircuitBreaker(sb.threshold, sb.cooldown)
+		sb.breakers[sink] = b
+	}
+	return b
+}
+
+// states returns the state of every sink's circuit, sorted by sink name.
+func (sb *sinkBreakers) states() (sinks []string, states []breakerState) {
+	if sb == nil {
+		return nil, nil
+	}
+	sb.mtx.Lock()
+	for sink := range sb.breakers {
+		sinks = append(sinks, sink)
+	}
+	sb.mtx.Unlock()
+	sort.Strings(sinks)
+	for _, sink := range sinks {
+		states = append(states, sb.get(sink).State())
+	}
+	return sinks, states
+}
+
+// errSinkSkipped is returned by flushSink when the sink's circuit is open.
+// Nothing was sent, so callers shouldn't report the flush.
+var errSinkSkipped = errors.New("the sink's circuit is open")
+
+// flushSink runs flush for the named sink, unless its circuit is open, in
+// which case the flush is skipped, counted, and errSinkSkipped is returned.
+// The flush is given a context
+// that expires after the sink's flush timeout, and if it hasn't returned by
+// then it is abandoned and recorded as failed, so that one slow sink can't
+// hold up the others.
+func (s *Server) flushSink(ctx context.Context, sink string, flush func(context.Context) error) error {
+	start := time.Now()
+	breaker := s.breakers.get(sink)
+	if !breaker.Allow() {
+		s.statsd.Count("flush.skipped_total", 1, []string{"sink:" + sink, "cause:circuit_open"}, 1.0)
+		s.flushScheduler.recordSink(sink, start, 0, nil, true)
+		return errSinkSkipped
+	}
+	err := s.flushSinkWithTimeout(ctx, sink, flush)
+	s.flushScheduler.recordSink(sink, start, time.Since(start), err, false)
+	if state, changed := breaker.Record(err); changed {
+		log.WithFields(logrus.Fields{
+			"sink":  sink,
+			"state": state.String(),
+		}).Warn("Sink circuit changed state")
+	}
+	return err
+}
+
+func (s *Server) flushSinkWithTimeout(ctx context.Context, sink string, flush func(context.Context) error) error {
+	timeout := s.sinkFlushTimeout(sink)
+	if timeout <= 0 {
+		return flush(ctx)
+	}
+	// plugins can't be cancelled, so one that hangs would otherwise leave
+	// another goroutine behind at every interval
+	if s.abandonedFlushes.has(sink) {
+		s.statsd.Count("flush.skipped_total", 1, []string{"sink:" + sink, "cause:still_running"}, 1.0)
+		return fmt.Errorf("the abandoned flush to %s is still running", sink)
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// buffered, so that an abandoned flush can still finish
+	done := make(chan error, 1)
+	go func() {
+		done <- flush(ctx)
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		s.abandonedFlushes.add(sink)
+		go func() {
+			<-done
+			s.abandonedFlushes.remove(sink)
+		}()
+		s.statsd.Count("flush.timeout_total", 1, []string{"sink:" + sink}, 1.0)
+		return fmt.Errorf("flush to %s timed out after %s", sink, timeout)
+	}
+}
+
+// abandonedFlushes is the set of sinks with a flush that timed out but
+// hasn't returned yet. A nil *abandonedFlushes tracks nothing.
+type abandonedFlushes struct {
+	mtx   sync.Mutex
+	sinks map[string]bool
+}
+
+func newAbandonedFlushes() *abandonedFlushes {
+	return &abandonedFlushes{sinks: map[string]bool{}}
+}
+
+func (af *abandonedFlushes) has(sink string) bool {
+	if af == nil {
+		return false
+	}
+	af.mtx.Lock()
+	defer af.mtx.Unlock()
+	return af.sinks[sink]
+}
+
+func (af *abandonedFlushes) add(sink string) {
+	if af == nil {
+		return
+	}
+	af.mtx.Lock()
+	defer af.mtx.Unlock()
+	af.sinks[sink] = true
+}
+
+func (af *abandonedFlushes) remove(sink string) {
+	if af == nil {
+		return
+	}
+	af.mtx.Lock()
+	defer af.mtx.Unlock()
+	delete(af.sinks, sink)
+}
+
+// sinkFlushTimeout returns how long a flush to the named sink may take,
+// which is the global flush timeout unless sink_flush_timeouts overrides it.
+func (s *Server) sinkFlushTimeout(sink string) time.Duration {
+	if timeout, ok := s.sinkFlushTimeouts[sink]; ok {
+		return timeout
+	}
+	return s.flushTimeout
+}
@@ -0,0 +1,163 @@
+package veneur
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := newCircuitBreaker(3, time.Minute)
+	b.now = func() time.Time { return now }
+	failure := errors.New("sink is down")
+
+	// failures that aren't consecutive don't open the circuit
+	for _, err := range []error{failure, failure, nil, failure, failure} {
+		assert.True(t, b.Allow())
+		b.Record(err)
+	}
+	assert.Equal(t, breakerClosed, b.State())
+
+	assert.True(t, b.Allow())
+	state, changed := b.Record(failure)
+	assert.True(t, changed)
+	assert.Equal(t, breakerOpen, state, "the third consecutive failure opens the circuit")
+	assert.False(t, b.Allow())
+
+	now = now.Add(59 * time.Second)
+	assert.False(t, b.Allow(), "the circuit stays open for the whole cooldown")
+
+	// a failed probe reopens it for another cooldown
+	now = now.Add(time.Second)
+	assert.True(t, b.Allow())
+	assert.Equal(t, breakerHalfOpen, b.State())
+	assert.False(t, b.Allow(), "only one probe at a time")
+	b.Record(failure)
+	assert.Equal(t, breakerOpen, b.State())
+	now = now.Add(30 * time.Second)
+	assert.False(t, b.Allow())
+
+	// a successful one closes it, and starts counting failures afresh
+	now = now.Add(30 * time.Second)
+	assert.True(t, b.Allow())
+	state, changed = b.Record(nil)
+	assert.True(t, changed)
+	assert.Equal(t, breakerClosed, state)
+	for i := 0; i < 2; i++ {
+		assert.True(t, b.Allow())
+		b.Record(failure)
+	}
+	assert.Equal(t, breakerClosed, b.State())
+
+	var disabled *circuitBreaker
+	assert.True(t, disabled.Allow())
+}
+
+func TestFlushPluginsCircuitBreaker(t *testing.T) {
+	s := &Server{breakers: newSinkBreakers(2, time.Hour)}
+	flushes := 0
+	s.registerPlugin(&dummyPlugin{flush: func(metrics []samplers.DDMetric, hostname string) error {
+		flushes++
+		return errors.New("plugin is down")
+	}})
+
+	for i := 0; i < 5; i++ {
+		s.flushPlugins(context.Background(), nil, nil)
+	}
+	assert.Equal(t, 2, flushes, "flushes after the circuit opens should be skipped")
+	err := s.flushSink(context.Background(), "dummy_plugin", func(context.Context) error {
+		return nil
+	})
+	assert.Equal(t, errSinkSkipped, err, "callers should be able to tell a skipped flush from a successful one")
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthcheck", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "ok\nsink dummy_plugin: circuit open\n", w.Body.String())
+}
+
+func TestFlushSinkTimeout(t *testing.T) {
+	s := &Server{
+		breakers:          newSinkBreakers(1, time.Hour),
+		flushTimeout:      time.Hour,
+		sinkFlushTimeouts: map[string]time.Duration{"dummy_plugin": 10 * time.Millisecond},
+	}
+	release := make(chan struct{})
+	defer close(release)
+	s.registerPlugin(&dummyPlugin{flush: func(metrics []samplers.DDMetric, hostname string) error {
+		<-release
+		return nil
+	}})
+
+	start := time.Now()
+	s.flushPlugins(context.Background(), nil, nil)
+	assert.True(t, time.Since(start) < time.Minute, "a slow plugin should be abandoned at its own timeout")
+	assert.Equal(t, breakerOpen, s.breakers.get("dummy_plugin").State(), "a timed out flush should count as failed")
+
+	// sinks that aren't listed get the global timeout, and their context is
+	// cancelled when it passes
+	s.flushTimeout = 10 * time.Millisecond
+	err := s.flushSink(context.Background(), datadogSinkName, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.Error(t, err)
+	assert.Equal(t, breakerOpen, s.breakers.get(datadogSinkName).State())
+	assert.Equal(t, 10*time.Millisecond, s.sinkFlushTimeout("s3"))
+}
+
+func TestFlushSinkStillRunning(t *testing.T) {
+	s := &Server{
+		flushTimeout:     10 * time.Millisecond,
+		abandonedFlushes: newAbandonedFlushes(),
+	}
+	release := make(chan struct{})
+	finished := make(chan struct{})
+	err := s.flushSink(context.Background(), "dummy_plugin", func(context.Context) error {
+		// a plugin that ignores its context
+		<-release
+		close(finished)
+		return nil
+	})
+	assert.Error(t, err, "the flush should have timed out")
+
+	started := false
+	err = s.flushSink(context.Background(), "dummy_plugin", func(context.Context) error {
+		started = true
+		return nil
+	})
+	assert.Error(t, err)
+	assert.False(t, started, "no flush should start while the abandoned one is still running")
+
+	close(release)
+	<-finished
+	for s.abandonedFlushes.has("dummy_plugin") {
+		time.Sleep(time.Millisecond)
+	}
+	err = s.flushSink(context.Background(), "dummy_plugin", func(context.Context) error {
+		started = true
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.True(t, started, "flushes should resume once the abandoned one finishes")
+}
+
+func TestSinkFlushTimeoutsConfig(t *testing.T) {
+	config := localConfig()
+	config.SinkFlushTimeouts = map[string]string{"datadog": "2s"}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Second, s.sinkFlushTimeout(datadogSinkName))
+	assert.Equal(t, s.interval*9/10, s.sinkFlushTimeout("influxdb"))
+
+	config.SinkFlushTimeouts = map[string]string{"datadog": "0s"}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "timeouts must be positive")
+}
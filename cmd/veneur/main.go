@@ -5,6 +5,7 @@ import (
 
 	"github.com/Sirupsen/logrus"
 	"github.com/stripe/veneur"
+	_ "github.com/stripe/veneur/plugins/parquet"
 	"github.com/stripe/veneur/trace"
 )
 
@@ -1,34 +1,128 @@
 package veneur
 
 type Config struct {
-	Aggregates          []string  `yaml:"aggregates"`
-	APIHostname         string    `yaml:"api_hostname"`
-	AwsAccessKeyID      string    `yaml:"aws_access_key_id"`
-	AwsRegion           string    `yaml:"aws_region"`
-	AwsS3Bucket         string    `yaml:"aws_s3_bucket"`
-	AwsSecretAccessKey  string    `yaml:"aws_secret_access_key"`
-	Debug               bool      `yaml:"debug"`
-	EnableProfiling     bool      `yaml:"enable_profiling"`
-	FlushMaxPerBody     int       `yaml:"flush_max_per_body"`
-	ForwardAddress      string    `yaml:"forward_address"`
-	Hostname            string    `yaml:"hostname"`
-	HTTPAddress         string    `yaml:"http_address"`
-	InfluxAddress       string    `yaml:"influx_address"`
-	InfluxConsistency   string    `yaml:"influx_consistency"`
-	InfluxDBName        string    `yaml:"influx_db_name"`
-	Interval            string    `yaml:"interval"`
-	Key                 string    `yaml:"key"`
-	MetricMaxLength     int       `yaml:"metric_max_length"`
-	NumReaders          int       `yaml:"num_readers"`
-	NumWorkers          int       `yaml:"num_workers"`
-	OmitEmptyHostname   bool      `yaml:"omit_empty_hostname"`
-	Percentiles         []float64 `yaml:"percentiles"`
-	ReadBufferSizeBytes int       `yaml:"read_buffer_size_bytes"`
-	SentryDsn           string    `yaml:"sentry_dsn"`
-	StatsAddress        string    `yaml:"stats_address"`
-	Tags                []string  `yaml:"tags"`
-	TraceAddress        string    `yaml:"trace_address"`
-	TraceAPIAddress     string    `yaml:"trace_api_address"`
-	TraceMaxLengthBytes int       `yaml:"trace_max_length_bytes"`
-	UdpAddress          string    `yaml:"udp_address"`
+	Aggregates                  []string               `yaml:"aggregates"`
+	APIHostname                 string                 `yaml:"api_hostname"`
+	AvailabilityZone            string                 `yaml:"availability_zone"`
+	AvailabilityZoneSource      string                 `yaml:"availability_zone_source"`
+	AvailabilityZoneTag         string                 `yaml:"availability_zone_tag"`
+	AwsAccessKeyID              string                 `yaml:"aws_access_key_id"`
+	AwsRegion                   string                 `yaml:"aws_region"`
+	AwsS3Bucket                 string                 `yaml:"aws_s3_bucket"`
+	AwsSecretAccessKey          string                 `yaml:"aws_secret_access_key"`
+	CloudMonitoringBatchSize    int                    `yaml:"cloud_monitoring_batch_size"`
+	CloudMonitoringMetricPrefix string                 `yaml:"cloud_monitoring_metric_prefix"`
+	CloudMonitoringProjectID    string                 `yaml:"cloud_monitoring_project_id"`
+	DatadogShadowAPIHostname    string                 `yaml:"datadog_shadow_api_hostname"`
+	DatadogShadowAPIKey         string                 `yaml:"datadog_shadow_api_key"`
+	Debug                       bool                   `yaml:"debug"`
+	DogstatsdTimestamps         bool                   `yaml:"dogstatsd_timestamps"`
+	EnableMetricReset           bool                   `yaml:"enable_metric_reset"`
+	EnableProfiling             bool                   `yaml:"enable_profiling"`
+	EventDedupe                 bool                   `yaml:"event_dedupe"`
+	EventDedupeAnnotate         bool                   `yaml:"event_dedupe_annotate"`
+	EventDedupeMaxKeys          int                    `yaml:"event_dedupe_max_keys"`
+	FlushCountersAsCounts       bool                   `yaml:"flush_counters_as_counts"`
+	FlushMaxBodyBytes           int                    `yaml:"flush_max_body_bytes"`
+	FlushMaxPerBody             int                    `yaml:"flush_max_per_body"`
+	FlushOmitEmptyHistograms    bool                   `yaml:"flush_omit_empty_histograms"`
+	FlushOmitHeartbeat          bool                   `yaml:"flush_omit_heartbeat"`
+	FlushOverrun                string                 `yaml:"flush_overrun"`
+	FlushSerializationWorkers   int                    `yaml:"flush_serialization_workers"`
+	FlushTiers                  []FlushTier            `yaml:"flush_tiers"`
+	FlushTiersEnabled           bool                   `yaml:"flush_tiers_enabled"`
+	FlushTimestampAlignment     string                 `yaml:"flush_timestamp_alignment"`
+	FlushTracePhases            bool                   `yaml:"flush_trace_phases"`
+	ForwardAddress              string                 `yaml:"forward_address"`
+	ForwardCompressionLevel     int                    `yaml:"forward_compression_level"`
+	ForwardDeadletterDir        string                 `yaml:"forward_deadletter_dir"`
+	ForwardDeadletterMaxAge     string                 `yaml:"forward_deadletter_max_age"`
+	ForwardDeadletterMaxBytes   int                    `yaml:"forward_deadletter_max_bytes"`
+	ForwardPassthroughTypes     []string               `yaml:"forward_passthrough_types"`
+	ForwardTLSCA                string                 `yaml:"forward_tls_ca"`
+	ForwardTLSCert              string                 `yaml:"forward_tls_cert"`
+	ForwardTLSKey               string                 `yaml:"forward_tls_key"`
+	GaugeAggregations           map[string]string      `yaml:"gauge_aggregations"`
+	HistogramBuckets            map[string][]float64   `yaml:"histogram_buckets"`
+	HistogramCompressions       []HistogramCompression `yaml:"histogram_compressions"`
+	HistogramCountSuffix        string                 `yaml:"histogram_count_suffix"`
+	HistogramDistributions      string                 `yaml:"histogram_distributions"`
+	HistogramMaxRate            int                    `yaml:"histogram_max_rate"`
+	Hostname                    string                 `yaml:"hostname"`
+	HostnameEnv                 string                 `yaml:"hostname_env"`
+	HostnameFile                string                 `yaml:"hostname_file"`
+	HostnameSource              string                 `yaml:"hostname_source"`
+	HostnameTag                 string                 `yaml:"hostname_tag"`
+	HTTPAddress                 string                 `yaml:"http_address"`
+	HTTPSinkEncodings           map[string]string      `yaml:"http_sink_encodings"`
+	HTTPSinkPools               map[string]HTTPPool    `yaml:"http_sink_pools"`
+	HTTPTLSCertificate          string                 `yaml:"http_tls_certificate"`
+	HTTPTLSClientCA             string                 `yaml:"http_tls_client_ca"`
+	HTTPTLSKey                  string                 `yaml:"http_tls_key"`
+	ImportMaxInFlight           int                    `yaml:"import_max_in_flight"`
+	InfluxAddress               string                 `yaml:"influx_address"`
+	InfluxBatchSize             int                    `yaml:"influx_batch_size"`
+	InfluxBucket                string                 `yaml:"influx_bucket"`
+	InfluxConsistency           string                 `yaml:"influx_consistency"`
+	InfluxDBName                string                 `yaml:"influx_db_name"`
+	InfluxOrg                   string                 `yaml:"influx_org"`
+	InfluxPassword              string                 `yaml:"influx_password"`
+	InfluxRetentionPolicy       string                 `yaml:"influx_retention_policy"`
+	InfluxToken                 string                 `yaml:"influx_token"`
+	InfluxUsername              string                 `yaml:"influx_username"`
+	InternalMetricsFlushEvery   int                    `yaml:"internal_metrics_flush_every"`
+	Interval                    string                 `yaml:"interval"`
+	Key                         string                 `yaml:"key"`
+	MaxFlushPause               string                 `yaml:"max_flush_pause"`
+	MaxFlushPauseSeries         int                    `yaml:"max_flush_pause_series"`
+	MaxTagsPerMetric            int                    `yaml:"max_tags_per_metric"`
+	MetricDropRules             []MetricDropRule       `yaml:"metric_drop_rules"`
+	MetricMaxLength             int                    `yaml:"metric_max_length"`
+	MetricMaxLineLength         int                    `yaml:"metric_max_line_length"`
+	MetricNamePattern           string                 `yaml:"metric_name_pattern"`
+	MetricNameViolations        string                 `yaml:"metric_name_violations"`
+	MetricRoutes                []MetricRoute          `yaml:"metric_routes"`
+	MetricRoutesDefault         []string               `yaml:"metric_routes_default"`
+	MetricScales                []MetricScale          `yaml:"metric_scales"`
+	NumReaders                  int                    `yaml:"num_readers"`
+	NumWorkers                  int                    `yaml:"num_workers"`
+	OmitEmptyHostname           bool                   `yaml:"omit_empty_hostname"`
+	Percentiles                 []float64              `yaml:"percentiles"`
+	PrometheusScrapeInterval    string                 `yaml:"prometheus_scrape_interval"`
+	PrometheusScrapeTargets     []ScrapeTarget         `yaml:"prometheus_scrape_targets"`
+	ReadBufferSizeBytes         int                    `yaml:"read_buffer_size_bytes"`
+	SentryDsn                   string                 `yaml:"sentry_dsn"`
+	SinkBreakerCooldown         string                 `yaml:"sink_breaker_cooldown"`
+	SinkBreakerThreshold        int                    `yaml:"sink_breaker_threshold"`
+	SinkFlushTimeouts           map[string]string      `yaml:"sink_flush_timeouts"`
+	SinkMaxRetries              int                    `yaml:"sink_max_retries"`
+	SinkRetryBudgetCapacity     float64                `yaml:"sink_retry_budget_capacity"`
+	SinkRetryBudgetRate         float64                `yaml:"sink_retry_budget_rate"`
+	Sinks                       []SinkConfig           `yaml:"sinks"`
+	SSFAgentAddress             string                 `yaml:"ssf_agent_address"`
+	SSFAgentBatchSize           int                    `yaml:"ssf_agent_batch_size"`
+	StatsAddress                string                 `yaml:"stats_address"`
+	StdoutColor                 bool                   `yaml:"stdout_color"`
+	StdoutEnabled               bool                   `yaml:"stdout_enabled"`
+	StdoutMaxLines              int                    `yaml:"stdout_max_lines"`
+	StripEntityTags             bool                   `yaml:"strip_entity_tags"`
+	TagCardinalityTop           int                    `yaml:"tag_cardinality_top"`
+	TagPrecedence               []string               `yaml:"tag_precedence"`
+	TagTransport                bool                   `yaml:"tag_transport"`
+	Tags                        []string               `yaml:"tags"`
+	TraceAddress                string                 `yaml:"trace_address"`
+	TraceAPIAddress             string                 `yaml:"trace_api_address"`
+	TraceCanaryNextHop          string                 `yaml:"trace_canary_next_hop"`
+	TraceCaptureFile            string                 `yaml:"trace_capture_file"`
+	TraceCaptureMaxFileBytes    int                    `yaml:"trace_capture_max_file_bytes"`
+	TraceCaptureMaxTotalBytes   int                    `yaml:"trace_capture_max_total_bytes"`
+	TraceMaxLengthBytes         int                    `yaml:"trace_max_length_bytes"`
+	TracerMaxSpansPerSecond     float64                `yaml:"tracer_max_spans_per_second"`
+	UdpAddress                  string                 `yaml:"udp_address"`
+	UDPMulticastGroup           string                 `yaml:"udp_multicast_group"`
+	UDPMulticastInterface       string                 `yaml:"udp_multicast_interface"`
+	UDPMulticastJoinOptional    bool                   `yaml:"udp_multicast_join_optional"`
+	WarmupFlushes               int                    `yaml:"warmup_flushes"`
+	ZipkinAddress               string                 `yaml:"zipkin_address"`
+	ZipkinBatchSize             int                    `yaml:"zipkin_batch_size"`
 }
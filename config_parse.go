@@ -1,9 +1,14 @@
 package veneur
 
 import (
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"gopkg.in/yaml.v2"
@@ -11,6 +16,28 @@ import (
 
 const defaultBufferSizeBytes = 1048576 * 2 // 2 MB
 
+// envPrefix is prepended to the upper-cased YAML key of a config option to
+// get the environment variable that overrides it, eg VENEUR_STATS_ADDRESS
+// for stats_address.
+const envPrefix = "VENEUR_"
+
+// redactedValue is what the values of sensitive options are replaced with
+// wherever the config is exposed.
+const redactedValue = "REDACTED"
+
+// sensitiveConfigKeys are the options that hold secrets, by YAML key. This is
+// the one list of them, so any new secret option must be added here to keep
+// it out of logs and /debug/config.
+var sensitiveConfigKeys = map[string]bool{
+	"aws_access_key_id":      true,
+	"aws_secret_access_key":  true,
+	"datadog_shadow_api_key": true,
+	"influx_password":        true,
+	"influx_token":           true,
+	"key":                    true,
+	"sentry_dsn":             true,
+}
+
 // ReadConfig unmarshals the config file and slurps in it's data.
 func ReadConfig(path string) (c Config, err error) {
 	f, err := os.Open(path)
@@ -35,8 +62,18 @@ func readConfig(r io.Reader) (c Config, err error) {
 		return
 	}
 
-	if c.Hostname == "" && !c.OmitEmptyHostname {
-		c.Hostname, _ = os.Hostname()
+	unknown, err := applyEnvironment(&c, os.Environ())
+	if err != nil {
+		return Config{}, err
+	}
+	for _, name := range unknown {
+		// probably a misspelled option, which would otherwise be silently
+		// ignored
+		log.WithField("variable", name).Warn("Environment variable does not match any config option")
+	}
+
+	if c.Hostname, err = resolveHostname(c); err != nil {
+		return Config{}, err
 	}
 
 	if c.ReadBufferSizeBytes == 0 {
@@ -46,6 +83,167 @@ func readConfig(r io.Reader) (c Config, err error) {
 	return c, nil
 }
 
+// resolveHostname returns the hostname to tag metrics with, from the source
+// selected by hostname_source. By default that's the hostname option, or the
+// OS hostname if it's empty (unless omit_empty_hostname is set). Otherwise
+// it's exactly what the source says, which may be empty.
+func resolveHostname(c Config) (string, error) {
+	switch c.HostnameSource {
+	case "", "config":
+		if c.Hostname == "" && !c.OmitEmptyHostname {
+			hostname, _ := os.Hostname()
+			return hostname, nil
+		}
+		return c.Hostname, nil
+	case "os":
+		return os.Hostname()
+	case "env":
+		if c.HostnameEnv == "" {
+			return "", fmt.Errorf("hostname_source is env, but hostname_env is not set")
+		}
+		return os.Getenv(c.HostnameEnv), nil
+	case "file":
+		if c.HostnameFile == "" {
+			return "", fmt.Errorf("hostname_source is file, but hostname_file is not set")
+		}
+		contents, err := ioutil.ReadFile(c.HostnameFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(contents)), nil
+	default:
+		return "", fmt.Errorf("unknown hostname_source %q", c.HostnameSource)
+	}
+}
+
+// applyEnvironment overrides the options in c with any that are set in env
+// (a list of KEY=value strings, as returned by os.Environ). Lists are given
+// as comma-separated values, and maps, structs and lists of them as JSON (or
+// any other YAML), eg VENEUR_SINK_FLUSH_TIMEOUTS='{"datadog": "5s"}'. It
+// returns the names of any variables with the
+// prefix that don't match an option, in sorted order.
+func applyEnvironment(c *Config, env []string) ([]string, error) {
+	vars := make(map[string]string, len(env))
+	for _, kv := range env {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], envPrefix) {
+			vars[parts[0]] = parts[1]
+		}
+	}
+	if len(vars) == 0 {
+		return nil, nil
+	}
+
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		name := envPrefix + strings.ToUpper(key)
+		value, ok := vars[name]
+		if !ok {
+			continue
+		}
+		delete(vars, name)
+		if err := setFromString(v.Field(i), value); err != nil {
+			return nil, fmt.Errorf("invalid value %q for environment variable %s: %s", value, name, err)
+		}
+	}
+
+	var unknown []string
+	for name := range vars {
+		unknown = append(unknown, name)
+	}
+	sort.Strings(unknown)
+	return unknown, nil
+}
+
+// redactConfig returns a copy of c with the value of every sensitive option
+// masked. Options that aren't set are left empty, so that it's still clear
+// that they aren't.
+func redactConfig(c Config) Config {
+	v := reflect.ValueOf(&c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		field := v.Field(i)
+		if sensitiveConfigKeys[key] && field.Kind() == reflect.String && field.String() != "" {
+			field.SetString(redactedValue)
+		}
+	}
+	// what a sink is configured with means nothing to veneur, so any of it
+	// could be a secret
+	if len(c.Sinks) > 0 {
+		sinks := make([]SinkConfig, len(c.Sinks))
+		for i, sink := range c.Sinks {
+			sinks[i] = SinkConfig{Name: sink.Name, Config: make(map[string]string, len(sink.Config))}
+			for key, value := range sink.Config {
+				if value != "" {
+					value = redactedValue
+				}
+				sinks[i].Config[key] = value
+			}
+		}
+		c.Sinks = sinks
+	}
+	return c
+}
+
+func setFromString(field reflect.Value, value string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int:
+		i, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		field.SetInt(int64(i))
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		field.SetBool(b)
+	case reflect.Map, reflect.Struct:
+		return setFromYAML(field, value)
+	case reflect.Slice:
+		if kind := field.Type().Elem().Kind(); kind == reflect.Map || kind == reflect.Struct {
+			return setFromYAML(field, value)
+		}
+		var parts []string
+		if value != "" {
+			parts = strings.Split(value, ",")
+		}
+		slice := reflect.MakeSlice(field.Type(), len(parts), len(parts))
+		for i, part := range parts {
+			if err := setFromString(slice.Index(i), strings.TrimSpace(part)); err != nil {
+				return err
+			}
+		}
+		field.Set(slice)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		field.SetFloat(f)
+	default:
+		return fmt.Errorf("unsupported option type %s", field.Type())
+	}
+	return nil
+}
+
+// setFromYAML replaces field with value parsed as YAML, which JSON is a subset
+// of, so that the same keys as in the config file are used.
+func setFromYAML(field reflect.Value, value string) error {
+	parsed := reflect.New(field.Type())
+	if err := yaml.Unmarshal([]byte(value), parsed.Interface()); err != nil {
+		return err
+	}
+	field.Set(parsed.Elem())
+	return nil
+}
+
 // ParseInterval handles parsing the flush interval as a time.Duration
 func (c Config) ParseInterval() (time.Duration, error) {
 	return time.ParseDuration(c.Interval)
@@ -1,6 +1,7 @@
 package veneur
 
 import (
+	"io/ioutil"
 	"os"
 	"strings"
 	"testing"
@@ -65,3 +66,104 @@ func TestHostname(t *testing.T) {
 		ReadBufferSizeBytes: defaultBufferSizeBytes,
 		OmitEmptyHostname:   true})
 }
+
+func TestConfigEnvironment(t *testing.T) {
+	c := Config{
+		StatsAddress: "localhost:8125",
+		NumWorkers:   96,
+	}
+	unknown, err := applyEnvironment(&c, []string{
+		"VENEUR_STATS_ADDRESS=statsd:8125",
+		"VENEUR_DEBUG=true",
+		"VENEUR_TAGS=a:b, c:d",
+		"VENEUR_PERCENTILES=0.5,0.99",
+		"STATS_ADDRESS=ignored:1",
+		"VENEUR_NOT_AN_OPTION=1",
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"VENEUR_NOT_AN_OPTION"}, unknown, "variables that don't match an option should be reported")
+	assert.Equal(t, "statsd:8125", c.StatsAddress, "environment should take precedence")
+	assert.Equal(t, 96, c.NumWorkers, "options not in the environment should be kept")
+	assert.True(t, c.Debug)
+	assert.Equal(t, []string{"a:b", "c:d"}, c.Tags)
+	assert.Equal(t, []float64{0.5, 0.99}, c.Percentiles)
+
+	_, err = applyEnvironment(&c, []string{"VENEUR_NUM_WORKERS=lots"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "VENEUR_NUM_WORKERS", "error should name the variable")
+}
+
+func TestConfigEnvironmentStructured(t *testing.T) {
+	c := Config{SinkFlushTimeouts: map[string]string{"influxdb": "10s"}}
+	unknown, err := applyEnvironment(&c, []string{
+		`VENEUR_SINK_FLUSH_TIMEOUTS={"datadog": "5s"}`,
+		`VENEUR_HTTP_SINK_POOLS={"datadog": {"max_idle_conns_per_host": 8, "idle_conn_timeout": "2m"}}`,
+		`VENEUR_METRIC_ROUTES=[{"name": "^api\\.", "tags": ["env:prod"], "sinks": ["datadog"]}, {"name": "", "sinks": []}]`,
+		`VENEUR_GAUGE_AGGREGATIONS={"queue.depth": "max"}`,
+		`VENEUR_HISTOGRAM_BUCKETS={"latency": [0.1, 0.5, 1]}`,
+		`VENEUR_FLUSH_TIERS=[{"interval": "60s", "sinks": ["s3"]}]`,
+	})
+	assert.NoError(t, err)
+	assert.Empty(t, unknown)
+	assert.Equal(t, map[string]string{"datadog": "5s"}, c.SinkFlushTimeouts, "maps should be replaced, not merged")
+	assert.Equal(t, map[string]HTTPPool{"datadog": {MaxIdleConnsPerHost: 8, IdleConnTimeout: "2m"}}, c.HTTPSinkPools)
+	assert.Equal(t, []MetricRoute{
+		{Name: `^api\.`, Tags: []string{"env:prod"}, Sinks: []string{"datadog"}},
+		{Sinks: []string{}},
+	}, c.MetricRoutes)
+	assert.Equal(t, map[string]string{"queue.depth": "max"}, c.GaugeAggregations)
+	assert.Equal(t, map[string][]float64{"latency": {0.1, 0.5, 1}}, c.HistogramBuckets)
+	assert.Equal(t, []FlushTier{{Interval: "60s", Sinks: []string{"s3"}}}, c.FlushTiers)
+
+	_, err = applyEnvironment(&c, []string{`VENEUR_HTTP_SINK_POOLS={"datadog": `})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "VENEUR_HTTP_SINK_POOLS")
+}
+
+func TestReadConfigEnvironment(t *testing.T) {
+	os.Setenv("VENEUR_INTERVAL", "30s")
+	defer os.Unsetenv("VENEUR_INTERVAL")
+
+	c, err := readConfig(strings.NewReader("interval: 10s\nhostname: foo"))
+	assert.NoError(t, err)
+	assert.Equal(t, "30s", c.Interval)
+	assert.Equal(t, "foo", c.Hostname)
+}
+
+func TestHostnameSource(t *testing.T) {
+	osHostname, err := os.Hostname()
+	assert.NoError(t, err)
+
+	hostname, err := resolveHostname(Config{HostnameSource: "os", Hostname: "ignored"})
+	assert.NoError(t, err)
+	assert.Equal(t, osHostname, hostname)
+
+	os.Setenv("VENEUR_TEST_NODE_NAME", "node-1")
+	defer os.Unsetenv("VENEUR_TEST_NODE_NAME")
+	hostname, err = resolveHostname(Config{HostnameSource: "env", HostnameEnv: "VENEUR_TEST_NODE_NAME"})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-1", hostname)
+	hostname, err = resolveHostname(Config{HostnameSource: "env", HostnameEnv: "VENEUR_TEST_UNSET"})
+	assert.NoError(t, err)
+	assert.Equal(t, "", hostname, "an unset variable resolves to no hostname, not the OS one")
+	_, err = resolveHostname(Config{HostnameSource: "env"})
+	assert.Error(t, err)
+
+	f, err := ioutil.TempFile("", "veneur-hostname")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString("node-2.example.com\n")
+	f.Close()
+	hostname, err = resolveHostname(Config{HostnameSource: "file", HostnameFile: f.Name()})
+	assert.NoError(t, err)
+	assert.Equal(t, "node-2.example.com", hostname)
+	_, err = resolveHostname(Config{HostnameSource: "file", HostnameFile: f.Name() + ".missing"})
+	assert.Error(t, err)
+
+	_, err = resolveHostname(Config{HostnameSource: "dns"})
+	assert.Error(t, err)
+
+	// readConfig fails if the hostname can't be resolved
+	_, err = readConfig(strings.NewReader("hostname_source: file"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,308 @@
+package veneur
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+)
+
+const (
+	// defaultDeadletterMaxAge is how long a forward that failed is kept for
+	// retrying, if forward_deadletter_max_age is not set
+	defaultDeadletterMaxAge = 15 * time.Minute
+	// defaultDeadletterMaxBytes is how much disk the queue may use, if
+	// forward_deadletter_max_bytes is not set
+	defaultDeadletterMaxBytes = 64 << 20
+
+	deadletterSuffix = ".json"
+	// deadletterTempPrefix starts the names of the files that forwards are
+	// written to before they're renamed into the queue
+	deadletterTempPrefix = "spill"
+)
+
+// deadletterQueue keeps forwards that could not be delivered to the global
+// veneur on disk, so that they can be retried on later flushes. Each one is
+// a file in dir holding the JSON body of the forward, named after the time
+// it was spilled so that they sort oldest first. Once a forward is older
+// than maxAge, or the queue holds more than maxBytes, the oldest are
+// dropped.
+//
+// Counters and gauges are spilled with the time they were forwarded as
+// their timestamp, unless they already had one, so that the global veneur
+// reports them at that time when they are replayed, rather than adding
+// them to the interval they arrive in.
+type deadletterQueue struct {
+	mtx      sync.Mutex
+	dir      string
+	maxAge   time.Duration
+	maxBytes int64
+	// replayTimeout bounds how long each replay spends retrying spilled
+	// forwards, or is 0 if it's unbounded
+	replayTimeout time.Duration
+
+	// swapped out by tests
+	now func() time.Time
+}
+
+type deadletter struct {
+	path    string
+	spilled time.Time
+	size    int64
+}
+
+// newDeadletterQueue creates a queue in dir, removing any forwards that a
+// previous veneur was still writing when it exited.
+func newDeadletterQueue(dir string, maxAge time.Duration, maxBytes int64, replayTimeout time.Duration) (*deadletterQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	orphans, err := filepath.Glob(filepath.Join(dir, deadletterTempPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, orphan := range orphans {
+		if err := os.Remove(orphan); err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	return &deadletterQueue{
+		dir:           dir,
+		maxAge:        maxAge,
+		maxBytes:      maxBytes,
+		replayTimeout: replayTimeout,
+		now:           time.Now,
+	}, nil
+}
+
+// push spills a forward to disk. It returns how many forwards had to be
+// dropped to keep the queue within its bounds, by cause.
+func (q *deadletterQueue) push(metrics []samplers.JSONMetric) (map[string]int, error) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	now := q.now()
+	stamped := make([]samplers.JSONMetric, len(metrics))
+	for i, m := range metrics {
+		if (m.Type == "counter" || m.Type == "gauge") && m.Timestamp == 0 {
+			m.Timestamp = now.Unix()
+		}
+		stamped[i] = m
+	}
+	body, err := json.Marshal(stamped)
+	if err != nil {
+		return nil, err
+	}
+
+	name := fmt.Sprintf("%020d%s", now.UnixNano(), deadletterSuffix)
+	tmp, err := ioutil.TempFile(q.dir, deadletterTempPrefix)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tmp.Write(body)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		// renaming means a half-written file is never replayed
+		err = os.Rename(tmp.Name(), filepath.Join(q.dir, name))
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return q.trim()
+}
+
+// list returns the spilled forwards, oldest first, having dropped any that
+// are out of bounds. The caller must hold mtx.
+func (q *deadletterQueue) list() ([]deadletter, map[string]int, error) {
+	dropped, err := q.trim()
+	if err != nil {
+		return nil, dropped, err
+	}
+	letters, err := q.read()
+	return letters, dropped, err
+}
+
+func (q *deadletterQueue) read() ([]deadletter, error) {
+	letters, _, err := q.scan()
+	return letters, err
+}
+
+// scan returns the spilled forwards, oldest first, and the size of any
+// files that are still being, or failed to be, renamed into the queue.
+func (q *deadletterQueue) scan() ([]deadletter, int64, error) {
+	infos, err := ioutil.ReadDir(q.dir)
+	if err != nil {
+		return nil, 0, err
+	}
+	var letters []deadletter
+	var temp int64
+	for _, info := range infos {
+		name := info.Name()
+		if info.IsDir() {
+			continue
+		}
+		if strings.HasPrefix(name, deadletterTempPrefix) {
+			temp += info.Size()
+			continue
+		}
+		if !strings.HasSuffix(name, deadletterSuffix) {
+			continue
+		}
+		var nanos int64
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, deadletterSuffix), "%d", &nanos); err != nil {
+			continue
+		}
+		letters = append(letters, deadletter{
+			path:    filepath.Join(q.dir, name),
+			spilled: time.Unix(0, nanos),
+			size:    info.Size(),
+		})
+	}
+	// ReadDir sorts by name, which is oldest first
+	return letters, temp, nil
+}
+
+// trim drops forwards older than maxAge, and then the oldest until the
+// queue, including any temporary files in it, fits in maxBytes. The caller
+// must hold mtx.
+func (q *deadletterQueue) trim() (map[string]int, error) {
+	letters, total, err := q.scan()
+	if err != nil {
+		return nil, err
+	}
+	dropped := map[string]int{}
+	for _, l := range letters {
+		total += l.size
+	}
+	for _, l := range letters {
+		cause := ""
+		if q.now().Sub(l.spilled) > q.maxAge {
+			cause = "age"
+		} else if total > q.maxBytes {
+			cause = "size"
+		} else {
+			continue
+		}
+		if err := os.Remove(l.path); err != nil && !os.IsNotExist(err) {
+			return dropped, err
+		}
+		total -= l.size
+		dropped[cause]++
+	}
+	return dropped, nil
+}
+
+// replay retries each spilled forward with post, oldest first, removing the
+// ones that succeed. It stops at the first failure, or once replayTimeout
+// has passed, so that forwards are always delivered in the order they were
+// made, and reports whether the whole queue was delivered. post is given a
+// context that expires with the replayTimeout.
+func (q *deadletterQueue) replay(ctx context.Context, post func(context.Context, []samplers.JSONMetric) error) (replayed int, dropped map[string]int, ok bool) {
+	q.mtx.Lock()
+	defer q.mtx.Unlock()
+
+	if q.replayTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, q.replayTimeout)
+		defer cancel()
+	}
+
+	letters, dropped, err := q.list()
+	if err != nil {
+		log.WithError(err).Error("Could not list spilled forwards")
+		return 0, dropped, false
+	}
+	for i, l := range letters {
+		if ctx.Err() != nil {
+			log.WithField("forwards", len(letters)-i).Warn("Ran out of time replaying spilled forwards")
+			return replayed, dropped, false
+		}
+		body, err := ioutil.ReadFile(l.path)
+		if err != nil {
+			log.WithError(err).WithField("path", l.path).Error("Could not read spilled forward")
+			return replayed, dropped, false
+		}
+		var metrics []samplers.JSONMetric
+		if err := json.Unmarshal(body, &metrics); err != nil {
+			// retrying won't help, so get it out of the way
+			log.WithError(err).WithField("path", l.path).Error("Dropping corrupt spilled forward")
+			os.Remove(l.path)
+			dropped["corrupt"]++
+			continue
+		}
+		if err := post(ctx, metrics); err != nil {
+			return replayed, dropped, false
+		}
+		os.Remove(l.path)
+		replayed++
+	}
+	return replayed, dropped, true
+}
+
+// forwardWithDeadletters forwards metrics, first retrying any forwards that
+// were spilled because they failed, and spilling this one if it fails too.
+// If the spilled forwards can't all be delivered, this one is spilled
+// without being tried, to keep them in order.
+func (s *Server) forwardWithDeadletters(ctx context.Context, endpoint string, metrics []samplers.JSONMetric) error {
+	post := func(ctx context.Context, metrics []samplers.JSONMetric) error {
+		return s.postHelper(ctx, endpoint, metrics, "forward", s.sinkEncoding(forwardSinkName))
+	}
+
+	replayed, dropped, ok := s.deadletters.replay(ctx, post)
+	s.countDeadlettersDropped(dropped)
+	if replayed > 0 {
+		s.statsd.Count("forward.deadletter_replayed_total", int64(replayed), nil, 1.0)
+		log.WithField("forwards", replayed).Info("Replayed spilled forwards to upstream Veneur")
+	}
+
+	var err error
+	if ok {
+		if err = post(ctx, metrics); err == nil {
+			return nil
+		}
+	} else {
+		err = errors.New("upstream Veneur is still unreachable")
+	}
+
+	dropped, spillErr := s.deadletters.push(metrics)
+	s.countDeadlettersDropped(dropped)
+	if spillErr != nil {
+		s.statsd.Count("forward.deadletter_dropped_total", 1, []string{"cause:spill"}, 1.0)
+		log.WithError(spillErr).Error("Could not spill forward to disk")
+		return err
+	}
+	s.statsd.Count("forward.deadletter_spilled_total", 1, nil, 1.0)
+	log.WithFields(logrus.Fields{
+		logrus.ErrorKey: err,
+		"metrics":       len(metrics),
+	}).Warn("Spilled forward to disk for retrying")
+	return err
+}
+
+func (s *Server) countDeadlettersDropped(dropped map[string]int) {
+	causes := make([]string, 0, len(dropped))
+	for cause := range dropped {
+		causes = append(causes, cause)
+	}
+	sort.Strings(causes)
+	for _, cause := range causes {
+		s.statsd.Count("forward.deadletter_dropped_total", int64(dropped[cause]), []string{"cause:" + cause}, 1.0)
+		log.WithFields(logrus.Fields{
+			"forwards": dropped[cause],
+			"cause":    cause,
+		}).Warn("Dropped spilled forwards")
+	}
+}
@@ -0,0 +1,286 @@
+package veneur
+
+import (
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func newTestDeadletterQueue(t *testing.T, maxAge time.Duration, maxBytes int64) (*deadletterQueue, func()) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	assert.NoError(t, err)
+	q, err := newDeadletterQueue(dir, maxAge, maxBytes, 0)
+	assert.NoError(t, err)
+	return q, func() { os.RemoveAll(dir) }
+}
+
+func deadletterMetrics(name string) []samplers.JSONMetric {
+	return []samplers.JSONMetric{{
+		MetricKey: samplers.MetricKey{Name: name, Type: "histogram"},
+		Value:     []byte("value"),
+	}}
+}
+
+func TestDeadletterReplayOrder(t *testing.T) {
+	q, cleanup := newTestDeadletterQueue(t, time.Hour, 1<<20)
+	defer cleanup()
+
+	start := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		q.now = func() time.Time { return start.Add(time.Duration(i) * time.Second) }
+		dropped, err := q.push(deadletterMetrics(name))
+		assert.NoError(t, err)
+		assert.Empty(t, dropped)
+	}
+
+	var names []string
+	replayed, dropped, ok := q.replay(context.Background(), func(_ context.Context, metrics []samplers.JSONMetric) error {
+		names = append(names, metrics[0].Name)
+		return nil
+	})
+	assert.True(t, ok)
+	assert.Empty(t, dropped)
+	assert.Equal(t, 3, replayed)
+	assert.Equal(t, []string{"a", "b", "c"}, names)
+
+	letters, err := q.read()
+	assert.NoError(t, err)
+	assert.Empty(t, letters, "replayed forwards should be removed")
+}
+
+func TestDeadletterReplayStopsAtFailure(t *testing.T) {
+	q, cleanup := newTestDeadletterQueue(t, time.Hour, 1<<20)
+	defer cleanup()
+
+	start := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		q.now = func() time.Time { return start.Add(time.Duration(i) * time.Second) }
+		_, err := q.push(deadletterMetrics(name))
+		assert.NoError(t, err)
+	}
+
+	var names []string
+	replayed, _, ok := q.replay(context.Background(), func(_ context.Context, metrics []samplers.JSONMetric) error {
+		names = append(names, metrics[0].Name)
+		if metrics[0].Name == "b" {
+			return errors.New("unreachable")
+		}
+		return nil
+	})
+	assert.False(t, ok)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, []string{"a", "b"}, names, "should not try c after b failed")
+
+	letters, err := q.read()
+	assert.NoError(t, err)
+	assert.Len(t, letters, 2, "b and c should still be queued")
+}
+
+func TestDeadletterBounds(t *testing.T) {
+	q, cleanup := newTestDeadletterQueue(t, time.Minute, 1<<20)
+	defer cleanup()
+
+	start := time.Now()
+	q.now = func() time.Time { return start }
+	_, err := q.push(deadletterMetrics("m1"))
+	assert.NoError(t, err)
+
+	q.now = func() time.Time { return start.Add(2 * time.Minute) }
+	dropped, err := q.push(deadletterMetrics("m2"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"age": 1}, dropped)
+
+	letters, err := q.read()
+	assert.NoError(t, err)
+	if assert.Len(t, letters, 1) {
+		q.maxBytes = letters[0].size
+	}
+
+	// a second forward puts the queue over maxBytes, so the oldest goes
+	q.now = func() time.Time { return start.Add(2*time.Minute + time.Second) }
+	dropped, err = q.push(deadletterMetrics("m3"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"size": 1}, dropped)
+
+	var names []string
+	_, _, ok := q.replay(context.Background(), func(_ context.Context, metrics []samplers.JSONMetric) error {
+		names = append(names, metrics[0].Name)
+		return nil
+	})
+	assert.True(t, ok)
+	assert.Equal(t, []string{"m3"}, names)
+}
+
+func TestDeadletterReplayTimeout(t *testing.T) {
+	q, cleanup := newTestDeadletterQueue(t, time.Hour, 1<<20)
+	defer cleanup()
+	q.replayTimeout = 10 * time.Millisecond
+
+	start := time.Now()
+	for i, name := range []string{"a", "b", "c"} {
+		q.now = func() time.Time { return start.Add(time.Duration(i) * time.Second) }
+		_, err := q.push(deadletterMetrics(name))
+		assert.NoError(t, err)
+	}
+
+	var names []string
+	replayed, _, ok := q.replay(context.Background(), func(ctx context.Context, metrics []samplers.JSONMetric) error {
+		names = append(names, metrics[0].Name)
+		// an upstream that hangs until the replay runs out of time
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.False(t, ok)
+	assert.Equal(t, 0, replayed)
+	assert.Equal(t, []string{"a"}, names, "nothing more should be tried once the replay is out of time")
+
+	letters, err := q.read()
+	assert.NoError(t, err)
+	assert.Len(t, letters, 3)
+}
+
+func TestDeadletterTempFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	orphan := filepath.Join(dir, deadletterTempPrefix+"123")
+	assert.NoError(t, ioutil.WriteFile(orphan, []byte("half a forw"), 0644))
+
+	q, err := newDeadletterQueue(dir, time.Hour, 1<<20, 0)
+	assert.NoError(t, err)
+	_, err = os.Stat(orphan)
+	assert.True(t, os.IsNotExist(err), "files left half-written by a previous veneur should be removed")
+
+	_, err = q.push(deadletterMetrics("a"))
+	assert.NoError(t, err)
+	letters, err := q.read()
+	assert.NoError(t, err)
+	if !assert.Len(t, letters, 1) {
+		return
+	}
+
+	// a temp file that couldn't be removed still takes up space
+	assert.NoError(t, ioutil.WriteFile(orphan, []byte("x"), 0644))
+	q.maxBytes = letters[0].size
+	dropped, err := q.trim()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]int{"size": 1}, dropped)
+}
+
+func TestDeadletterTimestamps(t *testing.T) {
+	q, cleanup := newTestDeadletterQueue(t, time.Hour, 1<<20)
+	defer cleanup()
+
+	spilled := time.Unix(1500000000, 0)
+	q.now = func() time.Time { return spilled }
+	metrics := []samplers.JSONMetric{
+		{MetricKey: samplers.MetricKey{Name: "requests", Type: "counter"}},
+		{MetricKey: samplers.MetricKey{Name: "backfilled", Type: "counter", Timestamp: 1400000000}},
+		{MetricKey: samplers.MetricKey{Name: "queue_depth", Type: "gauge"}},
+		{MetricKey: samplers.MetricKey{Name: "latency", Type: "histogram"}},
+	}
+	_, err := q.push(metrics)
+	assert.NoError(t, err)
+	assert.Zero(t, metrics[0].Timestamp, "the caller's metrics shouldn't be changed")
+
+	timestamps := map[string]int64{}
+	_, _, ok := q.replay(context.Background(), func(_ context.Context, metrics []samplers.JSONMetric) error {
+		for _, m := range metrics {
+			timestamps[m.Name] = m.Timestamp
+		}
+		return nil
+	})
+	assert.True(t, ok)
+	assert.Equal(t, map[string]int64{
+		"requests":    1500000000,
+		"backfilled":  1400000000,
+		"queue_depth": 1500000000,
+		"latency":     0,
+	}, timestamps, "counters and gauges should be reported when they were forwarded")
+}
+
+func TestDeadletterCorrupt(t *testing.T) {
+	q, cleanup := newTestDeadletterQueue(t, time.Hour, 1<<20)
+	defer cleanup()
+
+	now := time.Now()
+	q.now = func() time.Time { return now }
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(q.dir, "00000000000000000001.json"), []byte("{"), 0644))
+	// corrupt files are older than anything pushed, so replay them first
+	q.maxAge = now.Sub(time.Unix(0, 0)) + time.Hour
+	_, err := q.push(deadletterMetrics("a"))
+	assert.NoError(t, err)
+
+	var names []string
+	replayed, dropped, ok := q.replay(context.Background(), func(_ context.Context, metrics []samplers.JSONMetric) error {
+		names = append(names, metrics[0].Name)
+		return nil
+	})
+	assert.True(t, ok)
+	assert.Equal(t, 1, replayed)
+	assert.Equal(t, map[string]int{"corrupt": 1}, dropped)
+	assert.Equal(t, []string{"a"}, names)
+}
+
+func TestForwardWithDeadletters(t *testing.T) {
+	var up int32
+	imported := make(chan string, 10)
+	globalVeneur := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&up) == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		zr, err := zlib.NewReader(r.Body)
+		assert.NoError(t, err)
+		var metrics []samplers.JSONMetric
+		assert.NoError(t, json.NewDecoder(zr).Decode(&metrics))
+		for _, m := range metrics {
+			imported <- m.Name
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer globalVeneur.Close()
+
+	q, cleanup := newTestDeadletterQueue(t, time.Hour, 1<<20)
+	defer cleanup()
+	s := &Server{
+		HTTPClient:  &http.Client{},
+		deadletters: q,
+	}
+	endpoint := globalVeneur.URL + "/import"
+
+	start := time.Now()
+	q.now = func() time.Time { return start }
+	assert.Error(t, s.forwardWithDeadletters(context.Background(), endpoint, deadletterMetrics("a")))
+	q.now = func() time.Time { return start.Add(time.Second) }
+	assert.Error(t, s.forwardWithDeadletters(context.Background(), endpoint, deadletterMetrics("b")))
+	letters, err := q.read()
+	assert.NoError(t, err)
+	assert.Len(t, letters, 2, "both failed forwards should be spilled")
+
+	atomic.StoreInt32(&up, 1)
+	q.now = func() time.Time { return start.Add(2 * time.Second) }
+	assert.NoError(t, s.forwardWithDeadletters(context.Background(), endpoint, deadletterMetrics("c")))
+	close(imported)
+	var names []string
+	for name := range imported {
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"a", "b", "c"}, names, "spilled forwards should be delivered first, in order")
+
+	letters, err = q.read()
+	assert.NoError(t, err)
+	assert.Empty(t, letters)
+}
@@ -0,0 +1,50 @@
+package veneur
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"gopkg.in/yaml.v2"
+)
+
+// handleDebugConfig responds with the config that the server is running
+// with, after environment variables have been applied and with secrets
+// redacted, as JSON keyed the same way as the config file.
+func (s *Server) handleDebugConfig(w http.ResponseWriter, r *http.Request) {
+	// round-tripping through YAML gives every option, including nested
+	// ones, the key it has in the config file
+	bts, err := yaml.Marshal(s.config)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var config interface{}
+	if err := yaml.Unmarshal(bts, &config); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(jsonCompatible(config))
+}
+
+// jsonCompatible converts the maps that the YAML decoder produces, which are
+// keyed by interface{}, into maps that encoding/json can marshal.
+func jsonCompatible(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, value := range v {
+			m[fmt.Sprint(k)] = jsonCompatible(value)
+		}
+		return m
+	case []interface{}:
+		for i, value := range v {
+			v[i] = jsonCompatible(value)
+		}
+		return v
+	default:
+		return v
+	}
+}
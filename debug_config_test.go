@@ -0,0 +1,54 @@
+package veneur
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleDebugConfig(t *testing.T) {
+	config := localConfig()
+	config.Key = "hunter2"
+	config.InfluxToken = "swordfish"
+	config.MetricRoutes = []MetricRoute{{Name: "^security\\.", Sinks: []string{"scrape"}}}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/config", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.NotContains(t, w.Body.String(), "hunter2")
+	assert.NotContains(t, w.Body.String(), "swordfish")
+
+	var effective map[string]interface{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&effective))
+	assert.Equal(t, redactedValue, effective["key"])
+	assert.Equal(t, redactedValue, effective["influx_token"])
+	assert.Equal(t, "", effective["sentry_dsn"], "unset secrets should stay visibly unset")
+	assert.Equal(t, config.UdpAddress, effective["udp_address"])
+	assert.Equal(t, []interface{}{map[string]interface{}{
+		"name":  "^security\\.",
+		"tags":  []interface{}{},
+		"sinks": []interface{}{"scrape"},
+	}}, effective["metric_routes"], "nested options should be keyed as in the config file")
+
+	assert.Equal(t, "hunter2", s.DDAPIKey, "redaction shouldn't affect the server itself")
+}
+
+func TestSensitiveConfigKeys(t *testing.T) {
+	keys := map[string]reflect.Kind{}
+	typ := reflect.TypeOf(Config{})
+	for i := 0; i < typ.NumField(); i++ {
+		keys[strings.Split(typ.Field(i).Tag.Get("yaml"), ",")[0]] = typ.Field(i).Type.Kind()
+	}
+	for key := range sensitiveConfigKeys {
+		kind, ok := keys[key]
+		assert.True(t, ok, "%s is not a config option", key)
+		assert.Equal(t, reflect.String, kind, "only string options can be redacted, but %s isn't one", key)
+	}
+}
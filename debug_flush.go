@@ -0,0 +1,70 @@
+package veneur
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// flushDebugResponse is the body returned by /debug/flush. Durations are
+// formatted like the interval option, eg "1.5s".
+type flushDebugResponse struct {
+	Interval string `json:"interval"`
+	Overrun  string `json:"overrun"`
+	Running  bool   `json:"running"`
+	// when the latest flush to finish started, and how long it took
+	LastFlush         *time.Time `json:"last_flush,omitempty"`
+	LastFlushDuration string     `json:"last_flush_duration,omitempty"`
+	NextFlush         *time.Time `json:"next_flush,omitempty"`
+	// the latest flush to each sink, by sink name
+	Sinks map[string]sinkFlushDebug `json:"sinks"`
+}
+
+type sinkFlushDebug struct {
+	LastFlush time.Time `json:"last_flush"`
+	Duration  string    `json:"duration"`
+	Error     string    `json:"error,omitempty"`
+	// the sink's circuit was open, so it wasn't flushed to
+	Skipped bool `json:"skipped,omitempty"`
+}
+
+// debugState returns the scheduler's state, for /debug/flush.
+func (fs *flushScheduler) debugState() flushDebugResponse {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	resp := flushDebugResponse{
+		Interval: fs.interval.String(),
+		Overrun:  fs.mode,
+		Running:  fs.running,
+		Sinks:    make(map[string]sinkFlushDebug, len(fs.sinks)),
+	}
+	if !fs.lastFlush.IsZero() {
+		lastFlush := fs.lastFlush
+		resp.LastFlush = &lastFlush
+		resp.LastFlushDuration = fs.lastFlushDuration.String()
+	}
+	if next := fs.nextFlush(); !next.IsZero() {
+		resp.NextFlush = &next
+	}
+	for sink, timing := range fs.sinks {
+		debug := sinkFlushDebug{
+			LastFlush: timing.start,
+			Duration:  timing.duration.String(),
+			Skipped:   timing.skipped,
+		}
+		if timing.err != nil {
+			debug.Error = timing.err.Error()
+		}
+		resp.Sinks[sink] = debug
+	}
+	return resp
+}
+
+// handleDebugFlush responds with when the server last flushed and will next
+// flush, and how long its latest flush to each sink took, eg
+// GET /debug/flush
+func (s *Server) handleDebugFlush(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.flushScheduler.debugState())
+}
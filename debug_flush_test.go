@@ -0,0 +1,69 @@
+package veneur
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleDebugFlush(t *testing.T) {
+	config := localConfig()
+	config.FlushOverrun = flushOverrunQueue
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+
+	getDebugFlush := func() flushDebugResponse {
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/flush", nil))
+		assert.Equal(t, http.StatusOK, w.Code)
+		var resp flushDebugResponse
+		assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		return resp
+	}
+
+	resp := getDebugFlush()
+	assert.Equal(t, s.interval.String(), resp.Interval)
+	assert.Equal(t, flushOverrunQueue, resp.Overrun)
+	assert.Nil(t, resp.LastFlush, "nothing has been flushed yet")
+	assert.Nil(t, resp.NextFlush, "the ticker hasn't been started")
+	assert.Empty(t, resp.Sinks)
+
+	now := time.Date(2017, 3, 1, 12, 0, 0, 0, time.UTC)
+	fs := s.flushScheduler
+	fs.now = func() time.Time { return now }
+	fs.started = now.Add(-time.Minute)
+	// a flush that started on the last tick and took a second
+	fs.flush = func() { now = now.Add(time.Second) }
+	fs.tick()
+	fs.mutex.Lock()
+	for fs.running {
+		fs.mutex.Unlock()
+		time.Sleep(time.Millisecond)
+		fs.mutex.Lock()
+	}
+	fs.mutex.Unlock()
+
+	s.flushSink(context.Background(), datadogSinkName, func(context.Context) error {
+		return errors.New("boom")
+	})
+
+	resp = getDebugFlush()
+	if assert.NotNil(t, resp.LastFlush) {
+		assert.True(t, resp.LastFlush.Equal(now.Add(-time.Second)))
+	}
+	assert.Equal(t, "1s", resp.LastFlushDuration)
+	if assert.NotNil(t, resp.NextFlush) {
+		assert.True(t, resp.NextFlush.Equal(now.Add(-time.Second).Add(s.interval)), "the next flush is an interval after the last tick")
+	}
+	assert.False(t, resp.Running)
+	if assert.Contains(t, resp.Sinks, datadogSinkName) {
+		assert.Equal(t, "boom", resp.Sinks[datadogSinkName].Error)
+		assert.False(t, resp.Sinks[datadogSinkName].Skipped)
+	}
+}
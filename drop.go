@@ -0,0 +1,118 @@
+package veneur
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// MetricDropRule drops the metrics that have every one of its Tags as they
+// are received, before they are aggregated. A tag is either a key:value pair,
+// or a bare key, which matches that key with any value. Name identifies the
+// rule in the count of the metrics it dropped.
+type MetricDropRule struct {
+	Name string   `yaml:"name"`
+	Tags []string `yaml:"tags"`
+}
+
+// metricDropper holds the drop rules. A metric is dropped if any of them
+// matches. Since it checks every metric received, matching is just string
+// comparisons against the metric's tags.
+//
+// A nil *metricDropper drops nothing.
+type metricDropper struct {
+	rules []dropRule
+}
+
+type dropRule struct {
+	name string
+	// exact tags, and the prefixes (key plus colon) of keys that match any
+	// value
+	tags     []string
+	prefixes []string
+	// the tags that are bare keys, which also match with no value at all
+	keys []string
+}
+
+func newMetricDropper(rules []MetricDropRule) (*metricDropper, error) {
+	if len(rules) == 0 {
+		return nil, nil
+	}
+	d := &metricDropper{}
+	for i, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("metric drop rule %d has no name", i)
+		}
+		if len(rule.Tags) == 0 {
+			return nil, fmt.Errorf("metric drop rule %q has no tags, so it would drop every metric", rule.Name)
+		}
+		dr := dropRule{name: rule.Name}
+		for _, tag := range rule.Tags {
+			if strings.IndexByte(tag, ':') == -1 {
+				dr.keys = append(dr.keys, tag)
+				dr.prefixes = append(dr.prefixes, tag+":")
+			} else {
+				dr.tags = append(dr.tags, tag)
+			}
+		}
+		d.rules = append(d.rules, dr)
+	}
+	return d, nil
+}
+
+// match returns the name of the first rule that matches the tags, and
+// whether one did.
+func (d *metricDropper) match(tags []string) (string, bool) {
+	if d == nil {
+		return "", false
+	}
+	for _, rule := range d.rules {
+		if rule.matches(tags) {
+			return rule.name, true
+		}
+	}
+	return "", false
+}
+
+func (rule dropRule) matches(tags []string) bool {
+	for _, want := range rule.tags {
+		if !hasTag(tags, want) {
+			return false
+		}
+	}
+	for i, prefix := range rule.prefixes {
+		if !hasTagKey(tags, rule.keys[i], prefix) {
+			return false
+		}
+	}
+	return true
+}
+
+func hasTag(tags []string, want string) bool {
+	for _, tag := range tags {
+		if tag == want {
+			return true
+		}
+	}
+	return false
+}
+
+func hasTagKey(tags []string, key, prefix string) bool {
+	for _, tag := range tags {
+		if tag == key || strings.HasPrefix(tag, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// dropMetrics reports whether metrics that were just received, which share
+// the same tags, match one of the drop rules, and counts them if so.
+func (s *Server) dropMetrics(metrics []*samplers.UDPMetric) bool {
+	rule, ok := s.dropper.match(metrics[0].Tags)
+	if ok {
+		s.statsd.Count("ingest.metrics_dropped_total", int64(len(metrics)), []string{"cause:drop_rule", "rule:" + rule}, 1.0)
+	}
+	return ok
+}
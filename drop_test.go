@@ -0,0 +1,96 @@
+package veneur
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestMetricDropper(t *testing.T) {
+	d, err := newMetricDropper([]MetricDropRule{
+		{Name: "debug", Tags: []string{"debug:true"}},
+		{Name: "canary_scratch", Tags: []string{"canary", "env:scratch"}},
+	})
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		tags []string
+		rule string
+	}{
+		{[]string{"debug:true"}, "debug"},
+		{[]string{"env:prod", "debug:true"}, "debug"},
+		{[]string{"canary:7", "env:scratch"}, "canary_scratch"},
+		{[]string{"canary", "env:scratch"}, "canary_scratch"},
+		{[]string{"canary:7", "debug:true", "env:scratch"}, "debug"},
+	} {
+		rule, ok := d.match(tc.tags)
+		assert.True(t, ok, "%v should be dropped", tc.tags)
+		assert.Equal(t, tc.rule, rule, "%v should be dropped by the first rule that matches", tc.tags)
+	}
+
+	for _, tags := range [][]string{
+		nil,
+		{"debug:false"},
+		{"debug"},
+		{"debug:true2"},
+		{"canary:7"},
+		{"canary_id:7", "env:scratch"},
+		{"env:scratch"},
+	} {
+		_, ok := d.match(tags)
+		assert.False(t, ok, "%v should not be dropped", tags)
+	}
+
+	var nilDropper *metricDropper
+	_, ok := nilDropper.match([]string{"debug:true"})
+	assert.False(t, ok)
+}
+
+func TestMetricDropperConfig(t *testing.T) {
+	d, err := newMetricDropper(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, d)
+
+	_, err = newMetricDropper([]MetricDropRule{{Tags: []string{"debug:true"}}})
+	assert.Error(t, err, "rules need a name to be counted by")
+	_, err = newMetricDropper([]MetricDropRule{{Name: "everything"}})
+	assert.Error(t, err, "a rule with no tags would drop everything")
+
+	config := localConfig()
+	config.MetricDropRules = []MetricDropRule{{Name: "everything"}}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestHandleMetricPacketDrops(t *testing.T) {
+	dropper, err := newMetricDropper([]MetricDropRule{{Name: "debug", Tags: []string{"debug:true"}}})
+	assert.NoError(t, err)
+	s := &Server{
+		Workers: []*Worker{NewWorker(1, nil, logrus.New())},
+		dropper: dropper,
+	}
+	received := make(chan samplers.UDPMetric, 10)
+	go func() {
+		for m := range s.Workers[0].PacketChan {
+			received <- m
+		}
+	}()
+
+	s.HandleMetricPacket([]byte("a.b.c:1:2|c|#debug:true"))
+	s.HandleMetricPacket([]byte("a.b.c:3|c|#debug:false"))
+
+	select {
+	case m := <-received:
+		assert.Equal(t, []string{"debug:false"}, m.Tags)
+	case <-time.After(time.Second):
+		assert.FailNow(t, "expected a metric at the worker")
+	}
+	select {
+	case m := <-received:
+		assert.Fail(t, "a dropped metric reached the worker", "%v", m)
+	case <-time.After(10 * time.Millisecond):
+	}
+}
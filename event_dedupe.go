@@ -0,0 +1,97 @@
+package veneur
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// defaultEventDedupeMaxKeys is how many distinct events are tracked for
+// de-duplication in each flush window, unless event_dedupe_max_keys is set.
+const defaultEventDedupeMaxKeys = 10000
+
+// eventDedupe collapses the identical events an EventWorker receives within
+// a flush window, like the same deploy event sent by every pod, into the
+// first of them. Events are identical if they have the same title and tags;
+// their text, host and timestamp may differ, and the first one's are kept.
+// Only the first maxKeys distinct events in a window are tracked, so that
+// memory stays bounded; any others pass through as they are.
+type eventDedupe struct {
+	maxKeys int
+	// if set, the text of an event that others were collapsed into says
+	// how many there were
+	annotate bool
+
+	// for each distinct event in the window, where it is in the worker's
+	// events and how many times it was received
+	seen map[string]*dedupedEvent
+	// how many events were collapsed in the window
+	collapsed int64
+}
+
+type dedupedEvent struct {
+	index int
+	count int
+}
+
+func newEventDedupe(maxKeys int, annotate bool) *eventDedupe {
+	if maxKeys <= 0 {
+		maxKeys = defaultEventDedupeMaxKeys
+	}
+	return &eventDedupe{maxKeys: maxKeys, annotate: annotate, seen: map[string]*dedupedEvent{}}
+}
+
+// eventKey is what identical events have in common: their title and their
+// tags, in any order.
+func eventKey(evt samplers.UDPEvent) string {
+	tags := append([]string(nil), evt.Tags...)
+	sort.Strings(tags)
+	return evt.Title + "\x00" + strings.Join(tags, ",")
+}
+
+// duplicate reports whether evt is identical to one already received in the
+// window, in which case it's counted against that one and should be
+// dropped. Otherwise it's remembered as being at index in the worker's
+// events, if there's room.
+func (d *eventDedupe) duplicate(evt samplers.UDPEvent, index int) bool {
+	key := eventKey(evt)
+	if first, ok := d.seen[key]; ok {
+		first.count++
+		d.collapsed++
+		return true
+	}
+	if len(d.seen) < d.maxKeys {
+		d.seen[key] = &dedupedEvent{index: index, count: 1}
+	}
+	return false
+}
+
+// finish ends the window whose events are being flushed, annotating those
+// that others were collapsed into if need be, and returns how many events
+// were collapsed.
+func (d *eventDedupe) finish(events []samplers.UDPEvent) int64 {
+	if d.annotate {
+		for _, first := range d.seen {
+			if first.count > 1 {
+				evt := &events[first.index]
+				evt.Text = annotateEventCount(evt.Text, first.count)
+			}
+		}
+	}
+	collapsed := d.collapsed
+	d.seen = map[string]*dedupedEvent{}
+	d.collapsed = 0
+	return collapsed
+}
+
+// annotateEventCount appends how many identical events an event stands for
+// to its text.
+func annotateEventCount(text string, count int) string {
+	annotation := fmt.Sprintf("(aggregated from %d identical events)", count)
+	if text == "" {
+		return annotation
+	}
+	return text + "\n\n" + annotation
+}
@@ -0,0 +1,83 @@
+package veneur
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestEventKey(t *testing.T) {
+	deploy := samplers.UDPEvent{Title: "deploy", Text: "pod a", Hostname: "a", Tags: []string{"service:web", "env:prod"}}
+	same := samplers.UDPEvent{Title: "deploy", Text: "pod b", Hostname: "b", Tags: []string{"env:prod", "service:web"}}
+	assert.Equal(t, eventKey(deploy), eventKey(same), "text, host and tag order don't matter")
+
+	assert.NotEqual(t, eventKey(deploy), eventKey(samplers.UDPEvent{Title: "rollback", Tags: deploy.Tags}))
+	assert.NotEqual(t, eventKey(deploy), eventKey(samplers.UDPEvent{Title: "deploy", Tags: []string{"service:web"}}))
+}
+
+func TestEventWorkerDedupe(t *testing.T) {
+	ew := NewEventWorker(nil)
+	ew.dedupe = newEventDedupe(2, true)
+	go ew.Work()
+
+	for _, evt := range []samplers.UDPEvent{
+		{Title: "deploy", Text: "deployed web", Timestamp: 100, Hostname: "a", Tags: []string{"service:web"}},
+		{Title: "deploy", Text: "deployed web", Timestamp: 101, Hostname: "b", Tags: []string{"service:web"}},
+		{Title: "oom", Hostname: "a"},
+		{Title: "deploy", Text: "deployed web", Timestamp: 102, Hostname: "c", Tags: []string{"service:web"}},
+		// past the limit of 2 distinct events, they aren't de-duplicated
+		{Title: "restart", Hostname: "a"},
+		{Title: "restart", Hostname: "b"},
+		{Title: "oom", Hostname: "b"},
+	} {
+		ew.EventChan <- evt
+	}
+	// an unbuffered send doesn't wait for the previous event to be
+	// stored, so send a check to make sure they all have been
+	ew.ServiceCheckChan <- samplers.UDPServiceCheck{}
+
+	events, _ := ew.Flush()
+	assert.Equal(t, []samplers.UDPEvent{
+		{
+			Title:     "deploy",
+			Text:      "deployed web\n\n(aggregated from 3 identical events)",
+			Timestamp: 100,
+			Hostname:  "a",
+			Tags:      []string{"service:web"},
+		},
+		{Title: "oom", Text: "(aggregated from 2 identical events)", Hostname: "a"},
+		{Title: "restart", Hostname: "a"},
+		{Title: "restart", Hostname: "b"},
+	}, events)
+
+	// the next window starts afresh
+	ew.EventChan <- samplers.UDPEvent{Title: "deploy", Tags: []string{"service:web"}}
+	ew.ServiceCheckChan <- samplers.UDPServiceCheck{}
+	events, _ = ew.Flush()
+	assert.Equal(t, []samplers.UDPEvent{{Title: "deploy", Tags: []string{"service:web"}}}, events)
+}
+
+func TestEventWorkerNoDedupe(t *testing.T) {
+	ew := NewEventWorker(nil)
+	go ew.Work()
+	for i := 0; i < 2; i++ {
+		ew.EventChan <- samplers.UDPEvent{Title: "deploy"}
+	}
+	ew.ServiceCheckChan <- samplers.UDPServiceCheck{}
+	events, _ := ew.Flush()
+	assert.Len(t, events, 2, "identical events are only collapsed with event_dedupe")
+}
+
+func TestEventDedupeConfig(t *testing.T) {
+	config := localConfig()
+	config.EventDedupe = true
+	s, err := NewFromConfig(config)
+	if assert.NoError(t, err) && assert.NotNil(t, s.EventWorker.dedupe) {
+		assert.Equal(t, defaultEventDedupeMaxKeys, s.EventWorker.dedupe.maxKeys)
+		assert.False(t, s.EventWorker.dedupe.annotate)
+	}
+	config.EventDedupeMaxKeys = -1
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+}
@@ -0,0 +1,148 @@
+package veneur
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"sync"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// metricSizes returns the length of each metric's JSON, measured across
+// workers goroutines that each encode a contiguous part of metrics. The
+// encoded metrics aren't kept, so that a flush never holds all of them in
+// memory at once. Callers skip metrics that can't be encoded before
+// measuring them, so a metric that can't be has a size of 0.
+func metricSizes(metrics []samplers.DDMetric, workers int) []int {
+	sizes := make([]int, len(metrics))
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(metrics) {
+		workers = len(metrics)
+	}
+	if workers == 0 {
+		return sizes
+	}
+	partSize := (len(metrics)-1)/workers + 1
+	var wg sync.WaitGroup
+	for start := 0; start < len(metrics); start += partSize {
+		end := start + partSize
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+		wg.Add(1)
+		go func(start, end int) {
+			defer wg.Done()
+			for i := start; i < end; i++ {
+				if encoded, err := json.Marshal(metrics[i]); err == nil {
+					sizes[i] = len(encoded)
+				}
+			}
+		}(start, end)
+	}
+	wg.Wait()
+	return sizes
+}
+
+// chunkBounds breaks metrics, whose encoded sizes are given, into chunks of
+// approximately equal size, such that each chunk has no more than
+// maxPerBody metrics. If maxBytes is positive, chunks are split further so
+// that each one's body is no more than maxBytes long, before compression. A
+// metric that is too big on its own still gets a chunk to itself, rather
+// than being dropped. Each chunk is returned as the indexes of its first
+// metric and the one after its last.
+func chunkBounds(sizes []int, maxPerBody, maxBytes int) [][2]int {
+	// we compute the chunks using rounding-up integer division
+	workers := ((len(sizes) - 1) / maxPerBody) + 1
+	chunkSize := ((len(sizes) - 1) / workers) + 1
+	chunks := make([][2]int, 0, workers)
+	for i := 0; i < workers; i++ {
+		chunkStart := i * chunkSize
+		chunkEnd := len(sizes)
+		if i < workers-1 {
+			// trim to chunk size unless this is the last one
+			chunkEnd = chunkStart + chunkSize
+		}
+		if maxBytes <= 0 {
+			chunks = append(chunks, [2]int{chunkStart, chunkEnd})
+			continue
+		}
+
+		start, size := chunkStart, seriesEnvelopeBytes
+		for j := chunkStart; j < chunkEnd; j++ {
+			metricSize := sizes[j]
+			if j > start {
+				// the comma between it and the previous metric
+				metricSize++
+			}
+			if j > start && size+metricSize > maxBytes {
+				chunks = append(chunks, [2]int{start, j})
+				start, size = j, seriesEnvelopeBytes
+				metricSize = sizes[j]
+			}
+			size += metricSize
+		}
+		chunks = append(chunks, [2]int{start, chunkEnd})
+	}
+	return chunks
+}
+
+// a bodyEncoder encodes its own JSON request body for postHelper, which
+// streams it into the compressor as it is written.
+type bodyEncoder interface {
+	encodeTo(w io.Writer) error
+}
+
+// seriesChunk is the body of one POST to the Datadog series API. It is only
+// encoded as it is posted, so a flush holds no more encoded bodies than it
+// has requests in flight, and no more than cap(encoders) chunks are encoded
+// at once.
+type seriesChunk struct {
+	metrics  []samplers.DDMetric
+	encoders chan struct{}
+}
+
+// encodeTo writes exactly what json.Encoder would have written for the
+// chunk as {"series": metrics}.
+func (c seriesChunk) encodeTo(w io.Writer) error {
+	c.encoders <- struct{}{}
+	defer func() { <-c.encoders }()
+
+	bw := bufio.NewWriter(w)
+	bw.WriteString(`{"series":[`)
+	for i := range c.metrics {
+		encoded, err := json.Marshal(c.metrics[i])
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			bw.WriteByte(',')
+		}
+		bw.Write(encoded)
+	}
+	bw.WriteString("]}\n")
+	return bw.Flush()
+}
+
+// seriesChunks breaks metrics into the bodies of a flush to the Datadog
+// series API, chunked like chunkMetrics would, with their sizes measured
+// across workers goroutines if maxBytes is positive. The chunks are encoded
+// by no more than workers goroutines at once.
+func seriesChunks(metrics []samplers.DDMetric, maxPerBody, maxBytes, workers int) []seriesChunk {
+	if workers < 1 {
+		workers = 1
+	}
+	sizes := make([]int, len(metrics))
+	if maxBytes > 0 {
+		sizes = metricSizes(metrics, workers)
+	}
+	encoders := make(chan struct{}, workers)
+	bounds := chunkBounds(sizes, maxPerBody, maxBytes)
+	chunks := make([]seriesChunk, len(bounds))
+	for i, b := range bounds {
+		chunks[i] = seriesChunk{metrics: metrics[b[0]:b[1]], encoders: encoders}
+	}
+	return chunks
+}
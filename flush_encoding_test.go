@@ -0,0 +1,97 @@
+package veneur
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func seriesMetrics(n int) []samplers.DDMetric {
+	metrics := make([]samplers.DDMetric, n)
+	for i := range metrics {
+		metrics[i] = samplers.DDMetric{
+			Name:       fmt.Sprintf("a.b.c.%d", i),
+			Value:      [1][2]float64{{1500000000, float64(i) / 3}},
+			Tags:       []string{"foo:bar", fmt.Sprintf("baz:<%d>", i%7)},
+			MetricType: "gauge",
+			Hostname:   "localhost",
+			Interval:   10,
+		}
+	}
+	return metrics
+}
+
+func TestSeriesChunks(t *testing.T) {
+	metrics := seriesMetrics(1000)
+	for _, limits := range [][2]int{{300, 0}, {300, 10000}, {5000, 0}, {5000, 1}} {
+		expected := chunkMetrics(metrics, limits[0], limits[1])
+		for _, workers := range []int{1, 3, 16, 2000} {
+			chunks := seriesChunks(metrics, limits[0], limits[1], workers)
+			if !assert.Len(t, chunks, len(expected), "limits %v, %d workers", limits, workers) {
+				continue
+			}
+			for i, chunk := range expected {
+				assert.Equal(t, chunk, chunks[i].metrics)
+			}
+		}
+	}
+}
+
+func TestSeriesChunkEncode(t *testing.T) {
+	for _, metrics := range [][]samplers.DDMetric{{}, seriesMetrics(1), seriesMetrics(300)} {
+		var expected, encoded bytes.Buffer
+		assert.NoError(t, json.NewEncoder(&expected).Encode(map[string][]samplers.DDMetric{"series": metrics}))
+		chunk := seriesChunk{metrics: metrics, encoders: make(chan struct{}, 1)}
+		assert.NoError(t, chunk.encodeTo(&encoded))
+		assert.Equal(t, expected.String(), encoded.String(), "bodies should be what json.Encoder writes for each chunk")
+	}
+
+	var empty bytes.Buffer
+	assert.NoError(t, seriesChunks(nil, 300, 0, 4)[0].encodeTo(&empty))
+	assert.Equal(t, "{\"series\":[]}\n", empty.String())
+
+	inf := seriesChunk{
+		metrics:  []samplers.DDMetric{{Name: "a.b.c", Value: [1][2]float64{{1500000000, math.Inf(1)}}}},
+		encoders: make(chan struct{}, 1),
+	}
+	assert.Error(t, inf.encodeTo(ioutil.Discard))
+}
+
+// encodeChunks encodes every chunk at once, as flushSeries would if it could
+// post them all at once.
+func encodeChunks(b *testing.B, chunks []seriesChunk) {
+	var wg sync.WaitGroup
+	for _, chunk := range chunks {
+		wg.Add(1)
+		go func(chunk seriesChunk) {
+			defer wg.Done()
+			if err := chunk.encodeTo(ioutil.Discard); err != nil {
+				b.Error(err)
+			}
+		}(chunk)
+	}
+	wg.Wait()
+}
+
+func BenchmarkSeriesChunks(b *testing.B) {
+	metrics := seriesMetrics(50000)
+	workerCounts := []int{1}
+	if procs := runtime.GOMAXPROCS(0); procs > 1 {
+		workerCounts = append(workerCounts, procs)
+	}
+	for _, workers := range workerCounts {
+		b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				encodeChunks(b, seriesChunks(metrics, 5000, 0, workers))
+			}
+		})
+	}
+}
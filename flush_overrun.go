@@ -0,0 +1,189 @@
+package veneur
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+const (
+	// flushOverrunSkip skips a flush that is due while the previous one is
+	// still running. Nothing is lost: the workers keep aggregating, so the
+	// next flush reports both intervals as one window.
+	flushOverrunSkip = "skip"
+	// flushOverrunQueue starts a flush that is due while the previous one is
+	// still running as soon as that one finishes. At most one flush is
+	// queued, since it takes everything aggregated until it starts anyway.
+	flushOverrunQueue = "queue"
+)
+
+// flushScheduler starts a flush on every tick of the flush interval, and
+// makes sure that flushes never overlap, so that each window's metrics are
+// taken from the workers exactly once however slow a flush gets. A flush
+// that is due while the previous one is still running is an overrun, and is
+// skipped or queued depending on the mode. It also keeps the timings of the
+// latest flush, for /debug/flush.
+//
+// A nil *flushScheduler records nothing.
+type flushScheduler struct {
+	mode     string
+	interval time.Duration
+	flush    func()
+	stats    *statsd.Client
+	now      func() time.Time
+	// closed by stop, to end schedule
+	stopped  chan struct{}
+	stopOnce sync.Once
+
+	mutex   sync.Mutex
+	running bool
+	queued  bool
+	// set by stop, after which no flush is started
+	stopping bool
+	// the flush that is running, which stop waits for
+	flushes sync.WaitGroup
+	// when the ticker was started, and last ticked
+	started  time.Time
+	lastTick time.Time
+	// when the latest flush to finish started, and how long it took
+	lastFlush         time.Time
+	lastFlushDuration time.Duration
+	sinks             map[string]sinkFlushTiming
+}
+
+// sinkFlushTiming is the latest flush to one sink.
+type sinkFlushTiming struct {
+	start    time.Time
+	duration time.Duration
+	err      error
+	skipped  bool
+}
+
+func newFlushScheduler(mode string, interval time.Duration, flush func(), stats *statsd.Client) (*flushScheduler, error) {
+	switch mode {
+	case "":
+		mode = flushOverrunSkip
+	case flushOverrunSkip, flushOverrunQueue:
+	default:
+		return nil, fmt.Errorf("flush_overrun must be %q or %q, got %q", flushOverrunSkip, flushOverrunQueue, mode)
+	}
+	return &flushScheduler{
+		mode:     mode,
+		interval: interval,
+		flush:    flush,
+		stats:    stats,
+		now:      time.Now,
+		stopped:  make(chan struct{}),
+		sinks:    map[string]sinkFlushTiming{},
+	}, nil
+}
+
+// schedule ticks every interval until stop is called, calling flush unless
+// it overruns.
+func (fs *flushScheduler) schedule(flush func()) {
+	fs.mutex.Lock()
+	fs.flush = flush
+	fs.started = fs.now()
+	fs.mutex.Unlock()
+
+	ticker := time.NewTicker(fs.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fs.tick()
+		case <-fs.stopped:
+			return
+		}
+	}
+}
+
+// stop stops scheduling flushes, and waits for a flush that is already
+// running to finish, so that nothing is flushed to a sink once it has been
+// stopped. A flush that was queued behind it is dropped.
+func (fs *flushScheduler) stop() {
+	if fs == nil {
+		return
+	}
+	fs.mutex.Lock()
+	fs.stopping = true
+	fs.mutex.Unlock()
+	fs.stopOnce.Do(func() { close(fs.stopped) })
+	fs.flushes.Wait()
+}
+
+// tick is called every interval. It starts a flush in the background if none
+// is running, and otherwise handles the overrun.
+func (fs *flushScheduler) tick() {
+	fs.mutex.Lock()
+	fs.lastTick = fs.now()
+	if fs.stopping {
+		fs.mutex.Unlock()
+		return
+	}
+	if fs.running {
+		action := flushOverrunSkip
+		if fs.mode == flushOverrunQueue && !fs.queued {
+			fs.queued = true
+			action = flushOverrunQueue
+		}
+		fs.mutex.Unlock()
+		log.WithField("action", action).Warn("Flush is overrunning the interval")
+		fs.stats.Count("flush.overruns_total", 1, []string{"action:" + action}, 1.0)
+		return
+	}
+	fs.running = true
+	fs.flushes.Add(1)
+	fs.mutex.Unlock()
+
+	go fs.run()
+}
+
+// run flushes, and then flushes again for as long as another flush was
+// queued in the meantime.
+func (fs *flushScheduler) run() {
+	defer fs.flushes.Done()
+	for {
+		start := fs.now()
+		fs.flush()
+
+		fs.mutex.Lock()
+		fs.lastFlush = start
+		fs.lastFlushDuration = fs.now().Sub(start)
+		if !fs.queued || fs.stopping {
+			fs.queued = false
+			fs.running = false
+			fs.mutex.Unlock()
+			return
+		}
+		fs.queued = false
+		fs.mutex.Unlock()
+	}
+}
+
+// recordSink records the latest flush to one sink.
+func (fs *flushScheduler) recordSink(sink string, start time.Time, duration time.Duration, err error, skipped bool) {
+	if fs == nil {
+		return
+	}
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fs.sinks[sink] = sinkFlushTiming{start: start, duration: duration, err: err, skipped: skipped}
+}
+
+// nextFlush returns when the next flush is scheduled for, which is zero if
+// the ticker hasn't been started. The next flush may yet be skipped or
+// queued, if the running one overruns. It must be called with the mutex
+// held.
+func (fs *flushScheduler) nextFlush() time.Time {
+	if fs.started.IsZero() {
+		return time.Time{}
+	}
+	last := fs.lastTick
+	if last.IsZero() {
+		last = fs.started
+	}
+	return last.Add(fs.interval)
+}
@@ -0,0 +1,160 @@
+package veneur
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// blockingFlush is a flush that doesn't finish until it is released, and
+// records whether it ever overlapped with another.
+type blockingFlush struct {
+	started    chan struct{}
+	release    chan struct{}
+	running    int32
+	overlapped bool
+}
+
+func newBlockingFlush() *blockingFlush {
+	return &blockingFlush{started: make(chan struct{}, 10), release: make(chan struct{})}
+}
+
+func (f *blockingFlush) flush() {
+	if atomic.AddInt32(&f.running, 1) > 1 {
+		f.overlapped = true
+	}
+	f.started <- struct{}{}
+	<-f.release
+	atomic.AddInt32(&f.running, -1)
+}
+
+func (f *blockingFlush) waitStarted(t *testing.T) {
+	select {
+	case <-f.started:
+	case <-time.After(time.Second):
+		t.Fatal("the flush never started")
+	}
+}
+
+func (f *blockingFlush) assertNotStarted(t *testing.T) {
+	select {
+	case <-f.started:
+		t.Fatal("a flush started while another was running")
+	case <-time.After(10 * time.Millisecond):
+	}
+}
+
+func TestFlushSchedulerSkip(t *testing.T) {
+	f := newBlockingFlush()
+	fs, err := newFlushScheduler("", time.Second, f.flush, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, flushOverrunSkip, fs.mode)
+
+	fs.tick()
+	f.waitStarted(t)
+	fs.tick()
+	fs.tick()
+	f.assertNotStarted(t)
+	f.release <- struct{}{}
+	f.assertNotStarted(t)
+
+	// the skipped flushes are folded into the next one
+	fs.tick()
+	f.waitStarted(t)
+	f.release <- struct{}{}
+	assert.False(t, f.overlapped)
+}
+
+func TestFlushSchedulerQueue(t *testing.T) {
+	f := newBlockingFlush()
+	fs, err := newFlushScheduler(flushOverrunQueue, time.Second, f.flush, nil)
+	assert.NoError(t, err)
+
+	fs.tick()
+	f.waitStarted(t)
+	fs.tick()
+	fs.tick()
+	f.assertNotStarted(t)
+	f.release <- struct{}{}
+
+	// only one flush is queued, however many were due
+	f.waitStarted(t)
+	f.release <- struct{}{}
+	f.assertNotStarted(t)
+	assert.False(t, f.overlapped)
+}
+
+func TestFlushSchedulerStop(t *testing.T) {
+	f := newBlockingFlush()
+	fs, err := newFlushScheduler("", time.Millisecond, nil, nil)
+	assert.NoError(t, err)
+
+	done := make(chan struct{})
+	go func() {
+		fs.schedule(f.flush)
+		close(done)
+	}()
+	f.waitStarted(t)
+	stopped := make(chan struct{})
+	go func() {
+		fs.stop()
+		fs.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+		t.Fatal("stop returned while a flush was still running")
+	case <-time.After(10 * time.Millisecond):
+	}
+	f.release <- struct{}{}
+	for _, c := range []chan struct{}{stopped, done} {
+		select {
+		case <-c:
+		case <-time.After(time.Second):
+			t.Fatal("the scheduler kept running after it was stopped")
+		}
+	}
+	f.assertNotStarted(t)
+}
+
+func TestFlushSchedulerStopDropsQueued(t *testing.T) {
+	f := newBlockingFlush()
+	fs, err := newFlushScheduler(flushOverrunQueue, time.Second, f.flush, nil)
+	assert.NoError(t, err)
+
+	fs.tick()
+	f.waitStarted(t)
+	fs.tick()
+	stopped := make(chan struct{})
+	go func() {
+		fs.stop()
+		close(stopped)
+	}()
+	for {
+		fs.mutex.Lock()
+		stopping := fs.stopping
+		fs.mutex.Unlock()
+		if stopping {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	f.release <- struct{}{}
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop never returned")
+	}
+	f.assertNotStarted(t)
+	fs.tick()
+	f.assertNotStarted(t)
+}
+
+func TestFlushOverrunConfig(t *testing.T) {
+	config := localConfig()
+	config.FlushOverrun = "overlap"
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "unknown overrun modes should be rejected")
+}
@@ -0,0 +1,176 @@
+package veneur
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// flushPause holds off flushing while a downstream is down for maintenance.
+// Metrics keep being aggregated while flushing is paused, and the first flush
+// after it resumes reports everything accumulated in the meantime as one
+// window. A pause always ends by itself after max, so that a forgotten one
+// can't accumulate forever, or as soon as the workers hold more than
+// maxSeries series, if that is set, so that it can't exhaust memory.
+//
+// A nil *flushPause never pauses.
+type flushPause struct {
+	mutex     sync.Mutex
+	max       time.Duration
+	maxSeries int
+	// when the current pause ends by itself, or zero if flushing isn't paused
+	until time.Time
+	// how many flushes have been skipped since the last one that happened
+	held int
+	now  func() time.Time
+}
+
+func newFlushPause(max time.Duration, maxSeries int) *flushPause {
+	return &flushPause{max: max, maxSeries: maxSeries, now: time.Now}
+}
+
+// pause pauses flushing for d, or for max if d is zero or longer than that.
+// Pausing again while paused just moves the end of the pause.
+func (p *flushPause) pause(d time.Duration) time.Time {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if d <= 0 || d > p.max {
+		d = p.max
+	}
+	p.until = p.now().Add(d)
+	return p.until
+}
+
+// resume unpauses flushing, so that the next flush reports everything held.
+// It reports whether flushing was paused.
+func (p *flushPause) resume() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	wasPaused := !p.until.IsZero()
+	p.until = time.Time{}
+	return wasPaused
+}
+
+// skip is called at the start of each flush, and reports whether it should
+// be skipped because flushing is paused. A pause that has run out, or is
+// holding more series than maxSeries, ends here. series is only called while
+// flushing is paused, to count the series being held.
+func (p *flushPause) skip(series func() int) bool {
+	if p == nil {
+		return false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.until.IsZero() {
+		return false
+	}
+	if !p.now().Before(p.until) {
+		log.WithField("held", p.held).Warn("Flush pause ran out, resuming")
+		p.until = time.Time{}
+		return false
+	}
+	if p.maxSeries > 0 {
+		if n := series(); n > p.maxSeries {
+			log.WithFields(logrus.Fields{
+				"held":   p.held,
+				"series": n,
+			}).Warn("Flush pause is holding too many series, resuming")
+			p.until = time.Time{}
+			return false
+		}
+	}
+	p.held++
+	return true
+}
+
+// takeHeld returns how many flushes were skipped before this one, and resets
+// the count.
+func (p *flushPause) takeHeld() int {
+	if p == nil {
+		return 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	held := p.held
+	p.held = 0
+	return held
+}
+
+// state returns when the current pause ends, which is zero if flushing isn't
+// paused, and how many flushes have been held so far.
+func (p *flushPause) state() (time.Time, int) {
+	if p == nil {
+		return time.Time{}, 0
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.until, p.held
+}
+
+// seriesCount returns how many series the workers are accumulating.
+func (s *Server) seriesCount() int {
+	n := 0
+	for _, w := range s.Workers {
+		n += w.SeriesCount()
+	}
+	return n
+}
+
+// flushPauseResponse is the body returned by /admin/flush/pause and
+// /admin/flush/resume
+type flushPauseResponse struct {
+	Paused bool       `json:"paused"`
+	Until  *time.Time `json:"until,omitempty"`
+	Held   int        `json:"held"`
+}
+
+// handleFlushPause pauses flushing, eg
+// POST /admin/flush/pause?duration=30m
+// If duration is omitted or longer than max_flush_pause, the pause lasts for
+// max_flush_pause. It is refused unless max_flush_pause is set.
+func (s *Server) handleFlushPause(w http.ResponseWriter, r *http.Request) {
+	if s.flushPause == nil {
+		http.Error(w, "flush pausing is not enabled", http.StatusForbidden)
+		return
+	}
+	var d time.Duration
+	if param := r.URL.Query().Get("duration"); param != "" {
+		var err error
+		d, err = time.ParseDuration(param)
+		if err != nil || d <= 0 {
+			http.Error(w, "duration must be a positive duration, eg 30m", http.StatusBadRequest)
+			return
+		}
+	}
+	until := s.flushPause.pause(d)
+	log.WithField("until", until).Info("Paused flushing")
+	s.writeFlushPause(w)
+}
+
+// handleFlushResume resumes flushing after handleFlushPause, eg
+// POST /admin/flush/resume
+// Everything held is reported by the next scheduled flush.
+func (s *Server) handleFlushResume(w http.ResponseWriter, r *http.Request) {
+	if s.flushPause == nil {
+		http.Error(w, "flush pausing is not enabled", http.StatusForbidden)
+		return
+	}
+	if s.flushPause.resume() {
+		_, held := s.flushPause.state()
+		log.WithField("held", held).Info("Resumed flushing")
+	}
+	s.writeFlushPause(w)
+}
+
+func (s *Server) writeFlushPause(w http.ResponseWriter) {
+	until, held := s.flushPause.state()
+	resp := flushPauseResponse{Paused: !until.IsZero(), Held: held}
+	if resp.Paused {
+		resp.Until = &until
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
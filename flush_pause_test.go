@@ -0,0 +1,147 @@
+package veneur
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func noSeries() int { return 0 }
+
+func TestFlushPause(t *testing.T) {
+	var nilPause *flushPause
+	assert.False(t, nilPause.skip(noSeries))
+	assert.Equal(t, 0, nilPause.takeHeld())
+
+	now := time.Now()
+	p := newFlushPause(time.Hour, 0)
+	p.now = func() time.Time { return now }
+	assert.False(t, p.skip(noSeries), "flushing isn't paused to begin with")
+
+	assert.Equal(t, now.Add(time.Hour), p.pause(2*time.Hour), "pauses are capped at max")
+	assert.Equal(t, now.Add(time.Minute), p.pause(time.Minute))
+	assert.True(t, p.skip(noSeries))
+	assert.True(t, p.skip(noSeries))
+	assert.True(t, p.resume())
+	assert.False(t, p.resume(), "flushing was already resumed")
+	assert.False(t, p.skip(noSeries))
+	assert.Equal(t, 2, p.takeHeld())
+	assert.Equal(t, 0, p.takeHeld())
+
+	p.pause(time.Minute)
+	assert.True(t, p.skip(noSeries))
+	now = now.Add(time.Minute)
+	assert.False(t, p.skip(noSeries), "the pause should end by itself")
+	until, held := p.state()
+	assert.True(t, until.IsZero())
+	assert.Equal(t, 1, held)
+}
+
+func TestFlushPauseMaxSeries(t *testing.T) {
+	s := &Server{
+		Workers:    []*Worker{NewWorker(1, nil, logrus.New()), NewWorker(2, nil, logrus.New())},
+		flushPause: newFlushPause(time.Hour, 2),
+	}
+	for i, packet := range []string{"a.b.c:1|c", "a.b.d:1|g", "a.b.e:1|h"} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		assert.NoError(t, err)
+		s.Workers[i%2].ProcessMetric(m)
+		if i == 1 {
+			s.flushPause.pause(0)
+			assert.True(t, s.flushPause.skip(s.seriesCount), "two series are within the limit")
+		}
+	}
+	assert.Equal(t, 3, s.seriesCount())
+	assert.False(t, s.flushPause.skip(s.seriesCount), "the pause should end once it holds too many series")
+	until, _ := s.flushPause.state()
+	assert.True(t, until.IsZero())
+}
+
+func TestFlushPauseWindow(t *testing.T) {
+	s := &Server{
+		Workers:    []*Worker{NewWorker(1, nil, logrus.New())},
+		interval:   10 * time.Second,
+		flushPause: newFlushPause(time.Hour, 0),
+	}
+	m, err := samplers.ParseMetric([]byte("a.b.c:30|c"))
+	assert.NoError(t, err)
+	s.Workers[0].ProcessMetric(m)
+
+	s.flushPause.pause(0)
+	s.Flush()
+	s.Flush()
+	s.flushPause.resume()
+
+	tempMetrics, ms := s.tallyMetrics(nil)
+	finalMetrics := s.generateDDMetrics(context.Background(), nil, tempMetrics, ms)
+	if assert.Len(t, finalMetrics, 1) {
+		// 30 over the three intervals it was held for, not just the last
+		assert.Equal(t, 1.0, finalMetrics[0].Value[0][1])
+		assert.Equal(t, int32(30), finalMetrics[0].Interval)
+	}
+}
+
+func TestFlushPauseEndpoints(t *testing.T) {
+	s := &Server{}
+	handler := s.Handler()
+
+	r := httptest.NewRequest(http.MethodPost, "/admin/flush/pause", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code, "pausing must be refused unless max_flush_pause is set")
+
+	s.flushPause = newFlushPause(time.Hour, 0)
+	r = httptest.NewRequest(http.MethodPost, "/admin/flush/pause?duration=bogus", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	r = httptest.NewRequest(http.MethodPost, "/admin/flush/pause?duration=30m", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp flushPauseResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.True(t, resp.Paused)
+	assert.NotNil(t, resp.Until)
+
+	r = httptest.NewRequest(http.MethodGet, "/healthcheck", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Contains(t, w.Body.String(), "flush: paused until")
+
+	r = httptest.NewRequest(http.MethodPost, "/admin/flush/resume", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	resp = flushPauseResponse{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.False(t, resp.Paused)
+	assert.Nil(t, resp.Until)
+}
+
+func TestFlushPauseConfig(t *testing.T) {
+	config := localConfig()
+	config.MaxFlushPause = "soon"
+	_, err := NewFromConfig(config)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "max_flush_pause")
+	}
+
+	config.MaxFlushPause = "1h"
+	config.MaxFlushPauseSeries = -1
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+
+	config.MaxFlushPauseSeries = 1000
+	s, err := NewFromConfig(config)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1000, s.flushPause.maxSeries)
+	}
+}
@@ -0,0 +1,140 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
+)
+
+// FlushTier sends the metrics of every Interval, rather than every flush, to
+// the given sinks, which are only flushed to by their tier. Interval must be
+// a multiple of the server's interval.
+type FlushTier struct {
+	Interval string   `yaml:"interval"`
+	Sinks    []string `yaml:"sinks"`
+}
+
+// flushTier rolls up what the workers flush every interval until its own
+// interval has passed, and then flushes the rollup to its sinks as if it had
+// been aggregated over all of it: counters are summed, gauges reduced by
+// their aggregation, and histograms, timers and sets merged. Only the flush
+// goroutine touches it.
+type flushTier struct {
+	interval time.Duration
+	sinks    []string
+	// how long rollup has been accumulating for
+	window time.Duration
+	rollup WorkerMetrics
+}
+
+// newFlushTiers checks the configured tiers, which must each have a
+// different interval and sinks that no other tier has.
+func (s *Server) newFlushTiers(configs []FlushTier) ([]*flushTier, error) {
+	if len(configs) == 0 {
+		return nil, fmt.Errorf("flush_tiers_enabled is set, but flush_tiers has no tiers")
+	}
+	tiers := make([]*flushTier, 0, len(configs))
+	intervals := map[time.Duration]bool{}
+	tiered := map[string]bool{}
+	for i, config := range configs {
+		option := fmt.Sprintf("flush tier %d", i)
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", option, err)
+		}
+		if interval <= s.interval || interval%s.interval != 0 {
+			return nil, fmt.Errorf("%s: interval %s must be a longer multiple of the interval %s", option, interval, s.interval)
+		}
+		if intervals[interval] {
+			return nil, fmt.Errorf("%s: another tier has the interval %s", option, interval)
+		}
+		intervals[interval] = true
+
+		if len(config.Sinks) == 0 {
+			return nil, fmt.Errorf("%s has no sinks", option)
+		}
+		if err := s.checkSinkNames(option, config.Sinks); err != nil {
+			return nil, err
+		}
+		for _, sink := range config.Sinks {
+			if sink == datadogSinkName || sink == scrapeSinkName {
+				return nil, fmt.Errorf("%s: %q can't be flushed by a tier", option, sink)
+			}
+			if tiered[sink] {
+				return nil, fmt.Errorf("%s: %q is already flushed by another tier", option, sink)
+			}
+			tiered[sink] = true
+		}
+		tiers = append(tiers, &flushTier{
+			interval: interval,
+			sinks:    config.Sinks,
+			rollup:   NewWorkerMetrics(),
+		})
+	}
+	return tiers, nil
+}
+
+// tiered reports whether the sink with the given name is only flushed to by
+// a tier.
+func (s *Server) tiered(sink string) bool {
+	for _, t := range s.tiers {
+		for _, name := range t.sinks {
+			if name == sink {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rollUpTiers merges the metrics of a flush covering window into each tier,
+// and returns the tiers whose interval has passed, with what they rolled up
+// over it, to be flushed. It must be called before anything else can use
+// flushed, and it doesn't keep any of it.
+func (s *Server) rollUpTiers(flushed []WorkerMetrics, window time.Duration) []flushTier {
+	var due []flushTier
+	for _, t := range s.tiers {
+		for _, wm := range flushed {
+			if err := t.rollup.merge(wm); err != nil {
+				log.WithFields(logrus.Fields{
+					logrus.ErrorKey: err,
+					"tier":          t.interval.String(),
+				}).Error("Could not roll up metrics for flush tier")
+			}
+		}
+		t.window += window
+		if t.window < t.interval {
+			continue
+		}
+		t.rollup.interval = t.window
+		due = append(due, *t)
+		t.window = 0
+		t.rollup = NewWorkerMetrics()
+	}
+	return due
+}
+
+// flushTiers flushes what each tier rolled up to its sinks.
+func (s *Server) flushTiers(ctx context.Context, percentiles []float64, due []flushTier) {
+	for _, t := range due {
+		finalMetrics := s.generateDDMetrics(ctx, percentiles, []WorkerMetrics{t.rollup}, metricsSummary{})
+		routed := s.routeMetrics(finalMetrics)
+		for _, p := range s.getPlugins() {
+			if tierFlushes(t, p) {
+				s.flushPlugin(ctx, p, routed.forSink(p.Name(), finalMetrics))
+			}
+		}
+	}
+}
+
+func tierFlushes(t flushTier, p plugins.Plugin) bool {
+	for _, name := range t.sinks {
+		if name == p.Name() {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package veneur
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestFlushTiersConfig(t *testing.T) {
+	tierConfig := func(tiers ...FlushTier) Config {
+		config := localConfig()
+		config.Sinks = []SinkConfig{
+			{Name: "recording", Config: map[string]string{"name": "hourly"}},
+			{Name: "recording", Config: map[string]string{"name": "daily"}},
+		}
+		config.FlushTiersEnabled = true
+		config.FlushTiers = tiers
+		return config
+	}
+	longer := (3 * DefaultFlushInterval).String()
+
+	for name, config := range map[string]Config{
+		"no tiers":              tierConfig(),
+		"not an interval":       tierConfig(FlushTier{Interval: "hourly", Sinks: []string{"hourly"}}),
+		"the server's interval": tierConfig(FlushTier{Interval: DefaultFlushInterval.String(), Sinks: []string{"hourly"}}),
+		"not a multiple":        tierConfig(FlushTier{Interval: (DefaultFlushInterval * 5 / 2).String(), Sinks: []string{"hourly"}}),
+		"no sinks":              tierConfig(FlushTier{Interval: longer}),
+		"unknown sink":          tierConfig(FlushTier{Interval: longer, Sinks: []string{"weekly"}}),
+		"built-in sink":         tierConfig(FlushTier{Interval: longer, Sinks: []string{datadogSinkName}}),
+		"sink in two tiers": tierConfig(
+			FlushTier{Interval: longer, Sinks: []string{"hourly"}},
+			FlushTier{Interval: (6 * DefaultFlushInterval).String(), Sinks: []string{"hourly", "daily"}},
+		),
+		"same interval twice": tierConfig(
+			FlushTier{Interval: longer, Sinks: []string{"hourly"}},
+			FlushTier{Interval: longer, Sinks: []string{"daily"}},
+		),
+	} {
+		_, err := NewFromConfig(config)
+		assert.Error(t, err, name)
+	}
+
+	config := tierConfig(
+		FlushTier{Interval: longer, Sinks: []string{"hourly"}},
+		FlushTier{Interval: (6 * DefaultFlushInterval).String(), Sinks: []string{"daily"}},
+	)
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Len(t, s.tiers, 2)
+	assert.True(t, s.tiered("daily"))
+	assert.False(t, s.tiered(datadogSinkName))
+
+	config.FlushTiersEnabled = false
+	s, err = NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Empty(t, s.tiers, "tiers are off unless enabled")
+}
+
+func TestFlushTiers(t *testing.T) {
+	config := localConfig()
+	config.Sinks = []SinkConfig{
+		{Name: "recording", Config: map[string]string{"name": "every"}},
+		{Name: "recording", Config: map[string]string{"name": "tiered"}},
+	}
+	config.FlushTiersEnabled = true
+	config.FlushTiers = []FlushTier{{Interval: (3 * DefaultFlushInterval).String(), Sinks: []string{"tiered"}}}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	every, tiered := recordingSinks["every"], recordingSinks["tiered"]
+
+	w := NewWorker(1, nil, nil)
+	flushed := func(values ...float64) []WorkerMetrics {
+		for _, v := range values {
+			w.ProcessMetric(&samplers.UDPMetric{
+				MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: "counter"},
+				Value:      v,
+				SampleRate: 0.5,
+			})
+			w.ProcessMetric(&samplers.UDPMetric{
+				MetricKey:  samplers.MetricKey{Name: "a.b.g", Type: "gauge"},
+				Value:      v,
+				SampleRate: 1.0,
+			})
+		}
+		return []WorkerMetrics{w.Flush()}
+	}
+
+	var due []flushTier
+	for _, values := range [][]float64{{1}, {2, 3}} {
+		metrics := flushed(values...)
+		due = s.rollUpTiers(metrics, DefaultFlushInterval)
+		assert.Empty(t, due, "the tier's interval hasn't passed yet")
+		s.flushPlugins(context.Background(), s.generateDDMetrics(context.Background(), nil, metrics, metricsSummary{}), nil)
+	}
+	// a flush that covers two intervals, like one after flushing was paused
+	due = s.rollUpTiers(flushed(4), 2*DefaultFlushInterval)
+	if assert.Len(t, due, 1) {
+		assert.Equal(t, 4*DefaultFlushInterval, due[0].rollup.interval)
+		s.flushTiers(context.Background(), nil, due)
+	}
+	assert.Empty(t, s.rollUpTiers(nil, DefaultFlushInterval), "the tier starts over once flushed")
+
+	every.Lock()
+	assert.Len(t, every.metrics, 4, "sinks without a tier are flushed every interval")
+	every.Unlock()
+
+	tiered.Lock()
+	defer tiered.Unlock()
+	values := map[string]float64{}
+	for _, m := range tiered.metrics {
+		values[m.Name] = m.Value[0][1]
+	}
+	assert.Len(t, tiered.metrics, 2, "a tiered sink is only flushed by its tier")
+	assert.InDelta(t, 20/(4*DefaultFlushInterval).Seconds(), values["a.b.c"], 1e-9, "counters are the rate over the whole tier")
+	assert.Equal(t, float64(4), values["a.b.g"], "gauges are the last value in the tier")
+}
+
+func TestWorkerMetricsMerge(t *testing.T) {
+	w := NewWorker(1, nil, nil)
+	w.ProcessMetric(&samplers.UDPMetric{
+		MetricKey:  samplers.MetricKey{Name: "a.b.h", Type: "histogram"},
+		Value:      float64(1),
+		SampleRate: 1.0,
+	})
+	first := w.Flush()
+	first.firstReceived = time.Now()
+
+	rollup := NewWorkerMetrics()
+	assert.NoError(t, rollup.merge(first))
+	assert.NoError(t, rollup.merge(NewWorkerMetrics()))
+	assert.Equal(t, first.firstReceived, rollup.firstReceived, "the oldest observation is kept")
+	for mk, h := range rollup.histograms {
+		assert.False(t, h == first.histograms[mk], "the rollup shouldn't share samplers with what it merged")
+		h.Sample(2, 1.0)
+		assert.Equal(t, float64(1), first.histograms[mk].LocalWeight, "later samples to the rollup don't change what it merged")
+	}
+	assert.Len(t, rollup.histograms, 1)
+}
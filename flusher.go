@@ -6,15 +6,20 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/trace"
@@ -26,6 +31,28 @@ func (s *Server) Flush() {
 	span := tracer.StartSpan("flush", trace.NameTag("veneur.opentracing.flush")).(*trace.Span)
 	defer span.Finish()
 
+	s.reportHeartbeat()
+	s.reportTracer(tracer)
+	if s.flushPause.skip(s.seriesCount) {
+		// everything keeps accumulating in the workers until flushing
+		// resumes
+		s.statsd.Count("flush.paused_total", 1, nil, 1.0)
+		return
+	}
+	if s.skipWarmupFlush() {
+		s.statsd.Count("flush.warmup_skipped_total", 1, nil, 1.0)
+		return
+	}
+
+	if s.retryBudget != nil {
+		s.statsd.Gauge("retry.budget_tokens", s.retryBudget.Tokens(), nil, 1.0)
+	}
+	s.statsd.Gauge("import.requests_in_flight", float64(atomic.LoadInt64(&s.importsInFlight)), nil, 1.0)
+	s.statsd.Count("ingest.packets_received_total", atomic.SwapInt64(&s.packetsReceived, 0), nil, 1.0)
+	s.reportReaders()
+	s.statsd.Count("ingest.lines_received_total", atomic.SwapInt64(&s.linesReceived, 0), nil, 1.0)
+	s.statsd.Count("ingest.lines_parsed_total", atomic.SwapInt64(&s.linesParsed, 0), nil, 1.0)
+
 	// right now we have only one destination plugin
 	// but eventually, this is where we would loop over our supported
 	// destinations
@@ -36,6 +63,77 @@ func (s *Server) Flush() {
 	}
 }
 
+// reportTracer reports the state of veneur's own tracer, t.
+func (s *Server) reportTracer(t trace.Tracer) {
+	if t.Sampler != nil {
+		s.statsd.Gauge("tracer.sampling_rate", t.Sampler.Rate(), nil, 1.0)
+	}
+	if t.Counts == nil {
+		return
+	}
+	s.statsd.Gauge("tracer.spans_active", float64(t.Counts.Active()), nil, 1.0)
+	for resource, counts := range t.Counts.TakeSampling() {
+		tags := []string{"resource:" + resource}
+		s.statsd.Count("spans.created", counts.Created, tags, 1.0)
+		s.statsd.Count("spans.kept", counts.Kept, tags, 1.0)
+	}
+	for extraction, count := range t.Counts.TakeExtractions() {
+		s.statsd.Count("tracer.extractions_total", count, []string{"format:" + extraction.Format, "result:" + extraction.Result}, 1.0)
+	}
+	limits := t.Counts.TakeLimits()
+	s.statsd.Count("tracer.spans_depth_limited_total", limits.DepthLimited, nil, 1.0)
+	s.statsd.Count("tracer.tags_truncated_total", limits.TagsTruncated, nil, 1.0)
+	s.statsd.Count("tracer.annotations_dropped_total", limits.AnnotationsDropped, nil, 1.0)
+}
+
+// skipWarmupFlush reports whether this is one of the first warmup_flushes
+// flushes since startup, whose windows are only partly covered, and if so
+// throws away the metrics the workers have accumulated, so that the next
+// window starts clean. Spans, events and checks aren't windowed, so they
+// are kept for the next flush.
+func (s *Server) skipWarmupFlush() bool {
+	for {
+		remaining := atomic.LoadInt32(&s.warmupFlushes)
+		if remaining <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&s.warmupFlushes, remaining, remaining-1) {
+			break
+		}
+	}
+	discarded := 0
+	for _, w := range s.Workers {
+		wm := w.Flush()
+		discarded += wm.seriesCount()
+		if internal, ok := w.FlushInternal(s.interval); ok {
+			discarded += internal.seriesCount()
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"remaining": atomic.LoadInt32(&s.warmupFlushes),
+		"discarded": discarded,
+	}).Info("Skipping a flush while warming up after startup")
+	return true
+}
+
+// reportHeartbeat reports veneur.heartbeat as 1, on every flush whether or
+// not any metrics were received, so that an instance that is up but idle
+// can be told apart from one that is down.
+func (s *Server) reportHeartbeat() {
+	if s.omitHeartbeat {
+		return
+	}
+	var tags []string
+	if s.Hostname != "" {
+		key := "host"
+		if s.hostnameTag != "" {
+			key = s.hostnameTag
+		}
+		tags = []string{key + ":" + s.Hostname}
+	}
+	s.statsd.Gauge("heartbeat", 1, tags, 1.0)
+}
+
 // FlushGlobal sends any global metrics to their destination.
 func (s *Server) FlushGlobal(ctx context.Context) {
 	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush.FlushGlobal"))
@@ -46,7 +144,10 @@ func (s *Server) FlushGlobal(ctx context.Context) {
 
 	percentiles := s.HistogramPercentiles
 
+	tallySpan, _ := s.startFlushPhase(span.Attach(ctx), "tallyMetrics")
 	tempMetrics, ms := s.tallyMetrics(percentiles)
+	tallySpan.Finish()
+	due := s.rollUpTiers(tempMetrics, ms.window)
 
 	// the global veneur instance is also responsible for reporting the sets
 	// and global counters
@@ -59,20 +160,15 @@ func (s *Server) FlushGlobal(ctx context.Context) {
 
 	s.reportGlobalMetricsFlushCounts(ms)
 
-	go func() {
-		for _, p := range s.getPlugins() {
-			start := time.Now()
-			err := p.Flush(finalMetrics, s.Hostname)
-			s.statsd.TimeInMilliseconds(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), float64(time.Since(start).Nanoseconds()), []string{"part:post"}, 1.0)
-			if err != nil {
-				countName := fmt.Sprintf("flush.plugins.%s.error_total", p.Name())
-				s.statsd.Count(countName, 1, []string{}, 1.0)
-			}
-			s.statsd.Gauge(fmt.Sprintf("flush.plugins.%s.post_metrics_total", p.Name()), float64(len(finalMetrics)), nil, 1.0)
-		}
-	}()
+	routed := s.routeMetrics(finalMetrics)
+	s.lastFlush.set(s.forRepresentation(routed.forSink(scrapeSinkName, finalMetrics), false))
+
+	go s.flushPlugins(span.Attach(ctx), finalMetrics, routed)
+	if len(due) > 0 {
+		go s.flushTiers(span.Attach(ctx), percentiles, due)
+	}
 
-	s.flushRemote(finalMetrics)
+	s.flushRemote(span.Attach(ctx), s.forRepresentation(routed.forSink(datadogSinkName, finalMetrics), false))
 }
 
 // FlushLocal takes the slices of metrics, combines then and marshals them to json
@@ -88,7 +184,10 @@ func (s *Server) FlushLocal(ctx context.Context) {
 	// veneur's job
 	var percentiles []float64
 
+	tallySpan, _ := s.startFlushPhase(span.Attach(ctx), "tallyMetrics")
 	tempMetrics, ms := s.tallyMetrics(percentiles)
+	tallySpan.Finish()
+	due := s.rollUpTiers(tempMetrics, ms.window)
 
 	finalMetrics := s.generateDDMetrics(span.Attach(ctx), percentiles, tempMetrics, ms)
 
@@ -98,22 +197,69 @@ func (s *Server) FlushLocal(ctx context.Context) {
 
 	// we cannot do this until we're done using tempMetrics within this function,
 	// since not everything in tempMetrics is safe for sharing
-	go s.flushForward(tempMetrics)
+	go s.flushForward(span.Attach(ctx), tempMetrics)
 
-	go func() {
-		for _, p := range s.getPlugins() {
-			start := time.Now()
-			err := p.Flush(finalMetrics, s.Hostname)
-			s.statsd.TimeInMilliseconds(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), float64(time.Since(start).Nanoseconds()), []string{"part:post"}, 1.0)
-			if err != nil {
-				countName := fmt.Sprintf("flush.plugins.%s.error_total", p.Name())
-				s.statsd.Count(countName, 1, []string{}, 1.0)
-			}
-			s.statsd.Gauge(fmt.Sprintf("flush.plugins.%s.post_metrics_total", p.Name()), float64(len(finalMetrics)), nil, 1.0)
+	routed := s.routeMetrics(finalMetrics)
+	s.lastFlush.set(s.forRepresentation(routed.forSink(scrapeSinkName, finalMetrics), false))
+
+	go s.flushPlugins(span.Attach(ctx), finalMetrics, routed)
+	if len(due) > 0 {
+		go s.flushTiers(span.Attach(ctx), percentiles, due)
+	}
+
+	s.flushRemote(span.Attach(ctx), s.forRepresentation(routed.forSink(datadogSinkName, finalMetrics), false))
+}
+
+// flushPlugins sends the flushed metrics to each plugin in turn, or only
+// those routed to it if routing is configured. Plugins that a flush tier
+// flushes to are left to it.
+func (s *Server) flushPlugins(ctx context.Context, finalMetrics []samplers.DDMetric, routed routedMetrics) {
+	for _, p := range s.getPlugins() {
+		if s.tiered(p.Name()) {
+			continue
 		}
-	}()
+		s.flushPlugin(ctx, p, routed.forSink(p.Name(), finalMetrics))
+	}
+}
 
-	s.flushRemote(finalMetrics)
+// flushPlugin sends metrics to one plugin, with histograms represented the
+// way it takes them, and reports how that went.
+func (s *Server) flushPlugin(ctx context.Context, p plugins.Plugin, metrics []samplers.DDMetric) {
+	metrics = s.forRepresentation(metrics, takesDistributions(p))
+	span, _ := s.startFlushPhase(ctx, "plugins."+p.Name())
+	defer span.Finish()
+	start := time.Now()
+	err := s.flushSink(ctx, p.Name(), func(context.Context) error {
+		return p.Flush(metrics, s.Hostname)
+	})
+	if err == errSinkSkipped {
+		return
+	}
+	s.statsd.TimeInMilliseconds(fmt.Sprintf("flush.plugins.%s.total_duration_ns", p.Name()), float64(time.Since(start).Nanoseconds()), []string{"part:post"}, 1.0)
+	if err != nil {
+		countName := fmt.Sprintf("flush.plugins.%s.error_total", p.Name())
+		s.statsd.Count(countName, 1, []string{}, 1.0)
+		if span != nil {
+			span.Error(err)
+		}
+	}
+	s.statsd.Gauge(fmt.Sprintf("flush.plugins.%s.post_metrics_total", p.Name()), float64(len(metrics)), nil, 1.0)
+}
+
+// startFlushPhase starts a span for one phase of a flush as a child of ctx,
+// if flush_trace_phases is enabled, and returns a context carrying it.
+// Otherwise it returns a nil span (which is safe to Finish) and a context
+// with no span in it, so that any spans the phase starts itself are not
+// attached to the flush.
+func (s *Server) startFlushPhase(ctx context.Context, phase string) (*trace.Span, context.Context) {
+	if !s.traceFlushPhases {
+		return nil, context.Background()
+	}
+	span, _ := trace.StartSpanFromContext(ctx, "flush", trace.NameTag("veneur.opentracing.flush."+phase))
+	if span == nil {
+		return nil, context.Background()
+	}
+	return span, span.Attach(ctx)
 }
 
 type metricsSummary struct {
@@ -130,6 +276,9 @@ type metricsSummary struct {
 	totalLocalTimers     int
 
 	totalLength int
+
+	// the interval this flush covers
+	window time.Duration
 }
 
 // tallyMetrics gives a slight overestimate of the number
@@ -143,26 +292,57 @@ func (s *Server) tallyMetrics(percentiles []float64) ([]WorkerMetrics, metricsSu
 
 	gatherStart := time.Now()
 	ms := metricsSummary{}
+	var oldest time.Time
+	// if flushes were held while flushing was paused, this one covers all
+	// of their intervals, so that counters' rates aren't inflated
+	window := s.interval
+	if held := s.flushPause.takeHeld(); held > 0 {
+		window = time.Duration(held+1) * s.interval
+	}
+	ms.window = window
 
 	for i, w := range s.Workers {
 		log.WithField("worker", i).Debug("Flushing")
 		wm := w.Flush()
-		tempMetrics = append(tempMetrics, wm)
+		wm.interval = window
+		flushed := []WorkerMetrics{wm}
+		if internal, ok := w.FlushInternal(window); ok {
+			flushed = append(flushed, internal)
+		}
+		for _, wm := range flushed {
+			tempMetrics = append(tempMetrics, wm)
 
-		ms.totalCounters += len(wm.counters)
-		ms.totalGauges += len(wm.gauges)
-		ms.totalHistograms += len(wm.histograms)
-		ms.totalSets += len(wm.sets)
-		ms.totalTimers += len(wm.timers)
+			ms.totalCounters += len(wm.counters)
+			ms.totalGauges += len(wm.gauges)
+			ms.totalHistograms += len(wm.histograms)
+			ms.totalSets += len(wm.sets)
+			ms.totalTimers += len(wm.timers)
 
-		ms.totalGlobalCounters += len(wm.globalCounters)
+			ms.totalGlobalCounters += len(wm.globalCounters)
 
-		ms.totalLocalHistograms += len(wm.localHistograms)
-		ms.totalLocalSets += len(wm.localSets)
-		ms.totalLocalTimers += len(wm.localTimers)
+			ms.totalLocalHistograms += len(wm.localHistograms)
+			ms.totalLocalSets += len(wm.localSets)
+			ms.totalLocalTimers += len(wm.localTimers)
+
+			if !wm.firstReceived.IsZero() && (oldest.IsZero() || wm.firstReceived.Before(oldest)) {
+				oldest = wm.firstReceived
+			}
+		}
 	}
 
 	s.statsd.TimeInMilliseconds("flush.total_duration_ns", float64(time.Since(gatherStart).Nanoseconds()), []string{"part:gather"}, 1.0)
+	if !oldest.IsZero() {
+		// how stale the oldest observation in this flush had become by the
+		// time we got around to flushing it
+		s.statsd.Gauge("flush.max_data_age", time.Since(oldest).Seconds(), nil, 1.0)
+	}
+
+	distinct, added, hasPrev := s.metricNames.observe(tempMetrics)
+	s.statsd.Gauge("flush.distinct_metric_names", float64(distinct), nil, 1.0)
+	if hasPrev {
+		s.statsd.Gauge("flush.new_metric_names", float64(added), nil, 1.0)
+	}
+	s.reportTagCardinality(tempMetrics)
 
 	ms.totalLength = ms.totalCounters + ms.totalGauges +
 		// histograms and timers each report a metric point for each percentile
@@ -186,20 +366,26 @@ func (s *Server) generateDDMetrics(ctx context.Context, percentiles []float64, t
 	defer span.Finish()
 
 	finalMetrics := make([]samplers.DDMetric, 0, ms.totalLength)
+	now := time.Now()
 	for _, wm := range tempMetrics {
+		interval := s.interval
+		if wm.interval != 0 {
+			interval = wm.interval
+		}
+		ts := s.alignedTimestamp(now, interval)
 		for _, c := range wm.counters {
-			finalMetrics = append(finalMetrics, c.Flush(s.interval)...)
+			finalMetrics = append(finalMetrics, stampMetrics(s.flushCounter(c, interval), ts, c.Timestamp)...)
 		}
 		for _, g := range wm.gauges {
-			finalMetrics = append(finalMetrics, g.Flush()...)
+			finalMetrics = append(finalMetrics, stampMetrics(g.Flush(), ts, g.Timestamp)...)
 		}
 		// if we're a local veneur, then percentiles=nil, and only the local
 		// parts (count, min, max) will be flushed
 		for _, h := range wm.histograms {
-			finalMetrics = append(finalMetrics, h.Flush(s.interval, percentiles, s.HistogramAggregates)...)
+			finalMetrics = append(finalMetrics, stampMetrics(s.flushHistogram(h, interval, percentiles, !s.IsLocal()), ts, 0)...)
 		}
 		for _, t := range wm.timers {
-			finalMetrics = append(finalMetrics, t.Flush(s.interval, percentiles, s.HistogramAggregates)...)
+			finalMetrics = append(finalMetrics, stampMetrics(s.flushHistogram(t, interval, percentiles, !s.IsLocal()), ts, 0)...)
 		}
 
 		// local-only samplers should be flushed in their entirety, since they
@@ -207,13 +393,13 @@ func (s *Server) generateDDMetrics(ctx context.Context, percentiles []float64, t
 		// we still want percentiles for these, even if we're a local veneur, so
 		// we use the original percentile list when flushing them
 		for _, h := range wm.localHistograms {
-			finalMetrics = append(finalMetrics, h.Flush(s.interval, s.HistogramPercentiles, s.HistogramAggregates)...)
+			finalMetrics = append(finalMetrics, stampMetrics(s.flushHistogram(h, interval, s.HistogramPercentiles, true), ts, 0)...)
 		}
 		for _, s := range wm.localSets {
-			finalMetrics = append(finalMetrics, s.Flush()...)
+			finalMetrics = append(finalMetrics, stampMetrics(s.Flush(), ts, 0)...)
 		}
 		for _, t := range wm.localTimers {
-			finalMetrics = append(finalMetrics, t.Flush(s.interval, s.HistogramPercentiles, s.HistogramAggregates)...)
+			finalMetrics = append(finalMetrics, stampMetrics(s.flushHistogram(t, interval, s.HistogramPercentiles, true), ts, 0)...)
 		}
 
 		// TODO (aditya) refactor this out so we don't
@@ -222,24 +408,91 @@ func (s *Server) generateDDMetrics(ctx context.Context, percentiles []float64, t
 			// sets have no local parts, so if we're a local veneur, there's
 			// nothing to flush at all
 			for _, s := range wm.sets {
-				finalMetrics = append(finalMetrics, s.Flush()...)
+				finalMetrics = append(finalMetrics, stampMetrics(s.Flush(), ts, 0)...)
 			}
 
 			// also do this for global counters
 			// global counters have no local parts, so if we're a local veneur,
 			// there's nothing to flush
 			for _, gc := range wm.globalCounters {
-				finalMetrics = append(finalMetrics, gc.Flush(s.interval)...)
+				finalMetrics = append(finalMetrics, stampMetrics(s.flushCounter(gc, interval), ts, gc.Timestamp)...)
 			}
 		}
 	}
 
-	finalizeMetrics(s.Hostname, s.Tags, finalMetrics)
+	if s.hostnameTag == "" {
+		finalizeMetrics(s.Hostname, s.Tags, s.tagMerger, finalMetrics)
+	} else {
+		finalizeMetrics("", s.Tags, s.tagMerger, finalMetrics)
+		tagHostname(s.hostnameTag, s.Hostname, s.tagMerger, finalMetrics)
+	}
 	s.statsd.TimeInMilliseconds("flush.total_duration_ns", float64(time.Since(span.Start).Nanoseconds()), []string{"part:combine"}, 1.0)
 
 	return finalMetrics
 }
 
+// the timestamps that flush_timestamp_alignment can report metrics at,
+// instead of when they are flushed
+const (
+	// the start of the interval-aligned window the flush covers
+	flushTimestampStart = "start"
+	// the end of it
+	flushTimestampEnd = "end"
+)
+
+// alignedTimestamp returns the timestamp that metrics flushed at now,
+// covering window, are reported at if flush_timestamp_alignment is set, or
+// 0 if each is reported at the time it's flushed. The end of the window is
+// the multiple of the interval nearest to now, so that Veneurs whose flushes
+// are staggered by less than half an interval agree on it, and its start is
+// the window before that.
+func (s *Server) alignedTimestamp(now time.Time, window time.Duration) float64 {
+	if s.flushTimestampAlignment == "" || s.interval <= 0 {
+		return 0
+	}
+	end := now.Round(s.interval)
+	if s.flushTimestampAlignment == flushTimestampStart {
+		return float64(end.Add(-window).Unix())
+	}
+	return float64(end.Unix())
+}
+
+// stampMetrics reports metrics at ts, unless it's 0, or the sampler they
+// were flushed from had an explicit timestamp, which is kept.
+func stampMetrics(metrics []samplers.DDMetric, ts float64, explicit int64) []samplers.DDMetric {
+	if ts == 0 || explicit != 0 {
+		return metrics
+	}
+	for i := range metrics {
+		metrics[i].Value[0][0] = ts
+	}
+	return metrics
+}
+
+// flushCounter flushes a counter either as a per-second rate (the default) or
+// as a total over the interval, depending on configuration.
+func (s *Server) flushCounter(c *samplers.Counter, interval time.Duration) []samplers.DDMetric {
+	if s.countersAsCounts {
+		return c.FlushCount(interval)
+	}
+	return c.Flush(interval)
+}
+
+// flushHistogram flushes a histogram or timer, unless it is empty and we have
+// been configured to omit empty histograms. It is only flushed as a
+// distribution if it is complete, rather than being forwarded to a global
+// veneur, which flushes the distribution of all of its observations.
+func (s *Server) flushHistogram(h *samplers.Histo, interval time.Duration, percentiles []float64, complete bool) []samplers.DDMetric {
+	if s.omitEmptyHistograms && h.Empty() {
+		return nil
+	}
+	metrics := h.Flush(interval, percentiles, s.HistogramAggregates)
+	if s.histogramDistributions != "" && complete {
+		metrics = append(metrics, h.FlushDistribution()...)
+	}
+	return metrics
+}
+
 // reportMetricsFlushCounts reports the counts of
 // Counters, Gauges, LocalHistograms, LocalSets, and LocalTimers
 // as metrics. These are shared by both global and local flush operations.
@@ -273,39 +526,106 @@ func (s *Server) reportGlobalMetricsFlushCounts(ms metricsSummary) {
 
 // flushRemote breaks up the final metrics into chunks
 // (to avoid hitting the size cap) and POSTs them to the remote API
-func (s *Server) flushRemote(finalMetrics []samplers.DDMetric) {
-	s.statsd.Gauge("flush.post_metrics_total", float64(len(finalMetrics)), nil, 1.0)
+func (s *Server) flushRemote(ctx context.Context, finalMetrics []samplers.DDMetric) {
+	span, ctx := s.startFlushPhase(ctx, "datadog")
+	defer span.Finish()
+
 	// Check to see if we have anything to do
 	if len(finalMetrics) == 0 {
+		s.statsd.Gauge("flush.post_metrics_total", 0, nil, 1.0)
 		log.Info("Nothing to flush, skipping.")
 		return
 	}
 
-	// break the metrics into chunks of approximately equal size, such that
-	// each chunk is less than the limit
-	// we compute the chunks using rounding-up integer division
-	workers := ((len(finalMetrics) - 1) / s.FlushMaxPerBody) + 1
-	chunkSize := ((len(finalMetrics) - 1) / workers) + 1
-	log.WithField("workers", workers).Debug("Worker count chosen")
-	log.WithField("chunkSize", chunkSize).Debug("Chunk size chosen")
-	var wg sync.WaitGroup
+	// the shadow gets its copy concurrently, and never holds up (or fails)
+	// the real flush
+	s.datadogShadow.Send(finalMetrics, s.Hostname)
+
+	finalMetrics = plugins.SkipUnserializable(s.statsd, log, datadogSinkName, finalMetrics, checkDDMetricJSON)
 	flushStart := time.Now()
-	for i := 0; i < workers; i++ {
-		chunk := finalMetrics[i*chunkSize:]
-		if i < workers-1 {
-			// trim to chunk size unless this is the last one
-			chunk = chunk[:chunkSize]
-		}
-		wg.Add(1)
-		go s.flushPart(chunk, &wg)
+	err := s.flushSink(ctx, datadogSinkName, func(ctx context.Context) error {
+		return s.flushSeries(ctx, s.DDHostname, s.DDAPIKey, finalMetrics, "flush")
+	})
+	if err == errSinkSkipped {
+		// nothing was posted, so there's nothing to report
+		return
 	}
-	wg.Wait()
+	s.statsd.Gauge("flush.post_metrics_total", float64(len(finalMetrics)), nil, 1.0)
 	s.statsd.TimeInMilliseconds("flush.total_duration_ns", float64(time.Since(flushStart).Nanoseconds()), []string{"part:post"}, 1.0)
 
 	log.WithField("metrics", len(finalMetrics)).Info("Completed flush to Datadog")
 }
 
-func finalizeMetrics(hostname string, tags []string, finalMetrics []samplers.DDMetric) {
+// seriesEnvelopeBytes is the length of the JSON that flushPart wraps a chunk
+// of metrics in, ie `{"series":[]}` and the encoder's trailing newline.
+const seriesEnvelopeBytes = 14
+
+// chunkMetrics breaks the metrics into chunks like chunkBounds, measuring
+// their sizes by encoding them if maxBytes is positive.
+func chunkMetrics(metrics []samplers.DDMetric, maxPerBody, maxBytes int) [][]samplers.DDMetric {
+	sizes := make([]int, len(metrics))
+	if maxBytes > 0 {
+		sizes = metricSizes(metrics, 1)
+	}
+	bounds := chunkBounds(sizes, maxPerBody, maxBytes)
+	chunks := make([][]samplers.DDMetric, len(bounds))
+	for i, b := range bounds {
+		chunks[i] = metrics[b[0]:b[1]]
+	}
+	return chunks
+}
+
+// checkDDMetricJSON returns an error if the metric can't be encoded as JSON
+// for the Datadog API. Its strings are always encodable (invalid UTF-8 is
+// replaced), so this can only happen for values that JSON has no way to
+// represent: NaN and the infinities.
+func checkDDMetricJSON(m samplers.DDMetric) error {
+	for _, point := range m.Value {
+		for _, v := range point {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return &json.UnsupportedValueError{Str: strconv.FormatFloat(v, 'g', -1, 64)}
+			}
+		}
+	}
+	return nil
+}
+
+// tagMerger merges the tags configured for the whole veneur into the ones
+// that each metric, event and check already has, by the configured
+// tag_precedence. A metric's own tags were already merged with its
+// listener's when it was parsed, so they're told apart again by key: the ones
+// with a key that a listener tags with count as the listener's. The zero
+// value uses the default precedence.
+type tagMerger struct {
+	precedence   samplers.TagPrecedence
+	listenerKeys map[string]bool
+}
+
+// merge returns own merged with host, which may be own itself if there is
+// nothing to merge.
+func (m tagMerger) merge(own, host []string) []string {
+	if len(host) == 0 {
+		return own
+	}
+	hostTags := samplers.SourcedTags{Source: samplers.TagSourceHost, Tags: host}
+	if len(m.listenerKeys) == 0 {
+		return samplers.MergeTags(m.precedence, samplers.SourcedTags{Source: samplers.TagSourceClient, Tags: own}, hostTags)
+	}
+	var client, listener []string
+	for _, tag := range own {
+		if m.listenerKeys[samplers.TagKey(tag)] {
+			listener = append(listener, tag)
+		} else {
+			client = append(client, tag)
+		}
+	}
+	return samplers.MergeTags(m.precedence,
+		samplers.SourcedTags{Source: samplers.TagSourceClient, Tags: client},
+		samplers.SourcedTags{Source: samplers.TagSourceListener, Tags: listener},
+		hostTags)
+}
+
+func finalizeMetrics(hostname string, tags []string, merger tagMerger, finalMetrics []samplers.DDMetric) {
 	for i := range finalMetrics {
 		// Let's look for "magic tags" that override metric fields host and device.
 		for j, tag := range finalMetrics[i].Tags {
@@ -326,19 +646,111 @@ func finalizeMetrics(hostname string, tags []string, finalMetrics []samplers.DDM
 			finalMetrics[i].Hostname = hostname
 		}
 
-		finalMetrics[i].Tags = append(finalMetrics[i].Tags, tags...)
+		finalMetrics[i].Tags = merger.merge(finalMetrics[i].Tags, tags)
+	}
+}
+
+// tagHostname tags every metric with key:hostname, as a host tag, unless the
+// hostname is empty. By default, that means metrics that already have a tag
+// with that key keep it. It's used instead of setting each metric's Hostname
+// when hostname_tag names a key other than "host".
+func tagHostname(key, hostname string, merger tagMerger, finalMetrics []samplers.DDMetric) {
+	if hostname == "" {
+		return
+	}
+	tags := []string{key + ":" + hostname}
+	for i := range finalMetrics {
+		finalMetrics[i].Tags = merger.merge(finalMetrics[i].Tags, tags)
 	}
 }
 
+// flushParts flushes each chunk of metrics to the Datadog API server in
+// parallel, at most as many at a time as the datadog pool's
+// max_requests_in_flight, so that splitting a big flush into many small
+// bodies doesn't open as many connections, or hold as many encoded bodies in
+// memory, all at once. Every chunk is POSTed regardless of whether the others
+// fail, and the first error encountered is returned.
+func (s *Server) flushParts(ctx context.Context, ddHostname, apiKey string, chunks [][]samplers.DDMetric, action string) error {
+	return s.postInParallel(len(chunks), func(i int) error {
+		return s.flushPart(ctx, ddHostname, apiKey, chunks[i], action)
+	})
+}
+
+// flushSeries chunks metrics by flush_max_per_body and flush_max_body_bytes,
+// and POSTs the chunks to the Datadog series API like flushParts. Each chunk
+// is encoded by the goroutine that POSTs it, with as many encoding at once as
+// serializationWorkers allows, so the encoding is spread across cores
+// without any more of the flush being held encoded than is in flight.
+func (s *Server) flushSeries(ctx context.Context, ddHostname, apiKey string, metrics []samplers.DDMetric, action string) error {
+	chunks := seriesChunks(metrics, s.FlushMaxPerBody, s.FlushMaxBodyBytes, s.serializationWorkers)
+	log.WithField("workers", len(chunks)).Debug("Worker count chosen")
+	endpoint := fmt.Sprintf("%s/api/v1/series?api_key=%s", ddHostname, apiKey)
+	return s.postInParallel(len(chunks), func(i int) error {
+		return s.postHelper(ctx, endpoint, chunks[i], action, s.sinkEncoding(datadogSinkName))
+	})
+}
+
+// postInParallel calls post for each of n parts, with no more than the
+// datadog pool's max_requests_in_flight of them at once, and returns the
+// first error any of them had.
+func (s *Server) postInParallel(n int, post func(i int) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, n)
+	inFlight := s.maxRequestsInFlight
+	if inFlight <= 0 {
+		inFlight = defaultMaxRequestsInFlight
+	}
+	sem := make(chan struct{}, inFlight)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			errs[i] = post(i)
+		}(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // flushPart flushes a set of metrics to the remote API server
-func (s *Server) flushPart(metricSlice []samplers.DDMetric, wg *sync.WaitGroup) {
-	defer wg.Done()
-	s.postHelper(context.TODO(), fmt.Sprintf("%s/api/v1/series?api_key=%s", s.DDHostname, s.DDAPIKey), map[string][]samplers.DDMetric{
+func (s *Server) flushPart(ctx context.Context, ddHostname, apiKey string, metricSlice []samplers.DDMetric, action string) error {
+	return s.postHelper(ctx, fmt.Sprintf("%s/api/v1/series?api_key=%s", ddHostname, apiKey), map[string][]samplers.DDMetric{
 		"series": metricSlice,
-	}, "flush", true)
+	}, action, s.sinkEncoding(datadogSinkName))
+}
+
+// datadogShadowSinkName is the name of the Datadog account that gets a copy
+// of every flush, if datadog_shadow_api_hostname is set.
+const datadogShadowSinkName = "datadog_shadow"
+
+// datadogShadowPlugin flushes to a second Datadog account, chunked the same
+// way as flushes to the primary one.
+type datadogShadowPlugin struct {
+	server     *Server
+	ddHostname string
+	apiKey     string
 }
 
-func (s *Server) flushForward(wms []WorkerMetrics) {
+func (p *datadogShadowPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	metrics = plugins.SkipUnserializable(p.server.statsd, log, datadogShadowSinkName, metrics, checkDDMetricJSON)
+	return p.server.flushSeries(context.Background(), p.ddHostname, p.apiKey, metrics, "flush_shadow")
+}
+
+func (p *datadogShadowPlugin) Name() string {
+	return datadogShadowSinkName
+}
+
+func (s *Server) flushForward(ctx context.Context, wms []WorkerMetrics) {
+	span, ctx := s.startFlushPhase(ctx, "forward")
+	defer span.Finish()
+
 	jmLength := 0
 	for _, wm := range wms {
 		jmLength += len(wm.histograms)
@@ -419,9 +831,14 @@ func (s *Server) flushForward(wms []WorkerMetrics) {
 	}
 	s.statsd.TimeInMilliseconds("forward.duration_ns", float64(time.Since(dnsStart).Nanoseconds()), []string{"part:dns"}, 1.0)
 
+	if s.deadletters != nil {
+		err = s.forwardWithDeadletters(ctx, endpoint, jsonMetrics)
+	} else {
+		err = s.postHelper(ctx, endpoint, jsonMetrics, "forward", s.sinkEncoding(forwardSinkName))
+	}
 	// the error has already been logged (if there was one), so we only care
 	// about the success case
-	if s.postHelper(context.TODO(), endpoint, jsonMetrics, "forward", true) == nil {
+	if err == nil {
 		log.WithField("metrics", len(jsonMetrics)).Info("Completed forward to upstream Veneur")
 	}
 }
@@ -468,6 +885,8 @@ func (s *Server) flushTraces(ctx context.Context) {
 	traces := s.TraceWorker.Flush()
 
 	var finalTraces []*DatadogTraceSpan
+	var zipkinSpans []zipkinSpan
+	var sinkSpans []ssf.SSFSample
 	traces.Do(func(t interface{}) {
 		if t != nil {
 			span, ok := t.(ssf.SSFSample)
@@ -475,6 +894,15 @@ func (s *Server) flushTraces(ctx context.Context) {
 				log.Error("Got an unknown object in tracing ring!")
 				return
 			}
+			if len(s.sinks) != 0 {
+				sinkSpans = append(sinkSpans, span)
+			}
+			if s.zipkinAddress != "" {
+				zipkinSpans = append(zipkinSpans, zipkinSpanFromSSF(span))
+			}
+			if s.DDTraceAddress == "" {
+				return
+			}
 			// -1 is a canonical way of passing in invalid info in Go
 			// so we should support that too
 			parentID := span.Trace.ParentId
@@ -494,6 +922,13 @@ func (s *Server) flushTraces(ctx context.Context) {
 
 			// TODO implement additional metrics
 			var metrics map[string]float64
+			// Datadog only honors the measured flag as a metric
+			if measured, ok := tags[trace.MeasuredTag]; ok {
+				if v, err := strconv.ParseFloat(measured, 64); err == nil {
+					delete(tags, trace.MeasuredTag)
+					metrics = map[string]float64{trace.MeasuredTag: v}
+				}
+			}
 
 			ddspan := &DatadogTraceSpan{
 				TraceID:  span.Trace.TraceId,
@@ -513,12 +948,21 @@ func (s *Server) flushTraces(ctx context.Context) {
 			finalTraces = append(finalTraces, ddspan)
 		}
 	})
+	if len(zipkinSpans) != 0 {
+		s.flushZipkin(span.Attach(ctx), zipkinSpans)
+	}
+	if len(sinkSpans) != 0 {
+		s.flushSpansToSinks(span.Attach(ctx), sinkSpans)
+	}
+	if s.DDTraceAddress == "" {
+		return
+	}
 	if len(finalTraces) != 0 {
 		// this endpoint is not documented to take an array... but it does
 		// another curious constraint of this endpoint is that it does not
 		// support "Content-Encoding: deflate"
 
-		err := s.postHelper(span.Attach(ctx), fmt.Sprintf("%s/spans", s.DDTraceAddress), finalTraces, "flush_traces", false)
+		err := s.postHelper(span.Attach(ctx), fmt.Sprintf("%s/spans", s.DDTraceAddress), finalTraces, "flush_traces", plugins.EncodingNone)
 
 		if err == nil {
 			log.WithField("traces", len(finalTraces)).Info("Completed flushing traces to Datadog")
@@ -543,13 +987,13 @@ func (s *Server) flushEventsChecks() {
 		if events[i].Hostname == "" {
 			events[i].Hostname = s.Hostname
 		}
-		events[i].Tags = append(events[i].Tags, s.Tags...)
+		events[i].Tags = s.tagMerger.merge(events[i].Tags, s.Tags)
 	}
 	for i := range checks {
 		if checks[i].Hostname == "" {
 			checks[i].Hostname = s.Hostname
 		}
-		checks[i].Tags = append(checks[i].Tags, s.Tags...)
+		checks[i].Tags = s.tagMerger.merge(checks[i].Tags, s.Tags)
 	}
 
 	if len(events) != 0 {
@@ -561,7 +1005,7 @@ func (s *Server) flushEventsChecks() {
 			"events": {
 				"api": events,
 			},
-		}, "flush_events", true)
+		}, "flush_events", s.sinkEncoding(datadogSinkName))
 		if err == nil {
 			log.WithField("events", len(events)).Info("Completed flushing events to Datadog")
 		}
@@ -571,71 +1015,132 @@ func (s *Server) flushEventsChecks() {
 		// this endpoint is not documented to take an array... but it does
 		// another curious constraint of this endpoint is that it does not
 		// support "Content-Encoding: deflate"
-		err := s.postHelper(context.TODO(), fmt.Sprintf("%s/api/v1/check_run?api_key=%s", s.DDHostname, s.DDAPIKey), checks, "flush_checks", false)
+		err := s.postHelper(context.TODO(), fmt.Sprintf("%s/api/v1/check_run?api_key=%s", s.DDHostname, s.DDAPIKey), checks, "flush_checks", plugins.EncodingNone)
 		if err == nil {
 			log.WithField("checks", len(checks)).Info("Completed flushing service checks to Datadog")
 		}
 	}
 }
 
-// shared code for POSTing to an endpoint, that consumes JSON, that is zlib-
-// compressed, that returns 202 on success, that has a small response
+// compressionLevel returns the level that postHelper compresses the body for
+// action with. Forwards use forward_compression_level, if it's set, and
+// everything else uses zlib's default.
+func (s *Server) compressionLevel(action string) int {
+	if strings.HasPrefix(action, "forward") && s.forwardCompressionLevel != 0 {
+		return s.forwardCompressionLevel
+	}
+	return zlib.DefaultCompression
+}
+
+// shared code for POSTing to an endpoint, that consumes JSON, that is
+// compressed with encoding (see sinkEncoding), that returns 202 on success,
+// that has a small response
 // action is a string used for statsd metric names and log messages emitted from
 // this function - probably a static string for each callsite
-// you can disable compression with compress=false for endpoints that don't
-// support it
-func (s *Server) postHelper(ctx context.Context, endpoint string, bodyObject interface{}, action string, compress bool) error {
+// endpoints that don't support compression get plugins.EncodingNone
+func (s *Server) postHelper(ctx context.Context, endpoint string, bodyObject interface{}, action string, encoding string) error {
 	span, _ := trace.StartSpanFromContext(ctx, action, trace.NameTag("veneur.opentracing.flush.postHelper"))
 	defer span.Finish()
 
 	// attach this field to all the logs we generate
 	innerLogger := log.WithField("action", action)
 
-	marshalStart := time.Now()
-	var (
-		bodyBuffer bytes.Buffer
-		encoder    *json.Encoder
-		compressor *zlib.Writer
-	)
-	if compress {
-		compressor = zlib.NewWriter(&bodyBuffer)
-		encoder = json.NewEncoder(compressor)
-	} else {
-		encoder = json.NewEncoder(&bodyBuffer)
-	}
-	if err := encoder.Encode(bodyObject); err != nil {
-		s.statsd.Count(action+".error_total", 1, []string{"cause:json"}, 1.0)
-		innerLogger.WithError(err).Error("Could not render JSON")
-		return err
-	}
-	if compress {
+	encodingTags := []string{"encoding:" + encoding}
+	var bodyBuffer bytes.Buffer
+	if plugins.ContentEncodingHeader(encoding) != "" {
+		compressStart := time.Now()
+		// the JSON is streamed into the compressor, rather than being held
+		// in memory uncompressed as well
+		reader, writer := io.Pipe()
+		go func() {
+			var err error
+			if body, ok := bodyObject.(bodyEncoder); ok {
+				err = body.encodeTo(writer)
+			} else {
+				err = json.NewEncoder(writer).Encode(bodyObject)
+			}
+			if err != nil {
+				err = jsonError{err}
+			}
+			writer.CloseWithError(err)
+		}()
+		// the encoding and level have been validated, so this can't fail
+		compressor, _ := plugins.NewCompressor(&bodyBuffer, encoding, s.compressionLevel(action))
+		jsonLength, err := io.Copy(compressor, reader)
+		// unblocks the encoder if the compressor failed
+		reader.Close()
+		if err != nil {
+			if encodeErr, ok := err.(jsonError); ok {
+				s.statsd.Count(action+".error_total", 1, []string{"cause:json"}, 1.0)
+				innerLogger.WithError(encodeErr.error).Error("Could not render JSON")
+				return encodeErr.error
+			}
+			s.statsd.Count(action+".error_total", 1, []string{"cause:compress"}, 1.0)
+			innerLogger.WithError(err).Error("Could not compress body")
+			return err
+		}
 		// don't forget to flush leftover compressed bytes to the buffer
 		if err := compressor.Close(); err != nil {
 			s.statsd.Count(action+".error_total", 1, []string{"cause:compress"}, 1.0)
 			innerLogger.WithError(err).Error("Could not finalize compression")
 			return err
 		}
+		s.statsd.TimeInMilliseconds(action+".duration_ns", float64(time.Since(compressStart).Nanoseconds()), []string{"part:compress"}, 1.0)
+		if bodyBuffer.Len() > 0 {
+			s.statsd.Histogram(action+".compression_ratio", float64(jsonLength)/float64(bodyBuffer.Len()), encodingTags, 1.0)
+		}
+	} else {
+		marshalStart := time.Now()
+		var err error
+		if body, ok := bodyObject.(bodyEncoder); ok {
+			err = body.encodeTo(&bodyBuffer)
+		} else {
+			err = json.NewEncoder(&bodyBuffer).Encode(bodyObject)
+		}
+		if err != nil {
+			s.statsd.Count(action+".error_total", 1, []string{"cause:json"}, 1.0)
+			innerLogger.WithError(err).Error("Could not render JSON")
+			return err
+		}
+		s.statsd.TimeInMilliseconds(action+".duration_ns", float64(time.Since(marshalStart).Nanoseconds()), []string{"part:json"}, 1.0)
 	}
-	s.statsd.TimeInMilliseconds(action+".duration_ns", float64(time.Since(marshalStart).Nanoseconds()), []string{"part:json"}, 1.0)
 
-	// Len reports the unread length, so we have to record this before the
-	// http client consumes it
 	bodyLength := bodyBuffer.Len()
-	s.statsd.Histogram(action+".content_length_bytes", float64(bodyLength), nil, 1.0)
+	s.statsd.Histogram(action+".content_length_bytes", float64(bodyLength), encodingTags, 1.0)
 
-	req, err := http.NewRequest(http.MethodPost, endpoint, &bodyBuffer)
+	// failures that might not happen again are retried, if the retry budget
+	// allows, so each attempt needs its own reader of the body
+	body := bodyBuffer.Bytes()
+	err := s.retryBudget.Do(ctx, action, func() error {
+		return s.post(ctx, span, innerLogger, endpoint, body, action, encoding)
+	})
+	if retryable, ok := err.(plugins.RetryableError); ok {
+		return retryable.Err
+	}
+	return err
+}
+
+// jsonError distinguishes an error encoding postHelper's body from one
+// compressing it, when the two are streamed together.
+type jsonError struct {
+	error
+}
+
+// post makes one attempt at POSTing the body for postHelper. Errors that are
+// worth retrying are returned as plugins.RetryableErrors.
+func (s *Server) post(ctx context.Context, span *trace.Span, innerLogger *logrus.Entry, endpoint string, body []byte, action string, encoding string) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
 
 	if err != nil {
 		s.statsd.Count(action+".error_total", 1, []string{"cause:construct"}, 1.0)
 		innerLogger.WithError(err).Error("Could not construct request")
 		return err
 	}
+	req = req.WithContext(ctx)
 	req.Header.Set("Content-Type", "application/json")
-	if compress {
-		req.Header.Set("Content-Encoding", "deflate")
+	if header := plugins.ContentEncodingHeader(encoding); header != "" {
+		req.Header.Set("Content-Encoding", header)
 	}
-	// we only make http requests at flush time, so keepalive is not a big win
-	req.Close = true
 
 	err = tracer.InjectRequest(span.Trace, req)
 	if err != nil {
@@ -643,8 +1148,13 @@ func (s *Server) postHelper(ctx context.Context, endpoint string, bodyObject int
 		innerLogger.WithError(err).Error("Error injecting header")
 	}
 
+	client := s.HTTPClient
+	if s.forwardClient != nil && strings.HasPrefix(action, "forward") {
+		// forwards, whether aggregated, passed through or replayed
+		client = s.forwardClient
+	}
 	requestStart := time.Now()
-	resp, err := s.HTTPClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		if urlErr, ok := err.(*url.Error); ok {
 			// if the error has the url in it, then retrieve the inner error
@@ -653,7 +1163,7 @@ func (s *Server) postHelper(ctx context.Context, endpoint string, bodyObject int
 		}
 		s.statsd.Count(action+".error_total", 1, []string{"cause:io"}, 1.0)
 		innerLogger.WithError(err).Error("Could not execute request")
-		return err
+		return plugins.RetryableError{Err: err}
 	}
 	s.statsd.TimeInMilliseconds(action+".duration_ns", float64(time.Since(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
 	defer resp.Body.Close()
@@ -666,7 +1176,7 @@ func (s *Server) postHelper(ctx context.Context, endpoint string, bodyObject int
 		innerLogger.WithError(err).Error("Could not read response body")
 	}
 	resultLogger := innerLogger.WithFields(logrus.Fields{
-		"request_length":   bodyLength,
+		"request_length":   len(body),
 		"request_headers":  req.Header,
 		"status":           resp.Status,
 		"response_headers": resp.Header,
@@ -676,6 +1186,10 @@ func (s *Server) postHelper(ctx context.Context, endpoint string, bodyObject int
 	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
 		s.statsd.Count(action+".error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
 		resultLogger.Error("Could not POST")
+		err = fmt.Errorf("received %s from %s", resp.Status, endpoint)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return plugins.RetryableError{Err: err}
+		}
 		return err
 	}
 
@@ -1,18 +1,33 @@
 package veneur
 
 import (
+	"bytes"
+	"compress/zlib"
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/plugins/shadow"
 	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/trace"
 )
 
 func TestServerTags(t *testing.T) {
@@ -24,11 +39,269 @@ func TestServerTags(t *testing.T) {
 		Interval:   10,
 	}}
 
-	finalizeMetrics("somehostname", []string{"a:b", "c:d"}, metrics)
+	finalizeMetrics("somehostname", []string{"a:b", "c:d"}, tagMerger{}, metrics)
 	assert.Equal(t, "somehostname", metrics[0].Hostname, "Metric hostname uses argument")
 	assert.Contains(t, metrics[0].Tags, "a:b", "Tags should contain server tags")
 }
 
+func TestTagHostname(t *testing.T) {
+	metrics := []samplers.DDMetric{
+		{Name: "a", Tags: []string{"x:e"}},
+		{Name: "b", Tags: []string{"node:already"}},
+	}
+	finalizeMetrics("", []string{"a:b"}, tagMerger{}, metrics)
+	tagHostname("node", "node-1", tagMerger{}, metrics)
+	assert.Equal(t, []string{"x:e", "a:b", "node:node-1"}, metrics[0].Tags)
+	assert.Equal(t, []string{"node:already", "a:b"}, metrics[1].Tags, "existing tags with the key take precedence")
+	assert.Equal(t, "", metrics[0].Hostname)
+
+	tagHostname("node", "", tagMerger{}, metrics)
+	assert.Len(t, metrics[0].Tags, 3, "an empty hostname should not be tagged")
+}
+
+func TestFlushOmitEmptyHistograms(t *testing.T) {
+	s := &Server{
+		interval:            10 * time.Second,
+		HistogramAggregates: samplers.HistogramAggregates{Value: samplers.AggregateMedian | samplers.AggregateCount, Count: 2},
+	}
+	percentiles := []float64{0.9}
+
+	empty := samplers.NewHist("a.b.c", nil)
+	assert.Len(t, s.flushHistogram(empty, s.interval, percentiles, true), 2, "empty histograms are still flushed by default")
+
+	s.omitEmptyHistograms = true
+	assert.Len(t, s.flushHistogram(empty, s.interval, percentiles, true), 0, "empty histogram should not be flushed")
+
+	full := samplers.NewHist("a.b.c", nil)
+	full.Sample(5, 1.0)
+	assert.Len(t, s.flushHistogram(full, s.interval, percentiles, true), 3, "non-empty histogram should still be flushed")
+}
+
+func TestReportHeartbeat(t *testing.T) {
+	stats, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stats.Close()
+	client, err := statsd.New(stats.LocalAddr().String())
+	assert.NoError(t, err)
+	client.Namespace = internalMetricsPrefix
+	s := &Server{Hostname: "node-1", statsd: client}
+
+	read := func() string {
+		buf := make([]byte, 1024)
+		stats.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := stats.ReadFrom(buf)
+		if err != nil {
+			return ""
+		}
+		return string(buf[:n])
+	}
+	s.reportHeartbeat()
+	assert.Equal(t, "veneur.heartbeat:1.000000|g|#host:node-1", read())
+
+	s.hostnameTag = "node"
+	s.reportHeartbeat()
+	assert.Equal(t, "veneur.heartbeat:1.000000|g|#node:node-1", read(), "the host should be tagged with hostname_tag")
+
+	s.omitHeartbeat = true
+	s.reportHeartbeat()
+	stats.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	_, _, err = stats.ReadFrom(make([]byte, 1024))
+	assert.Error(t, err, "no heartbeat should be reported if it's omitted")
+}
+
+// readStats returns every metric sent to stats until nothing more arrives.
+func readStats(stats net.PacketConn) []string {
+	var metrics []string
+	buf := make([]byte, 1024)
+	for {
+		stats.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		n, _, err := stats.ReadFrom(buf)
+		if err != nil {
+			return metrics
+		}
+		metrics = append(metrics, strings.Split(string(buf[:n]), "\n")...)
+	}
+}
+
+func TestReportTracer(t *testing.T) {
+	stats, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stats.Close()
+	client, err := statsd.New(stats.LocalAddr().String())
+	assert.NoError(t, err)
+	client.Namespace = internalMetricsPrefix
+	s := &Server{statsd: client}
+
+	sampler, err := trace.NewAdaptiveSampler(100, nil, trace.SampleAtStart)
+	assert.NoError(t, err)
+	limited := trace.Tracer{MaxDepth: 1, Counts: &trace.SpanCounts{}}
+	child := limited.StartSpan("child", opentracing.ChildOf(limited.StartSpan("root").Context()))
+	limited.StartSpan("grandchild", opentracing.ChildOf(child.Context()))
+	limited.StartSpan("grandchild", opentracing.ChildOf(child.Context()))
+	limited.Sampler = sampler
+	s.reportTracer(limited)
+	metrics := readStats(stats)
+	assert.Contains(t, metrics, "veneur.tracer.sampling_rate:1.000000|g")
+	assert.Contains(t, metrics, "veneur.tracer.spans_active:2.000000|g")
+	assert.Contains(t, metrics, "veneur.tracer.spans_depth_limited_total:2|c")
+	assert.Contains(t, metrics, "veneur.tracer.tags_truncated_total:0|c")
+	assert.Contains(t, metrics, "veneur.tracer.annotations_dropped_total:0|c")
+
+	s.reportTracer(trace.Tracer{Counts: &trace.SpanCounts{}})
+	for _, metric := range readStats(stats) {
+		assert.NotContains(t, metric, "sampling_rate", "a tracer without a sampler keeps every span")
+	}
+}
+
+func TestTracerMaxSpansPerSecondConfig(t *testing.T) {
+	defer func() {
+		tracer.Sampler = nil
+		opentracing.SetGlobalTracer(tracer)
+	}()
+	config := localConfig()
+	config.TracerMaxSpansPerSecond = -1
+	_, err := NewFromConfig(config)
+	assert.Error(t, err)
+
+	config.TracerMaxSpansPerSecond = 500
+	_, err = NewFromConfig(config)
+	assert.NoError(t, err)
+	if assert.NotNil(t, tracer.Sampler) {
+		assert.Equal(t, float64(1), tracer.Sampler.Rate())
+	}
+	assert.Equal(t, tracer.Sampler, opentracing.GlobalTracer().(trace.Tracer).Sampler, "spans started from contexts should be sampled too")
+}
+
+func TestHistogramCountSuffixConfig(t *testing.T) {
+	config := localConfig()
+	config.HistogramCountSuffix = "observations"
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, "observations", s.HistogramAggregates.CountSuffix)
+	assert.Equal(t, len(config.Aggregates)+1, s.HistogramAggregates.Count)
+
+	for _, suffix := range []string{"count", "99percentile"} {
+		config.HistogramCountSuffix = suffix
+		_, err = NewFromConfig(config)
+		assert.Error(t, err, "%s would clash with an aggregate", suffix)
+	}
+}
+
+func TestStartFlushPhase(t *testing.T) {
+	parent := tracer.StartSpan("flush").(*trace.Span)
+	ctx := parent.Attach(context.Background())
+
+	s := &Server{}
+	span, phaseCtx := s.startFlushPhase(ctx, "tallyMetrics")
+	assert.Nil(t, span, "phases should not be traced unless configured")
+	assert.Nil(t, opentracing.SpanFromContext(phaseCtx))
+	span.Finish()
+
+	s.traceFlushPhases = true
+	span, phaseCtx = s.startFlushPhase(ctx, "tallyMetrics")
+	assert.NotNil(t, span)
+	assert.Equal(t, parent.TraceId, span.TraceId)
+	assert.Equal(t, parent.SpanId, span.ParentId, "phase should be a child of the flush")
+	assert.Equal(t, span, opentracing.SpanFromContext(phaseCtx))
+	span.Finish()
+}
+
+func TestChunkMetricsByteLimit(t *testing.T) {
+	metrics := make([]samplers.DDMetric, 1000)
+	for i := range metrics {
+		metrics[i] = samplers.DDMetric{
+			Name:       fmt.Sprintf("a.b.c.%04d", i),
+			Value:      [1][2]float64{{1500000000, float64(i)}},
+			Tags:       []string{"foo:bar", "baz:quz"},
+			MetricType: "gauge",
+			Hostname:   "localhost",
+		}
+	}
+	encoded, err := json.Marshal(metrics[0])
+	assert.NoError(t, err)
+	metricBytes := len(encoded)
+
+	const maxBytes = 10000
+	// each chunk holds as many metrics (and commas between them) as fit
+	// alongside the envelope
+	perChunk := (maxBytes - seriesEnvelopeBytes + 1) / (metricBytes + 1)
+	// the count limit splits the metrics into 4 chunks of 250 first
+	expected := 4 * ((250-1)/perChunk + 1)
+
+	chunks := chunkMetrics(metrics, 300, maxBytes)
+	assert.Len(t, chunks, expected)
+	var flushed []samplers.DDMetric
+	for _, chunk := range chunks {
+		var body bytes.Buffer
+		assert.NoError(t, json.NewEncoder(&body).Encode(map[string][]samplers.DDMetric{"series": chunk}))
+		assert.True(t, body.Len() <= maxBytes, "chunk of %d bytes is over the limit", body.Len())
+		assert.True(t, len(chunk) <= 300)
+		flushed = append(flushed, chunk...)
+	}
+	assert.Equal(t, metrics, flushed, "every metric should be flushed exactly once, in order")
+
+	assert.Len(t, chunkMetrics(metrics, 300, 0), 4, "without a byte limit, only the count limit applies")
+
+	chunks = chunkMetrics(metrics[:3], 300, 1)
+	assert.Len(t, chunks, 3, "metrics over the limit by themselves should each get a chunk")
+}
+
+func TestFlushRemoteShadow(t *testing.T) {
+	decode := func(r *http.Request) []samplers.DDMetric {
+		zr, err := zlib.NewReader(r.Body)
+		assert.NoError(t, err)
+		var body DDMetricsRequest
+		assert.NoError(t, json.NewDecoder(zr).Decode(&body))
+		return body.Series
+	}
+	primaryMetrics := make(chan []samplers.DDMetric, 1)
+	primary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		primaryMetrics <- decode(r)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer primary.Close()
+	shadowMetrics := make(chan []samplers.DDMetric, 1)
+	staging := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "stagingkey", r.URL.Query().Get("api_key"))
+		shadowMetrics <- decode(r)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer staging.Close()
+
+	s := &Server{
+		DDHostname:      primary.URL,
+		DDAPIKey:        "primarykey",
+		HTTPClient:      &http.Client{},
+		FlushMaxPerBody: 100,
+		breakers:        newSinkBreakers(1, time.Hour),
+	}
+	s.datadogShadow = shadow.NewSender(&datadogShadowPlugin{
+		server:     s,
+		ddHostname: staging.URL,
+		apiKey:     "stagingkey",
+	}, logrus.New(), nil)
+
+	metrics := []samplers.DDMetric{{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{{1500000000, 1}},
+		MetricType: "gauge",
+		Hostname:   "localhost",
+	}}
+	s.flushRemote(context.Background(), metrics)
+	assert.Equal(t, metrics, <-primaryMetrics)
+	select {
+	case shadowed := <-shadowMetrics:
+		assert.Equal(t, metrics, shadowed)
+	case <-time.After(time.Second):
+		assert.Fail(t, "nothing was sent to the shadow")
+	}
+	assert.Equal(t, breakerClosed, s.breakers.get(datadogSinkName).State(), "the shadow's failure shouldn't count against the primary")
+}
+
 func TestHostMagicTag(t *testing.T) {
 	metrics := []samplers.DDMetric{{
 		Name:       "foo.bar.baz",
@@ -38,7 +311,7 @@ func TestHostMagicTag(t *testing.T) {
 		Interval:   10,
 	}}
 
-	finalizeMetrics("badhostname", []string{"a:b", "c:d"}, metrics)
+	finalizeMetrics("badhostname", []string{"a:b", "c:d"}, tagMerger{}, metrics)
 	assert.Equal(t, "abc123", metrics[0].Hostname, "Metric hostname should be from tag")
 	assert.NotContains(t, metrics[0].Tags, "host:abc123", "Host tag should be removed")
 	assert.Contains(t, metrics[0].Tags, "x:e", "Last tag is still around")
@@ -53,7 +326,7 @@ func TestDeviceMagicTag(t *testing.T) {
 		Interval:   10,
 	}}
 
-	finalizeMetrics("badhostname", []string{"a:b", "c:d"}, metrics)
+	finalizeMetrics("badhostname", []string{"a:b", "c:d"}, tagMerger{}, metrics)
 	assert.Equal(t, "abc123", metrics[0].DeviceName, "Metric devicename should be from tag")
 	assert.NotContains(t, metrics[0].Tags, "device:abc123", "Host tag should be removed")
 	assert.Contains(t, metrics[0].Tags, "x:e", "Last tag is still around")
@@ -94,6 +367,33 @@ func TestFlushTraces(t *testing.T) {
 	}
 }
 
+func TestFlushTraceMeasured(t *testing.T) {
+	tracer := trace.Tracer{}
+	root := tracer.StartSpan("root")
+	span := tracer.StartSpan("query", opentracing.ChildOf(root.Context()), trace.Measured()).(*trace.Span)
+	span.Finish()
+	sample := span.SSFSample()
+	packet, err := proto.Marshal(sample)
+	assert.NoError(t, err)
+
+	expected, err := json.Marshal([]*DatadogTraceSpan{{
+		TraceID:  sample.Trace.TraceId,
+		SpanID:   sample.Trace.Id,
+		ParentID: sample.Trace.ParentId,
+		Service:  sample.Service,
+		Name:     sample.Name,
+		Resource: "root",
+		Start:    sample.Timestamp,
+		Duration: sample.Trace.Duration,
+		Type:     "http",
+		Meta:     map[string]string{},
+		Metrics:  map[string]float64{trace.MeasuredTag: 1},
+	}})
+	assert.NoError(t, err)
+
+	testFlushTrace(t, bytes.NewReader(packet), bytes.NewReader(expected))
+}
+
 func testFlushTrace(t *testing.T, protobuf, jsn io.Reader) {
 
 	RemoteResponseChan := make(chan struct{}, 1)
@@ -140,3 +440,225 @@ func testFlushTrace(t *testing.T, protobuf, jsn io.Reader) {
 	assert.NoError(t, err)
 	server.Flush()
 }
+
+func TestForwardCompressionLevel(t *testing.T) {
+	var received []samplers.JSONMetric
+	globalVeneur := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "deflate", r.Header.Get("Content-Encoding"))
+		zr, err := zlib.NewReader(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.NewDecoder(zr).Decode(&received))
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer globalVeneur.Close()
+
+	s := &Server{HTTPClient: &http.Client{}, forwardCompressionLevel: zlib.BestSpeed}
+	assert.Equal(t, zlib.BestSpeed, s.compressionLevel("forward"))
+	assert.Equal(t, zlib.DefaultCompression, s.compressionLevel("flush"), "only forwards use the configured level")
+
+	metrics := []samplers.JSONMetric{{MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "histogram"}, Value: []byte("value")}}
+	assert.NoError(t, s.postHelper(context.Background(), globalVeneur.URL+"/import", metrics, "forward", plugins.EncodingDeflate))
+	assert.Equal(t, metrics, received)
+
+	// a body that can't be encoded is never sent
+	received = nil
+	assert.Error(t, s.postHelper(context.Background(), globalVeneur.URL+"/import", []float64{math.NaN()}, "forward", plugins.EncodingDeflate))
+	assert.Nil(t, received)
+
+	config := localConfig()
+	config.ForwardCompressionLevel = 10
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "10 is not a zlib level")
+}
+
+func TestPostHelperRetries(t *testing.T) {
+	var requests int32
+	statuses := []int{http.StatusServiceUnavailable, http.StatusAccepted, http.StatusBadRequest}
+	var bodies []string
+	sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&requests, 1)
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(statuses[(n-1)%int32(len(statuses))])
+	}))
+	defer sink.Close()
+
+	s := &Server{HTTPClient: &http.Client{}}
+	assert.Error(t, s.postHelper(context.Background(), sink.URL, []string{"a"}, "flush", plugins.EncodingNone), "without a budget, nothing is retried")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	atomic.StoreInt32(&requests, 0)
+	bodies = nil
+	s.retryBudget = plugins.NewRetryBudget(0.001, 1, 2, nil)
+	assert.NoError(t, s.postHelper(context.Background(), sink.URL, []string{"a"}, "flush", plugins.EncodingNone), "the 503 should be retried")
+	assert.Equal(t, []string{"[\"a\"]\n", "[\"a\"]\n"}, bodies, "each attempt should send the whole body")
+
+	// a 400 isn't worth retrying, and the next 503 finds the budget spent
+	err := s.postHelper(context.Background(), sink.URL, []string{"a"}, "flush", plugins.EncodingNone)
+	assert.Equal(t, fmt.Sprintf("received 400 Bad Request from %s", sink.URL), err.Error())
+	assert.Error(t, s.postHelper(context.Background(), sink.URL, []string{"a"}, "flush", plugins.EncodingNone))
+	assert.Equal(t, int32(4), atomic.LoadInt32(&requests))
+
+	config := localConfig()
+	config.SinkRetryBudgetRate = -1
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestFlushRemoteSkipsUnserializable(t *testing.T) {
+	received := make(chan []samplers.DDMetric, 1)
+	remote := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		zr, err := zlib.NewReader(r.Body)
+		assert.NoError(t, err)
+		var body DDMetricsRequest
+		assert.NoError(t, json.NewDecoder(zr).Decode(&body))
+		received <- body.Series
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer remote.Close()
+
+	s := &Server{
+		DDHostname:      remote.URL,
+		HTTPClient:      &http.Client{},
+		FlushMaxPerBody: 100,
+		breakers:        newSinkBreakers(1, time.Hour),
+	}
+	good := samplers.DDMetric{Name: "a.b.c", Value: [1][2]float64{{1500000000, 1}}, MetricType: "gauge", Hostname: "localhost"}
+	bad := samplers.DDMetric{Name: "d.e.f", Value: [1][2]float64{{1500000000, math.NaN()}}, MetricType: "gauge", Hostname: "localhost"}
+	s.flushRemote(context.Background(), []samplers.DDMetric{good, bad})
+	assert.Equal(t, []samplers.DDMetric{good}, <-received, "the NaN should be skipped, not fail the flush")
+	assert.Equal(t, breakerClosed, s.breakers.get(datadogSinkName).State())
+}
+
+func TestTagMerger(t *testing.T) {
+	metrics := []samplers.DDMetric{{Name: "a", Tags: []string{"env:staging", "transport:udp"}}}
+	finalizeMetrics("host", []string{"env:prod", "dc:east"}, tagMerger{}, metrics)
+	assert.Equal(t, []string{"env:staging", "transport:udp", "dc:east"}, metrics[0].Tags, "the metric's own tags should win by default")
+
+	// the listener's tags are told apart from the client's by their key
+	merger := tagMerger{
+		precedence:   samplers.TagPrecedence{samplers.TagSourceClient, samplers.TagSourceHost, samplers.TagSourceListener},
+		listenerKeys: map[string]bool{"transport": true},
+	}
+	metrics = []samplers.DDMetric{{Name: "a", Tags: []string{"env:staging", "transport:udp"}}}
+	finalizeMetrics("host", []string{"env:prod", "transport:none"}, merger, metrics)
+	assert.Equal(t, []string{"env:staging", "transport:none"}, metrics[0].Tags)
+
+	own := []string{"env:staging"}
+	assert.Equal(t, own, merger.merge(own, nil), "with nothing to merge, the tags are left alone")
+
+	config := localConfig()
+	config.TagPrecedence = []string{"client"}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestFlushPartsConcurrency(t *testing.T) {
+	var inFlight, most, requests int32
+	release := make(chan struct{})
+	datadog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&inFlight, -1)
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer datadog.Close()
+
+	chunks := make([][]samplers.DDMetric, 3*defaultMaxRequestsInFlight)
+	for i := range chunks {
+		chunks[i] = []samplers.DDMetric{{Name: fmt.Sprintf("a.b.c%d", i), MetricType: "gauge"}}
+	}
+	s := &Server{HTTPClient: &http.Client{}}
+	done := make(chan error)
+	go func() {
+		done <- s.flushParts(context.Background(), datadog.URL, "key", chunks, "flush")
+	}()
+	for atomic.LoadInt32(&inFlight) < defaultMaxRequestsInFlight {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, int32(defaultMaxRequestsInFlight), atomic.LoadInt32(&most), "no more than the limit should be POSTed at once")
+	assert.Equal(t, int32(len(chunks)), atomic.LoadInt32(&requests))
+}
+
+func TestWarmupFlushes(t *testing.T) {
+	s := &Server{
+		Workers:       []*Worker{NewWorker(1, nil, logrus.New())},
+		interval:      10 * time.Second,
+		warmupFlushes: 2,
+	}
+	process := func(packet string) {
+		m, err := samplers.ParseMetric([]byte(packet))
+		assert.NoError(t, err)
+		s.Workers[0].ProcessMetric(m)
+	}
+
+	process("a.b.c:20|c")
+	assert.True(t, s.skipWarmupFlush())
+	assert.Equal(t, 0, s.seriesCount(), "the partial window should be thrown away")
+	process("a.b.c:20|c")
+	s.Flush()
+	assert.Equal(t, 0, s.seriesCount())
+	assert.False(t, s.skipWarmupFlush(), "only the first warmup_flushes are skipped")
+
+	process("a.b.c:30|c")
+	tempMetrics, ms := s.tallyMetrics(nil)
+	finalMetrics := s.generateDDMetrics(context.Background(), nil, tempMetrics, ms)
+	if assert.Len(t, finalMetrics, 1) {
+		// only what was received since the last skipped flush
+		assert.Equal(t, 3.0, finalMetrics[0].Value[0][1])
+	}
+
+	config := localConfig()
+	config.WarmupFlushes = -1
+	_, err := NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestFlushTimestampAlignment(t *testing.T) {
+	s := &Server{interval: 10 * time.Second}
+	now := time.Unix(1000013, 0)
+	assert.Equal(t, 0.0, s.alignedTimestamp(now, s.interval), "metrics are reported at flush time by default")
+	s.flushTimestampAlignment = flushTimestampEnd
+	assert.Equal(t, 1000010.0, s.alignedTimestamp(now, s.interval))
+	assert.Equal(t, 1000020.0, s.alignedTimestamp(now.Add(3*time.Second), s.interval), "the nearest boundary is the end")
+	s.flushTimestampAlignment = flushTimestampStart
+	assert.Equal(t, 1000000.0, s.alignedTimestamp(now, s.interval))
+	assert.Equal(t, 999980.0, s.alignedTimestamp(now, 3*s.interval), "a paused window starts further back")
+
+	s.Workers = []*Worker{NewWorker(1, nil, logrus.New())}
+	s.flushTimestampAlignment = flushTimestampEnd
+	parser := samplers.Parser{ExplicitTimestamps: true}
+	for _, packet := range []string{"a.b.c:1|c", "a.b.d:1|g", "a.b.e:1|ms", "a.b.f:1|c|#veneurlocalonly", "a.b.g:1|c|T1000"} {
+		m, err := parser.ParseMetric([]byte(packet))
+		assert.NoError(t, err)
+		s.Workers[0].ProcessMetric(m)
+	}
+	tempMetrics, ms := s.tallyMetrics(nil)
+	finalMetrics := s.generateDDMetrics(context.Background(), nil, tempMetrics, ms)
+	assert.NotEmpty(t, finalMetrics)
+	explicit := 0
+	for _, m := range finalMetrics {
+		if m.Name == "a.b.g" {
+			assert.Equal(t, 1000.0, m.Value[0][0], "explicit timestamps are kept")
+			explicit++
+			continue
+		}
+		assert.Equal(t, 0.0, math.Mod(m.Value[0][0], 10), "%s should be reported at a multiple of the interval", m.Name)
+	}
+	assert.Equal(t, 1, explicit)
+
+	config := localConfig()
+	config.FlushTimestampAlignment = "middle"
+	_, err := NewFromConfig(config)
+	assert.Error(t, err)
+}
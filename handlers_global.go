@@ -1,16 +1,19 @@
 package veneur
 
 import (
-	"compress/zlib"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"reflect"
+	"strconv"
+	"sync/atomic"
 	"time"
 
+	"github.com/stripe/veneur/plugins"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/trace"
 )
@@ -34,6 +37,27 @@ func handleImport(s *Server) http.Handler {
 			span        *trace.Span
 		)
 
+		if !s.acquireImport() {
+			// tell forwarders to come back after their next flush, rather
+			// than piling on while we're busy
+			retryAfter := int(math.Ceil(s.interval.Seconds()))
+			if retryAfter < 1 {
+				retryAfter = 1
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			http.Error(w, "too many imports in progress", http.StatusServiceUnavailable)
+			s.statsd.Count("import.request_error_total", 1, []string{"cause:saturated"}, 1.0)
+			return
+		}
+		// released by ImportMetrics once the import is done, or right away
+		// if we bail out before then
+		importing := false
+		defer func() {
+			if !importing {
+				s.releaseImport()
+			}
+		}()
+
 		span, err = tracer.ExtractRequestChild("/import", r, "veneur.opentracing.import")
 		if err != nil {
 			log.WithError(err).Info("Could not extract span from request")
@@ -49,13 +73,13 @@ func handleImport(s *Server) http.Handler {
 		case "":
 			body = r.Body
 			encoding = "identity"
-		case "deflate":
-			body, err = zlib.NewReader(r.Body)
+		case plugins.EncodingDeflate, plugins.EncodingGzip:
+			body, err = plugins.NewDecompressor(r.Body, encoding)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadRequest)
 				span.Error(err)
 				encLogger.WithError(err).Error("Could not read compressed request body")
-				s.statsd.Count("import.request_error_total", 1, []string{"cause:deflate"}, 1.0)
+				s.statsd.Count("import.request_error_total", 1, []string{"cause:" + encoding}, 1.0)
 				return
 			}
 			defer body.Close()
@@ -104,10 +128,36 @@ func handleImport(s *Server) http.Handler {
 
 		// the server usually waits for this to return before finalizing the
 		// response, so this part must be done asynchronously
-		go s.ImportMetrics(span.Attach(ctx), jsonMetrics)
+		importing = true
+		go func() {
+			defer s.releaseImport()
+			s.ImportMetrics(span.Attach(ctx), jsonMetrics)
+		}()
 	})
 }
 
+// acquireImport reserves a slot for an import request, returning false if
+// the configured number of imports are already in progress.
+func (s *Server) acquireImport() bool {
+	if s.importSem != nil {
+		select {
+		case s.importSem <- struct{}{}:
+		default:
+			return false
+		}
+	}
+	atomic.AddInt64(&s.importsInFlight, 1)
+	return true
+}
+
+// releaseImport frees a slot reserved by acquireImport.
+func (s *Server) releaseImport() {
+	atomic.AddInt64(&s.importsInFlight, -1)
+	if s.importSem != nil {
+		<-s.importSem
+	}
+}
+
 // nonEmpty returns true if there is at least one non-empty
 // metric
 func (s *Server) nonEmpty(ctx context.Context, jsonMetrics []samplers.JSONMetric) bool {
@@ -0,0 +1,52 @@
+package veneur
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// HistogramCompression sets the compression of the t-digests that
+// percentiles are estimated from, for histograms and timers whose name
+// matches the Name regular expression. The default is
+// samplers.DefaultHistogramCompression; higher compressions give more
+// accurate percentiles at the cost of more memory per series, and lower ones
+// the reverse.
+type HistogramCompression struct {
+	Name        string  `yaml:"name"`
+	Compression float64 `yaml:"compression"`
+}
+
+// histogramCompressions is a compiled, ordered list of HistogramCompressions.
+// The first one whose name matches a metric decides its compression.
+type histogramCompressions []histogramCompression
+
+type histogramCompression struct {
+	name        *regexp.Regexp
+	compression float64
+}
+
+func newHistogramCompressions(compressions []HistogramCompression) (histogramCompressions, error) {
+	var hc histogramCompressions
+	for i, c := range compressions {
+		if c.Compression < 1 {
+			return nil, fmt.Errorf("histogram compression %d: compression must be at least 1, got %v", i, c.Compression)
+		}
+		re, err := regexp.Compile(c.Name)
+		if err != nil {
+			return nil, fmt.Errorf("histogram compression %d: %s", i, err)
+		}
+		hc = append(hc, histogramCompression{name: re, compression: c.Compression})
+	}
+	return hc, nil
+}
+
+// compressionFor returns the compression for histograms and timers with the
+// given name, and false if none of the rules match it.
+func (hc histogramCompressions) compressionFor(name string) (float64, bool) {
+	for _, c := range hc {
+		if c.name.MatchString(name) {
+			return c.compression, true
+		}
+	}
+	return 0, false
+}
@@ -0,0 +1,71 @@
+package veneur
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+// histogram_distributions flushes histograms and timers as a single
+// distribution metric, for the sinks that take them, either alongside their
+// percentiles or instead of them. Other sinks get the percentiles either way.
+const (
+	distributionsAlongside = "alongside"
+	distributionsInstead   = "instead"
+)
+
+func checkHistogramDistributions(mode string) error {
+	switch mode {
+	case "", distributionsAlongside, distributionsInstead:
+		return nil
+	}
+	return fmt.Errorf("histogram_distributions must be %q or %q, got %q", distributionsAlongside, distributionsInstead, mode)
+}
+
+// takesDistributions reports whether the plugin, or registered sink,
+// declared that it takes distribution metrics.
+func takesDistributions(sink interface{}) bool {
+	ds, ok := sink.(plugins.DistributionSink)
+	return ok && ds.TakesDistributions()
+}
+
+// forRepresentation returns the metrics that a sink should get, depending on
+// whether it takes distributions: the distribution metrics are left out for
+// one that doesn't, and the percentiles they replace are left out for one
+// that does, if histogram_distributions is "instead". metrics is never
+// modified, since other sinks share it.
+func (s *Server) forRepresentation(metrics []samplers.DDMetric, distributions bool) []samplers.DDMetric {
+	if s.histogramDistributions == "" || (distributions && s.histogramDistributions == distributionsAlongside) {
+		return metrics
+	}
+	var skip map[string]bool
+	if distributions {
+		skip = map[string]bool{}
+		for _, m := range metrics {
+			if m.MetricType != "distribution" {
+				continue
+			}
+			for _, p := range s.HistogramPercentiles {
+				skip[distributionKey(fmt.Sprintf("%s.%dpercentile", m.Name, int(p*100)), m.Tags)] = true
+			}
+		}
+	}
+	kept := make([]samplers.DDMetric, 0, len(metrics))
+	for _, m := range metrics {
+		if distributions {
+			if m.MetricType == "gauge" && skip[distributionKey(m.Name, m.Tags)] {
+				continue
+			}
+		} else if m.MetricType == "distribution" {
+			continue
+		}
+		kept = append(kept, m)
+	}
+	return kept
+}
+
+func distributionKey(name string, tags []string) string {
+	return name + "|" + strings.Join(tags, ",")
+}
@@ -0,0 +1,117 @@
+package veneur
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+// distributionPlugin keeps what it was flushed, and takes distributions if
+// takes is set.
+type distributionPlugin struct {
+	name    string
+	takes   bool
+	metrics []samplers.DDMetric
+}
+
+func (p *distributionPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	p.metrics = metrics
+	return nil
+}
+
+func (p *distributionPlugin) Name() string { return p.name }
+
+func (p *distributionPlugin) TakesDistributions() bool { return p.takes }
+
+func TestHistogramDistributionsConfig(t *testing.T) {
+	config := globalConfig()
+	config.HistogramDistributions = "sometimes"
+	_, err := NewFromConfig(config)
+	assert.Error(t, err)
+
+	config.HistogramDistributions = distributionsInstead
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, distributionsInstead, s.histogramDistributions)
+}
+
+func TestHistogramDistributions(t *testing.T) {
+	flushed := func(mode string) map[string][]string {
+		config := globalConfig()
+		config.Percentiles = []float64{0.5}
+		config.HistogramDistributions = mode
+		s, err := NewFromConfig(config)
+		assert.NoError(t, err)
+		takes := &distributionPlugin{name: "sketches", takes: true}
+		doesnt := &distributionPlugin{name: "gauges"}
+		s.registerPlugin(takes)
+		s.registerPlugin(doesnt)
+
+		wm := NewWorkerMetrics()
+		h := samplers.NewHist("a.b.c", nil)
+		h.Sample(1, 1.0)
+		wm.histograms[samplers.MetricKey{Name: "a.b.c", Type: "histogram"}] = h
+		metrics := s.generateDDMetrics(context.Background(), s.HistogramPercentiles, []WorkerMetrics{wm}, metricsSummary{})
+		s.flushPlugins(context.Background(), metrics, nil)
+
+		names := map[string][]string{}
+		for _, p := range []*distributionPlugin{takes, doesnt} {
+			for _, m := range p.metrics {
+				if m.MetricType == "distribution" || m.Name == "a.b.c.50percentile" {
+					names[p.name] = append(names[p.name], m.Name)
+				}
+			}
+		}
+		names["datadog"] = nil
+		for _, m := range s.forRepresentation(metrics, false) {
+			if m.MetricType == "distribution" {
+				names["datadog"] = append(names["datadog"], m.Name)
+			}
+		}
+		return names
+	}
+
+	assert.Equal(t, map[string][]string{
+		"sketches": {"a.b.c.50percentile"},
+		"gauges":   {"a.b.c.50percentile"},
+		"datadog":  nil,
+	}, flushed(""), "histograms are only flushed as percentiles by default")
+	assert.Equal(t, map[string][]string{
+		"sketches": {"a.b.c.50percentile", "a.b.c"},
+		"gauges":   {"a.b.c.50percentile"},
+		"datadog":  nil,
+	}, flushed(distributionsAlongside))
+	assert.Equal(t, map[string][]string{
+		"sketches": {"a.b.c"},
+		"gauges":   {"a.b.c.50percentile"},
+		"datadog":  nil,
+	}, flushed(distributionsInstead), "sinks that don't take distributions still get percentiles")
+}
+
+func TestHistogramDistributionsWithoutPercentiles(t *testing.T) {
+	config := globalConfig()
+	config.Percentiles = nil
+	config.HistogramDistributions = distributionsAlongside
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+
+	wm := NewWorkerMetrics()
+	h := samplers.NewHist("a.b.c", nil)
+	h.Sample(1, 1.0)
+	wm.histograms[samplers.MetricKey{Name: "a.b.c", Type: "histogram"}] = h
+	distributions := func() []string {
+		var names []string
+		for _, m := range s.generateDDMetrics(context.Background(), nil, []WorkerMetrics{wm}, metricsSummary{}) {
+			if m.MetricType == "distribution" {
+				names = append(names, m.Name)
+			}
+		}
+		return names
+	}
+	assert.Equal(t, []string{"a.b.c"}, distributions(), "histograms are flushed as distributions even without percentiles")
+
+	s.ForwardAddr = "http://global"
+	assert.Empty(t, distributions(), "a local veneur leaves forwarded histograms to the global one")
+}
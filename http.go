@@ -1,12 +1,19 @@
 package veneur
 
 import (
+	"encoding/json"
+	"fmt"
 	"hash/fnv"
+	"math"
 	"net/http"
 	"net/http/pprof"
+	"net/url"
 	"sort"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/trace"
 
@@ -21,10 +28,55 @@ func (s *Server) Handler() http.Handler {
 
 	mux.HandleFuncC(pat.Get("/healthcheck"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte("ok\n"))
+		// a sink being down doesn't make veneur itself unhealthy, but it's
+		// worth showing
+		sinks, states := s.breakers.states()
+		for i, sink := range sinks {
+			fmt.Fprintf(w, "sink %s: circuit %s\n", sink, states[i])
+		}
+		if until, held := s.flushPause.state(); !until.IsZero() {
+			fmt.Fprintf(w, "flush: paused until %s, %d flushes held\n", until.Format(time.RFC3339), held)
+		}
 	})
 
 	mux.Handle(pat.Post("/import"), handleImport(s))
 
+	mux.HandleFuncC(pat.Get("/metrics"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s.handleScrape(w, r)
+	})
+
+	mux.HandleFuncC(pat.Get("/debug/histogram"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s.handleHistogramQuantile(w, r)
+	})
+
+	mux.HandleFuncC(pat.Get("/debug/config"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s.handleDebugConfig(w, r)
+	})
+
+	mux.HandleFuncC(pat.Get("/debug/flush"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s.handleDebugFlush(w, r)
+	})
+
+	mux.HandleFuncC(pat.Get("/debug/trace-canary"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s.handleTraceCanary(w, r)
+	})
+
+	mux.HandleFuncC(pat.Get("/debug/trace-canary/echo"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s.handleTraceCanaryEcho(w, r)
+	})
+
+	mux.HandleFuncC(pat.Post("/admin/metrics/reset"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s.handleMetricReset(w, r)
+	})
+
+	mux.HandleFuncC(pat.Post("/admin/flush/pause"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s.handleFlushPause(w, r)
+	})
+
+	mux.HandleFuncC(pat.Post("/admin/flush/resume"), func(c context.Context, w http.ResponseWriter, r *http.Request) {
+		s.handleFlushResume(w, r)
+	})
+
 	mux.Handle(pat.Get("/debug/pprof/cmdline"), http.HandlerFunc(pprof.Cmdline))
 	mux.Handle(pat.Get("/debug/pprof/profile"), http.HandlerFunc(pprof.Profile))
 	mux.Handle(pat.Get("/debug/pprof/symbol"), http.HandlerFunc(pprof.Symbol))
@@ -56,6 +108,171 @@ func (s *Server) ImportMetrics(ctx context.Context, jsonMetrics []samplers.JSONM
 	s.statsd.TimeInMilliseconds("import.response_duration_ns", float64(time.Since(span.Start).Nanoseconds()), []string{"part:merge"}, 1.0)
 }
 
+// histogramQuantileResponse is the body returned by /debug/histogram
+type histogramQuantileResponse struct {
+	Name     string   `json:"name"`
+	Type     string   `json:"type"`
+	Tags     []string `json:"tags"`
+	Quantile float64  `json:"quantile"`
+	Value    float64  `json:"value"`
+	Weight   float64  `json:"weight"`
+}
+
+// handleHistogramQuantile reports the current, partial estimate of a quantile
+// for a live histogram or timer, eg
+// /debug/histogram?name=a.b.c&tags=foo:bar,baz:quz&quantile=0.99
+// The quantile defaults to the median, and the type (histogram or timer) can
+// be given with the type parameter; if it is omitted, both are tried.
+func (s *Server) handleHistogramQuantile(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	name := query.Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	quantile := 0.5
+	if q := query.Get("quantile"); q != "" {
+		var err error
+		quantile, err = strconv.ParseFloat(q, 64)
+		if err != nil || quantile < 0 || quantile > 1 {
+			http.Error(w, "quantile must be a number between 0 and 1", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tags := queryTags(query)
+
+	types := []string{"histogram", "timer"}
+	switch t := query.Get("type"); t {
+	case "":
+	case "histogram", "timer":
+		types = []string{t}
+	default:
+		http.Error(w, "type must be histogram or timer", http.StatusBadRequest)
+		return
+	}
+
+	for _, typ := range types {
+		mk := samplers.MetricKey{
+			Name:       name,
+			Type:       typ,
+			JoinedTags: strings.Join(tags, ","),
+		}
+		value, weight, ok := s.Workers[s.workerIndex(mk)].HistogramQuantile(mk, quantile)
+		if !ok {
+			continue
+		}
+		if math.IsNaN(value) {
+			// encoding/json refuses to marshal NaN, and there's nothing
+			// useful to report for an empty digest anyway
+			break
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(histogramQuantileResponse{
+			Name:     name,
+			Type:     typ,
+			Tags:     tags,
+			Quantile: quantile,
+			Value:    value,
+			Weight:   weight,
+		})
+		return
+	}
+	http.Error(w, "no live histogram or timer with that name and tags", http.StatusNotFound)
+}
+
+// queryTags returns the comma-separated tags in the tags query parameter,
+// sorted the same way tags are when packets are parsed.
+func queryTags(query url.Values) []string {
+	var tags []string
+	if t := query.Get("tags"); t != "" {
+		tags = strings.Split(t, ",")
+		sort.Strings(tags)
+	}
+	return tags
+}
+
+// metricResetResponse is the body returned by /admin/metrics/reset
+type metricResetResponse struct {
+	Reset bool     `json:"reset"`
+	Types []string `json:"types,omitempty"`
+}
+
+// handleMetricReset discards whatever has been accumulated in the current
+// interval for a series, eg
+// POST /admin/metrics/reset?name=a.b.c&tags=foo:bar&type=counter
+// If type is omitted, series of every type with that name and tags are
+// reset. This is meant for tests and debugging, so it is refused unless
+// enable_metric_reset is set.
+func (s *Server) handleMetricReset(w http.ResponseWriter, r *http.Request) {
+	if !s.enableMetricReset {
+		http.Error(w, "metric reset is not enabled", http.StatusForbidden)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+
+	types := []string{"counter", "gauge", "histogram", "set", "timer"}
+	switch t := query.Get("type"); t {
+	case "":
+	case "counter", "gauge", "histogram", "set", "timer":
+		types = []string{t}
+	default:
+		http.Error(w, "type must be counter, gauge, histogram, set or timer", http.StatusBadRequest)
+		return
+	}
+
+	resp := metricResetResponse{}
+	joinedTags := strings.Join(queryTags(query), ",")
+	for _, typ := range types {
+		mk := samplers.MetricKey{
+			Name:       name,
+			Type:       typ,
+			JoinedTags: joinedTags,
+		}
+		// imports and packets both hash series to the same worker, but
+		// checking them all costs little and doesn't depend on that
+		for _, worker := range s.Workers {
+			if worker.ResetMetric(mk) {
+				resp.Reset = true
+				resp.Types = append(resp.Types, typ)
+			}
+		}
+	}
+	log.WithFields(logrus.Fields{
+		"name":  name,
+		"tags":  joinedTags,
+		"types": resp.Types,
+	}).Info("Reset metric")
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// workerIndex returns the index of the worker that owns the given metric.
+func (s *Server) workerIndex(mk samplers.MetricKey) int {
+	return int(metricWorkerIndex(mk, len(s.Workers)))
+}
+
+// metricWorkerIndex returns the index of the worker, of numWorkers, that
+// owns the given metric. It must agree with the digest computed by
+// samplers.ParseMetric.
+func metricWorkerIndex(mk samplers.MetricKey, numWorkers int) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(mk.Name))
+	h.Write([]byte(mk.Type))
+	h.Write([]byte(mk.JoinedTags))
+	return h.Sum32() % uint32(numWorkers)
+}
+
 // sorts a set of jsonmetrics by what worker they belong to
 type sortableJSONMetrics struct {
 	metrics       []samplers.JSONMetric
@@ -68,11 +285,7 @@ func newSortableJSONMetrics(metrics []samplers.JSONMetric, numWorkers int) *sort
 		workerIndices: make([]uint32, 0, len(metrics)),
 	}
 	for _, j := range metrics {
-		h := fnv.New32a()
-		h.Write([]byte(j.Name))
-		h.Write([]byte(j.Type))
-		h.Write([]byte(j.JoinedTags))
-		ret.workerIndices = append(ret.workerIndices, h.Sum32()%uint32(numWorkers))
+		ret.workerIndices = append(ret.workerIndices, metricWorkerIndex(j.MetricKey, numWorkers))
 	}
 	return &ret
 }
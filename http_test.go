@@ -4,14 +4,19 @@ import (
 	"bytes"
 	"compress/gzip"
 	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"sort"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stripe/veneur/samplers"
 )
@@ -129,8 +134,9 @@ func TestServerImportUncompressed(t *testing.T) {
 }
 
 func TestServerImportGzip(t *testing.T) {
-	// Test that the global veneur instance
-	// returns a 400 for gzipped-input
+	// Test that the global veneur instance can handle
+	// requests that provide gzipped metrics, as forwards
+	// do with http_sink_encodings
 
 	f, err := os.Open(filepath.Join("fixtures", "import.uncompressed"))
 	assert.NoError(t, err, "Error reading response fixture")
@@ -154,6 +160,29 @@ func TestServerImportGzip(t *testing.T) {
 	handler := handleImport(&s)
 	handler.ServeHTTP(w, r)
 
+	assert.Equal(t, http.StatusAccepted, w.Code, "Test server returned wrong HTTP response code")
+}
+
+func TestServerImportUnsupportedEncoding(t *testing.T) {
+	// Test that the global veneur instance
+	// returns a 415 for encodings it can't read
+
+	f, err := os.Open(filepath.Join("fixtures", "import.uncompressed"))
+	assert.NoError(t, err, "Error reading response fixture")
+	defer f.Close()
+
+	r := httptest.NewRequest(http.MethodPost, "/import", f)
+	r.Header.Set("Content-Encoding", "br")
+
+	w := httptest.NewRecorder()
+
+	config := localConfig()
+	s := setupVeneurServer(t, config)
+	defer s.Shutdown()
+
+	handler := handleImport(&s)
+	handler.ServeHTTP(w, r)
+
 	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, "Test server returned wrong HTTP response code")
 }
 
@@ -267,3 +296,182 @@ func testServerImportHelper(t *testing.T, data interface{}) {
 
 	assert.Equal(t, http.StatusBadRequest, w.Code, "Test server returned wrong HTTP response code")
 }
+
+func TestServerImportMaxInFlight(t *testing.T) {
+	config := localConfig()
+	config.ImportMaxInFlight = 1
+	s := setupVeneurServer(t, config)
+	defer s.Shutdown()
+	handler := handleImport(&s)
+
+	post := func(filename string) *httptest.ResponseRecorder {
+		f, err := os.Open(filename)
+		assert.NoError(t, err, "Error reading response fixture")
+		defer f.Close()
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/import", f))
+		return w
+	}
+
+	// occupy the only slot, as if another import were in progress
+	assert.True(t, s.acquireImport())
+	w := post(filepath.Join("fixtures", "import.uncompressed"))
+	assert.Equal(t, http.StatusServiceUnavailable, w.Code, "import should be refused while saturated")
+	assert.NotEmpty(t, w.Header().Get("Retry-After"))
+	s.releaseImport()
+
+	// a failed import must give its slot back
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/import", strings.NewReader("[]")))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&s.importsInFlight))
+
+	w = post(filepath.Join("fixtures", "import.uncompressed"))
+	assert.Equal(t, http.StatusAccepted, w.Code, "import should be accepted once a slot is free")
+}
+
+func TestScrapeEndpoint(t *testing.T) {
+	config := localConfig()
+	s := setupVeneurServer(t, config)
+	defer s.Shutdown()
+	handler := s.Handler()
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Empty(t, w.Body.String(), "nothing should be exposed before the first flush")
+
+	s.lastFlush.set([]samplers.DDMetric{
+		{Name: "a.b.c", Value: [1][2]float64{{1, 5}}, Tags: []string{"foo:bar", "9lives", `q:say "hi"`}, Hostname: "h1"},
+		{Name: "a.b.c", Value: [1][2]float64{{1, 6}}, Tags: []string{"foo:baz", "foo:dupe"}},
+		{Name: "2xx.d-e", Value: [1][2]float64{{1, 0.5}}},
+	})
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, scrapeContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, `# TYPE _2xx_d_e gauge
+_2xx_d_e 0.5
+# TYPE a_b_c gauge
+a_b_c{_9lives="true",foo="bar",host="h1",q="say \"hi\""} 5
+a_b_c{foo="baz"} 6
+`, w.Body.String())
+}
+
+func TestHistogramQuantileEndpoint(t *testing.T) {
+	s := Server{Workers: []*Worker{
+		NewWorker(1, nil, logrus.New()),
+		NewWorker(2, nil, logrus.New()),
+		NewWorker(3, nil, logrus.New()),
+	}}
+	for i := 1; i <= 100; i++ {
+		m, err := samplers.ParseMetric([]byte(fmt.Sprintf("a.b.c:%d|ms|#foo:bar,baz:quz", i)))
+		assert.NoError(t, err)
+		s.Workers[m.Digest%uint32(len(s.Workers))].ProcessMetric(m)
+	}
+	handler := s.Handler()
+
+	// tag order in the query shouldn't matter
+	r := httptest.NewRequest(http.MethodGet, "/debug/histogram?name=a.b.c&tags=foo:bar,baz:quz&quantile=0.99", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code, "should have found the live timer")
+
+	var resp histogramQuantileResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, "timer", resp.Type)
+	assert.Equal(t, []string{"baz:quz", "foo:bar"}, resp.Tags)
+	assert.Equal(t, float64(100), resp.Weight)
+	assert.InDelta(t, 99, resp.Value, 1)
+
+	// the median is the default
+	r = httptest.NewRequest(http.MethodGet, "/debug/histogram?name=a.b.c&tags=baz:quz,foo:bar&type=timer", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, 0.5, resp.Quantile)
+	assert.InDelta(t, 50, resp.Value, 1)
+
+	// reading the histogram must not disturb it
+	wm := s.Workers[s.workerIndex(samplers.MetricKey{Name: "a.b.c", Type: "timer", JoinedTags: "baz:quz,foo:bar"})].Flush()
+	assert.Len(t, wm.timers, 1)
+	for _, timer := range wm.timers {
+		assert.Equal(t, float64(100), timer.Value.Count())
+		assert.Equal(t, float64(100), timer.LocalWeight)
+	}
+
+	r = httptest.NewRequest(http.MethodGet, "/debug/histogram?name=a.b.c&tags=baz:quz,foo:bar", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusNotFound, w.Code, "flushed timers are no longer live")
+
+	r = httptest.NewRequest(http.MethodGet, "/debug/histogram?name=a.b.c&quantile=2", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "quantiles must be between 0 and 1")
+}
+
+func TestMetricResetEndpoint(t *testing.T) {
+	s := Server{Workers: []*Worker{
+		NewWorker(1, nil, logrus.New()),
+		NewWorker(2, nil, logrus.New()),
+	}}
+	for _, packet := range []string{"a.b.c:1|c|#foo:bar", "a.b.c:5|ms|#foo:bar", "a.b.c:1|c|#baz:quz"} {
+		m, err := samplers.ParseMetric([]byte(packet))
+		assert.NoError(t, err)
+		s.Workers[m.Digest%uint32(len(s.Workers))].ProcessMetric(m)
+	}
+	handler := s.Handler()
+
+	r := httptest.NewRequest(http.MethodPost, "/admin/metrics/reset?name=a.b.c&tags=foo:bar", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusForbidden, w.Code, "reset must be refused unless it is enabled")
+
+	s.enableMetricReset = true
+	r = httptest.NewRequest(http.MethodPost, "/admin/metrics/reset?name=a.b.c&tags=foo:bar&type=counter", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp metricResetResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.Equal(t, metricResetResponse{Reset: true, Types: []string{"counter"}}, resp)
+
+	// resetting the same series again finds nothing
+	r = httptest.NewRequest(http.MethodPost, "/admin/metrics/reset?name=a.b.c&tags=foo:bar&type=counter", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	resp = metricResetResponse{}
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	assert.False(t, resp.Reset)
+
+	// and new observations start it afresh
+	m, err := samplers.ParseMetric([]byte("a.b.c:3|c|#foo:bar"))
+	assert.NoError(t, err)
+	s.Workers[m.Digest%uint32(len(s.Workers))].ProcessMetric(m)
+
+	var counters []*samplers.Counter
+	var timers int
+	for _, worker := range s.Workers {
+		wm := worker.Flush()
+		for _, c := range wm.counters {
+			counters = append(counters, c)
+		}
+		timers += len(wm.timers)
+	}
+	assert.Equal(t, 1, timers, "other types with the same name and tags are untouched")
+	if assert.Len(t, counters, 2, "other tags are untouched") {
+		for _, c := range counters {
+			if c.Tags[0] == "foo:bar" {
+				assert.Equal(t, "a.b.c", c.Name)
+				m := c.FlushCount(10 * time.Second)
+				assert.Equal(t, float64(3), m[0].Value[0][1], "only observations after the reset count")
+			}
+		}
+	}
+
+	r = httptest.NewRequest(http.MethodPost, "/admin/metrics/reset?tags=foo:bar", nil)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code, "name is required")
+}
@@ -0,0 +1,171 @@
+package veneur
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// newHTTPTLSConfig returns the TLS config that the HTTP server (and so the
+// import endpoint) is served with, or nil if it is plaintext, as it is unless
+// http_tls_certificate and http_tls_key are set. If http_tls_client_ca is
+// set too, clients must present a certificate that it signed.
+func newHTTPTLSConfig(conf Config) (*tls.Config, error) {
+	if conf.HTTPTLSCertificate == "" && conf.HTTPTLSKey == "" {
+		if conf.HTTPTLSClientCA != "" {
+			return nil, errors.New("http_tls_client_ca needs http_tls_certificate and http_tls_key")
+		}
+		return nil, nil
+	}
+	if conf.HTTPTLSCertificate == "" || conf.HTTPTLSKey == "" {
+		return nil, errors.New("http_tls_certificate and http_tls_key must be set together")
+	}
+	certs, err := newCertReloader(conf.HTTPTLSCertificate, conf.HTTPTLSKey)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     tls.VersionTLS12,
+	}
+	if conf.HTTPTLSClientCA != "" {
+		pem, err := ioutil.ReadFile(conf.HTTPTLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("http_tls_client_ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("http_tls_client_ca: no certificates in %s", conf.HTTPTLSClientCA)
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// newForwardTLSConfig returns the TLS config that forwards to a global
+// veneur are made with, or nil if none of forward_tls_cert, forward_tls_key
+// and forward_tls_ca are set, in which case they use the system's roots and
+// present no certificate. forward_tls_cert and forward_tls_key are the client
+// certificate presented to a global veneur with http_tls_client_ca set, and
+// forward_tls_ca replaces the system's roots for verifying it.
+func newForwardTLSConfig(conf Config) (*tls.Config, error) {
+	if conf.ForwardTLSCert == "" && conf.ForwardTLSKey == "" && conf.ForwardTLSCA == "" {
+		return nil, nil
+	}
+	if (conf.ForwardTLSCert == "") != (conf.ForwardTLSKey == "") {
+		return nil, errors.New("forward_tls_cert and forward_tls_key must be set together")
+	}
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if conf.ForwardTLSCert != "" {
+		certs, err := newCertReloader(conf.ForwardTLSCert, conf.ForwardTLSKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = certs.GetClientCertificate
+	}
+	if conf.ForwardTLSCA != "" {
+		pem, err := ioutil.ReadFile(conf.ForwardTLSCA)
+		if err != nil {
+			return nil, fmt.Errorf("forward_tls_ca: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("forward_tls_ca: no certificates in %s", conf.ForwardTLSCA)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// A certReloader serves a certificate and key from files, loading them again
+// whenever either file changes, so that they can be rotated without
+// restarting veneur. (SIGHUP already restarts the HTTP server gracefully,
+// so it isn't needed to pick up new ones.)
+type certReloader struct {
+	certFile, keyFile string
+
+	mu sync.Mutex
+	// the certificate, and the modification times of the files it was
+	// loaded from
+	cert            *tls.Certificate
+	certMod, keyMod time.Time
+}
+
+// newCertReloader loads the certificate and key, which must be valid for
+// veneur to start.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate returns the certificate to handshake with, for
+// tls.Config. If the files have changed but can't be loaded, eg because the
+// certificate has been replaced but its key hasn't yet, the last good one is
+// used until they can.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.changed() {
+		if err := r.reload(); err != nil {
+			log.WithError(err).WithFields(logrus.Fields{
+				"certificate": r.certFile,
+				"key":         r.keyFile,
+			}).Warn("Could not reload the TLS certificate, still using the old one")
+		}
+	}
+	return r.cert, nil
+}
+
+// GetClientCertificate returns the certificate to present to a server that
+// asks for one, like GetCertificate, for tls.Config.
+func (r *certReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return r.GetCertificate(nil)
+}
+
+// changed reports whether either file has been modified since the
+// certificate was loaded.
+func (r *certReloader) changed() bool {
+	certMod, keyMod, err := r.modTimes()
+	return err == nil && (!certMod.Equal(r.certMod) || !keyMod.Equal(r.keyMod))
+}
+
+func (r *certReloader) modTimes() (certMod, keyMod time.Time, err error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+func (r *certReloader) reload() error {
+	// stat first, so that a change made while loading is picked up next time
+	certMod, keyMod, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	if r.cert != nil {
+		log.WithField("certificate", r.certFile).Info("Reloaded the TLS certificate")
+	}
+	r.cert = &cert
+	r.certMod, r.keyMod = certMod, keyMod
+	return nil
+}
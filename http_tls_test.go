@@ -0,0 +1,241 @@
+package veneur
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+// testCert is a certificate and its key, signed by parent, or self-signed
+// if parent is nil.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+func newTestCert(t *testing.T, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	assert.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+// write writes the certificate and key to cert.pem and key.pem in dir.
+func (c *testCert) write(t *testing.T, dir string) (certFile, keyFile string) {
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.der}, PrivateKey: c.key}
+}
+
+// serveTLS serves the server's handler over TLS on a local port, as
+// HTTPServe would, and returns its address.
+func serveTLS(t *testing.T, s *Server) (addr string, stop func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	go http.Serve(tls.NewListener(ln, s.httpTLS), s.Handler())
+	return ln.Addr().String(), func() { ln.Close() }
+}
+
+func tlsGet(addr string, roots *x509.CertPool, clientCerts ...tls.Certificate) (*http.Response, error) {
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: roots, Certificates: clientCerts},
+		DisableKeepAlives: true,
+	}}
+	return client.Get("https://" + addr + "/healthcheck")
+}
+
+func TestHTTPTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	certFile, keyFile := newTestCert(t, "veneur", ca).write(t, dir)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	config := localConfig()
+	config.HTTPTLSCertificate = certFile
+	config.HTTPTLSKey = keyFile
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	addr, stop := serveTLS(t, &s)
+	defer stop()
+
+	resp, err := tlsGet(addr, roots)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestHTTPTLSClientCerts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	certFile, keyFile := newTestCert(t, "veneur", ca).write(t, dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0600))
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	config := localConfig()
+	config.HTTPTLSCertificate = certFile
+	config.HTTPTLSKey = keyFile
+	config.HTTPTLSClientCA = caFile
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	addr, stop := serveTLS(t, &s)
+	defer stop()
+
+	_, err = tlsGet(addr, roots)
+	assert.Error(t, err, "clients must present a certificate")
+	_, err = tlsGet(addr, roots, newTestCert(t, "stranger", newTestCert(t, "other ca", nil)).tlsCertificate())
+	assert.Error(t, err, "the client's certificate must be signed by the CA")
+	resp, err := tlsGet(addr, roots, newTestCert(t, "local veneur", ca).tlsCertificate())
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	}
+}
+
+func TestHTTPTLSReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCert(t, "ca", nil)
+	first := newTestCert(t, "first", ca)
+	certFile, keyFile := first.write(t, dir)
+
+	certs, err := newCertReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	cert, err := certs.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, first.der, cert.Certificate[0])
+
+	// a half-finished rotation keeps the old certificate
+	second := newTestCert(t, "second", ca)
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: second.der}), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	cert, err = certs.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, first.der, cert.Certificate[0])
+
+	second.write(t, dir)
+	later = later.Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	assert.NoError(t, os.Chtimes(keyFile, later, later))
+	cert, err = certs.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, second.der, cert.Certificate[0])
+}
+
+func TestHTTPTLSConfig(t *testing.T) {
+	tlsConfig, err := newHTTPTLSConfig(Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig, "plaintext is the default")
+
+	_, err = newHTTPTLSConfig(Config{HTTPTLSCertificate: "cert.pem"})
+	assert.Error(t, err, "a certificate needs a key")
+	_, err = newHTTPTLSConfig(Config{HTTPTLSClientCA: "ca.pem"})
+	assert.Error(t, err, "client verification needs TLS")
+	_, err = newHTTPTLSConfig(Config{HTTPTLSCertificate: "/nonexistent/cert.pem", HTTPTLSKey: "/nonexistent/key.pem"})
+	assert.Error(t, err, "the certificate must load at startup")
+}
+
+func TestForwardTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	globalDir, localDir := filepath.Join(dir, "global"), filepath.Join(dir, "local")
+	assert.NoError(t, os.Mkdir(globalDir, 0700))
+	assert.NoError(t, os.Mkdir(localDir, 0700))
+	ca := newTestCert(t, "ca", nil)
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.der}), 0600))
+
+	config := globalConfig()
+	config.HTTPTLSCertificate, config.HTTPTLSKey = newTestCert(t, "global veneur", ca).write(t, globalDir)
+	config.HTTPTLSClientCA = caFile
+	global := setupVeneurServer(t, config)
+	defer global.Shutdown()
+	addr, stop := serveTLS(t, &global)
+	defer stop()
+
+	config = localConfig()
+	config.ForwardAddress = "https://" + addr
+	config.ForwardTLSCert, config.ForwardTLSKey = newTestCert(t, "local veneur", ca).write(t, localDir)
+	config.ForwardTLSCA = caFile
+	local, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	metrics := []samplers.JSONMetric{{MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "counter"}, Value: []byte{0, 0, 0, 0, 0, 0, 0, 1}}}
+	assert.NoError(t, local.postHelper(context.Background(), local.ForwardAddr+"/import", metrics, "forward", local.sinkEncoding(forwardSinkName)),
+		"forwards should present the client certificate, and verify the global veneur with the CA")
+
+	config.ForwardTLSCert, config.ForwardTLSKey = "", ""
+	anonymous, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Error(t, anonymous.postHelper(context.Background(), anonymous.ForwardAddr+"/import", metrics, "forward", anonymous.sinkEncoding(forwardSinkName)),
+		"the global veneur should require a client certificate")
+}
+
+func TestForwardTLSConfig(t *testing.T) {
+	tlsConfig, err := newForwardTLSConfig(Config{})
+	assert.NoError(t, err)
+	assert.Nil(t, tlsConfig, "forwards use the default TLS config by default")
+
+	_, err = newForwardTLSConfig(Config{ForwardTLSCert: "cert.pem"})
+	assert.Error(t, err, "a certificate needs a key")
+	_, err = newForwardTLSConfig(Config{ForwardTLSCA: "/nonexistent/ca.pem"})
+	assert.Error(t, err, "the CA must load at startup")
+
+	s, err := NewFromConfig(localConfig())
+	assert.NoError(t, err)
+	assert.Nil(t, s.forwardClient, "forwards share the Datadog client by default")
+}
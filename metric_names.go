@@ -0,0 +1,92 @@
+package veneur
+
+import (
+	"hash/fnv"
+
+	"github.com/clarkduvall/hyperloglog"
+)
+
+// metricNamesPrecision is the precision of the HLLs that metric names are
+// counted with, which is the same as that of sets.
+const metricNamesPrecision = 18
+
+// metricNameTracker approximately counts the distinct metric names flushed
+// in each window, and how many of them were not flushed in the window
+// before it. A sudden jump in new names usually means a deploy has started
+// putting something dynamic, like an ID, into metric names.
+//
+// It is only used from the flush loop, so it has no locking.
+type metricNameTracker struct {
+	// the names seen in the previous window, gob-encoded so that each window
+	// can start its union from a copy of them, or nil before the first one
+	prev []byte
+}
+
+// observe counts the names in one window's metrics. The count of new names
+// is estimated as the size of the union of this window and the previous one,
+// less the size of the previous one, so it has a small floor of noise that
+// grows with the number of names. It is only meaningful once there has been
+// a previous window, which hasPrev reports.
+func (t *metricNameTracker) observe(wms []WorkerMetrics) (distinct, added uint64, hasPrev bool) {
+	cur, _ := hyperloglog.NewPlus(metricNamesPrecision)
+	// Merge doesn't combine a sparse HLL correctly, so the union is built by
+	// adding this window's names to a copy of the previous window instead
+	var union *hyperloglog.HyperLogLogPlus
+	var prevCount uint64
+	if t.prev != nil {
+		union, _ = hyperloglog.NewPlus(metricNamesPrecision)
+		if err := union.GobDecode(t.prev); err == nil {
+			hasPrev = true
+			prevCount = union.Count()
+		} else {
+			union = nil
+		}
+	}
+
+	add := func(name string) {
+		hasher := fnv.New64a()
+		hasher.Write([]byte(name))
+		cur.Add(hasher)
+		if union != nil {
+			union.Add(hasher)
+		}
+	}
+	for _, wm := range wms {
+		for k := range wm.counters {
+			add(k.Name)
+		}
+		for k := range wm.gauges {
+			add(k.Name)
+		}
+		for k := range wm.histograms {
+			add(k.Name)
+		}
+		for k := range wm.sets {
+			add(k.Name)
+		}
+		for k := range wm.timers {
+			add(k.Name)
+		}
+		for k := range wm.globalCounters {
+			add(k.Name)
+		}
+		for k := range wm.localHistograms {
+			add(k.Name)
+		}
+		for k := range wm.localSets {
+			add(k.Name)
+		}
+		for k := range wm.localTimers {
+			add(k.Name)
+		}
+	}
+
+	distinct = cur.Count()
+	if union != nil {
+		if u := union.Count(); u > prevCount {
+			added = u - prevCount
+		}
+	}
+	t.prev, _ = cur.GobEncode()
+	return distinct, added, hasPrev
+}
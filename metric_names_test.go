@@ -0,0 +1,49 @@
+package veneur
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func metricNamesWindow(names ...string) []WorkerMetrics {
+	wm := NewWorkerMetrics()
+	for _, name := range names {
+		// the same name with different tags and types is still one name
+		wm.counters[samplers.MetricKey{Name: name, Type: "counter", JoinedTags: "a:b"}] = nil
+		wm.counters[samplers.MetricKey{Name: name, Type: "counter", JoinedTags: "a:c"}] = nil
+		wm.gauges[samplers.MetricKey{Name: name, Type: "gauge"}] = nil
+	}
+	return []WorkerMetrics{wm, NewWorkerMetrics()}
+}
+
+func TestMetricNameTracker(t *testing.T) {
+	var names []string
+	for i := 0; i < 1000; i++ {
+		names = append(names, fmt.Sprintf("metric.%d", i))
+	}
+
+	tracker := metricNameTracker{}
+	distinct, _, hasPrev := tracker.observe(metricNamesWindow(names...))
+	assert.False(t, hasPrev, "the first window has nothing to compare to")
+	assert.InEpsilon(t, 1000, distinct, 0.02)
+
+	distinct, added, hasPrev := tracker.observe(metricNamesWindow(names...))
+	assert.True(t, hasPrev)
+	assert.InEpsilon(t, 1000, distinct, 0.02)
+	assert.True(t, added < 20, "no names are new, but got %d", added)
+
+	for i := 0; i < 500; i++ {
+		names = append(names, fmt.Sprintf("metric.id_%d", i))
+	}
+	distinct, added, _ = tracker.observe(metricNamesWindow(names...))
+	assert.InEpsilon(t, 1500, distinct, 0.02)
+	assert.InEpsilon(t, 500, added, 0.1)
+
+	// names that disappear aren't new, and don't make the count negative
+	distinct, added, _ = tracker.observe(metricNamesWindow(names[:10]...))
+	assert.InEpsilon(t, 10, distinct, 0.02)
+	assert.Equal(t, uint64(0), added)
+}
@@ -1,10 +1,16 @@
 package veneur
 
 import (
+	"errors"
+	"math"
+	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
 )
 
 func TestParser(t *testing.T) {
@@ -112,6 +118,216 @@ func TestInvalidPackets(t *testing.T) {
 	}
 }
 
+func TestParseErrorCauses(t *testing.T) {
+	table := map[string]string{
+		"foo":               samplers.ParseErrorSyntax,
+		":1|c":              samplers.ParseErrorName,
+		"foo:1||":           samplers.ParseErrorType,
+		"foo:1|foo":         samplers.ParseErrorType,
+		"foo:bar|c":         samplers.ParseErrorValue,
+		"foo:1|c|@1.1":      samplers.ParseErrorSampleRate,
+		"foo:1|c|#foo|#bar": samplers.ParseErrorSyntax,
+	}
+
+	for packet, cause := range table {
+		_, err := samplers.ParseMetric([]byte(packet))
+		assert.Equal(t, cause, samplers.ParseErrorCause(err), "wrong cause for %q", packet)
+	}
+
+	_, err := samplers.Parser{ExplicitTimestamps: true}.ParseMetric([]byte("foo:1|h|T1500000000"))
+	assert.Equal(t, samplers.ParseErrorTimestamp, samplers.ParseErrorCause(err))
+	assert.Equal(t, samplers.ParseErrorUnknown, samplers.ParseErrorCause(errors.New("other")))
+}
+
+func TestParserEntityTags(t *testing.T) {
+	const packet = "a.b.c:1|c|#foo:bar,dd.internal.entity_id:123abc|c:deadbeef"
+
+	m, err := samplers.ParseMetric([]byte(packet))
+	assert.NoError(t, err, "should have parsed container ID field")
+	assert.Equal(t, "deadbeef", m.ContainerID, "ContainerID")
+	assert.Equal(t, []string{"container_id:deadbeef", "dd.internal.entity_id:123abc", "foo:bar"}, m.Tags, "container ID and entity tags should be kept as tags")
+	assert.Equal(t, "container_id:deadbeef,dd.internal.entity_id:123abc,foo:bar", m.JoinedTags, "JoinedTags")
+
+	stripped, err := samplers.Parser{StripEntityTags: true}.ParseMetric([]byte(packet))
+	assert.NoError(t, err, "should have parsed container ID field")
+	assert.Equal(t, "deadbeef", stripped.ContainerID, "ContainerID")
+	assert.Equal(t, []string{"foo:bar"}, stripped.Tags, "container ID and entity tags should be stripped")
+
+	plain, err := samplers.ParseMetric([]byte("a.b.c:1|c|#foo:bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, plain.Digest, stripped.Digest, "stripped metric should aggregate with one that never had entity tags")
+	assert.Equal(t, plain.MetricKey, stripped.MetricKey)
+
+	// the container ID can come before the tags, too
+	m, err = samplers.ParseMetric([]byte("a.b.c:1|c|c:deadbeef|#foo:bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"container_id:deadbeef", "foo:bar"}, m.Tags)
+
+	_, err = samplers.ParseMetric([]byte("a.b.c:1|c|c:a|c:b"))
+	assert.Error(t, err, "should reject multiple container IDs")
+}
+
+func TestParserTimestamps(t *testing.T) {
+	parser := samplers.Parser{ExplicitTimestamps: true}
+
+	m, err := parser.ParseMetric([]byte("a.b.c:1|c|#foo:bar|T1656581400"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1656581400), m.Timestamp)
+	assert.Equal(t, []string{"foo:bar"}, m.Tags)
+	m, err = parser.ParseMetric([]byte("a.b.c:1|g|T1656581400|@0.5"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1656581400), m.Timestamp)
+	assert.Equal(t, float32(0.5), m.SampleRate)
+
+	// malformed timestamps fall back to flush time
+	for _, packet := range []string{"a.b.c:1|c|T", "a.b.c:1|c|Tyesterday", "a.b.c:1|c|T-5"} {
+		m, err = parser.ParseMetric([]byte(packet))
+		assert.NoError(t, err, packet)
+		assert.Equal(t, int64(0), m.Timestamp, packet)
+	}
+
+	for _, packet := range []string{"a.b.c:1|h|T1656581400", "a.b.c:1|ms|T1656581400", "a.b.c:foo|s|T1656581400"} {
+		_, err = parser.ParseMetric([]byte(packet))
+		assert.Error(t, err, "%s should be rejected", packet)
+	}
+	_, err = parser.ParseMetric([]byte("a.b.c:1|c|T1656581400|T1656581401"))
+	assert.Error(t, err, "should reject multiple timestamps")
+
+	m, err = samplers.ParseMetric([]byte("a.b.c:1|h|T1656581400"))
+	assert.NoError(t, err, "timestamps should be ignored unless enabled")
+	assert.Equal(t, int64(0), m.Timestamp)
+	_, err = samplers.ParseMetric([]byte("a.b.c:1|c|T1656581400|T1656581401"))
+	assert.NoError(t, err, "so should repeated ones")
+}
+
+func TestParserExtraTags(t *testing.T) {
+	parser := samplers.Parser{ExtraTags: []string{"transport:udp"}}
+	m, err := parser.ParseMetric([]byte("a.b.c:1|c|#zzz:1,foo:bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"foo:bar", "transport:udp", "zzz:1"}, m.Tags)
+	assert.Equal(t, "foo:bar,transport:udp,zzz:1", m.JoinedTags)
+
+	plain, err := samplers.ParseMetric([]byte("a.b.c:1|c|#zzz:1,foo:bar"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, plain.Digest, m.Digest, "extra tags should make for a separate series")
+
+	m, err = parser.ParseMetric([]byte("a.b.c:1|c"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"transport:udp"}, m.Tags)
+
+	m, err = parser.ParseMetric([]byte("a.b.c:1|c|#transport:tcp"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"transport:tcp"}, m.Tags, "the client's tag should win by default")
+	parser.TagPrecedence = samplers.TagPrecedence{samplers.TagSourceListener, samplers.TagSourceClient, samplers.TagSourceHost}
+	m, err = parser.ParseMetric([]byte("a.b.c:1|c|#transport:tcp"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"transport:udp"}, m.Tags)
+}
+
+func TestParserSkipsUnknownFields(t *testing.T) {
+	m, err := samplers.ParseMetric([]byte("a.b.c:1|c|@0.5|x:whatever|#foo:bar|e:1"))
+	assert.NoError(t, err, "unknown fields should be skipped")
+	assert.Equal(t, float32(0.5), m.SampleRate, "Sample Rate")
+	assert.Equal(t, []string{"foo:bar"}, m.Tags, "Tags")
+}
+
+func TestParserMultipleValues(t *testing.T) {
+	metrics, invalid, err := samplers.Parser{}.ParseMetrics([]byte("a.b.c:1:2.5:3|h|@0.5|#foo:bar"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, invalid)
+	assert.Len(t, metrics, 3, "each value should become its own metric")
+	for i, want := range []float64{1, 2.5, 3} {
+		m := metrics[i]
+		assert.Equal(t, "a.b.c", m.Name, "Name")
+		assert.Equal(t, "histogram", m.Type, "Type")
+		assert.Equal(t, want, m.Value, "Value")
+		assert.Equal(t, float32(0.5), m.SampleRate, "Sample Rate")
+		assert.Equal(t, []string{"foo:bar"}, m.Tags, "Tags")
+		assert.Equal(t, metrics[0].Digest, m.Digest, "Digest")
+	}
+	metrics[0].Tags[0] = "changed"
+	assert.Equal(t, []string{"foo:bar"}, metrics[1].Tags, "each metric should have its own tags")
+
+	metrics, invalid, err = samplers.Parser{}.ParseMetrics([]byte("a.b.c:1:fart:3|h"))
+	assert.NoError(t, err, "a bad value should not drop the rest of the line")
+	assert.Equal(t, 1, invalid)
+	assert.Len(t, metrics, 2)
+
+	_, _, err = samplers.Parser{}.ParseMetrics([]byte("a.b.c:fart:fart|h"))
+	assert.Error(t, err, "a line with no valid values should be rejected")
+
+	_, err = samplers.ParseMetric([]byte("a.b.c:1:2|h"))
+	assert.Error(t, err, "ParseMetric only accepts a single value")
+
+	metrics, _, err = samplers.Parser{}.ParseMetrics([]byte("a.b.c:foo:bar|s"))
+	assert.NoError(t, err)
+	assert.Len(t, metrics, 1, "sets should not be split")
+	assert.Equal(t, "foo:bar", metrics[0].Value)
+}
+
+func TestParserMaxTags(t *testing.T) {
+	p := samplers.Parser{MaxTags: 2}
+	m, err := p.ParseMetric([]byte("a.b.c:1|c|#d:1,b:1,c:1,a:1"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a:1", "b:1"}, m.Tags, "the first tags in sorted order should be kept")
+	assert.Equal(t, "a:1,b:1", m.JoinedTags)
+	assert.Equal(t, 2, m.TruncatedTags)
+
+	reordered, err := p.ParseMetric([]byte("a.b.c:1|c|#c:1,a:1,d:1,b:1"))
+	assert.NoError(t, err)
+	assert.Equal(t, m.Digest, reordered.Digest, "truncation should be deterministic")
+
+	m, err = p.ParseMetric([]byte("a.b.c:1|c|#b:1,a:1"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, m.TruncatedTags)
+	assert.Len(t, m.Tags, 2)
+}
+
+func TestMaxTagsPerMetricConfig(t *testing.T) {
+	s, err := NewFromConfig(localConfig())
+	assert.NoError(t, err)
+	assert.Equal(t, defaultMaxTagsPerMetric, s.parser.MaxTags, "tags should be limited to Datadog's limit by default")
+
+	config := localConfig()
+	config.MaxTagsPerMetric = 20
+	s, err = NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, s.parser.MaxTags)
+
+	config.MaxTagsPerMetric = -1
+	s, err = NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, s.parser.MaxTags, "-1 should turn the limit off")
+
+	config.MaxTagsPerMetric = -2
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestParserNamePattern(t *testing.T) {
+	pattern := regexp.MustCompile(`^[a-z]+\.[a-z]+\.[a-z_.]+$`)
+	p := samplers.Parser{NamePattern: pattern}
+
+	m, err := p.ParseMetric([]byte("team.service.latency:1|h|#a:b"))
+	assert.NoError(t, err)
+	assert.False(t, m.NamingViolation)
+
+	_, err = p.ParseMetric([]byte("latency:1|h|#a:b"))
+	assert.Equal(t, samplers.ParseErrorNaming, samplers.ParseErrorCause(err))
+
+	p.TagNamingViolations = true
+	p.MaxTags = 1
+	m, err = p.ParseMetric([]byte("latency:1|h|#a:b"))
+	assert.NoError(t, err)
+	assert.True(t, m.NamingViolation)
+	assert.Equal(t, []string{"a:b", samplers.NamingViolationTag}, m.Tags, "the tag shouldn't count towards MaxTags")
+	assert.Equal(t, "a:b,"+samplers.NamingViolationTag, m.JoinedTags)
+
+	untagged, err := samplers.ParseMetric([]byte("latency:1|h|#a:b"))
+	assert.NoError(t, err)
+	assert.NotEqual(t, untagged.Digest, m.Digest, "the tag is part of the series")
+}
+
 func TestLocalOnlyEscape(t *testing.T) {
 	m, err := samplers.ParseMetric([]byte("a.b.c:1|h|#veneurlocalonly,tag2:quacks"))
 	assert.NoError(t, err, "should have no error parsing")
@@ -199,3 +415,178 @@ func TestServiceCheckMessageUnescape(t *testing.T) {
 	assert.NoError(t, err, "Should have parsed correctly")
 	assert.Equal(t, "foo\nbar\nbaz\n", svcheck.Message, "Should contain newline")
 }
+
+func TestParseSSFDuration(t *testing.T) {
+	sample := &ssf.SSFSample{
+		Metric: ssf.SSFSample_HISTOGRAM,
+		Name:   "http.request.duration",
+		Tags: []*ssf.SSFTag{
+			{Name: "service", Value: "web"},
+			{Name: "resource", Value: "GET /users"},
+		},
+		Unit:  "ns",
+		Trace: &ssf.SSFTrace{Duration: int64(1500 * time.Microsecond)},
+	}
+	m, err := samplers.ParseSSFDuration(sample)
+	assert.NoError(t, err)
+	assert.Equal(t, "http.request.duration", m.Name)
+	assert.Equal(t, "histogram", m.Type)
+	assert.Equal(t, float64(1500000), m.Value)
+	assert.Equal(t, float32(1), m.SampleRate)
+	assert.Equal(t, []string{"resource:GET /users", "service:web"}, m.Tags)
+	assert.Equal(t, "resource:GET /users,service:web", m.JoinedTags)
+
+	// the digest must agree with the one the equivalent packet would get,
+	// so that both end up on the same worker
+	packet, err := samplers.ParseMetric([]byte("http.request.duration:1500000|h|#service:web,resource:GET /users"))
+	assert.NoError(t, err)
+	assert.Equal(t, packet.Digest, m.Digest)
+
+	sample.Unit = "ms"
+	m, err = samplers.ParseSSFDuration(sample)
+	assert.NoError(t, err)
+	assert.Equal(t, "timer", m.Type)
+	assert.Equal(t, 1.5, m.Value)
+
+	sample.Trace = nil
+	_, err = samplers.ParseSSFDuration(sample)
+	assert.Error(t, err, "a histogram sample without a span has no duration")
+}
+
+func TestParseSSFMetric(t *testing.T) {
+	sample := &ssf.SSFSample{
+		Metric: ssf.SSFSample_COUNTER,
+		Name:   "a.b.c",
+		Value:  3,
+		Tags:   []*ssf.SSFTag{{Name: "foo", Value: "bar"}, {Name: "baz"}},
+	}
+	m, err := samplers.ParseSSFMetric(sample)
+	assert.NoError(t, err)
+	assert.Equal(t, "counter", m.Type)
+	assert.Equal(t, float64(3), m.Value)
+	assert.Equal(t, float32(1), m.SampleRate)
+	assert.Equal(t, []string{"baz", "foo:bar"}, m.Tags)
+	packet, err := samplers.ParseMetric([]byte("a.b.c:3|c|#foo:bar,baz"))
+	assert.NoError(t, err)
+	assert.Equal(t, packet.Digest, m.Digest, "it should be aggregated with the equivalent packet")
+
+	sample.Metric = ssf.SSFSample_GAUGE
+	sample.SampleRate = 0.5
+	m, err = samplers.ParseSSFMetric(sample)
+	assert.NoError(t, err)
+	assert.Equal(t, "gauge", m.Type)
+	assert.Equal(t, float32(0.5), m.SampleRate)
+
+	sample.Metric = ssf.SSFSample_HISTOGRAM
+	m, err = samplers.ParseSSFMetric(sample)
+	assert.NoError(t, err)
+	assert.Equal(t, "histogram", m.Type)
+	sample.Unit = "ms"
+	m, err = samplers.ParseSSFMetric(sample)
+	assert.NoError(t, err)
+	assert.Equal(t, "timer", m.Type)
+
+	sample.Metric = ssf.SSFSample_SET
+	sample.Message = "user-1"
+	m, err = samplers.ParseSSFMetric(sample)
+	assert.NoError(t, err)
+	assert.Equal(t, "set", m.Type)
+	assert.Equal(t, "user-1", m.Value)
+
+	sample.Metric = ssf.SSFSample_STATUS
+	_, err = samplers.ParseSSFMetric(sample)
+	assert.Equal(t, samplers.ParseErrorType, samplers.ParseErrorCause(err))
+	sample.Metric = ssf.SSFSample_COUNTER
+	sample.Name = ""
+	_, err = samplers.ParseSSFMetric(sample)
+	assert.Equal(t, samplers.ParseErrorName, samplers.ParseErrorCause(err))
+}
+
+// TestParserSSFDuration tests that span durations get the same treatment
+// from a Parser's options as the equivalent packets.
+func TestParserSSFDuration(t *testing.T) {
+	p := samplers.Parser{
+		MaxTags:         2,
+		StripEntityTags: true,
+		ExtraTags:       []string{"transport:udp"},
+		NamePattern:     regexp.MustCompile(`^[a-z]+\.[a-z]+\.[a-z_.]+$`),
+	}
+	sample := &ssf.SSFSample{
+		Metric: ssf.SSFSample_HISTOGRAM,
+		Name:   "http.request.duration",
+		Tags: []*ssf.SSFTag{
+			{Name: "service", Value: "web"},
+			{Name: "dd.internal.entity_id", Value: "abc"},
+			{Name: "resource", Value: "GET /users"},
+		},
+		Trace: &ssf.SSFTrace{Duration: int64(time.Millisecond)},
+	}
+	m, err := p.ParseSSFDuration(sample)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"resource:GET /users", "service:web"}, m.Tags)
+	assert.Equal(t, 1, m.TruncatedTags)
+
+	packet, err := p.ParseMetric([]byte("http.request.duration:1000000|h|#service:web,dd.internal.entity_id:abc,resource:GET /users"))
+	assert.NoError(t, err)
+	assert.Equal(t, packet.Tags, m.Tags)
+	assert.Equal(t, packet.Digest, m.Digest)
+
+	sample.Name = "duration"
+	_, err = p.ParseSSFDuration(sample)
+	assert.Equal(t, samplers.ParseErrorNaming, samplers.ParseErrorCause(err))
+}
+
+func TestParseExposition(t *testing.T) {
+	samples, err := samplers.ParseExposition(strings.NewReader(`# HELP http_requests_total Requests served.
+# TYPE http_requests_total counter
+http_requests_total{code="200",path="/a \"b\"\\c"} 1027 1395066363000
+http_requests_total{code="500"} 3
+
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.5"} 24054
+latency_seconds_bucket{le="+Inf"} 144320 # {trace_id="abc"} 3.2
+latency_seconds_sum 53423
+latency_seconds_count 144320
+# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.99"} NaN
+temperature 21.5
+# EOF
+`))
+	assert.NoError(t, err)
+	if !assert.Len(t, samples, 8) {
+		return
+	}
+
+	assert.Equal(t, samplers.ExpositionSample{
+		Name:   "http_requests_total",
+		Family: "http_requests_total",
+		Type:   "counter",
+		Labels: []samplers.ExpositionLabel{{Name: "code", Value: "200"}, {Name: "path", Value: `/a "b"\c`}},
+		Value:  1027,
+	}, samples[0])
+
+	bucket := samples[3]
+	assert.Equal(t, "latency_seconds_bucket", bucket.Name)
+	assert.Equal(t, "latency_seconds", bucket.Family)
+	assert.Equal(t, "histogram", bucket.Type)
+	le, ok := bucket.Label("le")
+	assert.True(t, ok)
+	assert.Equal(t, "+Inf", le)
+	assert.Equal(t, float64(144320), bucket.Value, "the exemplar should be ignored")
+
+	assert.Equal(t, "latency_seconds", samples[4].Family)
+	assert.Equal(t, "summary", samples[6].Type)
+	assert.True(t, math.IsNaN(samples[6].Value))
+	assert.Equal(t, "untyped", samples[7].Type)
+
+	for _, bad := range []string{
+		"no_value",
+		"bad_value abc",
+		`unclosed{a="b" 1`,
+		`unquoted{a=b} 1`,
+		"too_many 1 2 3",
+	} {
+		_, err := samplers.ParseExposition(strings.NewReader(bad))
+		assert.Error(t, err, "%q should not parse", bad)
+	}
+}
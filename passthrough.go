@@ -0,0 +1,84 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+const (
+	// passthroughInterval is how often passthrough metrics are forwarded
+	passthroughInterval = time.Second
+	// passthroughBuffer is how many passthrough metrics can be waiting to
+	// be forwarded before more are dropped
+	passthroughBuffer = 8192
+)
+
+// passthroughTypes are the metric types that forward_passthrough_types may
+// name. Only gauges make sense: the global veneur already takes the last
+// value it sees for them, so there's nothing lost by not aggregating them
+// locally first.
+var passthroughTypes = map[string]bool{
+	"gauge": true,
+}
+
+// passthroughMetric hands a metric to the passthrough forwarder, if its type
+// bypasses local aggregation, and reports whether it did. Metrics tagged
+// veneurlocalonly are never passed through.
+func (s *Server) passthroughMetric(m *samplers.UDPMetric) bool {
+	if s.passthrough == nil || !s.passthroughTypes[m.Type] || m.Scope == samplers.LocalOnly {
+		return false
+	}
+	g := samplers.NewGauge(m.Name, m.Tags)
+	g.Timestamp = m.Timestamp
+	// the workers would have scaled it, had it been aggregated
+	g.Sample(m.Value.(float64)*s.scales.scaleFor(m.Name), m.SampleRate)
+	jm, err := g.Export()
+	if err != nil {
+		log.WithError(err).Error("Could not export passthrough metric")
+		return true
+	}
+	select {
+	case s.passthrough <- jm:
+	default:
+		s.statsd.Count("forward.error_total", 1, []string{"cause:passthrough_full"}, 1.0)
+	}
+	return true
+}
+
+// forwardPassthrough forwards passthrough metrics to the global veneur every
+// passthroughInterval, rather than at the end of each flush interval. Each
+// batch is posted before the next is collected, so a series' values arrive
+// in the order they were received.
+func (s *Server) forwardPassthrough() {
+	ticker := time.NewTicker(passthroughInterval)
+	defer ticker.Stop()
+
+	var batch []samplers.JSONMetric
+	for {
+		select {
+		case jm := <-s.passthrough:
+			batch = append(batch, jm)
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+			s.postPassthrough(batch)
+			batch = nil
+		}
+	}
+}
+
+func (s *Server) postPassthrough(batch []samplers.JSONMetric) {
+	s.statsd.Gauge("forward.post_metrics_total", float64(len(batch)), []string{"part:passthrough"}, 1.0)
+	endpoint, err := resolveEndpoint(fmt.Sprintf("%s/import", s.ForwardAddr))
+	if err != nil {
+		s.statsd.Count("forward.error_total", 1, []string{"cause:dns"}, 1.0)
+		log.WithError(err).Warn("Could not re-resolve host for passthrough forward")
+	}
+	if s.postHelper(context.Background(), endpoint, batch, "forward_passthrough", s.sinkEncoding(forwardSinkName)) == nil {
+		log.WithField("metrics", len(batch)).Debug("Completed passthrough forward to upstream Veneur")
+	}
+}
@@ -0,0 +1,104 @@
+package veneur
+
+import (
+	"compress/zlib"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestPassthroughGauges(t *testing.T) {
+	imported := make(chan []samplers.JSONMetric, 1)
+	globalVeneur := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/import", r.URL.Path)
+		zr, err := zlib.NewReader(r.Body)
+		assert.NoError(t, err)
+		var metrics []samplers.JSONMetric
+		assert.NoError(t, json.NewDecoder(zr).Decode(&metrics))
+		imported <- metrics
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer globalVeneur.Close()
+
+	s := &Server{
+		Workers:          []*Worker{NewWorker(1, nil, logrus.New())},
+		ForwardAddr:      globalVeneur.URL,
+		HTTPClient:       &http.Client{},
+		passthrough:      make(chan samplers.JSONMetric, 10),
+		passthroughTypes: map[string]bool{"gauge": true},
+	}
+	received := make(chan samplers.UDPMetric, 10)
+	go func() {
+		for m := range s.Workers[0].PacketChan {
+			received <- m
+		}
+	}()
+
+	s.HandleMetricPacket([]byte("a.b.c:1:3|g|#foo:bar"))
+	s.HandleMetricPacket([]byte("a.b.c:5|g|#veneurlocalonly"))
+	s.HandleMetricPacket([]byte("a.b.c:1|c"))
+
+	// gauges that aren't local-only skip the worker entirely
+	for _, typ := range []string{"gauge", "counter"} {
+		select {
+		case m := <-received:
+			assert.Equal(t, typ, m.Type)
+		case <-time.After(time.Second):
+			assert.Fail(t, "expected a metric at the worker")
+		}
+	}
+	assert.Len(t, s.passthrough, 2)
+
+	s.postPassthrough([]samplers.JSONMetric{<-s.passthrough, <-s.passthrough})
+	var metrics []samplers.JSONMetric
+	select {
+	case metrics = <-imported:
+	case <-time.After(time.Second):
+		assert.FailNow(t, "nothing was forwarded")
+	}
+	assert.Len(t, metrics, 2)
+
+	// the global veneur keeps the last value it was forwarded
+	global := NewWorker(1, nil, logrus.New())
+	for _, jm := range metrics {
+		assert.Equal(t, "gauge", jm.Type)
+		assert.Equal(t, "foo:bar", jm.JoinedTags)
+		global.ImportMetric(jm)
+	}
+	wm := global.Flush()
+	if assert.Len(t, wm.gauges, 1) {
+		for _, g := range wm.gauges {
+			assert.Equal(t, float64(3), g.Flush()[0].Value[0][1])
+		}
+	}
+}
+
+func TestPassthroughGaugesScaled(t *testing.T) {
+	scales, err := newMetricScales([]MetricScale{{Name: `_us$`, Scale: 0.001}})
+	assert.NoError(t, err)
+	s := &Server{
+		passthrough:      make(chan samplers.JSONMetric, 10),
+		passthroughTypes: map[string]bool{"gauge": true},
+		scales:           scales,
+	}
+	assert.True(t, s.passthroughMetric(samplers.NewUDPMetric("queue.age_us", "gauge", 3000, 1.0, nil)))
+
+	global := NewWorker(1, nil, logrus.New())
+	global.ImportMetric(<-s.passthrough)
+	for _, g := range global.Flush().gauges {
+		assert.Equal(t, float64(3), g.Flush()[0].Value[0][1], "passed-through gauges should be scaled like aggregated ones")
+	}
+}
+
+func TestPassthroughTypesConfig(t *testing.T) {
+	config := localConfig()
+	config.ForwardPassthroughTypes = []string{"histogram"}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "histograms need to be aggregated locally")
+}
@@ -0,0 +1,234 @@
+// Package cloudmonitoring flushes metrics to Google Cloud Monitoring (once
+// known as Stackdriver), as custom metrics.
+package cloudmonitoring
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+	"golang.org/x/oauth2"
+)
+
+var _ plugins.Plugin = &CloudMonitoringPlugin{}
+var _ plugins.DistributionSink = &CloudMonitoringPlugin{}
+
+// MaxBatchSize is the most time series the API accepts in one request, and
+// the default BatchSize.
+const MaxBatchSize = 200
+
+// DefaultMetricPrefix is prepended to each metric's name to make its metric
+// type, if MetricPrefix is not set.
+const DefaultMetricPrefix = "custom.googleapis.com/"
+
+// DefaultEndpoint is the Cloud Monitoring API.
+const DefaultEndpoint = "https://monitoring.googleapis.com/v3"
+
+// CloudMonitoringPlugin writes each flush to Cloud Monitoring as time series
+// of the "global" monitored resource, labelled with each metric's tags, host
+// and device. Gauges, and the aggregates of histograms and timers, become
+// GAUGE series. Custom metrics can't be DELTAs, so counters become
+// CUMULATIVE series, whose running totals the plugin keeps. The buckets of
+// histograms with histogram_buckets, and the sketches of those flushed as
+// distributions, are combined into a CUMULATIVE DISTRIBUTION series, named
+// for the histogram.
+type CloudMonitoringPlugin struct {
+	Logger      *logrus.Logger
+	Statsd      *statsd.Client
+	HTTPClient  *http.Client
+	Credentials oauth2.TokenSource
+	ProjectID   string
+	Endpoint    string
+	BatchSize   int
+	// RetryBudget is the retry budget shared with veneur's other sinks, or
+	// nil if failed requests aren't retried.
+	RetryBudget *plugins.RetryBudget
+	// ContentEncoding is what requests are compressed with, one of the
+	// plugins.Encoding* constants. Empty is plugins.EncodingNone.
+	ContentEncoding string
+
+	// flushes can overlap, and share the running totals. It is only held
+	// while they are updated, so that a slow flush doesn't hold up the next
+	mtx       sync.Mutex
+	converter *converter
+	now       func() time.Time
+}
+
+// NewCloudMonitoringPlugin creates a CloudMonitoringPlugin that writes to the
+// project with the given ID, naming metric types with metricPrefix (or
+// DefaultMetricPrefix, if it is empty). A batchSize that is not positive, or
+// more than MaxBatchSize, is MaxBatchSize.
+func NewCloudMonitoringPlugin(logger *logrus.Logger, stats *statsd.Client, client *http.Client, credentials oauth2.TokenSource, projectID, metricPrefix string, batchSize int) *CloudMonitoringPlugin {
+	if metricPrefix == "" {
+		metricPrefix = DefaultMetricPrefix
+	}
+	if batchSize <= 0 || batchSize > MaxBatchSize {
+		batchSize = MaxBatchSize
+	}
+	return &CloudMonitoringPlugin{
+		Logger:      logger,
+		Statsd:      stats,
+		HTTPClient:  client,
+		Credentials: credentials,
+		ProjectID:   projectID,
+		Endpoint:    DefaultEndpoint,
+		BatchSize:   batchSize,
+		converter:   newConverter(projectID, metricPrefix),
+		now:         time.Now,
+	}
+}
+
+// Name returns "cloud_monitoring".
+func (p *CloudMonitoringPlugin) Name() string {
+	return "cloud_monitoring"
+}
+
+// TakesDistributions returns true, since Cloud Monitoring can re-aggregate
+// distributions across hosts.
+func (p *CloudMonitoringPlugin) TakesDistributions() bool {
+	return true
+}
+
+// Flush writes the metrics to Cloud Monitoring, in batches of BatchSize
+// series. Every batch is sent regardless of whether the others fail, and the
+// first error encountered is returned.
+func (p *CloudMonitoringPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+	metrics = plugins.SkipUnserializable(p.Statsd, p.Logger, p.Name(), metrics, checkValue)
+
+	p.mtx.Lock()
+	series, skips := p.converter.convert(metrics, hostname, p.now())
+	p.mtx.Unlock()
+	for _, s := range skips {
+		plugins.ReportUnserializable(p.Statsd, p.Logger, p.Name(), s.metric, s.err)
+	}
+
+	var firstErr error
+	for start := 0; start < len(series); start += p.BatchSize {
+		end := start + p.BatchSize
+		if end > len(series) {
+			end = len(series)
+		}
+		body, err := json.Marshal(map[string][]timeSeries{"timeSeries": series[start:end]})
+		if err != nil {
+			p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{"cause:json"}, 1.0)
+			p.Logger.WithError(err).Error("Could not render JSON")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		jsonLength := len(body)
+		body, err = plugins.Compress(body, p.encoding())
+		if err != nil {
+			p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{"cause:compress"}, 1.0)
+			p.Logger.WithError(err).Error("Could not compress body")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if p.encoding() != plugins.EncodingNone && len(body) > 0 {
+			p.Statsd.Histogram("cloud_monitoring_post.compression_ratio", float64(jsonLength)/float64(len(body)), []string{"encoding:" + p.encoding()}, 1.0)
+		}
+		err = p.RetryBudget.Do(context.Background(), "cloud_monitoring_post", func() error {
+			return p.post(body)
+		})
+		if retryable, ok := err.(plugins.RetryableError); ok {
+			err = retryable.Err
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		p.Statsd.Count("cloud_monitoring.series_written_total", int64(end-start), nil, 1.0)
+	}
+	return firstErr
+}
+
+// post makes one attempt at writing a batch of time series. Errors that are
+// worth retrying are returned as plugins.RetryableErrors.
+func (p *CloudMonitoringPlugin) post(body []byte) error {
+	innerLogger := p.Logger.WithField("action", "cloud_monitoring_post")
+
+	token, err := p.Credentials.Token()
+	if err != nil {
+		p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{"cause:auth"}, 1.0)
+		innerLogger.WithError(err).Error("Could not get an access token")
+		return plugins.RetryableError{Err: err}
+	}
+
+	endpoint := fmt.Sprintf("%s/projects/%s/timeSeries", p.Endpoint, url.PathEscape(p.ProjectID))
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{"cause:construct"}, 1.0)
+		innerLogger.WithError(err).Error("Could not construct request")
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if header := plugins.ContentEncodingHeader(p.encoding()); header != "" {
+		req.Header.Set("Content-Encoding", header)
+	}
+	token.SetAuthHeader(req)
+	p.Statsd.Histogram("cloud_monitoring_post.content_length_bytes", float64(len(body)), []string{"encoding:" + p.encoding()}, 1.0)
+
+	requestStart := time.Now()
+	resp, err := p.HTTPClient.Do(req)
+	if err != nil {
+		p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{"cause:io"}, 1.0)
+		innerLogger.WithError(err).Error("Could not execute request")
+		return plugins.RetryableError{Err: err}
+	}
+	p.Statsd.TimeInMilliseconds("cloud_monitoring_post.duration_ns", float64(time.Since(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusOK {
+		innerLogger.WithField("status", resp.Status).Debug("POSTed successfully")
+		return nil
+	}
+	responseBody, _ := ioutil.ReadAll(resp.Body)
+	p.Statsd.Count("cloud_monitoring_post.error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
+	innerLogger.WithFields(logrus.Fields{
+		"status":        resp.Status,
+		"response_body": strings.TrimSpace(string(responseBody)),
+	}).Error("Could not POST")
+	err = fmt.Errorf("received %s from Cloud Monitoring", resp.Status)
+	if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+		return plugins.RetryableError{Err: err}
+	}
+	return err
+}
+
+// encoding returns what requests are compressed with.
+func (p *CloudMonitoringPlugin) encoding() string {
+	if p.ContentEncoding == "" {
+		return plugins.EncodingNone
+	}
+	return p.ContentEncoding
+}
+
+// checkValue returns an error if the metric's value can't be written to the
+// API, which has no way to represent NaN or the infinities.
+func checkValue(m samplers.DDMetric) error {
+	value := m.Value[0][1]
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("Cloud Monitoring can't represent the value %v", value)
+	}
+	return nil
+}
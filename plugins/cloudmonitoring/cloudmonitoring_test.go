@@ -0,0 +1,397 @@
+package cloudmonitoring
+
+import (
+	"compress/gzip"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/tdigest"
+	"golang.org/x/oauth2"
+)
+
+type staticToken string
+
+func (t staticToken) Token() (*oauth2.Token, error) {
+	return &oauth2.Token{AccessToken: string(t), TokenType: "Bearer"}, nil
+}
+
+func TestConvertGauge(t *testing.T) {
+	c := newConverter("my-project", DefaultMetricPrefix)
+	series, skips := c.convert([]samplers.DDMetric{{
+		Name:       "a.b-c",
+		Value:      [1][2]float64{{1500000000, 1.5}},
+		MetricType: "gauge",
+		Tags:       []string{"Env:prod", "9lives", "dd.internal:x"},
+		DeviceName: "sda",
+	}}, "localhost", time.Now())
+	assert.Empty(t, skips)
+	value := 1.5
+	assert.Equal(t, []timeSeries{{
+		Metric: metric{
+			Type: "custom.googleapis.com/a.b_c",
+			Labels: map[string]string{
+				"env":         "prod",
+				"l_9lives":    "true",
+				"dd_internal": "x",
+				"host":        "localhost",
+				"device":      "sda",
+			},
+		},
+		Resource:   monitoredResource{Type: "global", Labels: map[string]string{"project_id": "my-project"}},
+		MetricKind: "GAUGE",
+		ValueType:  "DOUBLE",
+		Points: []point{{
+			Interval: timeInterval{EndTime: "2017-07-14T02:40:00Z"},
+			Value:    typedValue{DoubleValue: &value},
+		}},
+	}}, series)
+}
+
+func TestConvertCounterCumulative(t *testing.T) {
+	c := newConverter("p", DefaultMetricPrefix)
+	now := time.Unix(1500000000, 0)
+	flush := func(ts float64, rate float64) timeSeries {
+		series, skips := c.convert([]samplers.DDMetric{{
+			Name:       "a.b.c",
+			Value:      [1][2]float64{{ts, rate}},
+			MetricType: "rate",
+			Interval:   10,
+		}}, "localhost", now)
+		assert.Empty(t, skips)
+		if !assert.Len(t, series, 1) {
+			return timeSeries{}
+		}
+		return series[0]
+	}
+
+	first := flush(1500000000, 0.5)
+	assert.Equal(t, "CUMULATIVE", first.MetricKind)
+	assert.Equal(t, timeInterval{StartTime: "2017-07-14T02:39:50Z", EndTime: "2017-07-14T02:40:00Z"}, first.Points[0].Interval)
+	assert.Equal(t, 5.0, *first.Points[0].Value.DoubleValue, "rates should be converted back into counts")
+
+	second := flush(1500000010, 0.2)
+	assert.Equal(t, timeInterval{StartTime: "2017-07-14T02:39:50Z", EndTime: "2017-07-14T02:40:10Z"}, second.Points[0].Interval, "the start should stay put")
+	assert.Equal(t, 7.0, *second.Points[0].Value.DoubleValue)
+
+	_, skips := c.convert([]samplers.DDMetric{{Name: "a.b.c", Value: [1][2]float64{{1500000010, 1}}, MetricType: "rate", Interval: 10}}, "localhost", now)
+	assert.Len(t, skips, 1, "a point no later than the last should be skipped")
+
+	// series that go quiet are forgotten
+	now = now.Add(2 * time.Hour)
+	c.convert(nil, "localhost", now)
+	assert.Empty(t, c.series)
+}
+
+func TestConvertDistribution(t *testing.T) {
+	c := newConverter("p", DefaultMetricPrefix)
+	bucket := func(le string, count float64) samplers.DDMetric {
+		return samplers.DDMetric{Name: "a.b.c_bucket", Value: [1][2]float64{{1500000000, count}}, MetricType: "count", Interval: 10, Tags: []string{"foo:bar", "le:" + le}}
+	}
+	metrics := []samplers.DDMetric{
+		bucket("1", 2),
+		bucket("10", 5),
+		bucket("+Inf", 6),
+		{Name: "a.b.c_sum", Value: [1][2]float64{{1500000000, 30}}, MetricType: "count", Interval: 10, Tags: []string{"foo:bar"}},
+		{Name: "a.b.c_count", Value: [1][2]float64{{1500000000, 6}}, MetricType: "count", Interval: 10, Tags: []string{"foo:bar"}},
+		{Name: "a.b.c.max", Value: [1][2]float64{{1500000000, 12}}, MetricType: "gauge", Tags: []string{"foo:bar"}},
+	}
+	series, skips := c.convert(metrics, "localhost", time.Now())
+	assert.Empty(t, skips)
+	if !assert.Len(t, series, 2) {
+		return
+	}
+	assert.Equal(t, "custom.googleapis.com/a.b.c.max", series[0].Metric.Type)
+	dist := series[1]
+	assert.Equal(t, "custom.googleapis.com/a.b.c", dist.Metric.Type)
+	assert.Equal(t, map[string]string{"foo": "bar", "host": "localhost"}, dist.Metric.Labels)
+	assert.Equal(t, "CUMULATIVE", dist.MetricKind)
+	assert.Equal(t, "DISTRIBUTION", dist.ValueType)
+	assert.Equal(t, &distribution{
+		Count:         6,
+		Mean:          5,
+		BucketOptions: bucketOptions{ExplicitBuckets: explicitBuckets{Bounds: []float64{1, 10}}},
+		BucketCounts:  []string{"2", "3", "1"},
+	}, dist.Points[0].Value.DistributionValue)
+}
+
+func TestConvertSketch(t *testing.T) {
+	c := newConverter("p", DefaultMetricPrefix)
+	sketch := func(ts float64) samplers.DDMetric {
+		return samplers.DDMetric{
+			Name:       "a.b.c",
+			Value:      [1][2]float64{{ts, 6}},
+			MetricType: "distribution",
+			Tags:       []string{"foo:bar"},
+			Distribution: []tdigest.Centroid{
+				{Mean: -1, Weight: 1},
+				{Mean: 0.5, Weight: 2},
+				{Mean: 3, Weight: 3},
+			},
+		}
+	}
+	counts := func(buckets map[int]string) []string {
+		all := make([]string, len(sketchBounds)+1)
+		for i := range all {
+			all[i] = "0"
+		}
+		for i, n := range buckets {
+			all[i] = n
+		}
+		return all
+	}
+
+	series, skips := c.convert([]samplers.DDMetric{sketch(1500000000)}, "localhost", time.Now())
+	assert.Empty(t, skips)
+	if !assert.Len(t, series, 1) {
+		return
+	}
+	assert.Equal(t, "custom.googleapis.com/a.b.c", series[0].Metric.Type)
+	assert.Equal(t, "CUMULATIVE", series[0].MetricKind)
+	assert.Equal(t, "DISTRIBUTION", series[0].ValueType)
+	assert.Equal(t, &distribution{
+		Count:         6,
+		Mean:          1.5,
+		BucketOptions: bucketOptions{ExplicitBuckets: explicitBuckets{Bounds: sketchBounds}},
+		// below 2^-10, up to 2^-1 and up to 2^2
+		BucketCounts: counts(map[int]string{0: "1", 9: "2", 12: "3"}),
+	}, series[0].Points[0].Value.DistributionValue)
+
+	series, _ = c.convert([]samplers.DDMetric{sketch(1500000010)}, "localhost", time.Now())
+	if assert.Len(t, series, 1) {
+		dist := series[0].Points[0].Value.DistributionValue
+		assert.Equal(t, int64(12), dist.Count, "the counts are cumulative")
+		assert.Equal(t, counts(map[int]string{0: "2", 9: "4", 12: "6"}), dist.BucketCounts)
+	}
+
+	bucket := samplers.DDMetric{Name: "a.b.c_bucket", Value: [1][2]float64{{1500000020, 6}}, MetricType: "count", Tags: []string{"foo:bar", "le:+Inf"}}
+	series, skips = c.convert([]samplers.DDMetric{sketch(1500000020), bucket}, "localhost", time.Now())
+	assert.Empty(t, skips, "a histogram's buckets take the place of its sketch")
+	if assert.Len(t, series, 1) {
+		assert.Empty(t, series[0].Points[0].Value.DistributionValue.BucketOptions.ExplicitBuckets.Bounds)
+	}
+}
+
+func TestConvertDuplicateSeries(t *testing.T) {
+	c := newConverter("p", DefaultMetricPrefix)
+	series, skips := c.convert([]samplers.DDMetric{
+		{Name: "a.b.c", Value: [1][2]float64{{1500000000, 1}}, MetricType: "gauge", Tags: []string{"Foo:bar"}},
+		{Name: "a.b.c", Value: [1][2]float64{{1500000000, 2}}, MetricType: "gauge", Tags: []string{"foo:bar"}},
+	}, "", time.Now())
+	assert.Len(t, series, 1)
+	assert.Len(t, skips, 1, "the API rejects requests with the same series twice")
+}
+
+func TestMetricLabelsLimits(t *testing.T) {
+	var tags []string
+	for i := 0; i < 40; i++ {
+		tags = append(tags, fmt.Sprintf("k%02d:v", i))
+	}
+	tags = append(tags, "a:"+strings.Repeat("é", 600))
+	labels := metricLabels(samplers.DDMetric{Tags: tags}, "")
+	assert.Len(t, labels, maxLabels)
+	assert.Contains(t, labels, "k00")
+	assert.NotContains(t, labels, "k39")
+	assert.Len(t, labels["a"], 1024)
+	assert.Equal(t, strings.Repeat("x", 100), sanitizeLabelKey(strings.Repeat("X", 150)))
+}
+
+func TestFlush(t *testing.T) {
+	var requests []map[string][]timeSeries
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/projects/my-project/timeSeries", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		var body map[string][]timeSeries
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		requests = append(requests, body)
+		if len(requests) == 2 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	p := NewCloudMonitoringPlugin(logrus.New(), nil, &http.Client{}, staticToken("secret"), "my-project", "", 500)
+	assert.Equal(t, MaxBatchSize, p.BatchSize)
+	p.Endpoint = server.URL
+	metrics := make([]samplers.DDMetric, 450)
+	for i := range metrics {
+		metrics[i] = samplers.DDMetric{Name: fmt.Sprintf("m%d", i), Value: [1][2]float64{{1500000000, 1}}, MetricType: "gauge"}
+	}
+	metrics = append(metrics, samplers.DDMetric{Name: "nan", Value: [1][2]float64{{1500000000, math.NaN()}}, MetricType: "gauge"})
+
+	err := p.Flush(metrics, "localhost")
+	assert.EqualError(t, err, "received 400 Bad Request from Cloud Monitoring")
+	if assert.Len(t, requests, 3, "every batch should be sent, however the others fare") {
+		assert.Len(t, requests[0]["timeSeries"], 200)
+		assert.Len(t, requests[2]["timeSeries"], 50, "the NaN should have been skipped")
+	}
+}
+
+func TestFlushGzip(t *testing.T) {
+	var body map[string][]timeSeries
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "gzip", r.Header.Get("Content-Encoding"))
+		gz, err := gzip.NewReader(r.Body)
+		assert.NoError(t, err)
+		assert.NoError(t, json.NewDecoder(gz).Decode(&body))
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	p := NewCloudMonitoringPlugin(logrus.New(), nil, &http.Client{}, staticToken("secret"), "my-project", "", 0)
+	p.Endpoint = server.URL
+	p.ContentEncoding = plugins.EncodingGzip
+	assert.NoError(t, p.Flush([]samplers.DDMetric{{Name: "a", Value: [1][2]float64{{1500000000, 1}}, MetricType: "gauge"}}, "localhost"))
+	assert.Len(t, body["timeSeries"], 1, "Cloud Monitoring should get a body it can decode")
+}
+
+func TestFlushOverlapping(t *testing.T) {
+	var requests int32
+	blocked := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the first flush's request hangs
+		if atomic.AddInt32(&requests, 1) == 1 {
+			close(blocked)
+			<-release
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+	defer close(release)
+
+	p := NewCloudMonitoringPlugin(logrus.New(), nil, &http.Client{}, staticToken("secret"), "my-project", "", 0)
+	p.Endpoint = server.URL
+	metrics := []samplers.DDMetric{{Name: "a", Value: [1][2]float64{{1500000000, 1}}, MetricType: "gauge"}}
+	go p.Flush(metrics, "localhost")
+	<-blocked
+
+	done := make(chan error)
+	go func() { done <- p.Flush(metrics, "localhost") }()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("a flush should not wait for another's requests")
+	}
+}
+
+func TestServiceAccountCredentials(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	assert.NoError(t, err)
+
+	fetches := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fetches++
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "urn:ietf:params:oauth:grant-type:jwt-bearer", r.PostForm.Get("grant_type"))
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		if assert.Len(t, parts, 3) {
+			sum := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+			signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+			assert.NoError(t, err)
+			assert.NoError(t, rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, sum[:], signature))
+			claims, err := base64.RawURLEncoding.DecodeString(parts[1])
+			assert.NoError(t, err)
+			assert.Contains(t, string(claims), `"iss":"veneur@my-project.iam.gserviceaccount.com"`)
+		}
+		w.Write([]byte(`{"access_token":"secret","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer server.Close()
+
+	creds, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "veneur@my-project.iam.gserviceaccount.com",
+		"private_key_id": "abc",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      server.URL,
+	})
+	assert.NoError(t, err)
+	source, err := CredentialsFromJSON(creds, &http.Client{})
+	assert.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		token, err := source.Token()
+		assert.NoError(t, err)
+		assert.Equal(t, "secret", token.AccessToken)
+	}
+	assert.Equal(t, 1, fetches, "the token should be reused until it expires")
+
+	_, err = CredentialsFromJSON([]byte(`{"type":"unknown"}`), &http.Client{})
+	assert.Error(t, err)
+}
+
+func TestMetadataCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+		switch r.URL.Path {
+		case "/computeMetadata/v1/project/project-id":
+			w.Write([]byte("my-project"))
+		case "/computeMetadata/v1/instance/service-accounts/default/token":
+			w.Write([]byte(`{"access_token":"from-metadata","expires_in":3600}`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	// with no credentials files to be found
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", "")
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("GCE_METADATA_HOST", strings.TrimPrefix(server.URL, "http://"))
+	source, err := DefaultCredentials(&http.Client{})
+	assert.NoError(t, err)
+	token, err := source.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "from-metadata", token.AccessToken)
+}
+
+func TestDefaultCredentialsFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.NoError(t, r.ParseForm())
+		assert.Equal(t, "refresh_token", r.PostForm.Get("grant_type"))
+		assert.Equal(t, "refresh", r.PostForm.Get("refresh_token"))
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"from-file","expires_in":3600,"token_type":"Bearer"}`))
+	}))
+	defer server.Close()
+
+	path := filepath.Join(t.TempDir(), "credentials.json")
+	creds, err := json.Marshal(map[string]string{
+		"type":          "authorized_user",
+		"client_id":     "id",
+		"client_secret": "secret",
+		"refresh_token": "refresh",
+		"token_uri":     server.URL,
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, creds, 0600))
+	t.Setenv("GOOGLE_APPLICATION_CREDENTIALS", path)
+	source, err := DefaultCredentials(&http.Client{})
+	assert.NoError(t, err)
+	token, err := source.Token()
+	assert.NoError(t, err)
+	assert.Equal(t, "from-file", token.AccessToken)
+}
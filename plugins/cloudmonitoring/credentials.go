@@ -0,0 +1,39 @@
+package cloudmonitoring
+
+import (
+	"context"
+	"net/http"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+// monitoringWriteScope is the only OAuth2 scope the plugin needs.
+const monitoringWriteScope = "https://www.googleapis.com/auth/monitoring.write"
+
+// DefaultCredentials finds Application Default Credentials the way Google's
+// client libraries do, with google.DefaultTokenSource: from the JSON file
+// named by the GOOGLE_APPLICATION_CREDENTIALS environment variable if it is
+// set, then from the file that `gcloud auth application-default login`
+// writes, and otherwise from the metadata server of the GCE instance (or GKE
+// node) that veneur is running on. Tokens are fetched with client, and
+// reused until they are about to expire.
+func DefaultCredentials(client *http.Client) (oauth2.TokenSource, error) {
+	return google.DefaultTokenSource(withClient(client), monitoringWriteScope)
+}
+
+// CredentialsFromJSON creates a TokenSource from a service account key, or
+// authorized user credentials, in JSON. Tokens are fetched with client.
+func CredentialsFromJSON(data []byte, client *http.Client) (oauth2.TokenSource, error) {
+	creds, err := google.CredentialsFromJSON(withClient(client), data, monitoringWriteScope)
+	if err != nil {
+		return nil, err
+	}
+	return creds.TokenSource, nil
+}
+
+// withClient returns a context that makes the oauth2 package fetch tokens
+// with client, rather than http.DefaultClient.
+func withClient(client *http.Client) context.Context {
+	return context.WithValue(context.Background(), oauth2.HTTPClient, client)
+}
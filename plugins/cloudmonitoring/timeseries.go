@@ -0,0 +1,533 @@
+package cloudmonitoring
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// These are the JSON forms of the Cloud Monitoring v3 API's types, as far as
+// the plugin uses them.
+
+type timeSeries struct {
+	Metric     metric            `json:"metric"`
+	Resource   monitoredResource `json:"resource"`
+	MetricKind string            `json:"metricKind"`
+	ValueType  string            `json:"valueType"`
+	Points     []point           `json:"points"`
+}
+
+type metric struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type monitoredResource struct {
+	Type   string            `json:"type"`
+	Labels map[string]string `json:"labels"`
+}
+
+type point struct {
+	Interval timeInterval `json:"interval"`
+	Value    typedValue   `json:"value"`
+}
+
+type timeInterval struct {
+	StartTime string `json:"startTime,omitempty"`
+	EndTime   string `json:"endTime"`
+}
+
+type typedValue struct {
+	DoubleValue       *float64      `json:"doubleValue,omitempty"`
+	DistributionValue *distribution `json:"distributionValue,omitempty"`
+}
+
+type distribution struct {
+	Count         int64         `json:"count,string"`
+	Mean          float64       `json:"mean"`
+	BucketOptions bucketOptions `json:"bucketOptions"`
+	// int64s, which the API's JSON carries as strings
+	BucketCounts []string `json:"bucketCounts"`
+}
+
+type bucketOptions struct {
+	ExplicitBuckets explicitBuckets `json:"explicitBuckets"`
+}
+
+type explicitBuckets struct {
+	Bounds []float64 `json:"bounds"`
+}
+
+const (
+	metricKindGauge       = "GAUGE"
+	metricKindCumulative  = "CUMULATIVE"
+	valueTypeDouble       = "DOUBLE"
+	valueTypeDistribution = "DISTRIBUTION"
+)
+
+// The API's limits on labels.
+const (
+	maxLabels        = 30
+	maxLabelKeyLen   = 100
+	maxLabelValueLen = 1024
+)
+
+// cumulativeExpiry is how long a cumulative series is remembered after it
+// was last flushed. One that comes back after that starts again from zero,
+// which Cloud Monitoring treats as a reset.
+const cumulativeExpiry = time.Hour
+
+// cumulative is the running total of a counter, or of a histogram's
+// buckets, since start.
+type cumulative struct {
+	start    time.Time
+	lastEnd  time.Time
+	lastSeen time.Time
+
+	total float64
+
+	bounds  []float64
+	buckets []float64
+	sum     float64
+}
+
+// converter turns flushed metrics into time series. Custom metrics can't be
+// DELTAs, so counters, which veneur flushes as the count over each interval,
+// are written as CUMULATIVE series, whose running totals are kept here.
+type converter struct {
+	project string
+	prefix  string
+	series  map[string]*cumulative
+}
+
+func newConverter(project, prefix string) *converter {
+	return &converter{project: project, prefix: prefix, series: map[string]*cumulative{}}
+}
+
+// skipped is a metric that couldn't be converted.
+type skipped struct {
+	metric samplers.DDMetric
+	err    error
+}
+
+// scalar is a metric on its way to becoming a time series.
+type scalar struct {
+	metric samplers.DDMetric
+	labels map[string]string
+}
+
+// histogram gathers the bucket, sum and count series that a histogram with
+// histogram_buckets is flushed as, since Cloud Monitoring represents them
+// together, as one distribution.
+type histogram struct {
+	name   string
+	first  samplers.DDMetric
+	labels map[string]string
+	// the cumulative counts of each bucket, by upper bound
+	le         map[float64]float64
+	sum, count float64
+}
+
+// sketchBounds are the bucket bounds that the sketches of distribution
+// metrics are written with: the powers of two from 2^-10 to 2^30. They have
+// to be the same every flush, for the counts to be added to the running
+// totals, so they can't follow the centroids.
+var sketchBounds = func() []float64 {
+	bounds := make([]float64, 41)
+	for i := range bounds {
+		bounds[i] = math.Ldexp(1, i-10)
+	}
+	return bounds
+}()
+
+// sketchHistogram gathers a distribution metric's centroids into the
+// buckets of sketchBounds, each centroid falling in the bucket of its mean.
+func sketchHistogram(m samplers.DDMetric, labels map[string]string) *histogram {
+	h := &histogram{name: m.Name, first: m, labels: labels, le: map[float64]float64{}}
+	for _, bound := range sketchBounds {
+		h.le[bound] = 0
+	}
+	for _, c := range m.Distribution {
+		h.sum += c.Mean * c.Weight
+		h.count += c.Weight
+		i := sort.SearchFloat64s(sketchBounds, c.Mean)
+		if i < len(sketchBounds) {
+			h.le[sketchBounds[i]] += c.Weight
+		}
+	}
+	// the counts are cumulative
+	below := 0.0
+	for _, bound := range sketchBounds {
+		below += h.le[bound]
+		h.le[bound] = below
+	}
+	h.le[math.Inf(1)] = h.count
+	return h
+}
+
+// convert converts the metrics into time series, at most one per series, as
+// the API requires of each request. hostname is the host of metrics that
+// don't have their own.
+func (c *converter) convert(metrics []samplers.DDMetric, hostname string, now time.Time) ([]timeSeries, []skipped) {
+	var scalars []scalar
+	var histograms []*histogram
+	byKey := map[string]*histogram{}
+	var rest []scalar
+	var sketches []scalar
+	for _, m := range metrics {
+		labels := metricLabels(m, hostname)
+		if m.MetricType == "distribution" {
+			sketches = append(sketches, scalar{metric: m, labels: labels})
+			continue
+		}
+		if base, le, ok := bucketOf(m, labels); ok {
+			key := seriesKey(base, labels)
+			h := byKey[key]
+			if h == nil {
+				h = &histogram{name: base, first: m, labels: labels, le: map[float64]float64{}}
+				byKey[key] = h
+				histograms = append(histograms, h)
+			}
+			h.le[le] = m.Value[0][1]
+			continue
+		}
+		rest = append(rest, scalar{metric: m, labels: labels})
+	}
+	for _, s := range sketches {
+		key := seriesKey(s.metric.Name, s.labels)
+		if byKey[key] != nil {
+			// its histogram_buckets are already a distribution, and more
+			// precise than the sketch's
+			continue
+		}
+		h := sketchHistogram(s.metric, s.labels)
+		byKey[key] = h
+		histograms = append(histograms, h)
+	}
+	for _, s := range rest {
+		if s.metric.MetricType == "count" && len(histograms) > 0 {
+			if base := strings.TrimSuffix(s.metric.Name, "_sum"); base != s.metric.Name {
+				if h := byKey[seriesKey(base, s.labels)]; h != nil {
+					h.sum = s.metric.Value[0][1]
+					continue
+				}
+			}
+			if base := strings.TrimSuffix(s.metric.Name, "_count"); base != s.metric.Name {
+				if h := byKey[seriesKey(base, s.labels)]; h != nil {
+					h.count = s.metric.Value[0][1]
+					continue
+				}
+			}
+		}
+		scalars = append(scalars, s)
+	}
+
+	var series []timeSeries
+	var skips []skipped
+	written := map[string]bool{}
+	add := func(m samplers.DDMetric, metricType string, labels map[string]string, convert func(key string) (timeSeries, error)) {
+		key := seriesKey(metricType, labels)
+		if written[key] {
+			skips = append(skips, skipped{metric: m, err: fmt.Errorf("%s is the same series as another metric once its labels are sanitized", metricType)})
+			return
+		}
+		ts, err := convert(key)
+		if err != nil {
+			skips = append(skips, skipped{metric: m, err: err})
+			return
+		}
+		written[key] = true
+		series = append(series, ts)
+	}
+	for _, s := range scalars {
+		metricType := c.metricType(s.metric.Name)
+		add(s.metric, metricType, s.labels, func(key string) (timeSeries, error) {
+			return c.scalarSeries(s.metric, metricType, key, s.labels, now)
+		})
+	}
+	for _, h := range histograms {
+		metricType := c.metricType(h.name)
+		add(h.first, metricType, h.labels, func(key string) (timeSeries, error) {
+			return c.distributionSeries(h, metricType, key, now)
+		})
+	}
+
+	for key, state := range c.series {
+		if now.Sub(state.lastSeen) > cumulativeExpiry {
+			delete(c.series, key)
+		}
+	}
+	return series, skips
+}
+
+func (c *converter) newSeries(metricType string, labels map[string]string, kind, valueType string) timeSeries {
+	return timeSeries{
+		Metric: metric{Type: metricType, Labels: labels},
+		Resource: monitoredResource{
+			Type:   "global",
+			Labels: map[string]string{"project_id": c.project},
+		},
+		MetricKind: kind,
+		ValueType:  valueType,
+	}
+}
+
+// scalarSeries converts a gauge into a GAUGE series, and a counter into a
+// CUMULATIVE one.
+func (c *converter) scalarSeries(m samplers.DDMetric, metricType, key string, labels map[string]string, now time.Time) (timeSeries, error) {
+	end := time.Unix(int64(m.Value[0][0]), 0)
+	value := m.Value[0][1]
+	switch m.MetricType {
+	case "rate", "count":
+		if m.MetricType == "rate" {
+			// rates are per second, and the total is the count
+			value *= float64(m.Interval)
+		}
+		state, err := c.cumulative(key, m, end, now)
+		if err != nil {
+			return timeSeries{}, err
+		}
+		if state.bounds != nil {
+			// it was a distribution before
+			*state = cumulative{start: state.start, lastEnd: end, lastSeen: now}
+		}
+		state.total += value
+		ts := c.newSeries(metricType, labels, metricKindCumulative, valueTypeDouble)
+		total := state.total
+		ts.Points = []point{{
+			Interval: timeInterval{StartTime: formatTime(state.start), EndTime: formatTime(end)},
+			Value:    typedValue{DoubleValue: &total},
+		}}
+		return ts, nil
+	default:
+		ts := c.newSeries(metricType, labels, metricKindGauge, valueTypeDouble)
+		ts.Points = []point{{
+			Interval: timeInterval{EndTime: formatTime(end)},
+			Value:    typedValue{DoubleValue: &value},
+		}}
+		return ts, nil
+	}
+}
+
+// distributionSeries converts a histogram's buckets, or a sketch's, into a
+// CUMULATIVE DISTRIBUTION series.
+func (c *converter) distributionSeries(h *histogram, metricType, key string, now time.Time) (timeSeries, error) {
+	end := time.Unix(int64(h.first.Value[0][0]), 0)
+	state, err := c.cumulative(key, h.first, end, now)
+	if err != nil {
+		return timeSeries{}, err
+	}
+
+	var bounds []float64
+	for le := range h.le {
+		if !math.IsInf(le, 1) {
+			bounds = append(bounds, le)
+		}
+	}
+	sort.Float64s(bounds)
+	// the API's buckets are an underflow bucket below the first bound, one
+	// between each pair of bounds, and an overflow bucket above the last,
+	// and each holds only its own count, rather than everything below it
+	buckets := make([]float64, len(bounds)+1)
+	below := 0.0
+	for i, bound := range bounds {
+		buckets[i] = h.le[bound] - below
+		below = h.le[bound]
+	}
+	total, ok := h.le[math.Inf(1)]
+	if !ok {
+		total = h.count
+	}
+	buckets[len(bounds)] = math.Max(total-below, 0)
+
+	if !equalBounds(state.bounds, bounds) {
+		// the buckets changed, so the totals so far can't be added to
+		*state = cumulative{start: state.start, lastEnd: end, lastSeen: now, bounds: bounds}
+	}
+	if state.buckets == nil {
+		state.buckets = make([]float64, len(buckets))
+	}
+	for i, n := range buckets {
+		state.buckets[i] += n
+	}
+	state.sum += h.sum
+
+	// the counts have to be integers, which they aren't necessarily, since
+	// they're weighted by sample rates, and the overall count has to be
+	// their sum
+	dist := &distribution{
+		BucketOptions: bucketOptions{ExplicitBuckets: explicitBuckets{Bounds: bounds}},
+		BucketCounts:  make([]string, len(state.buckets)),
+	}
+	for i, n := range state.buckets {
+		rounded := int64(math.Floor(n + 0.5))
+		dist.Count += rounded
+		dist.BucketCounts[i] = strconv.FormatInt(rounded, 10)
+	}
+	if dist.Count > 0 {
+		dist.Mean = state.sum / float64(dist.Count)
+	}
+
+	ts := c.newSeries(metricType, h.labels, metricKindCumulative, valueTypeDistribution)
+	ts.Points = []point{{
+		Interval: timeInterval{StartTime: formatTime(state.start), EndTime: formatTime(end)},
+		Value:    typedValue{DistributionValue: dist},
+	}}
+	return ts, nil
+}
+
+// cumulative returns the running totals of a series, which begin at the
+// start of the interval of the first metric flushed for it.
+func (c *converter) cumulative(key string, m samplers.DDMetric, end, now time.Time) (*cumulative, error) {
+	state := c.series[key]
+	if state == nil {
+		interval := time.Duration(m.Interval) * time.Second
+		if interval <= 0 {
+			interval = time.Second
+		}
+		state = &cumulative{start: end.Add(-interval)}
+		c.series[key] = state
+	} else if !end.After(state.lastEnd) {
+		return nil, fmt.Errorf("the point at %s is no later than the last one written, at %s", formatTime(end), formatTime(state.lastEnd))
+	}
+	state.lastEnd = end
+	state.lastSeen = now
+	return state, nil
+}
+
+// bucketOf reports whether the metric is one of the buckets of a histogram
+// with histogram_buckets, and if so, the name of the histogram and the
+// bucket's upper bound. The bound's le label is removed from labels.
+func bucketOf(m samplers.DDMetric, labels map[string]string) (string, float64, bool) {
+	if m.MetricType != "count" || !strings.HasSuffix(m.Name, "_bucket") {
+		return "", 0, false
+	}
+	le, ok := labels["le"]
+	if !ok {
+		return "", 0, false
+	}
+	bound, err := strconv.ParseFloat(le, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	delete(labels, "le")
+	return strings.TrimSuffix(m.Name, "_bucket"), bound, true
+}
+
+// metricLabels converts the metric's tags, host and device into labels.
+// Tags without a value are given the value "true". If there are more than
+// the API allows, the ones with the first keys in sorted order are kept.
+func metricLabels(m samplers.DDMetric, hostname string) map[string]string {
+	labels := make(map[string]string, len(m.Tags)+2)
+	for _, tag := range m.Tags {
+		key, value := tag, "true"
+		if colon := strings.IndexByte(tag, ':'); colon != -1 {
+			key, value = tag[:colon], tag[colon+1:]
+		}
+		labels[sanitizeLabelKey(key)] = truncateLabelValue(value)
+	}
+	host := m.Hostname
+	if host == "" {
+		host = hostname
+	}
+	if host != "" {
+		labels["host"] = truncateLabelValue(host)
+	}
+	if m.DeviceName != "" {
+		labels["device"] = truncateLabelValue(m.DeviceName)
+	}
+
+	if len(labels) > maxLabels {
+		keys := make([]string, 0, len(labels))
+		for key := range labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys[maxLabels:] {
+			delete(labels, key)
+		}
+	}
+	return labels
+}
+
+// sanitizeLabelKey converts a tag key into a label key, which must be at
+// most 100 lowercase letters, digits and underscores, starting with a
+// letter.
+func sanitizeLabelKey(key string) string {
+	b := make([]byte, 0, len(key)+2)
+	for i := 0; i < len(key); i++ {
+		ch := key[i]
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= '0' && ch <= '9', ch == '_':
+		case ch >= 'A' && ch <= 'Z':
+			ch += 'a' - 'A'
+		default:
+			ch = '_'
+		}
+		b = append(b, ch)
+	}
+	if len(b) == 0 || b[0] < 'a' || b[0] > 'z' {
+		b = append([]byte("l_"), b...)
+	}
+	if len(b) > maxLabelKeyLen {
+		b = b[:maxLabelKeyLen]
+	}
+	return string(b)
+}
+
+// truncateLabelValue shortens a label value to the most bytes the API
+// allows, without splitting a character.
+func truncateLabelValue(value string) string {
+	if len(value) <= maxLabelValueLen {
+		return value
+	}
+	end := maxLabelValueLen
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end]
+}
+
+// metricType converts a metric's name into a metric type, whose path may
+// only have letters, digits, underscores, dots and slashes.
+func (c *converter) metricType(name string) string {
+	b := []byte(name)
+	for i, ch := range b {
+		if !(ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' || ch >= '0' && ch <= '9' || ch == '_' || ch == '.' || ch == '/') {
+			b[i] = '_'
+		}
+	}
+	return c.prefix + string(b)
+}
+
+// seriesKey identifies a time series by its metric type and labels.
+func seriesKey(metricType string, labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return metricType + "\x00" + strings.Join(pairs, "\x00")
+}
+
+func equalBounds(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339Nano)
+}
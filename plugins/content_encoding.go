@@ -0,0 +1,101 @@
+package plugins
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// The Content-Encodings that HTTP sinks can compress their request bodies
+// with.
+const (
+	EncodingNone = "none"
+	EncodingGzip = "gzip"
+	// a zlib stream, which is what HTTP calls deflate
+	EncodingDeflate = "deflate"
+)
+
+// CheckContentEncoding returns an error if HTTP sinks can't compress their
+// bodies with encoding.
+func CheckContentEncoding(encoding string) error {
+	switch encoding {
+	case EncodingNone, EncodingGzip, EncodingDeflate:
+		return nil
+	case "zstd":
+		return errors.New("zstd is not supported, since there is no zstd implementation in this build; use gzip or deflate")
+	}
+	return fmt.Errorf("content encoding must be %q, %q or %q, got %q", EncodingNone, EncodingGzip, EncodingDeflate, encoding)
+}
+
+// ContentEncodingHeader returns the Content-Encoding header of a body
+// compressed with encoding, or "" if it isn't compressed.
+func ContentEncodingHeader(encoding string) string {
+	if encoding == EncodingNone || encoding == "" {
+		return ""
+	}
+	return encoding
+}
+
+// NewCompressor returns a writer that compresses what is written to it into
+// w with encoding, at level, which is one of compress/flate's levels. It
+// must be closed to write the last of the compressed body. With
+// EncodingNone, or no encoding, it writes to w as it is.
+func NewCompressor(w io.Writer, encoding string, level int) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingNone, "":
+		return nopCloser{w}, nil
+	case EncodingGzip:
+		return gzip.NewWriterLevel(w, level)
+	case EncodingDeflate:
+		return zlib.NewWriterLevel(w, level)
+	}
+	return nil, CheckContentEncoding(encoding)
+}
+
+// Compress returns body compressed with encoding, at compress/flate's
+// default level.
+func Compress(body []byte, encoding string) ([]byte, error) {
+	if encoding == EncodingNone || encoding == "" {
+		return body, nil
+	}
+	var buf bytes.Buffer
+	compressor, err := NewCompressor(&buf, encoding, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := compressor.Write(body); err != nil {
+		return nil, err
+	}
+	if err := compressor.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewDecompressor returns a reader of the body r, which was compressed with
+// the Content-Encoding encoding, for the receiving end of a sink. An empty
+// encoding is an uncompressed body.
+func NewDecompressor(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case EncodingNone, "":
+		return ioutil.NopCloser(r), nil
+	case EncodingGzip:
+		return gzip.NewReader(r)
+	case EncodingDeflate:
+		return zlib.NewReader(r)
+	}
+	return nil, CheckContentEncoding(encoding)
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,52 @@
+package plugins
+
+import (
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestContentEncodings(t *testing.T) {
+	body := []byte(strings.Repeat(`{"metric":"a.b.c","points":[[1500000000,1]]}`, 100))
+	for _, encoding := range []string{EncodingNone, EncodingGzip, EncodingDeflate} {
+		t.Run(encoding, func(t *testing.T) {
+			assert.NoError(t, CheckContentEncoding(encoding))
+			var buf bytes.Buffer
+			compressor, err := NewCompressor(&buf, encoding, flate.BestSpeed)
+			assert.NoError(t, err)
+			_, err = compressor.Write(body)
+			assert.NoError(t, err)
+			assert.NoError(t, compressor.Close())
+			if encoding != EncodingNone {
+				assert.True(t, buf.Len() < len(body), "the body should be compressed")
+			}
+
+			decompressor, err := NewDecompressor(&buf, ContentEncodingHeader(encoding))
+			assert.NoError(t, err)
+			decoded, err := ioutil.ReadAll(decompressor)
+			assert.NoError(t, err)
+			assert.Equal(t, body, decoded)
+
+			compressed, err := Compress(body, encoding)
+			assert.NoError(t, err)
+			decompressor, err = NewDecompressor(bytes.NewReader(compressed), ContentEncodingHeader(encoding))
+			assert.NoError(t, err)
+			decoded, err = ioutil.ReadAll(decompressor)
+			assert.NoError(t, err)
+			assert.Equal(t, body, decoded)
+		})
+	}
+	assert.Equal(t, "", ContentEncodingHeader(EncodingNone), "uncompressed bodies have no Content-Encoding")
+
+	for _, encoding := range []string{"zstd", "br", ""} {
+		assert.Error(t, CheckContentEncoding(encoding), encoding)
+	}
+	_, err := NewCompressor(&bytes.Buffer{}, "zstd", flate.DefaultCompression)
+	assert.Error(t, err)
+	_, err = NewDecompressor(&bytes.Buffer{}, "zstd")
+	assert.Error(t, err)
+}
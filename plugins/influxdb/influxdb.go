@@ -2,13 +2,12 @@ package influxdb
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
-	"regexp"
-	"strings"
 	"time"
 
 	"github.com/DataDog/datadog-go/statsd"
@@ -25,31 +24,89 @@ type lengther interface {
 	Len() int
 }
 
+const defaultBatchSize = 5000
+
+// Config holds the settings for an InfluxDBPlugin. Setting Bucket selects
+// the InfluxDB 2.x write API (with Org and Token); otherwise the 1.x API is
+// used, with DB and RetentionPolicy and either Username and Password or a
+// Token for authentication.
+type Config struct {
+	Address   string
+	BatchSize int // lines per POST
+	// ContentEncoding is what the lines are compressed with, one of the
+	// plugins.Encoding* constants. Empty is plugins.EncodingNone.
+	ContentEncoding string
+
+	// InfluxDB 1.x
+	DB              string
+	RetentionPolicy string
+	Consistency     string
+	Username        string
+	Password        string
+
+	// InfluxDB 2.x
+	Org    string
+	Bucket string
+	Token  string
+}
+
 // InfluxDBPlugin is a plugin for emitting metrics to InfluxDB.
 type InfluxDBPlugin struct {
 	Logger     *logrus.Logger
 	InfluxURL  string
 	HTTPClient *http.Client
 	Statsd     *statsd.Client
+	// RetryBudget is the retry budget shared with veneur's other sinks, or
+	// nil if failed POSTs aren't retried.
+	RetryBudget *plugins.RetryBudget
+
+	batchSize int
+	username  string
+	password  string
+	token     string
+	encoding  string
 }
 
 // NewInfluxDBPlugin creates a new Influx Plugin.
-func NewInfluxDBPlugin(logger *logrus.Logger, addr string, consistency string, db string, client *http.Client, stats *statsd.Client) *InfluxDBPlugin {
+func NewInfluxDBPlugin(logger *logrus.Logger, conf Config, client *http.Client, stats *statsd.Client) *InfluxDBPlugin {
 	plugin := &InfluxDBPlugin{
 		Logger:     logger,
 		HTTPClient: client,
 		Statsd:     stats,
+		batchSize:  conf.BatchSize,
+		username:   conf.Username,
+		password:   conf.Password,
+		token:      conf.Token,
+		encoding:   conf.ContentEncoding,
+	}
+	if plugin.batchSize <= 0 {
+		plugin.batchSize = defaultBatchSize
+	}
+	if plugin.encoding == "" {
+		plugin.encoding = plugins.EncodingNone
 	}
 
-	inurl, err := url.Parse(addr)
+	inurl, err := url.Parse(conf.Address)
 	if err != nil {
 		logger.Fatalf("Error parsing URL for InfluxDB: %q", err)
 	}
 
 	// Construct a path we will be using later.
-	inurl.Path = "/write"
 	q := inurl.Query()
-	q.Set("db", db)
+	if conf.Bucket != "" {
+		inurl.Path = "/api/v2/write"
+		q.Set("org", conf.Org)
+		q.Set("bucket", conf.Bucket)
+	} else {
+		inurl.Path = "/write"
+		q.Set("db", conf.DB)
+		if conf.RetentionPolicy != "" {
+			q.Set("rp", conf.RetentionPolicy)
+		}
+		if conf.Consistency != "" {
+			q.Set("consistency", conf.Consistency)
+		}
+	}
 	q.Set("precision", "s")
 	inurl.RawQuery = q.Encode()
 	plugin.InfluxURL = inurl.String()
@@ -66,21 +123,42 @@ func (p *InfluxDBPlugin) Flush(metrics []samplers.DDMetric, hostname string) err
 		return nil
 	}
 
-	buff := bytes.Buffer{}
-	colons := regexp.MustCompile(":")
-	for _, metric := range metrics {
-		tags := strings.Join(metric.Tags, ",")
-		// This is messy and we shouldn't have to do it this way, but since Veneur treats tags as arbitrary strings
-		// rather than name value pairs, we have to do this ugly conversion
-		cleanTags := colons.ReplaceAllLiteralString(tags, "=")
-		buff.WriteString(
-			fmt.Sprintf("%s,%s value=%f %d\n", metric.Name, cleanTags, metric.Value[0][1], int64(metric.Value[0][0])),
-		)
+	metrics = plugins.SkipUnserializable(p.Statsd, p.Logger, p.Name(), metrics, checkValue)
+	lines := encodeLines(metrics)
+	var firstErr error
+	for start := 0; start < len(lines); start += p.batchSize {
+		end := start + p.batchSize
+		if end > len(lines) {
+			end = len(lines)
+		}
+		buff := bytes.Buffer{}
+		for _, line := range lines[start:end] {
+			buff.Write(line)
+		}
+		body, err := plugins.Compress(buff.Bytes(), p.encoding)
+		if err != nil {
+			p.Statsd.Count("influxdb_post.error_total", 1, []string{"cause:compress"}, 1.0)
+			p.Logger.WithError(err).Error("Could not compress body")
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if p.encoding != plugins.EncodingNone && len(body) > 0 {
+			p.Statsd.Histogram("influxdb_post.compression_ratio", float64(buff.Len())/float64(len(body)), []string{"encoding:" + p.encoding}, 1.0)
+		}
+		err = p.RetryBudget.Do(context.Background(), "influxdb_post", func() error {
+			return p.postHelper(p.InfluxURL, bytes.NewReader(body))
+		})
+		if retryable, ok := err.(plugins.RetryableError); ok {
+			err = retryable.Err
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
 	}
 
-	p.postHelper(p.InfluxURL, &buff)
-
-	return nil
+	return firstErr
 }
 
 // Name returns the name of the plugin.
@@ -98,7 +176,7 @@ func (p *InfluxDBPlugin) postHelper(endpoint string, bodyBuffer io.Reader) error
 	// http client consumes it
 	if lenReader, ok := bodyBuffer.(lengther); ok {
 		bodyLength := lenReader.Len()
-		p.Statsd.Histogram("influxdb_post.content_length_bytes", float64(bodyLength), nil, 1.0)
+		p.Statsd.Histogram("influxdb_post.content_length_bytes", float64(bodyLength), []string{"encoding:" + p.encoding}, 1.0)
 	}
 
 	req, err := http.NewRequest(http.MethodPost, endpoint, bodyBuffer)
@@ -108,8 +186,15 @@ func (p *InfluxDBPlugin) postHelper(endpoint string, bodyBuffer io.Reader) error
 		return err
 	}
 
-	// we only make http requests at flush time, so keepalive is not a big win
-	req.Close = true
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if header := plugins.ContentEncodingHeader(p.encoding); header != "" {
+		req.Header.Set("Content-Encoding", header)
+	}
+	if p.token != "" {
+		req.Header.Set("Authorization", "Token "+p.token)
+	} else if p.username != "" {
+		req.SetBasicAuth(p.username, p.password)
+	}
 
 	requestStart := time.Now()
 	resp, err := p.HTTPClient.Do(req)
@@ -121,7 +206,7 @@ func (p *InfluxDBPlugin) postHelper(endpoint string, bodyBuffer io.Reader) error
 		}
 		p.Statsd.Count("influxdb_post.error_total", 1, []string{"cause:io"}, 1.0)
 		innerLogger.WithError(err).Error("Could not execute request")
-		return err
+		return plugins.RetryableError{Err: err}
 	}
 	p.Statsd.TimeInMilliseconds("influxdb_post.duration_ns", float64(time.Now().Sub(requestStart).Nanoseconds()), []string{"part:post"}, 1.0)
 	defer resp.Body.Close()
@@ -134,15 +219,19 @@ func (p *InfluxDBPlugin) postHelper(endpoint string, bodyBuffer io.Reader) error
 		innerLogger.WithError(err).Error("Could not read response body")
 	}
 	resultLogger := innerLogger.WithFields(logrus.Fields{
-		"request_headers":  req.Header,
 		"status":           resp.Status,
 		"response_headers": resp.Header,
 		"response":         string(responseBody),
 	})
 
-	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+	// InfluxDB responds with 204 on success
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
 		p.Statsd.Count("influxdb_post.error_total", 1, []string{fmt.Sprintf("cause:%d", resp.StatusCode)}, 1.0)
 		resultLogger.Error("Could not POST")
+		err = fmt.Errorf("InfluxDB responded with %s", resp.Status)
+		if resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests {
+			return plugins.RetryableError{Err: err}
+		}
 		return err
 	}
 
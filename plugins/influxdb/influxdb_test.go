@@ -0,0 +1,150 @@
+package influxdb
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestEncodeLinesEscaping(t *testing.T) {
+	lines := encodeLines([]samplers.DDMetric{{
+		Name:       "a b,c=d",
+		Value:      [1][2]float64{{1476119058, 1.5}},
+		Tags:       []string{"x y:1,2", "k=v:a=b", "bare"},
+		MetricType: "gauge",
+		Hostname:   "host 1",
+	}})
+	assert.Equal(t, []string{
+		`a\ b\,c=d,bare=true,host=host\ 1,k\=v=a\=b,x\ y=1\,2 value=1.5 1476119058` + "\n",
+	}, stringLines(lines))
+}
+
+func TestEncodeLinesHistogram(t *testing.T) {
+	ts := float64(1476119058)
+	lines := encodeLines([]samplers.DDMetric{
+		{Name: "a.b.c.max", Value: [1][2]float64{{ts, 10}}, Tags: []string{"foo:bar"}, MetricType: "gauge"},
+		{Name: "a.b.c.min", Value: [1][2]float64{{ts, 1}}, Tags: []string{"foo:bar"}, MetricType: "gauge"},
+		{Name: "a.b.c.99percentile", Value: [1][2]float64{{ts, 9.9}}, Tags: []string{"foo:bar"}, MetricType: "gauge"},
+		{Name: "a.b.c.max", Value: [1][2]float64{{ts, 3}}, Tags: []string{"foo:baz"}, MetricType: "gauge"},
+		{Name: "d.e.f", Value: [1][2]float64{{ts, 2}}, MetricType: "rate"},
+		{Name: "d.e.f.median", Value: [1][2]float64{{ts, math.NaN()}}, MetricType: "gauge"},
+	})
+	assert.Equal(t, []string{
+		"a.b.c,foo=bar 99percentile=9.9,max=10,min=1 1476119058\n",
+		// a lone aggregate is written like any other metric
+		"a.b.c.max,foo=baz value=3 1476119058\n",
+		"d.e.f value=2 1476119058\n",
+	}, stringLines(lines))
+}
+
+func TestFlushBatchesAndAuth(t *testing.T) {
+	var bodies []string
+	var requests []*http.Request
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		requests = append(requests, r)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	metrics := []samplers.DDMetric{
+		{Name: "a", Value: [1][2]float64{{1, 1}}, MetricType: "gauge"},
+		{Name: "b", Value: [1][2]float64{{1, 2}}, MetricType: "gauge"},
+		{Name: "c", Value: [1][2]float64{{1, 3}}, MetricType: "gauge"},
+	}
+
+	v1 := NewInfluxDBPlugin(logrus.New(), Config{
+		Address:         server.URL,
+		BatchSize:       2,
+		DB:              "mydb",
+		RetentionPolicy: "short",
+		Username:        "user",
+		Password:        "pass",
+	}, &http.Client{}, nil)
+	assert.NoError(t, v1.Flush(metrics, "localhost"))
+	assert.Equal(t, []string{"a value=1 1\nb value=2 1\n", "c value=3 1\n"}, bodies)
+	assert.Equal(t, "/write", requests[0].URL.Path)
+	assert.Equal(t, "mydb", requests[0].URL.Query().Get("db"))
+	assert.Equal(t, "short", requests[0].URL.Query().Get("rp"))
+	user, pass, ok := requests[0].BasicAuth()
+	assert.True(t, ok)
+	assert.Equal(t, "user", user)
+	assert.Equal(t, "pass", pass)
+
+	bodies, requests = nil, nil
+	v2 := NewInfluxDBPlugin(logrus.New(), Config{
+		Address: server.URL,
+		Org:     "myorg",
+		Bucket:  "mybucket",
+		Token:   "secret",
+	}, &http.Client{}, nil)
+	assert.NoError(t, v2.Flush(metrics, "localhost"))
+	assert.Len(t, bodies, 1)
+	assert.Equal(t, "/api/v2/write", requests[0].URL.Path)
+	assert.Equal(t, "myorg", requests[0].URL.Query().Get("org"))
+	assert.Equal(t, "mybucket", requests[0].URL.Query().Get("bucket"))
+	assert.Equal(t, "Token secret", requests[0].Header.Get("Authorization"))
+}
+
+func TestFlushError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "database not found", http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	p := NewInfluxDBPlugin(logrus.New(), Config{Address: server.URL, DB: "mydb"}, &http.Client{}, nil)
+	err := p.Flush([]samplers.DDMetric{{Name: "a", Value: [1][2]float64{{1, 1}}}}, "localhost")
+	assert.Error(t, err)
+}
+
+func stringLines(lines [][]byte) []string {
+	var ret []string
+	for _, line := range lines {
+		ret = append(ret, string(line))
+	}
+	return ret
+}
+
+func TestFlushContentEncodings(t *testing.T) {
+	for _, encoding := range []string{"", plugins.EncodingNone, plugins.EncodingGzip, plugins.EncodingDeflate} {
+		t.Run(encoding, func(t *testing.T) {
+			var body string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var reader io.Reader = r.Body
+				switch r.Header.Get("Content-Encoding") {
+				case "gzip":
+					gz, err := gzip.NewReader(r.Body)
+					assert.NoError(t, err)
+					reader = gz
+				case "deflate":
+					zr, err := zlib.NewReader(r.Body)
+					assert.NoError(t, err)
+					reader = zr
+				case "":
+				default:
+					t.Errorf("unexpected Content-Encoding %q", r.Header.Get("Content-Encoding"))
+				}
+				decoded, err := ioutil.ReadAll(reader)
+				assert.NoError(t, err)
+				body = string(decoded)
+				w.WriteHeader(http.StatusNoContent)
+			}))
+			defer server.Close()
+
+			p := NewInfluxDBPlugin(logrus.New(), Config{Address: server.URL, DB: "mydb", ContentEncoding: encoding}, &http.Client{}, nil)
+			assert.NoError(t, p.Flush([]samplers.DDMetric{{Name: "a", Value: [1][2]float64{{1, 1}}, MetricType: "gauge"}}, "localhost"))
+			assert.Equal(t, "a value=1 1\n", body, "InfluxDB should get lines it can decode")
+		})
+	}
+}
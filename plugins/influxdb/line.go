@@ -0,0 +1,161 @@
+package influxdb
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// histogramSuffix matches the names of the aggregates that a histogram or
+// timer is flushed as (see samplers.Histo.Flush)
+var histogramSuffix = regexp.MustCompile(`\.(min|max|sum|avg|count|median|[0-9]+percentile)$`)
+
+var (
+	measurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "\n", `\ `)
+	keyEscaper         = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `, "\n", `\ `)
+)
+
+// point is a single line of InfluxDB line protocol
+type point struct {
+	measurement string
+	tags        []string // already escaped key=value pairs, sorted
+	fields      map[string]float64
+	timestamp   int64
+}
+
+// checkValue returns an error if the metric's value can't be represented in
+// line protocol, which has no way to write NaN or the infinities.
+func checkValue(metric samplers.DDMetric) error {
+	value := metric.Value[0][1]
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		return fmt.Errorf("line protocol can't represent the value %v", value)
+	}
+	return nil
+}
+
+// encodeLines converts metrics into InfluxDB line protocol, with one line per
+// point. The aggregates of a histogram that share the same tags and
+// timestamp are combined into one point, with a field for each aggregate (eg
+// "a.b.c.max" and "a.b.c.99percentile" become measurement "a.b.c" with
+// fields "max" and "99percentile"). Every other metric becomes a point with
+// a single "value" field.
+func encodeLines(metrics []samplers.DDMetric) [][]byte {
+	var points []*point
+	groups := map[string]*point{}
+
+	for _, metric := range metrics {
+		if checkValue(metric) != nil {
+			continue
+		}
+		value := metric.Value[0][1]
+
+		measurement, field := metric.Name, "value"
+		if loc := histogramSuffix.FindStringIndex(metric.Name); loc != nil {
+			measurement, field = metric.Name[:loc[0]], metric.Name[loc[0]+1:]
+		}
+		tags := encodeTags(metric)
+		timestamp := int64(metric.Value[0][0])
+
+		key := measurement + "\x00" + strings.Join(tags, ",") + "\x00" + strconv.FormatInt(timestamp, 10)
+		p, ok := groups[key]
+		if field == "value" || !ok {
+			p = &point{
+				measurement: measurement,
+				tags:        tags,
+				fields:      map[string]float64{},
+				timestamp:   timestamp,
+			}
+			points = append(points, p)
+			if field != "value" {
+				groups[key] = p
+			}
+		}
+		p.fields[field] = value
+	}
+
+	lines := make([][]byte, 0, len(points))
+	for _, p := range points {
+		if len(p.fields) == 1 {
+			// a lone aggregate is indistinguishable from any other metric
+			// that happens to have a name like that, so leave it alone
+			for field, value := range p.fields {
+				if field != "value" {
+					p.measurement += "." + field
+					delete(p.fields, field)
+					p.fields["value"] = value
+				}
+			}
+		}
+		lines = append(lines, p.encode())
+	}
+	return lines
+}
+
+// encodeTags converts a metric's tags (and hostname and device, if it has
+// them) into escaped key=value pairs, sorted as InfluxDB recommends. Veneur
+// tags are arbitrary strings rather than key:value pairs, so tags without a
+// value are given the value "true".
+func encodeTags(metric samplers.DDMetric) []string {
+	tags := make([]string, 0, len(metric.Tags)+2)
+	add := func(key, value string) {
+		if key == "" {
+			return
+		}
+		if value == "" {
+			value = "true"
+		}
+		tags = append(tags, keyEscaper.Replace(key)+"="+keyEscaper.Replace(value))
+	}
+	for _, tag := range metric.Tags {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) == 2 {
+			add(kv[0], kv[1])
+		} else {
+			add(kv[0], "")
+		}
+	}
+	if metric.Hostname != "" {
+		add("host", metric.Hostname)
+	}
+	if metric.DeviceName != "" {
+		add("device", metric.DeviceName)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+func (p *point) encode() []byte {
+	buf := bytes.Buffer{}
+	buf.WriteString(measurementEscaper.Replace(p.measurement))
+	for _, tag := range p.tags {
+		buf.WriteByte(',')
+		buf.WriteString(tag)
+	}
+
+	fields := make([]string, 0, len(p.fields))
+	for field := range p.fields {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for i, field := range fields {
+		if i == 0 {
+			buf.WriteByte(' ')
+		} else {
+			buf.WriteByte(',')
+		}
+		buf.WriteString(keyEscaper.Replace(field))
+		buf.WriteByte('=')
+		buf.WriteString(strconv.FormatFloat(p.fields[field], 'f', -1, 64))
+	}
+
+	buf.WriteByte(' ')
+	buf.WriteString(strconv.FormatInt(p.timestamp, 10))
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
@@ -0,0 +1,366 @@
+// Package parquet is a sink that writes flushed metrics to Parquet files,
+// for offline analytics, and optionally uploads each file to S3 once it is
+// complete. Linking it into veneur registers it as the "parquet" sink.
+package parquet
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+const (
+	// DefaultRowGroupRows is how many rows are buffered in memory before
+	// they are written as a row group, if row_group_rows isn't set.
+	DefaultRowGroupRows = 100000
+	// DefaultMaxFileBytes is about how big a file gets before it is
+	// completed and a new one started, if max_file_bytes isn't set.
+	DefaultMaxFileBytes = 128 << 20
+	// DefaultRotateInterval is the longest a file is written to before it
+	// is completed and a new one started, if rotate_interval isn't set.
+	DefaultRotateInterval = time.Hour
+)
+
+// incompleteSuffix is added to the name of a file while it is being
+// written. It is renamed without it once its footer has been written and it
+// is readable, so that anything picking up files from the directory only
+// sees complete ones.
+const incompleteSuffix = ".incomplete"
+
+func init() {
+	plugins.RegisterSink("parquet", NewSink)
+}
+
+var _ plugins.Sink = &Sink{}
+
+// Sink writes each flush's metrics as rows of a Parquet file (see
+// metricSchema), buffering them into row groups. A file is completed once it
+// reaches about max_file_bytes, or has been written to for rotate_interval,
+// or when veneur shuts down.
+type Sink struct {
+	name           string
+	directory      string
+	rowGroupRows   int
+	maxFileBytes   int64
+	rotateInterval time.Duration
+	codec          int32
+	hostname       string
+
+	// if svc is set, completed files are uploaded to bucket, under prefix,
+	// and removed once they have been
+	svc    s3iface.S3API
+	bucket string
+	prefix string
+
+	// the completed files waiting to be uploaded, including ones that
+	// failed to be, which are retried by the next flush. Uploads happen in
+	// the background, one file at a time, so that they don't hold up
+	// flushes
+	uploadMtx sync.Mutex
+	pending   []string
+	uploading bool
+	uploads   sync.WaitGroup
+
+	log *logrus.Logger
+	now func() time.Time
+
+	// flushes can overlap with Stop
+	mtx    sync.Mutex
+	file   *os.File
+	buf    *bufio.Writer
+	writer *fileWriter
+	opened time.Time
+}
+
+// NewSink creates a Sink from its configuration in veneur's sinks option:
+//
+//   - directory: where files are written. Required.
+//   - name: the sink's name, "parquet" by default.
+//   - row_group_rows: how many rows each row group holds, DefaultRowGroupRows
+//     by default.
+//   - max_file_bytes: about how big a file gets, DefaultMaxFileBytes by
+//     default.
+//   - rotate_interval: the longest a file is written to, as a duration,
+//     DefaultRotateInterval by default.
+//   - compression: "gzip", the default, or "none".
+//   - s3_bucket, s3_prefix and aws_region: if s3_bucket is set, completed
+//     files are uploaded there, with credentials from the environment, and
+//     removed.
+func NewSink(config map[string]string) (plugins.Sink, error) {
+	s := &Sink{
+		name:           "parquet",
+		directory:      config["directory"],
+		rowGroupRows:   DefaultRowGroupRows,
+		maxFileBytes:   DefaultMaxFileBytes,
+		rotateInterval: DefaultRotateInterval,
+		codec:          codecGzip,
+		bucket:         config["s3_bucket"],
+		prefix:         config["s3_prefix"],
+		log:            logrus.StandardLogger(),
+		now:            time.Now,
+	}
+	if name := config["name"]; name != "" {
+		s.name = name
+	}
+	if s.directory == "" {
+		return nil, fmt.Errorf("parquet: directory must be set")
+	}
+	if v := config["row_group_rows"]; v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("parquet: row_group_rows %q must be a positive number", v)
+		}
+		s.rowGroupRows = n
+	}
+	if v := config["max_file_bytes"]; v != "" {
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("parquet: max_file_bytes %q must be a positive number", v)
+		}
+		s.maxFileBytes = n
+	}
+	if v := config["rotate_interval"]; v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("parquet: rotate_interval %q must be a positive duration", v)
+		}
+		s.rotateInterval = d
+	}
+	switch config["compression"] {
+	case "", "gzip":
+	case "none":
+		s.codec = codecUncompressed
+	default:
+		return nil, fmt.Errorf("parquet: compression %q must be gzip or none", config["compression"])
+	}
+	var err error
+	if s.hostname, err = os.Hostname(); err != nil {
+		return nil, fmt.Errorf("parquet: %v", err)
+	}
+	if s.bucket != "" {
+		sess, err := session.NewSession(&aws.Config{Region: aws.String(config["aws_region"])})
+		if err != nil {
+			return nil, fmt.Errorf("parquet: %v", err)
+		}
+		s.svc = s3.New(sess)
+	}
+	return s, nil
+}
+
+func (s *Sink) Name() string {
+	return s.name
+}
+
+// Start makes sure the directory exists. Files left incomplete by a veneur
+// that didn't shut down cleanly have no footer, and can't be read, so they
+// are only logged. Completed files that a previous veneur couldn't upload
+// are uploaded by the first flush.
+func (s *Sink) Start() error {
+	if err := os.MkdirAll(s.directory, 0755); err != nil {
+		return err
+	}
+	incomplete, _ := filepath.Glob(filepath.Join(s.directory, "*"+incompleteSuffix))
+	for _, f := range incomplete {
+		s.log.WithField("file", f).Warn("Ignoring a Parquet file that was never completed")
+	}
+	if s.svc != nil {
+		s.pending, _ = filepath.Glob(filepath.Join(s.directory, "*.parquet"))
+	}
+	return nil
+}
+
+// Flush adds metrics to the file being written, starting one if need be,
+// and completes it if it is due. It also retries uploading any files that
+// failed to be.
+func (s *Sink) Flush(metrics []samplers.DDMetric) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.queueUploads()
+
+	if len(metrics) > 0 && s.writer == nil {
+		if err := s.open(); err != nil {
+			return err
+		}
+	}
+	if s.writer == nil {
+		return nil
+	}
+	for _, r := range rowsFor(metrics) {
+		s.writer.writeRow(r)
+		if s.writer.buffered >= s.rowGroupRows {
+			if err := s.writer.flushRowGroup(); err != nil {
+				return s.abandon(err)
+			}
+		}
+	}
+	if s.writer.size() >= s.maxFileBytes || s.now().Sub(s.opened) >= s.rotateInterval {
+		return s.complete()
+	}
+	return nil
+}
+
+// FlushSpans does nothing; only metrics are written.
+func (s *Sink) FlushSpans(spans []ssf.SSFSample) error {
+	return nil
+}
+
+// Stop completes the file being written, so that nothing buffered is lost
+// and the file is readable, and waits for it and any others to be uploaded,
+// retrying those that failed once more. Files that still can't be are left
+// in the directory.
+func (s *Sink) Stop() error {
+	s.mtx.Lock()
+	var err error
+	if s.writer != nil {
+		err = s.complete()
+	}
+	s.mtx.Unlock()
+	if s.svc == nil {
+		return err
+	}
+
+	s.uploads.Wait()
+	s.queueUploads()
+	s.uploads.Wait()
+	s.uploadMtx.Lock()
+	defer s.uploadMtx.Unlock()
+	if err == nil && len(s.pending) > 0 {
+		err = fmt.Errorf("parquet: %d files could not be uploaded, and are kept in %s", len(s.pending), s.directory)
+	}
+	return err
+}
+
+func (s *Sink) open() error {
+	s.opened = s.now()
+	name := fmt.Sprintf("%s-%d.parquet%s", s.hostname, s.opened.UnixNano(), incompleteSuffix)
+	f, err := os.Create(filepath.Join(s.directory, name))
+	if err != nil {
+		return err
+	}
+	s.file = f
+	s.buf = bufio.NewWriter(f)
+	s.writer, err = newFileWriter(s.buf, metricSchema, s.codec)
+	if err != nil {
+		return s.abandon(err)
+	}
+	return nil
+}
+
+// complete writes the footer of the file being written, and makes it
+// visible under its final name, then queues it to be uploaded if there's a
+// bucket to upload it to.
+func (s *Sink) complete() error {
+	err := s.writer.close()
+	if err == nil {
+		err = s.buf.Flush()
+	}
+	if err != nil {
+		return s.abandon(err)
+	}
+	incomplete := s.file.Name()
+	s.writer, s.buf = nil, nil
+	if err := s.file.Close(); err != nil {
+		return err
+	}
+	s.file = nil
+	completed := strings.TrimSuffix(incomplete, incompleteSuffix)
+	if err := os.Rename(incomplete, completed); err != nil {
+		return err
+	}
+	if s.svc == nil {
+		return nil
+	}
+	s.queueUploads(completed)
+	return nil
+}
+
+// abandon gives up on the file being written after an error writing it.
+// The rows buffered for it are lost, and the file is left incomplete.
+func (s *Sink) abandon(err error) error {
+	s.log.WithError(err).WithField("file", s.file.Name()).Error("Could not write Parquet file")
+	s.file.Close()
+	s.file, s.buf, s.writer = nil, nil, nil
+	return err
+}
+
+// queueUploads adds files to the ones waiting to be uploaded, and starts
+// uploading them all in the background, unless that's already happening.
+func (s *Sink) queueUploads(files ...string) {
+	s.uploadMtx.Lock()
+	defer s.uploadMtx.Unlock()
+	s.pending = append(s.pending, files...)
+	if s.uploading || len(s.pending) == 0 {
+		return
+	}
+	s.uploading = true
+	s.uploads.Add(1)
+	go s.uploadPending()
+}
+
+// uploadPending uploads files until none are waiting. The ones that fail are
+// kept on disk, and waiting for the next time uploads are queued.
+func (s *Sink) uploadPending() {
+	defer s.uploads.Done()
+	var failed []string
+	for {
+		s.uploadMtx.Lock()
+		if len(s.pending) == 0 {
+			s.pending = failed
+			s.uploading = false
+			s.uploadMtx.Unlock()
+			return
+		}
+		file := s.pending[0]
+		s.pending = s.pending[1:]
+		s.uploadMtx.Unlock()
+
+		if err := s.upload(file); err != nil {
+			failed = append(failed, file)
+		}
+	}
+}
+
+func (s *Sink) upload(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = s.svc.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(filepath.Base(file))),
+		Body:   f,
+	})
+	if err != nil {
+		s.log.WithError(err).WithField("file", file).Error("Could not upload Parquet file; it is kept locally")
+		return err
+	}
+	return os.Remove(file)
+}
+
+// key returns where a file is uploaded to, partitioned by the day it was
+// started, which is in its name (see open).
+func (s *Sink) key(name string) string {
+	started := s.now()
+	stem := strings.TrimSuffix(name, ".parquet")
+	if nanos, err := strconv.ParseInt(stem[strings.LastIndexByte(stem, '-')+1:], 10, 64); err == nil {
+		started = time.Unix(0, nanos)
+	}
+	return path.Join(s.prefix, started.UTC().Format("2006/01/02"), name)
+}
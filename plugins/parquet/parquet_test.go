@@ -0,0 +1,423 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/stripe/veneur/plugins"
+	s3Mock "github.com/stripe/veneur/plugins/s3/mock"
+	"github.com/stripe/veneur/samplers"
+)
+
+// thriftReader decodes the compact protocol generically, into maps of field
+// IDs to values, for checking what the writer wrote.
+type thriftReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *thriftReader) byte() byte {
+	b := r.b[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	n, size := binary.Uvarint(r.b[r.pos:])
+	r.pos += size
+	return n
+}
+
+func (r *thriftReader) zigzag() int64 {
+	n := r.uvarint()
+	return int64(n>>1) ^ -int64(n&1)
+}
+
+func (r *thriftReader) readStruct() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	var last int16
+	for {
+		h := r.byte()
+		if h == 0 {
+			return fields
+		}
+		id := last + int16(h>>4)
+		if h>>4 == 0 {
+			id = int16(r.zigzag())
+		}
+		last = id
+		fields[id] = r.value(h & 0x0f)
+	}
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case 1:
+		return true
+	case 2:
+		return false
+	case thriftI32, thriftI64:
+		return r.zigzag()
+	case thriftBinary:
+		n := int(r.uvarint())
+		s := string(r.b[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case thriftList:
+		h := r.byte()
+		size := int(h >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(h & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.readStruct()
+	}
+	panic("unexpected thrift type")
+}
+
+// cell is one entry of a column: its levels, and its value unless it is a
+// null.
+type cell struct {
+	rep, def int
+	value    interface{}
+}
+
+// readFile checks the structure of a Parquet file, and returns its footer
+// and the cells of each column.
+func readFile(t *testing.T, name string) (map[int16]interface{}, [][]cell) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) < 12 || string(b[:4]) != magic || string(b[len(b)-4:]) != magic {
+		t.Fatalf("%s isn't a complete Parquet file", name)
+	}
+	footerLen := int(binary.LittleEndian.Uint32(b[len(b)-8:]))
+	footer := (&thriftReader{b: b[len(b)-8-footerLen : len(b)-8]}).readStruct()
+
+	cols := columns(metricSchema)
+	cells := make([][]cell, len(cols))
+	for _, rg := range footer[4].([]interface{}) {
+		for i, cc := range rg.(map[int16]interface{})[1].([]interface{}) {
+			meta := cc.(map[int16]interface{})[3].(map[int16]interface{})
+			assert.Equal(t, cols[i].path, toStrings(meta[3]))
+			r := &thriftReader{b: b, pos: int(meta[9].(int64))}
+			header := r.readStruct()
+			page := b[r.pos : r.pos+int(header[3].(int64))]
+			if meta[4].(int64) == codecGzip {
+				gz, err := gzip.NewReader(bytes.NewReader(page))
+				if err != nil {
+					t.Fatal(err)
+				}
+				page, err = ioutil.ReadAll(gz)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			assert.Len(t, page, int(header[2].(int64)))
+			numValues := int(header[5].(map[int16]interface{})[1].(int64))
+			cells[i] = append(cells[i], readPage(t, page, cols[i], numValues)...)
+		}
+	}
+	return footer, cells
+}
+
+func toStrings(v interface{}) []string {
+	var ss []string
+	for _, s := range v.([]interface{}) {
+		ss = append(ss, s.(string))
+	}
+	return ss
+}
+
+func readLevels(t *testing.T, page []byte, n int) ([]int, []byte) {
+	length := binary.LittleEndian.Uint32(page)
+	runs := &thriftReader{b: page[4 : 4+length]}
+	var levels []int
+	for runs.pos < len(runs.b) {
+		h := runs.uvarint()
+		if h&1 != 0 {
+			t.Fatal("only RLE runs are written")
+		}
+		v := int(runs.byte())
+		for i := uint64(0); i < h>>1; i++ {
+			levels = append(levels, v)
+		}
+	}
+	assert.Len(t, levels, n)
+	return levels, page[4+length:]
+}
+
+func readPage(t *testing.T, page []byte, c *column, n int) []cell {
+	reps, defs := make([]int, n), make([]int, n)
+	if c.maxRep > 0 {
+		reps, page = readLevels(t, page, n)
+	}
+	if c.maxDef > 0 {
+		defs, page = readLevels(t, page, n)
+	}
+	cells := make([]cell, n)
+	for i := range cells {
+		cells[i] = cell{rep: reps[i], def: defs[i]}
+		if defs[i] < c.maxDef {
+			continue
+		}
+		switch c.typ {
+		case typeByteArray:
+			size := binary.LittleEndian.Uint32(page)
+			cells[i].value = string(page[4 : 4+size])
+			page = page[4+size:]
+		case typeInt32:
+			cells[i].value = int32(binary.LittleEndian.Uint32(page))
+			page = page[4:]
+		case typeInt64:
+			cells[i].value = int64(binary.LittleEndian.Uint64(page))
+			page = page[8:]
+		case typeDouble:
+			cells[i].value = math.Float64frombits(binary.LittleEndian.Uint64(page))
+			page = page[8:]
+		}
+	}
+	assert.Empty(t, page, "every value should be read")
+	return cells
+}
+
+func testMetrics() []samplers.DDMetric {
+	const ts = 1500000000
+	h := func(name string, v float64) samplers.DDMetric {
+		return samplers.DDMetric{Name: name, Value: [1][2]float64{{ts, v}}, Tags: []string{"a:b"}, MetricType: "gauge", Interval: 10}
+	}
+	return []samplers.DDMetric{
+		{Name: "a.b.c", Value: [1][2]float64{{ts, 1.5}}, Tags: []string{"foo:bar", "baz", "url:http://x"}, MetricType: "rate", Hostname: "host", Interval: 10},
+		h("a.b.h.min", 1),
+		h("a.b.h.max", 9),
+		h("a.b.h.50percentile", 5),
+		h("a.b.h.99percentile", 8),
+		{Name: "a.b.g", Value: [1][2]float64{{ts, 3}}, MetricType: "gauge", Interval: 10},
+		// alone, an aggregate is like any other metric
+		h("x.y.max", 2),
+	}
+}
+
+func newTestSink(t *testing.T, config map[string]string) *Sink {
+	dir, err := ioutil.TempDir("", "parquet")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config["directory"] = dir
+	sink, err := NewSink(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Start(); err != nil {
+		t.Fatal(err)
+	}
+	return sink.(*Sink)
+}
+
+func completedFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "*.parquet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestSinkWritesReadableFiles(t *testing.T) {
+	for _, compression := range []string{"gzip", "none"} {
+		sink := newTestSink(t, map[string]string{"compression": compression, "row_group_rows": "3"})
+		defer os.RemoveAll(sink.directory)
+
+		// two flushes, and a row group boundary in the middle of each
+		assert.NoError(t, sink.Flush(testMetrics()))
+		assert.NoError(t, sink.Flush(testMetrics()[:1]))
+		assert.Empty(t, completedFiles(t, sink.directory), "the file is only visible once it's complete")
+		assert.NoError(t, sink.Stop())
+
+		files := completedFiles(t, sink.directory)
+		if !assert.Len(t, files, 1, compression) {
+			continue
+		}
+		footer, cells := readFile(t, files[0])
+		assert.Equal(t, int64(5), footer[3], "num_rows")
+		assert.Len(t, footer[4], 2, "row groups")
+		schema := footer[2].([]interface{})
+		assert.Len(t, schema, 1+len(metricSchema.children)+2*3, "the root, and the elements under it")
+
+		values := func(col int) []interface{} {
+			var vs []interface{}
+			for _, c := range cells[col] {
+				vs = append(vs, c.value)
+			}
+			return vs
+		}
+		assert.Equal(t, []interface{}{"a.b.c", "a.b.h", "a.b.g", "x.y.max", "a.b.c"}, values(0), compression)
+		assert.Equal(t, []interface{}{"rate", "histogram", "gauge", "gauge", "rate"}, values(1))
+		assert.Equal(t, []cell{
+			{0, 1, "foo"}, {1, 1, "baz"}, {1, 1, "url"},
+			{0, 1, "a"},
+			{0, 0, nil},
+			{0, 1, "a"},
+			{0, 1, "foo"}, {1, 1, "baz"}, {1, 1, "url"},
+		}, cells[2], "tag keys")
+		assert.Equal(t, []cell{
+			{0, 2, "bar"}, {1, 1, nil}, {1, 2, "http://x"},
+			{0, 2, "b"},
+			{0, 0, nil},
+			{0, 2, "b"},
+			{0, 2, "bar"}, {1, 1, nil}, {1, 2, "http://x"},
+		}, cells[3], "tag values, with a null for a tag without one")
+		assert.Equal(t, []interface{}{"host", nil, nil, nil, "host"}, values(4))
+		assert.Equal(t, int64(1500000000000), cells[5][0].value, "timestamps are in milliseconds")
+		assert.Equal(t, int32(10), cells[6][0].value)
+		assert.Equal(t, []interface{}{1.5, nil, float64(3), float64(2), 1.5}, values(7))
+		assert.Equal(t, []interface{}{nil, float64(1), nil, nil, nil}, values(8), "min")
+		assert.Equal(t, []interface{}{nil, float64(9), nil, nil, nil}, values(9), "max")
+		assert.Equal(t, []cell{
+			{0, 0, nil}, {0, 1, "50percentile"}, {1, 1, "99percentile"}, {0, 0, nil}, {0, 0, nil}, {0, 0, nil},
+		}, cells[14], "percentile keys")
+		assert.Equal(t, []interface{}{nil, float64(5), float64(8), nil, nil, nil}, values(15))
+	}
+}
+
+func TestSinkRotates(t *testing.T) {
+	sink := newTestSink(t, map[string]string{"rotate_interval": "1m"})
+	defer os.RemoveAll(sink.directory)
+	now := time.Unix(1500000000, 0)
+	sink.now = func() time.Time { return now }
+
+	assert.NoError(t, sink.Flush(testMetrics()))
+	assert.NoError(t, sink.Flush(nil))
+	assert.Empty(t, completedFiles(t, sink.directory))
+	now = now.Add(time.Minute)
+	assert.NoError(t, sink.Flush(nil), "a file is completed once it's due, even if there's nothing new")
+	assert.Len(t, completedFiles(t, sink.directory), 1)
+	assert.NoError(t, sink.Flush(nil))
+	assert.NoError(t, sink.Stop())
+	assert.Len(t, completedFiles(t, sink.directory), 1, "no file is started until there's something to write")
+
+	sink.maxFileBytes = 1
+	assert.NoError(t, sink.Flush(testMetrics()))
+	now = now.Add(time.Second)
+	assert.NoError(t, sink.Flush(testMetrics()))
+	assert.Len(t, completedFiles(t, sink.directory), 3, "files are completed once they're big enough")
+}
+
+func TestSinkUploads(t *testing.T) {
+	sink := newTestSink(t, map[string]string{})
+	defer os.RemoveAll(sink.directory)
+	sink.bucket, sink.prefix = "metrics", "veneur"
+	var uploaded []string
+	svc := &s3Mock.MockS3Client{}
+	svc.SetPutObject(func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		assert.Equal(t, "metrics", *input.Bucket)
+		b, err := ioutil.ReadAll(input.Body)
+		assert.NoError(t, err)
+		assert.Equal(t, magic, string(b[len(b)-4:]), "only complete files are uploaded")
+		uploaded = append(uploaded, *input.Key)
+		return &s3.PutObjectOutput{}, nil
+	})
+	sink.svc = svc
+	sink.now = func() time.Time { return time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC) }
+
+	assert.NoError(t, sink.Flush(testMetrics()))
+	assert.NoError(t, sink.Stop())
+	if assert.Len(t, uploaded, 1) {
+		assert.Regexp(t, `^veneur/2017/07/14/.+-1500000000000000000\.parquet$`, uploaded[0])
+	}
+	assert.Empty(t, completedFiles(t, sink.directory), "uploaded files are removed")
+}
+
+func TestNewSinkConfig(t *testing.T) {
+	for _, config := range []map[string]string{
+		{},
+		{"directory": "x", "row_group_rows": "0"},
+		{"directory": "x", "max_file_bytes": "big"},
+		{"directory": "x", "rotate_interval": "hourly"},
+		{"directory": "x", "compression": "snappy"},
+	} {
+		_, err := NewSink(config)
+		assert.Error(t, err, "%v", config)
+	}
+
+	sink, err := plugins.NewSink("parquet", map[string]string{"directory": "x", "name": "archive"})
+	assert.NoError(t, err, "the sink is registered")
+	assert.Equal(t, "archive", sink.Name())
+}
+
+func TestSinkUploadsInBackground(t *testing.T) {
+	sink := newTestSink(t, map[string]string{"max_file_bytes": "1"})
+	defer os.RemoveAll(sink.directory)
+	release := make(chan struct{})
+	uploaded := 0
+	svc := &s3Mock.MockS3Client{}
+	svc.SetPutObject(func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		<-release
+		uploaded++
+		return &s3.PutObjectOutput{}, nil
+	})
+	sink.svc = svc
+
+	assert.NoError(t, sink.Flush(testMetrics()), "the flush shouldn't wait for the upload")
+	assert.NoError(t, sink.Flush(testMetrics()))
+	close(release)
+	assert.NoError(t, sink.Stop(), "stopping should wait for the uploads")
+	assert.Equal(t, 2, uploaded)
+	assert.Empty(t, completedFiles(t, sink.directory))
+}
+
+func TestSinkRetriesUploads(t *testing.T) {
+	sink := newTestSink(t, map[string]string{"max_file_bytes": "1"})
+	defer os.RemoveAll(sink.directory)
+	failing := true
+	var uploaded []string
+	svc := &s3Mock.MockS3Client{}
+	svc.SetPutObject(func(input *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+		if failing {
+			return nil, errors.New("S3 is down")
+		}
+		uploaded = append(uploaded, *input.Key)
+		return &s3.PutObjectOutput{}, nil
+	})
+	sink.svc = svc
+
+	assert.NoError(t, sink.Flush(testMetrics()), "a failed upload doesn't fail the flush")
+	sink.uploads.Wait()
+	assert.Len(t, completedFiles(t, sink.directory), 1, "a file that failed to upload is kept")
+
+	failing = false
+	assert.NoError(t, sink.Flush(nil))
+	sink.uploads.Wait()
+	assert.Len(t, uploaded, 1, "the next flush should retry it")
+	assert.Empty(t, completedFiles(t, sink.directory))
+
+	failing = true
+	assert.NoError(t, sink.Flush(testMetrics()))
+	assert.Error(t, sink.Stop(), "files that can't be uploaded by the time veneur stops are reported")
+	assert.Len(t, completedFiles(t, sink.directory), 1)
+
+	// and uploaded by the next veneur to use the directory
+	failing = false
+	restarted := &Sink{directory: sink.directory, svc: svc, log: sink.log, now: time.Now}
+	assert.NoError(t, restarted.Start())
+	assert.NoError(t, restarted.Flush(nil))
+	assert.NoError(t, restarted.Stop())
+	assert.Len(t, uploaded, 2)
+	assert.Empty(t, completedFiles(t, sink.directory))
+}
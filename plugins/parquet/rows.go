@@ -0,0 +1,210 @@
+package parquet
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// metricSchema is the schema of the files the sink writes, one row per
+// metric:
+//
+//	message veneur {
+//	  required binary name (UTF8);
+//	  required binary type (UTF8);
+//	  required group tags (MAP) {
+//	    repeated group key_value {
+//	      required binary key (UTF8);
+//	      optional binary value (UTF8);
+//	    }
+//	  }
+//	  optional binary hostname (UTF8);
+//	  required int64 timestamp (TIMESTAMP_MILLIS);
+//	  required int32 interval;
+//	  optional double value;
+//	  optional double min;
+//	  optional double max;
+//	  optional double sum;
+//	  optional double avg;
+//	  optional double count;
+//	  optional double median;
+//	  required group percentiles (MAP) {
+//	    repeated group key_value {
+//	      required binary key (UTF8);
+//	      required double value;
+//	    }
+//	  }
+//	}
+//
+// Tags are a map, since every metric has different ones. A tag without a
+// colon is a key with a null value. The aggregates of a histogram or timer
+// are one row, whose value is null, with a column for each aggregate that
+// every histogram has, and its percentiles, which depend on veneur's
+// configuration, in a map keyed like their names, eg "99percentile".
+var metricSchema = &schemaNode{
+	name:      "veneur",
+	converted: -1,
+	children: []*schemaNode{
+		leaf("name", repetitionRequired, typeByteArray, convertedUTF8),
+		leaf("type", repetitionRequired, typeByteArray, convertedUTF8),
+		mapNode("tags", repetitionOptional, typeByteArray, convertedUTF8),
+		leaf("hostname", repetitionOptional, typeByteArray, convertedUTF8),
+		leaf("timestamp", repetitionRequired, typeInt64, convertedTimestampMillis),
+		leaf("interval", repetitionRequired, typeInt32, -1),
+		leaf("value", repetitionOptional, typeDouble, -1),
+		leaf("min", repetitionOptional, typeDouble, -1),
+		leaf("max", repetitionOptional, typeDouble, -1),
+		leaf("sum", repetitionOptional, typeDouble, -1),
+		leaf("avg", repetitionOptional, typeDouble, -1),
+		leaf("count", repetitionOptional, typeDouble, -1),
+		leaf("median", repetitionOptional, typeDouble, -1),
+		mapNode("percentiles", repetitionRequired, typeDouble, -1),
+	},
+}
+
+// the aggregates that have columns of their own, in the order of the
+// schema
+var aggregates = []string{"min", "max", "sum", "avg", "count", "median"}
+
+// histogramSuffix matches the names of the aggregates that a histogram or
+// timer is flushed as (see samplers.Histo.Flush)
+var histogramSuffix = regexp.MustCompile(`\.(min|max|sum|avg|count|median|([0-9]+percentile))$`)
+
+// row is one row of metricSchema.
+type row struct {
+	name, typ   string
+	tags        []string
+	hostname    string
+	timestamp   int64
+	interval    int32
+	value       float64
+	aggregates  map[string]float64
+	percentiles []percentile
+}
+
+type percentile struct {
+	key   string
+	value float64
+}
+
+// rowsFor converts metrics into rows. The aggregates of a histogram that
+// share the same tags, host and timestamp are combined into one row; an
+// aggregate on its own is indistinguishable from any other metric that
+// happens to have a name like that, so it is left alone.
+func rowsFor(metrics []samplers.DDMetric) []*row {
+	var rows []*row
+	groups := map[string]*row{}
+	// how many aggregates each grouped row has, and the row its first
+	// aggregate would have been on its own
+	grouped := map[*row]int{}
+	lone := map[*row]*row{}
+	for _, m := range metrics {
+		r := &row{
+			name:      m.Name,
+			typ:       m.MetricType,
+			tags:      m.Tags,
+			hostname:  m.Hostname,
+			timestamp: int64(m.Value[0][0] * 1000),
+			interval:  m.Interval,
+			value:     m.Value[0][1],
+		}
+		loc := histogramSuffix.FindStringSubmatchIndex(m.Name)
+		if loc == nil {
+			rows = append(rows, r)
+			continue
+		}
+		base, aggregate := m.Name[:loc[0]], m.Name[loc[0]+1:]
+		key := base + "\x00" + strings.Join(m.Tags, ",") + "\x00" + m.Hostname + "\x00" + strconv.FormatFloat(m.Value[0][0], 'f', -1, 64)
+		group, ok := groups[key]
+		if !ok {
+			group = &row{
+				name:       base,
+				typ:        "histogram",
+				tags:       m.Tags,
+				hostname:   m.Hostname,
+				timestamp:  r.timestamp,
+				interval:   m.Interval,
+				aggregates: map[string]float64{},
+			}
+			groups[key] = group
+			lone[group] = r
+			rows = append(rows, group)
+		}
+		grouped[group]++
+		if loc[4] >= 0 {
+			group.percentiles = append(group.percentiles, percentile{aggregate, m.Value[0][1]})
+		} else {
+			group.aggregates[aggregate] = m.Value[0][1]
+		}
+	}
+	for i, r := range rows {
+		if grouped[r] == 1 {
+			rows[i] = lone[r]
+		}
+	}
+	return rows
+}
+
+// writeRow adds a row to the row group being buffered.
+func (fw *fileWriter) writeRow(r *row) {
+	cols := fw.cols
+	cols[0].byteArray(0, 0, r.name)
+	cols[1].byteArray(0, 0, r.typ)
+
+	keys, values := cols[2], cols[3]
+	if len(r.tags) == 0 {
+		keys.level(0, 0)
+		values.level(0, 0)
+	}
+	for i, tag := range r.tags {
+		rep := 0
+		if i > 0 {
+			rep = 1
+		}
+		kv := strings.SplitN(tag, ":", 2)
+		keys.byteArray(rep, 1, kv[0])
+		if len(kv) == 2 {
+			values.byteArray(rep, 2, kv[1])
+		} else {
+			values.level(rep, 1)
+		}
+	}
+
+	if r.hostname != "" {
+		cols[4].byteArray(0, 1, r.hostname)
+	} else {
+		cols[4].level(0, 0)
+	}
+	cols[5].int64(0, 0, r.timestamp)
+	cols[6].int32(0, 0, r.interval)
+
+	if r.aggregates == nil {
+		cols[7].double(0, 1, r.value)
+	} else {
+		cols[7].level(0, 0)
+	}
+	for i, aggregate := range aggregates {
+		if v, ok := r.aggregates[aggregate]; ok {
+			cols[8+i].double(0, 1, v)
+		} else {
+			cols[8+i].level(0, 0)
+		}
+	}
+
+	keys, values = cols[8+len(aggregates)], cols[9+len(aggregates)]
+	if len(r.percentiles) == 0 {
+		keys.level(0, 0)
+		values.level(0, 0)
+	}
+	for i, p := range r.percentiles {
+		rep := 0
+		if i > 0 {
+			rep = 1
+		}
+		keys.byteArray(rep, 1, p.key)
+		values.double(rep, 1, p.value)
+	}
+	fw.buffered++
+}
@@ -0,0 +1,126 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// Parquet's page headers and footer are Thrift structs, in Thrift's compact
+// protocol. Only what writing them needs is implemented here: structs whose
+// fields are integers, strings, structs and lists.
+
+// the compact protocol's type codes
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter writes a Thrift struct in the compact protocol. Fields must
+// be written in increasing order of their IDs, and each struct, including
+// the outermost one, ended with end.
+type thriftWriter struct {
+	buf bytes.Buffer
+	// the ID of the last field written in each struct being written, the
+	// innermost last
+	lastIDs []int16
+}
+
+func newThriftWriter() *thriftWriter {
+	return &thriftWriter{lastIDs: []int16{0}}
+}
+
+func (w *thriftWriter) fieldHeader(id int16, typ byte) {
+	last := &w.lastIDs[len(w.lastIDs)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		w.buf.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.buf.WriteByte(typ)
+		w.varint(int64(id))
+	}
+	*last = id
+}
+
+// varint writes n zigzag-encoded, as the compact protocol encodes all of
+// its signed integers.
+func (w *thriftWriter) varint(n int64) {
+	w.uvarint(uint64(n<<1) ^ uint64(n>>63))
+}
+
+func (w *thriftWriter) uvarint(n uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.buf.Write(b[:binary.PutUvarint(b[:], n)])
+}
+
+func (w *thriftWriter) i32(id int16, n int32) {
+	w.fieldHeader(id, thriftI32)
+	w.varint(int64(n))
+}
+
+func (w *thriftWriter) i64(id int16, n int64) {
+	w.fieldHeader(id, thriftI64)
+	w.varint(n)
+}
+
+func (w *thriftWriter) string(id int16, s string) {
+	w.fieldHeader(id, thriftBinary)
+	w.uvarint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+// beginStruct starts a field that is a struct, whose fields are written
+// next.
+func (w *thriftWriter) beginStruct(id int16) {
+	w.fieldHeader(id, thriftStruct)
+	w.lastIDs = append(w.lastIDs, 0)
+}
+
+// end ends the struct being written.
+func (w *thriftWriter) end() {
+	w.buf.WriteByte(0)
+	w.lastIDs = w.lastIDs[:len(w.lastIDs)-1]
+}
+
+func (w *thriftWriter) listHeader(id int16, elemType byte, size int) {
+	w.fieldHeader(id, thriftList)
+	if size < 15 {
+		w.buf.WriteByte(byte(size)<<4 | elemType)
+		return
+	}
+	w.buf.WriteByte(0xf0 | elemType)
+	w.uvarint(uint64(size))
+}
+
+func (w *thriftWriter) i32List(id int16, ns []int32) {
+	w.listHeader(id, thriftI32, len(ns))
+	for _, n := range ns {
+		w.varint(int64(n))
+	}
+}
+
+func (w *thriftWriter) stringList(id int16, ss []string) {
+	w.listHeader(id, thriftBinary, len(ss))
+	for _, s := range ss {
+		w.uvarint(uint64(len(s)))
+		w.buf.WriteString(s)
+	}
+}
+
+// structList writes a list of size structs, calling each to write the
+// fields of the i'th. The structs are ended for it.
+func (w *thriftWriter) structList(id int16, size int, each func(i int)) {
+	w.listHeader(id, thriftStruct, size)
+	for i := 0; i < size; i++ {
+		w.lastIDs = append(w.lastIDs, 0)
+		each(i)
+		w.end()
+	}
+}
+
+// bytes ends the outermost struct and returns its encoding.
+func (w *thriftWriter) bytes() []byte {
+	w.end()
+	return w.buf.Bytes()
+}
@@ -0,0 +1,353 @@
+package parquet
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"math"
+	"math/bits"
+)
+
+// magic starts and ends every Parquet file.
+const magic = "PAR1"
+
+// the enums of parquet.thrift that the writer uses
+const (
+	typeInt32     = 1
+	typeInt64     = 2
+	typeDouble    = 5
+	typeByteArray = 6
+
+	repetitionRequired = 0
+	repetitionOptional = 1
+	repetitionRepeated = 2
+
+	convertedUTF8            = 0
+	convertedMap             = 1
+	convertedTimestampMillis = 9
+
+	encodingPlain = 0
+	encodingRLE   = 3
+
+	codecUncompressed = 0
+	codecGzip         = 2
+
+	pageData = 0
+)
+
+// schemaNode is an element of a Parquet schema: a leaf column if typ is set,
+// and otherwise a group of children.
+type schemaNode struct {
+	name       string
+	repetition int32
+	typ        int32 // 0 for a group
+	converted  int32 // -1 for none
+	children   []*schemaNode
+}
+
+func leaf(name string, repetition, typ, converted int32) *schemaNode {
+	return &schemaNode{name: name, repetition: repetition, typ: typ, converted: converted}
+}
+
+// mapNode is a map from UTF8 keys to values of the given type, in the
+// standard three-level representation. An empty map has no entries.
+func mapNode(name string, valueRepetition, valueType, valueConverted int32) *schemaNode {
+	return &schemaNode{
+		name:       name,
+		repetition: repetitionRequired,
+		converted:  convertedMap,
+		children: []*schemaNode{{
+			name:       "key_value",
+			repetition: repetitionRepeated,
+			converted:  -1,
+			children: []*schemaNode{
+				leaf("key", repetitionRequired, typeByteArray, convertedUTF8),
+				leaf("value", valueRepetition, valueType, valueConverted),
+			},
+		}},
+	}
+}
+
+// column buffers the values of one leaf of the schema for the row group
+// being written, encoded as a single data page: its repetition and
+// definition levels, and its values, PLAIN-encoded.
+type column struct {
+	path           []string
+	typ            int32
+	maxRep, maxDef int
+
+	reps, defs []int
+	values     bytes.Buffer
+}
+
+// columns returns a column for each leaf of the schema under root, in
+// order.
+func columns(root *schemaNode) []*column {
+	var cols []*column
+	var walk func(n *schemaNode, path []string, rep, def int)
+	walk = func(n *schemaNode, path []string, rep, def int) {
+		path = append(path[:len(path):len(path)], n.name)
+		switch n.repetition {
+		case repetitionOptional:
+			def++
+		case repetitionRepeated:
+			rep++
+			def++
+		}
+		if n.typ != 0 {
+			cols = append(cols, &column{path: path, typ: n.typ, maxRep: rep, maxDef: def})
+			return
+		}
+		for _, child := range n.children {
+			walk(child, path, rep, def)
+		}
+	}
+	for _, child := range root.children {
+		walk(child, nil, 0, 0)
+	}
+	return cols
+}
+
+// level records a level without a value, ie a null or an empty map.
+func (c *column) level(rep, def int) {
+	c.reps = append(c.reps, rep)
+	c.defs = append(c.defs, def)
+}
+
+func (c *column) byteArray(rep, def int, s string) {
+	c.level(rep, def)
+	binary.Write(&c.values, binary.LittleEndian, uint32(len(s)))
+	c.values.WriteString(s)
+}
+
+func (c *column) int32(rep, def int, n int32) {
+	c.level(rep, def)
+	binary.Write(&c.values, binary.LittleEndian, n)
+}
+
+func (c *column) int64(rep, def int, n int64) {
+	c.level(rep, def)
+	binary.Write(&c.values, binary.LittleEndian, n)
+}
+
+func (c *column) double(rep, def int, f float64) {
+	c.level(rep, def)
+	binary.Write(&c.values, binary.LittleEndian, math.Float64bits(f))
+}
+
+// page returns the column's data page, uncompressed, and resets it.
+func (c *column) page() (page []byte, numValues int) {
+	var buf bytes.Buffer
+	if c.maxRep > 0 {
+		writeLevels(&buf, c.reps, c.maxRep)
+	}
+	if c.maxDef > 0 {
+		writeLevels(&buf, c.defs, c.maxDef)
+	}
+	buf.Write(c.values.Bytes())
+	numValues = len(c.defs)
+	c.reps, c.defs = c.reps[:0], c.defs[:0]
+	c.values.Reset()
+	return buf.Bytes(), numValues
+}
+
+// writeLevels writes levels with the RLE/bit-packed hybrid encoding, as
+// runs of repeated values only, prefixed by their length as data pages
+// require.
+func writeLevels(buf *bytes.Buffer, levels []int, max int) {
+	width := (bits.Len(uint(max)) + 7) / 8
+	var runs bytes.Buffer
+	var varint [binary.MaxVarintLen64]byte
+	for i := 0; i < len(levels); {
+		j := i + 1
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		runs.Write(varint[:binary.PutUvarint(varint[:], uint64(j-i)<<1)])
+		for b := 0; b < width; b++ {
+			runs.WriteByte(byte(levels[i] >> (8 * uint(b))))
+		}
+		i = j
+	}
+	binary.Write(buf, binary.LittleEndian, uint32(runs.Len()))
+	buf.Write(runs.Bytes())
+}
+
+// chunkMeta is where a column chunk was written, and how big it is.
+type chunkMeta struct {
+	offset                   int64
+	numValues                int64
+	uncompressed, compressed int64
+}
+
+type rowGroupMeta struct {
+	chunks  []chunkMeta
+	numRows int64
+}
+
+// fileWriter writes a Parquet file with the given schema, a row group at a
+// time. The file is only readable once it is closed, which writes the footer
+// describing its row groups.
+type fileWriter struct {
+	w      io.Writer
+	offset int64
+	codec  int32
+	schema *schemaNode
+	cols   []*column
+
+	// how many rows are buffered in cols, for the next row group
+	buffered  int
+	rowGroups []rowGroupMeta
+}
+
+func newFileWriter(w io.Writer, schema *schemaNode, codec int32) (*fileWriter, error) {
+	fw := &fileWriter{w: w, codec: codec, schema: schema, cols: columns(schema)}
+	return fw, fw.write([]byte(magic))
+}
+
+func (fw *fileWriter) write(b []byte) error {
+	n, err := fw.w.Write(b)
+	fw.offset += int64(n)
+	return err
+}
+
+// size returns about how big the file would be if it were closed now.
+func (fw *fileWriter) size() int64 {
+	size := fw.offset
+	for _, c := range fw.cols {
+		size += int64(c.values.Len() + len(c.defs)/4)
+	}
+	return size
+}
+
+// flushRowGroup writes the buffered rows as a row group, with a page for
+// each column.
+func (fw *fileWriter) flushRowGroup() error {
+	if fw.buffered == 0 {
+		return nil
+	}
+	rg := rowGroupMeta{numRows: int64(fw.buffered)}
+	for _, c := range fw.cols {
+		page, numValues := c.page()
+		compressed := page
+		if fw.codec == codecGzip {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(page)
+			if err := gz.Close(); err != nil {
+				return err
+			}
+			compressed = buf.Bytes()
+		}
+
+		header := newThriftWriter()
+		header.i32(1, pageData)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(len(compressed)))
+		header.beginStruct(5)
+		header.i32(1, int32(numValues))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+		header.end()
+		headerBytes := header.bytes()
+
+		chunk := chunkMeta{
+			offset:       fw.offset,
+			numValues:    int64(numValues),
+			uncompressed: int64(len(headerBytes) + len(page)),
+			compressed:   int64(len(headerBytes) + len(compressed)),
+		}
+		if err := fw.write(headerBytes); err != nil {
+			return err
+		}
+		if err := fw.write(compressed); err != nil {
+			return err
+		}
+		rg.chunks = append(rg.chunks, chunk)
+	}
+	fw.rowGroups = append(fw.rowGroups, rg)
+	fw.buffered = 0
+	return nil
+}
+
+// close writes any buffered rows and the footer. The underlying writer is
+// left for the caller to close.
+func (fw *fileWriter) close() error {
+	if err := fw.flushRowGroup(); err != nil {
+		return err
+	}
+	footer := fw.footer()
+	if err := fw.write(footer); err != nil {
+		return err
+	}
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(footer)))
+	if err := fw.write(length[:]); err != nil {
+		return err
+	}
+	return fw.write([]byte(magic))
+}
+
+// footer returns the file's FileMetaData.
+func (fw *fileWriter) footer() []byte {
+	var elements []*schemaNode
+	var flatten func(n *schemaNode)
+	flatten = func(n *schemaNode) {
+		elements = append(elements, n)
+		for _, child := range n.children {
+			flatten(child)
+		}
+	}
+	flatten(fw.schema)
+
+	var numRows int64
+	for _, rg := range fw.rowGroups {
+		numRows += rg.numRows
+	}
+
+	t := newThriftWriter()
+	t.i32(1, 1)
+	t.structList(2, len(elements), func(i int) {
+		n := elements[i]
+		if n.typ != 0 {
+			t.i32(1, n.typ)
+		}
+		if i > 0 {
+			// the root has no repetition
+			t.i32(3, n.repetition)
+		}
+		t.string(4, n.name)
+		if n.typ == 0 {
+			t.i32(5, int32(len(n.children)))
+		}
+		if n.converted >= 0 {
+			t.i32(6, n.converted)
+		}
+	})
+	t.i64(3, numRows)
+	t.structList(4, len(fw.rowGroups), func(i int) {
+		rg := fw.rowGroups[i]
+		var totalBytes int64
+		t.structList(1, len(rg.chunks), func(j int) {
+			chunk, c := rg.chunks[j], fw.cols[j]
+			totalBytes += chunk.uncompressed
+			t.i64(2, chunk.offset)
+			t.beginStruct(3)
+			t.i32(1, c.typ)
+			t.i32List(2, []int32{encodingPlain, encodingRLE})
+			t.stringList(3, c.path)
+			t.i32(4, fw.codec)
+			t.i64(5, chunk.numValues)
+			t.i64(6, chunk.uncompressed)
+			t.i64(7, chunk.compressed)
+			t.i64(9, chunk.offset)
+			t.end()
+		})
+		t.i64(2, totalBytes)
+		t.i64(3, rg.numRows)
+	})
+	t.string(6, "veneur")
+	return t.bytes()
+}
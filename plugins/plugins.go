@@ -13,3 +13,11 @@ type Plugin interface {
 	Flush(metrics []samplers.DDMetric, hostname string) error
 	Name() string
 }
+
+// DistributionSink is implemented by plugins that can take histograms and
+// timers as a single metric with the MetricType "distribution", whose
+// Distribution holds their sketch, if TakesDistributions returns true.
+// Unless histogram_distributions is set, they still only get percentiles.
+type DistributionSink interface {
+	TakesDistributions() bool
+}
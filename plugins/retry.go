@@ -0,0 +1,135 @@
+package plugins
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+)
+
+// RetryableError marks an error from a sink as worth retrying, eg a network
+// error or a 5xx response, as opposed to a request the sink rejected.
+type RetryableError struct {
+	Err error
+}
+
+func (e RetryableError) Error() string {
+	return e.Err.Error()
+}
+
+// retryBackoff is how long the first retry waits. Each one after it waits
+// twice as long as the one before.
+const retryBackoff = 100 * time.Millisecond
+
+// RetryBudget is a token bucket of retries shared by every sink, so that
+// however many sinks are failing at once, and however often, the process as
+// a whole retries at no more than a bounded rate, rather than piling onto a
+// struggling downstream. Each retry takes a token; tokens are refilled at
+// Rate per second, up to Capacity.
+//
+// A nil *RetryBudget never retries.
+type RetryBudget struct {
+	// Rate is how many tokens are refilled per second.
+	Rate float64
+	// Capacity is the most tokens the bucket holds, and so the most
+	// retries that can be made in a burst.
+	Capacity float64
+	// MaxRetries is the most times one request is retried, however many
+	// tokens there are.
+	MaxRetries int
+	Statsd     *statsd.Client
+
+	mtx    sync.Mutex
+	tokens float64
+	last   time.Time
+	// swapped out by tests
+	now   func() time.Time
+	sleep func(context.Context, time.Duration) error
+}
+
+// NewRetryBudget creates a RetryBudget that starts out full.
+func NewRetryBudget(rate float64, capacity float64, maxRetries int, stats *statsd.Client) *RetryBudget {
+	return &RetryBudget{
+		Rate:       rate,
+		Capacity:   capacity,
+		MaxRetries: maxRetries,
+		Statsd:     stats,
+		tokens:     capacity,
+		last:       time.Now(),
+		now:        time.Now,
+		sleep:      sleepContext,
+	}
+}
+
+// Do calls f, and calls it again while it returns a RetryableError, up to
+// MaxRetries times and as long as there are tokens in the budget, backing
+// off between attempts. It returns the error from the last attempt. action
+// names what f does in the retry metrics, like the action of the sink's
+// other metrics.
+func (b *RetryBudget) Do(ctx context.Context, action string, f func() error) error {
+	err := f()
+	if b == nil {
+		return err
+	}
+	for attempt := 0; attempt < b.MaxRetries; attempt++ {
+		if _, ok := err.(RetryableError); !ok {
+			return err
+		}
+		if !b.take() {
+			b.Statsd.Count("retry.budget_exhausted_total", 1, []string{"action:" + action}, 1.0)
+			return err
+		}
+		b.Statsd.Count("retry.attempts_total", 1, []string{"action:" + action}, 1.0)
+		if sleepErr := b.sleep(ctx, retryBackoff<<uint(attempt)); sleepErr != nil {
+			// the flush ran out of time
+			return err
+		}
+		err = f()
+	}
+	return err
+}
+
+// take takes a token, if there is one.
+func (b *RetryBudget) take() bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Tokens returns how many retries are left in the budget. It is 0 for a nil
+// budget.
+func (b *RetryBudget) Tokens() float64 {
+	if b == nil {
+		return 0
+	}
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.refill()
+	return b.tokens
+}
+
+func (b *RetryBudget) refill() {
+	now := b.now()
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(b.Capacity, b.tokens+elapsed*b.Rate)
+	}
+	b.last = now
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,80 @@
+package plugins
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Now()
+	b := NewRetryBudget(1, 2, 3, nil)
+	b.now = func() time.Time { return now }
+	b.last = now
+	var slept []time.Duration
+	b.sleep = func(ctx context.Context, d time.Duration) error {
+		slept = append(slept, d)
+		return nil
+	}
+
+	calls := 0
+	failing := func() error {
+		calls++
+		return RetryableError{errors.New("503")}
+	}
+	err := b.Do(context.Background(), "a", failing)
+	assert.Equal(t, RetryableError{errors.New("503")}, err)
+	assert.Equal(t, 3, calls, "the two tokens should be spent on two retries")
+	assert.Equal(t, []time.Duration{retryBackoff, 2 * retryBackoff}, slept)
+
+	// the budget is shared, so another sink can't retry either
+	calls = 0
+	b.Do(context.Background(), "b", failing)
+	assert.Equal(t, 1, calls, "an empty budget should mean no retries")
+
+	now = now.Add(10 * time.Second)
+	assert.Equal(t, float64(2), b.Tokens(), "the budget should refill, up to its capacity")
+	calls = 0
+	b.Do(context.Background(), "b", func() error {
+		calls++
+		return errors.New("400")
+	})
+	assert.Equal(t, 1, calls, "errors that aren't retryable shouldn't be retried")
+	calls = 0
+	b.Do(context.Background(), "b", func() error {
+		calls++
+		if calls == 1 {
+			return RetryableError{errors.New("503")}
+		}
+		return nil
+	})
+	assert.Equal(t, 2, calls)
+	assert.Equal(t, float64(1), b.Tokens())
+
+	now = now.Add(time.Minute)
+	b.MaxRetries = 1
+	calls = 0
+	b.Do(context.Background(), "b", failing)
+	assert.Equal(t, 2, calls, "retries should stop at MaxRetries")
+
+	var nilBudget *RetryBudget
+	calls = 0
+	nilBudget.Do(context.Background(), "a", failing)
+	assert.Equal(t, 1, calls)
+}
+
+func TestRetryBudgetContext(t *testing.T) {
+	b := NewRetryBudget(1, 10, 10, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := b.Do(ctx, "a", func() error {
+		calls++
+		cancel()
+		return RetryableError{errors.New("503")}
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls, "retries shouldn't outlast the flush")
+}
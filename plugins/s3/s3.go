@@ -5,6 +5,7 @@ import (
 	"compress/gzip"
 	"encoding/csv"
 	"errors"
+	"fmt"
 	"io"
 	"path"
 	"strconv"
@@ -125,7 +126,11 @@ func EncodeDDMetricsCSV(metrics []samplers.DDMetric, delimiter rune, includeHead
 	// TODO avoid edge case at midnight
 	partitionDate := time.Now()
 	for _, metric := range metrics {
-		EncodeDDMetricCSV(metric, w, &partitionDate, hostname)
+		// CSV can't be written a row at a time, so the first metric that
+		// fails fails the lot, but at least say which it was
+		if err := EncodeDDMetricCSV(metric, w, &partitionDate, hostname); err != nil {
+			return nil, fmt.Errorf("could not encode %s: %v", metric.Name, err)
+		}
 	}
 
 	w.Flush()
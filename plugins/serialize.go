@@ -0,0 +1,50 @@
+package plugins
+
+import (
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+)
+
+// SkipUnserializable returns the metrics that encode accepts, so that a sink
+// can skip the odd metric it can't represent (like a NaN, for a JSON API)
+// rather than fail its whole flush over it. Each one skipped is counted in
+// veneur.flush.serialization_errors_total, tagged with the sink and the
+// metric's type, and logged by name, so that whatever emits it can be found
+// and fixed.
+//
+// The metrics are never modified; if any are skipped, the rest are copied
+// into a new slice.
+func SkipUnserializable(stats *statsd.Client, logger *logrus.Logger, sink string, metrics []samplers.DDMetric, encode func(samplers.DDMetric) error) []samplers.DDMetric {
+	var kept []samplers.DDMetric
+	for i, m := range metrics {
+		err := encode(m)
+		if err == nil {
+			if kept != nil {
+				kept = append(kept, m)
+			}
+			continue
+		}
+		if kept == nil {
+			kept = make([]samplers.DDMetric, i, len(metrics)-1)
+			copy(kept, metrics[:i])
+		}
+		ReportUnserializable(stats, logger, sink, m, err)
+	}
+	if kept == nil {
+		return metrics
+	}
+	return kept
+}
+
+// ReportUnserializable counts and logs a metric that the sink skipped because
+// it couldn't be serialized, like SkipUnserializable does, for sinks that
+// serialize metrics one at a time themselves.
+func ReportUnserializable(stats *statsd.Client, logger *logrus.Logger, sink string, m samplers.DDMetric, err error) {
+	stats.Count("flush.serialization_errors_total", 1, []string{"sink:" + sink, "metric_type:" + m.MetricType}, 1.0)
+	logger.WithError(err).WithFields(logrus.Fields{
+		"sink":   sink,
+		"metric": m.Name,
+		"type":   m.MetricType,
+	}).Warn("Could not serialize metric, skipping it")
+}
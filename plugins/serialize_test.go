@@ -0,0 +1,31 @@
+package plugins
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestSkipUnserializable(t *testing.T) {
+	metrics := []samplers.DDMetric{
+		{Name: "a", MetricType: "gauge"},
+		{Name: "bad", MetricType: "rate"},
+		{Name: "b", MetricType: "gauge"},
+	}
+	encode := func(m samplers.DDMetric) error {
+		if m.Name == "bad" {
+			return errors.New("can't")
+		}
+		return nil
+	}
+
+	kept := SkipUnserializable(nil, logrus.New(), "test", metrics, encode)
+	assert.Equal(t, []samplers.DDMetric{metrics[0], metrics[2]}, kept)
+	assert.Equal(t, "bad", metrics[1].Name, "the metrics shouldn't be modified")
+
+	all := metrics[:1]
+	assert.Equal(t, all, SkipUnserializable(nil, logrus.New(), "test", all, encode))
+}
@@ -0,0 +1,96 @@
+// Package shadow duplicates flushed metrics to a secondary plugin, for
+// validating a new backend with production traffic without putting the
+// primary flush at risk.
+package shadow
+
+import (
+	"sync/atomic"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+var _ plugins.Plugin = &ShadowPlugin{}
+
+// Sender flushes copies of metrics to a shadow plugin in the background.
+// Failures of the shadow are only logged and counted, as
+// flush.shadow.error_total tagged with the shadow's name. If the previous
+// copy is still being flushed when the next one arrives, the new one is
+// dropped (and counted with cause:busy) rather than letting a slow shadow
+// pile up goroutines.
+//
+// A nil Sender sends nothing.
+type Sender struct {
+	Logger *logrus.Logger
+	Statsd *statsd.Client
+
+	shadow plugins.Plugin
+	busy   int32
+}
+
+// NewSender creates a Sender that flushes to shadow.
+func NewSender(shadow plugins.Plugin, logger *logrus.Logger, stats *statsd.Client) *Sender {
+	return &Sender{
+		Logger: logger,
+		Statsd: stats,
+		shadow: shadow,
+	}
+}
+
+// Send starts flushing the metrics to the shadow and returns immediately.
+// The metrics must not be modified afterwards.
+func (s *Sender) Send(metrics []samplers.DDMetric, hostname string) {
+	if s == nil {
+		return
+	}
+	tags := []string{"sink:" + s.shadow.Name()}
+	if !atomic.CompareAndSwapInt32(&s.busy, 0, 1) {
+		s.Statsd.Count("flush.shadow.error_total", 1, append(tags, "cause:busy"), 1.0)
+		return
+	}
+	go func() {
+		defer atomic.StoreInt32(&s.busy, 0)
+		if err := s.shadow.Flush(metrics, hostname); err != nil {
+			s.Statsd.Count("flush.shadow.error_total", 1, append(tags, "cause:flush"), 1.0)
+			s.Logger.WithFields(logrus.Fields{
+				logrus.ErrorKey: err,
+				"sink":          s.shadow.Name(),
+				"metrics":       len(metrics),
+			}).Warn("Could not flush to shadow")
+			return
+		}
+		s.Statsd.Count("flush.shadow.post_metrics_total", int64(len(metrics)), tags, 1.0)
+	}()
+}
+
+// ShadowPlugin wraps a plugin, flushing a copy of everything it flushes to
+// a shadow too. It takes the name of the primary, and only the primary's
+// errors are returned, so veneur reports it (and routes metrics to it)
+// exactly as if it were not wrapped.
+type ShadowPlugin struct {
+	primary plugins.Plugin
+	shadow  *Sender
+}
+
+// NewShadowPlugin creates a ShadowPlugin that flushes to primary, and in
+// the background to shadow.
+func NewShadowPlugin(primary, shadow plugins.Plugin, logger *logrus.Logger, stats *statsd.Client) *ShadowPlugin {
+	return &ShadowPlugin{
+		primary: primary,
+		shadow:  NewSender(shadow, logger, stats),
+	}
+}
+
+// Flush flushes the metrics to the primary, having started flushing them to
+// the shadow concurrently.
+func (p *ShadowPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	p.shadow.Send(metrics, hostname)
+	return p.primary.Flush(metrics, hostname)
+}
+
+// Name returns the primary's name.
+func (p *ShadowPlugin) Name() string {
+	return p.primary.Name()
+}
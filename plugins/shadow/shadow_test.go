@@ -0,0 +1,67 @@
+package shadow
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+type funcPlugin struct {
+	name  string
+	flush func(metrics []samplers.DDMetric, hostname string) error
+}
+
+func (p funcPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	return p.flush(metrics, hostname)
+}
+
+func (p funcPlugin) Name() string {
+	return p.name
+}
+
+func TestShadowPlugin(t *testing.T) {
+	metrics := []samplers.DDMetric{{Name: "a.b.c", MetricType: "gauge"}}
+	primaryErr := errors.New("primary is down")
+	primary := funcPlugin{name: "primary", flush: func([]samplers.DDMetric, string) error {
+		return primaryErr
+	}}
+
+	release := make(chan struct{})
+	shadowed := make(chan []samplers.DDMetric, 2)
+	shadow := funcPlugin{name: "staging", flush: func(metrics []samplers.DDMetric, hostname string) error {
+		<-release
+		shadowed <- metrics
+		return errors.New("shadow is down")
+	}}
+
+	p := NewShadowPlugin(primary, shadow, logrus.New(), nil)
+	assert.Equal(t, "primary", p.Name())
+
+	// the shadow is stuck, but that doesn't hold up the primary, and only
+	// the primary's error is returned
+	done := make(chan error)
+	go func() { done <- p.Flush(metrics, "localhost") }()
+	select {
+	case err := <-done:
+		assert.Equal(t, primaryErr, err)
+	case <-time.After(time.Second):
+		assert.FailNow(t, "flush waited for the shadow")
+	}
+
+	// while the shadow is still busy, the next copy is dropped
+	assert.Equal(t, primaryErr, p.Flush(metrics, "localhost"))
+	close(release)
+	assert.Equal(t, metrics, <-shadowed)
+	select {
+	case <-shadowed:
+		assert.Fail(t, "the second copy should have been dropped")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	var disabled *Sender
+	disabled.Send(metrics, "localhost")
+}
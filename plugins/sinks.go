@@ -0,0 +1,94 @@
+package plugins
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+// A Sink is a destination for flushed metrics and spans that is written
+// outside of veneur, and wired in by registering it with RegisterSink rather
+// than by changing veneur itself. Veneur creates the sinks named in its
+// `sinks` option at startup, calls Start before the first flush and Stop
+// when it shuts down, and in between calls Flush with the metrics of every
+// flush and FlushSpans with the spans it received since the last one.
+//
+// Like a Plugin, a Sink must not modify the metrics or spans it is given,
+// which may be shared with other sinks. Flush and FlushSpans are never
+// called concurrently with themselves, but may be called concurrently with
+// each other.
+type Sink interface {
+	// Name identifies the sink in veneur's own metrics, and in options
+	// like metric_routes. It should be a short, lowercase, snake-cased
+	// identifier, and is usually the name it was registered under.
+	Name() string
+	// Start prepares the sink to be flushed to, eg by connecting to its
+	// backend. If it returns an error, veneur exits.
+	Start() error
+	Flush(metrics []samplers.DDMetric) error
+	FlushSpans(spans []ssf.SSFSample) error
+	// Stop releases whatever the sink holds. Nothing is flushed to it
+	// afterwards.
+	Stop() error
+}
+
+// A SinkFactory creates a Sink from its configuration in veneur's `sinks`
+// option.
+type SinkFactory func(config map[string]string) (Sink, error)
+
+var sinkFactories = struct {
+	sync.Mutex
+	byName map[string]SinkFactory
+}{byName: map[string]SinkFactory{}}
+
+// RegisterSink makes a Sink available to veneur's `sinks` option under
+// name. It is meant to be called from the init function of the package that
+// implements the sink, and panics if name is empty, factory is nil, or a
+// sink is already registered under name.
+func RegisterSink(name string, factory SinkFactory) {
+	sinkFactories.Lock()
+	defer sinkFactories.Unlock()
+	if name == "" {
+		panic("plugins: RegisterSink with an empty name")
+	}
+	if factory == nil {
+		panic("plugins: RegisterSink factory for " + name + " is nil")
+	}
+	if _, ok := sinkFactories.byName[name]; ok {
+		panic("plugins: RegisterSink called twice for " + name)
+	}
+	sinkFactories.byName[name] = factory
+}
+
+// RegisteredSinks returns the names that sinks are registered under, sorted.
+func RegisteredSinks() []string {
+	sinkFactories.Lock()
+	defer sinkFactories.Unlock()
+	names := make([]string, 0, len(sinkFactories.byName))
+	for name := range sinkFactories.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// NewSink creates the sink registered under name with the given
+// configuration. It returns an error if no sink is registered under name,
+// usually because the package implementing it isn't linked into the binary.
+func NewSink(name string, config map[string]string) (Sink, error) {
+	sinkFactories.Lock()
+	factory, ok := sinkFactories.byName[name]
+	sinkFactories.Unlock()
+	if !ok {
+		registered := "none are"
+		if names := RegisteredSinks(); len(names) > 0 {
+			registered = "the registered sinks are " + strings.Join(names, ", ")
+		}
+		return nil, fmt.Errorf("no sink is registered as %q (%s)", name, registered)
+	}
+	return factory(config)
+}
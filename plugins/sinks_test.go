@@ -0,0 +1,49 @@
+package plugins
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+type testSink struct {
+	name string
+}
+
+func (s testSink) Name() string                            { return s.name }
+func (s testSink) Start() error                            { return nil }
+func (s testSink) Flush(metrics []samplers.DDMetric) error { return nil }
+func (s testSink) FlushSpans(spans []ssf.SSFSample) error  { return nil }
+func (s testSink) Stop() error                             { return nil }
+
+func TestRegisterSink(t *testing.T) {
+	RegisterSink("plugins_test", func(config map[string]string) (Sink, error) {
+		if config["fail"] != "" {
+			return nil, errors.New(config["fail"])
+		}
+		return testSink{name: "plugins_test:" + config["suffix"]}, nil
+	})
+	assert.Contains(t, RegisteredSinks(), "plugins_test")
+
+	sink, err := NewSink("plugins_test", map[string]string{"suffix": "a"})
+	assert.NoError(t, err)
+	assert.Equal(t, "plugins_test:a", sink.Name(), "the factory should be given the config")
+
+	_, err = NewSink("plugins_test", map[string]string{"fail": "bad config"})
+	assert.EqualError(t, err, "bad config")
+
+	_, err = NewSink("plugins_tset", nil)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), `"plugins_tset"`)
+		assert.Contains(t, err.Error(), "plugins_test", "the error should list the sinks that are registered")
+	}
+
+	assert.Panics(t, func() {
+		RegisterSink("plugins_test", func(map[string]string) (Sink, error) { return nil, nil })
+	}, "a name can't be registered twice")
+	assert.Panics(t, func() { RegisterSink("", func(map[string]string) (Sink, error) { return nil, nil }) })
+	assert.Panics(t, func() { RegisterSink("plugins_nil", nil) })
+}
@@ -0,0 +1,181 @@
+// Package ssfagent flushes metrics to a local agent over a Unix socket, as
+// SSF samples, for hosts whose metrics pipeline already speaks SSF.
+package ssfagent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+var _ plugins.Plugin = &SSFAgentPlugin{}
+
+// DefaultBatchSize is how many samples are written in each frame if
+// BatchSize is not set.
+const DefaultBatchSize = 100
+
+// DefaultWriteTimeout is how long writing a frame may block, waiting for the
+// agent to read from the socket, if WriteTimeout is not set.
+const DefaultWriteTimeout = 100 * time.Millisecond
+
+// SSFAgentPlugin writes each flush to a Unix stream socket as a series of
+// frames. Each frame is a big-endian uint32 byte length, followed by that
+// many bytes of samples, each of which is an ssf.SSFSample preceded by its
+// length as a protobuf varint (the same encoding as
+// proto.Buffer.EncodeMessage).
+//
+// If the agent doesn't keep up, and a frame can't be written within
+// WriteTimeout, the rest of the flush is dropped and counted in
+// veneur.ssf_agent.samples_dropped_total, rather than holding up the flush
+// loop. Since a frame may have been partially written, the connection is
+// closed, and the next flush reconnects.
+type SSFAgentPlugin struct {
+	Logger       *logrus.Logger
+	Statsd       *statsd.Client
+	Address      string
+	BatchSize    int
+	WriteTimeout time.Duration
+
+	// flushes can overlap, and their frames mustn't interleave
+	mtx  sync.Mutex
+	conn net.Conn
+}
+
+// NewSSFAgentPlugin creates an SSFAgentPlugin that writes to the Unix socket
+// at address. It doesn't connect until the first flush, so that veneur can
+// start before the agent.
+func NewSSFAgentPlugin(logger *logrus.Logger, stats *statsd.Client, address string, batchSize int) *SSFAgentPlugin {
+	if batchSize <= 0 {
+		batchSize = DefaultBatchSize
+	}
+	return &SSFAgentPlugin{
+		Logger:       logger,
+		Statsd:       stats,
+		Address:      address,
+		BatchSize:    batchSize,
+		WriteTimeout: DefaultWriteTimeout,
+	}
+}
+
+// Name returns "ssf_agent".
+func (p *SSFAgentPlugin) Name() string {
+	return "ssf_agent"
+}
+
+// Flush writes the metrics to the agent.
+func (p *SSFAgentPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	if len(metrics) == 0 {
+		return nil
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.conn == nil {
+		conn, err := net.Dial("unix", p.Address)
+		if err != nil {
+			return err
+		}
+		p.conn = conn
+	}
+
+	var frame bytes.Buffer
+	skipped := 0
+	buf := proto.NewBuffer(nil)
+	for start := 0; start < len(metrics); start += p.BatchSize {
+		end := start + p.BatchSize
+		if end > len(metrics) {
+			end = len(metrics)
+		}
+
+		buf.Reset()
+		for _, m := range metrics[start:end] {
+			encoded, err := proto.Marshal(sampleFromMetric(m, hostname))
+			if err != nil {
+				// skip just this one, rather than the whole flush
+				plugins.ReportUnserializable(p.Statsd, p.Logger, p.Name(), m, err)
+				skipped++
+				continue
+			}
+			buf.EncodeRawBytes(encoded)
+		}
+		if len(buf.Bytes()) == 0 {
+			continue
+		}
+		frame.Reset()
+		binary.Write(&frame, binary.BigEndian, uint32(len(buf.Bytes())))
+		frame.Write(buf.Bytes())
+
+		p.conn.SetWriteDeadline(time.Now().Add(p.WriteTimeout))
+		if _, err := p.conn.Write(frame.Bytes()); err != nil {
+			p.conn.Close()
+			p.conn = nil
+			dropped := len(metrics) - start
+			cause := "error"
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				cause = "backpressure"
+			}
+			p.Statsd.Count("ssf_agent.samples_dropped_total", int64(dropped), []string{"cause:" + cause}, 1.0)
+			p.Logger.WithError(err).WithField("dropped", dropped).Warn("Could not write to the SSF agent, dropping the rest of the flush")
+			if cause == "backpressure" {
+				// the agent is up, just slow, so this isn't a failure
+				// worth tripping its circuit over
+				return nil
+			}
+			return err
+		}
+	}
+	p.Statsd.Count("ssf_agent.samples_written_total", int64(len(metrics)-skipped), nil, 1.0)
+	return nil
+}
+
+// sampleFromMetric converts a flushed metric into an SSF sample. SSF has no
+// notion of an interval, so rates are converted back into counts over their
+// interval, and the host and device become tags.
+func sampleFromMetric(m samplers.DDMetric, hostname string) *ssf.SSFSample {
+	sample := &ssf.SSFSample{
+		Name:       m.Name,
+		Timestamp:  int64(m.Value[0][0]) * int64(time.Second),
+		Value:      float32(m.Value[0][1]),
+		SampleRate: 1.0,
+	}
+	switch m.MetricType {
+	case "rate":
+		sample.Metric = ssf.SSFSample_COUNTER
+		if m.Interval > 0 {
+			sample.Value = float32(m.Value[0][1] * float64(m.Interval))
+		}
+	case "count":
+		sample.Metric = ssf.SSFSample_COUNTER
+	default:
+		sample.Metric = ssf.SSFSample_GAUGE
+	}
+
+	for _, tag := range m.Tags {
+		t := &ssf.SSFTag{Name: tag}
+		if colon := strings.IndexByte(tag, ':'); colon != -1 {
+			t.Name, t.Value = tag[:colon], tag[colon+1:]
+		}
+		sample.Tags = append(sample.Tags, t)
+	}
+	host := m.Hostname
+	if host == "" {
+		host = hostname
+	}
+	if host != "" {
+		sample.Tags = append(sample.Tags, &ssf.SSFTag{Name: "host", Value: host})
+	}
+	if m.DeviceName != "" {
+		sample.Tags = append(sample.Tags, &ssf.SSFTag{Name: "device", Value: m.DeviceName})
+	}
+	return sample
+}
@@ -0,0 +1,140 @@
+package ssfagent
+
+import (
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+func listen(t *testing.T) (net.Listener, string, func()) {
+	dir, err := ioutil.TempDir("", "ssfagent")
+	assert.NoError(t, err)
+	path := filepath.Join(dir, "agent.sock")
+	l, err := net.Listen("unix", path)
+	assert.NoError(t, err)
+	return l, path, func() {
+		l.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// readFrame reads one frame, and decodes the samples in it.
+func readFrame(t *testing.T, r io.Reader) []*ssf.SSFSample {
+	var length uint32
+	if !assert.NoError(t, binary.Read(r, binary.BigEndian, &length)) {
+		return nil
+	}
+	body := make([]byte, length)
+	_, err := io.ReadFull(r, body)
+	assert.NoError(t, err)
+
+	var samples []*ssf.SSFSample
+	for len(body) > 0 {
+		n, size := proto.DecodeVarint(body)
+		sample := &ssf.SSFSample{}
+		assert.NoError(t, proto.Unmarshal(body[size:size+int(n)], sample))
+		samples = append(samples, sample)
+		body = body[size+int(n):]
+	}
+	return samples
+}
+
+func TestFlush(t *testing.T) {
+	l, path, cleanup := listen(t)
+	defer cleanup()
+
+	p := NewSSFAgentPlugin(logrus.New(), nil, path, 2)
+	metrics := []samplers.DDMetric{
+		{Name: "a.b.c", Value: [1][2]float64{{1500000000, 0.5}}, MetricType: "rate", Interval: 10, Tags: []string{"foo:bar", "baz"}},
+		{Name: "d.e.f", Value: [1][2]float64{{1500000000, 7}}, MetricType: "gauge", Hostname: "other"},
+		{Name: "g.h.i", Value: [1][2]float64{{1500000000, 3}}, MetricType: "count", DeviceName: "sda"},
+	}
+	go func() {
+		assert.NoError(t, p.Flush(metrics, "localhost"))
+	}()
+
+	conn, err := l.Accept()
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	first := readFrame(t, conn)
+	if assert.Len(t, first, 2, "frames should hold BatchSize samples") {
+		assert.Equal(t, &ssf.SSFSample{
+			Metric:     ssf.SSFSample_COUNTER,
+			Name:       "a.b.c",
+			Timestamp:  1500000000 * int64(time.Second),
+			Value:      5,
+			SampleRate: 1,
+			Tags: []*ssf.SSFTag{
+				{Name: "foo", Value: "bar"},
+				{Name: "baz"},
+				{Name: "host", Value: "localhost"},
+			},
+		}, first[0], "rates should be converted back into counts")
+		assert.Equal(t, ssf.SSFSample_GAUGE, first[1].Metric)
+		assert.Equal(t, float32(7), first[1].Value)
+		assert.Equal(t, []*ssf.SSFTag{{Name: "host", Value: "other"}}, first[1].Tags, "a metric's own host wins")
+	}
+	second := readFrame(t, conn)
+	if assert.Len(t, second, 1) {
+		assert.Equal(t, ssf.SSFSample_COUNTER, second[0].Metric)
+		assert.Equal(t, float32(3), second[0].Value)
+		assert.Contains(t, second[0].Tags, &ssf.SSFTag{Name: "device", Value: "sda"})
+	}
+}
+
+func TestFlushBackpressure(t *testing.T) {
+	l, path, cleanup := listen(t)
+	defer cleanup()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			// never read from it
+			accepted <- conn
+		}
+	}()
+
+	p := NewSSFAgentPlugin(logrus.New(), nil, path, 1000)
+	p.WriteTimeout = 10 * time.Millisecond
+	metrics := make([]samplers.DDMetric, 100000)
+	for i := range metrics {
+		metrics[i] = samplers.DDMetric{Name: "a.b.c", Value: [1][2]float64{{1500000000, 1}}, MetricType: "gauge", Tags: []string{"foo:bar"}}
+	}
+
+	start := time.Now()
+	assert.NoError(t, p.Flush(metrics, "localhost"), "a slow agent shouldn't fail the flush")
+	assert.True(t, time.Since(start) < 5*time.Second, "the flush should give up rather than block")
+	assert.Nil(t, p.conn, "the connection should be closed, since a frame may have been cut off")
+	(<-accepted).Close()
+
+	// the next flush reconnects
+	assert.NoError(t, p.Flush(metrics[:1], "localhost"))
+	conn := <-accepted
+	defer conn.Close()
+	assert.Len(t, readFrame(t, conn), 1)
+}
+
+func TestSampleFromCount(t *testing.T) {
+	counter := samplers.NewCounter("a.b.c", []string{"foo:bar"})
+	counter.Sample(3, 1.0)
+	counter.Sample(4, 0.5)
+	metrics := counter.FlushCount(10 * time.Second)
+	sample := sampleFromMetric(metrics[0], "localhost")
+	assert.Equal(t, ssf.SSFSample_COUNTER, sample.Metric, "counts should be sent as counters")
+	assert.Equal(t, float32(11), sample.Value, "counts shouldn't be scaled by their interval")
+}
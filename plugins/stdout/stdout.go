@@ -0,0 +1,193 @@
+// Package stdout prints flushed metrics in a human-readable table, for
+// running veneur locally during development without a real backend. It is
+// not meant for production.
+package stdout
+
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+var _ plugins.Plugin = &StdoutPlugin{}
+
+// DefaultMaxLines is how many lines a flush prints if MaxLines is not set.
+const DefaultMaxLines = 100
+
+const (
+	colorBold  = "\x1b[1m"
+	colorCyan  = "\x1b[36m"
+	colorFaint = "\x1b[2m"
+	colorReset = "\x1b[0m"
+)
+
+// percentileSuffix matches the last component of a histogram percentile's
+// name, eg the "99percentile" of "a.b.c.99percentile"
+var percentileSuffix = regexp.MustCompile(`^(\d+)percentile$`)
+
+// StdoutPlugin prints each flush as a table of metrics, one per line, with
+// their type, value and tags. The aggregates and percentiles of each
+// histogram or timer are collapsed onto one line.
+type StdoutPlugin struct {
+	Out io.Writer
+	// If Color is set, names, types and tags are colorized with ANSI
+	// escape codes.
+	Color bool
+	// MaxLines is the most lines printed for one flush, so that a busy
+	// veneur doesn't flood the terminal; the rest are only counted.
+	// Defaults to DefaultMaxLines.
+	MaxLines int
+
+	// flushes can overlap, and shouldn't interleave their lines
+	mtx sync.Mutex
+	// swapped out by tests
+	now func() time.Time
+}
+
+// NewStdoutPlugin creates a StdoutPlugin that prints to out.
+func NewStdoutPlugin(out io.Writer, color bool, maxLines int) *StdoutPlugin {
+	if maxLines <= 0 {
+		maxLines = DefaultMaxLines
+	}
+	return &StdoutPlugin{
+		Out:      out,
+		Color:    color,
+		MaxLines: maxLines,
+		now:      time.Now,
+	}
+}
+
+// line is one row of the table: a single metric, or every aggregate of a
+// histogram.
+type line struct {
+	name, typ, value string
+	tags             []string
+}
+
+// Flush prints the metrics.
+func (p *StdoutPlugin) Flush(metrics []samplers.DDMetric, hostname string) error {
+	lines := groupLines(metrics)
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	fmt.Fprintf(p.Out, "%s flushed %d metrics from %s\n", p.now().Format("15:04:05"), len(metrics), hostname)
+	w := tabwriter.NewWriter(p.Out, 0, 4, 2, ' ', 0)
+	for i, l := range lines {
+		if i == p.MaxLines {
+			fmt.Fprintf(w, "... and %d more\n", len(lines)-i)
+			break
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s", p.colorize(colorBold, l.name), p.colorize(colorCyan, l.typ), l.value)
+		if len(l.tags) > 0 {
+			fmt.Fprintf(w, "\t%s", p.colorize(colorFaint, strings.Join(l.tags, ",")))
+		}
+		fmt.Fprintln(w)
+	}
+	return w.Flush()
+}
+
+// Name returns "stdout".
+func (p *StdoutPlugin) Name() string {
+	return "stdout"
+}
+
+func (p *StdoutPlugin) colorize(color, s string) string {
+	if !p.Color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// groupLines turns metrics into lines. Histograms and timers are flushed as a
+// run of series named "<name>.<aggregate>" (eg "a.b.c.max",
+// "a.b.c.99percentile") with the same tags, so each such run of two or more
+// is collapsed into a single line like
+//
+//	a.b.c  histogram  max=9 min=1 count=0.5/s p50=3 p99=9  foo:bar
+//
+// Anything else gets a line of its own.
+func groupLines(metrics []samplers.DDMetric) []line {
+	var lines []line
+	for i := 0; i < len(metrics); {
+		base, _, ok := splitAggregate(metrics[i].Name)
+		j := i + 1
+		if ok {
+			for j < len(metrics) && sameHistogram(metrics[i], metrics[j], base) {
+				j++
+			}
+		}
+		if j-i < 2 {
+			m := metrics[i]
+			lines = append(lines, line{
+				name:  m.Name,
+				typ:   m.MetricType,
+				value: formatValue(m),
+				tags:  m.Tags,
+			})
+			i++
+			continue
+		}
+
+		values := make([]string, 0, j-i)
+		for _, m := range metrics[i:j] {
+			_, label, _ := splitAggregate(m.Name)
+			values = append(values, label+"="+formatValue(m))
+		}
+		lines = append(lines, line{
+			name:  base,
+			typ:   "histogram",
+			value: strings.Join(values, " "),
+			tags:  metrics[i].Tags,
+		})
+		i = j
+	}
+	return lines
+}
+
+// splitAggregate splits the name of a histogram aggregate into the name of
+// the histogram and a short label for the aggregate. ok is false if the name
+// doesn't end with an aggregate.
+func splitAggregate(name string) (base, label string, ok bool) {
+	dot := strings.LastIndex(name, ".")
+	if dot <= 0 {
+		return "", "", false
+	}
+	base, suffix := name[:dot], name[dot+1:]
+	if _, isAggregate := samplers.AggregatesLookup[suffix]; isAggregate {
+		return base, suffix, true
+	}
+	if match := percentileSuffix.FindStringSubmatch(suffix); match != nil {
+		return base, "p" + match[1], true
+	}
+	return "", "", false
+}
+
+func sameHistogram(first, m samplers.DDMetric, base string) bool {
+	mBase, _, ok := splitAggregate(m.Name)
+	if !ok || mBase != base || len(m.Tags) != len(first.Tags) {
+		return false
+	}
+	for i := range m.Tags {
+		if m.Tags[i] != first.Tags[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func formatValue(m samplers.DDMetric) string {
+	value := strconv.FormatFloat(m.Value[0][1], 'g', 6, 64)
+	if m.MetricType == "rate" {
+		value += "/s"
+	}
+	return value
+}
@@ -0,0 +1,67 @@
+package stdout
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func testMetrics() []samplers.DDMetric {
+	metric := func(name, typ string, value float64, tags ...string) samplers.DDMetric {
+		return samplers.DDMetric{
+			Name:       name,
+			Value:      [1][2]float64{{1500000000, value}},
+			Tags:       tags,
+			MetricType: typ,
+		}
+	}
+	return []samplers.DDMetric{
+		metric("api.requests", "rate", 0.5, "route:/users"),
+		metric("api.latency.max", "gauge", 90, "route:/users"),
+		metric("api.latency.min", "gauge", 1.25, "route:/users"),
+		metric("api.latency.count", "rate", 2, "route:/users"),
+		metric("api.latency.50percentile", "gauge", 10, "route:/users"),
+		metric("api.latency.99percentile", "gauge", 88.5, "route:/users"),
+		// a different series of the same histogram gets its own line
+		metric("api.latency.max", "gauge", 12, "route:/posts"),
+		metric("api.latency.min", "gauge", 3, "route:/posts"),
+		// a lone aggregate-looking name is left alone
+		metric("jobs.count", "gauge", 7),
+	}
+}
+
+func TestFlush(t *testing.T) {
+	var out bytes.Buffer
+	p := NewStdoutPlugin(&out, false, 0)
+	p.now = func() time.Time { return time.Date(2017, 7, 14, 2, 40, 0, 0, time.UTC) }
+
+	assert.NoError(t, p.Flush(testMetrics(), "localhost"))
+	assert.Equal(t, `02:40:00 flushed 9 metrics from localhost
+api.requests  rate       0.5/s                                      route:/users
+api.latency   histogram  max=90 min=1.25 count=2/s p50=10 p99=88.5  route:/users
+api.latency   histogram  max=12 min=3                               route:/posts
+jobs.count    gauge      7
+`, out.String())
+}
+
+func TestFlushMaxLines(t *testing.T) {
+	var out bytes.Buffer
+	p := NewStdoutPlugin(&out, false, 2)
+
+	assert.NoError(t, p.Flush(testMetrics(), "localhost"))
+	assert.Contains(t, out.String(), "api.latency   histogram  max=90")
+	assert.NotContains(t, out.String(), "route:/posts")
+	assert.Contains(t, out.String(), "... and 2 more\n")
+}
+
+func TestFlushColor(t *testing.T) {
+	var out bytes.Buffer
+	p := NewStdoutPlugin(&out, true, 0)
+
+	assert.NoError(t, p.Flush(testMetrics()[:1], "localhost"))
+	assert.Contains(t, out.String(), "\x1b[1mapi.requests\x1b[0m")
+	assert.Contains(t, out.String(), "\x1b[36mrate\x1b[0m")
+}
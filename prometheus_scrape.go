@@ -0,0 +1,290 @@
+package veneur
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/samplers"
+)
+
+// ScrapeTarget is an endpoint serving metrics in the Prometheus or
+// OpenMetrics text format, which veneur scrapes and aggregates like the
+// metrics it receives. Tags are added to every metric scraped from it.
+type ScrapeTarget struct {
+	URL  string   `yaml:"url"`
+	Tags []string `yaml:"tags"`
+}
+
+// scraper scrapes one target every interval, and turns what it exposes
+// into veneur metrics:
+//
+// Counters, and the _sum and _count of histograms and summaries, are
+// cumulative, so each scrape reports how much they increased since the
+// previous one as a veneur counter. The first scrape of a series only sets
+// its baseline, a decrease means the target restarted, and since veneur
+// counters are integers a fractional increase is carried into the next
+// scrape.
+//
+// Histogram buckets are turned into samples of a veneur histogram named for
+// the family: the observations that fell in a bucket since the previous
+// scrape are sampled, with their count as the weight, as the midpoint of the
+// bucket, or its upper bound for the first bucket, or the largest finite
+// bound for the +Inf bucket. Its percentiles are only as precise as the
+// buckets.
+//
+// Summary quantiles, which can't be aggregated, are reported as gauges tagged
+// with the quantile, as are gauges and untyped samples.
+type scraper struct {
+	url      string
+	tags     []string
+	interval time.Duration
+	client   *http.Client
+	// the cumulative series at the previous scrape, by series key. Only the
+	// target's goroutine touches it.
+	last map[string]float64
+}
+
+func newScrapers(targets []ScrapeTarget, interval time.Duration) ([]*scraper, error) {
+	ret := make([]*scraper, 0, len(targets))
+	for i, target := range targets {
+		if target.URL == "" {
+			return nil, fmt.Errorf("prometheus scrape target %d has no url", i)
+		}
+		if _, err := url.Parse(target.URL); err != nil {
+			return nil, fmt.Errorf("prometheus scrape target %d: %v", i, err)
+		}
+		ret = append(ret, &scraper{
+			url:      target.URL,
+			tags:     target.Tags,
+			interval: interval,
+			// a scrape that takes longer than the interval would just
+			// delay the next one
+			client: &http.Client{Timeout: interval},
+			last:   map[string]float64{},
+		})
+	}
+	return ret, nil
+}
+
+// scrapeForever scrapes the target every interval. Each target has its own
+// goroutine, so one that is slow or down doesn't hold up the others.
+func (s *Server) scrapeForever(t *scraper) {
+	ticker := time.NewTicker(t.interval)
+	for range ticker.C {
+		s.scrapeOnce(t)
+	}
+}
+
+// scrapeOnce scrapes the target, and hands what it exposed to the workers.
+func (s *Server) scrapeOnce(t *scraper) {
+	metrics, err := t.scrape()
+	if err != nil {
+		log.WithFields(logrus.Fields{
+			logrus.ErrorKey: err,
+			"target":        t.url,
+		}).Warn("Could not scrape Prometheus target")
+		s.statsd.Count("prometheus_scrape.errors_total", 1, []string{"target:" + t.url}, 1.0)
+		return
+	}
+	for _, metric := range metrics {
+		if s.dropMetrics([]*samplers.UDPMetric{metric}) {
+			continue
+		}
+		s.Workers[metric.Digest%uint32(len(s.Workers))].PacketChan <- *metric
+	}
+}
+
+func (t *scraper) scrape() ([]*samplers.UDPMetric, error) {
+	resp, err := t.client.Get(t.url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("target responded with %s", resp.Status)
+	}
+	samples, err := samplers.ParseExposition(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return t.convert(samples), nil
+}
+
+// scrapeBucket is one bucket of a histogram series.
+type scrapeBucket struct {
+	upper float64
+	count float64
+	key   string
+}
+
+type scrapeHistogram struct {
+	name    string
+	tags    []string
+	buckets []scrapeBucket
+}
+
+// convert turns the samples of one scrape into metrics, and keeps their
+// cumulative values for the next one.
+func (t *scraper) convert(samples []samplers.ExpositionSample) []*samplers.UDPMetric {
+	var metrics []*samplers.UDPMetric
+	last := make(map[string]float64, len(t.last))
+	histograms := map[string]*scrapeHistogram{}
+	var histogramKeys []string
+
+	for _, sample := range samples {
+		if strings.HasSuffix(sample.Name, "_created") && sample.Name != sample.Family {
+			// when an OpenMetrics counter was created, which isn't a value
+			continue
+		}
+
+		switch sample.Type {
+		case "counter":
+			tags := t.sampleTags(sample, "")
+			if m, ok := t.delta(sample.Name, tags, sample.Value, last); ok {
+				metrics = append(metrics, m)
+			}
+		case "histogram", "summary":
+			if sample.Name != sample.Family {
+				// _sum and _count, or a histogram's _bucket
+				if sample.Type == "histogram" && sample.Name == sample.Family+"_bucket" {
+					le, ok := sample.Label("le")
+					upper, err := strconv.ParseFloat(le, 64)
+					if !ok || err != nil {
+						continue
+					}
+					tags := t.sampleTags(sample, "le")
+					key := seriesKey(sample.Family, tags)
+					h, ok := histograms[key]
+					if !ok {
+						h = &scrapeHistogram{name: sample.Family, tags: tags}
+						histograms[key] = h
+						histogramKeys = append(histogramKeys, key)
+					}
+					h.buckets = append(h.buckets, scrapeBucket{
+						upper: upper,
+						count: sample.Value,
+						key:   seriesKey(sample.Name, tags) + "|le:" + le,
+					})
+					continue
+				}
+				tags := t.sampleTags(sample, "")
+				if m, ok := t.delta(sample.Name, tags, sample.Value, last); ok {
+					metrics = append(metrics, m)
+				}
+				continue
+			}
+			if _, ok := sample.Label("quantile"); !ok {
+				continue
+			}
+			metrics = t.appendGauge(metrics, sample)
+		default:
+			metrics = t.appendGauge(metrics, sample)
+		}
+	}
+
+	for _, key := range histogramKeys {
+		metrics = t.appendObservations(metrics, histograms[key], last)
+	}
+	t.last = last
+	return metrics
+}
+
+// sampleTags returns the tags for a sample: its labels, except the one named
+// except, and the target's tags.
+func (t *scraper) sampleTags(sample samplers.ExpositionSample, except string) []string {
+	tags := make([]string, 0, len(sample.Labels)+len(t.tags))
+	for _, label := range sample.Labels {
+		if label.Name == except {
+			continue
+		}
+		tags = append(tags, label.Name+":"+label.Value)
+	}
+	tags = append(tags, t.tags...)
+	sort.Strings(tags)
+	return tags
+}
+
+func seriesKey(name string, tags []string) string {
+	return name + "|" + strings.Join(tags, ",")
+}
+
+func (t *scraper) appendGauge(metrics []*samplers.UDPMetric, sample samplers.ExpositionSample) []*samplers.UDPMetric {
+	if math.IsNaN(sample.Value) || math.IsInf(sample.Value, 0) {
+		return metrics
+	}
+	return append(metrics, samplers.NewUDPMetric(sample.Name, "gauge", sample.Value, 1.0, t.sampleTags(sample, "")))
+}
+
+// increase returns how much the cumulative series with the given key, which
+// now has the given value, increased since the previous scrape, and records
+// its new baseline in last. It returns false if there was no previous scrape
+// to compare to.
+func (t *scraper) increase(key string, value float64, last map[string]float64) (float64, bool) {
+	if math.IsNaN(value) {
+		return 0, false
+	}
+	prev, ok := t.last[key]
+	if !ok {
+		last[key] = value
+		return 0, false
+	}
+	if value < prev {
+		// the target restarted, and counted value since
+		prev = 0
+	}
+	increase := math.Floor(value - prev)
+	last[key] = prev + increase
+	return increase, true
+}
+
+// delta returns a counter of how much the cumulative series increased since
+// the previous scrape.
+func (t *scraper) delta(name string, tags []string, value float64, last map[string]float64) (*samplers.UDPMetric, bool) {
+	increase, ok := t.increase(seriesKey(name, tags), value, last)
+	if !ok {
+		return nil, false
+	}
+	return samplers.NewUDPMetric(name, "counter", increase, 1.0, tags), true
+}
+
+// appendObservations samples the observations that fell in each of a
+// histogram's buckets since the previous scrape.
+func (t *scraper) appendObservations(metrics []*samplers.UDPMetric, h *scrapeHistogram, last map[string]float64) []*samplers.UDPMetric {
+	sort.Slice(h.buckets, func(i, j int) bool { return h.buckets[i].upper < h.buckets[j].upper })
+	// the buckets are cumulative, so each one's observations are its
+	// increase less the increase of the one below it
+	var below float64
+	for i, bucket := range h.buckets {
+		increase, ok := t.increase(bucket.key, bucket.count, last)
+		if !ok {
+			continue
+		}
+		count := increase - below
+		below = increase
+		if count <= 0 {
+			continue
+		}
+
+		value := bucket.upper
+		switch {
+		case math.IsInf(bucket.upper, 1):
+			if i == 0 {
+				continue
+			}
+			value = h.buckets[i-1].upper
+		case i > 0:
+			value = (h.buckets[i-1].upper + bucket.upper) / 2
+		}
+		// copied, since each metric sorts its own tags
+		tags := append([]string(nil), h.tags...)
+		metrics = append(metrics, samplers.NewUDPMetric(h.name, "histogram", value, float32(1/count), tags))
+	}
+	return metrics
+}
@@ -0,0 +1,128 @@
+package veneur
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func scrapeFormat(requests, bucket1, bucketInf float64) string {
+	return fmt.Sprintf(`# TYPE requests_total counter
+requests_total{code="200"} %g
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="1"} %g
+latency_seconds_bucket{le="3"} %g
+latency_seconds_bucket{le="+Inf"} %g
+latency_seconds_sum 10
+latency_seconds_count %g
+# TYPE rpc_seconds summary
+rpc_seconds{quantile="0.5"} 0.25
+# TYPE queue_depth gauge
+queue_depth 7
+`, requests, bucket1, bucket1, bucketInf, bucketInf)
+}
+
+func convertScrape(t *testing.T, target *scraper, exposition string) map[string]*samplers.UDPMetric {
+	samples, err := samplers.ParseExposition(strings.NewReader(exposition))
+	assert.NoError(t, err)
+	metrics := map[string]*samplers.UDPMetric{}
+	for _, m := range target.convert(samples) {
+		metrics[fmt.Sprintf("%s %s %g", m.Type, m.Name, m.Value)] = m
+	}
+	return metrics
+}
+
+func TestScrapeTargetConvert(t *testing.T) {
+	targets, err := newScrapers([]ScrapeTarget{{URL: "http://localhost:9100/metrics", Tags: []string{"job:node"}}}, time.Second)
+	assert.NoError(t, err)
+	target := targets[0]
+
+	metrics := convertScrape(t, target, scrapeFormat(10.5, 4, 6))
+	assert.Len(t, metrics, 2, "the first scrape only reports gauges, and sets the baseline of everything else")
+	if m := metrics["gauge rpc_seconds 0.25"]; assert.NotNil(t, m) {
+		assert.Equal(t, []string{"job:node", "quantile:0.5"}, m.Tags)
+	}
+	assert.NotNil(t, metrics["gauge queue_depth 7"])
+
+	metrics = convertScrape(t, target, scrapeFormat(13, 7, 10))
+	if m := metrics["counter requests_total 2"]; assert.NotNil(t, m, "the increase is reported, less its fraction") {
+		assert.Equal(t, []string{"code:200", "job:node"}, m.Tags)
+	}
+	assert.NotNil(t, metrics["counter latency_seconds_count 4"])
+	assert.NotNil(t, metrics["counter latency_seconds_sum 0"])
+	if m := metrics["histogram latency_seconds 1"]; assert.NotNil(t, m, "observations in the first bucket are its upper bound") {
+		assert.Equal(t, float32(1)/3, m.SampleRate)
+		assert.Equal(t, []string{"job:node"}, m.Tags)
+	}
+	if m := metrics["histogram latency_seconds 3"]; assert.NotNil(t, m, "observations in the +Inf bucket are the largest finite bound") {
+		assert.Equal(t, float32(1), m.SampleRate)
+	}
+	assert.Len(t, metrics, 7, "the empty middle bucket has no observations")
+
+	metrics = convertScrape(t, target, scrapeFormat(14, 7, 10))
+	assert.NotNil(t, metrics["counter requests_total 1"], "the carried fraction is counted once it adds up")
+
+	metrics = convertScrape(t, target, scrapeFormat(3, 7, 10))
+	assert.NotNil(t, metrics["counter requests_total 3"], "a decrease is a restart, so everything since is counted")
+}
+
+func TestScrapeOnce(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("# TYPE queue_depth gauge\nqueue_depth 7\n"))
+	}))
+	defer up.Close()
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	targets, err := newScrapers([]ScrapeTarget{{URL: down.URL}, {URL: up.URL}}, time.Second)
+	assert.NoError(t, err)
+	s := &Server{Workers: []*Worker{NewWorker(1, nil, logrus.New())}}
+	received := make(chan samplers.UDPMetric, 10)
+	go func() {
+		for m := range s.Workers[0].PacketChan {
+			received <- m
+		}
+	}()
+
+	_, err = targets[0].scrape()
+	assert.Error(t, err, "a target that doesn't respond OK hasn't been scraped")
+	s.scrapeOnce(targets[0])
+	s.scrapeOnce(targets[1])
+	select {
+	case m := <-received:
+		assert.Equal(t, "queue_depth", m.Name)
+		assert.Equal(t, "gauge", m.Type)
+		assert.Equal(t, float64(7), m.Value)
+	case <-time.After(time.Second):
+		t.Fatal("the target that is up should have been scraped")
+	}
+}
+
+func TestPrometheusScrapeConfig(t *testing.T) {
+	config := localConfig()
+	config.PrometheusScrapeTargets = []ScrapeTarget{{Tags: []string{"job:node"}}}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "targets need a url")
+
+	config = localConfig()
+	config.PrometheusScrapeTargets = []ScrapeTarget{{URL: "http://localhost:9100/metrics"}}
+	config.PrometheusScrapeInterval = "-1s"
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+
+	config.PrometheusScrapeInterval = "30s"
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	if assert.Len(t, s.scrapers, 1) {
+		assert.Equal(t, 30*time.Second, s.scrapers[0].interval)
+	}
+}
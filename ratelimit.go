@@ -0,0 +1,91 @@
+package veneur
+
+import (
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// sampleLimiter thins out histogram and timer observations for any series
+// that arrives faster than a configured ceiling, so that a client that
+// forgets to sample cannot flood downstream.
+//
+// Each series has a token bucket that refills at the ceiling rate and holds
+// at most one second's worth of tokens. Observations are kept with
+// probability keep, and each kept observation spends a token. Whenever the
+// bucket runs dry keep is halved, and whenever it is more than half full
+// again keep is doubled (up to 1), so the kept rate settles around the
+// ceiling. Kept observations have their sample rate multiplied by keep, which
+// scales up their weight to account for the ones that were dropped.
+//
+// A sampleLimiter belongs to a single Worker and relies on its mutex.
+type sampleLimiter struct {
+	ceiling float64 // observations per second
+	buckets map[samplers.MetricKey]*sampleBucket
+
+	// these are swapped out by tests
+	now    func() time.Time
+	random func() float64
+}
+
+type sampleBucket struct {
+	tokens float64
+	keep   float64
+	last   time.Time
+}
+
+func newSampleLimiter(ceiling int) *sampleLimiter {
+	return &sampleLimiter{
+		ceiling: float64(ceiling),
+		buckets: make(map[samplers.MetricKey]*sampleBucket),
+		now:     time.Now,
+		random:  rand.Float64,
+	}
+}
+
+// Admit decides whether an observation of the given series should be kept.
+// If so, it returns the sample rate it should be recorded with.
+func (l *sampleLimiter) Admit(mk samplers.MetricKey, sampleRate float32) (float32, bool) {
+	now := l.now()
+	b, ok := l.buckets[mk]
+	if !ok {
+		b = &sampleBucket{tokens: l.ceiling, keep: 1, last: now}
+		l.buckets[mk] = b
+	}
+
+	b.tokens += now.Sub(b.last).Seconds() * l.ceiling
+	if b.tokens > l.ceiling {
+		b.tokens = l.ceiling
+	}
+	b.last = now
+	if b.tokens > l.ceiling/2 && b.keep < 1 {
+		b.keep *= 2
+		if b.keep > 1 {
+			b.keep = 1
+		}
+	}
+
+	if b.keep < 1 && l.random() >= b.keep {
+		return 0, false
+	}
+	// observations kept while the bucket is dry don't put it into debt, so
+	// that a burst can't hold keep down long after the rate has fallen
+	b.tokens = math.Max(b.tokens-1, 0)
+	kept := sampleRate * float32(b.keep)
+	if b.tokens < 1 {
+		b.keep /= 2
+	}
+	return kept, true
+}
+
+// Prune forgets every series that has not been seen since the given time,
+// so that the limiter does not grow without bound.
+func (l *sampleLimiter) Prune(before time.Time) {
+	for mk, b := range l.buckets {
+		if b.last.Before(before) {
+			delete(l.buckets, mk)
+		}
+	}
+}
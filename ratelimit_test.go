@@ -0,0 +1,91 @@
+package veneur
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestSampleLimiter(t *testing.T) {
+	now := time.Now()
+	l := newSampleLimiter(10)
+	l.now = func() time.Time { return now }
+	l.random = func() float64 { return 0.99 }
+	mk := samplers.MetricKey{Name: "a.b.c", Type: "histogram"}
+
+	kept := 0
+	for i := 0; i < 100; i++ {
+		if rate, ok := l.Admit(mk, 1.0); ok {
+			assert.Equal(t, float32(1.0), rate, "observations under the ceiling should keep their weight")
+			kept++
+		}
+	}
+	assert.Equal(t, 10, kept, "only the ceiling's worth of observations should be kept")
+
+	other := samplers.MetricKey{Name: "d.e.f", Type: "histogram"}
+	_, ok := l.Admit(other, 1.0)
+	assert.True(t, ok, "series should be limited independently")
+
+	// once the bucket has refilled, observations flow again
+	now = now.Add(time.Second)
+	rate, ok := l.Admit(mk, 0.5)
+	assert.True(t, ok)
+	assert.Equal(t, float32(0.5), rate)
+
+	l.Prune(now.Add(-time.Millisecond))
+	assert.Len(t, l.buckets, 1, "idle series should be pruned")
+}
+
+func TestSampleLimiterScalesWeight(t *testing.T) {
+	now := time.Now()
+	l := newSampleLimiter(2)
+	l.now = func() time.Time { return now }
+	l.random = func() float64 { return 0 }
+	mk := samplers.MetricKey{Name: "a.b.c", Type: "timer"}
+
+	var rates []float32
+	for i := 0; i < 4; i++ {
+		rate, ok := l.Admit(mk, 1.0)
+		assert.True(t, ok)
+		rates = append(rates, rate)
+	}
+	assert.Equal(t, []float32{1, 1, 0.5, 0.25}, rates, "observations past the ceiling should be weighted up")
+
+	for i := 0; i < 100; i++ {
+		l.Admit(mk, 1.0)
+	}
+	b := l.buckets[mk]
+	assert.Equal(t, 0.0, b.tokens, "a burst shouldn't put the bucket into debt")
+	keep := b.keep
+	now = now.Add(time.Second)
+	l.Admit(mk, 1.0)
+	assert.Equal(t, keep*2, b.keep, "keep should recover as soon as the bucket refills")
+}
+
+func TestWorkerHistogramMaxRate(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	w.limiter = newSampleLimiter(5)
+	w.limiter.random = func() float64 { return 0.99 }
+
+	for _, typ := range []string{"histogram", "counter"} {
+		for i := 0; i < 20; i++ {
+			w.ProcessMetric(&samplers.UDPMetric{
+				MetricKey:  samplers.MetricKey{Name: "a.b.c", Type: typ},
+				Value:      1.0,
+				Digest:     12345,
+				SampleRate: 1.0,
+			})
+		}
+	}
+	dropped := w.dropped
+	assert.True(t, dropped > 0, "some histogram observations should have been dropped")
+
+	wm := w.Flush()
+	mk := samplers.MetricKey{Name: "a.b.c", Type: "histogram"}
+	assert.Equal(t, float64(20-dropped), wm.histograms[mk].LocalWeight, "kept histogram observations should be recorded")
+	assert.Len(t, wm.counters, 1, "counters should not be limited")
+	assert.Equal(t, int64(0), w.dropped, "dropped count should be reset on flush")
+}
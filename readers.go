@@ -0,0 +1,52 @@
+package veneur
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// readerStats counts what one goroutine reading the UDP metrics socket has
+// read since the last flush, so that an uneven spread of datagrams across
+// num_readers sockets shows up.
+type readerStats struct {
+	packets int64
+	bytes   int64
+	tag     string
+}
+
+// readerSet holds the stats of every reader that has been started.
+type readerSet struct {
+	mtx     sync.Mutex
+	readers []*readerStats
+}
+
+// add registers a reader, numbering them in the order they start.
+func (rs *readerSet) add() *readerStats {
+	rs.mtx.Lock()
+	defer rs.mtx.Unlock()
+	r := &readerStats{tag: "reader:" + strconv.Itoa(len(rs.readers))}
+	rs.readers = append(rs.readers, r)
+	return r
+}
+
+func (r *readerStats) read(n int) {
+	atomic.AddInt64(&r.packets, 1)
+	atomic.AddInt64(&r.bytes, int64(n))
+}
+
+// reportReaders reports what each reader has read since the last flush.
+func (s *Server) reportReaders() {
+	s.readers.mtx.Lock()
+	readers := s.readers.readers
+	s.readers.mtx.Unlock()
+	if len(readers) < 2 {
+		// the totals say it all
+		return
+	}
+	for _, r := range readers {
+		tags := []string{r.tag}
+		s.statsd.Count("ingest.reader_packets_received_total", atomic.SwapInt64(&r.packets, 0), tags, 1.0)
+		s.statsd.Count("ingest.reader_bytes_received_total", atomic.SwapInt64(&r.bytes, 0), tags, 1.0)
+	}
+}
@@ -0,0 +1,159 @@
+package veneur
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// datadogSinkName is what routing rules call the Datadog API, which is
+// flushed to directly rather than through a plugin.
+const datadogSinkName = "datadog"
+
+// scrapeSinkName is what routing rules call the /metrics endpoint, which
+// serves what was routed to it at the last flush.
+const scrapeSinkName = "scrape"
+
+// MetricRoute is a rule for which sinks receive a metric. A metric matches if
+// its name matches the Name regular expression (an empty Name matches every
+// metric) and it has every one of Tags. Sinks are named "datadog" for the
+// Datadog API, "scrape" for the /metrics endpoint, and by plugin name (eg
+// "s3", "influxdb", or that of a plugins.Sink) for the others. A
+// rule with no Sinks drops the metrics it matches.
+type MetricRoute struct {
+	Name  string   `yaml:"name"`
+	Tags  []string `yaml:"tags"`
+	Sinks []string `yaml:"sinks"`
+}
+
+// metricRouter decides which sinks receive each flushed metric. Rules are
+// tried in the order they were configured, and the first one that matches
+// decides; a metric that matches no rule goes to the default sinks, or to
+// every sink if no defaults were configured.
+type metricRouter struct {
+	rules    []metricRule
+	defaults []string
+}
+
+type metricRule struct {
+	name  *regexp.Regexp
+	tags  []string
+	sinks []string
+}
+
+func newMetricRouter(routes []MetricRoute, defaults []string) (*metricRouter, error) {
+	r := &metricRouter{}
+	if len(defaults) > 0 {
+		r.defaults = defaults
+	}
+	for i, route := range routes {
+		// never nil, since that would mean every sink
+		sinks := append([]string{}, route.Sinks...)
+		rule := metricRule{tags: route.Tags, sinks: sinks}
+		if route.Name != "" {
+			re, err := regexp.Compile(route.Name)
+			if err != nil {
+				return nil, fmt.Errorf("metric route %d: %s", i, err)
+			}
+			rule.name = re
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// sinks returns the names of the sinks that should receive the metric, or
+// nil if it should go to every sink.
+func (r *metricRouter) sinks(metric samplers.DDMetric) []string {
+	for _, rule := range r.rules {
+		if rule.matches(metric) {
+			return rule.sinks
+		}
+	}
+	return r.defaults
+}
+
+func (rule metricRule) matches(metric samplers.DDMetric) bool {
+	if rule.name != nil && !rule.name.MatchString(metric.Name) {
+		return false
+	}
+	for _, want := range rule.tags {
+		found := false
+		for _, tag := range metric.Tags {
+			if tag == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// route partitions the metrics by sink. sinkNames lists every sink that is
+// configured, so that metrics which go to every sink can be given to each of
+// them. NewFromConfig makes sure that rules only name configured sinks.
+func (r *metricRouter) route(metrics []samplers.DDMetric, sinkNames []string) routedMetrics {
+	routed := routedMetrics{}
+	for _, metric := range metrics {
+		sinks := r.sinks(metric)
+		if sinks == nil {
+			sinks = sinkNames
+		}
+		for _, sink := range sinks {
+			routed[sink] = append(routed[sink], metric)
+		}
+	}
+	return routed
+}
+
+// routedMetrics holds the metrics for each sink. A nil routedMetrics means
+// no routing is configured, and every sink gets every metric.
+type routedMetrics map[string][]samplers.DDMetric
+
+func (rm routedMetrics) forSink(sink string, all []samplers.DDMetric) []samplers.DDMetric {
+	if rm == nil {
+		return all
+	}
+	return rm[sink]
+}
+
+// checkSinkNames returns an error if any of the names, from the given config
+// option, isn't a configured sink, so that a typo doesn't silently drop the
+// metrics meant for it.
+func (s *Server) checkSinkNames(option string, names []string) error {
+	known := []string{datadogSinkName, scrapeSinkName}
+	for _, p := range s.getPlugins() {
+		known = append(known, p.Name())
+	}
+	for _, name := range names {
+		found := false
+		for _, sink := range known {
+			if name == sink {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %q is not a configured sink, which are %s", option, name, strings.Join(known, ", "))
+		}
+	}
+	return nil
+}
+
+// routeMetrics partitions the flushed metrics between the configured sinks,
+// if routing is enabled.
+func (s *Server) routeMetrics(metrics []samplers.DDMetric) routedMetrics {
+	if s.router == nil {
+		return nil
+	}
+	sinkNames := []string{datadogSinkName, scrapeSinkName}
+	for _, p := range s.getPlugins() {
+		sinkNames = append(sinkNames, p.Name())
+	}
+	return s.router.route(metrics, sinkNames)
+}
@@ -0,0 +1,136 @@
+package veneur
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func routingTestMetrics() []samplers.DDMetric {
+	return []samplers.DDMetric{
+		{Name: "security.login.failed", Tags: []string{"team:security"}},
+		{Name: "security.audit", Tags: []string{"team:infra"}},
+		{Name: "api.latency", Tags: []string{"team:security", "env:prod"}},
+		{Name: "api.requests"},
+	}
+}
+
+func routedNames(routed routedMetrics) map[string][]string {
+	names := map[string][]string{}
+	for sink, metrics := range routed {
+		for _, m := range metrics {
+			names[sink] = append(names[sink], m.Name)
+		}
+	}
+	return names
+}
+
+func TestMetricRouterFirstMatchWins(t *testing.T) {
+	r, err := newMetricRouter([]MetricRoute{
+		{Name: `^security\.`, Tags: []string{"team:security"}, Sinks: []string{"s3"}},
+		{Name: `^security\.`, Sinks: []string{"s3", "influxdb"}},
+		{Tags: []string{"team:security", "env:prod"}, Sinks: []string{"datadog", "s3"}},
+	}, []string{"datadog"})
+	assert.NoError(t, err)
+
+	routed := r.route(routingTestMetrics(), []string{"datadog", "s3", "influxdb"})
+	assert.Equal(t, map[string][]string{
+		"s3":       {"security.login.failed", "security.audit", "api.latency"},
+		"influxdb": {"security.audit"},
+		"datadog":  {"api.latency", "api.requests"},
+	}, routedNames(routed))
+}
+
+func TestMetricRouterDefaults(t *testing.T) {
+	routes := []MetricRoute{{Name: `^security\.`, Sinks: []string{"s3"}}}
+	sinks := []string{"datadog", "s3"}
+
+	// without defaults, unmatched metrics go everywhere
+	r, err := newMetricRouter(routes, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"s3":      {"security.login.failed", "security.audit", "api.latency", "api.requests"},
+		"datadog": {"api.latency", "api.requests"},
+	}, routedNames(r.route(routingTestMetrics(), sinks)))
+
+	// an empty list of defaults is the same as none
+	r, err = newMetricRouter(routes, []string{})
+	assert.NoError(t, err)
+	assert.Len(t, r.route(routingTestMetrics(), sinks)["datadog"], 2)
+
+	// a rule with no sinks drops what it matches
+	r, err = newMetricRouter([]MetricRoute{{Name: `^security\.`}}, []string{"datadog"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]string{
+		"datadog": {"api.latency", "api.requests"},
+	}, routedNames(r.route(routingTestMetrics(), sinks)))
+}
+
+func TestMetricRouterInvalidPattern(t *testing.T) {
+	_, err := newMetricRouter([]MetricRoute{{Name: "("}}, nil)
+	assert.Error(t, err)
+}
+
+func TestFlushPluginsRouted(t *testing.T) {
+	s := &Server{}
+	var flushed []samplers.DDMetric
+	s.registerPlugin(&dummyPlugin{flush: func(metrics []samplers.DDMetric, hostname string) error {
+		flushed = metrics
+		return nil
+	}})
+
+	metrics := routingTestMetrics()
+	s.flushPlugins(context.Background(), metrics, nil)
+	assert.Equal(t, metrics, flushed, "without routing, plugins get everything")
+
+	var err error
+	s.router, err = newMetricRouter([]MetricRoute{{Name: `^api\.`, Sinks: []string{"dummy_plugin"}}}, []string{"datadog"})
+	assert.NoError(t, err)
+	routed := s.routeMetrics(metrics)
+	s.flushPlugins(context.Background(), metrics, routed)
+	assert.Equal(t, metrics[2:], flushed)
+	assert.Equal(t, metrics[:2], routed.forSink(datadogSinkName, metrics))
+}
+
+func TestScrapeRouted(t *testing.T) {
+	config := localConfig()
+	config.MetricRoutes = []MetricRoute{{Name: `^security\.`, Sinks: []string{"datadog"}}}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+
+	for _, name := range []string{"security.logins", "api.requests"} {
+		s.Workers[0].ProcessMetric(samplers.NewUDPMetric(name, "counter", 1, 1.0, nil))
+	}
+	s.Flush()
+
+	names := map[string]bool{}
+	for _, metric := range s.lastFlush.get() {
+		names[metric.Name] = true
+	}
+	assert.Equal(t, map[string]bool{"api.requests": true}, names, "/metrics should only serve what is routed to it")
+}
+
+func TestRouteSinksConfig(t *testing.T) {
+	config := localConfig()
+	config.MetricRoutes = []MetricRoute{{Name: `^security\.`, Sinks: []string{"datadgo"}}}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "routes to sinks that aren't configured should be rejected")
+
+	config = localConfig()
+	config.MetricRoutesDefault = []string{"s3"}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "s3 isn't configured")
+
+	config = localConfig()
+	config.SinkFlushTimeouts = map[string]string{"influxdb": "2s"}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "timeouts for sinks that aren't configured should be rejected")
+
+	config = localConfig()
+	config.MetricRoutes = []MetricRoute{{Name: `^security\.`, Sinks: []string{"datadog"}}}
+	config.MetricRoutesDefault = []string{"datadog", "scrape"}
+	_, err = NewFromConfig(config)
+	assert.NoError(t, err)
+}
@@ -0,0 +1,185 @@
+package samplers
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// ExpositionSample is one sample from a Prometheus or OpenMetrics text
+// exposition, eg the line
+//
+//	http_request_duration_seconds_bucket{code="200",le="0.5"} 129
+//
+// is a sample of the histogram family http_request_duration_seconds.
+type ExpositionSample struct {
+	// Name is the sample's own name, and Family the name of the family it
+	// belongs to, which differ for the _bucket, _sum, _count, _total and
+	// _created samples of a family.
+	Name   string
+	Family string
+	// Type is the family's type from its TYPE line: counter, gauge,
+	// histogram, summary, or untyped if it had none.
+	Type   string
+	Labels []ExpositionLabel
+	Value  float64
+}
+
+// ExpositionLabel is one of a sample's labels.
+type ExpositionLabel struct {
+	Name  string
+	Value string
+}
+
+// Label returns the value of the sample's label with the given name, and
+// whether it has one.
+func (s ExpositionSample) Label(name string) (string, bool) {
+	for _, label := range s.Labels {
+		if label.Name == name {
+			return label.Value, true
+		}
+	}
+	return "", false
+}
+
+// expositionSuffixes are the suffixes that a sample's name may add to its
+// family's.
+var expositionSuffixes = []string{"_bucket", "_sum", "_count", "_total", "_created", "_gcount", "_gsum"}
+
+// ParseExposition parses the text exposition format that Prometheus scrapes,
+// and the OpenMetrics text format. HELP lines, other comments, and sample
+// timestamps and exemplars are ignored.
+func ParseExposition(r io.Reader) ([]ExpositionSample, error) {
+	var samples []ExpositionSample
+	types := map[string]string{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if line[0] == '#' {
+			fields := strings.Fields(string(line[1:]))
+			if len(fields) >= 3 && fields[0] == "TYPE" {
+				types[fields[1]] = fields[2]
+			}
+			continue
+		}
+		sample, err := parseExpositionLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+		sample.Family, sample.Type = expositionFamily(sample.Name, types)
+		samples = append(samples, sample)
+	}
+	return samples, scanner.Err()
+}
+
+// expositionFamily returns the family a sample with the given name belongs
+// to, and its type, given the types declared so far.
+func expositionFamily(name string, types map[string]string) (string, string) {
+	if typ, ok := types[name]; ok {
+		return name, typ
+	}
+	for _, suffix := range expositionSuffixes {
+		if !strings.HasSuffix(name, suffix) {
+			continue
+		}
+		family := strings.TrimSuffix(name, suffix)
+		if typ, ok := types[family]; ok {
+			return family, typ
+		}
+	}
+	return name, "untyped"
+}
+
+func parseExpositionLine(line []byte) (ExpositionSample, error) {
+	sample := ExpositionSample{}
+	end := bytes.IndexAny(line, "{ \t")
+	if end == -1 {
+		return sample, fmt.Errorf("sample %q has no value", line)
+	}
+	sample.Name = string(line[:end])
+	if sample.Name == "" {
+		return sample, fmt.Errorf("sample %q has no name", line)
+	}
+	rest := line[end:]
+
+	if rest[0] == '{' {
+		var err error
+		sample.Labels, rest, err = parseExpositionLabels(rest[1:])
+		if err != nil {
+			return sample, fmt.Errorf("sample %s: %v", sample.Name, err)
+		}
+	}
+
+	// an OpenMetrics exemplar follows the value and timestamp
+	if i := bytes.IndexByte(rest, '#'); i >= 0 {
+		rest = rest[:i]
+	}
+	fields := strings.Fields(string(rest))
+	if len(fields) == 0 || len(fields) > 2 {
+		return sample, fmt.Errorf("sample %s must have a value, and optionally a timestamp", sample.Name)
+	}
+	value, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return sample, fmt.Errorf("sample %s has an invalid value %q", sample.Name, fields[0])
+	}
+	sample.Value = value
+	return sample, nil
+}
+
+// parseExpositionLabels parses the labels following a sample's opening brace,
+// and returns them and what follows the closing one.
+func parseExpositionLabels(b []byte) ([]ExpositionLabel, []byte, error) {
+	var labels []ExpositionLabel
+	for {
+		b = bytes.TrimLeft(b, " \t")
+		if len(b) == 0 {
+			return nil, nil, fmt.Errorf("labels are not closed")
+		}
+		if b[0] == '}' {
+			return labels, b[1:], nil
+		}
+
+		eq := bytes.IndexByte(b, '=')
+		if eq <= 0 {
+			return nil, nil, fmt.Errorf("label has no value")
+		}
+		name := string(bytes.TrimSpace(b[:eq]))
+		b = bytes.TrimLeft(b[eq+1:], " \t")
+		if len(b) == 0 || b[0] != '"' {
+			return nil, nil, fmt.Errorf("value of label %s is not quoted", name)
+		}
+
+		value := bytes.Buffer{}
+		i := 1
+		for ; i < len(b) && b[i] != '"'; i++ {
+			if b[i] != '\\' || i+1 == len(b) {
+				value.WriteByte(b[i])
+				continue
+			}
+			i++
+			switch b[i] {
+			case 'n':
+				value.WriteByte('\n')
+			default:
+				// \\ and \", and anything else escaped as itself
+				value.WriteByte(b[i])
+			}
+		}
+		if i == len(b) {
+			return nil, nil, fmt.Errorf("value of label %s is not closed", name)
+		}
+		labels = append(labels, ExpositionLabel{Name: name, Value: value.String()})
+
+		b = bytes.TrimLeft(b[i+1:], " \t")
+		if len(b) > 0 && b[0] == ',' {
+			b = b[1:]
+		}
+	}
+}
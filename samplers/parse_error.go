@@ -0,0 +1,53 @@
+package samplers
+
+import "fmt"
+
+// The causes of ParseErrors, for telling apart the ways in which clients send
+// bad packets.
+const (
+	// ParseErrorSyntax is a packet that isn't structured like a metric,
+	// eg missing its colon or type, or with an empty, unknown or repeated
+	// section.
+	ParseErrorSyntax = "syntax"
+	// ParseErrorName is a metric with an empty name.
+	ParseErrorName = "name"
+	// ParseErrorType is a metric whose type is not one we know.
+	ParseErrorType = "type"
+	// ParseErrorValue is a metric none of whose values are numbers.
+	ParseErrorValue = "value"
+	// ParseErrorSampleRate is a metric whose sample rate is not a number
+	// in (0, 1].
+	ParseErrorSampleRate = "sample_rate"
+	// ParseErrorTimestamp is a timestamp on a type of metric that can't
+	// have one.
+	ParseErrorTimestamp = "timestamp"
+	// ParseErrorNaming is a metric whose name doesn't match the Parser's
+	// NamePattern.
+	ParseErrorNaming = "naming"
+	// ParseErrorUnknown is any other error.
+	ParseErrorUnknown = "unknown"
+)
+
+// A ParseError is an error parsing a metric packet. Its Cause is one of the
+// ParseError constants.
+type ParseError struct {
+	Cause   string
+	message string
+}
+
+func (e *ParseError) Error() string {
+	return e.message
+}
+
+func parseError(cause, format string, args ...interface{}) error {
+	return &ParseError{Cause: cause, message: fmt.Sprintf(format, args...)}
+}
+
+// ParseErrorCause returns the cause of an error returned by ParseMetric or
+// ParseMetrics, or ParseErrorUnknown if it isn't a ParseError.
+func ParseErrorCause(err error) string {
+	if pe, ok := err.(*ParseError); ok {
+		return pe.Cause
+	}
+	return ParseErrorUnknown
+}
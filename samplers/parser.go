@@ -5,10 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"hash/fnv"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/stripe/veneur/ssf"
 )
 
 // UDPMetric is a representation of the sample provided by a client. The tag list
@@ -20,6 +23,15 @@ type UDPMetric struct {
 	SampleRate float32
 	Tags       []string
 	Scope      MetricScope
+	// ContainerID is the ID of the container that sent the metric, if its
+	// client set one
+	ContainerID string
+	// TruncatedTags is how many tags were dropped because the metric had
+	// more than the Parser's MaxTags
+	TruncatedTags int
+	// NamingViolation is set if the metric's name doesn't match the
+	// Parser's NamePattern
+	NamingViolation bool
 }
 
 type MetricScope int
@@ -35,11 +47,88 @@ type MetricKey struct {
 	Name       string `json:"name"`
 	Type       string `json:"type"`
 	JoinedTags string `json:"tagstring"` // tags in deterministic order, joined with commas
+	// Timestamp is the explicit timestamp the client sent the metric with,
+	// as a unix epoch, or 0 if it should be reported at flush time. Since
+	// it is part of the key, each backfilled point is aggregated separately
+	// from live values of the same series.
+	Timestamp int64 `json:"timestamp,omitempty"`
+}
+
+// entityTagPrefix marks tags that DogStatsD clients attach to identify the
+// entity (pod, container, etc) that sent a metric
+const entityTagPrefix = "dd.internal."
+
+// containerIDTag is the tag that a container ID field is kept under, unless
+// entity tags are being stripped
+const containerIDTag = "container_id"
+
+// A Parser converts DogStatsD packets into metrics. The zero value is ready
+// to use and is what ParseMetric uses.
+type Parser struct {
+	// StripEntityTags drops the container ID field (|c:) and any
+	// dd.internal.* tags that newer DogStatsD clients attach, instead of
+	// keeping them as ordinary tags.
+	StripEntityTags bool
+
+	// ExplicitTimestamps makes counters and gauges that carry a timestamp
+	// field (|T<unix epoch>) be reported at that time rather than at flush
+	// time, for clients that backfill. Otherwise the field is ignored.
+	ExplicitTimestamps bool
+
+	// ExtraTags are added to every metric parsed, eg to mark which
+	// listener received it. They count towards MaxTags. Where a metric
+	// already has a tag with the same key, TagPrecedence decides which is
+	// kept, with ExtraTags being TagSourceListener tags.
+	ExtraTags     []string
+	TagPrecedence TagPrecedence
+
+	// MaxTags is the most tags a metric may have. Metrics with more keep
+	// only the first MaxTags in sorted order, so that an over-tagged series
+	// is always truncated the same way. 0 means no limit.
+	MaxTags int
+
+	// NamePattern, if set, is a regular expression that metric names must
+	// match. Metrics whose names don't are rejected with a ParseError whose
+	// cause is ParseErrorNaming, unless TagNamingViolations is set, in which
+	// case they are kept with the NamingViolationTag (which doesn't count
+	// towards MaxTags) and their NamingViolation set.
+	NamePattern         *regexp.Regexp
+	TagNamingViolations bool
 }
 
+// NamingViolationTag marks metrics whose names don't match the Parser's
+// NamePattern, if it tags them rather than rejecting them.
+const NamingViolationTag = "naming_violation:true"
+
 // ParseMetric converts the incoming packet from Datadog DogStatsD
 // Datagram format in to a Metric. http://docs.datadoghq.com/guides/dogstatsd/#datagram-format
 func ParseMetric(packet []byte) (*UDPMetric, error) {
+	return Parser{}.ParseMetric(packet)
+}
+
+// ParseMetric converts the incoming packet from Datadog DogStatsD
+// Datagram format in to a Metric, using the Parser's options. Packets
+// carrying more than one value are rejected; use ParseMetrics for those.
+func (p Parser) ParseMetric(packet []byte) (*UDPMetric, error) {
+	metrics, invalid, err := p.ParseMetrics(packet)
+	if err != nil {
+		return nil, err
+	}
+	if len(metrics) != 1 || invalid != 0 {
+		return nil, parseError(ParseErrorSyntax, "Invalid metric packet, multiple values specified")
+	}
+	return metrics[0], nil
+}
+
+// ParseMetrics converts the incoming packet from Datadog DogStatsD Datagram
+// format in to Metrics, using the Parser's options. A packet may carry
+// several colon-separated values for the same metric (eg "a.b.c:1:2:3|h"),
+// which results in one Metric per value, all sharing the same type, tags and
+// sample rate. Values that cannot be parsed are skipped, and their number is
+// returned as invalid; it is only an error if none of the values parse.
+//
+// Set members can legitimately contain colons, so sets are never split.
+func (p Parser) ParseMetrics(packet []byte) (metrics []*UDPMetric, invalid int, err error) {
 	ret := &UDPMetric{
 		SampleRate: 1.0,
 	}
@@ -48,26 +137,27 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 
 	startingColon := bytes.IndexByte(pipeSplitter.Chunk(), ':')
 	if startingColon == -1 {
-		return nil, errors.New("Invalid metric packet, need at least 1 colon")
+		return nil, 0, parseError(ParseErrorSyntax, "Invalid metric packet, need at least 1 colon")
 	}
 	nameChunk := pipeSplitter.Chunk()[:startingColon]
 	valueChunk := pipeSplitter.Chunk()[startingColon+1:]
 	if len(nameChunk) == 0 {
-		return nil, errors.New("Invalid metric packet, name cannot be empty")
+		return nil, 0, parseError(ParseErrorName, "Invalid metric packet, name cannot be empty")
+	}
+	if err := p.checkName(ret, nameChunk); err != nil {
+		return nil, 0, err
 	}
 
 	if !pipeSplitter.Next() {
-		return nil, errors.New("Invalid metric packet, need at least 1 pipe for type")
+		return nil, 0, parseError(ParseErrorSyntax, "Invalid metric packet, need at least 1 pipe for type")
 	}
 	typeChunk := pipeSplitter.Chunk()
 	if len(typeChunk) == 0 {
 		// avoid panicking on malformed packets missing a type
 		// (eg "foo:1||")
-		return nil, errors.New("Invalid metric packet, metric type not specified")
+		return nil, 0, parseError(ParseErrorType, "Invalid metric packet, metric type not specified")
 	}
 
-	h := fnv.New32a()
-	h.Write(nameChunk)
 	ret.Name = string(nameChunk)
 
 	// Decide on a type
@@ -83,43 +173,50 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 	case 's':
 		ret.Type = "set"
 	default:
-		return nil, errors.New("Invalid type for metric")
+		return nil, 0, parseError(ParseErrorType, "Invalid type for metric")
 	}
-	// Add the type to the digest
-	h.Write([]byte(ret.Type))
 
-	// Now convert the metric's value
+	// Now convert the metric's values
+	var values []interface{}
 	if ret.Type == "set" {
-		ret.Value = string(valueChunk)
+		values = append(values, string(valueChunk))
 	} else {
-		v, err := strconv.ParseFloat(string(valueChunk), 64)
-		if err != nil {
-			return nil, fmt.Errorf("Invalid number for metric value: %s", valueChunk)
+		for _, chunk := range bytes.Split(valueChunk, []byte{':'}) {
+			v, err := strconv.ParseFloat(string(chunk), 64)
+			if err != nil {
+				invalid++
+				continue
+			}
+			values = append(values, v)
+		}
+		if len(values) == 0 {
+			return nil, 0, parseError(ParseErrorValue, "Invalid number for metric value: %s", valueChunk)
 		}
-		ret.Value = v
 	}
 
 	// each of these sections can only appear once in the packet
 	foundSampleRate := false
+	foundContainerID := false
+	foundTimestamp := false
 	for pipeSplitter.Next() {
 		if len(pipeSplitter.Chunk()) == 0 {
 			// avoid panicking on malformed packets that have too many pipes
 			// (eg "foo:1|g|" or "foo:1|c||@0.1")
-			return nil, errors.New("Invalid metric packet, empty string after/between pipes")
+			return nil, 0, parseError(ParseErrorSyntax, "Invalid metric packet, empty string after/between pipes")
 		}
 		switch pipeSplitter.Chunk()[0] {
 		case '@':
 			if foundSampleRate {
-				return nil, errors.New("Invalid metric packet, multiple sample rates specified")
+				return nil, 0, parseError(ParseErrorSyntax, "Invalid metric packet, multiple sample rates specified")
 			}
 			// sample rate!
 			sr := string(pipeSplitter.Chunk()[1:])
 			sampleRate, err := strconv.ParseFloat(sr, 32)
 			if err != nil {
-				return nil, fmt.Errorf("Invalid float for sample rate: %s", sr)
+				return nil, 0, parseError(ParseErrorSampleRate, "Invalid float for sample rate: %s", sr)
 			}
 			if sampleRate <= 0 || sampleRate > 1 {
-				return nil, fmt.Errorf("Sample rate %f must be >0 and <=1", sampleRate)
+				return nil, 0, parseError(ParseErrorSampleRate, "Sample rate %f must be >0 and <=1", sampleRate)
 			}
 			ret.SampleRate = float32(sampleRate)
 			foundSampleRate = true
@@ -127,7 +224,7 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 		case '#':
 			// tags!
 			if ret.Tags != nil {
-				return nil, errors.New("Invalid metric packet, multiple tag sections specified")
+				return nil, 0, parseError(ParseErrorSyntax, "Invalid metric packet, multiple tag sections specified")
 			}
 			tags := strings.Split(string(pipeSplitter.Chunk()[1:]), ",")
 			sort.Strings(tags)
@@ -147,19 +244,116 @@ func ParseMetric(packet []byte) (*UDPMetric, error) {
 				}
 			}
 			ret.Tags = tags
-			// we specifically need the sorted version here so that hashing over
-			// tags behaves deterministically
-			ret.JoinedTags = strings.Join(tags, ",")
-			h.Write([]byte(ret.JoinedTags))
+
+		case 'c':
+			if len(pipeSplitter.Chunk()) < 2 || pipeSplitter.Chunk()[1] != ':' {
+				return nil, 0, parseError(ParseErrorSyntax, "Invalid metric packet, contains unknown section %q", pipeSplitter.Chunk())
+			}
+			if foundContainerID {
+				return nil, 0, parseError(ParseErrorSyntax, "Invalid metric packet, multiple container ID sections specified")
+			}
+			// container ID, sent by DogStatsD clients running in containers
+			ret.ContainerID = string(pipeSplitter.Chunk()[2:])
+			foundContainerID = true
+
+		case 'T':
+			if !p.ExplicitTimestamps {
+				// ignored entirely, like any other field we don't use
+				continue
+			}
+			if foundTimestamp {
+				return nil, 0, parseError(ParseErrorSyntax, "Invalid metric packet, multiple timestamps specified")
+			}
+			foundTimestamp = true
+			if ret.Type != "counter" && ret.Type != "gauge" {
+				return nil, 0, parseError(ParseErrorTimestamp, "Invalid metric packet, timestamps are not supported for %ss", ret.Type)
+			}
+			timestamp, err := strconv.ParseInt(string(pipeSplitter.Chunk()[1:]), 10, 64)
+			if err != nil || timestamp <= 0 {
+				// a timestamp we can't make sense of just means the metric
+				// is reported at flush time, like one without a timestamp
+				continue
+			}
+			ret.Timestamp = timestamp
 
 		default:
-			return nil, fmt.Errorf("Invalid metric packet, contains unknown section %q", pipeSplitter.Chunk())
+			if isUnknownField(pipeSplitter.Chunk()) {
+				// newer versions of the protocol keep adding fields of this
+				// form, so skip the ones we don't understand rather than
+				// throwing the whole metric away
+				continue
+			}
+			return nil, 0, parseError(ParseErrorSyntax, "Invalid metric packet, contains unknown section %q", pipeSplitter.Chunk())
 		}
 	}
 
-	ret.Digest = h.Sum32()
+	p.finishTags(ret)
 
-	return ret, nil
+	metrics = make([]*UDPMetric, len(values))
+	for i, v := range values {
+		m := *ret
+		m.Value = v
+		if i > 0 && ret.Tags != nil {
+			// each metric gets its own tags, since workers may change them
+			m.Tags = append([]string(nil), ret.Tags...)
+		}
+		metrics[i] = &m
+	}
+	return metrics, invalid, nil
+}
+
+// checkName checks the metric's name against the Parser's NamePattern,
+// returning a ParseError if it doesn't match and violations aren't tagged.
+func (p Parser) checkName(ret *UDPMetric, name []byte) error {
+	if p.NamePattern != nil && !p.NamePattern.Match(name) {
+		if !p.TagNamingViolations {
+			return parseError(ParseErrorNaming, "Invalid metric packet, name %q does not match %s", name, p.NamePattern)
+		}
+		ret.NamingViolation = true
+	}
+	return nil
+}
+
+// finishTags applies the Parser's tag options to the tags a metric was sent
+// with, which must be sorted, and computes its digest from the result.
+func (p Parser) finishTags(ret *UDPMetric) {
+	if p.StripEntityTags && ret.Tags != nil {
+		kept := ret.Tags[:0]
+		for _, tag := range ret.Tags {
+			if !strings.HasPrefix(tag, entityTagPrefix) {
+				kept = append(kept, tag)
+			}
+		}
+		ret.Tags = kept
+	}
+	if ret.ContainerID != "" && !p.StripEntityTags {
+		ret.Tags = append(ret.Tags, containerIDTag+":"+ret.ContainerID)
+		sort.Strings(ret.Tags)
+	}
+	if len(p.ExtraTags) > 0 {
+		ret.Tags = MergeTags(p.TagPrecedence,
+			SourcedTags{Source: TagSourceClient, Tags: ret.Tags},
+			SourcedTags{Source: TagSourceListener, Tags: p.ExtraTags})
+		sort.Strings(ret.Tags)
+	}
+	if p.MaxTags > 0 && len(ret.Tags) > p.MaxTags {
+		ret.TruncatedTags = len(ret.Tags) - p.MaxTags
+		ret.Tags = ret.Tags[:p.MaxTags]
+	}
+	if ret.NamingViolation {
+		ret.Tags = append(ret.Tags, NamingViolationTag)
+		sort.Strings(ret.Tags)
+	}
+	ret.setDigest()
+}
+
+// isUnknownField reports whether a packet section looks like a DogStatsD
+// field (a single letter followed by a colon) that we don't recognize.
+func isUnknownField(chunk []byte) bool {
+	if len(chunk) < 2 || chunk[1] != ':' {
+		return false
+	}
+	return (chunk[0] >= 'a' && chunk[0] <= 'z') || (chunk[0] >= 'A' && chunk[0] <= 'Z')
 }
 
 // UDPEvent represents the structure of datadog's undocumented /intake endpoint
@@ -408,3 +602,134 @@ func ParseServiceCheck(packet []byte) (*UDPServiceCheck, error) {
 
 	return ret, nil
 }
+
+// ParseSSFDuration converts an SSF sample reporting the duration of a span
+// (a HISTOGRAM sample with its Trace set, as emitted by a trace.Tracer with
+// DurationMetrics enabled) into a metric. A Unit of "ms" makes it a timer in
+// milliseconds, and anything else a histogram in nanoseconds.
+func ParseSSFDuration(sample *ssf.SSFSample) (*UDPMetric, error) {
+	return Parser{}.ParseSSFDuration(sample)
+}
+
+// ParseSSFDuration converts an SSF sample reporting the duration of a span
+// into a metric, like its package-level counterpart, and applies the
+// Parser's options to its name and tags as it would to a packet's.
+func (p Parser) ParseSSFDuration(sample *ssf.SSFSample) (*UDPMetric, error) {
+	if sample.Metric != ssf.SSFSample_HISTOGRAM || sample.Trace == nil {
+		return nil, errors.New("SSF sample is not a span duration")
+	}
+	if sample.Name == "" {
+		return nil, parseError(ParseErrorName, "SSF sample has no name")
+	}
+
+	ret := &UDPMetric{
+		MetricKey: MetricKey{
+			Name: sample.Name,
+			Type: "histogram",
+		},
+		Value:      float64(sample.Trace.Duration),
+		SampleRate: 1.0,
+	}
+	if sample.Unit == "ms" {
+		ret.Type = "timer"
+		ret.Value = float64(sample.Trace.Duration) / float64(time.Millisecond)
+	}
+	if err := p.finishSSF(ret, sample); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// ParseSSFMetric converts an SSF sample that is a metric, rather than a span,
+// into one: a COUNTER, GAUGE or HISTOGRAM of its Value (a timer in
+// milliseconds if its Unit is "ms"), or a SET with its Message as the member.
+func ParseSSFMetric(sample *ssf.SSFSample) (*UDPMetric, error) {
+	return Parser{}.ParseSSFMetric(sample)
+}
+
+// ParseSSFMetric converts an SSF sample that is a metric into one, like its
+// package-level counterpart, and applies the Parser's options to its name
+// and tags as it would to a packet's.
+func (p Parser) ParseSSFMetric(sample *ssf.SSFSample) (*UDPMetric, error) {
+	if sample.Name == "" {
+		return nil, parseError(ParseErrorName, "SSF sample has no name")
+	}
+	ret := &UDPMetric{
+		MetricKey:  MetricKey{Name: sample.Name},
+		Value:      float64(sample.Value),
+		SampleRate: 1.0,
+	}
+	switch sample.Metric {
+	case ssf.SSFSample_COUNTER:
+		ret.Type = "counter"
+	case ssf.SSFSample_GAUGE:
+		ret.Type = "gauge"
+	case ssf.SSFSample_HISTOGRAM:
+		ret.Type = "histogram"
+		if sample.Unit == "ms" {
+			ret.Type = "timer"
+		}
+	case ssf.SSFSample_SET:
+		ret.Type = "set"
+		ret.Value = sample.Message
+	default:
+		return nil, parseError(ParseErrorType, "SSF sample of type %s is not a metric", sample.Metric)
+	}
+	if err := p.finishSSF(ret, sample); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// finishSSF gives a metric converted from an SSF sample the sample's rate and
+// tags, and applies the Parser's options to them.
+func (p Parser) finishSSF(ret *UDPMetric, sample *ssf.SSFSample) error {
+	if sample.SampleRate > 0 && sample.SampleRate <= 1 {
+		ret.SampleRate = sample.SampleRate
+	}
+
+	for _, tag := range sample.Tags {
+		if tag.Value == "" {
+			ret.Tags = append(ret.Tags, tag.Name)
+		} else {
+			ret.Tags = append(ret.Tags, tag.Name+":"+tag.Value)
+		}
+	}
+
+	if err := p.checkName(ret, []byte(ret.Name)); err != nil {
+		return err
+	}
+	sort.Strings(ret.Tags)
+	p.finishTags(ret)
+	return nil
+}
+
+// NewUDPMetric creates a metric that didn't come from a packet, as if it had
+// been parsed from one with the given name, type, value, sample rate and tags.
+func NewUDPMetric(name, metricType string, value float64, sampleRate float32, tags []string) *UDPMetric {
+	ret := &UDPMetric{
+		MetricKey: MetricKey{
+			Name: name,
+			Type: metricType,
+		},
+		Value:      value,
+		SampleRate: sampleRate,
+		Tags:       tags,
+	}
+	ret.setDigest()
+	return ret
+}
+
+// setDigest sorts the metric's tags into its key, and hashes the key into its
+// digest, which picks the worker it's aggregated by.
+func (m *UDPMetric) setDigest() {
+	h := fnv.New32a()
+	h.Write([]byte(m.Name))
+	h.Write([]byte(m.Type))
+	if m.Tags != nil {
+		sort.Strings(m.Tags)
+		m.JoinedTags = strings.Join(m.Tags, ",")
+		h.Write([]byte(m.JoinedTags))
+	}
+	m.Digest = h.Sum32()
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"hash/fnv"
 	"math"
+	"sort"
+	"strconv"
 	"strings"
 	"time"
 
@@ -23,6 +25,10 @@ type DDMetric struct {
 	Hostname   string        `json:"host,omitempty"`
 	DeviceName string        `json:"device_name,omitempty"`
 	Interval   int32         `json:"interval,omitempty"`
+	// Distribution is only set on histograms and timers flushed as one
+	// "distribution" metric, by FlushDistribution, and is the sketch of
+	// their observations. Those metrics only go to sinks that take them.
+	Distribution []tdigest.Centroid `json:"-"`
 }
 
 type Aggregate int
@@ -48,6 +54,13 @@ var AggregatesLookup = map[string]Aggregate{
 type HistogramAggregates struct {
 	Value Aggregate
 	Count int
+
+	// If CountSuffix is set, the number of observations received locally
+	// is also flushed as a count (rather than a rate, like the count
+	// aggregate), named <name>.<CountSuffix>, so that it sums correctly
+	// when a downstream rolls it up over longer windows. It is counted in
+	// Count.
+	CountSuffix string
 }
 
 var aggregates = [...]string{
@@ -69,16 +82,35 @@ type JSONMetric struct {
 	Value []byte `json:"value"`
 }
 
+// flushTimestamp returns the time a metric is reported at: its explicit
+// timestamp if it has one, and now otherwise.
+func flushTimestamp(explicit int64) float64 {
+	if explicit != 0 {
+		return float64(explicit)
+	}
+	return float64(time.Now().Unix())
+}
+
 // Counter is an accumulator
 type Counter struct {
-	Name  string
-	Tags  []string
-	value int64
+	Name string
+	Tags []string
+	// if Timestamp is set, the counter is reported at this unix epoch
+	// rather than at flush time
+	Timestamp int64
+	// accumulated unrounded, so that fractional samples (like scaled or
+	// sampled ones) add up, and rounded once when flushed or exported
+	value float64
 }
 
 // Sample adds a sample to the counter.
 func (c *Counter) Sample(sample float64, sampleRate float32) {
-	c.value += int64(sample) * int64(1/sampleRate)
+	c.value += sample / float64(sampleRate)
+}
+
+// count is the counter's total, rounded to a whole number.
+func (c *Counter) count() int64 {
+	return int64(math.Round(c.value))
 }
 
 // Flush generates a DDMetric from the current state of this Counter.
@@ -87,18 +119,33 @@ func (c *Counter) Flush(interval time.Duration) []DDMetric {
 	copy(tags, c.Tags)
 	return []DDMetric{{
 		Name:       c.Name,
-		Value:      [1][2]float64{{float64(time.Now().Unix()), float64(c.value) / interval.Seconds()}},
+		Value:      [1][2]float64{{flushTimestamp(c.Timestamp), float64(c.count()) / interval.Seconds()}},
 		Tags:       tags,
 		MetricType: "rate",
 		Interval:   int32(interval.Seconds()),
 	}}
 }
 
+// FlushCount generates a DDMetric from the current state of this Counter,
+// reporting the total accumulated over the interval instead of a per-second
+// rate. This is for destinations that prefer to do their own rating.
+func (c *Counter) FlushCount(interval time.Duration) []DDMetric {
+	tags := make([]string, len(c.Tags))
+	copy(tags, c.Tags)
+	return []DDMetric{{
+		Name:       c.Name,
+		Value:      [1][2]float64{{flushTimestamp(c.Timestamp), float64(c.count())}},
+		Tags:       tags,
+		MetricType: "count",
+		Interval:   int32(interval.Seconds()),
+	}}
+}
+
 // Export converts a Counter into a JSONMetric which reports the rate.
 func (c *Counter) Export() (JSONMetric, error) {
 	buf := new(bytes.Buffer)
 
-	err := binary.Write(buf, binary.LittleEndian, c.value)
+	err := binary.Write(buf, binary.LittleEndian, c.count())
 	if err != nil {
 		return JSONMetric{}, err
 	}
@@ -108,6 +155,7 @@ func (c *Counter) Export() (JSONMetric, error) {
 			Name:       c.Name,
 			Type:       "counter",
 			JoinedTags: strings.Join(c.Tags, ","),
+			Timestamp:  c.Timestamp,
 		},
 		Tags:  c.Tags,
 		Value: buf.Bytes(),
@@ -124,11 +172,19 @@ func (c *Counter) Combine(other []byte) error {
 		return err
 	}
 
-	c.value += otherCounts
+	c.value += float64(otherCounts)
 
 	return nil
 }
 
+// Merge adds the value of another counter in memory, as if its samples had
+// been reported to this one. Unlike Combine, the value isn't rounded first,
+// so counters merged from many short intervals add up to what one counter
+// over all of them would have.
+func (c *Counter) Merge(other *Counter) {
+	c.value += other.value
+}
+
 // NewCounter generates and returns a new Counter.
 func NewCounter(Name string, Tags []string) *Counter {
 	return &Counter{Name: Name, Tags: Tags}
@@ -136,14 +192,62 @@ func NewCounter(Name string, Tags []string) *Counter {
 
 // Gauge retains whatever the last value was.
 type Gauge struct {
-	Name  string
-	Tags  []string
-	value float64
+	Name string
+	Tags []string
+	// if Timestamp is set, the gauge is reported at this unix epoch rather
+	// than at flush time
+	Timestamp int64
+	// how the values reported within an interval are reduced to the one
+	// that is flushed
+	Aggregation GaugeAggregation
+	value       float64
+	sum         float64
+	count       int64
 }
 
-// Sample takes on whatever value is passed in as a sample.
+// GaugeAggregation selects how a gauge reduces the values reported for it
+// within an interval.
+type GaugeAggregation int
+
+const (
+	// GaugeLast keeps the last value reported, which is the default.
+	GaugeLast GaugeAggregation = iota
+	// GaugeMax keeps the largest value reported.
+	GaugeMax
+	// GaugeMin keeps the smallest value reported.
+	GaugeMin
+	// GaugeMean reports the mean of the values reported.
+	GaugeMean
+)
+
+// GaugeAggregationsLookup maps the names used in gauge_aggregations to
+// aggregations.
+var GaugeAggregationsLookup = map[string]GaugeAggregation{
+	"last": GaugeLast,
+	"max":  GaugeMax,
+	"min":  GaugeMin,
+	"mean": GaugeMean,
+}
+
+// Sample reduces a reported value into the gauge, according to its
+// Aggregation. By default, the gauge takes on whatever value is passed in.
 func (g *Gauge) Sample(sample float64, sampleRate float32) {
-	g.value = sample
+	switch g.Aggregation {
+	case GaugeMax:
+		if g.count == 0 || sample > g.value {
+			g.value = sample
+		}
+	case GaugeMin:
+		if g.count == 0 || sample < g.value {
+			g.value = sample
+		}
+	case GaugeMean:
+		g.sum += sample
+		g.value = g.sum / float64(g.count+1)
+	default:
+		g.value = sample
+	}
+	g.count++
 }
 
 // Flush generates a DDMetric from the current state of this gauge.
@@ -152,12 +256,74 @@ func (g *Gauge) Flush() []DDMetric {
 	copy(tags, g.Tags)
 	return []DDMetric{{
 		Name:       g.Name,
-		Value:      [1][2]float64{{float64(time.Now().Unix()), float64(g.value)}},
+		Value:      [1][2]float64{{flushTimestamp(g.Timestamp), float64(g.value)}},
 		Tags:       tags,
 		MetricType: "gauge",
 	}}
 }
 
+// Export converts a Gauge into a JSONMetric, for forwarding the raw value to
+// a global veneur.
+func (g *Gauge) Export() (JSONMetric, error) {
+	buf := new(bytes.Buffer)
+
+	err := binary.Write(buf, binary.LittleEndian, g.value)
+	if err != nil {
+		return JSONMetric{}, err
+	}
+
+	return JSONMetric{
+		MetricKey: MetricKey{
+			Name:       g.Name,
+			Type:       "gauge",
+			JoinedTags: strings.Join(g.Tags, ","),
+			Timestamp:  g.Timestamp,
+		},
+		Tags:  g.Tags,
+		Value: buf.Bytes(),
+	}, nil
+}
+
+// Combine reduces the value of another gauge (marshalled as a byte slice)
+// into this one as if it had been reported here, so by default the last
+// value wins. For GaugeMean, this is the mean of the gauges' means, not
+// weighted by how many values each of them had.
+func (g *Gauge) Combine(other []byte) error {
+	var otherValue float64
+	buf := bytes.NewReader(other)
+	if err := binary.Read(buf, binary.LittleEndian, &otherValue); err != nil {
+		return err
+	}
+	g.Sample(otherValue, 1.0)
+	return nil
+}
+
+// Merge reduces another gauge, which was reported to over a later interval,
+// into this one, as if its values had been reported here. For GaugeMean the
+// result is weighted by how many values each had, unlike Combine. A gauge
+// that was never reported to leaves this one as it is.
+func (g *Gauge) Merge(other *Gauge) {
+	if other.count == 0 {
+		return
+	}
+	switch g.Aggregation {
+	case GaugeMax:
+		if g.count == 0 || other.value > g.value {
+			g.value = other.value
+		}
+	case GaugeMin:
+		if g.count == 0 || other.value < g.value {
+			g.value = other.value
+		}
+	case GaugeMean:
+		g.sum += other.sum
+		g.value = g.sum / float64(g.count+other.count)
+	default:
+		g.value = other.value
+	}
+	g.count += other.count
+}
+
 // NewGauge genearaaaa who am I kidding just getting rid of the warning.
 func NewGauge(Name string, Tags []string) *Gauge {
 	return &Gauge{Name: Name, Tags: Tags}
@@ -234,6 +400,11 @@ func (s *Set) Combine(other []byte) error {
 	return nil
 }
 
+// Merge adds the values seen by another set in memory.
+func (s *Set) Merge(other *Set) error {
+	return s.Hll.Merge(other.Hll)
+}
+
 // Histo is a collection of values that generates max, min, count, and
 // percentiles over time.
 type Histo struct {
@@ -249,6 +420,12 @@ type Histo struct {
 	LocalMin    float64
 	LocalMax    float64
 	LocalSum    float64
+
+	// if Buckets is set, local samples are also counted into explicit
+	// buckets with these (ascending) upper bounds, plus an implicit +Inf
+	// bucket that is the last element of BucketWeights
+	Buckets       []float64
+	BucketWeights []float64
 }
 
 // Sample adds the supplied value to the histogram.
@@ -260,15 +437,57 @@ func (h *Histo) Sample(sample float64, sampleRate float32) {
 	h.LocalMin = math.Min(h.LocalMin, sample)
 	h.LocalMax = math.Max(h.LocalMax, sample)
 	h.LocalSum += sample * weight
+
+	if h.Buckets != nil {
+		// a sample equal to an upper bound belongs in that bucket
+		h.BucketWeights[sort.SearchFloat64s(h.Buckets, sample)] += weight
+	}
+}
+
+// SetBuckets makes the Histo count its local samples into explicit buckets
+// with the given upper bounds, which must pass CheckBuckets.
+func (h *Histo) SetBuckets(bounds []float64) {
+	h.Buckets = bounds
+	h.BucketWeights = make([]float64, len(bounds)+1)
 }
 
+// SetCompression gives the Histo a t-digest with the given compression. A
+// higher compression keeps more centroids, about 1.6 per unit of compression
+// (at 16 bytes each), in exchange for more accurate percentiles. It must be
+// called before any samples are added, since they would be discarded.
+func (h *Histo) SetCompression(compression float64) {
+	h.Value = tdigest.NewMerging(compression, false)
+}
+
+// CheckBuckets returns an error unless bounds are suitable explicit bucket
+// upper bounds: finite and strictly ascending. The +Inf bucket is implicit
+// and should not be included.
+func CheckBuckets(bounds []float64) error {
+	if len(bounds) == 0 {
+		return fmt.Errorf("no bucket bounds")
+	}
+	for i, b := range bounds {
+		if math.IsNaN(b) || math.IsInf(b, 0) {
+			return fmt.Errorf("bucket bound %v is not finite", b)
+		}
+		if i > 0 && b <= bounds[i-1] {
+			return fmt.Errorf("bucket bounds are not strictly ascending: %v follows %v", b, bounds[i-1])
+		}
+	}
+	return nil
+}
+
+// DefaultHistogramCompression is the compression of the t-digests that
+// histograms and timers are estimated with, unless SetCompression changes it.
+// We're going to allocate a lot of these, so we don't want them to be huge.
+const DefaultHistogramCompression = 100
+
 // NewHist generates a new Histo and returns it.
 func NewHist(Name string, Tags []string) *Histo {
 	return &Histo{
-		Name: Name,
-		Tags: Tags,
-		// we're going to allocate a lot of these, so we don't want them to be huge
-		Value:    tdigest.NewMerging(100, false),
+		Name:     Name,
+		Tags:     Tags,
+		Value:    tdigest.NewMerging(DefaultHistogramCompression, false),
 		LocalMin: math.Inf(+1),
 		LocalMax: math.Inf(-1),
 		LocalSum: 0,
@@ -344,6 +563,18 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 		})
 	}
 
+	if aggregates.CountSuffix != "" && h.LocalWeight != 0 {
+		tags := make([]string, len(h.Tags))
+		copy(tags, h.Tags)
+		metrics = append(metrics, DDMetric{
+			Name:       fmt.Sprintf("%s.%s", h.Name, aggregates.CountSuffix),
+			Value:      [1][2]float64{{now, h.LocalWeight}},
+			Tags:       tags,
+			MetricType: "count",
+			Interval:   int32(interval.Seconds()),
+		})
+	}
+
 	if (aggregates.Value & AggregateMedian) == AggregateMedian {
 		tags := make([]string, len(h.Tags))
 		copy(tags, h.Tags)
@@ -373,9 +604,94 @@ func (h *Histo) Flush(interval time.Duration, percentiles []float64, aggregates
 		)
 	}
 
+	if h.Buckets != nil && h.LocalWeight != 0 {
+		metrics = append(metrics, h.flushBuckets(now, interval)...)
+	}
+
+	return metrics
+}
+
+// flushBuckets generates the explicit bucket series for the local samples,
+// in the same shape as a Prometheus histogram: a cumulative "_bucket" count
+// for each upper bound (tagged "le:<bound>", ending with "le:+Inf"), plus
+// "_sum" and "_count". All of them are counts over the interval.
+func (h *Histo) flushBuckets(now float64, interval time.Duration) []DDMetric {
+	metrics := make([]DDMetric, 0, len(h.BucketWeights)+2)
+	count := func(name string, value float64, extraTag string) DDMetric {
+		tags := make([]string, len(h.Tags), len(h.Tags)+1)
+		copy(tags, h.Tags)
+		if extraTag != "" {
+			tags = append(tags, extraTag)
+		}
+		return DDMetric{
+			Name:       name,
+			Value:      [1][2]float64{{now, value}},
+			Tags:       tags,
+			MetricType: "count",
+			Interval:   int32(interval.Seconds()),
+		}
+	}
+
+	cumulative := 0.0
+	for i, weight := range h.BucketWeights {
+		cumulative += weight
+		le := "+Inf"
+		if i < len(h.Buckets) {
+			le = strconv.FormatFloat(h.Buckets[i], 'g', -1, 64)
+		}
+		metrics = append(metrics, count(h.Name+"_bucket", cumulative, "le:"+le))
+	}
+	metrics = append(metrics, count(h.Name+"_sum", h.LocalSum, ""))
+	metrics = append(metrics, count(h.Name+"_count", h.LocalWeight, ""))
 	return metrics
 }
 
+// FlushDistribution flushes the Histo as one "distribution" metric, whose
+// Distribution is the centroids of its t-digest and whose value is how many
+// observations it has, merged ones included. Unlike percentiles, which can't
+// be combined, a sink can re-aggregate distributions across hosts. An empty
+// Histo has no distribution to flush.
+func (h *Histo) FlushDistribution() []DDMetric {
+	if h.Value.Count() == 0 {
+		return nil
+	}
+	tags := make([]string, len(h.Tags))
+	copy(tags, h.Tags)
+	return []DDMetric{{
+		Name:         h.Name,
+		Value:        [1][2]float64{{float64(time.Now().Unix()), h.Value.Count()}},
+		Tags:         tags,
+		MetricType:   "distribution",
+		Distribution: h.Value.Sketch(),
+	}}
+}
+
+// Merge adds another histogram's observations in memory, local ones
+// included, as if they had been sampled by this one. If both have explicit
+// buckets, they must have the same bounds.
+func (h *Histo) Merge(other *Histo) {
+	h.Value.Merge(other.Value)
+	h.LocalWeight += other.LocalWeight
+	h.LocalMin = math.Min(h.LocalMin, other.LocalMin)
+	h.LocalMax = math.Max(h.LocalMax, other.LocalMax)
+	h.LocalSum += other.LocalSum
+	if other.Buckets == nil {
+		return
+	}
+	if h.Buckets == nil {
+		h.SetBuckets(other.Buckets)
+	}
+	for i, weight := range other.BucketWeights {
+		h.BucketWeights[i] += weight
+	}
+}
+
+// Empty reports whether the Histo has received no observations, either
+// locally or by importing them from another instance.
+func (h *Histo) Empty() bool {
+	return h.LocalWeight == 0 && h.Value.Count() == 0
+}
+
 // Export converts a Histogram into a JSONMetric
 func (h *Histo) Export() (JSONMetric, error) {
 	val, err := h.Value.GobEncode()
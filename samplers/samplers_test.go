@@ -53,6 +53,26 @@ func TestCounterSampleRate(t *testing.T) {
 	assert.Equal(t, float64(1), metrics[0].Value[0][1], "Metric value")
 }
 
+func TestCounterMonotonicRate(t *testing.T) {
+	c := NewCounter("a.b.c", []string{"a:b"})
+	for i := 0; i < 6; i++ {
+		c.Sample(100, 1.0)
+	}
+
+	// summing to 600 over a minute is 10 per second
+	metrics := c.Flush(60 * time.Second)
+	assert.Len(t, metrics, 1, "Flushes 1 metric")
+	assert.Equal(t, "rate", metrics[0].MetricType, "Type")
+	assert.Equal(t, float64(10), metrics[0].Value[0][1], "Metric value")
+	assert.Equal(t, int32(60), metrics[0].Interval, "Interval")
+
+	metrics = c.FlushCount(60 * time.Second)
+	assert.Len(t, metrics, 1, "Flushes 1 metric")
+	assert.Equal(t, "count", metrics[0].MetricType, "Type")
+	assert.Equal(t, float64(600), metrics[0].Value[0][1], "Metric value")
+	assert.Equal(t, int32(60), metrics[0].Interval, "Interval")
+}
+
 func TestCounterMerge(t *testing.T) {
 	c := NewCounter("a.b.c", []string{"tag:val"})
 
@@ -104,6 +124,37 @@ func TestGauge(t *testing.T) {
 	assert.Equal(t, float64(5), m1.Value[0][1], "Value")
 }
 
+func TestGaugeAggregations(t *testing.T) {
+	reports := []float64{3, 7, -1, 5}
+	for name, expected := range map[string]float64{
+		"last": 5,
+		"max":  7,
+		"min":  -1,
+		"mean": 3.5,
+	} {
+		g := NewGauge("a.b.c", nil)
+		g.Aggregation = GaugeAggregationsLookup[name]
+		for _, v := range reports {
+			g.Sample(v, 1.0)
+		}
+		assert.Equal(t, expected, g.Flush()[0].Value[0][1], name)
+
+		// importing a gauge treats its value as another report
+		other := NewGauge("a.b.c", nil)
+		other.Sample(10, 1.0)
+		jm, err := other.Export()
+		assert.NoError(t, err)
+		assert.NoError(t, g.Combine(jm.Value))
+		if name == "min" {
+			assert.Equal(t, float64(-1), g.Flush()[0].Value[0][1], name)
+		} else if name == "mean" {
+			assert.Equal(t, float64(4.8), g.Flush()[0].Value[0][1], name)
+		} else {
+			assert.Equal(t, float64(10), g.Flush()[0].Value[0][1], name)
+		}
+	}
+}
+
 func TestSet(t *testing.T) {
 	s := NewSet("a.b.c", []string{"a:b"})
 
@@ -154,6 +205,28 @@ func TestSetMerge(t *testing.T) {
 	assert.True(t, -1 <= countDifference && countDifference <= 1, "counts did not match after merging (%d and %d)", count1, count2)
 }
 
+func TestHistoFlushDistribution(t *testing.T) {
+	h := NewHist("a.b.c", []string{"a:b"})
+	assert.Empty(t, h.FlushDistribution(), "an empty histogram has no distribution")
+
+	for _, v := range []float64{1, 2, 7, 8, 100} {
+		h.Sample(v, 0.5)
+	}
+	metrics := h.FlushDistribution()
+	if assert.Len(t, metrics, 1) {
+		m := metrics[0]
+		assert.Equal(t, "a.b.c", m.Name)
+		assert.Equal(t, "distribution", m.MetricType)
+		assert.Equal(t, []string{"a:b"}, m.Tags)
+		assert.Equal(t, float64(10), m.Value[0][1], "the value is the weight of every observation")
+		var weight float64
+		for _, c := range m.Distribution {
+			weight += c.Weight
+		}
+		assert.Equal(t, float64(10), weight)
+	}
+}
+
 func TestHisto(t *testing.T) {
 
 	h := NewHist("a.b.c", []string{"a:b"})
@@ -283,6 +356,86 @@ func TestHistoSampleRate(t *testing.T) {
 	assert.Equal(t, float64(1), count.Value[0][1], "count value")
 }
 
+func TestHistoCountSuffix(t *testing.T) {
+	h := NewHist("a.b.c", []string{"a:b"})
+	for i := 0; i < 5; i++ {
+		h.Sample(float64(i), 1)
+	}
+	h.Sample(10, 0.5)
+
+	aggregates := HistogramAggregates{Value: AggregateCount, Count: 2, CountSuffix: "observations"}
+	metrics := h.Flush(10*time.Second, nil, aggregates)
+	if assert.Len(t, metrics, 2) {
+		assert.Equal(t, "a.b.c.count", metrics[0].Name)
+		assert.Equal(t, "rate", metrics[0].MetricType)
+		assert.Equal(t, DDMetric{
+			Name:       "a.b.c.observations",
+			Value:      [1][2]float64{{metrics[1].Value[0][0], 7}},
+			Tags:       []string{"a:b"},
+			MetricType: "count",
+			Interval:   10,
+		}, metrics[1], "the count should be counter-typed, and count each observation once per its sample rate")
+	}
+
+	empty := NewHist("a.b.c", nil)
+	assert.Empty(t, empty.Flush(10*time.Second, nil, aggregates), "nothing should be flushed without observations")
+}
+
+func TestHistoBuckets(t *testing.T) {
+	h := NewHist("a.b.c", []string{"a:b"})
+	h.SetBuckets([]float64{1, 5, 10})
+
+	// 0.5 and 1 are <= 1, 3 and 5 are <= 5, nothing is in (5, 10], and 11
+	// and 100 only fall in +Inf
+	for _, v := range []float64{0.5, 1, 3, 5, 11, 100} {
+		h.Sample(v, 1)
+	}
+	// a sample rate of 0.5 counts twice
+	h.Sample(7, 0.5)
+
+	metrics := h.Flush(10*time.Second, []float64{0.5}, HistogramAggregates{Value: AggregateCount, Count: 1})
+	// count and percentile still come first
+	assert.Equal(t, "a.b.c.count", metrics[0].Name)
+	assert.Equal(t, "a.b.c.50percentile", metrics[1].Name)
+
+	buckets := metrics[2:]
+	if !assert.Len(t, buckets, 6) {
+		return
+	}
+	expected := []struct {
+		le    string
+		count float64
+	}{{"1", 2}, {"5", 4}, {"10", 6}, {"+Inf", 8}}
+	for i, e := range expected {
+		assert.Equal(t, "a.b.c_bucket", buckets[i].Name)
+		assert.Equal(t, []string{"a:b", "le:" + e.le}, buckets[i].Tags)
+		assert.Equal(t, e.count, buckets[i].Value[0][1], "cumulative count for le:%s", e.le)
+		assert.Equal(t, "count", buckets[i].MetricType)
+		assert.Equal(t, int32(10), buckets[i].Interval)
+	}
+	assert.Equal(t, "a.b.c_sum", buckets[4].Name)
+	assert.Equal(t, []string{"a:b"}, buckets[4].Tags)
+	assert.Equal(t, 134.5, buckets[4].Value[0][1])
+	assert.Equal(t, "a.b.c_count", buckets[5].Name)
+	assert.Equal(t, float64(8), buckets[5].Value[0][1])
+	assert.Equal(t, []string{"a:b"}, h.Tags, "buckets must not alias the histogram's tags")
+
+	// a histogram with no local samples (eg one that was only imported)
+	// has no buckets to report
+	empty := NewHist("a.b.c", nil)
+	empty.SetBuckets([]float64{1})
+	assert.Len(t, empty.Flush(10*time.Second, nil, HistogramAggregates{}), 0)
+}
+
+func TestCheckBuckets(t *testing.T) {
+	assert.NoError(t, CheckBuckets([]float64{-1, 0, 0.5, 10}))
+	assert.Error(t, CheckBuckets(nil))
+	assert.Error(t, CheckBuckets([]float64{1, 1}), "bounds must be strictly ascending")
+	assert.Error(t, CheckBuckets([]float64{2, 1}))
+	assert.Error(t, CheckBuckets([]float64{1, math.Inf(1)}), "+Inf is implicit")
+	assert.Error(t, CheckBuckets([]float64{math.NaN()}))
+}
+
 func TestHistoMerge(t *testing.T) {
 	rand.Seed(time.Now().Unix())
 
@@ -306,3 +459,101 @@ func TestHistoMerge(t *testing.T) {
 	assert.InDelta(t, 1.0, h2.LocalMin, 0.02, "merged histogram should have min of 1 after adding a value")
 	assert.InDelta(t, 1.0, h2.LocalMax, 0.02, "merged histogram should have max of 1 after adding a value")
 }
+
+// TestMergeWindows checks that merging samplers from consecutive intervals
+// in memory gives what one sampler over all of them would have.
+func TestMergeWindows(t *testing.T) {
+	whole := NewCounter("a.b.c", nil)
+	rollup := NewCounter("a.b.c", nil)
+	for i := 0; i < 6; i++ {
+		window := NewCounter("a.b.c", nil)
+		// fractional samples only add up to whole counts across windows
+		window.Sample(1, 0.3)
+		whole.Sample(1, 0.3)
+		rollup.Merge(window)
+	}
+	assert.Equal(t, whole.Flush(time.Minute), rollup.Flush(time.Minute), "counters shouldn't be rounded each window")
+
+	for name, expected := range map[string]float64{"last": 5, "max": 7, "min": -1, "mean": 22.0 / 6} {
+		rollup := NewGauge("a.b.c", nil)
+		rollup.Aggregation = GaugeAggregationsLookup[name]
+		for _, reports := range [][]float64{{3, 7}, nil, {-1, 5, 3}, {5}} {
+			window := NewGauge("a.b.c", nil)
+			window.Aggregation = rollup.Aggregation
+			for _, v := range reports {
+				window.Sample(v, 1.0)
+			}
+			rollup.Merge(window)
+		}
+		assert.InDelta(t, expected, rollup.Flush()[0].Value[0][1], 1e-9, "%s: means should be weighted by how many values each window had", name)
+	}
+
+	set := NewSet("a.b.c", nil)
+	everywhere := strconv.Itoa(rand.Int())
+	for i := 0; i < 3; i++ {
+		window := NewSet("a.b.c", nil)
+		window.Sample(everywhere, 1.0)
+		window.Sample(strconv.Itoa(rand.Int()), 1.0)
+		assert.NoError(t, set.Merge(window))
+	}
+	assert.Equal(t, uint64(4), set.Hll.Count(), "values seen in more than one window count once")
+
+	bounds := []float64{1, 5}
+	wholeHisto := NewHist("a.b.c", nil)
+	wholeHisto.SetBuckets(bounds)
+	rollupHisto := NewHist("a.b.c", nil)
+	for _, values := range [][]float64{{0.5, 3}, {}, {9, 2, 4}} {
+		window := NewHist("a.b.c", nil)
+		window.SetBuckets(bounds)
+		for _, v := range values {
+			window.Sample(v, 0.5)
+			wholeHisto.Sample(v, 0.5)
+		}
+		rollupHisto.Merge(window)
+	}
+	aggregates := HistogramAggregates{Value: AggregateMin | AggregateMax | AggregateCount | AggregateSum, Count: 4}
+	assert.Equal(t, wholeHisto.Flush(time.Minute, []float64{0.5}, aggregates), rollupHisto.Flush(time.Minute, []float64{0.5}, aggregates))
+	assert.Equal(t, wholeHisto.BucketWeights, rollupHisto.BucketWeights)
+}
+
+func TestMergeTags(t *testing.T) {
+	client := SourcedTags{Source: TagSourceClient, Tags: []string{"env:staging", "role:a", "role:b", "flag"}}
+	listener := SourcedTags{Source: TagSourceListener, Tags: []string{"transport:udp", "role:listener"}}
+	host := SourcedTags{Source: TagSourceHost, Tags: []string{"env:prod", "flag:off", "dc:east", "transport:none"}}
+
+	assert.Equal(t, []string{
+		"env:staging", "role:a", "role:b", "flag",
+		"transport:udp",
+		"dc:east",
+	}, MergeTags(nil, client, listener, host), "by default clients beat listeners, which beat hosts")
+
+	reversed := TagPrecedence{TagSourceHost, TagSourceListener, TagSourceClient}
+	assert.Equal(t, []string{
+		"role:listener",
+		"env:prod", "flag:off", "dc:east", "transport:none",
+	}, MergeTags(reversed, client, listener, host))
+
+	assert.Equal(t, []string{"env:staging", "role:a", "role:b", "flag", "dc:east", "transport:none"},
+		MergeTags(DefaultTagPrecedence, client, host), "an absent source shouldn't matter")
+	assert.Equal(t, []string{"a:1", "a:2"}, MergeTags(nil, SourcedTags{Source: TagSourceHost, Tags: []string{"a:1", "a:2"}}), "a source's own duplicate keys are kept")
+	assert.Empty(t, MergeTags(nil))
+}
+
+func TestParseTagPrecedence(t *testing.T) {
+	p, err := ParseTagPrecedence(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, DefaultTagPrecedence, p)
+
+	p, err = ParseTagPrecedence([]string{"host", "client", "listener"})
+	assert.NoError(t, err)
+	assert.Equal(t, TagPrecedence{TagSourceHost, TagSourceClient, TagSourceListener}, p)
+
+	for _, bad := range [][]string{
+		{"host", "client"},
+		{"host", "client", "client"},
+		{"host", "client", "rollup"},
+	} {
+		_, err = ParseTagPrecedence(bad)
+		assert.Error(t, err, "%v", bad)
+	}
+}
@@ -54,3 +54,8 @@ func (sb *SplitBytes) Next() bool {
 func (sb *SplitBytes) Chunk() []byte {
 	return sb.currentChunk
 }
+
+// Last reports whether the current chunk is the last one in the buffer.
+func (sb *SplitBytes) Last() bool {
+	return sb.lastChunk
+}
@@ -0,0 +1,122 @@
+package samplers
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TagSource is where one of a metric's tags came from, for deciding which
+// tag wins when more than one source sets the same key.
+type TagSource string
+
+const (
+	// TagSourceClient tags were sent along with the metric.
+	TagSourceClient TagSource = "client"
+	// TagSourceListener tags were added by the listener that received the
+	// metric, like the transport tag.
+	TagSourceListener TagSource = "listener"
+	// TagSourceHost tags were configured for the whole veneur, with the
+	// tags or hostname_tag options.
+	TagSourceHost TagSource = "host"
+)
+
+// TagPrecedence ranks the sources of tags, highest first. A nil
+// TagPrecedence is DefaultTagPrecedence.
+type TagPrecedence []TagSource
+
+// DefaultTagPrecedence lets clients override the tags veneur adds, and
+// listeners override the ones configured for the whole veneur.
+var DefaultTagPrecedence = TagPrecedence{TagSourceClient, TagSourceListener, TagSourceHost}
+
+// ParseTagPrecedence validates a ranking of tag sources by name, which must
+// list every source exactly once. An empty ranking is DefaultTagPrecedence.
+func ParseTagPrecedence(names []string) (TagPrecedence, error) {
+	if len(names) == 0 {
+		return DefaultTagPrecedence, nil
+	}
+	p := make(TagPrecedence, 0, len(names))
+	for _, name := range names {
+		source := TagSource(name)
+		switch source {
+		case TagSourceClient, TagSourceListener, TagSourceHost:
+		default:
+			return nil, fmt.Errorf("unknown tag source %q", name)
+		}
+		if p.rank(source) < len(p) {
+			return nil, fmt.Errorf("tag source %q is listed more than once", name)
+		}
+		p = append(p, source)
+	}
+	if len(p) != len(DefaultTagPrecedence) {
+		return nil, fmt.Errorf("tag precedence must list each of %s, %s and %s", TagSourceClient, TagSourceListener, TagSourceHost)
+	}
+	return p, nil
+}
+
+// rank returns the source's position in the ranking, or the length of the
+// ranking if it isn't in it.
+func (p TagPrecedence) rank(source TagSource) int {
+	for i, s := range p {
+		if s == source {
+			return i
+		}
+	}
+	return len(p)
+}
+
+// SourcedTags are the tags from one source.
+type SourcedTags struct {
+	Source TagSource
+	Tags   []string
+}
+
+// TagKey returns the key of a tag: the part before the first colon, or the
+// whole tag if it has none.
+func TagKey(tag string) string {
+	if colon := strings.IndexByte(tag, ':'); colon != -1 {
+		return tag[:colon]
+	}
+	return tag
+}
+
+// MergeTags combines tags from several sources into a new slice. When more
+// than one source has a tag with the same key, only the tags with that key
+// from the source that ranks highest in the precedence are kept, so that eg
+// a client's env:staging replaces rather than joins a configured env:prod.
+// Tags that share a key within one source are all kept, since a tag may
+// legitimately have several values. Otherwise the tags are kept in the order
+// of the sources given.
+func MergeTags(precedence TagPrecedence, sources ...SourcedTags) []string {
+	if precedence == nil {
+		precedence = DefaultTagPrecedence
+	}
+	size := 0
+	for _, s := range sources {
+		size += len(s.Tags)
+	}
+	merged := make([]string, 0, size)
+	if size == 0 {
+		return merged
+	}
+
+	// the highest rank that sets each key
+	owners := make(map[string]int, size)
+	for _, s := range sources {
+		rank := precedence.rank(s.Source)
+		for _, tag := range s.Tags {
+			key := TagKey(tag)
+			if owner, ok := owners[key]; !ok || rank < owner {
+				owners[key] = rank
+			}
+		}
+	}
+	for _, s := range sources {
+		rank := precedence.rank(s.Source)
+		for _, tag := range s.Tags {
+			if owners[TagKey(tag)] == rank {
+				merged = append(merged, tag)
+			}
+		}
+	}
+	return merged
+}
@@ -0,0 +1,50 @@
+package veneur
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// MetricScale multiplies the values of metrics whose name matches the Name
+// regular expression by Scale as they are received, before they are
+// aggregated, for converting units (eg a Scale of 0.001 turns microseconds
+// into milliseconds). Sets are not scaled.
+type MetricScale struct {
+	Name  string  `yaml:"name"`
+	Scale float64 `yaml:"scale"`
+}
+
+// metricScales is a compiled, ordered list of MetricScales. The first one
+// whose name matches a metric decides its scale.
+type metricScales []metricScale
+
+type metricScale struct {
+	name  *regexp.Regexp
+	scale float64
+}
+
+func newMetricScales(scales []MetricScale) (metricScales, error) {
+	var ms metricScales
+	for i, scale := range scales {
+		if scale.Scale == 0 {
+			return nil, fmt.Errorf("metric scale %d: scale must not be zero", i)
+		}
+		re, err := regexp.Compile(scale.Name)
+		if err != nil {
+			return nil, fmt.Errorf("metric scale %d: %s", i, err)
+		}
+		ms = append(ms, metricScale{name: re, scale: scale.Scale})
+	}
+	return ms, nil
+}
+
+// scaleFor returns the scale for metrics with the given name, which is 1 if
+// none of the scales match.
+func (ms metricScales) scaleFor(name string) float64 {
+	for _, scale := range ms {
+		if scale.name.MatchString(name) {
+			return scale.scale
+		}
+	}
+	return 1
+}
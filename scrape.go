@@ -0,0 +1,151 @@
+package veneur
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/stripe/veneur/samplers"
+)
+
+// scrapeContentType is the Prometheus text exposition format, which
+// OpenMetrics scrapers also accept.
+const scrapeContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// flushSnapshot holds the metrics from the most recent flush, so that they
+// can be scraped.
+type flushSnapshot struct {
+	sync.RWMutex
+	metrics []samplers.DDMetric
+}
+
+func (fs *flushSnapshot) set(metrics []samplers.DDMetric) {
+	if fs == nil {
+		return
+	}
+	fs.Lock()
+	fs.metrics = metrics
+	fs.Unlock()
+}
+
+func (fs *flushSnapshot) get() []samplers.DDMetric {
+	if fs == nil {
+		return nil
+	}
+	fs.RLock()
+	defer fs.RUnlock()
+	return fs.metrics
+}
+
+// handleScrape serves the metrics from the most recent flush in the
+// Prometheus text exposition format. Every metric is exposed as a gauge,
+// since what we flush are per-interval values (counters are flushed as rates,
+// and histograms as one gauge per aggregate and percentile), not the
+// cumulative totals Prometheus means by counters. Scraping between two
+// flushes always returns the same values.
+func (s *Server) handleScrape(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", scrapeContentType)
+	w.Write(encodeExposition(s.lastFlush.get()))
+}
+
+func encodeExposition(metrics []samplers.DDMetric) []byte {
+	lines := map[string][]string{}
+	for _, metric := range metrics {
+		name := sanitizeMetricName(metric.Name)
+		line := name + encodeLabels(metric) + " " + strconv.FormatFloat(metric.Value[0][1], 'g', -1, 64)
+		lines[name] = append(lines[name], line)
+	}
+
+	names := make([]string, 0, len(lines))
+	for name := range lines {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	buf := bytes.Buffer{}
+	for _, name := range names {
+		buf.WriteString("# TYPE " + name + " gauge\n")
+		sort.Strings(lines[name])
+		for _, line := range lines[name] {
+			buf.WriteString(line)
+			buf.WriteByte('\n')
+		}
+	}
+	return buf.Bytes()
+}
+
+// encodeLabels converts a metric's tags, hostname and device into a label
+// set. Tags of the form key:value become labels; tags without a value are
+// given the value "true". If several tags have the same key, only the first
+// is kept, since labels must be unique.
+func encodeLabels(metric samplers.DDMetric) string {
+	seen := map[string]bool{}
+	var labels []string
+	add := func(key, value string) {
+		key = sanitizeLabelName(key)
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		labels = append(labels, key+`="`+labelValueEscaper.Replace(value)+`"`)
+	}
+	for _, tag := range metric.Tags {
+		kv := strings.SplitN(tag, ":", 2)
+		if len(kv) == 2 {
+			add(kv[0], kv[1])
+		} else {
+			add(kv[0], "true")
+		}
+	}
+	if metric.Hostname != "" {
+		add("host", metric.Hostname)
+	}
+	if metric.DeviceName != "" {
+		add("device", metric.DeviceName)
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	sort.Strings(labels)
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// sanitizeMetricName replaces any characters that are not allowed in a
+// metric name (which must match [a-zA-Z_:][a-zA-Z0-9_:]*) with underscores,
+// so "a.b.c" becomes "a_b_c".
+func sanitizeMetricName(name string) string {
+	return sanitizeName(name, true)
+}
+
+// sanitizeLabelName is like sanitizeMetricName, but for label names, which
+// may not contain colons.
+func sanitizeLabelName(name string) string {
+	return sanitizeName(name, false)
+}
+
+func sanitizeName(name string, allowColons bool) string {
+	if name == "" {
+		return "_"
+	}
+	buf := make([]byte, 0, len(name)+1)
+	if name[0] >= '0' && name[0] <= '9' {
+		buf = append(buf, '_')
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+			buf = append(buf, c)
+		case c == ':' && allowColons:
+			buf = append(buf, c)
+		default:
+			buf = append(buf, '_')
+		}
+	}
+	return string(buf)
+}
@@ -2,10 +2,20 @@ package veneur
 
 import (
 	"bytes"
+	"compress/zlib"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
@@ -18,15 +28,21 @@ import (
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
 	"github.com/getsentry/raven-go"
 	"github.com/golang/protobuf/proto"
+	"github.com/opentracing/opentracing-go"
 	"github.com/stripe/veneur/ssf"
 	"github.com/zenazn/goji/bind"
 	"github.com/zenazn/goji/graceful"
+	"golang.org/x/oauth2"
 
 	"github.com/pkg/profile"
 
 	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/plugins/cloudmonitoring"
 	"github.com/stripe/veneur/plugins/influxdb"
 	s3p "github.com/stripe/veneur/plugins/s3"
+	"github.com/stripe/veneur/plugins/shadow"
+	"github.com/stripe/veneur/plugins/ssfagent"
+	"github.com/stripe/veneur/plugins/stdout"
 	"github.com/stripe/veneur/samplers"
 	"github.com/stripe/veneur/trace"
 )
@@ -41,11 +57,16 @@ var log = logrus.New()
 
 var tracer = trace.GlobalTracer
 
+// internalMetricsPrefix is the namespace of the metrics veneur reports about
+// itself.
+const internalMetricsPrefix = "veneur."
+
 // A Server is the actual veneur instance that will be run.
 type Server struct {
 	Workers     []*Worker
 	EventWorker *EventWorker
 	TraceWorker *TraceWorker
+	SpanCapture *SpanCapture
 
 	statsd *statsd.Client
 	sentry *raven.Client
@@ -57,19 +78,47 @@ type Server struct {
 	DDAPIKey       string
 	DDTraceAddress string
 	HTTPClient     *http.Client
+	// the client that forwards to a global veneur are made with, if they
+	// need a TLS config of their own; otherwise they use HTTPClient
+	forwardClient *http.Client
+	// how many requests HTTPClient may have open to a host at once, which
+	// also bounds how many chunks of a flush are POSTed at once
+	maxRequestsInFlight int
 
 	HTTPAddr    string
 	ForwardAddr string
 	UDPAddr     *net.UDPAddr
 	TraceAddr   *net.UDPAddr
+	// the TLS config the HTTP server is served with, or nil for plaintext
+	httpTLS *tls.Config
+	// the sockets inherited from systemd, if veneur was socket-activated
+	activated   *activatedSockets
 	RcvbufBytes int
 
+	// if multicastGroup is set, the UDP listener also joins it, on
+	// multicastInterface (or the system default, if that is nil)
+	multicastGroup        net.IP
+	multicastInterface    *net.Interface
+	multicastJoinOptional bool
+
 	interval             time.Duration
 	numReaders           int
 	metricMaxLength      int
+	metricMaxLineLength  int
 	traceMaxLengthBytes  int
 	HistogramPercentiles []float64
 	FlushMaxPerBody      int
+	FlushMaxBodyBytes    int
+	// how many goroutines encode each flush to Datadog
+	serializationWorkers int
+	countersAsCounts     bool
+	omitEmptyHistograms  bool
+	// empty, or how histograms are flushed as distributions
+	histogramDistributions string
+	omitHeartbeat          bool
+	traceFlushPhases       bool
+	// empty, or which end of its window metrics are timestamped with
+	flushTimestampAlignment string
 
 	plugins   []plugins.Plugin
 	pluginMtx sync.Mutex
@@ -77,15 +126,133 @@ type Server struct {
 	enableProfiling bool
 
 	HistogramAggregates samplers.HistogramAggregates
+
+	parser samplers.Parser
+
+	// importSem bounds the number of concurrent imports, if set
+	importSem       chan struct{}
+	importsInFlight int64
+
+	// the ingest funnel since the last flush: UDP packets read, the lines
+	// in them, and the lines that parsed
+	packetsReceived int64
+	linesReceived   int64
+	linesParsed     int64
+	// and the packets read by each reader
+	readers readerSet
+
+	// the name prefixes that naming violations have been tagged with
+	namingPrefixes boundedTagValues
+
+	// the metrics from the most recent flush, for /metrics
+	lastFlush *flushSnapshot
+
+	// router is nil unless metrics are routed to particular sinks
+	router *metricRouter
+	// nil unless metric_drop_rules are configured
+	dropper *metricDropper
+
+	// the Prometheus endpoints to scrape, each in its own goroutine
+	scrapers []*scraper
+
+	enableMetricReset bool
+
+	// nil unless max_flush_pause is set
+	flushPause *flushPause
+	// where /debug/trace-canary sends its span context, if anywhere
+	traceCanaryNextHop string
+	// how many more of the first flushes since startup are skipped, as
+	// warmup_flushes says
+	warmupFlushes int32
+	// empty unless flush_tiers_enabled is set
+	tiers []*flushTier
+
+	flushScheduler *flushScheduler
+
+	// shared by every sink, and nil unless sink_retry_budget_rate is set
+	retryBudget *plugins.RetryBudget
+
+	// if set, metrics are tagged with the transport they were received on
+	tagTransport bool
+
+	// merges the tags configured for the whole veneur into each metric's
+	tagMerger tagMerger
+
+	// breakers is nil unless sinks have circuit breakers
+	breakers *sinkBreakers
+
+	// flushTimeout is how long a flush to a sink may take, unless
+	// sinkFlushTimeouts has a timeout for that sink
+	flushTimeout      time.Duration
+	sinkFlushTimeouts map[string]time.Duration
+	// the sinks whose last flush timed out and is still running
+	abandonedFlushes *abandonedFlushes
+
+	// if set, the hostname is applied as a tag with this key rather than as
+	// each metric's host
+	hostnameTag string
+
+	metricNames metricNameTracker
+	// how many of the tag keys with the most values are reported each
+	// flush, if any
+	tagCardinalityTop int
+
+	// deadletters is nil unless forwards that fail are spilled to disk to
+	// be retried
+	deadletters *deadletterQueue
+
+	// the level that forwards are compressed with, or 0 for the default
+	forwardCompressionLevel int
+	// the http_sink_encodings, which override defaultSinkEncodings
+	sinkEncodings map[string]string
+
+	// the config the server was created from, with secrets redacted, for
+	// /debug/config
+	config Config
+
+	// the sinks selected by the sinks option, which are also plugins, and
+	// flushed spans too
+	sinks []plugins.Sink
+
+	// if zipkinAddress is set, spans are also flushed to that Zipkin
+	// collector, zipkinBatchSize at a time
+	zipkinAddress   string
+	zipkinBatchSize int
+
+	// passthrough is nil unless some types of metric are forwarded without
+	// being aggregated locally
+	passthrough      chan samplers.JSONMetric
+	passthroughTypes map[string]bool
+	// the same metric_scales the workers apply, for the metrics that bypass
+	// them
+	scales metricScales
+
+	// if the shadow hostname is set, a copy of every flush to Datadog is
+	// also sent to this second account, by datadogShadow (created by Start)
+	shadowDDHostname string
+	shadowDDAPIKey   string
+	datadogShadow    *shadow.Sender
 }
 
 // NewFromConfig creates a new veneur server from a configuration specification.
 func NewFromConfig(conf Config) (ret Server, err error) {
 	ret.Hostname = conf.Hostname
+	if conf.HostnameTag != "host" {
+		ret.hostnameTag = conf.HostnameTag
+	}
 	ret.Tags = conf.Tags
+	azTag, err := resolveAvailabilityZone(conf)
+	if err != nil {
+		return
+	}
+	if azTag != "" {
+		ret.Tags = append(ret.Tags[:len(ret.Tags):len(ret.Tags)], azTag)
+	}
 	ret.DDHostname = conf.APIHostname
 	ret.DDAPIKey = conf.Key
 	ret.DDTraceAddress = conf.TraceAPIAddress
+	ret.shadowDDHostname = conf.DatadogShadowAPIHostname
+	ret.shadowDDAPIKey = conf.DatadogShadowAPIKey
 	ret.HistogramPercentiles = conf.Percentiles
 	if len(conf.Aggregates) == 0 {
 		ret.HistogramAggregates.Value = samplers.AggregateMin + samplers.AggregateMax + samplers.AggregateCount
@@ -97,24 +264,110 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 		}
 		ret.HistogramAggregates.Count = len(conf.Aggregates)
 	}
+	if conf.HistogramCountSuffix != "" {
+		if _, ok := samplers.AggregatesLookup[conf.HistogramCountSuffix]; ok || strings.HasSuffix(conf.HistogramCountSuffix, "percentile") {
+			err = fmt.Errorf("histogram_count_suffix %q is the name of an aggregate", conf.HistogramCountSuffix)
+			return
+		}
+		ret.HistogramAggregates.CountSuffix = conf.HistogramCountSuffix
+		ret.HistogramAggregates.Count++
+	}
 
 	interval, err := time.ParseDuration(conf.Interval)
 	if err != nil {
 		return
 	}
 	ret.interval = interval
-	ret.HTTPClient = &http.Client{
-		// make sure that POSTs to datadog do not overflow the flush interval
-		Timeout: interval * 9 / 10,
-		// we're fine with using the default transport and redirect behavior
+	// make sure that flushes do not overflow the flush interval
+	ret.flushTimeout = interval * 9 / 10
+	if len(conf.SinkFlushTimeouts) > 0 {
+		ret.sinkFlushTimeouts = make(map[string]time.Duration, len(conf.SinkFlushTimeouts))
+		for sink, timeout := range conf.SinkFlushTimeouts {
+			var d time.Duration
+			d, err = time.ParseDuration(timeout)
+			if err != nil {
+				return
+			}
+			if d <= 0 {
+				err = fmt.Errorf("sink_flush_timeouts: the timeout for %q must be positive, got %s", sink, timeout)
+				return
+			}
+			ret.sinkFlushTimeouts[sink] = d
+		}
+	}
+	ret.abandonedFlushes = newAbandonedFlushes()
+	if err = checkHTTPPools(conf.HTTPSinkPools); err != nil {
+		return
+	}
+	if err = checkHTTPSinkEncodings(conf.HTTPSinkEncodings); err != nil {
+		return
+	}
+	ret.sinkEncodings = conf.HTTPSinkEncodings
+	// make sure that POSTs to datadog do not overflow the flush interval.
+	// forwarding to a global veneur uses the same client (and pool), so a
+	// longer timeout for datadog is still cut off at this one
+	ret.HTTPClient, err = newSinkHTTPClient(ret.flushTimeout, conf.HTTPSinkPools[datadogSinkName])
+	if err != nil {
+		err = fmt.Errorf("http_sink_pools: %q: %s", datadogSinkName, err)
+		return
+	}
+	ret.maxRequestsInFlight = maxRequestsInFlight(conf.HTTPSinkPools[datadogSinkName])
+	forwardTLS, err := newForwardTLSConfig(conf)
+	if err != nil {
+		return
+	}
+	if forwardTLS != nil {
+		// the same pool settings as HTTPClient, but a client of its own,
+		// so that Datadog is neither presented the certificate nor
+		// verified against the global veneur's CA
+		ret.forwardClient, err = newSinkHTTPClient(ret.flushTimeout, conf.HTTPSinkPools[datadogSinkName])
+		if err != nil {
+			return
+		}
+		ret.forwardClient.Transport.(*http.Transport).TLSClientConfig = forwardTLS
 	}
 	ret.FlushMaxPerBody = conf.FlushMaxPerBody
+	ret.FlushMaxBodyBytes = conf.FlushMaxBodyBytes
+	ret.serializationWorkers = conf.FlushSerializationWorkers
+	ret.tagCardinalityTop = conf.TagCardinalityTop
+	if ret.serializationWorkers <= 0 {
+		ret.serializationWorkers = runtime.GOMAXPROCS(0)
+	}
+	ret.countersAsCounts = conf.FlushCountersAsCounts
+	ret.omitEmptyHistograms = conf.FlushOmitEmptyHistograms
+	ret.omitHeartbeat = conf.FlushOmitHeartbeat
+	switch conf.FlushTimestampAlignment {
+	case "", flushTimestampStart, flushTimestampEnd:
+		ret.flushTimestampAlignment = conf.FlushTimestampAlignment
+	default:
+		err = fmt.Errorf("flush_timestamp_alignment must be %q or %q, got %q", flushTimestampStart, flushTimestampEnd, conf.FlushTimestampAlignment)
+		return
+	}
+	if err = checkHistogramDistributions(conf.HistogramDistributions); err != nil {
+		return
+	}
+	ret.histogramDistributions = conf.HistogramDistributions
+	ret.traceFlushPhases = conf.FlushTracePhases
+	ret.lastFlush = &flushSnapshot{}
+	if conf.SinkBreakerThreshold > 0 {
+		cooldown := defaultSinkBreakerCooldown
+		if conf.SinkBreakerCooldown != "" {
+			cooldown, err = time.ParseDuration(conf.SinkBreakerCooldown)
+			if err != nil {
+				return
+			}
+		}
+		ret.breakers = newSinkBreakers(conf.SinkBreakerThreshold, cooldown)
+	}
+	if conf.ImportMaxInFlight > 0 {
+		ret.importSem = make(chan struct{}, conf.ImportMaxInFlight)
+	}
 
 	ret.statsd, err = statsd.NewBuffered(conf.StatsAddress, 1024)
 	if err != nil {
 		return
 	}
-	ret.statsd.Namespace = "veneur."
+	ret.statsd.Namespace = internalMetricsPrefix
 	ret.statsd.Tags = append(ret.Tags, "veneurlocalonly")
 
 	// nil is a valid sentry client that noops all methods, if there is no DSN
@@ -133,6 +386,47 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 	if conf.EnableProfiling {
 		ret.enableProfiling = true
 	}
+	ret.enableMetricReset = conf.EnableMetricReset
+	if conf.MaxFlushPause != "" {
+		var maxPause time.Duration
+		maxPause, err = time.ParseDuration(conf.MaxFlushPause)
+		if err != nil {
+			err = fmt.Errorf("max_flush_pause: %s", err)
+			return
+		}
+		if maxPause <= 0 {
+			err = fmt.Errorf("max_flush_pause must be positive, got %s", conf.MaxFlushPause)
+			return
+		}
+		if conf.MaxFlushPauseSeries < 0 {
+			err = fmt.Errorf("max_flush_pause_series must not be negative, got %d", conf.MaxFlushPauseSeries)
+			return
+		}
+		ret.flushPause = newFlushPause(maxPause, conf.MaxFlushPauseSeries)
+	}
+	if conf.WarmupFlushes < 0 {
+		err = fmt.Errorf("warmup_flushes must not be negative, got %d", conf.WarmupFlushes)
+		return
+	}
+	ret.warmupFlushes = int32(conf.WarmupFlushes)
+	if conf.TraceCanaryNextHop != "" {
+		var u *url.URL
+		u, err = url.Parse(conf.TraceCanaryNextHop)
+		if err == nil && u.Scheme != "http" && u.Scheme != "https" {
+			err = fmt.Errorf("must be an http or https URL")
+		}
+		if err != nil {
+			err = fmt.Errorf("trace_canary_next_hop: %s", err)
+			return
+		}
+		ret.traceCanaryNextHop = conf.TraceCanaryNextHop
+	}
+	// the flush is set by Start, since it must flush the Server that was
+	// started rather than this copy of it
+	ret.flushScheduler, err = newFlushScheduler(conf.FlushOverrun, ret.interval, nil, ret.statsd)
+	if err != nil {
+		return
+	}
 
 	log.Hooks.Add(sentryHook{
 		c:        ret.sentry,
@@ -144,14 +438,59 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 		},
 	})
 
+	for name, bounds := range conf.HistogramBuckets {
+		if err = samplers.CheckBuckets(bounds); err != nil {
+			err = fmt.Errorf("histogram_buckets for %s: %s", name, err)
+			return
+		}
+	}
+
+	var gaugeAggregations map[string]samplers.GaugeAggregation
+	for name, aggName := range conf.GaugeAggregations {
+		agg, ok := samplers.GaugeAggregationsLookup[aggName]
+		if !ok {
+			err = fmt.Errorf("gauge_aggregations for %s: unknown aggregation %q", name, aggName)
+			return
+		}
+		if gaugeAggregations == nil {
+			gaugeAggregations = make(map[string]samplers.GaugeAggregation)
+		}
+		gaugeAggregations[name] = agg
+	}
+
+	var scales metricScales
+	scales, err = newMetricScales(conf.MetricScales)
+	if err != nil {
+		return
+	}
+	ret.scales = scales
+
+	var compressions histogramCompressions
+	compressions, err = newHistogramCompressions(conf.HistogramCompressions)
+	if err != nil {
+		return
+	}
+
 	log.WithField("number", conf.NumWorkers).Info("Preparing workers")
 	// Allocate the slice, we'll fill it with workers later.
 	ret.Workers = make([]*Worker, conf.NumWorkers)
 	ret.numReaders = conf.NumReaders
+	if ret.numReaders > 1 && !reuseportSupported {
+		err = errors.New("num_readers can only be more than 1 on Linux, which supports SO_REUSEPORT")
+		return
+	}
 
 	// Use the pre-allocated Workers slice to know how many to start.
 	for i := range ret.Workers {
 		ret.Workers[i] = NewWorker(i+1, ret.statsd, log)
+		if conf.HistogramMaxRate > 0 {
+			ret.Workers[i].limiter = newSampleLimiter(conf.HistogramMaxRate)
+		}
+		ret.Workers[i].histogramBuckets = conf.HistogramBuckets
+		ret.Workers[i].gaugeAggregations = gaugeAggregations
+		ret.Workers[i].scales = scales
+		ret.Workers[i].compressions = compressions
+		ret.Workers[i].internalEvery = conf.InternalMetricsFlushEvery
 		// do not close over loop index
 		go func(w *Worker) {
 			defer func() {
@@ -162,23 +501,115 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 	}
 
 	ret.EventWorker = NewEventWorker(ret.statsd)
+	if conf.EventDedupe {
+		if conf.EventDedupeMaxKeys < 0 {
+			err = fmt.Errorf("event_dedupe_max_keys must not be negative, got %d", conf.EventDedupeMaxKeys)
+			return
+		}
+		ret.EventWorker.dedupe = newEventDedupe(conf.EventDedupeMaxKeys, conf.EventDedupeAnnotate)
+	}
 
 	ret.UDPAddr, err = net.ResolveUDPAddr("udp", conf.UdpAddress)
 	if err != nil {
 		return
 	}
+	ret.activated, err = newActivatedSockets()
+	if err != nil {
+		return
+	}
+	if conf.UDPMulticastGroup != "" {
+		if err = ret.setMulticast(conf); err != nil {
+			return
+		}
+	}
+
+	ret.parser = samplers.Parser{
+		StripEntityTags:    conf.StripEntityTags,
+		ExplicitTimestamps: conf.DogstatsdTimestamps,
+	}
+	switch {
+	case conf.MaxTagsPerMetric == 0:
+		ret.parser.MaxTags = defaultMaxTagsPerMetric
+	case conf.MaxTagsPerMetric == -1:
+		// unlimited
+	case conf.MaxTagsPerMetric < 0:
+		err = fmt.Errorf("max_tags_per_metric must be positive, or -1 for no limit, got %d", conf.MaxTagsPerMetric)
+		return
+	default:
+		ret.parser.MaxTags = conf.MaxTagsPerMetric
+	}
+	if conf.MetricNamePattern != "" {
+		ret.parser.NamePattern, err = regexp.Compile(conf.MetricNamePattern)
+		if err != nil {
+			err = fmt.Errorf("metric_name_pattern: %s", err)
+			return
+		}
+	}
+	switch conf.MetricNameViolations {
+	case "", "drop":
+	case "tag":
+		ret.parser.TagNamingViolations = true
+	default:
+		err = fmt.Errorf("metric_name_violations must be drop or tag, got %q", conf.MetricNameViolations)
+		return
+	}
+	ret.tagTransport = conf.TagTransport
+	ret.tagMerger.precedence, err = samplers.ParseTagPrecedence(conf.TagPrecedence)
+	if err != nil {
+		err = fmt.Errorf("tag_precedence: %s", err)
+		return
+	}
+	ret.parser.TagPrecedence = ret.tagMerger.precedence
+	if ret.tagTransport {
+		ret.tagMerger.listenerKeys = map[string]bool{"transport": true}
+	}
 
 	ret.metricMaxLength = conf.MetricMaxLength
+	ret.metricMaxLineLength = conf.MetricMaxLineLength
+	if ret.metricMaxLineLength == 0 {
+		ret.metricMaxLineLength = defaultMetricMaxLineLength
+	} else if ret.metricMaxLineLength < 0 {
+		err = fmt.Errorf("metric_max_line_length must be positive, got %d", conf.MetricMaxLineLength)
+		return
+	}
 	ret.traceMaxLengthBytes = conf.TraceMaxLengthBytes
+	if conf.TracerMaxSpansPerSecond != 0 {
+		// veneur's own spans are started both from tracer and from the
+		// global opentracing tracer, so both sample them
+		tracer.Sampler, err = trace.NewAdaptiveSampler(conf.TracerMaxSpansPerSecond, nil, trace.SampleAtStart)
+		if err != nil {
+			err = fmt.Errorf("tracer_max_spans_per_second: %s", err)
+			return
+		}
+		opentracing.SetGlobalTracer(tracer)
+	}
 	ret.RcvbufBytes = conf.ReadBufferSizeBytes
 	ret.HTTPAddr = conf.HTTPAddress
+	ret.httpTLS, err = newHTTPTLSConfig(conf)
+	if err != nil {
+		return
+	}
 	ret.ForwardAddr = conf.ForwardAddress
+	for _, typ := range conf.ForwardPassthroughTypes {
+		if !passthroughTypes[typ] {
+			err = fmt.Errorf("forward_passthrough_types: %s metrics cannot be passed through", typ)
+			return
+		}
+		if ret.passthroughTypes == nil {
+			ret.passthroughTypes = map[string]bool{}
+		}
+		ret.passthroughTypes[typ] = true
+	}
+	if ret.ForwardAddr != "" && len(ret.passthroughTypes) > 0 {
+		ret.passthrough = make(chan samplers.JSONMetric, passthroughBuffer)
+	}
 
-	conf.Key = "REDACTED"
-	conf.SentryDsn = "REDACTED"
-	log.WithField("config", conf).Debug("Initialized server")
+	ret.config = redactConfig(conf)
+	log.WithField("config", ret.config).Debug("Initialized server")
 
-	if len(conf.TraceAddress) > 0 && len(conf.TraceAPIAddress) > 0 {
+	ret.zipkinAddress = conf.ZipkinAddress
+	ret.zipkinBatchSize = conf.ZipkinBatchSize
+	if len(conf.TraceAddress) > 0 && (len(conf.TraceAPIAddress) > 0 || len(conf.ZipkinAddress) > 0) {
 
 		ret.TraceWorker = NewTraceWorker(ret.statsd)
 
@@ -190,6 +621,19 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 		if err != nil {
 			return
 		}
+
+		if conf.TraceCaptureFile != "" {
+			ret.SpanCapture, err = NewSpanCapture(
+				conf.TraceCaptureFile,
+				int64(conf.TraceCaptureMaxFileBytes),
+				int64(conf.TraceCaptureMaxTotalBytes),
+				ret.statsd,
+			)
+			if err != nil {
+				return
+			}
+			log.WithField("file", conf.TraceCaptureFile).Info("Capturing received spans")
+		}
 	} else {
 		trace.Disabled = true
 	}
@@ -198,9 +642,6 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 	awsID := conf.AwsAccessKeyID
 	awsSecret := conf.AwsSecretAccessKey
 
-	conf.AwsAccessKeyID = "REDACTED"
-	conf.AwsSecretAccessKey = "REDACTED"
-
 	if len(awsID) > 0 && len(awsSecret) > 0 {
 		sess, err := session.NewSession(&aws.Config{
 			Region:      aws.String(conf.AwsRegion),
@@ -232,13 +673,158 @@ func NewFromConfig(conf Config) (ret Server, err error) {
 		log.Info("S3 archives are enabled")
 	}
 
+	if conf.SinkRetryBudgetRate < 0 || conf.SinkRetryBudgetCapacity < 0 || conf.SinkMaxRetries < 0 {
+		err = errors.New("sink_retry_budget_rate, sink_retry_budget_capacity and sink_max_retries must not be negative")
+		return
+	}
+	if conf.SinkRetryBudgetRate > 0 {
+		capacity := conf.SinkRetryBudgetCapacity
+		if capacity == 0 {
+			capacity = conf.SinkRetryBudgetRate
+		}
+		maxRetries := conf.SinkMaxRetries
+		if maxRetries == 0 {
+			maxRetries = defaultSinkMaxRetries
+		}
+		ret.retryBudget = plugins.NewRetryBudget(conf.SinkRetryBudgetRate, capacity, maxRetries, ret.statsd)
+	}
+
 	if conf.InfluxAddress != "" {
-		plugin := influxdb.NewInfluxDBPlugin(
-			log, conf.InfluxAddress, conf.InfluxConsistency, conf.InfluxDBName, ret.HTTPClient, ret.statsd,
-		)
+		var influxClient *http.Client
+		influxClient, err = newSinkHTTPClient(ret.sinkFlushTimeout(influxDBSinkName), conf.HTTPSinkPools[influxDBSinkName])
+		if err != nil {
+			err = fmt.Errorf("http_sink_pools: %q: %s", influxDBSinkName, err)
+			return
+		}
+		plugin := influxdb.NewInfluxDBPlugin(log, influxdb.Config{
+			Address:         conf.InfluxAddress,
+			BatchSize:       conf.InfluxBatchSize,
+			DB:              conf.InfluxDBName,
+			RetentionPolicy: conf.InfluxRetentionPolicy,
+			Consistency:     conf.InfluxConsistency,
+			Username:        conf.InfluxUsername,
+			Password:        conf.InfluxPassword,
+			Org:             conf.InfluxOrg,
+			Bucket:          conf.InfluxBucket,
+			Token:           conf.InfluxToken,
+			ContentEncoding: ret.sinkEncoding(influxDBSinkName),
+		}, influxClient, ret.statsd)
+		plugin.RetryBudget = ret.retryBudget
+		ret.registerPlugin(plugin)
+	}
+
+	if conf.CloudMonitoringProjectID != "" {
+		var client *http.Client
+		client, err = newSinkHTTPClient(ret.sinkFlushTimeout(cloudMonitoringSinkName), conf.HTTPSinkPools[cloudMonitoringSinkName])
+		if err != nil {
+			err = fmt.Errorf("http_sink_pools: %q: %s", cloudMonitoringSinkName, err)
+			return
+		}
+		var credentials oauth2.TokenSource
+		credentials, err = cloudmonitoring.DefaultCredentials(client)
+		if err != nil {
+			err = fmt.Errorf("cloud_monitoring_project_id: %s", err)
+			return
+		}
+		log.WithField("project", conf.CloudMonitoringProjectID).Info("Flushing metrics to Cloud Monitoring")
+		plugin := cloudmonitoring.NewCloudMonitoringPlugin(log, ret.statsd, client, credentials, conf.CloudMonitoringProjectID, conf.CloudMonitoringMetricPrefix, conf.CloudMonitoringBatchSize)
+		plugin.RetryBudget = ret.retryBudget
+		plugin.ContentEncoding = ret.sinkEncoding(cloudMonitoringSinkName)
 		ret.registerPlugin(plugin)
 	}
 
+	if conf.SSFAgentAddress != "" {
+		log.WithField("address", conf.SSFAgentAddress).Info("Flushing metrics to a local SSF agent")
+		ret.registerPlugin(ssfagent.NewSSFAgentPlugin(log, ret.statsd, conf.SSFAgentAddress, conf.SSFAgentBatchSize))
+	}
+
+	if conf.StdoutEnabled {
+		log.Warn("Printing flushed metrics to stdout, which is meant for development only")
+		ret.registerPlugin(stdout.NewStdoutPlugin(os.Stdout, conf.StdoutColor, conf.StdoutMaxLines))
+	}
+
+	if err = ret.newSinks(conf.Sinks); err != nil {
+		return
+	}
+
+	if conf.ForwardCompressionLevel < 0 || conf.ForwardCompressionLevel > zlib.BestCompression {
+		err = fmt.Errorf("forward_compression_level must be between %d (fastest) and %d (best), got %d", zlib.BestSpeed, zlib.BestCompression, conf.ForwardCompressionLevel)
+		return
+	}
+	ret.forwardCompressionLevel = conf.ForwardCompressionLevel
+
+	if conf.ForwardDeadletterDir != "" && ret.ForwardAddr != "" {
+		maxAge := defaultDeadletterMaxAge
+		if conf.ForwardDeadletterMaxAge != "" {
+			maxAge, err = time.ParseDuration(conf.ForwardDeadletterMaxAge)
+			if err != nil {
+				return
+			}
+		}
+		maxBytes := int64(conf.ForwardDeadletterMaxBytes)
+		if maxBytes <= 0 {
+			maxBytes = defaultDeadletterMaxBytes
+		}
+		// retrying the queue may use half the flush, leaving the rest for
+		// the forward that follows it
+		ret.deadletters, err = newDeadletterQueue(conf.ForwardDeadletterDir, maxAge, maxBytes, ret.flushTimeout/2)
+		if err != nil {
+			return
+		}
+	}
+
+	ret.dropper, err = newMetricDropper(conf.MetricDropRules)
+	if err != nil {
+		return
+	}
+
+	scrapeInterval := ret.interval
+	if conf.PrometheusScrapeInterval != "" {
+		scrapeInterval, err = time.ParseDuration(conf.PrometheusScrapeInterval)
+		if err != nil {
+			return
+		}
+		if scrapeInterval <= 0 {
+			err = fmt.Errorf("prometheus_scrape_interval must be positive, got %s", scrapeInterval)
+			return
+		}
+	}
+	ret.scrapers, err = newScrapers(conf.PrometheusScrapeTargets, scrapeInterval)
+	if err != nil {
+		return
+	}
+
+	if len(conf.MetricRoutes) > 0 || len(conf.MetricRoutesDefault) > 0 {
+		for i, route := range conf.MetricRoutes {
+			if err = ret.checkSinkNames(fmt.Sprintf("metric route %d", i), route.Sinks); err != nil {
+				return
+			}
+		}
+		if err = ret.checkSinkNames("metric_routes_default", conf.MetricRoutesDefault); err != nil {
+			return
+		}
+		ret.router, err = newMetricRouter(conf.MetricRoutes, conf.MetricRoutesDefault)
+		if err != nil {
+			return
+		}
+	}
+	timeoutSinks := make([]string, 0, len(conf.SinkFlushTimeouts))
+	for sink := range conf.SinkFlushTimeouts {
+		timeoutSinks = append(timeoutSinks, sink)
+	}
+	sort.Strings(timeoutSinks)
+	if err = ret.checkSinkNames("sink_flush_timeouts", timeoutSinks); err != nil {
+		return
+	}
+	if conf.FlushTiersEnabled {
+		ret.tiers, err = ret.newFlushTiers(conf.FlushTiers)
+		if err != nil {
+			return
+		}
+	} else if len(conf.FlushTiers) > 0 {
+		log.Warn("Ignoring flush_tiers, since flush_tiers_enabled isn't set")
+	}
+
 	return
 }
 
@@ -265,9 +851,57 @@ func (s *Server) Start() {
 		}()
 	}
 
+	if s.shadowDDHostname != "" {
+		log.WithField("api_hostname", s.shadowDDHostname).Info("Shadowing flushes to a second Datadog account")
+		s.datadogShadow = shadow.NewSender(&datadogShadowPlugin{
+			server:     s,
+			ddHostname: s.shadowDDHostname,
+			apiKey:     s.shadowDDAPIKey,
+		}, log, s.statsd)
+	}
+
+	if s.passthrough != nil {
+		log.Info("Starting passthrough forwarder")
+		go func() {
+			defer func() {
+				s.ConsumePanic(recover())
+			}()
+			s.forwardPassthrough()
+		}()
+	}
+
+	for _, target := range s.scrapers {
+		log.WithField("target", target.url).Info("Starting Prometheus scraper")
+		go func(target *scraper) {
+			defer func() {
+				s.ConsumePanic(recover())
+			}()
+			s.scrapeForever(target)
+		}(target)
+	}
+
+	for _, sink := range s.sinks {
+		log.WithField("sink", sink.Name()).Info("Starting sink")
+		if err := sink.Start(); err != nil {
+			log.WithError(err).WithField("sink", sink.Name()).Fatal("Could not start sink")
+		}
+	}
+
+	if s.SpanCapture != nil {
+		log.Info("Starting span capture writer")
+		go func() {
+			defer func() {
+				s.ConsumePanic(recover())
+			}()
+			s.SpanCapture.Work()
+		}()
+	}
+
 	packetPool := &sync.Pool{
 		New: func() interface{} {
-			return make([]byte, s.metricMaxLength)
+			// one byte more than the longest datagram we accept, so that
+			// ReadFrom filling the buffer means the datagram was truncated
+			return make([]byte, s.metricMaxLength+1)
 		},
 	}
 
@@ -304,10 +938,12 @@ func (s *Server) Start() {
 		defer func() {
 			s.ConsumePanic(recover())
 		}()
-		ticker := time.NewTicker(s.interval)
-		for range ticker.C {
+		s.flushScheduler.schedule(func() {
+			defer func() {
+				s.ConsumePanic(recover())
+			}()
 			s.Flush()
-		}
+		})
 	}()
 
 }
@@ -315,6 +951,12 @@ func (s *Server) Start() {
 // HandleMetricPacket processes each packet that is sent to the server, and sends to an
 // appropriate worker (EventWorker or Worker).
 func (s *Server) HandleMetricPacket(packet []byte) {
+	s.handleMetricPacket(packet, s.parser)
+}
+
+// handleMetricPacket is HandleMetricPacket, parsing metrics with the given
+// parser, which listeners get from transportParser.
+func (s *Server) handleMetricPacket(packet []byte, parser samplers.Parser) {
 	// This is a very performance-sensitive function
 	// and packets may be dropped if it gets slowed down.
 	// Keep that in mind when modifying!
@@ -325,6 +967,8 @@ func (s *Server) HandleMetricPacket(packet []byte) {
 		return
 	}
 
+	atomic.AddInt64(&s.linesReceived, 1)
+
 	if bytes.HasPrefix(packet, []byte{'_', 'e', '{'}) {
 		event, err := samplers.ParseEvent(packet)
 		if err != nil {
@@ -335,6 +979,7 @@ func (s *Server) HandleMetricPacket(packet []byte) {
 			s.statsd.Count("packet.error_total", 1, []string{"packet_type:event"}, 1.0)
 			return
 		}
+		atomic.AddInt64(&s.linesParsed, 1)
 		s.EventWorker.EventChan <- *event
 	} else if bytes.HasPrefix(packet, []byte{'_', 's', 'c'}) {
 		svcheck, err := samplers.ParseServiceCheck(packet)
@@ -346,19 +991,89 @@ func (s *Server) HandleMetricPacket(packet []byte) {
 			s.statsd.Count("packet.error_total", 1, []string{"packet_type:service_check"}, 1.0)
 			return
 		}
+		atomic.AddInt64(&s.linesParsed, 1)
 		s.EventWorker.ServiceCheckChan <- *svcheck
 	} else {
-		metric, err := samplers.ParseMetric(packet)
+		metrics, invalid, err := parser.ParseMetrics(packet)
+		if samplers.ParseErrorCause(err) == samplers.ParseErrorNaming {
+			// these are well-formed, so they're not worth logging
+			s.countNamingViolation(packet, "drop")
+			return
+		}
 		if err != nil {
 			log.WithFields(logrus.Fields{
 				logrus.ErrorKey: err,
 				"packet":        string(packet),
 			}).Error("Could not parse packet")
-			s.statsd.Count("packet.error_total", 1, []string{"packet_type:metric"}, 1.0)
+			s.statsd.Count("packet.error_total", 1, []string{"packet_type:metric", "cause:" + samplers.ParseErrorCause(err)}, 1.0)
 			return
 		}
-		s.Workers[metric.Digest%uint32(len(s.Workers))].PacketChan <- *metric
+		atomic.AddInt64(&s.linesParsed, 1)
+		if invalid > 0 {
+			s.statsd.Count("packet.invalid_values_total", int64(invalid), []string{"packet_type:metric"}, 1.0)
+		}
+		if metrics[0].TruncatedTags > 0 {
+			s.statsd.Count("packet.tags_truncated_total", 1, []string{"packet_type:metric"}, 1.0)
+		}
+		if metrics[0].NamingViolation {
+			s.countNamingViolation(packet, "tag")
+		}
+		if s.dropMetrics(metrics) {
+			return
+		}
+		for _, metric := range metrics {
+			if s.passthroughMetric(metric) {
+				continue
+			}
+			s.Workers[metric.Digest%uint32(len(s.Workers))].PacketChan <- *metric
+		}
+	}
+}
+
+// countNamingViolation counts a metric packet whose name didn't match
+// metric_name_pattern, tagged with the name's first segment (up to the first
+// dot) so that the team responsible can be found. Since the names are
+// uncontrolled, only the first maxNamingViolationPrefixes prefixes are
+// tagged, and any after that are counted as prefix:other.
+func (s *Server) countNamingViolation(packet []byte, action string) {
+	name := packet
+	if i := bytes.IndexByte(name, ':'); i >= 0 {
+		name = name[:i]
+	}
+	if i := bytes.IndexByte(name, '.'); i >= 0 {
+		name = name[:i]
 	}
+	prefix := s.namingPrefixes.value(string(name), maxNamingViolationPrefixes)
+	s.statsd.Count("packet.naming_violation_total", 1, []string{"prefix:" + prefix, "action:" + action}, 1.0)
+}
+
+// maxNamingViolationPrefixes bounds the cardinality of the prefix tag on
+// veneur.packet.naming_violation_total.
+const maxNamingViolationPrefixes = 100
+
+// boundedTagValues limits a tag to the first values it's given. The zero
+// value is ready to use.
+type boundedTagValues struct {
+	mtx  sync.Mutex
+	seen map[string]bool
+}
+
+// value returns v if it is one of the first max distinct values it was
+// given, and "other" otherwise.
+func (b *boundedTagValues) value(v string, max int) string {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.seen[v] {
+		return v
+	}
+	if len(b.seen) >= max {
+		return "other"
+	}
+	if b.seen == nil {
+		b.seen = map[string]bool{}
+	}
+	b.seen[v] = true
+	return v
 }
 
 // HandleTracePacket accepts an incoming packet as bytes and sends it to the
@@ -370,8 +1085,7 @@ func (s *Server) HandleTracePacket(packet []byte) {
 		return
 	}
 
-	// Technically this could be anything, but we're only consuming trace spans
-	// for now.
+	// This is usually a span, but can also be a metric
 	newSample := &ssf.SSFSample{}
 	err := proto.Unmarshal(packet, newSample)
 	if err != nil {
@@ -379,24 +1093,179 @@ func (s *Server) HandleTracePacket(packet []byte) {
 		return
 	}
 
+	if s.SpanCapture != nil {
+		s.SpanCapture.Capture(packet)
+	}
+
+	parser := s.transportParser(transportUDP)
+	var parse func(*ssf.SSFSample) (*samplers.UDPMetric, error)
+	switch {
+	case newSample.Metric == ssf.SSFSample_HISTOGRAM && newSample.Trace != nil:
+		// a tracer reporting how long a span took, which is aggregated
+		// like any other histogram rather than forwarded as a span
+		parse = parser.ParseSSFDuration
+	case newSample.Trace == nil && newSample.Metric != ssf.SSFSample_TRACE:
+		// a metric sent along with spans, like trace.Client's Count
+		parse = parser.ParseSSFMetric
+	}
+	if parse != nil {
+		metric, err := parse(newSample)
+		if samplers.ParseErrorCause(err) == samplers.ParseErrorNaming {
+			s.countNamingViolation([]byte(newSample.Name), "drop")
+			return
+		}
+		if err != nil {
+			log.WithError(err).Error("Could not parse SSF metric")
+			s.statsd.Count("packet.error_total", 1, []string{"packet_type:ssf_metric"}, 1.0)
+			return
+		}
+		if metric.TruncatedTags > 0 {
+			s.statsd.Count("packet.tags_truncated_total", 1, []string{"packet_type:ssf_metric"}, 1.0)
+		}
+		if metric.NamingViolation {
+			s.countNamingViolation([]byte(metric.Name), "tag")
+		}
+		if s.dropMetrics([]*samplers.UDPMetric{metric}) {
+			return
+		}
+		s.Workers[metric.Digest%uint32(len(s.Workers))].PacketChan <- *metric
+		return
+	}
+
 	s.TraceWorker.TraceChan <- *newSample
 }
 
+// transportUDP is what the transport tag calls metrics received over UDP,
+// the only transport veneur listens for metrics on so far.
+const transportUDP = "udp"
+
+// transportParser returns the parser for metrics received over the given
+// transport, which tags them with it if tag_transport is set.
+func (s *Server) transportParser(transport string) samplers.Parser {
+	parser := s.parser
+	if s.tagTransport {
+		parser.ExtraTags = []string{"transport:" + transport}
+	}
+	return parser
+}
+
+// setMulticast validates the configuration for joining a multicast group.
+func (s *Server) setMulticast(conf Config) error {
+	group := net.ParseIP(conf.UDPMulticastGroup)
+	if group == nil || !group.IsMulticast() {
+		return fmt.Errorf("udp_multicast_group %q is not a multicast address", conf.UDPMulticastGroup)
+	}
+	// a socket bound to a particular address only receives datagrams sent
+	// to that address
+	if ip := s.UDPAddr.IP; ip != nil && !ip.IsUnspecified() && !ip.Equal(group) {
+		return fmt.Errorf("udp_address %s must listen on all interfaces, or on udp_multicast_group, to receive from it", s.UDPAddr)
+	}
+	// every socket bound to the port receives a copy of each multicast
+	// datagram, so more readers would process everything more than once
+	if conf.NumReaders > 1 {
+		return errors.New("udp_multicast_group requires num_readers to be 1")
+	}
+	if conf.UDPMulticastInterface != "" {
+		ifi, err := net.InterfaceByName(conf.UDPMulticastInterface)
+		if err != nil {
+			return fmt.Errorf("udp_multicast_interface: %s", err)
+		}
+		s.multicastInterface = ifi
+	}
+	s.multicastGroup = group
+	s.multicastJoinOptional = conf.UDPMulticastJoinOptional
+	return nil
+}
+
+// joinMulticast joins the UDP listener to the multicast group. If that
+// fails, veneur exits, unless joining was configured to be optional, in which
+// case it carries on receiving only the datagrams sent to it directly.
+func (s *Server) joinMulticast(conn net.PacketConn) {
+	logger := log.WithField("group", s.multicastGroup)
+	if s.multicastInterface != nil {
+		logger = logger.WithField("interface", s.multicastInterface.Name)
+	}
+	if err := joinMulticast(conn, s.multicastGroup, s.multicastInterface); err != nil {
+		if s.multicastJoinOptional {
+			s.statsd.Count("multicast.join_error_total", 1, nil, 1.0)
+			logger.WithError(err).Error("Could not join multicast group, continuing without it")
+			return
+		}
+		logger.WithError(err).Fatal("Could not join multicast group")
+	}
+	logger.Info("Joined multicast group for UDP metrics")
+}
+
+// defaultSinkMaxRetries is how many times a request to a sink may be
+// retried, if sink_retry_budget_rate is set but sink_max_retries isn't.
+const defaultSinkMaxRetries = 2
+
+// defaultMaxTagsPerMetric is the most tags a metric may have if
+// max_tags_per_metric isn't set, which is Datadog's per-metric tag limit.
+const defaultMaxTagsPerMetric = 100
+
+// defaultMetricMaxLineLength is the longest metric line accepted if
+// metric_max_line_length isn't set, which is as long as the datagrams that
+// DogStatsD clients send over Unix domain sockets by default.
+const defaultMetricMaxLineLength = 8192
+
+// handleMetricDatagram handles each line of a datagram of metrics. statsd
+// allows multiple packets to be joined by newlines and sent as one larger
+// packet. Note that spurious newlines are not allowed in this format, it has
+// to be exactly one newline between each packet, with no leading or trailing
+// newlines.
+//
+// Lines longer than metricMaxLineLength are dropped whole, as is the last
+// line of a datagram that was truncated because it didn't fit in the read
+// buffer, since parsing part of a line can silently produce the wrong metric
+// (eg by losing its tags or sample rate).
+func (s *Server) handleMetricDatagram(datagram []byte, truncated bool, parser samplers.Parser) {
+	splitPacket := samplers.NewSplitBytes(datagram, '\n')
+	for splitPacket.Next() {
+		line := splitPacket.Chunk()
+		if truncated && splitPacket.Last() {
+			s.statsd.Count("packet.line_too_long_total", 1, []string{"transport:" + transportUDP, "cause:truncated"}, 1.0)
+			continue
+		}
+		if len(line) > s.metricMaxLineLength {
+			s.statsd.Count("packet.line_too_long_total", 1, []string{"transport:" + transportUDP, "cause:length"}, 1.0)
+			continue
+		}
+		s.handleMetricPacket(line, parser)
+	}
+}
+
 // ReadMetricSocket listens for available packets to handle.
 func (s *Server) ReadMetricSocket(packetPool *sync.Pool, reuseport bool) {
-	// each goroutine gets its own socket
-	// if the sockets support SO_REUSEPORT, then this will cause the
-	// kernel to distribute datagrams across them, for better read
-	// performance
-	serverConn, err := NewSocket(s.UDPAddr, s.RcvbufBytes, reuseport)
-	if err != nil {
-		// if any goroutine fails to create the socket, we can't really
-		// recover, so we just blow up
-		// this probably indicates a systemic issue, eg lack of
-		// SO_REUSEPORT support
-		log.WithError(err).Fatal("Error listening for UDP metrics")
+	// a socket inherited from systemd is shared by every goroutine, and
+	// set up by the first
+	serverConn, first := s.activated.take(s.UDPAddr)
+	if serverConn != nil {
+		if first {
+			log.WithField("address", s.UDPAddr).Info("Listening for UDP metrics on the socket systemd passed")
+		}
+	} else {
+		// each goroutine gets its own socket
+		// if the sockets support SO_REUSEPORT, then this will cause the
+		// kernel to distribute datagrams across them, for better read
+		// performance
+		var err error
+		serverConn, err = NewSocket(s.UDPAddr, s.RcvbufBytes, reuseport)
+		if err != nil {
+			// if any goroutine fails to create the socket, we can't really
+			// recover, so we just blow up
+			// this probably indicates a systemic issue, eg lack of
+			// SO_REUSEPORT support
+			log.WithError(err).Fatal("Error listening for UDP metrics")
+		}
+		log.WithField("address", s.UDPAddr).Info("Listening for UDP metrics")
+		first = true
+	}
+	if s.multicastGroup != nil && first {
+		s.joinMulticast(serverConn)
 	}
-	log.WithField("address", s.UDPAddr).Info("Listening for UDP metrics")
+	parser := s.transportParser(transportUDP)
+	stats := s.readers.add()
 
 	for {
 		buf := packetPool.Get().([]byte)
@@ -405,16 +1274,9 @@ func (s *Server) ReadMetricSocket(packetPool *sync.Pool, reuseport bool) {
 			log.WithError(err).Error("Error reading from UDP metrics socket")
 			continue
 		}
-
-		// statsd allows multiple packets to be joined by newlines and sent as
-		// one larger packet
-		// note that spurious newlines are not allowed in this format, it has
-		// to be exactly one newline between each packet, with no leading or
-		// trailing newlines
-		splitPacket := samplers.NewSplitBytes(buf[:n], '\n')
-		for splitPacket.Next() {
-			s.HandleMetricPacket(splitPacket.Chunk())
-		}
+		atomic.AddInt64(&s.packetsReceived, 1)
+		stats.read(n)
+		s.handleMetricDatagram(buf[:n], n == len(buf), parser)
 
 		// the Metric struct created by HandleMetricPacket has no byte slices in it,
 		// only strings
@@ -433,15 +1295,21 @@ func (s *Server) ReadTraceSocket(packetPool *sync.Pool, reuseport bool) {
 		log.WithField("s.TraceAddr", s.TraceAddr).Fatal("Cannot listen on nil trace address")
 	}
 
-	serverConn, err := NewSocket(s.TraceAddr, s.RcvbufBytes, reuseport)
-	if err != nil {
-		// if any goroutine fails to create the socket, we can't really
-		// recover, so we just blow up
-		// this probably indicates a systemic issue, eg lack of
-		// SO_REUSEPORT support
-		log.WithError(err).Fatal("Error listening for UDP traces")
+	serverConn, _ := s.activated.take(s.TraceAddr)
+	if serverConn != nil {
+		log.WithField("address", s.TraceAddr).Info("Listening for UDP traces on the socket systemd passed")
+	} else {
+		var err error
+		serverConn, err = NewSocket(s.TraceAddr, s.RcvbufBytes, reuseport)
+		if err != nil {
+			// if any goroutine fails to create the socket, we can't really
+			// recover, so we just blow up
+			// this probably indicates a systemic issue, eg lack of
+			// SO_REUSEPORT support
+			log.WithError(err).Fatal("Error listening for UDP traces")
+		}
+		log.WithField("address", s.TraceAddr).Info("Listening for UDP traces")
 	}
-	log.WithField("address", s.TraceAddr).Info("Listening for UDP traces")
 
 	for {
 		buf := packetPool.Get().([]byte)
@@ -477,6 +1345,9 @@ func (s *Server) HTTPServe() {
 		}()
 	}
 	httpSocket := bind.Socket(s.HTTPAddr)
+	if s.httpTLS != nil {
+		httpSocket = tls.NewListener(httpSocket, s.httpTLS)
+	}
 	graceful.Timeout(10 * time.Second)
 	graceful.PreHook(func() {
 
@@ -491,14 +1362,14 @@ func (s *Server) HTTPServe() {
 	// when *not* running under einhorn.
 	graceful.AddSignal(syscall.SIGUSR2, syscall.SIGHUP)
 	graceful.HandleSignals()
-	log.WithField("address", s.HTTPAddr).Info("HTTP server listening")
+	log.WithField("address", s.HTTPAddr).WithField("tls", s.httpTLS != nil).Info("HTTP server listening")
 	bind.Ready()
 
 	if err := graceful.Serve(httpSocket, s.Handler()); err != nil {
 		log.WithError(err).Error("HTTP server shut down due to error")
 	}
 
-	graceful.Shutdown()
+	s.Shutdown()
 }
 
 // Shutdown signals the server to shut down after closing all
@@ -507,6 +1378,18 @@ func (s *Server) Shutdown() {
 	// TODO(aditya) shut down workers and socket readers
 	log.Info("Shutting down server gracefully")
 	graceful.Shutdown()
+	// waits for a flush that is running, so that the sinks aren't flushed
+	// to after they're stopped
+	s.flushScheduler.stop()
+	if s.SpanCapture != nil {
+		// so that the capture file being written is complete
+		s.SpanCapture.Stop()
+	}
+	for _, sink := range s.sinks {
+		if err := sink.Stop(); err != nil {
+			log.WithError(err).WithField("sink", sink.Name()).Error("Could not stop sink")
+		}
+	}
 }
 
 // IsLocal indicates whether veneur is running as a local instance
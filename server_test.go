@@ -10,10 +10,13 @@ import (
 	"fmt"
 	"io"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -23,9 +26,11 @@ import (
 	"github.com/Sirupsen/logrus"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/golang/protobuf/proto"
 	"github.com/stretchr/testify/assert"
 	s3p "github.com/stripe/veneur/plugins/s3"
 	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
 	"github.com/stripe/veneur/tdigest"
 )
 
@@ -257,6 +262,32 @@ func TestGlobalServerFlush(t *testing.T) {
 	assertMetrics(t, ddmetrics, expectedMetrics)
 }
 
+func TestGlobalServerFlushCountersAsCounts(t *testing.T) {
+	config := globalConfig()
+	config.FlushCountersAsCounts = true
+	f := newFixture(t, config)
+	defer f.Close()
+
+	for i := 0; i < 40; i++ {
+		f.server.Workers[0].ProcessMetric(&samplers.UDPMetric{
+			MetricKey: samplers.MetricKey{
+				Name: "x.y.z",
+				Type: "counter",
+			},
+			Value:      1.0,
+			Digest:     12345,
+			SampleRate: 1.0,
+		})
+	}
+
+	f.server.Flush()
+
+	ddmetrics := <-f.ddmetrics
+	assert.Equal(t, 1, len(ddmetrics.Series), "incorrect number of elements in the flushed series on the remote server")
+	assert.Equal(t, "count", ddmetrics.Series[0].MetricType, "counter should be flushed as a count")
+	assertMetric(t, ddmetrics, "x.y.z", 40)
+}
+
 func TestLocalServerMixedMetrics(t *testing.T) {
 	// The exact gob stream that we will receive might differ, so we can't
 	// test against the bytestream directly. But the two streams should unmarshal
@@ -569,3 +600,237 @@ func assertCSVFieldsMatch(t *testing.T, expected, actual [][]string, columns []i
 		}
 	}
 }
+
+// TestHandleTracePacketDuration tests that span durations reported by a
+// tracer are aggregated as metrics rather than treated as spans.
+func TestHandleTracePacketDuration(t *testing.T) {
+	s := Server{Workers: []*Worker{NewWorker(1, nil, logrus.New())}}
+	packet, err := proto.Marshal(&ssf.SSFSample{
+		Metric: ssf.SSFSample_HISTOGRAM,
+		Name:   "a.b.c.duration",
+		Tags:   []*ssf.SSFTag{{Name: "resource", Value: "r"}},
+		Unit:   "ms",
+		Trace:  &ssf.SSFTrace{Duration: int64(2 * time.Millisecond)},
+	})
+	assert.NoError(t, err)
+
+	// TraceWorker is nil, so this would panic if it were treated as a span
+	go s.HandleTracePacket(packet)
+	select {
+	case m := <-s.Workers[0].PacketChan:
+		assert.Equal(t, "a.b.c.duration", m.Name)
+		assert.Equal(t, "timer", m.Type)
+		assert.Equal(t, []string{"resource:r"}, m.Tags)
+		assert.Equal(t, float64(2), m.Value)
+	case <-time.After(time.Second):
+		assert.Fail(t, "duration was not sent to a worker")
+	}
+}
+
+// TestHandleTracePacketMetric tests that metrics sent as SSF samples on the
+// trace listener, alongside spans, are aggregated.
+func TestHandleTracePacketMetric(t *testing.T) {
+	s := Server{Workers: []*Worker{NewWorker(1, nil, logrus.New())}}
+	packet, err := proto.Marshal(&ssf.SSFSample{
+		Metric: ssf.SSFSample_COUNTER,
+		Name:   "a.b.c",
+		Value:  2,
+		Tags:   []*ssf.SSFTag{{Name: "foo", Value: "bar"}},
+	})
+	assert.NoError(t, err)
+
+	// TraceWorker is nil, so this would panic if it were treated as a span
+	go s.HandleTracePacket(packet)
+	select {
+	case m := <-s.Workers[0].PacketChan:
+		assert.Equal(t, "a.b.c", m.Name)
+		assert.Equal(t, "counter", m.Type)
+		assert.Equal(t, []string{"foo:bar"}, m.Tags)
+		assert.Equal(t, float64(2), m.Value)
+	case <-time.After(time.Second):
+		assert.Fail(t, "metric was not sent to a worker")
+	}
+}
+
+// TestTransportTag tests that metrics are tagged with the transport they
+// arrived on only if tag_transport is set.
+func TestTransportTag(t *testing.T) {
+	for _, tagTransport := range []bool{false, true} {
+		s := Server{
+			Workers:      []*Worker{NewWorker(1, nil, logrus.New())},
+			tagTransport: tagTransport,
+		}
+		go s.handleMetricPacket([]byte("a.b.c:1|c|#foo:bar"), s.transportParser(transportUDP))
+		select {
+		case m := <-s.Workers[0].PacketChan:
+			if tagTransport {
+				assert.Equal(t, []string{"foo:bar", "transport:udp"}, m.Tags)
+			} else {
+				assert.Equal(t, []string{"foo:bar"}, m.Tags)
+			}
+		case <-time.After(time.Second):
+			assert.Fail(t, "metric was not sent to a worker")
+		}
+	}
+}
+
+// TestIngestFunnel tests that lines are counted as they are received and
+// parsed.
+func TestIngestFunnel(t *testing.T) {
+	s := Server{Workers: []*Worker{NewWorker(1, nil, logrus.New())}}
+	go func() {
+		for range s.Workers[0].PacketChan {
+		}
+	}()
+	s.HandleMetricPacket([]byte("a.b.c:1|c"))
+	s.HandleMetricPacket([]byte("a.b.c:1:2|h"))
+	s.HandleMetricPacket([]byte("a.b.c:x|c"))
+	s.HandleMetricPacket([]byte(""))
+	close(s.Workers[0].PacketChan)
+
+	assert.Equal(t, int64(3), atomic.LoadInt64(&s.linesReceived), "empty lines aren't counted")
+	assert.Equal(t, int64(2), atomic.LoadInt64(&s.linesParsed))
+}
+
+// TestStartedServerFlushes checks that the flushes Start schedules report
+// what the started server's readers received, rather than the counts of
+// another copy of the Server.
+func TestStartedServerFlushes(t *testing.T) {
+	stats, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stats.Close()
+	free, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := free.LocalAddr().String()
+	free.Close()
+
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+
+	config := globalConfig()
+	config.APIHostname = api.URL
+	config.StatsAddress = stats.LocalAddr().String()
+	config.UdpAddress = addr
+	want := map[string]bool{"veneur.ingest.packets_received_total": false}
+	if reuseportSupported {
+		config.NumReaders = 2
+		want["veneur.ingest.reader_packets_received_total"] = false
+	}
+	server := setupVeneurServer(t, config)
+	defer server.Shutdown()
+
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 8192)
+	deadline := time.Now().Add(5 * time.Second)
+	for seen := 0; seen < len(want); {
+		if time.Now().After(deadline) {
+			t.Fatalf("never saw nonzero counts of all of %v", want)
+		}
+		conn.Write([]byte("a.b.c:1|c"))
+		stats.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		n, _, err := stats.ReadFrom(buf)
+		if err != nil {
+			continue
+		}
+		for _, line := range strings.Split(string(buf[:n]), "\n") {
+			name := strings.SplitN(line, ":", 2)[0]
+			if found, ok := want[name]; ok && !found && !strings.HasPrefix(line, name+":0|") {
+				want[name] = true
+				seen++
+			}
+		}
+	}
+}
+
+func TestMetricNameViolations(t *testing.T) {
+	config := localConfig()
+	config.MetricNamePattern = `^[a-z]+\.`
+	config.MetricNameViolations = "tag"
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	s.Workers = []*Worker{NewWorker(1, nil, logrus.New())}
+
+	go s.HandleMetricPacket([]byte("Latency:1|c"))
+	select {
+	case m := <-s.Workers[0].PacketChan:
+		assert.Equal(t, []string{samplers.NamingViolationTag}, m.Tags)
+	case <-time.After(time.Second):
+		assert.Fail(t, "a tagged violation should still be sent to a worker")
+	}
+
+	config = localConfig()
+	config.MetricNameViolations = "warn"
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+	config.MetricNameViolations = ""
+	config.MetricNamePattern = "("
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestMetricMaxLineLength(t *testing.T) {
+	config := localConfig()
+	config.MetricMaxLineLength = 10
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	s.Workers = []*Worker{NewWorker(1, nil, logrus.New())}
+	s.Workers[0].PacketChan = make(chan samplers.UDPMetric, 10)
+
+	// the long line is dropped whole, and so is the partial line at the end
+	// of a truncated datagram
+	s.handleMetricDatagram([]byte("a.b:1|c\na.b.c.d.e:1|c\nc.d:1|c\ne.f:1|c|#fo"), true, s.parser)
+	close(s.Workers[0].PacketChan)
+	var names []string
+	for m := range s.Workers[0].PacketChan {
+		names = append(names, m.Name)
+	}
+	assert.Equal(t, []string{"a.b", "c.d"}, names)
+
+	config.MetricMaxLineLength = -1
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+}
+
+func TestMulticastConfig(t *testing.T) {
+	for _, c := range []struct {
+		group, address string
+		readers        int
+		ok             bool
+	}{
+		{"239.255.82.1", "0.0.0.0:0", 1, true},
+		{"239.255.82.1", "239.255.82.1:0", 1, true},
+		{"10.0.0.1", "0.0.0.0:0", 1, false},
+		{"239.255.82.1", "127.0.0.1:0", 1, false},
+		{"239.255.82.1", "0.0.0.0:0", 2, false},
+	} {
+		config := localConfig()
+		config.UDPMulticastGroup = c.group
+		config.UdpAddress = c.address
+		config.NumReaders = c.readers
+		_, err := NewFromConfig(config)
+		if c.ok {
+			assert.NoError(t, err, "group %s on %s with %d readers", c.group, c.address, c.readers)
+		} else {
+			assert.Error(t, err, "group %s on %s with %d readers", c.group, c.address, c.readers)
+		}
+	}
+}
+
+func TestBoundedTagValues(t *testing.T) {
+	var b boundedTagValues
+	assert.Equal(t, "a", b.value("a", 2))
+	assert.Equal(t, "b", b.value("b", 2))
+	assert.Equal(t, "other", b.value("c", 2), "values past the limit should be bucketed")
+	assert.Equal(t, "a", b.value("a", 2), "values already seen should still be kept")
+}
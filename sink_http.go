@@ -0,0 +1,156 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/stripe/veneur/plugins"
+)
+
+const (
+	// defaultIdleConnTimeout is how long an idle connection to a sink is
+	// kept open, if its pool doesn't set idle_conn_timeout. It should be
+	// longer than the flush interval, so that connections survive from one
+	// flush to the next.
+	defaultIdleConnTimeout = 90 * time.Second
+	// defaultMaxRequestsInFlight is how many requests a sink has open to a
+	// host at once, if its pool doesn't set max_requests_in_flight.
+	defaultMaxRequestsInFlight = 16
+	influxDBSinkName           = "influxdb"
+	cloudMonitoringSinkName    = "cloud_monitoring"
+	// forwarding to a global veneur, including passthroughs and dead
+	// letters, for http_sink_encodings
+	forwardSinkName = "forward"
+	zipkinSinkName  = "zipkin"
+)
+
+// defaultSinkEncodings are the Content-Encodings that each HTTP sink
+// compresses its bodies with, unless http_sink_encodings says otherwise.
+// Datadog's series and events, and global veneurs, have always taken
+// deflate; the others are sent uncompressed, which every version of them
+// accepts. Datadog's service checks and traces are never compressed, since
+// their endpoints don't document any encoding.
+var defaultSinkEncodings = map[string]string{
+	datadogSinkName:         plugins.EncodingDeflate,
+	forwardSinkName:         plugins.EncodingDeflate,
+	zipkinSinkName:          plugins.EncodingNone,
+	influxDBSinkName:        plugins.EncodingNone,
+	cloudMonitoringSinkName: plugins.EncodingNone,
+}
+
+// HTTPPool configures the pool of idle connections that an HTTP sink keeps
+// open between flushes. MaxIdleConnsPerHost defaults to Go's default of 2,
+// which should be raised to the number of bodies posted concurrently (see
+// flush_max_per_body) for all of them to reuse connections.
+//
+// MaxRequestsInFlight bounds how many requests the sink has open to a host at
+// once, defaulting to defaultMaxRequestsInFlight; the rest wait for one of
+// them to finish. RequestTimeout is how long each request, including the time
+// it waits for its turn, may take before it fails (and may be retried),
+// defaulting to the sink's flush timeout.
+type HTTPPool struct {
+	MaxIdleConnsPerHost int    `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     string `yaml:"idle_conn_timeout"`
+	MaxRequestsInFlight int    `yaml:"max_requests_in_flight"`
+	RequestTimeout      string `yaml:"request_timeout"`
+}
+
+// newSinkHTTPClient creates an HTTP client for a sink, whose requests time
+// out after timeout, and which keeps connections open between requests and
+// bounds how many it makes at once as configured by pool.
+func newSinkHTTPClient(timeout time.Duration, pool HTTPPool) (*http.Client, error) {
+	if pool.RequestTimeout != "" {
+		requestTimeout, err := time.ParseDuration(pool.RequestTimeout)
+		if err != nil {
+			return nil, err
+		}
+		if requestTimeout <= 0 {
+			return nil, fmt.Errorf("request_timeout must be positive, got %s", pool.RequestTimeout)
+		}
+		timeout = requestTimeout
+	}
+	idleConnTimeout := defaultIdleConnTimeout
+	if pool.IdleConnTimeout != "" {
+		var err error
+		idleConnTimeout, err = time.ParseDuration(pool.IdleConnTimeout)
+		if err != nil {
+			return nil, err
+		}
+	}
+	maxIdleConnsPerHost := pool.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+	}
+	if pool.MaxRequestsInFlight < 0 {
+		return nil, fmt.Errorf("max_requests_in_flight must not be negative, got %d", pool.MaxRequestsInFlight)
+	}
+
+	return &http.Client{
+		// each attempt at a request has its own deadline, so one that is
+		// stuck waiting for a connection fails and is retried (or given up
+		// on) rather than holding up the rest of the flush
+		Timeout: timeout,
+		// the same as http.DefaultTransport, except for the pool settings.
+		// Each request needs a connection of its own, so bounding them
+		// bounds the requests in flight, and the file descriptors they use;
+		// the transport queues the rest until a connection is free
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:          100,
+			MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+			MaxConnsPerHost:       maxRequestsInFlight(pool),
+			IdleConnTimeout:       idleConnTimeout,
+			TLSHandshakeTimeout:   10 * time.Second,
+			ExpectContinueTimeout: 1 * time.Second,
+		},
+	}, nil
+}
+
+// maxRequestsInFlight returns how many requests a sink with the given pool
+// may have open to a host at once.
+func maxRequestsInFlight(pool HTTPPool) int {
+	if pool.MaxRequestsInFlight > 0 {
+		return pool.MaxRequestsInFlight
+	}
+	return defaultMaxRequestsInFlight
+}
+
+// checkHTTPPools returns an error if any of the pools are for sinks that
+// don't flush over HTTP.
+func checkHTTPPools(pools map[string]HTTPPool) error {
+	for sink := range pools {
+		if sink != datadogSinkName && sink != influxDBSinkName && sink != cloudMonitoringSinkName {
+			return fmt.Errorf("http_sink_pools: %q is not an HTTP sink", sink)
+		}
+	}
+	return nil
+}
+
+// checkHTTPSinkEncodings returns an error if any of the encodings are for
+// sinks that don't flush over HTTP, or aren't supported.
+func checkHTTPSinkEncodings(encodings map[string]string) error {
+	for sink, encoding := range encodings {
+		if _, ok := defaultSinkEncodings[sink]; !ok {
+			return fmt.Errorf("http_sink_encodings: %q is not an HTTP sink", sink)
+		}
+		if err := plugins.CheckContentEncoding(encoding); err != nil {
+			return fmt.Errorf("http_sink_encodings: %q: %s", sink, err)
+		}
+	}
+	return nil
+}
+
+// sinkEncoding returns the Content-Encoding that sink compresses its bodies
+// with.
+func (s *Server) sinkEncoding(sink string) string {
+	if encoding, ok := s.sinkEncodings[sink]; ok {
+		return encoding
+	}
+	return defaultSinkEncodings[sink]
+}
@@ -0,0 +1,211 @@
+package veneur
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestSinkHTTPClientReusesConnections(t *testing.T) {
+	var connections int32
+	api := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	api.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&connections, 1)
+		}
+	}
+	api.Start()
+	defer api.Close()
+
+	client, err := newSinkHTTPClient(time.Second, HTTPPool{MaxIdleConnsPerHost: 4, IdleConnTimeout: "1m"})
+	assert.NoError(t, err)
+	s := &Server{
+		DDHostname:      api.URL,
+		HTTPClient:      client,
+		FlushMaxPerBody: 100,
+	}
+	metrics := []samplers.DDMetric{{
+		Name:       "a.b.c",
+		Value:      [1][2]float64{{1500000000, 1}},
+		MetricType: "gauge",
+		Hostname:   "localhost",
+	}}
+	for i := 0; i < 3; i++ {
+		s.flushRemote(context.Background(), metrics)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&connections), "consecutive flushes should reuse the same connection")
+}
+
+func TestHTTPSinkPoolsConfig(t *testing.T) {
+	config := localConfig()
+	config.HTTPSinkPools = map[string]HTTPPool{"s3": {MaxIdleConnsPerHost: 4}}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "s3 doesn't flush over HTTP")
+
+	config = localConfig()
+	config.HTTPSinkPools = map[string]HTTPPool{"datadog": {IdleConnTimeout: "forever"}}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+
+	config = localConfig()
+	config.HTTPSinkPools = map[string]HTTPPool{"datadog": {MaxIdleConnsPerHost: 8, IdleConnTimeout: "2m"}}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	transport := s.HTTPClient.Transport.(*http.Transport)
+	assert.Equal(t, 8, transport.MaxIdleConnsPerHost)
+	assert.Equal(t, 2*time.Minute, transport.IdleConnTimeout)
+	assert.Equal(t, defaultMaxRequestsInFlight, transport.MaxConnsPerHost)
+	assert.Equal(t, s.flushTimeout, s.HTTPClient.Timeout)
+
+	config = localConfig()
+	config.HTTPSinkPools = map[string]HTTPPool{"datadog": {MaxRequestsInFlight: -1}}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+
+	config = localConfig()
+	config.HTTPSinkPools = map[string]HTTPPool{"datadog": {RequestTimeout: "0s"}}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err)
+
+	config = localConfig()
+	config.HTTPSinkPools = map[string]HTTPPool{"datadog": {MaxRequestsInFlight: 4, RequestTimeout: "2s"}}
+	s, err = NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, s.HTTPClient.Transport.(*http.Transport).MaxConnsPerHost)
+	assert.Equal(t, 4, s.maxRequestsInFlight)
+	assert.Equal(t, 2*time.Second, s.HTTPClient.Timeout)
+}
+
+func TestSinkHTTPClientBoundsRequestsInFlight(t *testing.T) {
+	var inFlight, most int32
+	release := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&inFlight, 1)
+		for {
+			m := atomic.LoadInt32(&most)
+			if n <= m || atomic.CompareAndSwapInt32(&most, m, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&inFlight, -1)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+
+	client, err := newSinkHTTPClient(5*time.Second, HTTPPool{MaxRequestsInFlight: 2})
+	assert.NoError(t, err)
+	// more chunks are POSTed at once than the client will send
+	s := &Server{HTTPClient: client, maxRequestsInFlight: 8}
+	chunks := make([][]samplers.DDMetric, 6)
+	for i := range chunks {
+		chunks[i] = []samplers.DDMetric{{Name: "a.b.c", MetricType: "gauge"}}
+	}
+	done := make(chan error)
+	go func() {
+		done <- s.flushParts(context.Background(), api.URL, "key", chunks, "flush")
+	}()
+	for atomic.LoadInt32(&inFlight) < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&most), "the rest should wait for a connection")
+}
+
+func TestSinkHTTPClientRequestTimeout(t *testing.T) {
+	release := make(chan struct{})
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer api.Close()
+	defer close(release)
+
+	client, err := newSinkHTTPClient(time.Minute, HTTPPool{MaxRequestsInFlight: 1, RequestTimeout: "50ms"})
+	assert.NoError(t, err)
+	start := time.Now()
+	_, err = client.Get(api.URL)
+	assert.Error(t, err, "a request that takes longer than request_timeout should fail")
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestPostHelperContentEncodings(t *testing.T) {
+	body := map[string][]samplers.DDMetric{"series": seriesMetrics(100)}
+	for _, encoding := range []string{plugins.EncodingNone, plugins.EncodingGzip, plugins.EncodingDeflate} {
+		t.Run(encoding, func(t *testing.T) {
+			var received map[string][]samplers.DDMetric
+			sink := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var reader io.Reader = r.Body
+				switch r.Header.Get("Content-Encoding") {
+				case "gzip":
+					gz, err := gzip.NewReader(r.Body)
+					assert.NoError(t, err)
+					reader = gz
+				case "deflate":
+					zr, err := zlib.NewReader(r.Body)
+					assert.NoError(t, err)
+					reader = zr
+				case "":
+				default:
+					t.Errorf("unexpected Content-Encoding %q", r.Header.Get("Content-Encoding"))
+				}
+				assert.NoError(t, json.NewDecoder(reader).Decode(&received))
+				w.WriteHeader(http.StatusAccepted)
+			}))
+			defer sink.Close()
+
+			s := &Server{HTTPClient: &http.Client{}, sinkEncodings: map[string]string{datadogSinkName: encoding}}
+			assert.NoError(t, s.postHelper(context.Background(), sink.URL, body, "flush", s.sinkEncoding(datadogSinkName)))
+			assert.Equal(t, body, received, "the sink should get a body it can decode")
+		})
+	}
+}
+
+func TestForwardGzip(t *testing.T) {
+	global := setupVeneurServer(t, globalConfig())
+	defer global.Shutdown()
+	globalVeneur := httptest.NewServer(handleImport(&global))
+	defer globalVeneur.Close()
+
+	s := &Server{HTTPClient: &http.Client{}, sinkEncodings: map[string]string{forwardSinkName: plugins.EncodingGzip}}
+	metrics := []samplers.JSONMetric{{MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "counter"}, Value: []byte{0, 0, 0, 0, 0, 0, 0, 1}}}
+	assert.NoError(t, s.postHelper(context.Background(), globalVeneur.URL+"/import", metrics, "forward", s.sinkEncoding(forwardSinkName)), "a global veneur should accept gzipped forwards")
+}
+
+func TestHTTPSinkEncodingsConfig(t *testing.T) {
+	s := &Server{}
+	assert.Equal(t, plugins.EncodingDeflate, s.sinkEncoding(datadogSinkName))
+	assert.Equal(t, plugins.EncodingDeflate, s.sinkEncoding(forwardSinkName))
+	assert.Equal(t, plugins.EncodingNone, s.sinkEncoding(zipkinSinkName))
+
+	config := localConfig()
+	config.HTTPSinkEncodings = map[string]string{"s3": "gzip"}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "s3 doesn't flush over HTTP")
+
+	config.HTTPSinkEncodings = map[string]string{"datadog": "zstd"}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "zstd isn't supported")
+
+	config.HTTPSinkEncodings = map[string]string{"zipkin": "gzip"}
+	server, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, plugins.EncodingGzip, server.sinkEncoding(zipkinSinkName))
+	assert.Equal(t, plugins.EncodingDeflate, server.sinkEncoding(datadogSinkName), "other sinks keep their defaults")
+}
@@ -0,0 +1,83 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+// SinkConfig selects a sink that was registered with plugins.RegisterSink,
+// by the name it was registered under. Config is passed to the sink's
+// factory as it is.
+type SinkConfig struct {
+	Name   string            `yaml:"name"`
+	Config map[string]string `yaml:"config"`
+}
+
+// registeredSink flushes metrics to a plugins.Sink like any other plugin, so
+// that it is routed, timed out and reported on the same way.
+type registeredSink struct {
+	sink plugins.Sink
+}
+
+func (p registeredSink) Flush(metrics []samplers.DDMetric, hostname string) error {
+	return p.sink.Flush(metrics)
+}
+
+func (p registeredSink) Name() string {
+	return p.sink.Name()
+}
+
+// TakesDistributions passes on whether the sink takes distributions, if it
+// says.
+func (p registeredSink) TakesDistributions() bool {
+	return takesDistributions(p.sink)
+}
+
+// newSinks creates the sinks selected by the sinks option. They are checked
+// against the other plugins, so that two destinations can't share a name.
+func (s *Server) newSinks(configs []SinkConfig) error {
+	for i, config := range configs {
+		sink, err := plugins.NewSink(config.Name, config.Config)
+		if err != nil {
+			return fmt.Errorf("sinks: sink %d: %s", i, err)
+		}
+		name := sink.Name()
+		if name == datadogSinkName || name == scrapeSinkName {
+			return fmt.Errorf("sinks: sink %d is named %q, which is reserved", i, name)
+		}
+		for _, p := range s.getPlugins() {
+			if p.Name() == name {
+				return fmt.Errorf("sinks: sink %d is named %q, like another sink", i, name)
+			}
+		}
+		s.registerPlugin(registeredSink{sink})
+		s.sinks = append(s.sinks, sink)
+	}
+	return nil
+}
+
+// flushSpansToSinks hands the spans received since the last flush to every
+// sink selected by the sinks option.
+func (s *Server) flushSpansToSinks(ctx context.Context, spans []ssf.SSFSample) {
+	for _, sink := range s.sinks {
+		start := time.Now()
+		err := s.flushSink(ctx, sink.Name(), func(context.Context) error {
+			return sink.FlushSpans(spans)
+		})
+		if err == errSinkSkipped {
+			continue
+		}
+		s.statsd.TimeInMilliseconds(fmt.Sprintf("flush.plugins.%s.total_duration_ns", sink.Name()), float64(time.Since(start).Nanoseconds()), []string{"part:spans"}, 1.0)
+		if err != nil {
+			log.WithError(err).WithField("sink", sink.Name()).Error("Could not flush spans")
+			s.statsd.Count(fmt.Sprintf("flush.plugins.%s.span_error_total", sink.Name()), 1, nil, 1.0)
+			continue
+		}
+		s.statsd.Gauge(fmt.Sprintf("flush.plugins.%s.post_spans_total", sink.Name()), float64(len(spans)), nil, 1.0)
+	}
+}
@@ -0,0 +1,109 @@
+package veneur
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/plugins"
+	"github.com/stripe/veneur/samplers"
+	"github.com/stripe/veneur/ssf"
+)
+
+// recordingSink keeps what it was flushed, for testing the sinks option.
+type recordingSink struct {
+	name string
+
+	sync.Mutex
+	stopped bool
+	metrics []samplers.DDMetric
+	spans   []ssf.SSFSample
+}
+
+func (s *recordingSink) Name() string { return s.name }
+
+func (s *recordingSink) Start() error { return nil }
+
+func (s *recordingSink) Flush(metrics []samplers.DDMetric) error {
+	s.Lock()
+	defer s.Unlock()
+	s.metrics = append(s.metrics, metrics...)
+	return nil
+}
+
+func (s *recordingSink) FlushSpans(spans []ssf.SSFSample) error {
+	s.Lock()
+	defer s.Unlock()
+	s.spans = append(s.spans, spans...)
+	return nil
+}
+
+func (s *recordingSink) Stop() error {
+	s.Lock()
+	defer s.Unlock()
+	s.stopped = true
+	return nil
+}
+
+var recordingSinks = map[string]*recordingSink{}
+
+func init() {
+	plugins.RegisterSink("recording", func(config map[string]string) (plugins.Sink, error) {
+		sink := &recordingSink{name: config["name"]}
+		if sink.name == "" {
+			sink.name = "recording"
+		}
+		recordingSinks[sink.name] = sink
+		return sink, nil
+	})
+}
+
+func TestSinksConfig(t *testing.T) {
+	config := localConfig()
+	config.Sinks = []SinkConfig{{Name: "recorder"}}
+	_, err := NewFromConfig(config)
+	if assert.Error(t, err, "a sink that isn't registered should be an error at startup") {
+		assert.Contains(t, err.Error(), `"recorder"`)
+		assert.Contains(t, err.Error(), "recording", "the error should say which sinks are registered")
+	}
+
+	config.Sinks = []SinkConfig{{Name: "recording", Config: map[string]string{"name": datadogSinkName}}}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "a sink can't be named like a built-in one")
+
+	config.Sinks = []SinkConfig{{Name: "recording"}, {Name: "recording"}}
+	_, err = NewFromConfig(config)
+	assert.Error(t, err, "two sinks can't have the same name")
+
+	config.Sinks = []SinkConfig{{Name: "recording", Config: map[string]string{"name": "backend"}}}
+	config.MetricRoutes = []MetricRoute{{Name: "^a\\.", Sinks: []string{"backend"}}}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err, "registered sinks should be routable by name")
+	if assert.Len(t, s.sinks, 1) {
+		assert.Equal(t, "backend", s.sinks[0].Name())
+	}
+	assert.Equal(t, redactedValue, redactConfig(config).Sinks[0].Config["name"], "sink configs may hold secrets")
+	assert.Equal(t, "backend", config.Sinks[0].Config["name"], "redaction shouldn't affect the config itself")
+}
+
+func TestSinksFlush(t *testing.T) {
+	config := localConfig()
+	config.Sinks = []SinkConfig{{Name: "recording", Config: map[string]string{"name": "flushed"}}}
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	sink := recordingSinks["flushed"]
+
+	metrics := []samplers.DDMetric{{Name: "a.b.c", MetricType: "gauge"}}
+	s.flushPlugins(context.Background(), metrics, nil)
+	s.flushSpansToSinks(context.Background(), []ssf.SSFSample{{Name: "span"}})
+	s.Shutdown()
+
+	sink.Lock()
+	defer sink.Unlock()
+	assert.Equal(t, metrics, sink.metrics)
+	if assert.Len(t, sink.spans, 1) {
+		assert.Equal(t, "span", sink.spans[0].Name)
+	}
+	assert.True(t, sink.stopped, "sinks should be stopped at shutdown")
+}
@@ -1,11 +1,17 @@
+//go:build !linux
 // +build !linux
 
 package veneur
 
 import (
+	"errors"
 	"net"
 )
 
+// reuseportSupported is whether NewSocket can share a port between several
+// sockets, for num_readers.
+const reuseportSupported = false
+
 // NewSocket creates a socket which is intended for use by a single goroutine.
 func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn, error) {
 	if reuseport {
@@ -20,3 +26,7 @@ func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn,
 	}
 	return serverConn, nil
 }
+
+func joinMulticast(conn net.PacketConn, group net.IP, ifi *net.Interface) error {
+	return errors.New("multicast groups are not supported on this platform")
+}
@@ -0,0 +1,125 @@
+package veneur
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// listenFDsStart is the first file descriptor that systemd passes to a
+// socket-activated service. The rest follow it in order.
+const listenFDsStart = 3
+
+// listenFDs returns the file descriptors that systemd passed to this
+// process, pid, under its socket activation protocol, and their names if it
+// gave them any. They are only for this process if LISTEN_PID is its pid,
+// since the environment is inherited by children that aren't. If it isn't
+// set, the process wasn't socket-activated, and there are none.
+func listenFDs(getenv func(string) string, pid int) ([]int, []string, error) {
+	listenPID := getenv("LISTEN_PID")
+	if listenPID == "" {
+		return nil, nil, nil
+	}
+	forPID, err := strconv.Atoi(listenPID)
+	if err != nil {
+		return nil, nil, fmt.Errorf("LISTEN_PID %q is not a pid", listenPID)
+	}
+	if forPID != pid {
+		return nil, nil, nil
+	}
+	count, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil, fmt.Errorf("LISTEN_FDS %q must be how many sockets were passed", getenv("LISTEN_FDS"))
+	}
+	var names []string
+	if listenNames := getenv("LISTEN_FDNAMES"); listenNames != "" {
+		names = strings.Split(listenNames, ":")
+		if len(names) != count {
+			return nil, nil, fmt.Errorf("LISTEN_FDNAMES names %d sockets, but LISTEN_FDS is %d", len(names), count)
+		}
+	}
+	fds := make([]int, count)
+	for i := range fds {
+		fds[i] = listenFDsStart + i
+	}
+	return fds, names, nil
+}
+
+// activatedSockets are the UDP sockets that veneur inherited from systemd,
+// in place of binding its own for udp_address and trace_address.
+type activatedSockets struct {
+	mutex sync.Mutex
+	conns []net.PacketConn
+	taken map[net.PacketConn]bool
+}
+
+// newActivatedSockets adopts the sockets passed to this process by socket
+// activation, if it was, and clears the environment variables that passed
+// them, as sd_listen_fds does, so that they aren't adopted twice. Only UDP
+// sockets are adopted; passing any other kind is an error.
+func newActivatedSockets() (*activatedSockets, error) {
+	fds, names, err := listenFDs(os.Getenv, os.Getpid())
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(name)
+	}
+	if err != nil || len(fds) == 0 {
+		return nil, err
+	}
+	files := make([]*os.File, len(fds))
+	for i, fd := range fds {
+		name := fmt.Sprintf("LISTEN_FDS %d", fd)
+		if names != nil {
+			name = names[i]
+		}
+		files[i] = os.NewFile(uintptr(fd), name)
+	}
+	return inheritSockets(files)
+}
+
+// inheritSockets makes each file into a socket, and closes it.
+func inheritSockets(files []*os.File) (*activatedSockets, error) {
+	a := &activatedSockets{taken: map[net.PacketConn]bool{}}
+	for _, f := range files {
+		// the socket is a duplicate of the file's descriptor, so the file
+		// can be closed either way
+		conn, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("socket activation: %s: %v", f.Name(), err)
+		}
+		if _, ok := conn.LocalAddr().(*net.UDPAddr); !ok {
+			conn.Close()
+			return nil, fmt.Errorf("socket activation: %s is a %s socket, not a UDP one", f.Name(), conn.LocalAddr().Network())
+		}
+		a.conns = append(a.conns, conn)
+	}
+	return a, nil
+}
+
+// take returns the inherited socket bound to addr, or nil if there isn't
+// one, in which case veneur binds its own. Readers share it, so first
+// reports whether this is the first time it was taken, for setting it up.
+// A nil *activatedSockets has no sockets.
+func (a *activatedSockets) take(addr *net.UDPAddr) (conn net.PacketConn, first bool) {
+	if a == nil || addr == nil {
+		return nil, false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, conn := range a.conns {
+		bound := conn.LocalAddr().(*net.UDPAddr)
+		if bound.Port != addr.Port {
+			continue
+		}
+		if addr.IP != nil && !addr.IP.IsUnspecified() && !addr.IP.Equal(bound.IP) {
+			continue
+		}
+		first := !a.taken[conn]
+		a.taken[conn] = true
+		return conn, first
+	}
+	return nil, false
+}
@@ -0,0 +1,71 @@
+package veneur
+
+import (
+	"net"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListenFDs(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(name string) string { return vars[name] }
+	}
+
+	fds, _, err := listenFDs(env(nil), 42)
+	assert.NoError(t, err)
+	assert.Empty(t, fds, "without LISTEN_PID, veneur wasn't socket-activated")
+
+	fds, _, err = listenFDs(env(map[string]string{"LISTEN_PID": "41", "LISTEN_FDS": "1"}), 42)
+	assert.NoError(t, err)
+	assert.Empty(t, fds, "sockets passed to another process aren't ours")
+
+	fds, names, err := listenFDs(env(map[string]string{"LISTEN_PID": "42", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "statsd:ssf"}), 42)
+	assert.NoError(t, err)
+	assert.Equal(t, []int{3, 4}, fds)
+	assert.Equal(t, []string{"statsd", "ssf"}, names)
+
+	for _, vars := range []map[string]string{
+		{"LISTEN_PID": "veneur", "LISTEN_FDS": "1"},
+		{"LISTEN_PID": "42"},
+		{"LISTEN_PID": "42", "LISTEN_FDS": "0"},
+		{"LISTEN_PID": "42", "LISTEN_FDS": "2", "LISTEN_FDNAMES": "statsd"},
+	} {
+		_, _, err := listenFDs(env(vars), 42)
+		assert.Error(t, err, "%v", vars)
+	}
+}
+
+func TestInheritSockets(t *testing.T) {
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer udp.Close()
+	udpFile, err := udp.File()
+	assert.NoError(t, err)
+
+	a, err := inheritSockets([]*os.File{udpFile})
+	assert.NoError(t, err)
+	addr := udp.LocalAddr().(*net.UDPAddr)
+	conn, first := a.take(&net.UDPAddr{Port: addr.Port})
+	if assert.NotNil(t, conn, "an inherited socket bound to the port should be used for any address on it") {
+		defer conn.Close()
+		assert.True(t, first)
+	}
+	_, first = a.take(addr)
+	assert.False(t, first, "the socket is only set up by whoever takes it first")
+	conn, _ = a.take(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 2), Port: addr.Port})
+	assert.Nil(t, conn, "a socket bound to another address isn't used")
+
+	tcp, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer tcp.Close()
+	tcpFile, err := tcp.File()
+	assert.NoError(t, err)
+	_, err = inheritSockets([]*os.File{tcpFile})
+	assert.Error(t, err, "only UDP sockets can be inherited")
+
+	var none *activatedSockets
+	conn, _ = none.take(addr)
+	assert.Nil(t, conn)
+}
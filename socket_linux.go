@@ -1,6 +1,7 @@
 package veneur
 
 import (
+	"errors"
 	"net"
 	"os"
 	"syscall"
@@ -8,6 +9,10 @@ import (
 	"golang.org/x/sys/unix"
 )
 
+// reuseportSupported is whether NewSocket can share a port between several
+// sockets, for num_readers.
+const reuseportSupported = true
+
 // see also https://github.com/jbenet/go-reuseport/blob/master/impl_unix.go#L279
 func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn, error) {
 	// default to AF_INET6 to be equivalent to net.ListenUDP()
@@ -69,3 +74,38 @@ func NewSocket(addr *net.UDPAddr, recvBuf int, reuseport bool) (net.PacketConn,
 	}
 	return ret, nil
 }
+
+// joinMulticast joins a socket created by NewSocket to a multicast group, so
+// that it receives datagrams sent to the group at its port. ifi selects the
+// interface to join on; if it is nil, the kernel picks one.
+func joinMulticast(conn net.PacketConn, group net.IP, ifi *net.Interface) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return errors.New("socket does not support multicast")
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var ifindex int
+	if ifi != nil {
+		ifindex = ifi.Index
+	}
+	var joinErr error
+	err = raw.Control(func(fd uintptr) {
+		if ip4 := group.To4(); ip4 != nil {
+			mreq := &unix.IPMreqn{Ifindex: int32(ifindex)}
+			copy(mreq.Multiaddr[:], ip4)
+			joinErr = unix.SetsockoptIPMreqn(int(fd), unix.IPPROTO_IP, unix.IP_ADD_MEMBERSHIP, mreq)
+			return
+		}
+		mreq := &syscall.IPv6Mreq{Interface: uint32(ifindex)}
+		copy(mreq.Multiaddr[:], group.To16())
+		joinErr = syscall.SetsockoptIPv6Mreq(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_JOIN_GROUP, mreq)
+	})
+	if err != nil {
+		return err
+	}
+	return joinErr
+}
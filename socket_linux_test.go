@@ -0,0 +1,51 @@
+package veneur
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestSocketMulticast(t *testing.T) {
+	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:0")
+	assert.NoError(t, err)
+	sock, err := NewSocket(addr, 2*1024*1024, false)
+	if !assert.NoError(t, err, "should have constructed socket correctly") {
+		return
+	}
+	defer sock.Close()
+	port := sock.LocalAddr().(*net.UDPAddr).Port
+
+	// everything goes over the loopback interface, so that the test doesn't
+	// depend on the host's network having a multicast route
+	lo, err := net.InterfaceByName("lo")
+	if !assert.NoError(t, err) {
+		return
+	}
+	group := net.ParseIP("239.255.82.1")
+	assert.NoError(t, joinMulticast(sock, group, lo))
+
+	client, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: group, Port: port})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer client.Close()
+	raw, err := client.SyscallConn()
+	assert.NoError(t, err)
+	var ifErr error
+	assert.NoError(t, raw.Control(func(fd uintptr) {
+		ifErr = unix.SetsockoptIPMreqn(int(fd), unix.IPPROTO_IP, unix.IP_MULTICAST_IF, &unix.IPMreqn{Ifindex: int32(lo.Index)})
+	}))
+	assert.NoError(t, ifErr)
+	_, err = client.Write([]byte("hello world"))
+	assert.NoError(t, err)
+
+	b := make([]byte, 15)
+	sock.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := sock.ReadFrom(b)
+	assert.NoError(t, err, "should have received the datagram sent to the group")
+	assert.Equal(t, "hello world", string(b[:n]))
+}
@@ -69,3 +69,22 @@ func TestSocket(t *testing.T) {
 		assert.NoError(t, err, "close should not fail")
 	}
 }
+
+func TestReaderStats(t *testing.T) {
+	s := &Server{}
+	first := s.readers.add()
+	second := s.readers.add()
+	assert.Equal(t, "reader:0", first.tag)
+	assert.Equal(t, "reader:1", second.tag)
+
+	first.read(10)
+	second.read(5)
+	second.read(7)
+	assert.Equal(t, int64(1), first.packets)
+	assert.Equal(t, int64(2), second.packets)
+	assert.Equal(t, int64(12), second.bytes)
+
+	s.reportReaders()
+	assert.Equal(t, int64(0), second.packets, "reporting should reset the counts")
+	assert.Equal(t, int64(0), second.bytes)
+}
@@ -6,12 +6,15 @@
 Package ssf is a generated protocol buffer package.
 
 It is generated from these files:
+
 	ssf/sample.proto
 
 It has these top-level messages:
+
 	SSFTag
 	SSFTrace
 	SSFSample
+	SSFAnnotation
 */
 package ssf
 
@@ -190,6 +193,11 @@ type SSFSample struct {
 	// the name of the service
 	// e.g. "veneur"
 	Service string `protobuf:"bytes,10,opt,name=service" json:"service,omitempty"`
+	// the value of a COUNTER, GAUGE or HISTOGRAM sample
+	Value float32 `protobuf:"fixed32,11,opt,name=value" json:"value,omitempty"`
+	// events within a span, such as when its sub-operations
+	// started and ended, in the order they happened
+	Annotations []*SSFAnnotation `protobuf:"bytes,12,rep,name=annotations" json:"annotations,omitempty"`
 }
 
 func (m *SSFSample) Reset()                    { *m = SSFSample{} }
@@ -267,10 +275,51 @@ func (m *SSFSample) GetService() string {
 	return ""
 }
 
+func (m *SSFSample) GetValue() float32 {
+	if m != nil {
+		return m.Value
+	}
+	return 0
+}
+
+func (m *SSFSample) GetAnnotations() []*SSFAnnotation {
+	if m != nil {
+		return m.Annotations
+	}
+	return nil
+}
+
+// An annotation marks when something happened during a span
+type SSFAnnotation struct {
+	Name string `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	// in Unix nanoseconds, like a span's timestamp
+	Timestamp int64 `protobuf:"varint,2,opt,name=timestamp" json:"timestamp,omitempty"`
+}
+
+func (m *SSFAnnotation) Reset()                    { *m = SSFAnnotation{} }
+func (m *SSFAnnotation) String() string            { return proto.CompactTextString(m) }
+func (*SSFAnnotation) ProtoMessage()               {}
+func (*SSFAnnotation) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{3} }
+
+func (m *SSFAnnotation) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *SSFAnnotation) GetTimestamp() int64 {
+	if m != nil {
+		return m.Timestamp
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*SSFTag)(nil), "ssf.SSFTag")
 	proto.RegisterType((*SSFTrace)(nil), "ssf.SSFTrace")
 	proto.RegisterType((*SSFSample)(nil), "ssf.SSFSample")
+	proto.RegisterType((*SSFAnnotation)(nil), "ssf.SSFAnnotation")
 	proto.RegisterEnum("ssf.SSFSample_Metric", SSFSample_Metric_name, SSFSample_Metric_value)
 	proto.RegisterEnum("ssf.SSFSample_Status", SSFSample_Status_name, SSFSample_Status_value)
 }
@@ -278,34 +327,36 @@ func init() {
 func init() { proto.RegisterFile("ssf/sample.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 463 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0x64, 0x52, 0x4f, 0x8b, 0xdb, 0x3e,
-	0x10, 0x5d, 0xdb, 0x89, 0x63, 0x4f, 0x7e, 0xbb, 0x88, 0xe1, 0x57, 0x50, 0xff, 0xc0, 0x06, 0xf7,
-	0x92, 0x4b, 0x53, 0x48, 0x2f, 0xbd, 0x9a, 0xe0, 0x4d, 0xcd, 0x76, 0x1d, 0x90, 0x94, 0x2e, 0xf4,
-	0xb2, 0xa8, 0xb1, 0x12, 0x0c, 0xeb, 0x24, 0x58, 0xf2, 0x7e, 0x88, 0x7e, 0xca, 0x7e, 0x94, 0x22,
-	0x29, 0x49, 0x0b, 0xbd, 0xcd, 0x7b, 0x6f, 0xc6, 0xf3, 0xde, 0x58, 0x40, 0xb4, 0xde, 0x7e, 0xd4,
-	0xb2, 0x3d, 0x3e, 0xab, 0xd9, 0xb1, 0x3b, 0x98, 0x03, 0x46, 0x5a, 0x6f, 0xb3, 0x39, 0xc4, 0x9c,
-	0xdf, 0x09, 0xb9, 0x43, 0x84, 0xc1, 0x5e, 0xb6, 0x8a, 0x06, 0x93, 0x60, 0x9a, 0x32, 0x57, 0xe3,
-	0xff, 0x30, 0x7c, 0x91, 0xcf, 0xbd, 0xa2, 0xa1, 0x23, 0x3d, 0xc8, 0x7e, 0x06, 0x90, 0xd8, 0xa1,
-	0x4e, 0x6e, 0x14, 0xbe, 0x86, 0xc4, 0xd8, 0xe2, 0xa9, 0xa9, 0xdd, 0x68, 0xc4, 0x46, 0x0e, 0x97,
-	0x35, 0xde, 0x40, 0xd8, 0xd4, 0x6e, 0x34, 0x62, 0x61, 0x53, 0xe3, 0x5b, 0x48, 0x8f, 0xb2, 0x53,
-	0x7b, 0x63, 0x7b, 0x23, 0x47, 0x27, 0x9e, 0x28, 0x6b, 0x7c, 0x03, 0x49, 0xa7, 0xf4, 0xa1, 0xef,
-	0x36, 0x8a, 0x0e, 0xdc, 0xb6, 0x0b, 0xb6, 0x5a, 0xdd, 0x77, 0xd2, 0x34, 0x87, 0x3d, 0x1d, 0xfa,
-	0xb9, 0x33, 0xce, 0x7e, 0x45, 0x90, 0x72, 0x7e, 0xc7, 0x5d, 0x32, 0xfc, 0x00, 0x71, 0xab, 0x4c,
-	0xd7, 0x6c, 0x9c, 0x97, 0x9b, 0xf9, 0xab, 0x99, 0xd6, 0xdb, 0xd9, 0x45, 0x9f, 0x3d, 0x38, 0x91,
-	0x9d, 0x9a, 0x2e, 0x99, 0xc3, 0xbf, 0x32, 0xbf, 0x83, 0xd4, 0x34, 0xad, 0xd2, 0x46, 0xb6, 0xc7,
-	0x93, 0xcb, 0x3f, 0x04, 0x52, 0x18, 0xb5, 0x4a, 0x6b, 0xb9, 0x3b, 0xbb, 0x3c, 0x43, 0xbb, 0x5a,
-	0x1b, 0x69, 0x7a, 0xed, 0x2c, 0xfe, 0xbb, 0x9a, 0x3b, 0x91, 0x9d, 0x9a, 0xf0, 0x16, 0xc6, 0xfe,
-	0x6f, 0x3c, 0x75, 0xd2, 0x28, 0x1a, 0x4f, 0x82, 0x69, 0xc8, 0xc0, 0x53, 0x4c, 0x1a, 0x85, 0xb7,
-	0x30, 0x30, 0x72, 0xa7, 0xe9, 0x68, 0x12, 0x4d, 0xc7, 0xf3, 0xf1, 0xf9, 0x6b, 0x42, 0xee, 0x98,
-	0x13, 0xac, 0xf9, 0x7e, 0xdf, 0x18, 0x9a, 0x78, 0xf3, 0xb6, 0xc6, 0xf7, 0x30, 0x74, 0xd7, 0xa7,
-	0xe9, 0x24, 0x98, 0x8e, 0xe7, 0xd7, 0x97, 0x29, 0x4b, 0x32, 0xaf, 0xd9, 0x0c, 0x5a, 0x75, 0x2f,
-	0xcd, 0x46, 0x51, 0xf0, 0x19, 0x4e, 0x30, 0xfb, 0x0e, 0xb1, 0xbf, 0x10, 0x8e, 0x61, 0xb4, 0x58,
-	0xad, 0x2b, 0x51, 0x30, 0x72, 0x85, 0x29, 0x0c, 0x97, 0xf9, 0x7a, 0x59, 0x90, 0x00, 0xaf, 0x21,
-	0xfd, 0x52, 0x72, 0xb1, 0x5a, 0xb2, 0xfc, 0x81, 0x84, 0x38, 0x82, 0x88, 0x17, 0x82, 0x44, 0x08,
-	0x10, 0x73, 0x91, 0x8b, 0x35, 0x27, 0x03, 0xdb, 0x5e, 0x7c, 0x2b, 0x2a, 0x41, 0x86, 0xb6, 0x14,
-	0x2c, 0x5f, 0x14, 0x24, 0xce, 0x3e, 0x43, 0xec, 0x4f, 0x80, 0x31, 0x84, 0xab, 0x7b, 0x72, 0x65,
-	0x77, 0x3c, 0xe6, 0xac, 0x2a, 0xab, 0x25, 0x09, 0xf0, 0x3f, 0x48, 0x16, 0xac, 0x14, 0xe5, 0x22,
-	0xff, 0x4a, 0x42, 0x2b, 0xad, 0xab, 0xfb, 0x6a, 0xf5, 0x58, 0x91, 0xe8, 0x47, 0xec, 0xde, 0xeb,
-	0xa7, 0xdf, 0x01, 0x00, 0x00, 0xff, 0xff, 0xde, 0xf2, 0x50, 0x4c, 0xc3, 0x02, 0x00, 0x00,
+	// 492 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0x03, 0x6d, 0x53, 0x4d, 0x6b, 0xdb, 0x40,
+	0x10, 0xad, 0xf5, 0xad, 0x51, 0x1c, 0xc4, 0xd2, 0xc2, 0xf6, 0x03, 0x1a, 0xd4, 0x4b, 0x2e, 0x75,
+	0xc0, 0xed, 0x21, 0x57, 0x61, 0x54, 0x57, 0xa4, 0x91, 0x61, 0x25, 0x37, 0xd0, 0x4b, 0x50, 0xed,
+	0xad, 0x11, 0xc4, 0x92, 0x91, 0x56, 0xf9, 0x11, 0xf9, 0x2d, 0xfd, 0x91, 0x9d, 0xdd, 0xb5, 0x94,
+	0xa4, 0xed, 0x6d, 0xe6, 0xcd, 0x9b, 0x99, 0x37, 0xb3, 0xb3, 0x10, 0x76, 0xdd, 0xaf, 0x8b, 0xae,
+	0xdc, 0x1f, 0xee, 0xf8, 0xec, 0xd0, 0x36, 0xa2, 0x21, 0x26, 0x22, 0xd1, 0x1c, 0x9c, 0x3c, 0xff,
+	0x52, 0x94, 0x3b, 0x42, 0xc0, 0xaa, 0xcb, 0x3d, 0xa7, 0x93, 0xb3, 0xc9, 0xb9, 0xcf, 0x94, 0x4d,
+	0x5e, 0x82, 0x7d, 0x5f, 0xde, 0xf5, 0x9c, 0x1a, 0x0a, 0xd4, 0x4e, 0xf4, 0x30, 0x01, 0x4f, 0x26,
+	0xb5, 0xe5, 0x86, 0x93, 0xd7, 0xe0, 0x09, 0x69, 0xdc, 0x56, 0x5b, 0x95, 0x6a, 0x32, 0x57, 0xf9,
+	0xe9, 0x96, 0x9c, 0x82, 0x81, 0xa0, 0xa1, 0x40, 0xb4, 0xc8, 0x5b, 0xf0, 0x0f, 0x65, 0xcb, 0x6b,
+	0x21, 0xb9, 0xa6, 0x82, 0x3d, 0x0d, 0x20, 0xf9, 0x0d, 0x78, 0x2d, 0xef, 0x9a, 0xbe, 0xdd, 0x70,
+	0x6a, 0xa9, 0x6e, 0xa3, 0x2f, 0x63, 0xdb, 0xbe, 0x2d, 0x45, 0xd5, 0xd4, 0xd4, 0xd6, 0x79, 0x83,
+	0x1f, 0xfd, 0xb6, 0xc0, 0x47, 0x31, 0xb9, 0x9a, 0x8c, 0x7c, 0x04, 0x67, 0xcf, 0x45, 0x5b, 0x6d,
+	0x94, 0x96, 0xd3, 0xf9, 0xab, 0x19, 0x0e, 0x39, 0x1b, 0xe3, 0xb3, 0x6b, 0x15, 0x64, 0x47, 0xd2,
+	0x38, 0xb3, 0xf1, 0x64, 0xe6, 0x77, 0xe0, 0x8b, 0x6a, 0xcf, 0x3b, 0x81, 0x19, 0x47, 0x95, 0x8f,
+	0x00, 0xa1, 0xe0, 0xa2, 0xd9, 0x95, 0xbb, 0x41, 0xe5, 0xe0, 0xca, 0xd6, 0x48, 0x11, 0x7d, 0xa7,
+	0x24, 0xfe, 0xdb, 0x3a, 0x57, 0x41, 0x76, 0x24, 0x91, 0xf7, 0x10, 0xe8, 0xd7, 0xb8, 0xc5, 0x41,
+	0x38, 0x75, 0x30, 0xc7, 0x60, 0xa0, 0x21, 0x86, 0x08, 0x12, 0x2c, 0x51, 0xee, 0x3a, 0xea, 0x9e,
+	0x99, 0xe7, 0xc1, 0x3c, 0x18, 0xaa, 0xe1, 0x53, 0x31, 0x15, 0x90, 0xe2, 0xfb, 0xba, 0x12, 0xd4,
+	0xd3, 0xe2, 0xa5, 0x4d, 0x3e, 0x80, 0xad, 0xb6, 0x4f, 0x7d, 0x04, 0x83, 0xf9, 0x74, 0xcc, 0x92,
+	0x20, 0xd3, 0x31, 0x39, 0x43, 0xc7, 0xdb, 0xfb, 0x0a, 0x69, 0xa0, 0x67, 0x38, 0xba, 0x8f, 0xef,
+	0x1d, 0x28, 0x39, 0xda, 0x21, 0x9f, 0x21, 0x28, 0xeb, 0xba, 0x11, 0x6a, 0xe1, 0x1d, 0x3d, 0x51,
+	0x82, 0xc8, 0x50, 0x3a, 0x1e, 0x43, 0xec, 0x29, 0x2d, 0xfa, 0x01, 0x8e, 0xde, 0x36, 0x09, 0xc0,
+	0x5d, 0xac, 0xd6, 0x59, 0x91, 0xb0, 0xf0, 0x05, 0xf1, 0xc1, 0x5e, 0xc6, 0xeb, 0x65, 0x12, 0x4e,
+	0xc8, 0x14, 0xfc, 0xaf, 0x69, 0x5e, 0xac, 0x96, 0x2c, 0xbe, 0x0e, 0x0d, 0xe2, 0x82, 0x99, 0x27,
+	0x45, 0x68, 0x12, 0xc0, 0x9b, 0x2c, 0xe2, 0x62, 0x9d, 0x87, 0x96, 0xa4, 0x27, 0xdf, 0x93, 0xac,
+	0x08, 0x6d, 0x69, 0x16, 0x2c, 0x5e, 0x24, 0xa1, 0x13, 0x5d, 0x22, 0x43, 0xaf, 0xd1, 0x01, 0x63,
+	0x75, 0x85, 0x65, 0xb1, 0xc7, 0x4d, 0xcc, 0xb2, 0x34, 0x5b, 0x62, 0xe1, 0x13, 0xf0, 0x16, 0x2c,
+	0x2d, 0xd2, 0x45, 0xfc, 0x0d, 0xeb, 0x62, 0x68, 0x9d, 0x5d, 0x65, 0xab, 0x9b, 0x2c, 0x34, 0xa3,
+	0x18, 0xa6, 0xcf, 0x34, 0xff, 0xf7, 0xec, 0x9f, 0x9d, 0x80, 0xf1, 0xd7, 0x09, 0xfc, 0x74, 0xd4,
+	0xf7, 0xf9, 0xf4, 0x07, 0x37, 0x30, 0xff, 0xce, 0x52, 0x03, 0x00, 0x00,
 }
@@ -0,0 +1,136 @@
+package veneur
+
+import (
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	"github.com/clarkduvall/hyperloglog"
+	"github.com/stripe/veneur/samplers"
+)
+
+// tagValuesPrecision is the precision of the HLLs that each tag key's values
+// are counted with. There's one for every tag key of every metric name, so
+// it's lower than that of sets; its standard error is still under 1%.
+const tagValuesPrecision = 14
+
+// tagKeyCardinality is approximately how many distinct values a tag key had
+// across the series of a metric name in one window.
+type tagKeyCardinality struct {
+	metric string
+	key    string
+	values uint64
+}
+
+// tagValueHash is the hash of a tag value. fnv's hashes of values that only
+// differ in their last bytes, like sequential IDs, share their high bits,
+// which the HLL indexes its registers by, so they are mixed first.
+type tagValueHash uint64
+
+func newTagValueHash(value string) tagValueHash {
+	hasher := fnv.New64a()
+	hasher.Write([]byte(value))
+	// the finalizer of MurmurHash3
+	h := hasher.Sum64()
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return tagValueHash(h)
+}
+
+func (h tagValueHash) Sum64() uint64 {
+	return uint64(h)
+}
+
+// topTagCardinality counts the distinct values of each tag key of each
+// metric name among one window's series, and returns the n keys with the
+// most values, most first. A tag without a colon is a key with an empty
+// value. Since series are flushed once per window, each combination of tags
+// is only counted once, however many times it was reported.
+func topTagCardinality(wms []WorkerMetrics, n int) []tagKeyCardinality {
+	values := map[string]map[string]*hyperloglog.HyperLogLogPlus{}
+	add := func(mk samplers.MetricKey) {
+		if mk.JoinedTags == "" {
+			return
+		}
+		keys, ok := values[mk.Name]
+		if !ok {
+			keys = map[string]*hyperloglog.HyperLogLogPlus{}
+			values[mk.Name] = keys
+		}
+		for _, tag := range strings.Split(mk.JoinedTags, ",") {
+			key, value := tag, ""
+			if i := strings.IndexByte(tag, ':'); i >= 0 {
+				key, value = tag[:i], tag[i+1:]
+			}
+			hll, ok := keys[key]
+			if !ok {
+				hll, _ = hyperloglog.NewPlus(tagValuesPrecision)
+				keys[key] = hll
+			}
+			hll.Add(newTagValueHash(value))
+		}
+	}
+	for _, wm := range wms {
+		for k := range wm.counters {
+			add(k)
+		}
+		for k := range wm.gauges {
+			add(k)
+		}
+		for k := range wm.histograms {
+			add(k)
+		}
+		for k := range wm.sets {
+			add(k)
+		}
+		for k := range wm.timers {
+			add(k)
+		}
+		for k := range wm.globalCounters {
+			add(k)
+		}
+		for k := range wm.localHistograms {
+			add(k)
+		}
+		for k := range wm.localSets {
+			add(k)
+		}
+		for k := range wm.localTimers {
+			add(k)
+		}
+	}
+
+	var counts []tagKeyCardinality
+	for metric, keys := range values {
+		for key, hll := range keys {
+			counts = append(counts, tagKeyCardinality{metric: metric, key: key, values: hll.Count()})
+		}
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].values != counts[j].values {
+			return counts[i].values > counts[j].values
+		}
+		if counts[i].metric != counts[j].metric {
+			return counts[i].metric < counts[j].metric
+		}
+		return counts[i].key < counts[j].key
+	})
+	if len(counts) > n {
+		counts = counts[:n]
+	}
+	return counts
+}
+
+// reportTagCardinality reports the tag keys with the most values in one
+// window's metrics, if tag_cardinality_top is set.
+func (s *Server) reportTagCardinality(wms []WorkerMetrics) {
+	if s.tagCardinalityTop <= 0 {
+		return
+	}
+	for _, c := range topTagCardinality(wms, s.tagCardinalityTop) {
+		s.statsd.Gauge("flush.tag_values", float64(c.values), []string{"metric:" + c.metric, "tag_key:" + c.key}, 1.0)
+	}
+}
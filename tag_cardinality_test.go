@@ -0,0 +1,46 @@
+package veneur
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/samplers"
+)
+
+func TestTopTagCardinality(t *testing.T) {
+	wm := NewWorkerMetrics()
+	other := NewWorkerMetrics()
+	for i := 0; i < 5000; i++ {
+		// the series of a name are spread across workers
+		into := wm
+		if i%2 == 1 {
+			into = other
+		}
+		into.counters[samplers.MetricKey{
+			Name:       "api.requests",
+			Type:       "counter",
+			JoinedTags: fmt.Sprintf("env:prod,user_id:%d", i),
+		}] = nil
+		into.histograms[samplers.MetricKey{
+			Name:       "api.latency",
+			Type:       "histogram",
+			JoinedTags: fmt.Sprintf("endpoint:/%d,env:prod,canary", i%40),
+		}] = nil
+	}
+	wm.gauges[samplers.MetricKey{Name: "untagged", Type: "gauge"}] = nil
+
+	top := topTagCardinality([]WorkerMetrics{wm, other}, 3)
+	if !assert.Len(t, top, 3) {
+		return
+	}
+	assert.Equal(t, "api.requests", top[0].metric)
+	assert.Equal(t, "user_id", top[0].key)
+	assert.InEpsilon(t, 5000, top[0].values, 0.03)
+	assert.Equal(t, tagKeyCardinality{metric: "api.latency", key: "endpoint", values: 40}, top[1])
+	assert.Equal(t, uint64(1), top[2].values, "every other key has one value")
+
+	all := topTagCardinality([]WorkerMetrics{wm, other}, 100)
+	assert.Len(t, all, 5, "a tag without a value is still a key, and untagged series have none")
+	assert.Contains(t, all, tagKeyCardinality{metric: "api.latency", key: "canary", values: 1})
+}
@@ -108,3 +108,23 @@ func BenchmarkQuantile(b *testing.B) {
 		td.Quantile(rand.Float64())
 	}
 }
+
+func TestSketch(t *testing.T) {
+	td := NewMerging(100, false)
+	for i := 0; i < 10000; i++ {
+		td.Add(rand.NormFloat64(), 1.0)
+	}
+
+	sketch := td.Sketch()
+	merged := NewMerging(100, false)
+	var weight float64
+	for i, c := range sketch {
+		weight += c.Weight
+		if i > 0 {
+			assert.True(t, c.Mean >= sketch[i-1].Mean, "centroids should be in ascending order")
+		}
+		merged.Add(c.Mean, c.Weight)
+	}
+	assert.Equal(t, td.Count(), weight, "the sketch should have every observation")
+	assert.InDelta(t, td.Quantile(0.9), merged.Quantile(0.9), 0.05, "a digest built from the sketch should have about the same quantiles")
+}
@@ -322,6 +322,24 @@ func (td *MergingDigest) Count() float64 {
 	return td.mainWeight + td.tempWeight
 }
 
+// Compression returns the compression the digest was created with, which
+// bounds how many centroids it keeps and so how accurate its quantiles are.
+func (td *MergingDigest) Compression() float64 {
+	return td.compression
+}
+
+// Sketch returns a copy of the digest's centroids, in ascending order of
+// their means, which is enough for another digest to merge it. Unlike
+// Centroids, it doesn't need debug, and the copies don't have Samples.
+func (td *MergingDigest) Sketch() []Centroid {
+	td.mergeAllTemps()
+	sketch := make([]Centroid, len(td.mainCentroids))
+	for i, c := range td.mainCentroids {
+		sketch[i] = Centroid{Mean: c.Mean, Weight: c.Weight}
+	}
+	return sketch
+}
+
 // we assume each centroid contains a uniform distribution of values
 // the lower bound of the distribution is the midpoint between this centroid and
 // the previous one (or the minimum, if this is the lowest centroid)
@@ -0,0 +1,49 @@
+package trace
+
+import (
+	"sort"
+	"sync/atomic"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// DefaultMaxAnnotations is how many annotations a span keeps, if its
+// Tracer's MaxAnnotations isn't set.
+const DefaultMaxAnnotations = 128
+
+// Annotate records that something happened during the span, like a
+// sub-operation starting or ending, at the current time according to its
+// Tracer's Clock. Annotations are sent with the span, ordered by when they
+// happened, so they can be shown as markers on its timeline; they are much
+// cheaper than child spans. Once the span has its Tracer's MaxAnnotations,
+// any more are dropped, and counted in Counts.
+func (s *Span) Annotate(name string) {
+	if s.unsampled {
+		// nothing will ever read it
+		return
+	}
+	max := s.tracer.MaxAnnotations
+	if max <= 0 {
+		max = DefaultMaxAnnotations
+	}
+	if len(s.Trace.Annotations) >= max {
+		if s.tracer.Counts != nil {
+			atomic.AddInt64(&s.tracer.Counts.annotationsDropped, 1)
+		}
+		return
+	}
+	// TODO mutex
+	s.Trace.Annotations = append(s.Trace.Annotations, &ssf.SSFAnnotation{
+		Name:      name,
+		Timestamp: s.tracer.now().UnixNano(),
+	})
+}
+
+// sortAnnotations orders annotations by when they happened, keeping those
+// that happened at the same time in the order they were added (the clock
+// may not be monotonic).
+func sortAnnotations(annotations []*ssf.SSFAnnotation) {
+	sort.SliceStable(annotations, func(i, j int) bool {
+		return annotations[i].Timestamp < annotations[j].Timestamp
+	})
+}
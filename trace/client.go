@@ -0,0 +1,187 @@
+package trace
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/veneur/ssf"
+)
+
+// ErrClientClosed is returned when a span is sent to a Client that has been
+// closed.
+var ErrClientClosed = errors.New("trace client is closed")
+
+// ErrWouldBlock is returned when a span is sent to a Client whose buffer is
+// full. The span is dropped rather than holding up the caller.
+var ErrWouldBlock = errors.New("trace client buffer is full")
+
+// Client sends spans to a veneur instance over a single UDP connection,
+// buffering them so that finishing a span never waits on the network. A
+// Tracer with a Client set sends its spans through it instead of dialing a
+// new connection for each one. Metrics can be sent through the same buffer
+// and connection too, with Count, Gauge, Histogram, Timing and Set, so that
+// a process needs only the one connection to veneur's trace_address for
+// both. A Client is safe for concurrent use.
+type Client struct {
+	conn    net.Conn
+	samples chan *ssf.SSFSample
+	done    chan struct{}
+
+	// mu guards closed. Senders hold it for reading while they register
+	// with inflight, and Close holds it for writing while it sets closed,
+	// so that no sender can register once Close has started waiting.
+	mu       sync.RWMutex
+	closed   bool
+	inflight sync.WaitGroup
+}
+
+// NewClient returns a Client that sends spans to the given UDP address,
+// buffering up to capacity of them.
+func NewClient(addr string, capacity int) (*Client, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.DialUDP("udp", nil, udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{
+		conn:    conn,
+		samples: make(chan *ssf.SSFSample, capacity),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c, nil
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	for sample := range c.samples {
+		data, err := proto.Marshal(sample)
+		if err != nil {
+			logrus.WithError(err).Error("Error marshaling sample")
+			continue
+		}
+		if _, err := c.conn.Write(data); err != nil {
+			logrus.WithError(err).Error("Error submitting sample")
+		}
+	}
+}
+
+// Closed reports whether Close has been called.
+func (c *Client) Closed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
+}
+
+// Send buffers a sample to be sent. It returns ErrClientClosed if the Client
+// has been closed, and ErrWouldBlock if the buffer is full.
+func (c *Client) Send(sample *ssf.SSFSample) error {
+	c.mu.RLock()
+	if c.closed {
+		c.mu.RUnlock()
+		return ErrClientClosed
+	}
+	c.inflight.Add(1)
+	c.mu.RUnlock()
+	defer c.inflight.Done()
+
+	if Disabled {
+		return nil
+	}
+	select {
+	case c.samples <- sample:
+		return nil
+	default:
+		return ErrWouldBlock
+	}
+}
+
+// Count sends a counter sample, which veneur aggregates like a DogStatsD
+// counter. Like spans, metrics are dropped with ErrWouldBlock rather than
+// waiting if the buffer is full.
+func (c *Client) Count(name string, value float32, tags map[string]string) error {
+	return c.Send(metricSample(ssf.SSFSample_COUNTER, name, value, tags))
+}
+
+// Gauge sends a gauge sample.
+func (c *Client) Gauge(name string, value float32, tags map[string]string) error {
+	return c.Send(metricSample(ssf.SSFSample_GAUGE, name, value, tags))
+}
+
+// Histogram sends a histogram sample.
+func (c *Client) Histogram(name string, value float32, tags map[string]string) error {
+	return c.Send(metricSample(ssf.SSFSample_HISTOGRAM, name, value, tags))
+}
+
+// Timing sends a duration as a timer sample, in milliseconds.
+func (c *Client) Timing(name string, d time.Duration, tags map[string]string) error {
+	sample := metricSample(ssf.SSFSample_HISTOGRAM, name, float32(d)/float32(time.Millisecond), tags)
+	sample.Unit = "ms"
+	return c.Send(sample)
+}
+
+// Set sends a member of a set, which veneur counts the distinct members of.
+func (c *Client) Set(name, member string, tags map[string]string) error {
+	sample := metricSample(ssf.SSFSample_SET, name, 0, tags)
+	sample.Message = member
+	return c.Send(sample)
+}
+
+// metricSample returns a sample for a metric, which veneur tells apart from
+// a span by its not having a Trace. A tag with an empty value is sent as a
+// bare tag.
+func metricSample(metric ssf.SSFSample_Metric, name string, value float32, tags map[string]string) *ssf.SSFSample {
+	sample := &ssf.SSFSample{
+		Metric:     metric,
+		Name:       name,
+		Value:      value,
+		SampleRate: 1,
+		Service:    Service,
+	}
+	for k, v := range tags {
+		sample.Tags = append(sample.Tags, &ssf.SSFTag{Name: k, Value: v})
+	}
+	return sample
+}
+
+// Close stops the Client from accepting new spans, waits for any Send calls
+// already in progress, flushes everything buffered and then closes the
+// connection. If the context ends first, Close closes the connection anyway
+// (dropping whatever was not yet sent) and returns the context's error.
+// Calling Close more than once returns ErrClientClosed.
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClientClosed
+	}
+	c.closed = true
+	c.mu.Unlock()
+
+	// samples can only be closed once nobody can send on it any more. This
+	// happens in its own goroutine so that it still happens eventually if
+	// the deadline passes first.
+	go func() {
+		c.inflight.Wait()
+		close(c.samples)
+	}()
+
+	var err error
+	select {
+	case <-c.done:
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	if cerr := c.conn.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
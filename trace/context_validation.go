@@ -0,0 +1,55 @@
+package trace
+
+import (
+	"fmt"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// errInvalidContext is returned by Extract for a context whose ids can't
+// belong to a real span. It wraps opentracing.ErrSpanContextCorrupted, which
+// is what callers should compare against.
+type errInvalidContext struct {
+	reason string
+}
+
+func (e errInvalidContext) Error() string {
+	return fmt.Sprintf("%s: %s", opentracing.ErrSpanContextCorrupted, e.reason)
+}
+
+func (e errInvalidContext) Unwrap() error {
+	return opentracing.ErrSpanContextCorrupted
+}
+
+// validateContext checks the ids of an extracted context, so that Extract
+// returns either a context that a child can be started from or an error,
+// rather than one that would put the child in a trace of its own or leave it
+// pointing at the wrong parent. The rules are:
+//
+//   - the trace id and span id must be positive, since 0 means "not set" and
+//     no tracer issues negative ones. Otherwise the context is rejected:
+//     without a trace id, a child would start a new trace that looks like it
+//     has a parent, and without a span id it would look like a root.
+//   - the exception is a context extracted from an X-Ray header that has a
+//     Root but no Parent (see parseXRayHeader), which is the root of a trace
+//     that an X-Ray participant started without a segment of its own. It
+//     has no span id, and a child started from it is a root span in that
+//     trace.
+//   - the parent id is the span's own parent, and 0 if it is a root. Some
+//     tracers send -1 for that, and a span can't be its own parent, so a
+//     negative parent id, or one equal to the span id, is zeroed.
+//
+// It returns whether anything was zeroed.
+func validateContext(c *spanContext) (bool, error) {
+	if c.TraceId() <= 0 {
+		return false, errInvalidContext{fmt.Sprintf("trace id %d is not positive", c.TraceId())}
+	}
+	if c.SpanId() < 0 || c.SpanId() == 0 && c.xrayRoot == "" {
+		return false, errInvalidContext{fmt.Sprintf("span id %d is not positive", c.SpanId())}
+	}
+	if parentId := c.ParentId(); parentId < 0 || parentId == c.SpanId() {
+		c.baggageItems["parentid"] = "0"
+		return true, nil
+	}
+	return false, nil
+}
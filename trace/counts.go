@@ -0,0 +1,201 @@
+package trace
+
+import (
+	"sync"
+	"sync/atomic"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// maxSamplingResources bounds how many distinct resources SpanCounts keeps
+// sampling counts for between calls to TakeSampling. Spans for any more
+// resources are counted under otherResource.
+const maxSamplingResources = 1000
+
+// otherResource is the resource that spans are counted under once
+// maxSamplingResources is reached.
+const otherResource = "other"
+
+// SpanCounts tracks how many spans a Tracer has started and finished, which
+// is useful for noticing spans that are started but never finished. It is
+// safe for concurrent use.
+type SpanCounts struct {
+	started      int64
+	finished     int64
+	depthLimited int64
+	// tag values truncated for being longer than MaxTagValueLength
+	tagsTruncated int64
+	// annotations dropped for exceeding MaxAnnotations
+	annotationsDropped int64
+
+	mtx         sync.Mutex
+	sampling    map[string]SamplingCounts
+	extractions map[Extraction]int64
+	// the totals as of the last call to TakeLimits
+	limitsTaken LimitCounts
+}
+
+// LimitCounts are how many spans, tag values and annotations were cut by a
+// Tracer's limits: its MaxDepth, MaxTagValueLength and MaxAnnotations.
+type LimitCounts struct {
+	DepthLimited       int64
+	TagsTruncated      int64
+	AnnotationsDropped int64
+}
+
+// SamplingCounts are how many spans for a resource were finished, and how
+// many of those were kept and sent rather than dropped (for instance, for
+// being deeper than the Tracer's MaxDepth). Their ratio is the effective
+// sampling rate of the resource.
+type SamplingCounts struct {
+	Created int64
+	Kept    int64
+}
+
+// Started returns the number of spans started so far.
+func (c *SpanCounts) Started() int64 {
+	return atomic.LoadInt64(&c.started)
+}
+
+// Finished returns the number of spans finished so far. A span that is
+// finished more than once is only counted the first time.
+func (c *SpanCounts) Finished() int64 {
+	return atomic.LoadInt64(&c.finished)
+}
+
+// Active returns the number of spans that have been started but not yet
+// finished. If this grows steadily, spans are being leaked.
+func (c *SpanCounts) Active() int64 {
+	// load finished first, so that a span that starts and finishes between
+	// the two loads can't make this negative
+	finished := c.Finished()
+	return c.Started() - finished
+}
+
+// DepthLimited returns the number of spans that were not recorded because
+// they were nested deeper than the Tracer's MaxDepth. These aren't counted
+// as started.
+func (c *SpanCounts) DepthLimited() int64 {
+	return atomic.LoadInt64(&c.depthLimited)
+}
+
+// TagsTruncated returns the number of tag values that were truncated for
+// being longer than the Tracer's MaxTagValueLength.
+func (c *SpanCounts) TagsTruncated() int64 {
+	return atomic.LoadInt64(&c.tagsTruncated)
+}
+
+// AnnotationsDropped returns the number of annotations that were dropped
+// for being added to spans that already had the Tracer's MaxAnnotations.
+func (c *SpanCounts) AnnotationsDropped() int64 {
+	return atomic.LoadInt64(&c.annotationsDropped)
+}
+
+// TakeLimits returns how many spans, tag values and annotations were cut by
+// the Tracer's limits since it was last called. Unlike TakeSampling, it
+// doesn't reset the totals that DepthLimited, TagsTruncated and
+// AnnotationsDropped return.
+func (c *SpanCounts) TakeLimits() LimitCounts {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	totals := LimitCounts{
+		DepthLimited:       c.DepthLimited(),
+		TagsTruncated:      c.TagsTruncated(),
+		AnnotationsDropped: c.AnnotationsDropped(),
+	}
+	taken := LimitCounts{
+		DepthLimited:       totals.DepthLimited - c.limitsTaken.DepthLimited,
+		TagsTruncated:      totals.TagsTruncated - c.limitsTaken.TagsTruncated,
+		AnnotationsDropped: totals.AnnotationsDropped - c.limitsTaken.AnnotationsDropped,
+	}
+	c.limitsTaken = totals
+	return taken
+}
+
+// countSampling records the sampling decision for a finished span.
+func (c *SpanCounts) countSampling(resource string, kept bool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.sampling == nil {
+		c.sampling = map[string]SamplingCounts{}
+	}
+	if _, ok := c.sampling[resource]; !ok && len(c.sampling) >= maxSamplingResources {
+		resource = otherResource
+	}
+	counts := c.sampling[resource]
+	counts.Created++
+	if kept {
+		counts.Kept++
+	}
+	c.sampling[resource] = counts
+}
+
+// TakeSampling returns the sampling counts for each resource since it was
+// last called, and resets them. Resources are as rewritten by the Tracer's
+// ResourceRules, which should be used to keep them bounded.
+func (c *SpanCounts) TakeSampling() map[string]SamplingCounts {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	sampling := c.sampling
+	c.sampling = nil
+	return sampling
+}
+
+// Extraction results, for Extraction's Result.
+const (
+	// ExtractionSuccess means a context was extracted.
+	ExtractionSuccess = "success"
+	// ExtractionMissing means the carrier had no context in it at all,
+	// usually because the upstream didn't propagate one.
+	ExtractionMissing = "missing"
+	// ExtractionMalformed means the carrier had a context that couldn't
+	// be parsed.
+	ExtractionMalformed = "malformed"
+	// ExtractionInvalid means the carrier had a context that parsed, but
+	// whose ids can't belong to a real span, so it was rejected.
+	ExtractionInvalid = "invalid"
+	// ExtractionNormalized means a context was extracted, but some of its
+	// ids were invalid and were zeroed, like a negative parent id.
+	ExtractionNormalized = "normalized"
+)
+
+// Extraction is the outcome of extracting a span context from a carrier in
+// one format, which is "binary", "text_map" or "http_headers".
+type Extraction struct {
+	Format string
+	Result string
+}
+
+// extractionFormat names an OpenTracing carrier format, for Extraction.
+func extractionFormat(format interface{}) string {
+	switch format {
+	case opentracing.Binary:
+		return "binary"
+	case opentracing.TextMap:
+		return "text_map"
+	case opentracing.HTTPHeaders:
+		return "http_headers"
+	}
+	return "other"
+}
+
+func (c *SpanCounts) countExtraction(format, result string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.extractions == nil {
+		c.extractions = map[Extraction]int64{}
+	}
+	c.extractions[Extraction{Format: format, Result: result}]++
+}
+
+// TakeExtractions returns how many times the Tracer's Extract (including
+// through helpers like ExtractRequestChild) had each outcome since it was
+// last called, and resets them. The proportion that are missing or
+// malformed shows how often upstreams fail to propagate their traces.
+func (c *SpanCounts) TakeExtractions() map[Extraction]int64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	extractions := c.extractions
+	c.extractions = nil
+	return extractions
+}
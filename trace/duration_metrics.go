@@ -0,0 +1,70 @@
+package trace
+
+import "github.com/stripe/veneur/ssf"
+
+// DurationMetricType selects the kind of metric a Tracer reports the duration
+// of each finished span as. Either way, veneur aggregates them like any other
+// histogram, so percentiles are computed server-side rather than recorded
+// per span.
+type DurationMetricType int
+
+const (
+	// DurationMetricNone reports no duration metrics. This is the zero value.
+	DurationMetricNone DurationMetricType = iota
+	// DurationMetricHistogram reports durations as histograms, in
+	// nanoseconds.
+	DurationMetricHistogram
+	// DurationMetricTimer reports durations as timers, in milliseconds.
+	DurationMetricTimer
+)
+
+// durationSample returns the sample reporting the duration of a finished
+// span, as "<span name>.duration" tagged with its resource, service and
+// status (see durationStatus). Since there is one series per resource,
+// ResourceRules should be used to keep the number of distinct resources
+// bounded.
+func (t Tracer) durationSample(s *Span) *ssf.SSFSample {
+	if t.DurationMetrics == DurationMetricNone || s.Name == "" {
+		return nil
+	}
+	unit := "ns"
+	if t.DurationMetrics == DurationMetricTimer {
+		unit = "ms"
+	}
+	tags := []*ssf.SSFTag{
+		{Name: "resource", Value: s.Resource},
+		{Name: "service", Value: Service},
+		{Name: "status", Value: durationStatus(s)},
+	}
+	t.limitTags(tags)
+	return &ssf.SSFSample{
+		Metric:     ssf.SSFSample_HISTOGRAM,
+		Name:       s.Name + ".duration",
+		Timestamp:  s.Start.UnixNano(),
+		SampleRate: 1,
+		Tags:       tags,
+		Unit:       unit,
+		Trace: &ssf.SSFTrace{
+			TraceId:  s.TraceId,
+			Id:       s.SpanId,
+			ParentId: s.ParentId,
+			Duration: s.Duration().Nanoseconds(),
+			Resource: s.Resource,
+		},
+		Service: Service,
+	}
+}
+
+// durationStatus returns "error" if the span failed, either because Error
+// was called on it or because it was given the OpenTracing error tag, and
+// "ok" otherwise. Only having the two keeps the number of duration series
+// bounded, whatever the span's error messages are.
+func durationStatus(s *Span) string {
+	if s.Status == ssf.SSFSample_CRITICAL {
+		return "error"
+	}
+	if value, ok := s.Tag("error"); ok && value == "true" {
+		return "error"
+	}
+	return "ok"
+}
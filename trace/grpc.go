@@ -0,0 +1,59 @@
+package trace
+
+import "fmt"
+
+// grpcCodeNames are the canonical names of the gRPC status codes, as
+// codes.Code's String method renders them.
+var grpcCodeNames = [...]string{
+	"OK",
+	"Canceled",
+	"Unknown",
+	"InvalidArgument",
+	"DeadlineExceeded",
+	"NotFound",
+	"AlreadyExists",
+	"PermissionDenied",
+	"ResourceExhausted",
+	"FailedPrecondition",
+	"Aborted",
+	"OutOfRange",
+	"Unimplemented",
+	"Internal",
+	"Unavailable",
+	"DataLoss",
+	"Unauthenticated",
+}
+
+// grpcCodeOK is the code of a call that succeeded.
+const grpcCodeOK = 0
+
+// GRPCCodeName returns the canonical name of a gRPC status code, eg
+// "NotFound" for 5. Codes that gRPC doesn't define are rendered the way
+// codes.Code does, eg "Code(17)".
+func GRPCCodeName(code uint32) string {
+	if code < uint32(len(grpcCodeNames)) {
+		return grpcCodeNames[code]
+	}
+	return fmt.Sprintf("Code(%d)", code)
+}
+
+// SetGRPCStatus records the outcome of a gRPC call on the span, as the
+// grpc.code tag (the code's canonical name) and, if there is one, the
+// grpc.message tag. A call that did not succeed is also tagged error=true,
+// which marks the span as failed in duration metrics. Since this package
+// doesn't depend on gRPC, it takes the parts of a status rather than a
+// status.Status, so an interceptor would call
+//
+//	st := status.Convert(err)
+//	span.SetGRPCStatus(uint32(st.Code()), st.Message())
+//
+// which, for a nil error, records an OK status.
+func (s *Span) SetGRPCStatus(code uint32, message string) {
+	s.SetTag("grpc.code", GRPCCodeName(code))
+	if message != "" {
+		s.SetTag("grpc.message", message)
+	}
+	if code != grpcCodeOK {
+		s.SetTag("error", "true")
+	}
+}
@@ -0,0 +1,80 @@
+package trace
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/opentracing/opentracing-go"
+)
+
+// HTTPRequestSpanName is the name of the spans that TraceMiddleware starts.
+const HTTPRequestSpanName = "http.request"
+
+// TraceMiddleware wraps an http.Handler so that every request it serves is
+// traced. If the request carries a trace (see InjectRequest), the span is a
+// child of it; otherwise the span starts a new trace. The span's resource is
+// the request's path, so set the Tracer's ResourceRules if paths have IDs in
+// them. It is tagged with the request's attributes, as if TagHTTPRequests
+// were set, and stored in the request's context, where the handler can find
+// it with opentracing.SpanFromContext or start children of it with
+// StartSpanFromContext.
+//
+// When the handler returns, the span is finished, tagged with the response's
+// http.status_code, and with error=true if that is a 5xx.
+func TraceMiddleware(tracer Tracer, next http.Handler) http.Handler {
+	// the middleware always tags requests
+	tracer.TagHTTPRequests = true
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resource := r.URL.Path
+		span, err := tracer.ExtractRequestChild(resource, r, HTTPRequestSpanName)
+		if err != nil {
+			// nothing upstream was tracing this request
+			span = tracer.StartSpan(resource, NameTag(HTTPRequestSpanName)).(*Span)
+			tracer.tagRequest(span, r)
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		defer func() {
+			status := rec.status
+			if status == 0 {
+				// the handler wrote nothing, which net/http sends as a 200
+				status = http.StatusOK
+			}
+			span.SetTag("http.status_code", strconv.Itoa(status))
+			if status >= 500 {
+				span.SetTag("error", "true")
+			}
+			span.Finish()
+		}()
+		next.ServeHTTP(rec, r.WithContext(opentracing.ContextWithSpan(r.Context(), span)))
+	})
+}
+
+// statusRecorder is an http.ResponseWriter that remembers the status code of
+// the response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush passes flushes through to the underlying ResponseWriter, if it
+// supports them, so that streaming handlers still work.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
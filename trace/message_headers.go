@@ -0,0 +1,157 @@
+package trace
+
+import (
+	"strings"
+
+	opentracing "github.com/opentracing/opentracing-go"
+)
+
+// MessageHeadersCarrier is a TextMap carrier for message headers whose values
+// are byte slices, like those of NATS messages. Every field Inject writes is
+// ASCII (decimal IDs, and the X-Ray header if PropagationXRay is used), so
+// the headers survive any transport that delivers them unmodified.
+type MessageHeadersCarrier map[string][]byte
+
+// Set implements opentracing.TextMapWriter.
+func (c MessageHeadersCarrier) Set(k, v string) {
+	c[k] = []byte(v)
+}
+
+// ForeachKey implements opentracing.TextMapReader.
+func (c MessageHeadersCarrier) ForeachKey(handler func(k, v string) error) error {
+	for k, v := range c {
+		if err := handler(k, string(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// has reports whether the carrier has a header with the given name, which
+// is compared case-insensitively like textMapReaderGet does.
+func (c MessageHeadersCarrier) has(key string) bool {
+	for k := range c {
+		if strings.ToLower(k) == strings.ToLower(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// InjectMessage injects a trace into the headers of a message that is about
+// to be published. headers must not be nil.
+// It is a convenience function for Inject.
+func (tracer Tracer) InjectMessage(t *Trace, headers map[string][]byte) error {
+	return tracer.Inject(t.context(), opentracing.TextMap, MessageHeadersCarrier(headers))
+}
+
+// ExtractMessageChild extracts a trace from the headers of a message and
+// starts a span for processing it, which follows from the span that
+// published it. (SSF has no separate notion of FollowsFrom, so it is reported
+// as a child of that span.)
+//
+// If the headers have no trace in them at all, because the publisher wasn't
+// traced, it returns opentracing.ErrSpanContextNotFound, and the consumer
+// can start a new trace instead.
+func (tracer Tracer) ExtractMessageChild(resource string, headers map[string][]byte, name string) (*Span, error) {
+	return tracer.extractFollowsFrom(resource, MessageHeadersCarrier(headers), name)
+}
+
+// KafkaHeader is a header of a Kafka record. It has the same fields as
+// confluent-kafka-go's kafka.Header, so a client's headers can be converted
+// to and from them one by one.
+type KafkaHeader struct {
+	Key   string
+	Value []byte
+}
+
+// KafkaHeadersCarrier is a TextMap carrier for the headers of a Kafka
+// record. It encodes the trace the same way as MessageHeadersCarrier, so a
+// trace can be carried from one kind of queue to the other unchanged.
+//
+// Kafka allows a record to have several headers with the same key. Extract
+// reads the first of them, and Set replaces the first of them, so that
+// re-injecting into a record that is being forwarded overwrites the trace it
+// arrived with.
+type KafkaHeadersCarrier []KafkaHeader
+
+// Set implements opentracing.TextMapWriter.
+func (c *KafkaHeadersCarrier) Set(k, v string) {
+	for i, h := range *c {
+		if strings.ToLower(h.Key) == strings.ToLower(k) {
+			(*c)[i].Value = []byte(v)
+			return
+		}
+	}
+	*c = append(*c, KafkaHeader{Key: k, Value: []byte(v)})
+}
+
+// ForeachKey implements opentracing.TextMapReader. It visits the headers in
+// order, including any duplicates.
+func (c KafkaHeadersCarrier) ForeachKey(handler func(k, v string) error) error {
+	for _, h := range c {
+		if err := handler(h.Key, string(h.Value)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c KafkaHeadersCarrier) has(key string) bool {
+	for _, h := range c {
+		if strings.ToLower(h.Key) == strings.ToLower(key) {
+			return true
+		}
+	}
+	return false
+}
+
+// InjectKafka injects a trace into the headers of a Kafka record that is
+// about to be produced, appending to them as needed.
+// It is a convenience function for Inject.
+func (tracer Tracer) InjectKafka(t *Trace, headers *[]KafkaHeader) error {
+	return tracer.Inject(t.context(), opentracing.TextMap, (*KafkaHeadersCarrier)(headers))
+}
+
+// ExtractKafkaChild extracts a trace from the headers of a Kafka record and
+// starts a span for consuming it, which follows from the span that produced
+// it, like ExtractMessageChild. If the record was produced without a trace,
+// it returns opentracing.ErrSpanContextNotFound.
+func (tracer Tracer) ExtractKafkaChild(resource string, headers []KafkaHeader, name string) (*Span, error) {
+	return tracer.extractFollowsFrom(resource, KafkaHeadersCarrier(headers), name)
+}
+
+// headersCarrier is a carrier of message headers that can tell whether a
+// header is present at all.
+type headersCarrier interface {
+	opentracing.TextMapReader
+	has(key string) bool
+}
+
+// extractFollowsFrom extracts a trace from the headers of a message, and
+// starts a span that follows from it.
+func (tracer Tracer) extractFollowsFrom(resource string, carrier headersCarrier, name string) (*Span, error) {
+	parent, err := tracer.Extract(opentracing.TextMap, carrier)
+	if err != nil {
+		if !tracer.hasTraceHeaders(carrier) {
+			return nil, opentracing.ErrSpanContextNotFound
+		}
+		return nil, err
+	}
+
+	span := tracer.StartSpan(resource, opentracing.FollowsFrom(parent), NameTag(name)).(*Span)
+	span.Resource = resource
+	return span, nil
+}
+
+// hasTraceHeaders reports whether the carrier has any of the headers that
+// Extract would read a trace ID from.
+func (tracer Tracer) hasTraceHeaders(carrier headersCarrier) bool {
+	if tracer.PropagationFormat == PropagationXRay && carrier.has(XRayTraceHeader) {
+		return true
+	}
+	if carrier.has(tracer.textMapKeys().TraceId) {
+		return true
+	}
+	return tracer.AcceptDefaultTextMapKeys && carrier.has(DefaultTextMapKeys.TraceId)
+}
@@ -7,10 +7,13 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/Sirupsen/logrus"
 	"github.com/golang/protobuf/proto"
 	opentracing "github.com/opentracing/opentracing-go"
 	opentracinglog "github.com/opentracing/opentracing-go/log"
@@ -21,7 +24,25 @@ const TraceIdHeader = "Traceid"
 const SpanIdHeader = "Spanid"
 const ParentIdHeader = "Parentid"
 
-var GlobalTracer = Tracer{}
+// TextMapKeys holds the names of the fields used to propagate a span context
+// through TextMap and HTTPHeaders carriers.
+type TextMapKeys struct {
+	TraceId  string
+	SpanId   string
+	ParentId string
+	Resource string
+}
+
+// DefaultTextMapKeys are the field names used by a Tracer that
+// has not been configured with its own.
+var DefaultTextMapKeys = TextMapKeys{
+	TraceId:  "traceid",
+	SpanId:   "spanid",
+	ParentId: "parentid",
+	Resource: "resource",
+}
+
+var GlobalTracer = Tracer{Counts: &SpanCounts{}}
 
 func init() {
 	opentracing.SetGlobalTracer(GlobalTracer)
@@ -79,6 +100,20 @@ func (t textMapReaderWriter) CloneTo(w opentracing.TextMapWriter) {
 
 type spanContext struct {
 	baggageItems map[string]string
+
+	// the tags that children started from this context inherit, if the
+	// Tracer that created it has InheritTags set. They are not propagated
+	// across processes
+	inheritedTags []*ssf.SSFTag
+
+	// whether the span it was taken from was local, which its children
+	// are too by default. It is not propagated across processes either
+	local bool
+
+	// the Root of the X-Ray trace header that the context's trace was
+	// extracted from, which is injected back out unchanged so that the trace
+	// keeps its X-Ray ID. It is only propagated in X-Ray headers
+	xrayRoot string
 }
 
 func (c *spanContext) Init() {
@@ -137,6 +172,53 @@ func (c *spanContext) parseBaggageInt64(key string) int64 {
 	return val
 }
 
+// depthKey is the baggage item holding how deep the span is in its trace. It
+// is only set for spans that have a parent, and only injected by Tracers
+// with a MaxDepth, so other contexts inject the same fields as they always
+// have.
+const depthKey = "tracedepth"
+
+// Depth returns how many ancestors the span has, or 0 if it is a root span
+// or its depth was not propagated.
+func (c *spanContext) Depth() int {
+	return int(c.parseBaggageInt64(depthKey))
+}
+
+func (c *spanContext) setDepth(depth int) {
+	if depth > 0 {
+		c.baggageItems[depthKey] = strconv.Itoa(depth)
+	}
+}
+
+// sampledKey is the baggage item holding the sampling decision that
+// children started from this context share: "1" to keep them, and "0" to
+// drop them. It is only set once a decision has been made, at start by a
+// Tracer's Sampler or upstream by an X-Ray participant, so other contexts
+// inject the same fields as they always have.
+const sampledKey = "sampled"
+
+// samplingDecision returns the sampling decision that children started from
+// this context share, if one has been made.
+func (c *spanContext) samplingDecision() samplingDecision {
+	switch c.baggageItems[sampledKey] {
+	case "1":
+		return samplingKeep
+	case "0":
+		return samplingDrop
+	}
+	return samplingUndecided
+}
+
+// setSampling records the sampling decision, if there is one.
+func (c *spanContext) setSampling(decision samplingDecision) {
+	switch decision {
+	case samplingKeep:
+		c.baggageItems[sampledKey] = "1"
+	case samplingDrop:
+		c.baggageItems[sampledKey] = "0"
+	}
+}
+
 // Resource returns the resource assocaited with the spanContext
 func (c *spanContext) Resource() string {
 	var resource string
@@ -155,6 +237,24 @@ type Span struct {
 
 	*Trace
 
+	// set once the span has been counted as finished
+	finished int32
+
+	// set if the span was started after the tracer's Client was closed,
+	// in which case it is never sent
+	noop bool
+
+	// whether the Tracer's Sampler kept the span, once it has decided
+	sampling samplingDecision
+
+	// set if the span is only recorded in-process, and never sent
+	local bool
+
+	// set if the span was dropped when it started by a Tracer that
+	// SkipUnsampled, in which case it has no tags and is never built into
+	// a sample
+	unsampled bool
+
 	// These are currently ignored
 	logLines []opentracinglog.Field
 }
@@ -167,7 +267,7 @@ func (s *Span) Finish() {
 		return
 	}
 	s.FinishWithOptions(opentracing.FinishOptions{
-		FinishTime:  time.Now(),
+		FinishTime:  s.tracer.now(),
 		LogRecords:  nil,
 		BulkLogData: nil,
 	})
@@ -177,6 +277,7 @@ func (s *Span) Finish() {
 // FinishWithOptions finishes the span, but with explicit
 // control over timestamps and log data.
 // The BulkLogData field is deprecated and ignored.
+// Only the first call finishes the span; later ones do nothing.
 func (s *Span) FinishWithOptions(opts opentracing.FinishOptions) {
 	// This should never happen,
 	// but calling defer span.FinishWithOptions() should always be
@@ -187,11 +288,101 @@ func (s *Span) FinishWithOptions(opts opentracing.FinishOptions) {
 
 	// TODO remove the name tag from the slice of tags
 
-	s.Record(s.Name, s.Tags)
+	// a span is only reported by the first call, so finishing it again is
+	// harmless
+	if !atomic.CompareAndSwapInt32(&s.finished, 0, 1) {
+		return
+	}
+	if s.unsampled {
+		s.finishUnsampled()
+		return
+	}
+	if opts.FinishTime.IsZero() {
+		opts.FinishTime = s.tracer.now()
+	}
+	s.End = opts.FinishTime
+	s.tracer.sampleAtFinish(s)
+	if s.tracer.ResourceRules != nil {
+		s.Resource = s.tracer.ResourceRules.Apply(s.Resource)
+	}
+	s.tracer.limitTags(s.Trace.Tags)
+	if s.tracer.Counts != nil {
+		s.tracer.Counts.countSampling(s.Resource, !s.noop && !s.local && s.sampling != samplingDrop)
+		if !s.noop {
+			atomic.AddInt64(&s.tracer.Counts.finished, 1)
+		}
+	}
+	if s.noop {
+		return
+	}
+	if s.local {
+		if s.tracer.Recorder != nil {
+			s.tracer.Recorder.record(s.finishSample(s.Name, nil))
+		}
+		return
+	}
+	// spans the Sampler dropped still report their durations
+	if s.sampling != samplingDrop {
+		if s.tracer.Recorder != nil {
+			s.tracer.Recorder.record(s.finishSample(s.Name, nil))
+		}
+		if s.tracer.Client != nil {
+			if err := s.tracer.Client.Send(s.finishSample(s.Name, nil)); err != nil {
+				logrus.WithError(err).Error("Error submitting sample")
+			}
+		} else {
+			s.Record(s.Name, s.Trace.Tags)
+		}
+	}
+
+	if sample := s.tracer.durationSample(s); sample != nil {
+		var err error
+		if s.tracer.Client != nil {
+			err = s.tracer.Client.Send(sample)
+		} else {
+			err = sendSample(sample)
+		}
+		if err != nil {
+			logrus.WithError(err).Error("Error submitting duration sample")
+		}
+	}
 }
 
 func (s *Span) Context() opentracing.SpanContext {
-	return s.context()
+	c := s.context()
+	if s.tracer.InheritTags && !s.unsampled {
+		c.inheritedTags = s.inheritableTags()
+	}
+	c.local = s.local
+	c.setSampling(s.sampling)
+	return c
+}
+
+// uninheritableTags describe a span itself rather than the work it is part
+// of, so children never inherit them.
+var uninheritableTags = map[string]bool{
+	"name":      true,
+	"error":     true,
+	MeasuredTag: true,
+}
+
+// inheritableTags returns a copy of the span's current tags that children
+// should inherit, sorted by name. If a tag was set more than once, only the
+// latest value is inherited.
+func (s *Span) inheritableTags() []*ssf.SSFTag {
+	tags := s.Tags()
+	names := make([]string, 0, len(tags))
+	for name := range tags {
+		if !uninheritableTags[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	inherited := make([]*ssf.SSFTag, 0, len(names))
+	for _, name := range names {
+		inherited = append(inherited, &ssf.SSFTag{Name: name, Value: tags[name]})
+	}
+	return inherited
 }
 
 // contextAsParent() is like its exported counterpart,
@@ -204,6 +395,7 @@ func (s *Span) contextAsParent() *spanContext {
 	c.baggageItems["traceid"] = strconv.FormatInt(s.TraceId, 10)
 	c.baggageItems["parentid"] = strconv.FormatInt(s.ParentId, 10)
 	c.baggageItems["resource"] = s.Resource
+	c.setDepth(s.depth)
 	return c
 }
 
@@ -214,19 +406,48 @@ func (s *Span) SetOperationName(name string) opentracing.Span {
 
 // SetTag sets the tags on the underlying span
 func (s *Span) SetTag(key string, value interface{}) opentracing.Span {
-	tag := ssf.SSFTag{Name: key}
+	if s.unsampled {
+		// nothing will ever read it
+		return s
+	}
 	// TODO mutex
+	s.Trace.Tags = append(s.Trace.Tags, &ssf.SSFTag{Name: key, Value: tagValue(value)})
+	return s
+}
+
+// tagValue returns how a tag's value is sent.
+func tagValue(value interface{}) string {
 	switch v := value.(type) {
 	case string:
-		tag.Value = v
+		return v
 	case fmt.Stringer:
-		tag.Value = v.String()
+		return v.String()
 	default:
 		// TODO maybe just ban non-strings?
-		tag.Value = fmt.Sprintf("%#v", value)
+		return fmt.Sprintf("%#v", value)
 	}
-	s.Tags = append(s.Tags, &tag)
-	return s
+}
+
+// Tag returns the value of the span's tag with the given key, and whether it
+// has one. If the tag was set more than once, the latest value is returned.
+func (s *Span) Tag(key string) (string, bool) {
+	for i := len(s.Trace.Tags) - 1; i >= 0; i-- {
+		if s.Trace.Tags[i].Name == key {
+			return s.Trace.Tags[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// Tags returns a copy of the span's tags, keyed by name, with the latest
+// value of any tag that was set more than once. Modifying it does not affect
+// the span.
+func (s *Span) Tags() map[string]string {
+	tags := make(map[string]string, len(s.Trace.Tags))
+	for _, tag := range s.Trace.Tags {
+		tags[tag.Name] = tag.Value
+	}
+	return tags
 }
 
 // Attach attaches the span to the context.
@@ -278,6 +499,132 @@ func (s *Span) Log(data opentracing.LogData) {
 }
 
 type Tracer struct {
+	// TextMapKeys renames the fields that are injected into and
+	// extracted from TextMap and HTTPHeaders carriers, for interoperating
+	// with systems that expect other names. Any field left empty uses
+	// the name from DefaultTextMapKeys.
+	TextMapKeys TextMapKeys
+
+	// If AcceptDefaultTextMapKeys is set, Extract will also accept
+	// DefaultTextMapKeys for any field that is not present under its
+	// configured name. This is intended for migrating between the two
+	// naming schemes.
+	AcceptDefaultTextMapKeys bool
+
+	// PropagationFormat selects the encoding used for TextMap and
+	// HTTPHeaders carriers. The zero value is PropagationVeneur.
+	PropagationFormat PropagationFormat
+
+	// If Counts is set, every span started and finished by this Tracer
+	// is counted in it.
+	Counts *SpanCounts
+
+	// If ResourceRules is set, each span's resource is rewritten by the
+	// rules when it finishes, for collapsing high-cardinality resources
+	// (like URL paths with IDs in them) into templates.
+	ResourceRules *ResourceRules
+
+	// If TagHTTPRequests is set, spans created by ExtractRequestChild are
+	// tagged with the request's method, URL, host and user agent. The URL
+	// does not include the query string unless TagHTTPQueryStrings is also
+	// set, since query strings tend to be high-cardinality.
+	TagHTTPRequests     bool
+	TagHTTPQueryStrings bool
+
+	// If DurationMetrics is set, the duration of each finished span is
+	// also reported as a metric, which veneur aggregates into percentiles
+	// like any other histogram.
+	DurationMetrics DurationMetricType
+
+	// If Client is set, spans are sent through it rather than over a new
+	// connection each. Once the Client is closed, spans started by this
+	// Tracer are no-ops that are never sent.
+	Client *Client
+
+	// If InheritTags is set, a span started as a child of one of this
+	// Tracer's spans in the same process starts with a copy of its parent's
+	// tags, as they were when the parent's Context was taken (usually just
+	// as the child is started), apart from those that describe the parent
+	// itself: name, error and MeasuredTag. Tags set by the child's options
+	// take precedence.
+	InheritTags bool
+
+	// If MaxDepth is set, a span started more than MaxDepth levels below
+	// the root of its trace is a no-op that is never sent, so that runaway
+	// recursion can't produce endless spans. It carries its parent's
+	// context, so anything it propagates to still joins the trace at the
+	// last real span. Such spans are counted in Counts. The depth is
+	// injected along with the rest of the context, so the limit holds
+	// across services whose Tracers also set it.
+	MaxDepth int
+
+	// If MaxTagValueLength is set, tag values longer than that many bytes
+	// are truncated, with "..." marking where they were cut, when the span
+	// finishes, as are those of the metrics derived from it (like its
+	// DurationMetrics), so that one huge value, like a request body, can't
+	// make the span too big to send. Each truncation is counted in Counts.
+	MaxTagValueLength int
+
+	// MaxAnnotations bounds how many annotations each span keeps, so that
+	// a long-lived span can't grow without limit. Any more are dropped,
+	// and counted in Counts. If it isn't set, DefaultMaxAnnotations is
+	// used.
+	MaxAnnotations int
+
+	// If Recorder is set, every span this Tracer finishes (apart from
+	// no-ops) is also kept there, for inspecting in-process. It is the only
+	// place that local spans go.
+	Recorder *Recorder
+
+	// If Sampler is set, it decides which spans are sent. Otherwise every
+	// span is.
+	Sampler *Sampler
+
+	// If SkipUnsampled is set, and Sampler decides at start, a span that
+	// is dropped when it starts costs as little as possible: it gets its
+	// IDs and can be propagated (with the decision, so its children are
+	// dropped as well, even in other processes), but its tags are ignored,
+	// and nothing is built or sent when it finishes, not even its
+	// DurationMetrics, nor is it kept in the Recorder. It is still counted
+	// in Counts. Local spans are never skipped.
+	SkipUnsampled bool
+
+	// Clock is where spans get their start and finish times, unless they
+	// are given explicitly. If it is nil, the wall clock is used. Setting
+	// it lets tests control span durations.
+	Clock Clock
+}
+
+// Clock tells the time.
+type Clock interface {
+	Now() time.Time
+}
+
+// now returns the current time according to the Tracer's Clock.
+func (t Tracer) now() time.Time {
+	if t.Clock == nil {
+		return time.Now()
+	}
+	return t.Clock.Now()
+}
+
+// textMapKeys returns the Tracer's TextMapKeys, with the defaults filled in
+// for any fields that were not set.
+func (t Tracer) textMapKeys() TextMapKeys {
+	keys := t.TextMapKeys
+	if keys.TraceId == "" {
+		keys.TraceId = DefaultTextMapKeys.TraceId
+	}
+	if keys.SpanId == "" {
+		keys.SpanId = DefaultTextMapKeys.SpanId
+	}
+	if keys.ParentId == "" {
+		keys.ParentId = DefaultTextMapKeys.ParentId
+	}
+	if keys.Resource == "" {
+		keys.Resource = DefaultTextMapKeys.Resource
+	}
+	return keys
 }
 
 type spanOption struct {
@@ -325,6 +672,50 @@ func NameTag(name string) opentracing.StartSpanOption {
 	return customSpanTags("name", name)
 }
 
+// MeasuredTag is the tag that marks a span as measured, which tells Datadog
+// APM to compute service metrics (like latency) for it even though it isn't
+// the entry span of a service. Veneur sends it to Datadog as the
+// _dd.measured metric rather than as a tag.
+const MeasuredTag = "_dd.measured"
+
+// customSpanMeasured returns a StartSpanOption that marks the created Span
+// as measured. Spans are unmeasured unless they have this option.
+func customSpanMeasured() opentracing.StartSpanOption {
+	return customSpanTags(MeasuredTag, "1")
+}
+
+// Measured is a StartSpanOption that marks a span as measured, for getting
+// APM metrics on internal spans such as database calls. See MeasuredTag.
+func Measured() opentracing.StartSpanOption {
+	return customSpanMeasured()
+}
+
+// localSpanKey is the option that customSpanLocal sets, which StartSpan
+// takes out of the span's options rather than tagging the span with it.
+const localSpanKey = "veneur.local"
+
+// customSpanLocal returns a StartSpanOption that makes the created Span
+// local, if local is true: when it finishes, it is kept in the Tracer's
+// Recorder (if it has one) but never sent, nor are its DurationMetrics. It
+// can still be used in-process like any other span, and its children are
+// local too, unless they are started with customSpanLocal(false).
+func customSpanLocal(local bool) opentracing.StartSpanOption {
+	return &spanOption{
+		apply: func(sso *opentracing.StartSpanOptions) {
+			if sso.Tags == nil {
+				sso.Tags = map[string]interface{}{}
+			}
+			sso.Tags[localSpanKey] = local
+		},
+	}
+}
+
+// LocalSpan is a StartSpanOption that makes a span local, for dense
+// instrumentation that is only inspected in-process. See customSpanLocal.
+func LocalSpan(local bool) opentracing.StartSpanOption {
+	return customSpanLocal(local)
+}
+
 // StartSpan starts a span with the specified operationName (resource) and options.
 // If the options specify a parent span and/or root trace, the resource from the
 // root trace will be used.
@@ -341,19 +732,42 @@ func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOpt
 		o.Apply(&sso)
 	}
 
+	if t.Client != nil && t.Client.Closed() {
+		return &Span{
+			Trace:  StartTrace(operationName),
+			tracer: t,
+			noop:   true,
+		}
+	}
+
 	span := &Span{}
+	// the parent's sampling decision, if it has one
+	var inheritedSampling samplingDecision
+	var inheritedLocal bool
+
+	start := sso.StartTime
+	if start.IsZero() {
+		start = t.now()
+	}
 
 	if len(sso.References) == 0 {
 		// This is a root-level span
 		// beginning a new trace
+		trace := StartTrace(operationName)
+		if skipped := t.skipUnsampled(trace, samplingUndecided, false, nil, sso.Tags); skipped != nil {
+			return skipped
+		}
 		span = &Span{
-			Trace:  StartTrace(operationName),
+			Trace:  trace,
 			tracer: t,
 		}
+		span.Start = start
 	} else {
 
 		// First, let's extract the parent's information
 		parent := Trace{}
+		var grandparentId int64
+		var inheritedTags []*ssf.SSFTag
 
 		// TODO don't assume that the ReferencedContext is a concrete spanContext
 		for _, ref := range sso.References {
@@ -370,18 +784,45 @@ func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOpt
 				parent.TraceId = ctx.TraceId()
 				parent.SpanId = ctx.SpanId()
 				parent.Resource = ctx.Resource()
+				parent.depth = ctx.Depth()
+				parent.xrayRoot = ctx.xrayRoot
+				grandparentId = ctx.ParentId()
+				inheritedTags = ctx.inheritedTags
+				inheritedSampling = ctx.samplingDecision()
+				inheritedLocal = ctx.local
 
 			default:
 				// TODO handle error
 			}
 		}
 
+		if t.MaxDepth > 0 && parent.depth+1 > t.MaxDepth {
+			if t.Counts != nil {
+				atomic.AddInt64(&t.Counts.depthLimited, 1)
+			}
+			// stand in for the parent, so that the context we propagate
+			// is the parent's
+			parent.ParentId = grandparentId
+			return &Span{
+				Trace:    &parent,
+				tracer:   t,
+				noop:     true,
+				sampling: inheritedSampling,
+				local:    inheritedLocal,
+			}
+		}
+
 		// TODO allow us to start the trace as a separate operation
 		// to prevent measurement error in timing
 		trace := StartChildSpan(&parent)
+		if skipped := t.skipUnsampled(trace, inheritedSampling, inheritedLocal, inheritedTags, sso.Tags); skipped != nil {
+			return skipped
+		}
+		trace.Start = start
 
-		if !sso.StartTime.IsZero() {
-			trace.Start = sso.StartTime
+		// copied, so that children of the same parent don't share tags
+		for _, tag := range inheritedTags {
+			trace.Tags = append(trace.Tags, &ssf.SSFTag{Name: tag.Name, Value: tag.Value})
 		}
 
 		span = &Span{
@@ -391,17 +832,45 @@ func (t Tracer) StartSpan(operationName string, opts ...opentracing.StartSpanOpt
 
 	}
 
+	span.local = inheritedLocal
+	if local, ok := sso.Tags[localSpanKey].(bool); ok {
+		span.local = local
+		delete(sso.Tags, localSpanKey)
+	}
 	for k, v := range sso.Tags {
 		span.SetTag(k, v)
 		if k == "name" {
 			span.Name = v.(string)
 		}
 	}
+	t.sampleAtStart(span, inheritedSampling)
 
+	if t.Counts != nil {
+		atomic.AddInt64(&t.Counts.started, 1)
+	}
 	return span
 
 }
 
+// StartDetachedSpan starts a span for background work that a span starts
+// but doesn't wait for, such as fire-and-forget work kicked off by a
+// request. The span follows from parent, so it joins parent's trace, but
+// nothing else ties it to parent: it is sent whenever it is finished, before
+// or after parent is, and it carries no context.Context, so cancelling the
+// context the parent was serving doesn't affect it. Attach it to a fresh
+// context, eg span.Attach(context.Background()), to pass it to the
+// background work. If parent is nil, the span starts a new trace.
+func (t Tracer) StartDetachedSpan(parent *Span, resource string) *Span {
+	if parent == nil {
+		return t.StartSpan(resource).(*Span)
+	}
+	span := t.StartSpan(resource, opentracing.FollowsFrom(parent.Context())).(*Span)
+	// children take the trace's resource, but background work is its own
+	// operation
+	span.Resource = resource
+	return span
+}
+
 // InjectRequest injects a trace into an HTTP request header.
 // It is a convenience function for Inject.
 func (tracer Tracer) InjectRequest(t *Trace, req *http.Request) error {
@@ -425,13 +894,51 @@ func (tracer Tracer) ExtractRequestChild(resource string, req *http.Request, nam
 		TraceId:  parent.TraceId(),
 		ParentId: parent.ParentId(),
 		Resource: resource,
+		depth:    parent.Depth(),
 	})
+	t.Start = tracer.now()
 
 	t.Name = name
-	return &Span{
+	if tracer.Client != nil && tracer.Client.Closed() {
+		return &Span{tracer: tracer, Trace: t, noop: true}, nil
+	}
+	// with TagHTTPRequests, a rule could match the request's tags, which
+	// aren't set until the span is started as usual
+	if inherited := parent.samplingDecision(); inherited == samplingDrop || !tracer.TagHTTPRequests {
+		if skipped := tracer.skipUnsampled(t, inherited, false, nil, nil); skipped != nil {
+			return skipped, nil
+		}
+	}
+	if tracer.Counts != nil {
+		atomic.AddInt64(&tracer.Counts.started, 1)
+	}
+	span := &Span{
 		tracer: tracer,
 		Trace:  t,
-	}, nil
+	}
+	if tracer.TagHTTPRequests {
+		tracer.tagRequest(span, req)
+	}
+	tracer.sampleAtStart(span, parent.samplingDecision())
+	return span, nil
+}
+
+// tagRequest tags a span with the standard attributes of the HTTP request it
+// is serving.
+func (tracer Tracer) tagRequest(span *Span, req *http.Request) {
+	u := *req.URL
+	if !tracer.TagHTTPQueryStrings {
+		u.RawQuery = ""
+	}
+	u.Fragment = ""
+	u.User = nil
+
+	span.SetTag("http.method", req.Method)
+	span.SetTag("http.url", u.String())
+	span.SetTag("http.host", req.Host)
+	if ua := req.UserAgent(); ua != "" {
+		span.SetTag("http.user_agent", ua)
+	}
 }
 
 // Inject injects the provided SpanContext into the carrier for propagation.
@@ -467,8 +974,29 @@ func (t Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier i
 
 	// If the carrier is a TextMapWriter, treat it as one, regardless of what the format is
 	if w, ok := carrier.(opentracing.TextMapWriter); ok {
+		if t.PropagationFormat == PropagationXRay {
+			w.Set(XRayTraceHeader, formatXRayHeader(sc, t.now()))
+			return nil
+		}
 
-		textMapReaderWriter(sc.baggageItems).CloneTo(w)
+		keys := t.textMapKeys()
+		renamed := map[string]string{
+			DefaultTextMapKeys.TraceId:  keys.TraceId,
+			DefaultTextMapKeys.SpanId:   keys.SpanId,
+			DefaultTextMapKeys.ParentId: keys.ParentId,
+			DefaultTextMapKeys.Resource: keys.Resource,
+		}
+
+		textMapReaderWriter(sc.baggageItems).ForeachKey(func(k, v string) error {
+			if k == depthKey && t.MaxDepth <= 0 {
+				return nil
+			}
+			if name, ok := renamed[k]; ok {
+				k = name
+			}
+			w.Set(k, v)
+			return nil
+		})
 		return nil
 	}
 
@@ -477,15 +1005,52 @@ func (t Tracer) Inject(sm opentracing.SpanContext, format interface{}, carrier i
 
 // Extract returns a SpanContext given the format and the carrier.
 // The SpanContext returned represents the parent span (ie, SpanId refers to the parent span's own SpanId).
+// If the carrier has no context at all, it returns
+// opentracing.ErrSpanContextNotFound. A context whose ids are invalid (see
+// validateContext) is rejected with an error wrapping
+// opentracing.ErrSpanContextCorrupted, or has the invalid ids zeroed where
+// that still leaves a usable context, so a partly corrupt carrier never
+// yields a half-populated one.
 // TODO support all the BuiltinFormats
 func (t Tracer) Extract(format interface{}, carrier interface{}) (ctx opentracing.SpanContext, err error) {
+	// set if the carrier has no context at all, as opposed to one that
+	// couldn't be parsed
+	missing := false
+	normalized := false
 	defer func() {
 		if r := recover(); r != nil {
 			// TODO annotate this error type
 			err = ErrContractViolation{r}
 		}
+		if t.Counts != nil && err != opentracing.ErrUnsupportedFormat {
+			result := ExtractionSuccess
+			if _, ok := err.(errInvalidContext); ok {
+				result = ExtractionInvalid
+			} else if missing {
+				result = ExtractionMissing
+			} else if err != nil {
+				result = ExtractionMalformed
+			} else if normalized {
+				result = ExtractionNormalized
+			}
+			t.Counts.countExtraction(extractionFormat(format), result)
+		}
 	}()
 
+	c, err := t.extract(format, carrier, &missing)
+	if err != nil {
+		return nil, err
+	}
+	normalized, err = validateContext(c)
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// extract does the work of Extract, short of validating the context. It sets
+// missing if the carrier has no context at all.
+func (t Tracer) extract(format interface{}, carrier interface{}, missing *bool) (*spanContext, error) {
 	if format == opentracing.Binary {
 		// carrier is guaranteed to be an io.Reader by contract
 		r := carrier.(io.Reader)
@@ -493,12 +1058,19 @@ func (t Tracer) Extract(format interface{}, carrier interface{}) (ctx opentracin
 		if err != nil {
 			return nil, err
 		}
+		if len(packet) == 0 {
+			*missing = true
+			return nil, opentracing.ErrSpanContextNotFound
+		}
 
 		sample := ssf.SSFSample{}
 		err = proto.Unmarshal(packet, &sample)
 		if err != nil {
 			return nil, err
 		}
+		if sample.Trace == nil {
+			return nil, errInvalidContext{"the sample has no trace"}
+		}
 
 		trace := &Trace{
 			TraceId:  sample.Trace.TraceId,
@@ -514,20 +1086,51 @@ func (t Tracer) Extract(format interface{}, carrier interface{}) (ctx opentracin
 
 		// carrier is guaranteed to be an opentracing.TextMapReader by contract
 		// TODO support other TextMapReader implementations
-		traceId, err := strconv.ParseInt(textMapReaderGet(tm, TraceIdHeader), 10, 64)
-		spanId, err2 := strconv.ParseInt(textMapReaderGet(tm, SpanIdHeader), 10, 64)
-		parentId, err3 := strconv.ParseInt(textMapReaderGet(tm, ParentIdHeader), 10, 64)
+		if t.PropagationFormat == PropagationXRay {
+			if header := textMapReaderGet(tm, XRayTraceHeader); header != "" {
+				return parseXRayHeader(header)
+			}
+		}
+
+		keys := t.textMapKeys()
+		get := func(key, defaultKey string) string {
+			value := textMapReaderGet(tm, key)
+			if value == "" && t.AcceptDefaultTextMapKeys {
+				value = textMapReaderGet(tm, defaultKey)
+			}
+			return value
+		}
+		if get(keys.TraceId, DefaultTextMapKeys.TraceId) == "" &&
+			get(keys.SpanId, DefaultTextMapKeys.SpanId) == "" &&
+			get(keys.ParentId, DefaultTextMapKeys.ParentId) == "" {
+			*missing = true
+			return nil, opentracing.ErrSpanContextNotFound
+		}
+
+		traceId, err := strconv.ParseInt(get(keys.TraceId, DefaultTextMapKeys.TraceId), 10, 64)
+		spanId, err2 := strconv.ParseInt(get(keys.SpanId, DefaultTextMapKeys.SpanId), 10, 64)
+		parentId, err3 := strconv.ParseInt(get(keys.ParentId, DefaultTextMapKeys.ParentId), 10, 64)
 		if !(err == nil && err2 == nil && err3 == nil) {
 			return nil, errors.New("error parsing fields from TextMapReader")
 		}
 
+		// the depth and sampling decision are optional, since they aren't
+		// sent for root spans or by other tracers
+		depth, _ := strconv.Atoi(textMapReaderGet(tm, depthKey))
+
 		trace := &Trace{
 			TraceId:  traceId,
 			SpanId:   spanId,
 			ParentId: parentId,
-			Resource: textMapReaderGet(tm, "resource"),
+			Resource: get(keys.Resource, DefaultTextMapKeys.Resource),
+			depth:    depth,
 		}
-		return trace.context(), nil
+		c := trace.context()
+		switch sampled := textMapReaderGet(tm, sampledKey); sampled {
+		case "1", "0":
+			c.baggageItems[sampledKey] = sampled
+		}
+		return c, nil
 
 	}
 
@@ -4,12 +4,20 @@ package trace
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
+	"unicode/utf8"
 
 	"github.com/stripe/veneur/ssf"
 
@@ -85,10 +93,10 @@ func TestTracerChildSpan(t *testing.T) {
 	assert.Equal(t, expectedParent, trace.ParentId)
 	assert.Equal(t, resource, trace.Resource)
 
-	assert.Len(t, trace.Tags, len(expectedTags))
+	assert.Len(t, trace.Trace.Tags, len(expectedTags))
 
 	for _, tag := range expectedTags {
-		assert.Contains(t, trace.Tags, tag)
+		assert.Contains(t, trace.Trace.Tags, tag)
 	}
 }
 
@@ -244,6 +252,585 @@ func TestTracerInjectExtractHeader(t *testing.T) {
 
 }
 
+// TestTracerInjectCustomTextMapKeys tests that a Tracer with custom
+// TextMapKeys injects the span context under those names.
+func TestTracerInjectCustomTextMapKeys(t *testing.T) {
+	trace := DummySpan().Trace
+	trace.finish()
+	tracer := Tracer{TextMapKeys: TextMapKeys{
+		TraceId:  "x-trace",
+		SpanId:   "x-span",
+		ParentId: "x-parent",
+		// Resource is left empty, so it should use the default name
+	}}
+
+	tm := textMapReaderWriter(map[string]string{})
+
+	err := tracer.Inject(trace.context(), opentracing.TextMap, tm)
+	assert.NoError(t, err)
+
+	assert.Equal(t, strconv.FormatInt(trace.TraceId, 10), tm["x-trace"])
+	assert.Equal(t, strconv.FormatInt(trace.ParentId, 10), tm["x-parent"])
+	assert.Equal(t, strconv.FormatInt(trace.SpanId, 10), tm["x-span"])
+	assert.Equal(t, trace.Resource, tm["resource"])
+	assert.Len(t, tm, 4, "the default names should not be injected as well")
+
+	c, err := tracer.Extract(opentracing.TextMap, tm)
+	assert.NoError(t, err)
+
+	ctx := c.(*spanContext)
+	assert.Equal(t, trace.TraceId, ctx.TraceId())
+	assert.Equal(t, trace.SpanId, ctx.SpanId())
+	assert.Equal(t, trace.ParentId, ctx.ParentId())
+	assert.Equal(t, trace.Resource, ctx.Resource())
+}
+
+// TestTracerExtractDefaultTextMapKeys tests that a Tracer with custom
+// TextMapKeys only accepts the default names if it is configured to.
+func TestTracerExtractDefaultTextMapKeys(t *testing.T) {
+	trace := DummySpan().Trace
+	trace.finish()
+
+	// this carrier uses the default names, like an un-migrated client would
+	tm := textMapReaderWriter(map[string]string{})
+	err := Tracer{}.Inject(trace.context(), opentracing.TextMap, tm)
+	assert.NoError(t, err)
+
+	keys := TextMapKeys{
+		TraceId:  "x-trace",
+		SpanId:   "x-span",
+		ParentId: "x-parent",
+		Resource: "x-resource",
+	}
+
+	_, err = Tracer{TextMapKeys: keys}.Extract(opentracing.TextMap, tm)
+	assert.Error(t, err, "default names should not be accepted unless configured")
+
+	tracer := Tracer{TextMapKeys: keys, AcceptDefaultTextMapKeys: true}
+	c, err := tracer.Extract(opentracing.TextMap, tm)
+	assert.NoError(t, err)
+
+	ctx := c.(*spanContext)
+	assert.Equal(t, trace.TraceId, ctx.TraceId())
+	assert.Equal(t, trace.SpanId, ctx.SpanId())
+	assert.Equal(t, trace.ParentId, ctx.ParentId())
+	assert.Equal(t, trace.Resource, ctx.Resource())
+
+	// the configured names win when both are present
+	tm["x-trace"] = "12345"
+	c, err = tracer.Extract(opentracing.TextMap, tm)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12345), c.(*spanContext).TraceId())
+
+	// and custom names work over HTTP headers, which are canonicalized
+	req, err := http.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	carrier := opentracing.HTTPHeadersCarrier(req.Header)
+	err = tracer.Inject(trace.context(), opentracing.HTTPHeaders, carrier)
+	assert.NoError(t, err)
+	assert.Equal(t, strconv.FormatInt(trace.TraceId, 10), req.Header.Get("X-Trace"))
+
+	c, err = tracer.Extract(opentracing.HTTPHeaders, carrier)
+	assert.NoError(t, err)
+	assert.Equal(t, trace.TraceId, c.(*spanContext).TraceId())
+}
+
+// TestTracerExtractXRay tests that a Tracer using PropagationXRay maps an
+// X-Ray trace header into our ID space deterministically.
+func TestTracerExtractXRay(t *testing.T) {
+	tracer := Tracer{PropagationFormat: PropagationXRay}
+
+	req, err := http.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	req.Header.Set("X-Amzn-Trace-Id", "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=0")
+
+	c, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	assert.NoError(t, err)
+	ctx := c.(*spanContext)
+	// the lowest 63 bits of each ID
+	assert.Equal(t, int64(0x61be46a994272793), ctx.TraceId())
+	assert.Equal(t, int64(0x53995c3f42cd8ad8), ctx.SpanId())
+	assert.Equal(t, int64(0), ctx.ParentId())
+
+	again, err := tracer.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	assert.NoError(t, err)
+	assert.Equal(t, ctx.TraceId(), again.(*spanContext).TraceId(), "mapping should be deterministic")
+
+	// the sampling decision is passed along to the next hop
+	out := textMapReaderWriter(map[string]string{})
+	assert.NoError(t, tracer.Inject(ctx, opentracing.TextMap, out))
+	assert.Contains(t, out[XRayTraceHeader], ";Sampled=0")
+
+	// and so is the Root, unchanged, from children of the context too
+	child := tracer.StartSpan("child", opentracing.ChildOf(ctx)).(*Span)
+	out = textMapReaderWriter(map[string]string{})
+	assert.NoError(t, tracer.Inject(child.Context(), opentracing.TextMap, out))
+	assert.Contains(t, out[XRayTraceHeader], fmt.Sprintf("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=%016x;", child.SpanId))
+
+	for _, header := range []string{
+		"Parent=53995c3f42cd8ad8;Sampled=1",
+		"Root=2-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8",
+		"Root=1-5759e988-bd862e3fe1be46a9942727;Parent=53995c3f42cd8ad8",
+		"Root=1-5759e988-bd862e3fe1be46a994272793;Parent=zzzz5c3f42cd8ad8",
+	} {
+		tm := textMapReaderWriter(map[string]string{XRayTraceHeader: header})
+		_, err := tracer.Extract(opentracing.TextMap, tm)
+		assert.Error(t, err, "header %q should be rejected", header)
+	}
+
+	// without the X-Ray header, the veneur fields are used
+	trace := DummySpan().Trace
+	trace.finish()
+	tm := textMapReaderWriter(map[string]string{})
+	assert.NoError(t, Tracer{}.Inject(trace.context(), opentracing.TextMap, tm))
+	c, err = tracer.Extract(opentracing.TextMap, tm)
+	assert.NoError(t, err)
+	assert.Equal(t, trace.TraceId, c.(*spanContext).TraceId())
+
+	// and the X-Ray header is ignored unless the format is selected
+	_, err = Tracer{}.Extract(opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header))
+	assert.Error(t, err)
+}
+
+// TestTracerExtractXRayRoot tests that an X-Ray header with a Root but no
+// Parent starts a root span in that trace.
+func TestTracerExtractXRayRoot(t *testing.T) {
+	tracer := Tracer{PropagationFormat: PropagationXRay}
+	c, err := tracer.Extract(opentracing.TextMap, opentracing.TextMapCarrier{
+		XRayTraceHeader: "Root=1-5759e988-bd862e3fe1be46a994272793;Sampled=1",
+	})
+	assert.NoError(t, err)
+	ctx := c.(*spanContext)
+	assert.Equal(t, int64(0x61be46a994272793), ctx.TraceId())
+	assert.Equal(t, int64(0), ctx.SpanId())
+
+	child := tracer.StartSpan("child", opentracing.ChildOf(ctx)).(*Span)
+	assert.Equal(t, ctx.TraceId(), child.TraceId)
+	assert.Equal(t, int64(0), child.ParentId, "the child should be the root of its trace")
+	assert.NotEqual(t, int64(0), child.SpanId)
+
+	out := textMapReaderWriter(map[string]string{})
+	assert.NoError(t, tracer.Inject(child.Context(), opentracing.TextMap, out))
+	assert.Equal(t, fmt.Sprintf("Root=1-5759e988-bd862e3fe1be46a994272793;Parent=%016x;Sampled=1", child.SpanId), out[XRayTraceHeader])
+}
+
+// TestTracerInjectExtractXRay tests that our IDs survive a round trip
+// through an X-Ray trace header.
+func TestTracerInjectExtractXRay(t *testing.T) {
+	trace := DummySpan().Trace
+	trace.finish()
+	tracer := Tracer{PropagationFormat: PropagationXRay}
+
+	req, err := http.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	carrier := opentracing.HTTPHeadersCarrier(req.Header)
+	assert.NoError(t, tracer.Inject(trace.context(), opentracing.HTTPHeaders, carrier))
+
+	header := req.Header.Get("X-Amzn-Trace-Id")
+	assert.Regexp(t, "^Root=1-[0-9a-f]{8}-[0-9a-f]{24};Parent=[0-9a-f]{16};Sampled=1$", header)
+	assert.Len(t, req.Header, 1, "only the X-Ray header should be injected")
+
+	c, err := tracer.Extract(opentracing.HTTPHeaders, carrier)
+	assert.NoError(t, err)
+	ctx := c.(*spanContext)
+	assert.Equal(t, trace.TraceId, ctx.TraceId())
+	assert.Equal(t, trace.SpanId, ctx.SpanId())
+}
+
+// TestTracerSpanCounts tests that a Tracer with Counts set keeps track of
+// spans that have been started but not finished.
+func TestTracerSpanCounts(t *testing.T) {
+	tracer := Tracer{Counts: &SpanCounts{}}
+
+	root := tracer.StartSpan("root")
+	child := tracer.StartSpan("child", opentracing.ChildOf(root.Context()))
+	assert.Equal(t, int64(2), tracer.Counts.Started())
+	assert.Equal(t, int64(2), tracer.Counts.Active())
+
+	child.Finish()
+	child.Finish()
+	assert.Equal(t, int64(1), tracer.Counts.Finished(), "finishing twice should only count once")
+	assert.Equal(t, int64(1), tracer.Counts.Active())
+
+	req, err := http.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(nil))
+	assert.NoError(t, err)
+	assert.NoError(t, tracer.Inject(root.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)))
+	extracted, err := tracer.ExtractRequestChild("resource", req, "name")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), tracer.Counts.Active())
+
+	extracted.Finish()
+	root.Finish()
+	assert.Equal(t, int64(0), tracer.Counts.Active())
+
+	// tracers without Counts don't count anything
+	Tracer{}.StartSpan("uncounted").Finish()
+	assert.Equal(t, int64(3), tracer.Counts.Started())
+}
+
+func TestClientCloseDrains(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer serverConn.Close()
+
+	client, err := NewClient(serverConn.LocalAddr().String(), 16)
+	assert.NoError(t, err)
+	tracer := Tracer{Client: client, Counts: &SpanCounts{}}
+
+	for i := 0; i < 3; i++ {
+		tracer.StartSpan("before").Finish()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.Close(ctx))
+	assert.Equal(t, ErrClientClosed, client.Close(ctx))
+
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	for i := 0; i < 3; i++ {
+		n, err := serverConn.Read(buf)
+		if !assert.NoError(t, err, "expected every buffered span to be sent") {
+			return
+		}
+		sample := &ssf.SSFSample{}
+		assert.NoError(t, proto.Unmarshal(buf[:n], sample))
+		assert.Equal(t, "before", sample.Trace.Resource)
+	}
+
+	// spans started after Close are no-ops
+	span := tracer.StartSpan("after")
+	span.SetTag("foo", "bar")
+	span.Finish()
+	assert.Equal(t, int64(3), tracer.Counts.Started())
+	assert.Equal(t, ErrClientClosed, client.Send(&ssf.SSFSample{}))
+
+	serverConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = serverConn.Read(buf)
+	assert.Error(t, err, "nothing should be sent after Close")
+}
+
+func TestClientMetrics(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer serverConn.Close()
+
+	client, err := NewClient(serverConn.LocalAddr().String(), 16)
+	assert.NoError(t, err)
+	tracer := Tracer{Client: client}
+
+	// spans and metrics share the buffer, so they arrive in order
+	assert.NoError(t, client.Count("requests", 1, map[string]string{"route": "/"}))
+	tracer.StartSpan("span").Finish()
+	assert.NoError(t, client.Gauge("queue.depth", 4, nil))
+	assert.NoError(t, client.Histogram("body.bytes", 512, nil))
+	assert.NoError(t, client.Timing("query", 1500*time.Microsecond, nil))
+	assert.NoError(t, client.Set("users", "user-1", nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.Close(ctx))
+
+	serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	var samples []*ssf.SSFSample
+	for i := 0; i < 6; i++ {
+		n, err := serverConn.Read(buf)
+		if !assert.NoError(t, err, "expected every sample to be sent") {
+			return
+		}
+		sample := &ssf.SSFSample{}
+		assert.NoError(t, proto.Unmarshal(buf[:n], sample))
+		samples = append(samples, sample)
+	}
+
+	assert.Equal(t, ssf.SSFSample_COUNTER, samples[0].Metric)
+	assert.Equal(t, "requests", samples[0].Name)
+	assert.Equal(t, float32(1), samples[0].Value)
+	assert.Equal(t, []*ssf.SSFTag{{Name: "route", Value: "/"}}, samples[0].Tags)
+	assert.Nil(t, samples[0].Trace, "metrics are told apart from spans by not having a trace")
+	assert.Equal(t, ssf.SSFSample_TRACE, samples[1].Metric)
+	assert.Equal(t, "span", samples[1].Trace.Resource)
+	assert.Equal(t, ssf.SSFSample_GAUGE, samples[2].Metric)
+	assert.Equal(t, ssf.SSFSample_HISTOGRAM, samples[3].Metric)
+	assert.Equal(t, float32(512), samples[3].Value)
+	assert.Equal(t, ssf.SSFSample_HISTOGRAM, samples[4].Metric)
+	assert.Equal(t, "ms", samples[4].Unit)
+	assert.Equal(t, float32(1.5), samples[4].Value)
+	assert.Equal(t, ssf.SSFSample_SET, samples[5].Metric)
+	assert.Equal(t, "user-1", samples[5].Message)
+}
+
+func TestClientCloseDeadline(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer serverConn.Close()
+
+	client, err := NewClient(serverConn.LocalAddr().String(), 16)
+	assert.NoError(t, err)
+
+	// pretend a Send is stuck in progress
+	client.inflight.Add(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, client.Close(ctx))
+	assert.True(t, client.Closed())
+
+	// once it finishes, the sender shuts down
+	client.inflight.Done()
+	select {
+	case <-client.done:
+	case <-time.After(5 * time.Second):
+		assert.Fail(t, "timed out waiting for the sender to stop")
+	}
+}
+
+func TestTracerDurationMetrics(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer serverConn.Close()
+	client, err := NewClient(serverConn.LocalAddr().String(), 16)
+	assert.NoError(t, err)
+	rules, err := CompileResourceRules([]ResourceRule{{Pattern: `/users/\d+`, Replacement: "/users/:id"}})
+	assert.NoError(t, err)
+
+	oldService := Service
+	Service = "web"
+	defer func() { Service = oldService }()
+
+	read := func() *ssf.SSFSample {
+		serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4096)
+		n, err := serverConn.Read(buf)
+		if !assert.NoError(t, err) {
+			return &ssf.SSFSample{}
+		}
+		sample := &ssf.SSFSample{}
+		assert.NoError(t, proto.Unmarshal(buf[:n], sample))
+		return sample
+	}
+
+	for _, tc := range []struct {
+		typ  DurationMetricType
+		unit string
+	}{{DurationMetricHistogram, "ns"}, {DurationMetricTimer, "ms"}} {
+		tracer := Tracer{Client: client, ResourceRules: rules, DurationMetrics: tc.typ}
+		tracer.StartSpan("/users/123", NameTag("http.request")).Finish()
+
+		span := read()
+		assert.Equal(t, ssf.SSFSample_TRACE, span.Metric)
+
+		duration := read()
+		assert.Equal(t, ssf.SSFSample_HISTOGRAM, duration.Metric)
+		assert.Equal(t, "http.request.duration", duration.Name)
+		assert.Equal(t, tc.unit, duration.Unit)
+		assert.Equal(t, span.Trace.Duration, duration.Trace.Duration)
+		assert.Equal(t, []*ssf.SSFTag{
+			{Name: "resource", Value: "/users/:id"},
+			{Name: "service", Value: "web"},
+			{Name: "status", Value: "ok"},
+		}, duration.Tags, "the resource should be tagged after it has been rewritten")
+	}
+
+	// failed spans are told apart by their status, however they failed
+	tracer := Tracer{Client: client, DurationMetrics: DurationMetricHistogram}
+	failed := tracer.StartSpan("/login", NameTag("http.request")).(*Span)
+	failed.Error(errors.New("bad password"))
+	failed.Finish()
+	tagged := tracer.StartSpan("/login", NameTag("http.request"))
+	tagged.SetTag("error", true)
+	tagged.Finish()
+	for i := 0; i < 2; i++ {
+		read()
+		status := ""
+		for _, tag := range read().Tags {
+			if tag.Name == "status" {
+				status = tag.Value
+			}
+		}
+		assert.Equal(t, "error", status)
+	}
+
+	// nothing extra is sent by default, or by finishing a span again
+	quiet := Tracer{Client: client}.StartSpan("quiet", NameTag("quiet"))
+	quiet.Finish()
+	quiet.Finish()
+	assert.Equal(t, ssf.SSFSample_TRACE, read().Metric)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NoError(t, client.Close(ctx))
+	serverConn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = serverConn.Read(make([]byte, 4096))
+	assert.Error(t, err)
+}
+
+func TestTruncateTagValue(t *testing.T) {
+	for _, tc := range []struct {
+		value, want string
+		max         int
+	}{
+		{"short", "short", 5},
+		{"longer", "lo...", 5},
+		// "é" is two bytes, so cutting after 3 bytes would split one
+		{"ééé", "é...", 5},
+		{"日本語です", "日本...", 11},
+		{"日本語です", "日...", 8},
+		{"ab", "ab", 2},
+		{"abcd", "ab", 2},
+		{"日本", "", 2},
+	} {
+		got, truncated := truncateTagValue(tc.value, tc.max)
+		assert.Equal(t, tc.want, got, "%q to %d bytes", tc.value, tc.max)
+		assert.Equal(t, tc.want != tc.value, truncated)
+		assert.True(t, len(got) <= tc.max)
+		assert.True(t, utf8.ValidString(got), "%q should still be valid UTF-8", got)
+	}
+}
+
+func TestTracerMaxTagValueLength(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer serverConn.Close()
+	client, err := NewClient(serverConn.LocalAddr().String(), 16)
+	assert.NoError(t, err)
+	defer client.Close(context.Background())
+
+	read := func() *ssf.SSFSample {
+		serverConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 4096)
+		n, err := serverConn.Read(buf)
+		if !assert.NoError(t, err) {
+			return &ssf.SSFSample{}
+		}
+		sample := &ssf.SSFSample{}
+		assert.NoError(t, proto.Unmarshal(buf[:n], sample))
+		return sample
+	}
+
+	tracer := Tracer{Client: client, Counts: &SpanCounts{}, DurationMetrics: DurationMetricHistogram, MaxTagValueLength: 8}
+	span := tracer.StartSpan("/résumé/upload", NameTag("http.request"))
+	span.SetTag("body", strings.Repeat("x", 10000))
+	span.SetTag("short", "ok")
+	span.Finish()
+
+	sent := read()
+	tags := map[string]string{}
+	for _, tag := range sent.Tags {
+		tags[tag.Name] = tag.Value
+	}
+	assert.Equal(t, "xxxxx...", tags["body"], "the tag should still be there, cut short")
+	assert.Equal(t, "ok", tags["short"])
+	assert.Equal(t, "/résumé/upload", sent.Trace.Resource, "only tags are truncated")
+
+	duration := read()
+	assert.Equal(t, "resource", duration.Tags[0].Name)
+	assert.Equal(t, "/rés...", duration.Tags[0].Value, "tags copied onto metrics are truncated too")
+	assert.Equal(t, "http....", tags["name"], "the name is a tag too")
+	assert.Equal(t, int64(3), tracer.Counts.TagsTruncated())
+}
+
+func TestCompileResourceRules(t *testing.T) {
+	_, err := CompileResourceRules([]ResourceRule{{Pattern: "(", Replacement: "x"}})
+	assert.Error(t, err, "invalid patterns should be rejected")
+
+	_, err = CompileResourceRules([]ResourceRule{{Pattern: "", Replacement: "x"}})
+	assert.Error(t, err, "empty patterns should be rejected")
+
+	rules, err := CompileResourceRules([]ResourceRule{
+		{Pattern: `^/users/\d+`, Replacement: "/users/:id"},
+		{Pattern: `^/users/.*`, Replacement: "/users/other"},
+		{Pattern: `^/secret$`, Replacement: ""},
+		{Pattern: `\?.*$`, Replacement: ""},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "/users/:id/posts", rules.Apply("/users/123/posts"))
+	assert.Equal(t, "/users/other", rules.Apply("/users/bob"), "only the first matching rule should apply")
+	assert.Equal(t, "/secret", rules.Apply("/secret"), "rewrites to an empty resource should be discarded")
+	assert.Equal(t, "/search", rules.Apply("/search?q=veneur"))
+	assert.Equal(t, "/unmatched", rules.Apply("/unmatched"))
+}
+
+// TestTracerResourceRules tests that each span has the Tracer's
+// ResourceRules applied to its resource when it finishes.
+func TestTracerResourceRules(t *testing.T) {
+	rules, err := CompileResourceRules([]ResourceRule{{Pattern: `/\d+`, Replacement: "/:id"}})
+	assert.NoError(t, err)
+	tracer := Tracer{ResourceRules: rules}
+
+	root := tracer.StartSpan("/users/123").(*Span)
+	child := tracer.StartSpan("child", opentracing.ChildOf(root.Context())).(*Span)
+	child.Resource = "/posts/456"
+	assert.Equal(t, "/users/123", root.Resource, "resources should not change until the span finishes")
+
+	child.Finish()
+	assert.Equal(t, "/posts/:id", child.Resource)
+	assert.Equal(t, "/users/123", root.Resource, "each span should be rewritten independently")
+
+	root.Finish()
+	assert.Equal(t, "/users/:id", root.Resource)
+
+	rules, err = CompileResourceRules([]ResourceRule{{Pattern: `^/api`, Replacement: "/api/v1"}})
+	assert.NoError(t, err)
+	span := Tracer{ResourceRules: rules}.StartSpan("/api/users").(*Span)
+	span.Finish()
+	span.Finish()
+	assert.Equal(t, "/api/v1/users", span.Resource, "the rules should only be applied once")
+}
+
+// TestSpanTags tests reading tags back off a span.
+func TestSpanTags(t *testing.T) {
+	span := Tracer{}.StartSpan("resource", NameTag("my.name")).(*Span)
+	span.SetTag("foo", "bar")
+	span.SetTag("count", 3)
+	span.SetTag("foo", "baz")
+
+	value, ok := span.Tag("foo")
+	assert.True(t, ok)
+	assert.Equal(t, "baz", value, "the latest value should win")
+	value, ok = span.Tag("count")
+	assert.True(t, ok)
+	assert.Equal(t, "3", value)
+	_, ok = span.Tag("missing")
+	assert.False(t, ok)
+
+	tags := span.Tags()
+	assert.Equal(t, map[string]string{"name": "my.name", "foo": "baz", "count": "3"}, tags)
+	tags["foo"] = "changed"
+	delete(tags, "name")
+	value, _ = span.Tag("foo")
+	assert.Equal(t, "baz", value, "modifying the copy shouldn't affect the span")
+	assert.Len(t, span.Tags(), 3)
+}
+
+// TestExtractRequestChildHTTPTags tests that a Tracer with TagHTTPRequests
+// tags extracted spans with the request's attributes.
+func TestExtractRequestChildHTTPTags(t *testing.T) {
+	trace := DummySpan().Trace
+	trace.finish()
+
+	newRequest := func() *http.Request {
+		req, err := http.NewRequest(http.MethodPost, "http://veneur.example.com/import?user=123", bytes.NewBuffer(nil))
+		assert.NoError(t, err)
+		req.Header.Set("User-Agent", "veneur-test/1.0")
+		assert.NoError(t, Tracer{}.InjectRequest(trace, req))
+		return req
+	}
+
+	span, err := Tracer{}.ExtractRequestChild("/import", newRequest(), "veneur.import")
+	assert.NoError(t, err)
+	assert.NotContains(t, span.Tags(), "http.method", "requests should only be tagged if configured")
+
+	span, err = Tracer{TagHTTPRequests: true}.ExtractRequestChild("/import", newRequest(), "veneur.import")
+	assert.NoError(t, err)
+	tags := span.Tags()
+	assert.Equal(t, "POST", tags["http.method"])
+	assert.Equal(t, "http://veneur.example.com/import", tags["http.url"], "query string should be left out")
+	assert.Equal(t, "veneur.example.com", tags["http.host"])
+	assert.Equal(t, "veneur-test/1.0", tags["http.user_agent"])
+
+	span, err = Tracer{TagHTTPRequests: true, TagHTTPQueryStrings: true}.ExtractRequestChild("/import", newRequest(), "veneur.import")
+	assert.NoError(t, err)
+	assert.Equal(t, "http://veneur.example.com/import?user=123", span.Tags()["http.url"])
+}
+
 // assertContextUnmarshalEqual is a helper that asserts that the given SSFSample
 // matches the expected *Trace on all fields that are passed through a SpanContext.
 // Since a SpanContext doesn't pass fields like tags, this function will not cause
@@ -288,3 +875,834 @@ func TestInjectRequestExtractRequestChild(t *testing.T) {
 	assert.Equal(t, trace.SpanId, span.ParentId, "child should have the original trace's SpanId as its ParentId")
 	assert.Equal(t, trace.TraceId, span.TraceId)
 }
+
+// TestInjectMessageExtractMessageChild tests that a trace survives a round
+// trip through message headers, and that a message with no trace in its
+// headers is distinguishable from one with a broken trace.
+func TestInjectMessageExtractMessageChild(t *testing.T) {
+	trace := DummySpan().Trace
+	trace.finish()
+	tracer := Tracer{}
+
+	headers := map[string][]byte{"Content-Type": []byte("application/json")}
+	assert.NoError(t, tracer.InjectMessage(trace, headers))
+	assert.Equal(t, []byte(strconv.FormatInt(trace.TraceId, 10)), headers["traceid"])
+
+	span, err := tracer.ExtractMessageChild("process job", headers, "jobs.process")
+	assert.NoError(t, err)
+	assert.NotEqual(t, trace.SpanId, span.SpanId)
+	assert.Equal(t, trace.SpanId, span.ParentId, "the consumer's span should follow from the producer's")
+	assert.Equal(t, trace.TraceId, span.TraceId)
+	assert.Equal(t, "process job", span.Resource)
+	assert.Equal(t, "jobs.process", span.Name)
+
+	_, err = tracer.ExtractMessageChild("process job", map[string][]byte{}, "jobs.process")
+	assert.Equal(t, opentracing.ErrSpanContextNotFound, err)
+	_, err = tracer.ExtractMessageChild("process job", nil, "jobs.process")
+	assert.Equal(t, opentracing.ErrSpanContextNotFound, err)
+
+	headers["traceid"] = []byte{0xff, 0x00, 0x12}
+	_, err = tracer.ExtractMessageChild("process job", headers, "jobs.process")
+	assert.Error(t, err)
+	assert.NotEqual(t, opentracing.ErrSpanContextNotFound, err)
+
+	xray := Tracer{PropagationFormat: PropagationXRay}
+	headers = map[string][]byte{}
+	assert.NoError(t, xray.InjectMessage(trace, headers))
+	span, err = xray.ExtractMessageChild("process job", headers, "jobs.process")
+	assert.NoError(t, err)
+	assert.Equal(t, trace.SpanId, span.ParentId)
+	assert.Equal(t, trace.TraceId, span.TraceId)
+}
+
+// TestInjectKafkaExtractKafkaChild tests that a trace survives a round trip
+// through Kafka record headers, including ones with duplicate keys.
+func TestInjectKafkaExtractKafkaChild(t *testing.T) {
+	trace := DummySpan().Trace
+	trace.finish()
+	tracer := Tracer{}
+
+	headers := []KafkaHeader{{Key: "content-type", Value: []byte("application/json")}}
+	assert.NoError(t, tracer.InjectKafka(trace, &headers))
+	assert.Equal(t, "content-type", headers[0].Key, "existing headers should be kept")
+	assert.Contains(t, headers, KafkaHeader{Key: "traceid", Value: []byte(strconv.FormatInt(trace.TraceId, 10))})
+
+	span, err := tracer.ExtractKafkaChild("consume order", headers, "orders.consume")
+	assert.NoError(t, err)
+	assert.Equal(t, trace.SpanId, span.ParentId, "the consumer's span should follow from the producer's")
+	assert.Equal(t, trace.TraceId, span.TraceId)
+	assert.Equal(t, "consume order", span.Resource)
+	assert.Equal(t, "orders.consume", span.Name)
+
+	// the first of several headers with the same key wins, and injecting
+	// again replaces it rather than adding another
+	headers = append(headers, KafkaHeader{Key: "traceid", Value: []byte("1")})
+	span, err = tracer.ExtractKafkaChild("consume order", headers, "orders.consume")
+	assert.NoError(t, err)
+	assert.Equal(t, trace.TraceId, span.TraceId)
+	next := DummySpan().Trace
+	next.finish()
+	n := len(headers)
+	assert.NoError(t, tracer.InjectKafka(next, &headers))
+	assert.Len(t, headers, n)
+	span, err = tracer.ExtractKafkaChild("consume order", headers, "orders.consume")
+	assert.NoError(t, err)
+	assert.Equal(t, next.TraceId, span.TraceId)
+
+	var none []KafkaHeader
+	_, err = tracer.ExtractKafkaChild("consume order", none, "orders.consume")
+	assert.Equal(t, opentracing.ErrSpanContextNotFound, err)
+	assert.NoError(t, tracer.InjectKafka(trace, &none), "injecting into no headers should add them")
+	_, err = tracer.ExtractKafkaChild("consume order", none, "orders.consume")
+	assert.NoError(t, err)
+
+	// the encoding is the same as for other message headers
+	msg := map[string][]byte{}
+	for _, h := range headers {
+		if _, ok := msg[h.Key]; !ok {
+			msg[h.Key] = h.Value
+		}
+	}
+	span, err = tracer.ExtractMessageChild("consume order", msg, "orders.consume")
+	assert.NoError(t, err)
+	assert.Equal(t, next.TraceId, span.TraceId)
+}
+
+func TestSQLComment(t *testing.T) {
+	span := &Span{Trace: &Trace{TraceId: 1111, SpanId: 2222}}
+	assert.Equal(t, "/*traceparent='00-00000000000000000000000000000457-00000000000008ae-01'*/", SQLComment(span))
+
+	drop, err := NewSampler(0, nil, SampleAtStart)
+	assert.NoError(t, err)
+	dropped := Tracer{Sampler: drop}.StartSpan("dropped").(*Span)
+	assert.Regexp(t, "-00'\\*/$", SQLComment(dropped), "spans the Sampler dropped should be flagged as not sampled")
+
+	assert.Equal(t, "", SQLComment(nil), "untraced queries should get no comment")
+}
+
+func TestSpanSetGRPCStatus(t *testing.T) {
+	tracer := Tracer{}
+	span := tracer.StartSpan("grpc").(*Span)
+	span.SetGRPCStatus(5, "no such widget")
+	assert.Equal(t, map[string]string{
+		"grpc.code":    "NotFound",
+		"grpc.message": "no such widget",
+		"error":        "true",
+	}, span.Tags())
+
+	ok := tracer.StartSpan("grpc").(*Span)
+	ok.SetGRPCStatus(0, "")
+	assert.Equal(t, map[string]string{"grpc.code": "OK"}, ok.Tags(), "an OK status is not an error")
+
+	assert.Equal(t, "Unauthenticated", GRPCCodeName(16))
+	assert.Equal(t, "Code(17)", GRPCCodeName(17))
+}
+
+func TestTracerMaxDepth(t *testing.T) {
+	tracer := Tracer{MaxDepth: 2, Counts: &SpanCounts{}}
+
+	root := tracer.StartSpan("recurse").(*Span)
+	child := tracer.StartSpan("recurse", opentracing.ChildOf(root.Context())).(*Span)
+	grandchild := tracer.StartSpan("recurse", opentracing.ChildOf(child.Context())).(*Span)
+	assert.False(t, grandchild.noop, "spans up to MaxDepth deep are real")
+
+	tooDeep := tracer.StartSpan("recurse", opentracing.ChildOf(grandchild.Context())).(*Span)
+	assert.True(t, tooDeep.noop)
+	assert.Equal(t, grandchild.SpanId, tooDeep.SpanId, "a limited span stands in for its parent")
+	assert.Equal(t, grandchild.ParentId, tooDeep.ParentId)
+	assert.Equal(t, int64(3), tracer.Counts.Started())
+	assert.Equal(t, int64(1), tracer.Counts.DepthLimited())
+
+	// the depth survives propagation, so the limit applies to the whole
+	// trace and not just this process
+	carrier := opentracing.TextMapCarrier{}
+	assert.NoError(t, tracer.Inject(tooDeep.Context(), opentracing.TextMap, carrier))
+	assert.Equal(t, "2", carrier["tracedepth"])
+	assert.Equal(t, strconv.FormatInt(grandchild.SpanId, 10), carrier["spanid"])
+	extracted, err := tracer.Extract(opentracing.TextMap, carrier)
+	assert.NoError(t, err)
+	remote := tracer.StartSpan("recurse", opentracing.ChildOf(extracted)).(*Span)
+	assert.True(t, remote.noop)
+	assert.Equal(t, int64(2), tracer.Counts.DepthLimited())
+	assert.Equal(t, LimitCounts{DepthLimited: 2}, tracer.Counts.TakeLimits())
+	assert.Equal(t, LimitCounts{}, tracer.Counts.TakeLimits(), "taking the limits should only return what is new")
+	assert.Equal(t, int64(2), tracer.Counts.DepthLimited(), "taking the limits shouldn't reset the totals")
+
+	// root spans don't send a depth at all
+	carrier = opentracing.TextMapCarrier{}
+	assert.NoError(t, tracer.Inject(root.Context(), opentracing.TextMap, carrier))
+	_, ok := carrier["tracedepth"]
+	assert.False(t, ok)
+
+	// nor do tracers without a MaxDepth
+	carrier = opentracing.TextMapCarrier{}
+	assert.NoError(t, Tracer{}.Inject(child.Context(), opentracing.TextMap, carrier))
+	_, ok = carrier["tracedepth"]
+	assert.False(t, ok)
+}
+
+func TestSpanCountsSampling(t *testing.T) {
+	rules, err := CompileResourceRules([]ResourceRule{{Pattern: `^/users/\d+$`, Replacement: "/users/:id"}})
+	assert.NoError(t, err)
+	tracer := Tracer{MaxDepth: 1, Counts: &SpanCounts{}, ResourceRules: rules}
+
+	root := tracer.StartSpan("/users/1")
+	child := tracer.StartSpan("child", opentracing.ChildOf(root.Context()))
+	tooDeep := tracer.StartSpan("child", opentracing.ChildOf(child.Context()))
+	tooDeep.Finish()
+	child.Finish()
+	child.Finish()
+	root.Finish()
+	tracer.StartSpan("/users/2").Finish()
+
+	assert.Equal(t, map[string]SamplingCounts{
+		"/users/:id": {Created: 4, Kept: 3},
+	}, tracer.Counts.TakeSampling(), "finishing twice should only count once")
+	assert.Empty(t, tracer.Counts.TakeSampling(), "taking the counts should reset them")
+	assert.Equal(t, int64(3), tracer.Counts.Finished(), "dropped spans aren't counted as finished")
+
+	for i := 0; i < maxSamplingResources+2; i++ {
+		tracer.StartSpan(strconv.Itoa(i)).Finish()
+	}
+	sampling := tracer.Counts.TakeSampling()
+	assert.Len(t, sampling, maxSamplingResources+1)
+	assert.Equal(t, SamplingCounts{Created: 2, Kept: 2}, sampling[otherResource])
+}
+
+func TestCustomSpanMeasured(t *testing.T) {
+	tracer := Tracer{}
+	root := tracer.StartSpan("root").(*Span)
+	db := tracer.StartSpan("db", opentracing.ChildOf(root.Context()), customSpanMeasured()).(*Span)
+	other := tracer.StartSpan("other", opentracing.ChildOf(root.Context())).(*Span)
+
+	tags := map[string]string{}
+	for _, tag := range db.SSFSample().Tags {
+		tags[tag.Name] = tag.Value
+	}
+	assert.Equal(t, "1", tags[MeasuredTag], "the flag should be carried into the SSF sample")
+	_, ok := other.Tag(MeasuredTag)
+	assert.False(t, ok, "spans are unmeasured by default")
+}
+
+func TestTracerInheritTags(t *testing.T) {
+	tracer := Tracer{InheritTags: true}
+	root := tracer.StartSpan("root", NameTag("root.name")).(*Span)
+	root.SetTag("request_id", "abc")
+	root.SetTag("tier", "free")
+	root.SetTag("tier", "paid")
+	root.SetTag("error", "true")
+
+	child := tracer.StartSpan("child", opentracing.ChildOf(root.Context()), customSpanTags("tier", "override")).(*Span)
+	assert.Equal(t, map[string]string{
+		"request_id": "abc",
+		"tier":       "override",
+	}, child.Tags(), "a child should inherit its parent's tags, but not ones about the parent itself")
+	assert.Equal(t, "", child.Name)
+
+	// copy-on-create: changing the parent later doesn't change the child
+	root.SetTag("late", "yes")
+	_, ok := child.Tag("late")
+	assert.False(t, ok)
+	grandchild := tracer.StartSpan("grandchild", opentracing.ChildOf(child.Context())).(*Span)
+	assert.Equal(t, "abc", grandchild.Tags()["request_id"], "inherited tags pass down the whole trace")
+
+	plain := Tracer{}.StartSpan("root").(*Span)
+	plain.SetTag("request_id", "abc")
+	assert.Empty(t, Tracer{}.StartSpan("child", opentracing.ChildOf(plain.Context())).(*Span).Tags(), "children start tag-less without InheritTags")
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestTracerClock(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	tracer := Tracer{Clock: clock}
+
+	root := tracer.StartSpan("root").(*Span)
+	child := tracer.StartSpan("child", opentracing.ChildOf(root.Context())).(*Span)
+	assert.Equal(t, clock.now, root.Start)
+	assert.Equal(t, clock.now, child.Start)
+
+	clock.now = clock.now.Add(3 * time.Second)
+	child.Finish()
+	clock.now = clock.now.Add(2 * time.Second)
+	root.Finish()
+	assert.Equal(t, 3*time.Second, child.Duration())
+	assert.Equal(t, 5*time.Second, root.Duration())
+
+	// an explicit start time still wins
+	start := time.Unix(1400000000, 0)
+	custom := tracer.StartSpan("custom", customSpanStart(start)).(*Span)
+	assert.Equal(t, start, custom.Start)
+	customChild := tracer.StartSpan("child", opentracing.ChildOf(custom.Context()), customSpanStart(start)).(*Span)
+	assert.Equal(t, start, customChild.Start)
+
+	// as does an explicit finish time
+	end := clock.now.Add(time.Minute)
+	customChild.FinishWithOptions(opentracing.FinishOptions{FinishTime: end})
+	assert.Equal(t, end, customChild.End)
+}
+
+func TestTraceMiddleware(t *testing.T) {
+	var span *Span
+	status := http.StatusNotFound
+	handler := TraceMiddleware(Tracer{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span = opentracing.SpanFromContext(r.Context()).(*Span)
+		w.WriteHeader(status)
+	}))
+
+	// a request with no trace starts one
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/widgets?id=1", nil))
+	if assert.NotNil(t, span) {
+		assert.Equal(t, int64(0), span.ParentId)
+		assert.Equal(t, "/widgets", span.Resource)
+		assert.Equal(t, HTTPRequestSpanName, span.Name)
+		assert.Equal(t, map[string]string{
+			"name":             HTTPRequestSpanName,
+			"http.method":      "GET",
+			"http.url":         "/widgets",
+			"http.host":        "example.com",
+			"http.status_code": "404",
+		}, span.Tags())
+		assert.False(t, span.End.IsZero(), "the span should be finished")
+	}
+
+	// one that carries a trace continues it
+	parent := DummySpan().Trace
+	req := httptest.NewRequest(http.MethodPost, "/widgets", nil)
+	assert.NoError(t, Tracer{}.InjectRequest(parent, req))
+	status = http.StatusServiceUnavailable
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+	assert.Equal(t, parent.TraceId, span.TraceId)
+	assert.Equal(t, parent.SpanId, span.ParentId)
+	assert.Equal(t, "503", span.Tags()["http.status_code"])
+	assert.Equal(t, "true", span.Tags()["error"], "a 5xx is an error")
+
+	// handlers that never call WriteHeader respond 200
+	handler = TraceMiddleware(Tracer{}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span = opentracing.SpanFromContext(r.Context()).(*Span)
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, "200", span.Tags()["http.status_code"])
+}
+
+func TestTracerSamplerAtStart(t *testing.T) {
+	sampler, err := NewSampler(0, []SamplingRule{
+		{Tag: "debug", Value: "true", Keep: false},
+		{Tag: "priority", Value: "high", Keep: true},
+	}, SampleAtStart)
+	assert.NoError(t, err)
+	tracer := Tracer{Sampler: sampler, Counts: &SpanCounts{}}
+
+	high := tracer.StartSpan("high", customSpanTags("priority", "high"))
+	tracer.StartSpan("high", opentracing.ChildOf(high.Context())).Finish()
+	high.Finish()
+
+	low := tracer.StartSpan("low")
+	tracer.StartSpan("low", opentracing.ChildOf(low.Context()), customSpanTags("priority", "high")).Finish()
+	// tags set after the span started aren't considered
+	low.SetTag("priority", "high")
+	low.Finish()
+
+	debug := tracer.StartSpan("debug", customSpanTags("priority", "high"), customSpanTags("debug", "true"))
+	debug.Finish()
+
+	assert.Equal(t, map[string]SamplingCounts{
+		"high":  {Created: 2, Kept: 2},
+		"low":   {Created: 2, Kept: 0},
+		"debug": {Created: 1, Kept: 0},
+	}, tracer.Counts.TakeSampling(), "children should share their parent's decision, and the first matching rule decides")
+	assert.Equal(t, int64(5), tracer.Counts.Finished(), "sampled out spans are still finished")
+}
+
+func TestTracerSamplerAtFinish(t *testing.T) {
+	sampler, err := NewSampler(0, []SamplingRule{{Tag: "priority", Keep: true}}, SampleAtFinish)
+	assert.NoError(t, err)
+	tracer := Tracer{Sampler: sampler, Counts: &SpanCounts{}}
+
+	root := tracer.StartSpan("root")
+	child := tracer.StartSpan("child", opentracing.ChildOf(root.Context()))
+	child.SetTag("priority", "low")
+	child.Finish()
+	root.Finish()
+
+	assert.Equal(t, map[string]SamplingCounts{
+		"root": {Created: 2, Kept: 1},
+	}, tracer.Counts.TakeSampling(), "each span should be decided on its own, with every tag it was given")
+}
+
+func TestTracerSamplerPropagated(t *testing.T) {
+	keep, err := NewSampler(1, nil, SampleAtStart)
+	assert.NoError(t, err)
+	drop, err := NewSampler(0, nil, SampleAtStart)
+	assert.NoError(t, err)
+	upstream := Tracer{Sampler: drop}
+	downstream := Tracer{Sampler: keep, Counts: &SpanCounts{}}
+
+	// the decision is injected, and honored by a Tracer that would have
+	// decided otherwise
+	dropped := upstream.StartSpan("dropped")
+	carrier := opentracing.TextMapCarrier{}
+	assert.NoError(t, upstream.Inject(dropped.Context(), opentracing.TextMap, carrier))
+	assert.Equal(t, "0", carrier[sampledKey])
+	ctx, err := downstream.Extract(opentracing.TextMap, carrier)
+	assert.NoError(t, err)
+	downstream.StartSpan("dropped", opentracing.ChildOf(ctx)).Finish()
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.NoError(t, upstream.Inject(dropped.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)))
+	span, err := downstream.ExtractRequestChild("dropped", req, "request")
+	assert.NoError(t, err)
+	span.Finish()
+
+	// and so is an upstream decision to keep
+	kept := Tracer{Sampler: keep}.StartSpan("kept")
+	carrier = opentracing.TextMapCarrier{}
+	assert.NoError(t, upstream.Inject(kept.Context(), opentracing.TextMap, carrier))
+	assert.Equal(t, "1", carrier[sampledKey])
+	ctx, err = Tracer{Sampler: drop, Counts: downstream.Counts}.Extract(opentracing.TextMap, carrier)
+	assert.NoError(t, err)
+	Tracer{Sampler: drop, Counts: downstream.Counts}.StartSpan("kept", opentracing.ChildOf(ctx)).Finish()
+
+	assert.Equal(t, map[string]SamplingCounts{
+		"dropped": {Created: 2, Kept: 0},
+		"kept":    {Created: 1, Kept: 1},
+	}, downstream.Counts.TakeSampling())
+
+	// a context without a decision injects no more than it used to
+	carrier = opentracing.TextMapCarrier{}
+	assert.NoError(t, Tracer{}.Inject(Tracer{}.StartSpan("undecided").Context(), opentracing.TextMap, carrier))
+	assert.NotContains(t, carrier, sampledKey)
+
+	// X-Ray carries the decision as its Sampled flag
+	xray := Tracer{Sampler: keep, PropagationFormat: PropagationXRay}
+	carrier = opentracing.TextMapCarrier{}
+	assert.NoError(t, xray.Inject(dropped.Context(), opentracing.TextMap, carrier))
+	assert.Contains(t, carrier[XRayTraceHeader], ";Sampled=0")
+	ctx, err = xray.Extract(opentracing.TextMap, carrier)
+	assert.NoError(t, err)
+	child := xray.StartSpan("xray", opentracing.ChildOf(ctx)).(*Span)
+	assert.Equal(t, samplingDrop, child.sampling)
+}
+
+func TestSamplerRate(t *testing.T) {
+	_, err := NewSampler(1.5, nil, SampleAtStart)
+	assert.Error(t, err)
+	_, err = NewSampler(0.5, []SamplingRule{{Value: "high", Keep: true}}, SampleAtStart)
+	assert.Error(t, err)
+
+	sampler, err := NewSampler(0.5, nil, SampleAtStart)
+	assert.NoError(t, err)
+	kept := 0
+	for id := int64(1); id <= 10000; id++ {
+		decision := sampler.decide(id, nil)
+		assert.Equal(t, decision, sampler.decide(id, nil), "the decision should be deterministic by trace ID")
+		if decision == samplingKeep {
+			kept++
+		}
+	}
+	assert.InDelta(t, 5000, kept, 500, "even sequential trace IDs should be kept at about the rate")
+
+	all, err := NewSampler(1, nil, SampleAtStart)
+	assert.NoError(t, err)
+	assert.Equal(t, samplingKeep, all.decide(-1, nil))
+	none, err := NewSampler(0, nil, SampleAtStart)
+	assert.NoError(t, err)
+	assert.Equal(t, samplingDrop, none.decide(-1, nil))
+}
+
+// observeAt has an adaptive rate observe perSecond spans a second for
+// seconds, as measured by the clock at now.
+func observeAt(a *adaptiveRate, now *time.Time, perSecond, seconds int) {
+	for i := 0; i < perSecond*seconds; i++ {
+		*now = now.Add(time.Second / time.Duration(perSecond))
+		a.observe()
+	}
+}
+
+func TestAdaptiveRate(t *testing.T) {
+	now := time.Unix(0, 0)
+	a := newAdaptiveRate(1000, func() time.Time { return now })
+	assert.Equal(t, 1.0, a.load(), "everything is kept until the rate has been measured")
+	observeAt(a, &now, 100, 5)
+	assert.Equal(t, 1.0, a.load(), "everything is kept below the target")
+
+	// a surge to 10x the target
+	observeAt(a, &now, 10000, 1)
+	surged := a.load()
+	assert.True(t, surged < 1 && surged > 0.2, "a single busy window should only move the rate part of the way, not %f", surged)
+	last := surged
+	for i := 0; i < 20; i++ {
+		observeAt(a, &now, 10000, 1)
+		rate := a.load()
+		assert.True(t, rate <= last && rate >= 0.1, "the rate should ramp down towards the target without overshooting, not %f after %f", rate, last)
+		last = rate
+	}
+	assert.InDelta(t, 0.1, a.load(), 0.001, "the rate should settle where 1000 spans a second are kept")
+
+	// and back
+	for i := 0; i < 20; i++ {
+		observeAt(a, &now, 100, 1)
+		rate := a.load()
+		assert.True(t, rate >= last, "the rate should ramp back up, not %f after %f", rate, last)
+		last = rate
+	}
+	assert.Equal(t, 1.0, a.load())
+}
+
+func TestAdaptiveSampler(t *testing.T) {
+	for _, max := range []float64{0, -1, math.NaN(), math.Inf(1)} {
+		_, err := NewAdaptiveSampler(max, nil, SampleAtStart)
+		assert.Error(t, err, "%f spans a second", max)
+	}
+	_, err := NewAdaptiveSampler(100, []SamplingRule{{Value: "high", Keep: true}}, SampleAtStart)
+	assert.Error(t, err)
+
+	sampler, err := NewAdaptiveSampler(100, nil, SampleAtStart)
+	assert.NoError(t, err)
+	now := time.Unix(0, 0)
+	sampler.adaptive = newAdaptiveRate(100, func() time.Time { return now })
+	tracer := Tracer{Sampler: sampler, Counts: &SpanCounts{}}
+	bumpClock := func() { now = now.Add(time.Millisecond) }
+	for i := 0; i < 30000; i++ {
+		// every trace has a root and a child, which both count
+		root := tracer.StartSpan("root").(*Span)
+		tracer.StartSpan("child", opentracing.ChildOf(root.Context())).Finish()
+		root.Finish()
+		bumpClock()
+	}
+	// 2000 spans a second are created
+	assert.InDelta(t, 0.05, sampler.Rate(), 0.001)
+	kept := 0
+	for _, counts := range tracer.Counts.TakeSampling() {
+		kept += int(counts.Kept)
+	}
+	assert.True(t, kept < 60000/2, "most spans should have been dropped once the rate adapted, but %d were kept", kept)
+
+	// the decision is by trace ID, at any given rate
+	keptAtRate := 0
+	for id := int64(1); id <= 10000; id++ {
+		decision := sampler.decide(id, nil)
+		assert.Equal(t, decision, sampler.decide(id, nil), "the decision should be deterministic by trace ID")
+		if decision == samplingKeep {
+			keptAtRate++
+		}
+	}
+	assert.InDelta(t, 500, keptAtRate, 100)
+
+	assert.Equal(t, 0.5, (&Sampler{rate: 0.5}).Rate(), "a fixed sampler's rate is its own")
+}
+
+func TestTracerExtractValidates(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		carrier opentracing.TextMapCarrier
+		result  string
+		parent  int64
+	}{
+		{"valid", opentracing.TextMapCarrier{"traceid": "1", "spanid": "2", "parentid": "3"}, ExtractionSuccess, 3},
+		{"root", opentracing.TextMapCarrier{"traceid": "1", "spanid": "2", "parentid": "0"}, ExtractionSuccess, 0},
+		{"missing", opentracing.TextMapCarrier{"resource": "/"}, ExtractionMissing, 0},
+		{"parent without a trace", opentracing.TextMapCarrier{"traceid": "0", "spanid": "2", "parentid": "3"}, ExtractionInvalid, 0},
+		{"negative trace", opentracing.TextMapCarrier{"traceid": "-1", "spanid": "2", "parentid": "3"}, ExtractionInvalid, 0},
+		{"no span", opentracing.TextMapCarrier{"traceid": "1", "spanid": "0", "parentid": "3"}, ExtractionInvalid, 0},
+		{"negative span", opentracing.TextMapCarrier{"traceid": "1", "spanid": "-2", "parentid": "3"}, ExtractionInvalid, 0},
+		{"only a parent", opentracing.TextMapCarrier{"parentid": "3"}, ExtractionMalformed, 0},
+		{"negative parent", opentracing.TextMapCarrier{"traceid": "1", "spanid": "2", "parentid": "-1"}, ExtractionNormalized, 0},
+		{"its own parent", opentracing.TextMapCarrier{"traceid": "1", "spanid": "2", "parentid": "2"}, ExtractionNormalized, 0},
+	} {
+		tracer := Tracer{Counts: &SpanCounts{}}
+		c, err := tracer.Extract(opentracing.TextMap, tc.carrier)
+		assert.Equal(t, map[Extraction]int64{{Format: "text_map", Result: tc.result}: 1}, tracer.Counts.TakeExtractions(), tc.name)
+		switch tc.result {
+		case ExtractionSuccess, ExtractionNormalized:
+			if assert.NoError(t, err, tc.name) {
+				ctx := c.(*spanContext)
+				assert.Equal(t, int64(1), ctx.TraceId(), tc.name)
+				assert.Equal(t, int64(2), ctx.SpanId(), tc.name)
+				assert.Equal(t, tc.parent, ctx.ParentId(), tc.name)
+			}
+		case ExtractionMissing:
+			assert.Equal(t, opentracing.ErrSpanContextNotFound, err, tc.name)
+		case ExtractionInvalid:
+			assert.True(t, errors.Is(err, opentracing.ErrSpanContextCorrupted), "%s: %v", tc.name, err)
+			assert.Nil(t, c, "%s: no half-populated context should be returned", tc.name)
+		default:
+			assert.Error(t, err, tc.name)
+			assert.Nil(t, c, tc.name)
+		}
+	}
+
+	tracer := Tracer{Counts: &SpanCounts{}}
+	noTrace, err := proto.Marshal(&ssf.SSFSample{Name: "no trace"})
+	assert.NoError(t, err)
+	_, err = tracer.Extract(opentracing.Binary, bytes.NewReader(noTrace))
+	assert.True(t, errors.Is(err, opentracing.ErrSpanContextCorrupted), "a sample without a trace has no context")
+	zeroTrace, err := proto.Marshal(&ssf.SSFSample{Trace: &ssf.SSFTrace{Id: 2, ParentId: 3}})
+	assert.NoError(t, err)
+	_, err = tracer.Extract(opentracing.Binary, bytes.NewReader(zeroTrace))
+	assert.True(t, errors.Is(err, opentracing.ErrSpanContextCorrupted))
+
+	xray := Tracer{PropagationFormat: PropagationXRay, Counts: tracer.Counts}
+	_, err = xray.Extract(opentracing.TextMap, opentracing.TextMapCarrier{
+		XRayTraceHeader: "Root=1-5759e988-bd862e3fe1be46a994272793;Parent=0000000000000000",
+	})
+	assert.True(t, errors.Is(err, opentracing.ErrSpanContextCorrupted), "an X-Ray parent of 0 is no span")
+	assert.Equal(t, map[Extraction]int64{
+		{Format: "binary", Result: ExtractionInvalid}:   2,
+		{Format: "text_map", Result: ExtractionInvalid}: 1,
+	}, tracer.Counts.TakeExtractions())
+}
+
+func TestTracerCountsExtractions(t *testing.T) {
+	tracer := Tracer{Counts: &SpanCounts{}}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	_, err := tracer.ExtractRequestChild("/", req, "http.request")
+	assert.Error(t, err)
+	assert.NoError(t, tracer.InjectRequest(DummySpan().Trace, req))
+	_, err = tracer.ExtractRequestChild("/", req, "http.request")
+	assert.NoError(t, err)
+	req.Header.Set("Traceid", "not a number")
+	_, err = tracer.ExtractRequestChild("/", req, "http.request")
+	assert.Error(t, err)
+
+	_, err = tracer.Extract(opentracing.TextMap, opentracing.TextMapCarrier{})
+	assert.Error(t, err)
+	_, err = tracer.Extract(opentracing.Binary, bytes.NewReader(nil))
+	assert.Error(t, err)
+	_, err = tracer.Extract(opentracing.Binary, bytes.NewReader([]byte{0xff, 0xff}))
+	assert.Error(t, err)
+	_, err = tracer.Extract("carrier pigeon", nil)
+	assert.Equal(t, opentracing.ErrUnsupportedFormat, err)
+
+	assert.Equal(t, map[Extraction]int64{
+		{Format: "http_headers", Result: ExtractionMissing}:   1,
+		{Format: "http_headers", Result: ExtractionSuccess}:   1,
+		{Format: "http_headers", Result: ExtractionMalformed}: 1,
+		{Format: "text_map", Result: ExtractionMissing}:       1,
+		{Format: "binary", Result: ExtractionMissing}:         1,
+		{Format: "binary", Result: ExtractionMalformed}:       1,
+	}, tracer.Counts.TakeExtractions(), "unsupported formats aren't a propagation failure")
+	assert.Empty(t, tracer.Counts.TakeExtractions(), "taking the counts should reset them")
+}
+
+func TestStartDetachedSpan(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	tracer := Tracer{Clock: clock, Counts: &SpanCounts{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	parent, ctx := StartSpanFromContext(ctx, "request")
+	detached := tracer.StartDetachedSpan(parent, "background")
+	assert.Equal(t, parent.TraceId, detached.TraceId)
+	assert.Equal(t, parent.SpanId, detached.ParentId)
+	assert.Equal(t, "background", detached.Resource, "detached spans are their own operation")
+
+	// the request ends, and its context is cancelled
+	cancel()
+	<-ctx.Done()
+	clock.now = clock.now.Add(time.Second)
+	parent.Finish()
+
+	clock.now = clock.now.Add(time.Minute)
+	detached.Finish()
+	assert.Equal(t, time.Minute+time.Second, detached.Duration(), "the detached span should outlive its parent")
+	assert.Equal(t, map[string]SamplingCounts{
+		"background": {Created: 1, Kept: 1},
+	}, tracer.Counts.TakeSampling())
+
+	root := tracer.StartDetachedSpan(nil, "background")
+	assert.Equal(t, int64(0), root.ParentId, "with no parent, a detached span starts a new trace")
+	assert.Equal(t, root.SpanId, root.TraceId)
+}
+
+func TestTracerLocalSpans(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer serverConn.Close()
+	client, err := NewClient(serverConn.LocalAddr().String(), 16)
+	assert.NoError(t, err)
+	defer client.Close(context.Background())
+
+	recorder := NewRecorder(2)
+	tracer := Tracer{Client: client, DurationMetrics: DurationMetricHistogram, Recorder: recorder}
+	root := tracer.StartSpan("debug", NameTag("root"), LocalSpan(true)).(*Span)
+	child := tracer.StartSpan("debug", NameTag("child"), opentracing.ChildOf(root.Context())).(*Span)
+	shipped := tracer.StartSpan("debug", NameTag("shipped"), opentracing.ChildOf(child.Context()), LocalSpan(false)).(*Span)
+	assert.Equal(t, root.TraceId, shipped.TraceId, "local spans propagate their context like any other")
+	assert.Equal(t, map[string]string{"name": "root"}, root.Tags(), "the option isn't a tag")
+	shipped.Finish()
+	child.Finish()
+	root.Finish()
+
+	serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	var names []string
+	for {
+		n, err := serverConn.Read(buf)
+		if err != nil {
+			break
+		}
+		sample := &ssf.SSFSample{}
+		assert.NoError(t, proto.Unmarshal(buf[:n], sample))
+		names = append(names, sample.Name)
+	}
+	assert.Equal(t, []string{"shipped", "shipped.duration"}, names, "only the span that isn't local should be sent, with its duration")
+
+	spans := recorder.Spans()
+	if assert.Len(t, spans, 2, "the recorder keeps the latest spans") {
+		assert.Equal(t, "child", spans[0].Name)
+		assert.Equal(t, "root", spans[1].Name)
+	}
+}
+
+func TestTracerSkipUnsampled(t *testing.T) {
+	serverConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	assert.NoError(t, err)
+	defer serverConn.Close()
+	client, err := NewClient(serverConn.LocalAddr().String(), 16)
+	assert.NoError(t, err)
+	defer client.Close(context.Background())
+
+	sampler, err := NewSampler(0, []SamplingRule{{Tag: "priority", Value: "high", Keep: true}}, SampleAtStart)
+	assert.NoError(t, err)
+	recorder := NewRecorder(4)
+	tracer := Tracer{
+		Client:          client,
+		Counts:          &SpanCounts{},
+		DurationMetrics: DurationMetricHistogram,
+		InheritTags:     true,
+		Recorder:        recorder,
+		Sampler:         sampler,
+		SkipUnsampled:   true,
+	}
+
+	root := tracer.StartSpan("unsampled", NameTag("root"), customSpanTags("user", "1")).(*Span)
+	assert.True(t, root.unsampled)
+	assert.NotZero(t, root.TraceId)
+	root.SetTag("more", "tags")
+	assert.Empty(t, root.Tags(), "an unsampled span doesn't keep its tags")
+	child := tracer.StartSpan("unsampled", opentracing.ChildOf(root.Context())).(*Span)
+	assert.True(t, child.unsampled, "children share the decision")
+	assert.Equal(t, root.TraceId, child.TraceId)
+	assert.Equal(t, root.SpanId, child.ParentId)
+
+	// it is propagated like any other span, along with the decision, so
+	// that a downstream Tracer drops the rest of the trace too
+	carrier := opentracing.TextMapCarrier{}
+	assert.NoError(t, tracer.Inject(child.Context(), opentracing.TextMap, carrier))
+	assert.Equal(t, "0", carrier[sampledKey])
+	keep, err := NewSampler(1, nil, SampleAtStart)
+	assert.NoError(t, err)
+	downstream := Tracer{Sampler: keep, SkipUnsampled: true}
+	ctx, err := downstream.Extract(opentracing.TextMap, carrier)
+	assert.NoError(t, err)
+	remote := downstream.StartSpan("remote", opentracing.ChildOf(ctx)).(*Span)
+	assert.True(t, remote.unsampled)
+	assert.Equal(t, root.TraceId, remote.TraceId)
+	assert.Equal(t, child.SpanId, remote.ParentId)
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	assert.NoError(t, tracer.Inject(root.Context(), opentracing.HTTPHeaders, opentracing.HTTPHeadersCarrier(req.Header)))
+	served, err := downstream.ExtractRequestChild("served", req, "request")
+	assert.NoError(t, err)
+	assert.True(t, served.unsampled)
+
+	// rules still see the tags that a span is started with
+	kept := tracer.StartSpan("kept", NameTag("kept"), customSpanTags("priority", "high")).(*Span)
+	assert.False(t, kept.unsampled)
+	local := tracer.StartSpan("local", NameTag("local"), LocalSpan(true)).(*Span)
+	assert.False(t, local.unsampled, "local spans are recorded whether or not they are sampled")
+
+	child.Finish()
+	root.Finish()
+	kept.Finish()
+	local.Finish()
+
+	serverConn.SetReadDeadline(time.Now().Add(time.Second))
+	buf := make([]byte, 4096)
+	var names []string
+	for {
+		n, err := serverConn.Read(buf)
+		if err != nil {
+			break
+		}
+		sample := &ssf.SSFSample{}
+		assert.NoError(t, proto.Unmarshal(buf[:n], sample))
+		names = append(names, sample.Name)
+	}
+	assert.Equal(t, []string{"kept", "kept.duration"}, names, "nothing is sent for unsampled spans, not even their durations")
+	recorded := recorder.Spans()
+	if assert.Len(t, recorded, 2) {
+		assert.Equal(t, "kept", recorded[0].Name)
+		assert.Equal(t, "local", recorded[1].Name)
+	}
+
+	assert.Equal(t, int64(4), tracer.Counts.Started())
+	assert.Equal(t, map[string]SamplingCounts{
+		"unsampled": {Created: 2, Kept: 0},
+		"kept":      {Created: 1, Kept: 1},
+		"local":     {Created: 1, Kept: 0},
+	}, tracer.Counts.TakeSampling())
+}
+
+func BenchmarkUnsampledSpan(b *testing.B) {
+	drop, err := NewSampler(0, nil, SampleAtStart)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, skip := range []bool{false, true} {
+		tracer := Tracer{Sampler: drop, SkipUnsampled: skip, InheritTags: true}
+		b.Run(fmt.Sprintf("SkipUnsampled=%t", skip), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				root := tracer.StartSpan("request", NameTag("root"), customSpanTags("user", "1"))
+				root.SetTag("status", 200)
+				child := tracer.StartSpan("request", NameTag("child"), opentracing.ChildOf(root.Context()))
+				child.Finish()
+				root.Finish()
+			}
+		})
+	}
+}
+
+func TestSpanAnnotations(t *testing.T) {
+	clock := &fakeClock{now: time.Unix(1500000000, 0)}
+	recorder := NewRecorder(1)
+	tracer := Tracer{Clock: clock, Counts: &SpanCounts{}, MaxAnnotations: 3, Recorder: recorder}
+
+	span := tracer.StartSpan("annotated").(*Span)
+	clock.now = clock.now.Add(2 * time.Millisecond)
+	span.Annotate("query.start")
+	clock.now = clock.now.Add(5 * time.Millisecond)
+	span.Annotate("query.end")
+	// the clock isn't necessarily monotonic
+	clock.now = clock.now.Add(-6 * time.Millisecond)
+	span.Annotate("cache.miss")
+	span.Annotate("dropped")
+	span.Finish()
+	assert.EqualValues(t, 1, tracer.Counts.AnnotationsDropped())
+
+	spans := recorder.Spans()
+	if !assert.Len(t, spans, 1) {
+		return
+	}
+	start := time.Unix(1500000000, 0)
+	assert.Equal(t, []*ssf.SSFAnnotation{
+		{Name: "cache.miss", Timestamp: start.Add(1 * time.Millisecond).UnixNano()},
+		{Name: "query.start", Timestamp: start.Add(2 * time.Millisecond).UnixNano()},
+		{Name: "query.end", Timestamp: start.Add(7 * time.Millisecond).UnixNano()},
+	}, spans[0].Annotations, "annotations are ordered by timestamp")
+
+	// they survive being sent
+	packet, err := proto.Marshal(spans[0])
+	assert.NoError(t, err)
+	var sample ssf.SSFSample
+	assert.NoError(t, proto.Unmarshal(packet, &sample))
+	assert.Equal(t, spans[0].Annotations, sample.Annotations)
+}
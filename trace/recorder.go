@@ -0,0 +1,46 @@
+package trace
+
+import (
+	"sync"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// Recorder keeps the most recent spans that a Tracer finished, in a ring
+// buffer, so that they can be inspected in-process. It holds local spans
+// (see LocalSpan), which are never sent anywhere else, as well as those
+// that are sent.
+type Recorder struct {
+	mutex sync.Mutex
+	spans []*ssf.SSFSample
+	// where the next span goes, once spans is full
+	next int
+}
+
+// NewRecorder returns a Recorder that keeps the latest capacity spans.
+func NewRecorder(capacity int) *Recorder {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Recorder{spans: make([]*ssf.SSFSample, 0, capacity)}
+}
+
+func (r *Recorder) record(span *ssf.SSFSample) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.spans) < cap(r.spans) {
+		r.spans = append(r.spans, span)
+		return
+	}
+	r.spans[r.next] = span
+	r.next = (r.next + 1) % len(r.spans)
+}
+
+// Spans returns the spans the Recorder holds, oldest first.
+func (r *Recorder) Spans() []*ssf.SSFSample {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	spans := make([]*ssf.SSFSample, 0, len(r.spans))
+	spans = append(spans, r.spans[r.next:]...)
+	return append(spans, r.spans[:r.next]...)
+}
@@ -0,0 +1,60 @@
+package trace
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+)
+
+// A ResourceRule rewrites span resources that match Pattern, a regular
+// expression, into Replacement, which may refer to submatches as in
+// regexp.Regexp.ReplaceAllString. For example, the pattern `^/users/\d+`
+// with the replacement "/users/:id" collapses every user's path into one
+// resource.
+type ResourceRule struct {
+	Pattern     string
+	Replacement string
+}
+
+// ResourceRules is a compiled, ordered list of ResourceRules.
+type ResourceRules struct {
+	rules []compiledResourceRule
+}
+
+type compiledResourceRule struct {
+	pattern     *regexp.Regexp
+	replacement string
+}
+
+// CompileResourceRules compiles rules, in order, for use as a Tracer's
+// ResourceRules.
+func CompileResourceRules(rules []ResourceRule) (*ResourceRules, error) {
+	compiled := &ResourceRules{}
+	for i, rule := range rules {
+		if rule.Pattern == "" {
+			return nil, errors.New("resource rule has an empty pattern")
+		}
+		pattern, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("resource rule %d: %s", i, err)
+		}
+		compiled.rules = append(compiled.rules, compiledResourceRule{pattern, rule.Replacement})
+	}
+	return compiled, nil
+}
+
+// Apply rewrites resource using the first rule whose pattern matches it. A
+// rewrite that would leave the resource empty is discarded, since a span
+// must have a resource.
+func (r *ResourceRules) Apply(resource string) string {
+	for _, rule := range r.rules {
+		if !rule.pattern.MatchString(resource) {
+			continue
+		}
+		if rewritten := rule.pattern.ReplaceAllString(resource, rule.replacement); rewritten != "" {
+			return rewritten
+		}
+		return resource
+	}
+	return resource
+}
@@ -0,0 +1,312 @@
+package trace
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// SamplingPoint is when a Sampler decides whether to keep a span.
+type SamplingPoint int
+
+const (
+	// SampleAtStart decides when a span is started, from the tags it is
+	// started with. Children started from a span's Context share its
+	// decision, which is injected along with the rest of the context, so a
+	// trace is kept or dropped whole, even across processes.
+	SampleAtStart SamplingPoint = iota
+	// SampleAtFinish decides when each span is finished, so that tags set
+	// while it ran (like an error) are taken into account. Each span is
+	// decided on its own, so a rule can keep one span of a trace whose
+	// other spans are dropped.
+	SampleAtFinish
+)
+
+// A SamplingRule keeps or drops every span that has the tag Tag, with the
+// value Value, or with any value if Value is empty.
+type SamplingRule struct {
+	Tag   string
+	Value string
+	Keep  bool
+}
+
+// Sampler decides which of a Tracer's spans are sent. A span matching one of
+// its rules is kept or dropped by the first rule that matches, and any other
+// span is kept at Rate. The rate is applied by trace ID, so that the spans of
+// a trace that aren't decided by a rule are all kept or all dropped, even
+// across processes, as long as their Tracers have the same Rate.
+//
+// Dropped spans are still counted in the Tracer's Counts, as created but not
+// kept, and still report DurationMetrics, so metrics derived from spans
+// don't depend on the sampling rate.
+type Sampler struct {
+	rate  float64
+	rules []SamplingRule
+	point SamplingPoint
+	// if set, it decides the rate instead
+	adaptive *adaptiveRate
+}
+
+type samplingDecision int
+
+const (
+	samplingUndecided samplingDecision = iota
+	samplingKeep
+	samplingDrop
+)
+
+// NewSampler creates a Sampler that keeps a fraction rate, between 0 and 1,
+// of the spans that none of the rules match, deciding at point.
+func NewSampler(rate float64, rules []SamplingRule, point SamplingPoint) (*Sampler, error) {
+	if rate < 0 || rate > 1 || math.IsNaN(rate) {
+		return nil, errors.New("sampling rate must be between 0 and 1")
+	}
+	for _, rule := range rules {
+		if rule.Tag == "" {
+			return nil, errors.New("sampling rule has an empty tag")
+		}
+	}
+	return &Sampler{rate: rate, rules: rules, point: point}, nil
+}
+
+// NewAdaptiveSampler creates a Sampler whose rate adapts to how many spans
+// its Tracer creates, so that it keeps about maxPerSecond of them a second:
+// it keeps every span while fewer than that are created, and a fraction of
+// them, chosen by trace ID as with a fixed rate, once there are more.
+func NewAdaptiveSampler(maxPerSecond float64, rules []SamplingRule, point SamplingPoint) (*Sampler, error) {
+	if maxPerSecond <= 0 || math.IsNaN(maxPerSecond) || math.IsInf(maxPerSecond, 0) {
+		return nil, errors.New("the maximum spans per second must be positive")
+	}
+	s, err := NewSampler(1, rules, point)
+	if err != nil {
+		return nil, err
+	}
+	s.adaptive = newAdaptiveRate(maxPerSecond, time.Now)
+	return s, nil
+}
+
+// Rate returns the fraction of the spans that no rule matches that the
+// Sampler currently keeps, which for an adaptive Sampler changes with the
+// rate spans are created at.
+func (s *Sampler) Rate() float64 {
+	if s.adaptive != nil {
+		return s.adaptive.load()
+	}
+	return s.rate
+}
+
+// observe counts a span for an adaptive Sampler's estimate of how many a
+// second are created. It is called once for every span, whether it is
+// decided by a rule, by rate, or inherits its parent's decision, since they
+// are all sent if they're kept.
+func (s *Sampler) observe() {
+	if s.adaptive != nil {
+		s.adaptive.observe()
+	}
+}
+
+// knuthFactor scatters trace IDs, which need not be uniformly distributed,
+// before they are compared to the rate.
+const knuthFactor uint64 = 1111111111111111111
+
+// decide returns whether the span with the given trace ID and tags should
+// be kept.
+func (s *Sampler) decide(traceID int64, tags []*ssf.SSFTag) samplingDecision {
+	for _, rule := range s.rules {
+		if rule.matches(tags) {
+			if rule.Keep {
+				return samplingKeep
+			}
+			return samplingDrop
+		}
+	}
+	rate := s.Rate()
+	if rate >= 1 {
+		return samplingKeep
+	}
+	if float64(uint64(traceID)*knuthFactor) < rate*math.MaxUint64 {
+		return samplingKeep
+	}
+	return samplingDrop
+}
+
+func (rule SamplingRule) matches(tags []*ssf.SSFTag) bool {
+	for _, tag := range tags {
+		if tag.Name == rule.Tag && (rule.Value == "" || tag.Value == rule.Value) {
+			return true
+		}
+	}
+	return false
+}
+
+// sampleAtStart decides whether a span that was just started is kept, if
+// the Tracer samples at start. inherited is its parent's decision, if it had
+// one, whether the parent was started in this process or its decision was
+// extracted along with its context.
+func (t Tracer) sampleAtStart(s *Span, inherited samplingDecision) {
+	if t.Sampler == nil || t.Sampler.point != SampleAtStart {
+		return
+	}
+	t.Sampler.observe()
+	s.sampling = inherited
+	if s.sampling == samplingUndecided {
+		s.sampling = t.Sampler.decide(s.TraceId, s.Trace.Tags)
+	}
+}
+
+// sampleAtFinish decides whether a span that was just finished is kept, if
+// the Tracer samples at finish.
+func (t Tracer) sampleAtFinish(s *Span) {
+	if t.Sampler == nil || t.Sampler.point != SampleAtFinish {
+		return
+	}
+	t.Sampler.observe()
+	s.sampling = t.Sampler.decide(s.TraceId, s.Trace.Tags)
+}
+
+// skipUnsampled returns the span for trace, which was just started, if the
+// Tracer SkipUnsampled and it is dropped at start, and nil if it is started
+// as usual. The decision is the one sampleAtStart would make for it, from
+// the decision it inherited, and its inherited tags and those it was
+// started with, since its tags are never set.
+func (t Tracer) skipUnsampled(trace *Trace, inherited samplingDecision, local bool, inheritedTags []*ssf.SSFTag, tags map[string]interface{}) *Span {
+	if !t.SkipUnsampled || t.Sampler == nil || t.Sampler.point != SampleAtStart {
+		return nil
+	}
+	if l, ok := tags[localSpanKey].(bool); ok {
+		local = l
+	}
+	if local {
+		return nil
+	}
+	decision := inherited
+	if decision == samplingUndecided {
+		decision = t.Sampler.decideAtStart(trace.TraceId, inheritedTags, tags)
+	}
+	if decision != samplingDrop {
+		return nil
+	}
+	// spans that aren't skipped are observed by sampleAtStart instead
+	t.Sampler.observe()
+	if t.Counts != nil {
+		atomic.AddInt64(&t.Counts.started, 1)
+	}
+	return &Span{Trace: trace, tracer: t, sampling: samplingDrop, unsampled: true}
+}
+
+// decideAtStart is decide, for a span whose tags haven't been converted to
+// SSF tags yet.
+func (s *Sampler) decideAtStart(traceID int64, inheritedTags []*ssf.SSFTag, tags map[string]interface{}) samplingDecision {
+	for _, rule := range s.rules {
+		matched := rule.matches(inheritedTags)
+		if v, ok := tags[rule.Tag]; ok && rule.Tag != localSpanKey && (rule.Value == "" || tagValue(v) == rule.Value) {
+			matched = true
+		}
+		if matched {
+			if rule.Keep {
+				return samplingKeep
+			}
+			return samplingDrop
+		}
+	}
+	return s.decide(traceID, nil)
+}
+
+// finishUnsampled counts a span that SkipUnsampled skipped as finished.
+func (s *Span) finishUnsampled() {
+	if s.tracer.Counts == nil {
+		return
+	}
+	resource := s.Resource
+	if s.tracer.ResourceRules != nil {
+		resource = s.tracer.ResourceRules.Apply(resource)
+	}
+	s.tracer.Counts.countSampling(resource, false)
+	atomic.AddInt64(&s.tracer.Counts.finished, 1)
+}
+
+const (
+	// adaptiveWindow is how often an adaptive Sampler measures the rate
+	// spans are created at, and adjusts its own.
+	adaptiveWindow = time.Second
+	// adaptiveSmoothing is the weight of the latest window in an adaptive
+	// Sampler's moving average of the creation rate. At 0.3, a sudden surge
+	// is mostly accounted for within five seconds, while a single unusually
+	// busy or quiet second doesn't swing the rate.
+	adaptiveSmoothing = 0.3
+)
+
+// adaptiveRate is the rate of an adaptive Sampler. It keeps an exponentially
+// weighted moving average of how many spans a second are created, over
+// windows of adaptiveWindow, and keeps maxPerSecond of that many. Spans are
+// counted as they're created, so the average doesn't depend on the rate
+// itself, and it can't feed back on itself and oscillate; averaging only
+// keeps one noisy window from moving it too far.
+type adaptiveRate struct {
+	maxPerSecond float64
+	now          func() time.Time
+
+	// spans counted in the current window
+	spans int64
+	// the rate, as the bits of a float64
+	rate uint64
+	// when the current window ends, in Unix nanoseconds
+	windowEnd int64
+
+	mtx         sync.Mutex
+	windowStart time.Time
+	// the average spans created a second, once a window has been measured
+	perSecond float64
+	measured  bool
+}
+
+// newAdaptiveRate returns a rate that keeps every span until the first
+// window has been measured.
+func newAdaptiveRate(maxPerSecond float64, now func() time.Time) *adaptiveRate {
+	start := now()
+	return &adaptiveRate{
+		maxPerSecond: maxPerSecond,
+		now:          now,
+		rate:         math.Float64bits(1),
+		windowEnd:    start.Add(adaptiveWindow).UnixNano(),
+		windowStart:  start,
+	}
+}
+
+func (a *adaptiveRate) load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&a.rate))
+}
+
+// observe counts a span, and adjusts the rate if the window it was counted
+// in is over.
+func (a *adaptiveRate) observe() {
+	atomic.AddInt64(&a.spans, 1)
+	now := a.now()
+	if now.UnixNano() < atomic.LoadInt64(&a.windowEnd) {
+		return
+	}
+	a.mtx.Lock()
+	defer a.mtx.Unlock()
+	if now.UnixNano() < atomic.LoadInt64(&a.windowEnd) {
+		// another span just ended it
+		return
+	}
+	// a span counted between these two lines is counted in the next window
+	// rather than this one, which doesn't matter to an average
+	perSecond := float64(atomic.SwapInt64(&a.spans, 0)) / now.Sub(a.windowStart).Seconds()
+	if a.measured {
+		perSecond = adaptiveSmoothing*perSecond + (1-adaptiveSmoothing)*a.perSecond
+	}
+	a.perSecond, a.measured = perSecond, true
+	rate := 1.0
+	if perSecond > a.maxPerSecond {
+		rate = a.maxPerSecond / perSecond
+	}
+	atomic.StoreUint64(&a.rate, math.Float64bits(rate))
+	a.windowStart = now
+	atomic.StoreInt64(&a.windowEnd, now.Add(adaptiveWindow).UnixNano())
+}
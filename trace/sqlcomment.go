@@ -0,0 +1,30 @@
+package trace
+
+import "fmt"
+
+// SQLComment renders the span's context as a SQL comment in the sqlcommenter
+// format, eg
+//
+//	/*traceparent='00-00000000000000000000000000000457-00000000000008ae-01'*/
+//
+// which can be appended to a query so that the database's logs (and APM tools
+// that parse them) can be correlated with the trace. The traceparent value is
+// a W3C Trace Context header: since our IDs are positive int64s, the trace ID
+// is zero-padded on the left to 128 bits. It is flagged as sampled unless the
+// Tracer's Sampler has decided to drop the span, so a span that is yet to be
+// decided (or whose Tracer has no Sampler) is flagged as sampled.
+//
+// It returns the empty string if span is nil, so that untraced queries are
+// left alone.
+func SQLComment(span *Span) string {
+	if span == nil || span.Trace == nil {
+		return ""
+	}
+	// sqlcommenter values are URL-encoded and quoted, but a traceparent is
+	// only hex digits and dashes, so it needs no escaping
+	flags := "01"
+	if span.sampling == samplingDrop {
+		flags = "00"
+	}
+	return fmt.Sprintf("/*traceparent='00-%032x-%016x-%s'*/", uint64(span.TraceId), uint64(span.SpanId), flags)
+}
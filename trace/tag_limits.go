@@ -0,0 +1,51 @@
+package trace
+
+import (
+	"sync/atomic"
+	"unicode/utf8"
+
+	"github.com/stripe/veneur/ssf"
+)
+
+// truncationMarker ends a tag value that was cut short for being longer than
+// a Tracer's MaxTagValueLength, so that it can't be mistaken for the whole
+// value.
+const truncationMarker = "..."
+
+// truncateTagValue cuts value down to at most max bytes, marker included,
+// without splitting a multibyte UTF-8 character. It returns false if value
+// was short enough already.
+func truncateTagValue(value string, max int) (string, bool) {
+	if len(value) <= max {
+		return value, false
+	}
+	marker := truncationMarker
+	if max < len(marker) {
+		marker = ""
+	}
+	end := max - len(marker)
+	// back up to the start of the character that would be split
+	for end > 0 && !utf8.RuneStart(value[end]) {
+		end--
+	}
+	return value[:end] + marker, true
+}
+
+// limitTags truncates the values of tags that are longer than the Tracer's
+// MaxTagValueLength, counting each one in Counts. Truncated tags are
+// replaced rather than modified, since they may be shared with other spans.
+func (t Tracer) limitTags(tags []*ssf.SSFTag) {
+	if t.MaxTagValueLength <= 0 {
+		return
+	}
+	for i, tag := range tags {
+		value, truncated := truncateTagValue(tag.Value, t.MaxTagValueLength)
+		if !truncated {
+			continue
+		}
+		tags[i] = &ssf.SSFTag{Name: tag.Name, Value: value}
+		if t.Counts != nil {
+			atomic.AddInt64(&t.Counts.tagsTruncated, 1)
+		}
+	}
+}
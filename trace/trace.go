@@ -8,6 +8,7 @@ package trace
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"math/rand"
 	"net"
@@ -73,14 +74,28 @@ type Trace struct {
 
 	Tags []*ssf.SSFTag
 
+	// Annotations mark when things happened during the span, and are
+	// sent ordered by their timestamps
+	Annotations []*ssf.SSFAnnotation
+
 	// Unlike the Resource, this should not contain spaces
 	// It should be of the format foo.bar.baz
 	Name string
+
+	// how many ancestors the span has, including any in upstream services
+	// that propagated their depth to us; 0 for a root span
+	depth int
+
+	// the X-Ray trace root, if the trace was started upstream by an X-Ray
+	// participant (see parseXRayHeader)
+	xrayRoot string
 }
 
-// Set the end timestamp and finalize Span state
+// Set the end timestamp, unless it was already set, and finalize Span state
 func (t *Trace) finish() {
-	t.End = time.Now()
+	if t.End.IsZero() {
+		t.End = time.Now()
+	}
 }
 
 // Duration is a convenience function for
@@ -100,6 +115,7 @@ func (t *Trace) Duration() time.Duration {
 func (t *Trace) SSFSample() *ssf.SSFSample {
 	duration := t.Duration().Nanoseconds()
 	name := t.Name
+	sortAnnotations(t.Annotations)
 
 	return &ssf.SSFSample{
 		Metric:    ssf.SSFSample_TRACE,
@@ -113,9 +129,10 @@ func (t *Trace) SSFSample() *ssf.SSFSample {
 			Duration: duration,
 			Resource: t.Resource,
 		},
-		SampleRate: *proto.Float32(.10),
-		Tags:       t.Tags,
-		Service:    Service,
+		SampleRate:  *proto.Float32(.10),
+		Tags:        t.Tags,
+		Service:     Service,
+		Annotations: t.Annotations,
 	}
 }
 
@@ -134,16 +151,27 @@ func (t *Trace) ProtoMarshalTo(w io.Writer) error {
 // which will pass it on to the tracing agent running on the
 // global veneur instance.
 func (t *Trace) Record(name string, tags []*ssf.SSFTag) error {
+	err := sendSample(t.finishSample(name, tags))
+	if err != nil {
+		logrus.WithError(err).Error("Error submitting sample")
+	}
+	return err
+}
+
+// finishSample ends the trace and converts it to an SSFSample with the
+// given name (or the trace's own, if name is empty) and additional tags.
+func (t *Trace) finishSample(name string, tags []*ssf.SSFTag) *ssf.SSFSample {
 	t.finish()
 	duration := t.Duration().Nanoseconds()
 
 	t.Tags = append(t.Tags, tags...)
+	sortAnnotations(t.Annotations)
 
 	if name == "" {
 		name = t.Name
 	}
 
-	sample := &ssf.SSFSample{
+	return &ssf.SSFSample{
 		Metric:    ssf.SSFSample_TRACE,
 		Timestamp: t.Start.UnixNano(),
 		Status:    t.Status,
@@ -155,16 +183,11 @@ func (t *Trace) Record(name string, tags []*ssf.SSFTag) error {
 			Duration: duration,
 			Resource: t.Resource,
 		},
-		SampleRate: *proto.Float32(.10),
-		Tags:       t.Tags,
-		Service:    Service,
+		SampleRate:  *proto.Float32(.10),
+		Tags:        t.Tags,
+		Service:     Service,
+		Annotations: t.Annotations,
 	}
-
-	err := sendSample(sample)
-	if err != nil {
-		logrus.WithError(err).Error("Error submitting sample")
-	}
-	return err
 }
 
 func (t *Trace) Error(err error) {
@@ -225,12 +248,41 @@ func StartSpanFromContext(ctx context.Context, name string, opts ...opentracing.
 	return s, c
 }
 
+// Do runs fn in a child span of the span in ctx, or at the root of a new
+// trace if ctx has none, passing it the child's context, and returns fn's
+// error. Unlike other children, the span has resource as its own resource,
+// since fn is usually an operation of its own. The span is finished when fn
+// returns, with the error recorded on it if there was one. If fn panics,
+// the span is finished with the panic recorded as its error, and the panic
+// carries on.
+func Do(ctx context.Context, resource string, fn func(context.Context) error) (err error) {
+	span, ctx := StartSpanFromContext(ctx, resource)
+	if span == nil {
+		return fn(ctx)
+	}
+	span.Resource = resource
+	defer func() {
+		if r := recover(); r != nil {
+			span.Error(fmt.Errorf("panic: %v", r))
+			span.Finish()
+			panic(r)
+		}
+		if err != nil {
+			span.Error(err)
+		}
+		span.Finish()
+	}()
+	return fn(ctx)
+}
+
 // SetParent updates the ParentId, TraceId, and Resource of a trace
 // based on the parent's values (SpanId, TraceId, Resource).
 func (t *Trace) SetParent(parent *Trace) {
 	t.ParentId = parent.SpanId
 	t.TraceId = parent.TraceId
 	t.Resource = parent.Resource
+	t.depth = parent.depth + 1
+	t.xrayRoot = parent.xrayRoot
 }
 
 // context returns a spanContext representing the trace
@@ -244,6 +296,8 @@ func (t *Trace) context() *spanContext {
 	c.baggageItems["parentid"] = strconv.FormatInt(t.ParentId, 10)
 	c.baggageItems["spanid"] = strconv.FormatInt(t.SpanId, 10)
 	c.baggageItems["resource"] = t.Resource
+	c.setDepth(t.depth)
+	c.xrayRoot = t.xrayRoot
 	return c
 }
 
@@ -257,6 +311,8 @@ func (t *Trace) contextAsParent() *spanContext {
 	c.baggageItems["traceid"] = strconv.FormatInt(t.TraceId, 10)
 	c.baggageItems["parentid"] = strconv.FormatInt(t.SpanId, 10)
 	c.baggageItems["resource"] = t.Resource
+	c.setDepth(t.depth)
+	c.xrayRoot = t.xrayRoot
 	return c
 }
 
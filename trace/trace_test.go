@@ -7,6 +7,7 @@ import (
 	"time"
 
 	"github.com/golang/protobuf/proto"
+	opentracing "github.com/opentracing/opentracing-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stripe/veneur/ssf"
 )
@@ -182,9 +183,9 @@ func TestNameTag(t *testing.T) {
 	const name = "my.name.tag"
 	tracer := Tracer{}
 	span := tracer.StartSpan("resource", NameTag(name)).(*Span)
-	assert.Equal(t, 1, len(span.Tags))
-	assert.Equal(t, "name", span.Tags[0].Name)
-	assert.Equal(t, name, span.Tags[0].Value)
+	assert.Equal(t, 1, len(span.Trace.Tags))
+	assert.Equal(t, "name", span.Trace.Tags[0].Name)
+	assert.Equal(t, name, span.Trace.Tags[0].Value)
 
 }
 
@@ -219,3 +220,56 @@ func TestError(t *testing.T) {
 	}
 
 }
+
+func TestDo(t *testing.T) {
+	recorder := NewRecorder(10)
+	opentracing.SetGlobalTracer(Tracer{Recorder: recorder})
+	defer opentracing.SetGlobalTracer(GlobalTracer)
+
+	parent, ctx := StartSpanFromContext(context.Background(), "request")
+	var childCtx context.Context
+	assert.NoError(t, Do(ctx, "lookup", func(ctx context.Context) error {
+		childCtx = ctx
+		return nil
+	}))
+	failure := localError{"not found"}
+	assert.Equal(t, failure, Do(ctx, "fetch", func(ctx context.Context) error {
+		return failure
+	}), "fn's error should be returned")
+	parent.Finish()
+
+	spans := recorder.Spans()
+	if assert.Len(t, spans, 3) {
+		lookup, fetch := spans[0], spans[1]
+		assert.Equal(t, "lookup", lookup.Trace.Resource)
+		assert.Equal(t, parent.TraceId, lookup.Trace.TraceId)
+		assert.Equal(t, parent.SpanId, lookup.Trace.ParentId)
+		assert.Equal(t, ssf.SSFSample_OK, lookup.Status)
+		assert.Equal(t, lookup.Trace.Id, opentracing.SpanFromContext(childCtx).(*Span).SpanId, "fn should get the child's context")
+
+		assert.Equal(t, "fetch", fetch.Trace.Resource)
+		assert.Equal(t, ssf.SSFSample_CRITICAL, fetch.Status)
+		assert.Contains(t, fetch.Tags, &ssf.SSFTag{Name: errorMessageTag, Value: "not found"})
+	}
+}
+
+func TestDoPanic(t *testing.T) {
+	recorder := NewRecorder(10)
+	opentracing.SetGlobalTracer(Tracer{Recorder: recorder})
+	defer opentracing.SetGlobalTracer(GlobalTracer)
+
+	func() {
+		defer func() {
+			assert.Equal(t, "oops", recover(), "the panic should carry on")
+		}()
+		Do(context.Background(), "risky", func(ctx context.Context) error {
+			panic("oops")
+		})
+	}()
+	spans := recorder.Spans()
+	if assert.Len(t, spans, 1, "the span should be finished") {
+		assert.Equal(t, "risky", spans[0].Trace.Resource)
+		assert.Equal(t, ssf.SSFSample_CRITICAL, spans[0].Status)
+		assert.Contains(t, spans[0].Tags, &ssf.SSFTag{Name: errorMessageTag, Value: "panic: oops"})
+	}
+}
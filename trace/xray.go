@@ -0,0 +1,127 @@
+package trace
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// XRayTraceHeader is the header that AWS X-Ray (and services that integrate
+// with it, like API Gateway) use to propagate traces.
+const XRayTraceHeader = "X-Amzn-Trace-Id"
+
+// PropagationFormat selects how a Tracer encodes span contexts into
+// TextMap and HTTPHeaders carriers.
+type PropagationFormat int
+
+const (
+	// PropagationVeneur uses veneur's own fields (see TextMapKeys).
+	PropagationVeneur PropagationFormat = iota
+
+	// PropagationXRay uses the AWS X-Ray trace header. On Extract, the
+	// veneur fields are still accepted if there is no X-Ray header.
+	PropagationXRay
+)
+
+// parseXRayHeader parses the value of an X-Amzn-Trace-Id header, eg
+//
+//	Root=1-5759e988-bd862e3fe1be46a994272793;Parent=53995c3f42cd8ad8;Sampled=1
+//
+// into a spanContext. X-Ray trace IDs are 96 bits and span IDs are 64 bits,
+// while ours are positive int64s, so both are mapped into our ID space by
+// keeping their lowest 63 bits. This is deterministic, so every service that
+// extracts the same header agrees on the IDs, and it round-trips IDs that
+// were generated by veneur (see formatXRayHeader). The Root itself is kept
+// in the context, so that its epoch and high bits are injected back out
+// unchanged.
+//
+// A header without a Parent is the root of a trace that the upstream started
+// without a segment of its own, eg one that only sampled it. Its context has
+// no span id, and a child started from it is a root span in that trace.
+func parseXRayHeader(header string) (*spanContext, error) {
+	var root, parent, sampled string
+	for _, field := range strings.Split(header, ";") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "Root":
+			root = kv[1]
+		case "Parent":
+			parent = kv[1]
+		case "Sampled":
+			sampled = kv[1]
+		}
+	}
+
+	// Root=<version>-<8 hex digit epoch>-<24 hex digit id>
+	rootParts := strings.Split(root, "-")
+	if len(rootParts) != 3 || rootParts[0] != "1" || len(rootParts[1]) != 8 || len(rootParts[2]) != 24 {
+		return nil, fmt.Errorf("invalid X-Ray trace root %q", root)
+	}
+	if _, err := strconv.ParseUint(rootParts[1], 16, 32); err != nil {
+		return nil, fmt.Errorf("invalid X-Ray trace root %q", root)
+	}
+	if _, err := strconv.ParseUint(rootParts[2][:8], 16, 32); err != nil {
+		return nil, fmt.Errorf("invalid X-Ray trace root %q", root)
+	}
+	traceId, err := strconv.ParseUint(rootParts[2][8:], 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid X-Ray trace root %q", root)
+	}
+
+	var spanId uint64
+	if parent != "" {
+		if len(parent) != 16 {
+			return nil, fmt.Errorf("invalid X-Ray parent %q", parent)
+		}
+		spanId, err = strconv.ParseUint(parent, 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid X-Ray parent %q", parent)
+		}
+		if spanId&math.MaxInt64 == 0 {
+			return nil, errInvalidContext{fmt.Sprintf("X-Ray parent %q is no span", parent)}
+		}
+	}
+
+	t := &Trace{
+		TraceId:  int64(traceId & math.MaxInt64),
+		SpanId:   int64(spanId & math.MaxInt64),
+		xrayRoot: root,
+	}
+	c := t.context()
+
+	// "?" (or no flag at all) means the upstream left the decision to us,
+	// which we don't record
+	switch sampled {
+	case "1", "0":
+		c.baggageItems[sampledKey] = sampled
+	}
+	return c, nil
+}
+
+// formatXRayHeader renders a spanContext as the value of an X-Amzn-Trace-Id
+// header. A trace that was extracted from an X-Ray header is sent with the
+// Root it arrived with. Otherwise the Root is made from now and our trace ID,
+// which is placed in the low bits of the X-Ray trace ID, so that
+// parseXRayHeader maps it straight back. The context's sampling decision is
+// sent as the Sampled flag, and since a Tracer without a Sampler records
+// every span, a context without a decision is sent as sampled.
+func formatXRayHeader(c *spanContext, now time.Time) string {
+	sampled := "1"
+	if c.baggageItems[sampledKey] == "0" {
+		sampled = "0"
+	}
+	root := c.xrayRoot
+	if root == "" {
+		root = fmt.Sprintf("1-%08x-00000000%016x", uint32(now.Unix()), uint64(c.TraceId()))
+	}
+	if c.SpanId() == 0 {
+		// a root context that was extracted without a parent
+		return fmt.Sprintf("Root=%s;Sampled=%s", root, sampled)
+	}
+	return fmt.Sprintf("Root=%s;Parent=%016x;Sampled=%s", root, uint64(c.SpanId()), sampled)
+}
@@ -0,0 +1,143 @@
+package veneur
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/stripe/veneur/trace"
+)
+
+// traceCanaryTimeout bounds how long the canary waits for its next hop.
+const traceCanaryTimeout = 5 * time.Second
+
+// the results the trace canary reports, in its response and as the result
+// tag of veneur.trace_canary.checks_total
+const (
+	// the next hop received the canary's span context intact
+	canaryPreserved = "preserved"
+	// the next hop answered, but without the canary's span context
+	canaryBroken = "broken"
+	// the next hop couldn't be reached, or its answer couldn't be read
+	canaryError = "error"
+)
+
+// traceCanaryEcho is the body of /debug/trace-canary/echo: the context it
+// extracted from the request.
+type traceCanaryEcho struct {
+	TraceID  int64  `json:"trace_id"`
+	ParentID int64  `json:"parent_id"`
+	Error    string `json:"error,omitempty"`
+}
+
+// traceCanaryResponse is the body of /debug/trace-canary.
+type traceCanaryResponse struct {
+	NextHop string `json:"next_hop"`
+	Result  string `json:"result"`
+	// the canary span's, which the next hop should have received
+	TraceID int64 `json:"trace_id"`
+	SpanID  int64 `json:"span_id"`
+	// what the next hop echoed, if it answered
+	Echo  *traceCanaryEcho `json:"echo,omitempty"`
+	Error string           `json:"error,omitempty"`
+}
+
+// handleTraceCanary checks that span contexts survive the trip to
+// trace_canary_next_hop, eg GET /debug/trace-canary. It starts a span,
+// injects it into a request to the next hop, which should be (or lead to)
+// another veneur's /debug/trace-canary/echo, and compares the context echoed
+// back with the span's. It responds 200 only if the context was preserved,
+// so it can be run as a synthetic check.
+func (s *Server) handleTraceCanary(w http.ResponseWriter, r *http.Request) {
+	if s.traceCanaryNextHop == "" {
+		http.Error(w, "trace_canary_next_hop is not set", http.StatusNotFound)
+		return
+	}
+	span := tracer.StartSpan("trace_canary", trace.NameTag("veneur.trace_canary")).(*trace.Span)
+	defer span.Finish()
+
+	resp := traceCanaryResponse{
+		NextHop: s.traceCanaryNextHop,
+		TraceID: span.TraceId,
+		SpanID:  span.SpanId,
+	}
+	echo, err := s.callTraceCanaryNextHop(span)
+	resp.Echo = echo
+	switch {
+	case err != nil && echo == nil:
+		resp.Result = canaryError
+		resp.Error = err.Error()
+	case err != nil:
+		resp.Result = canaryBroken
+		resp.Error = err.Error()
+	case echo.TraceID != span.TraceId || echo.ParentID != span.SpanId:
+		resp.Result = canaryBroken
+		resp.Error = fmt.Sprintf("the next hop received trace %d, parent %d", echo.TraceID, echo.ParentID)
+	default:
+		resp.Result = canaryPreserved
+	}
+	if resp.Result != canaryPreserved {
+		log.WithField("next_hop", s.traceCanaryNextHop).WithField("result", resp.Result).Warn(resp.Error)
+		span.SetTag("error", "true")
+	}
+	s.statsd.Count("trace_canary.checks_total", 1, []string{"result:" + resp.Result}, 1.0)
+
+	w.Header().Set("Content-Type", "application/json")
+	if resp.Result != canaryPreserved {
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+// callTraceCanaryNextHop makes the canary's request to the next hop, with
+// span injected into it, and returns what it echoed. If the next hop
+// answered without a context, the echo is returned with an error.
+func (s *Server) callTraceCanaryNextHop(span *trace.Span) (*traceCanaryEcho, error) {
+	req, err := http.NewRequest(http.MethodGet, s.traceCanaryNextHop, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := tracer.InjectRequest(span.Trace, req); err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: traceCanaryTimeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	echo := &traceCanaryEcho{}
+	if err := json.Unmarshal(body, echo); err != nil {
+		return nil, fmt.Errorf("the next hop responded %s, which isn't an echo: %s", res.Status, err)
+	}
+	if echo.Error != "" {
+		return echo, fmt.Errorf("the next hop received no context: %s", echo.Error)
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("the next hop responded %s", res.Status)
+	}
+	return echo, nil
+}
+
+// handleTraceCanaryEcho responds with the span context that a request
+// carried, as the next hop of another veneur's trace canary, eg
+// GET /debug/trace-canary/echo
+// Extracting it is counted in the tracer's extraction outcomes like any
+// other, so broken propagation also shows up there.
+func (s *Server) handleTraceCanaryEcho(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	span, err := tracer.ExtractRequestChild("trace_canary", r, "veneur.trace_canary.echo")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(traceCanaryEcho{Error: err.Error()})
+		return
+	}
+	defer span.Finish()
+	json.NewEncoder(w).Encode(traceCanaryEcho{TraceID: span.TraceId, ParentID: span.ParentId})
+}
@@ -0,0 +1,82 @@
+package veneur
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func canaryCheck(t *testing.T, s *Server) (int, traceCanaryResponse) {
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/trace-canary", nil))
+	var resp traceCanaryResponse
+	assert.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+	return w.Code, resp
+}
+
+func TestTraceCanary(t *testing.T) {
+	// the next hop is another veneur
+	nextHop := httptest.NewServer((&Server{}).Handler())
+	defer nextHop.Close()
+
+	s := &Server{traceCanaryNextHop: nextHop.URL + "/debug/trace-canary/echo"}
+	code, resp := canaryCheck(t, s)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, canaryPreserved, resp.Result)
+	assert.Empty(t, resp.Error)
+	if assert.NotNil(t, resp.Echo) {
+		assert.Equal(t, resp.TraceID, resp.Echo.TraceID)
+		assert.Equal(t, resp.SpanID, resp.Echo.ParentID, "the next hop's span should be a child of the canary's")
+	}
+}
+
+func TestTraceCanaryBroken(t *testing.T) {
+	echo := (&Server{}).Handler()
+	// a proxy that doesn't propagate the context
+	stripping := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Header = http.Header{}
+		echo.ServeHTTP(w, r)
+	}))
+	defer stripping.Close()
+	s := &Server{traceCanaryNextHop: stripping.URL + "/debug/trace-canary/echo"}
+	code, resp := canaryCheck(t, s)
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Equal(t, canaryBroken, resp.Result)
+	assert.NotEmpty(t, resp.Error)
+
+	// a proxy that starts a new trace
+	restarting := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(traceCanaryEcho{TraceID: 1, ParentID: 2})
+	}))
+	defer restarting.Close()
+	s.traceCanaryNextHop = restarting.URL
+	code, resp = canaryCheck(t, s)
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Equal(t, canaryBroken, resp.Result)
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachable.Close()
+	s.traceCanaryNextHop = unreachable.URL
+	code, resp = canaryCheck(t, s)
+	assert.Equal(t, http.StatusBadGateway, code)
+	assert.Equal(t, canaryError, resp.Result)
+	assert.Nil(t, resp.Echo)
+}
+
+func TestTraceCanaryConfig(t *testing.T) {
+	w := httptest.NewRecorder()
+	(&Server{}).Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/trace-canary", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code, "the canary needs a next hop")
+
+	config := localConfig()
+	config.TraceCanaryNextHop = "localhost:8127"
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "the next hop must be a URL")
+	config.TraceCanaryNextHop = "http://localhost:8127/debug/trace-canary/echo"
+	s, err := NewFromConfig(config)
+	assert.NoError(t, err)
+	assert.Equal(t, config.TraceCanaryNextHop, s.traceCanaryNextHop)
+}
@@ -0,0 +1,312 @@
+package veneur
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/statsd"
+	"github.com/golang/protobuf/proto"
+	"github.com/stripe/veneur/ssf"
+)
+
+const (
+	defaultTraceCaptureMaxFileBytes  = 100 * 1024 * 1024  // 100 MB
+	defaultTraceCaptureMaxTotalBytes = 1024 * 1024 * 1024 // 1 GB
+
+	// how many packets may be waiting for the capture writer before we start
+	// dropping them
+	traceCaptureBufferSize = 4096
+
+	// the file being written is named this, after its final name, until it
+	// is complete
+	traceCapturePartialSuffix = ".partial"
+)
+
+// capturedFile is a capture file on disk, along with how many bytes have
+// been written to it.
+type capturedFile struct {
+	path string
+	size int64
+}
+
+// SpanCapture tees received SSF packets to disk so that they can be analyzed
+// or replayed later. Each packet is written as a uvarint length followed by
+// the protobuf-encoded SSFSample. Files are rotated once they grow past
+// maxFileBytes, and the oldest files are deleted once the capture as a whole
+// grows past maxTotalBytes. The file being written has a .partial suffix
+// until it is rotated or the capture is stopped, so that a file with the
+// final name always holds complete records.
+//
+// Capture never blocks: if the writer cannot keep up, packets are dropped and
+// counted instead.
+type SpanCapture struct {
+	path          string
+	maxFileBytes  int64
+	maxTotalBytes int64
+
+	packets chan []byte
+	stats   *statsd.Client
+
+	// stopped is set once packets is closed, and working while Work runs
+	mtx     sync.RWMutex
+	stopped bool
+	working bool
+	done    chan struct{}
+
+	// these are only touched by the Work goroutine
+	current *os.File
+	files   []capturedFile // oldest first
+}
+
+// NewSpanCapture creates a SpanCapture writing files whose names are prefixed
+// with path. Capture files left behind by a previous run count towards the
+// total retained bytes, and one that was still being written when it stopped
+// is cut back to its last complete record.
+func NewSpanCapture(path string, maxFileBytes, maxTotalBytes int64, stats *statsd.Client) (*SpanCapture, error) {
+	if maxFileBytes <= 0 {
+		maxFileBytes = defaultTraceCaptureMaxFileBytes
+	}
+	if maxTotalBytes <= 0 {
+		maxTotalBytes = defaultTraceCaptureMaxTotalBytes
+	}
+	sc := &SpanCapture{
+		path:          path,
+		maxFileBytes:  maxFileBytes,
+		maxTotalBytes: maxTotalBytes,
+		packets:       make(chan []byte, traceCaptureBufferSize),
+		stats:         stats,
+		done:          make(chan struct{}),
+	}
+
+	candidates, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	var existing []string
+	for _, name := range candidates {
+		if strings.HasSuffix(name, traceCapturePartialSuffix) && isCaptureFile(path, strings.TrimSuffix(name, traceCapturePartialSuffix)) {
+			final := strings.TrimSuffix(name, traceCapturePartialSuffix)
+			if err := recoverCaptureFile(name, final); err != nil {
+				return nil, err
+			}
+			existing = append(existing, final)
+		} else if isCaptureFile(path, name) {
+			existing = append(existing, name)
+		}
+	}
+	// the suffix is a nanosecond timestamp of the same width for any date we
+	// care about, so lexical order is also chronological order
+	sort.Strings(existing)
+	for _, name := range existing {
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		sc.files = append(sc.files, capturedFile{path: name, size: info.Size()})
+	}
+	return sc, nil
+}
+
+// isCaptureFile returns whether name is one of the files written by a
+// SpanCapture with the given path, which are suffixed with a timestamp, rather
+// than another file that happens to share the prefix.
+func isCaptureFile(path, name string) bool {
+	suffix := strings.TrimPrefix(name, path+".")
+	if suffix == name || suffix == "" {
+		return false
+	}
+	for _, c := range suffix {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+// recoverCaptureFile cuts a capture file that was left partially written
+// back to its last complete record, and gives it its final name.
+func recoverCaptureFile(partial, final string) error {
+	f, err := os.Open(partial)
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var complete int64
+	for {
+		length, err := binary.ReadUvarint(r)
+		if err != nil {
+			break
+		}
+		n, err := io.CopyN(ioutil.Discard, r, int64(length))
+		if err != nil || n != int64(length) {
+			break
+		}
+		var header [binary.MaxVarintLen64]byte
+		complete += int64(binary.PutUvarint(header[:], length)) + n
+	}
+	f.Close()
+
+	log.WithField("file", final).Warn("Recovering span capture file that was left partially written")
+	if err := os.Truncate(partial, complete); err != nil {
+		return err
+	}
+	return os.Rename(partial, final)
+}
+
+// Capture queues a copy of the packet to be written to disk. The caller is
+// free to reuse the packet's buffer once this returns. Packets captured after
+// Stop are ignored.
+func (sc *SpanCapture) Capture(packet []byte) {
+	sc.mtx.RLock()
+	defer sc.mtx.RUnlock()
+	if sc.stopped {
+		return
+	}
+	buf := make([]byte, len(packet))
+	copy(buf, packet)
+	select {
+	case sc.packets <- buf:
+	default:
+		sc.stats.Count("trace_capture.dropped_total", 1, nil, 1.0)
+	}
+}
+
+// Work writes queued packets to disk. It will not return until Stop is
+// called.
+func (sc *SpanCapture) Work() {
+	sc.mtx.Lock()
+	sc.working = true
+	sc.mtx.Unlock()
+	defer close(sc.done)
+
+	for packet := range sc.packets {
+		if err := sc.write(packet); err != nil {
+			sc.stats.Count("trace_capture.error_total", 1, nil, 1.0)
+			log.WithError(err).Error("Could not write captured span")
+		}
+	}
+	sc.finish()
+}
+
+// Stop tells the capture writer to exit once it has written every packet
+// queued so far, and if it is running, waits for it to. It is safe to call
+// more than once, and concurrently with Capture.
+func (sc *SpanCapture) Stop() {
+	sc.mtx.Lock()
+	if sc.stopped {
+		sc.mtx.Unlock()
+		return
+	}
+	sc.stopped = true
+	close(sc.packets)
+	working := sc.working
+	sc.mtx.Unlock()
+
+	if working {
+		<-sc.done
+	}
+}
+
+func (sc *SpanCapture) write(packet []byte) error {
+	var header [binary.MaxVarintLen64]byte
+	headerLength := binary.PutUvarint(header[:], uint64(len(packet)))
+	recordLength := int64(headerLength + len(packet))
+
+	if sc.current == nil || sc.files[len(sc.files)-1].size+recordLength > sc.maxFileBytes {
+		if err := sc.rotate(); err != nil {
+			return err
+		}
+	}
+
+	last := &sc.files[len(sc.files)-1]
+	_, err := sc.current.Write(header[:headerLength])
+	if err == nil {
+		_, err = sc.current.Write(packet)
+	}
+	if err != nil {
+		// don't leave a partial record behind for the next one to follow
+		if _, terr := sc.current.Seek(last.size, io.SeekStart); terr != nil || sc.current.Truncate(last.size) != nil {
+			sc.finish()
+		}
+		return err
+	}
+	last.size += recordLength
+	sc.stats.Count("trace_capture.written_total", 1, nil, 1.0)
+	return nil
+}
+
+// finish closes the current capture file, and gives it its final name.
+func (sc *SpanCapture) finish() {
+	if sc.current == nil {
+		return
+	}
+	if err := sc.current.Close(); err != nil {
+		log.WithError(err).Warn("Could not close span capture file")
+	}
+	name := sc.files[len(sc.files)-1].path
+	if err := os.Rename(name+traceCapturePartialSuffix, name); err != nil {
+		log.WithError(err).WithField("file", name).Warn("Could not rename span capture file")
+	}
+	sc.current = nil
+}
+
+// rotate closes the current capture file, opens a fresh one and deletes the
+// oldest files until we are back under the retention limit.
+func (sc *SpanCapture) rotate() error {
+	sc.finish()
+
+	name := fmt.Sprintf("%s.%d", sc.path, time.Now().UnixNano())
+	f, err := os.OpenFile(name+traceCapturePartialSuffix, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	sc.current = f
+	sc.files = append(sc.files, capturedFile{path: name})
+
+	// leave room for the new file to fill up, so that we stay under the
+	// limit until the next rotation
+	total := sc.maxFileBytes
+	for _, cf := range sc.files {
+		total += cf.size
+	}
+	// never delete the file we just opened
+	for total > sc.maxTotalBytes && len(sc.files) > 1 {
+		oldest := sc.files[0]
+		if err := os.Remove(oldest.path); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("file", oldest.path).Warn("Could not remove old span capture file")
+		}
+		total -= oldest.size
+		sc.files = sc.files[1:]
+	}
+	return nil
+}
+
+// ReadCapturedSpan reads the next span from a file written by SpanCapture.
+// It returns io.EOF once there are no more spans to read.
+func ReadCapturedSpan(r *bufio.Reader) (*ssf.SSFSample, error) {
+	length, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	packet := make([]byte, length)
+	if _, err := io.ReadFull(r, packet); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	sample := &ssf.SSFSample{}
+	if err := proto.Unmarshal(packet, sample); err != nil {
+		return nil, err
+	}
+	return sample, nil
+}
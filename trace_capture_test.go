@@ -0,0 +1,194 @@
+package veneur
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/ssf"
+)
+
+func captureTestPacket(t *testing.T, name string) []byte {
+	packet, err := proto.Marshal(&ssf.SSFSample{
+		Metric: ssf.SSFSample_TRACE,
+		Name:   name,
+		Trace: &ssf.SSFTrace{
+			TraceId: 1,
+			Id:      2,
+		},
+	})
+	assert.NoError(t, err)
+	return packet
+}
+
+func readCaptureFiles(t *testing.T, prefix string) []string {
+	files, err := filepath.Glob(prefix + ".*")
+	assert.NoError(t, err)
+
+	var names []string
+	for _, name := range files {
+		f, err := os.Open(name)
+		assert.NoError(t, err)
+		r := bufio.NewReader(f)
+		for {
+			sample, err := ReadCapturedSpan(r)
+			if err == io.EOF {
+				break
+			}
+			assert.NoError(t, err)
+			names = append(names, sample.Name)
+		}
+		f.Close()
+	}
+	return names
+}
+
+func TestSpanCaptureRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-capture")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "spans")
+
+	sc, err := NewSpanCapture(prefix, 0, 0, nil)
+	assert.NoError(t, err)
+
+	packet := captureTestPacket(t, "a.b.c")
+	sc.Capture(packet)
+	// the capture must have taken its own copy
+	for i := range packet {
+		packet[i] = 0
+	}
+	sc.Capture(captureTestPacket(t, "d.e.f"))
+	sc.Stop()
+	sc.Work()
+
+	assert.Equal(t, []string{"a.b.c", "d.e.f"}, readCaptureFiles(t, prefix))
+}
+
+func TestSpanCaptureRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-capture")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "spans")
+
+	packet := captureTestPacket(t, "a.b.c")
+	record := int64(len(packet) + 1)
+
+	// two records fit in each file, and we retain at most two files
+	sc, err := NewSpanCapture(prefix, 2*record, 4*record, nil)
+	assert.NoError(t, err)
+	for i := 0; i < 9; i++ {
+		sc.Capture(packet)
+	}
+	sc.Stop()
+	sc.Work()
+
+	files, err := filepath.Glob(prefix + ".*")
+	assert.NoError(t, err)
+	assert.Len(t, files, 2, "oldest files should have been removed")
+	assert.Len(t, readCaptureFiles(t, prefix), 3, "only the most recent spans should be retained")
+}
+
+func TestSpanCaptureDropsWhenFull(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-capture")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sc, err := NewSpanCapture(filepath.Join(dir, "spans"), 0, 0, nil)
+	assert.NoError(t, err)
+
+	// nothing is draining the queue, so this must not block
+	packet := captureTestPacket(t, "a.b.c")
+	for i := 0; i < traceCaptureBufferSize+10; i++ {
+		sc.Capture(packet)
+	}
+	assert.Len(t, sc.packets, traceCaptureBufferSize)
+}
+
+func TestSpanCaptureIgnoresOtherFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-capture")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "spans")
+
+	// files that share the prefix, but weren't written by the capture
+	for _, name := range []string{prefix + ".conf", prefix + ".1.bak"} {
+		assert.NoError(t, ioutil.WriteFile(name, make([]byte, 1024), 0644))
+	}
+
+	sc, err := NewSpanCapture(prefix, 0, 1, nil)
+	assert.NoError(t, err)
+	assert.Empty(t, sc.files)
+	sc.Capture(captureTestPacket(t, "a.b.c"))
+	sc.Stop()
+	sc.Work()
+
+	for _, name := range []string{prefix + ".conf", prefix + ".1.bak"} {
+		_, err := os.Stat(name)
+		assert.NoError(t, err, "%s should not have been deleted", name)
+	}
+}
+
+func TestSpanCaptureRecoversPartialFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-capture")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "spans")
+
+	sc, err := NewSpanCapture(prefix, 0, 0, nil)
+	assert.NoError(t, err)
+	sc.Capture(captureTestPacket(t, "a.b.c"))
+	sc.Stop()
+	sc.Work()
+	files, err := filepath.Glob(prefix + ".*")
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+
+	// as if veneur had died while writing the second record
+	partial := files[0] + traceCapturePartialSuffix
+	assert.NoError(t, os.Rename(files[0], partial))
+	f, err := os.OpenFile(partial, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	f.Write([]byte{100, 1, 2})
+	f.Close()
+
+	sc, err = NewSpanCapture(prefix, 0, 0, nil)
+	assert.NoError(t, err)
+	assert.Len(t, sc.files, 1)
+	assert.Equal(t, []string{"a.b.c"}, readCaptureFiles(t, prefix), "the partial record should be cut off")
+}
+
+func TestSpanCaptureStop(t *testing.T) {
+	dir, err := ioutil.TempDir("", "veneur-capture")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	prefix := filepath.Join(dir, "spans")
+
+	sc, err := NewSpanCapture(prefix, 0, 0, nil)
+	assert.NoError(t, err)
+	go sc.Work()
+	for working := false; !working; {
+		sc.mtx.RLock()
+		working = sc.working
+		sc.mtx.RUnlock()
+	}
+	sc.Capture(captureTestPacket(t, "a.b.c"))
+	// waits for the writer, which renames the file once it is complete
+	sc.Stop()
+	sc.Stop()
+	sc.Capture(captureTestPacket(t, "d.e.f"))
+
+	files, err := filepath.Glob(prefix + ".*")
+	assert.NoError(t, err)
+	if assert.Len(t, files, 1) {
+		assert.True(t, isCaptureFile(prefix, files[0]), "%s should have its final name", files[0])
+	}
+	assert.Equal(t, []string{"a.b.c"}, readCaptureFiles(t, prefix))
+}
@@ -2,6 +2,7 @@ package veneur
 
 import (
 	"container/ring"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,6 +24,38 @@ type Worker struct {
 	stats      *statsd.Client
 	logger     *logrus.Logger
 	wm         WorkerMetrics
+
+	// limiter is nil unless histograms and timers have a rate ceiling
+	limiter   *sampleLimiter
+	dropped   int64
+	lastFlush time.Time
+
+	// explicit bucket bounds for histograms and timers, by metric name
+	histogramBuckets map[string][]float64
+
+	// the compressions of histograms' and timers' t-digests, for those that
+	// don't use the default. They're only looked up when a series is
+	// created, so they aren't cached
+	compressions histogramCompressions
+
+	// how gauges reduce the values reported within an interval, by metric
+	// name, if not GaugeLast
+	gaugeAggregations map[string]samplers.GaugeAggregation
+
+	// if scales is set, the values of the metrics it matches are scaled as
+	// they are processed. Since that's a regexp match per metric name, each
+	// name's scale is cached until the next flush
+	scales     metricScales
+	scaleCache map[string]float64
+
+	// if internalEvery is more than 1, veneur's own metrics are held in
+	// internal, accumulating across flushes, and only flushed every
+	// internalEvery flushes
+	internalEvery   int
+	internalFlushes int
+	// the total of the intervals of the flushes internal was held for
+	internalWindow time.Duration
+	internal       WorkerMetrics
 }
 
 // WorkerMetrics is just a plain struct bundling together the flushed contents of a worker
@@ -43,6 +76,21 @@ type WorkerMetrics struct {
 	localHistograms map[samplers.MetricKey]*samplers.Histo
 	localSets       map[samplers.MetricKey]*samplers.Set
 	localTimers     map[samplers.MetricKey]*samplers.Histo
+
+	// when the first (and therefore oldest) observation in this batch was
+	// received, or the zero time if there were none
+	firstReceived time.Time
+
+	// the interval these metrics were accumulated over, if it was not the
+	// server's interval
+	interval time.Duration
+}
+
+// seriesCount returns how many series wm holds.
+func (wm WorkerMetrics) seriesCount() int {
+	return len(wm.counters) + len(wm.gauges) + len(wm.histograms) + len(wm.sets) +
+		len(wm.timers) + len(wm.globalCounters) + len(wm.localHistograms) +
+		len(wm.localSets) + len(wm.localTimers)
 }
 
 // NewWorkerMetrics initializes a WorkerMetrics struct
@@ -70,15 +118,18 @@ func (wm WorkerMetrics) Upsert(mk samplers.MetricKey, Scope samplers.MetricScope
 		if Scope == samplers.GlobalOnly {
 			if _, present = wm.globalCounters[mk]; !present {
 				wm.globalCounters[mk] = samplers.NewCounter(mk.Name, tags)
+				wm.globalCounters[mk].Timestamp = mk.Timestamp
 			}
 		} else {
 			if _, present = wm.counters[mk]; !present {
 				wm.counters[mk] = samplers.NewCounter(mk.Name, tags)
+				wm.counters[mk].Timestamp = mk.Timestamp
 			}
 		}
 	case "gauge":
 		if _, present = wm.gauges[mk]; !present {
 			wm.gauges[mk] = samplers.NewGauge(mk.Name, tags)
+			wm.gauges[mk].Timestamp = mk.Timestamp
 		}
 	case "histogram":
 		if Scope == samplers.LocalOnly {
@@ -116,6 +167,132 @@ func (wm WorkerMetrics) Upsert(mk samplers.MetricKey, Scope samplers.MetricScope
 	return !present
 }
 
+// histo returns the histogram or timer for the given metrickey, or nil for
+// other types.
+func (wm WorkerMetrics) histo(mk samplers.MetricKey, Scope samplers.MetricScope) *samplers.Histo {
+	switch {
+	case mk.Type == "histogram" && Scope == samplers.LocalOnly:
+		return wm.localHistograms[mk]
+	case mk.Type == "histogram":
+		return wm.histograms[mk]
+	case mk.Type == "timer" && Scope == samplers.LocalOnly:
+		return wm.localTimers[mk]
+	case mk.Type == "timer":
+		return wm.timers[mk]
+	}
+	return nil
+}
+
+// setBuckets gives the histogram or timer for the given metrickey explicit
+// buckets. It does nothing for other types.
+func (wm WorkerMetrics) setBuckets(mk samplers.MetricKey, Scope samplers.MetricScope, bounds []float64) {
+	if h := wm.histo(mk, Scope); h != nil {
+		h.SetBuckets(bounds)
+	}
+}
+
+// setCompression gives the newly created histogram or timer for the given
+// metrickey a t-digest with the given compression. It does nothing for other
+// types.
+func (wm WorkerMetrics) setCompression(mk samplers.MetricKey, Scope samplers.MetricScope, compression float64) {
+	if h := wm.histo(mk, Scope); h != nil {
+		h.SetCompression(compression)
+	}
+}
+
+// scaleFor returns the scale for metrics with the given name. It must be
+// called with the mutex held.
+func (w *Worker) scaleFor(name string) float64 {
+	scale, ok := w.scaleCache[name]
+	if !ok {
+		scale = w.scales.scaleFor(name)
+		if w.scaleCache == nil {
+			w.scaleCache = make(map[string]float64)
+		}
+		w.scaleCache[name] = scale
+	}
+	return scale
+}
+
+// setGaugeAggregation sets how the gauge for the given metrickey reduces the
+// values reported for it. It does nothing for other types.
+func (wm WorkerMetrics) setGaugeAggregation(mk samplers.MetricKey, agg samplers.GaugeAggregation) {
+	if g, ok := wm.gauges[mk]; ok && mk.Type == "gauge" {
+		g.Aggregation = agg
+	}
+}
+
+// merge adds the metrics in other, which were accumulated over a later
+// interval, to wm. Metrics that wm doesn't have yet get their own samplers,
+// so nothing in wm is shared with other, which can be flushed as usual
+// afterwards.
+func (wm *WorkerMetrics) merge(other WorkerMetrics) error {
+	mergeCounters(wm.counters, other.counters)
+	mergeCounters(wm.globalCounters, other.globalCounters)
+	for mk, g := range other.gauges {
+		mine, ok := wm.gauges[mk]
+		if !ok {
+			mine = samplers.NewGauge(g.Name, g.Tags)
+			mine.Timestamp = g.Timestamp
+			mine.Aggregation = g.Aggregation
+			wm.gauges[mk] = mine
+		}
+		mine.Merge(g)
+	}
+	mergeHistos(wm.histograms, other.histograms)
+	mergeHistos(wm.timers, other.timers)
+	mergeHistos(wm.localHistograms, other.localHistograms)
+	mergeHistos(wm.localTimers, other.localTimers)
+	if err := mergeSets(wm.sets, other.sets); err != nil {
+		return err
+	}
+	if err := mergeSets(wm.localSets, other.localSets); err != nil {
+		return err
+	}
+	if wm.firstReceived.IsZero() {
+		wm.firstReceived = other.firstReceived
+	}
+	return nil
+}
+
+func mergeCounters(into, from map[samplers.MetricKey]*samplers.Counter) {
+	for mk, c := range from {
+		mine, ok := into[mk]
+		if !ok {
+			mine = samplers.NewCounter(c.Name, c.Tags)
+			mine.Timestamp = c.Timestamp
+			into[mk] = mine
+		}
+		mine.Merge(c)
+	}
+}
+
+func mergeHistos(into, from map[samplers.MetricKey]*samplers.Histo) {
+	for mk, h := range from {
+		mine, ok := into[mk]
+		if !ok {
+			mine = samplers.NewHist(h.Name, h.Tags)
+			mine.SetCompression(h.Value.Compression())
+			into[mk] = mine
+		}
+		mine.Merge(h)
+	}
+}
+
+func mergeSets(into, from map[samplers.MetricKey]*samplers.Set) error {
+	for mk, s := range from {
+		mine, ok := into[mk]
+		if !ok {
+			mine = samplers.NewSet(s.Name, s.Tags)
+			into[mk] = mine
+		}
+		if err := mine.Merge(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // NewWorker creates, and returns a new Worker object.
 func NewWorker(id int, stats *statsd.Client, logger *logrus.Logger) *Worker {
 	return &Worker{
@@ -129,9 +306,17 @@ func NewWorker(id int, stats *statsd.Client, logger *logrus.Logger) *Worker {
 		stats:      stats,
 		logger:     logger,
 		wm:         NewWorkerMetrics(),
+		lastFlush:  time.Now(),
+		internal:   NewWorkerMetrics(),
 	}
 }
 
+// isInternal reports whether a metric is one of veneur's own, sent by its
+// statsd client to itself, which are local-only and in the veneur namespace.
+func (w *Worker) isInternal(m *samplers.UDPMetric) bool {
+	return w.internalEvery > 1 && m.Scope == samplers.LocalOnly && strings.HasPrefix(m.Name, internalMetricsPrefix)
+}
+
 // Work will start the worker listening for metrics to process or import.
 // It will not return until the worker is sent a message to terminate using Stop()
 func (w *Worker) Work() {
@@ -159,34 +344,61 @@ func (w *Worker) ProcessMetric(m *samplers.UDPMetric) {
 	defer w.mutex.Unlock()
 
 	w.processed++
-	w.wm.Upsert(m.MetricKey, m.Scope, m.Tags)
+	if w.limiter != nil && (m.Type == "histogram" || m.Type == "timer") {
+		sampleRate, ok := w.limiter.Admit(m.MetricKey, m.SampleRate)
+		if !ok {
+			w.dropped++
+			return
+		}
+		m.SampleRate = sampleRate
+	}
+	if w.scales != nil && m.Type != "set" {
+		m.Value = m.Value.(float64) * w.scaleFor(m.Name)
+	}
+	wm := w.wm
+	if w.isInternal(m) {
+		wm = w.internal
+	} else if w.wm.firstReceived.IsZero() {
+		w.wm.firstReceived = time.Now()
+	}
+	if wm.Upsert(m.MetricKey, m.Scope, m.Tags) {
+		if bounds, ok := w.histogramBuckets[m.Name]; ok {
+			wm.setBuckets(m.MetricKey, m.Scope, bounds)
+		}
+		if compression, ok := w.compressions.compressionFor(m.Name); ok {
+			wm.setCompression(m.MetricKey, m.Scope, compression)
+		}
+		if agg, ok := w.gaugeAggregations[m.Name]; ok {
+			wm.setGaugeAggregation(m.MetricKey, agg)
+		}
+	}
 
 	switch m.Type {
 	case "counter":
 		if m.Scope == samplers.GlobalOnly {
-			w.wm.globalCounters[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.globalCounters[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
 		} else {
-			w.wm.counters[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.counters[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
 		}
 	case "gauge":
-		w.wm.gauges[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+		wm.gauges[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
 	case "histogram":
 		if m.Scope == samplers.LocalOnly {
-			w.wm.localHistograms[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.localHistograms[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
 		} else {
-			w.wm.histograms[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.histograms[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
 		}
 	case "set":
 		if m.Scope == samplers.LocalOnly {
-			w.wm.localSets[m.MetricKey].Sample(m.Value.(string), m.SampleRate)
+			wm.localSets[m.MetricKey].Sample(m.Value.(string), m.SampleRate)
 		} else {
-			w.wm.sets[m.MetricKey].Sample(m.Value.(string), m.SampleRate)
+			wm.sets[m.MetricKey].Sample(m.Value.(string), m.SampleRate)
 		}
 	case "timer":
 		if m.Scope == samplers.LocalOnly {
-			w.wm.localTimers[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.localTimers[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
 		} else {
-			w.wm.timers[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
+			wm.timers[m.MetricKey].Sample(m.Value.(float64), m.SampleRate)
 		}
 	default:
 		log.WithField("type", m.Type).Error("Unknown metric type for processing")
@@ -201,11 +413,21 @@ func (w *Worker) ImportMetric(other samplers.JSONMetric) {
 	// we don't increment the processed metric counter here, it was already
 	// counted by the original veneur that sent this to us
 	w.imported++
+	if w.wm.firstReceived.IsZero() {
+		w.wm.firstReceived = time.Now()
+	}
 	if other.Type == "counter" {
 		// this is an odd special case -- counters that are imported are global
 		w.wm.Upsert(other.MetricKey, samplers.GlobalOnly, other.Tags)
-	} else {
-		w.wm.Upsert(other.MetricKey, samplers.MixedScope, other.Tags)
+	} else if w.wm.Upsert(other.MetricKey, samplers.MixedScope, other.Tags) {
+		if agg, ok := w.gaugeAggregations[other.Name]; ok {
+			w.wm.setGaugeAggregation(other.MetricKey, agg)
+		}
+		// the forwarded digests are merged into this one, so it decides
+		// how accurate the global percentiles are
+		if compression, ok := w.compressions.compressionFor(other.Name); ok {
+			w.wm.setCompression(other.MetricKey, samplers.MixedScope, compression)
+		}
 	}
 
 	switch other.Type {
@@ -213,6 +435,10 @@ func (w *Worker) ImportMetric(other samplers.JSONMetric) {
 		if err := w.wm.globalCounters[other.MetricKey].Combine(other.Value); err != nil {
 			log.WithError(err).Error("Could not merge counters")
 		}
+	case "gauge":
+		if err := w.wm.gauges[other.MetricKey].Combine(other.Value); err != nil {
+			log.WithError(err).Error("Could not merge gauges")
+		}
 	case "set":
 		if err := w.wm.sets[other.MetricKey].Combine(other.Value); err != nil {
 			log.WithError(err).Error("Could not merge sets")
@@ -230,6 +456,71 @@ func (w *Worker) ImportMetric(other samplers.JSONMetric) {
 	}
 }
 
+// HistogramQuantile returns the current estimate of a quantile for a histogram
+// or timer that has not been flushed yet, along with the weight of samples it
+// has seen so far. The estimate only covers the current flush interval. ok is
+// false if this worker does not hold the series.
+func (w *Worker) HistogramQuantile(mk samplers.MetricKey, quantile float64) (value float64, weight float64, ok bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	var h *samplers.Histo
+	switch mk.Type {
+	case "histogram":
+		if h, ok = w.wm.histograms[mk]; !ok {
+			h, ok = w.wm.localHistograms[mk]
+		}
+	case "timer":
+		if h, ok = w.wm.timers[mk]; !ok {
+			h, ok = w.wm.localTimers[mk]
+		}
+	}
+	if !ok {
+		return 0, 0, false
+	}
+	// the worker lock keeps anybody else from touching the digest while
+	// its temporary buffer gets merged in
+	return h.Value.Quantile(quantile), h.Value.Count(), true
+}
+
+// ResetMetric discards everything the worker has accumulated for the given
+// series in the current interval, whatever its scope. The next observation
+// starts it afresh. It returns false if the worker does not hold the series.
+func (w *Worker) ResetMetric(mk samplers.MetricKey) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	// a series can be held in both the mixed and the local-only (or
+	// global-only) map for its type
+	var mixed, scoped bool
+	switch mk.Type {
+	case "counter":
+		_, mixed = w.wm.counters[mk]
+		_, scoped = w.wm.globalCounters[mk]
+		delete(w.wm.counters, mk)
+		delete(w.wm.globalCounters, mk)
+	case "gauge":
+		_, mixed = w.wm.gauges[mk]
+		delete(w.wm.gauges, mk)
+	case "histogram":
+		_, mixed = w.wm.histograms[mk]
+		_, scoped = w.wm.localHistograms[mk]
+		delete(w.wm.histograms, mk)
+		delete(w.wm.localHistograms, mk)
+	case "set":
+		_, mixed = w.wm.sets[mk]
+		_, scoped = w.wm.localSets[mk]
+		delete(w.wm.sets, mk)
+		delete(w.wm.localSets, mk)
+	case "timer":
+		_, mixed = w.wm.timers[mk]
+		_, scoped = w.wm.localTimers[mk]
+		delete(w.wm.timers, mk)
+		delete(w.wm.localTimers, mk)
+	}
+	return mixed || scoped
+}
+
 // Flush resets the worker's internal metrics and returns their contents.
 func (w *Worker) Flush() WorkerMetrics {
 	start := time.Now()
@@ -240,10 +531,19 @@ func (w *Worker) Flush() WorkerMetrics {
 	ret := w.wm
 	processed := w.processed
 	imported := w.imported
+	dropped := w.dropped
 
 	w.wm = NewWorkerMetrics()
+	w.scaleCache = nil
 	w.processed = 0
 	w.imported = 0
+	w.dropped = 0
+	if w.limiter != nil {
+		// anything that hasn't been seen for a whole interval has no
+		// history worth keeping
+		w.limiter.Prune(w.lastFlush)
+	}
+	w.lastFlush = start
 	w.mutex.Unlock()
 
 	// Track how much time each worker takes to flush.
@@ -256,10 +556,50 @@ func (w *Worker) Flush() WorkerMetrics {
 
 	w.stats.Count("worker.metrics_processed_total", processed, []string{}, 1.0)
 	w.stats.Count("worker.metrics_imported_total", imported, []string{}, 1.0)
+	// what's left of the ingest funnel once the rate ceiling has been applied
+	w.stats.Count("ingest.metrics_aggregated_total", processed-dropped, nil, 1.0)
+	if w.limiter != nil {
+		w.stats.Count("worker.metrics_dropped_total", dropped, []string{"cause:rate_ceiling"}, 1.0)
+	}
 
 	return ret
 }
 
+// FlushInternal is called after Flush, and returns veneur's own metrics if
+// they are due to be flushed, which is every internalEvery flushes. Until
+// then they keep accumulating, so counters sum across the flushes they were
+// held for, and gauges keep their latest value. interval is how long the
+// calling flush covers, which is more than the server's interval if flushes
+// were paused, and the returned metrics are marked as covering the total of
+// the intervals they were held for.
+func (w *Worker) FlushInternal(interval time.Duration) (WorkerMetrics, bool) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.internalEvery <= 1 {
+		return WorkerMetrics{}, false
+	}
+	w.internalFlushes++
+	w.internalWindow += interval
+	if w.internalFlushes < w.internalEvery {
+		return WorkerMetrics{}, false
+	}
+	ret := w.internal
+	ret.interval = w.internalWindow
+	w.internal = NewWorkerMetrics()
+	w.internalFlushes = 0
+	w.internalWindow = 0
+	return ret, true
+}
+
+// SeriesCount returns how many series the worker is accumulating for the
+// next flush.
+func (w *Worker) SeriesCount() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.wm.seriesCount() + w.internal.seriesCount()
+}
+
 // Stop tells the worker to stop listening for work requests.
 //
 // Note that the worker will only stop *after* it has finished its work.
@@ -275,6 +615,8 @@ type EventWorker struct {
 	events           []samplers.UDPEvent
 	checks           []samplers.UDPServiceCheck
 	stats            *statsd.Client
+	// nil unless event_dedupe is set
+	dedupe *eventDedupe
 }
 
 // NewEventWorker creates an EventWorker ready to collect events and service checks.
@@ -294,7 +636,9 @@ func (ew *EventWorker) Work() {
 		select {
 		case evt := <-ew.EventChan:
 			ew.mutex.Lock()
-			ew.events = append(ew.events, evt)
+			if ew.dedupe == nil || !ew.dedupe.duplicate(evt, len(ew.events)) {
+				ew.events = append(ew.events, evt)
+			}
 			ew.mutex.Unlock()
 		case svcheck := <-ew.ServiceCheckChan:
 			ew.mutex.Lock()
@@ -315,9 +659,16 @@ func (ew *EventWorker) Flush() ([]samplers.UDPEvent, []samplers.UDPServiceCheck)
 	// these slices will be allocated again at append time
 	ew.events = nil
 	ew.checks = nil
+	var collapsed int64
+	if ew.dedupe != nil {
+		collapsed = ew.dedupe.finish(retevts)
+	}
 
 	ew.mutex.Unlock()
 	ew.stats.TimeInMilliseconds("flush.event_worker_duration_ns", float64(time.Since(start).Nanoseconds()), nil, 1.0)
+	if ew.dedupe != nil {
+		ew.stats.Count("worker.events_deduplicated_total", collapsed, nil, 1.0)
+	}
 	return retevts, retsvchecks
 }
 
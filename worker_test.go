@@ -1,7 +1,12 @@
 package veneur
 
 import (
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
@@ -29,6 +34,42 @@ func TestWorker(t *testing.T) {
 	assert.Len(t, nometrics.counters, 0, "Should flush no metrics")
 }
 
+func TestWorkerTimestamps(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	parser := samplers.Parser{ExplicitTimestamps: true}
+	for _, packet := range []string{"a.b.c:1|c", "a.b.c:2|c|T1656581400", "a.b.c:4|c|T1656581400", "a.b.c:3|g|T1656581460"} {
+		m, err := parser.ParseMetric([]byte(packet))
+		assert.NoError(t, err)
+		w.ProcessMetric(m)
+	}
+
+	wm := w.Flush()
+	assert.Len(t, wm.counters, 2, "backfilled values should be kept apart from live ones")
+	backfilled := wm.counters[samplers.MetricKey{Name: "a.b.c", Type: "counter", Timestamp: 1656581400}]
+	if assert.NotNil(t, backfilled) {
+		flushed := backfilled.FlushCount(10 * time.Second)
+		assert.Equal(t, [1][2]float64{{1656581400, 6}}, flushed[0].Value)
+	}
+	live := wm.counters[samplers.MetricKey{Name: "a.b.c", Type: "counter"}]
+	if assert.NotNil(t, live) {
+		assert.InDelta(t, float64(time.Now().Unix()), live.FlushCount(10 * time.Second)[0].Value[0][0], 2)
+	}
+
+	gauge := wm.gauges[samplers.MetricKey{Name: "a.b.c", Type: "gauge", Timestamp: 1656581460}]
+	if assert.NotNil(t, gauge) {
+		// the timestamp survives being forwarded to a global veneur
+		jm, err := gauge.Export()
+		assert.NoError(t, err)
+		global := NewWorker(1, nil, logrus.New())
+		global.ImportMetric(jm)
+		imported := global.Flush().gauges
+		assert.Len(t, imported, 1)
+		for _, g := range imported {
+			assert.Equal(t, [1][2]float64{{1656581460, 3}}, g.Flush()[0].Value)
+		}
+	}
+}
+
 func TestWorkerLocal(t *testing.T) {
 	w := NewWorker(1, nil, logrus.New())
 
@@ -49,6 +90,150 @@ func TestWorkerLocal(t *testing.T) {
 	assert.Len(t, wm.histograms, 0, "number of global histograms")
 }
 
+func TestWorkerHistogramBuckets(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	w.histogramBuckets = map[string][]float64{"a.b.c": {1, 2}}
+
+	for _, m := range []samplers.UDPMetric{
+		{MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "timer"}, Value: 1.5, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "timer"}, Value: 3.0, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "a.b.c", Type: "histogram"}, Value: 1.0, SampleRate: 1.0, Scope: samplers.LocalOnly},
+		{MetricKey: samplers.MetricKey{Name: "d.e.f", Type: "histogram"}, Value: 1.0, SampleRate: 1.0},
+	} {
+		m := m
+		w.ProcessMetric(&m)
+	}
+
+	wm := w.Flush()
+	timer := wm.timers[samplers.MetricKey{Name: "a.b.c", Type: "timer"}]
+	assert.Equal(t, []float64{0, 1, 1}, timer.BucketWeights, "counts per bucket, before accumulating")
+	local := wm.localHistograms[samplers.MetricKey{Name: "a.b.c", Type: "histogram"}]
+	assert.Equal(t, []float64{1, 0, 0}, local.BucketWeights)
+	assert.Nil(t, wm.histograms[samplers.MetricKey{Name: "d.e.f", Type: "histogram"}].Buckets, "only configured names get buckets")
+}
+
+func TestWorkerGaugeAggregations(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	w.gaugeAggregations = map[string]samplers.GaugeAggregation{"mem.peak": samplers.GaugeMax}
+
+	for _, m := range []samplers.UDPMetric{
+		{MetricKey: samplers.MetricKey{Name: "mem.peak", Type: "gauge"}, Value: 10.0, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "mem.peak", Type: "gauge"}, Value: 30.0, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "mem.peak", Type: "gauge"}, Value: 20.0, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "mem.current", Type: "gauge"}, Value: 30.0, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "mem.current", Type: "gauge"}, Value: 20.0, SampleRate: 1.0},
+	} {
+		m := m
+		w.ProcessMetric(&m)
+	}
+
+	wm := w.Flush()
+	peak := wm.gauges[samplers.MetricKey{Name: "mem.peak", Type: "gauge"}]
+	assert.Equal(t, float64(30), peak.Flush()[0].Value[0][1], "configured gauges keep the max")
+	current := wm.gauges[samplers.MetricKey{Name: "mem.current", Type: "gauge"}]
+	assert.Equal(t, float64(20), current.Flush()[0].Value[0][1], "other gauges keep the last value")
+}
+
+func TestGaugeAggregationsConfig(t *testing.T) {
+	config := localConfig()
+	config.GaugeAggregations = map[string]string{"mem.peak": "median"}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "median is not a gauge aggregation")
+}
+
+func TestWorkerMetricScales(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	var err error
+	w.scales, err = newMetricScales([]MetricScale{
+		{Name: `\.latency_us$`, Scale: 0.001},
+		{Name: `^api\.`, Scale: 2},
+	})
+	assert.NoError(t, err)
+
+	for _, m := range []samplers.UDPMetric{
+		{MetricKey: samplers.MetricKey{Name: "api.latency_us", Type: "histogram"}, Value: 1000.0, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "api.latency_us", Type: "histogram"}, Value: 3000.0, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "api.requests", Type: "counter"}, Value: 5.0, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "db.requests", Type: "counter"}, Value: 5.0, SampleRate: 1.0},
+		{MetricKey: samplers.MetricKey{Name: "api.users", Type: "set"}, Value: "a", SampleRate: 1.0},
+	} {
+		m := m
+		w.ProcessMetric(&m)
+	}
+	// each of these scales to less than one, but they still add up
+	for i := 0; i < 2000; i++ {
+		w.ProcessMetric(&samplers.UDPMetric{MetricKey: samplers.MetricKey{Name: "db.latency_us", Type: "counter"}, Value: 1.0, SampleRate: 1.0})
+	}
+
+	wm := w.Flush()
+	assert.Equal(t, float64(2), wm.counters[samplers.MetricKey{Name: "db.latency_us", Type: "counter"}].Flush(time.Second)[0].Value[0][1], "scaled counter increments should not be truncated")
+	latency := wm.histograms[samplers.MetricKey{Name: "api.latency_us", Type: "histogram"}]
+	assert.Equal(t, 3.0, latency.LocalMax, "values should be scaled before they're observed")
+	assert.Equal(t, 1.0, latency.LocalMin)
+	assert.Equal(t, 2.0, latency.Value.Quantile(0.5), "percentiles should be in the scaled unit")
+	assert.Equal(t, float64(10), wm.counters[samplers.MetricKey{Name: "api.requests", Type: "counter"}].Flush(time.Second)[0].Value[0][1], "the first matching rule applies")
+	assert.Equal(t, float64(5), wm.counters[samplers.MetricKey{Name: "db.requests", Type: "counter"}].Flush(time.Second)[0].Value[0][1], "unmatched metrics are not scaled")
+	assert.Len(t, wm.sets, 1, "sets are not scaled, but are still processed")
+}
+
+func TestWorkerHistogramCompressions(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	var err error
+	w.compressions, err = newHistogramCompressions([]HistogramCompression{
+		{Name: `^api\.`, Compression: 1000},
+		{Name: `^bulk\.`, Compression: 10},
+	})
+	assert.NoError(t, err)
+
+	// a known distribution: every value in [0, 1) in steps of 1/n, in a
+	// fixed random order, so the true value of each quantile is the quantile
+	const n = 100000
+	for _, i := range rand.New(rand.NewSource(1)).Perm(n) {
+		for _, name := range []string{"api.latency", "bulk.latency", "db.latency"} {
+			m := samplers.UDPMetric{MetricKey: samplers.MetricKey{Name: name, Type: "timer"}, Value: float64(i) / n, SampleRate: 1.0}
+			w.ProcessMetric(&m)
+		}
+	}
+
+	wm := w.Flush()
+	maxError := func(name string) float64 {
+		timer := wm.timers[samplers.MetricKey{Name: name, Type: "timer"}]
+		var worst float64
+		for _, q := range []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99, 0.999} {
+			worst = math.Max(worst, math.Abs(timer.Value.Quantile(q)-q))
+		}
+		return worst
+	}
+	assert.Equal(t, float64(1000), wm.timers[samplers.MetricKey{Name: "api.latency", Type: "timer"}].Value.Compression())
+	assert.Equal(t, float64(samplers.DefaultHistogramCompression), wm.timers[samplers.MetricKey{Name: "db.latency", Type: "timer"}].Value.Compression(), "unmatched metrics get the default")
+	tight, coarse, def := maxError("api.latency"), maxError("bulk.latency"), maxError("db.latency")
+	assert.True(t, tight < def, "compression 1000 should be more accurate than the default: %v vs %v", tight, def)
+	assert.True(t, def < coarse, "the default should be more accurate than compression 10: %v vs %v", def, coarse)
+	assert.True(t, tight < 0.0005, "compression 1000 should be within 0.05%%, was %v", tight)
+
+	// imported digests are merged into one with the configured compression
+	exported, err := wm.timers[samplers.MetricKey{Name: "api.latency", Type: "timer"}].Export()
+	assert.NoError(t, err)
+	exported.Type = "timer"
+	exported.Name = "bulk.latency"
+	exported.MetricKey.Name = "bulk.latency"
+	w.ImportMetric(exported)
+	wm = w.Flush()
+	assert.Equal(t, float64(10), wm.timers[exported.MetricKey].Value.Compression())
+
+	_, err = newHistogramCompressions([]HistogramCompression{{Name: "a", Compression: 0}})
+	assert.Error(t, err)
+	_, err = newHistogramCompressions([]HistogramCompression{{Name: "(", Compression: 100}})
+	assert.Error(t, err)
+}
+
+func TestMetricScalesConfig(t *testing.T) {
+	config := localConfig()
+	config.MetricScales = []MetricScale{{Name: "latency_us$"}}
+	_, err := NewFromConfig(config)
+	assert.Error(t, err, "a scale of zero is a misconfiguration")
+}
+
 func TestWorkerImportSet(t *testing.T) {
 	w := NewWorker(1, nil, logrus.New())
 	testset := samplers.NewSet("a.b.c", nil)
@@ -78,3 +263,112 @@ func TestWorkerImportHistogram(t *testing.T) {
 	wm := w.Flush()
 	assert.Len(t, wm.histograms, 1, "number of flushed histograms")
 }
+
+func TestWorkerFirstReceived(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+
+	m := samplers.UDPMetric{
+		MetricKey: samplers.MetricKey{
+			Name: "a.b.c",
+			Type: "counter",
+		},
+		Value:      1.0,
+		Digest:     12345,
+		SampleRate: 1.0,
+	}
+	before := time.Now()
+	w.ProcessMetric(&m)
+	first := w.wm.firstReceived
+	w.ProcessMetric(&m)
+
+	wm := w.Flush()
+	assert.False(t, wm.firstReceived.Before(before), "should record when the first metric arrived")
+	assert.Equal(t, first, wm.firstReceived, "later metrics should not move the timestamp")
+
+	nometrics := w.Flush()
+	assert.True(t, nometrics.firstReceived.IsZero(), "should reset after a flush")
+}
+
+func TestWorkerResetMetricConcurrent(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	mk := samplers.MetricKey{Name: "a.b.c", Type: "histogram"}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			w.ProcessMetric(&samplers.UDPMetric{MetricKey: mk, Value: float64(i), SampleRate: 1.0})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			w.ResetMetric(mk)
+		}
+	}()
+	wg.Wait()
+
+	// whatever survived the last reset must be internally consistent
+	wm := w.Flush()
+	if h, ok := wm.histograms[mk]; ok {
+		assert.Equal(t, h.LocalWeight, h.Value.Count())
+	}
+}
+
+func TestWorkerInternalMetricsHeld(t *testing.T) {
+	w := NewWorker(1, nil, logrus.New())
+	w.internalEvery = 3
+	parser := samplers.Parser{}
+	process := func(packets ...string) {
+		for _, packet := range packets {
+			m, err := parser.ParseMetric([]byte(packet))
+			assert.NoError(t, err)
+			w.ProcessMetric(m)
+		}
+	}
+
+	for i := 1; i <= 3; i++ {
+		process(
+			"veneur.packet.error_total:10|c|#veneurlocalonly",
+			fmt.Sprintf("veneur.import.requests_in_flight:%d|g|#veneurlocalonly", i),
+			// neither of these are veneur's own
+			"veneur.packet.error_total:1|c",
+			"a.b.c:1|c|#veneurlocalonly",
+		)
+		wm := w.Flush()
+		assert.Len(t, wm.counters, 2, "other metrics should be flushed every interval")
+		assert.Len(t, wm.gauges, 0)
+
+		internal, ok := w.FlushInternal(10 * time.Second)
+		if i < 3 {
+			assert.False(t, ok, "internal metrics should be held until the 3rd flush")
+			continue
+		}
+		if !assert.True(t, ok) {
+			return
+		}
+		assert.Equal(t, 30*time.Second, internal.interval)
+		if assert.Len(t, internal.counters, 1) {
+			for _, c := range internal.counters {
+				flushed := c.Flush(internal.interval)
+				assert.Equal(t, float64(1), flushed[0].Value[0][1], "counters should sum over the held intervals")
+				assert.Equal(t, int32(30), flushed[0].Interval)
+			}
+		}
+		if assert.Len(t, internal.gauges, 1) {
+			for _, g := range internal.gauges {
+				assert.Equal(t, float64(3), g.Flush()[0].Value[0][1], "gauges should keep their latest value")
+			}
+		}
+	}
+
+	_, ok := w.FlushInternal(10 * time.Second)
+	assert.False(t, ok, "the count should start over after flushing")
+
+	// a flush that covers a paused window counts for all of it
+	w.FlushInternal(30 * time.Second)
+	internal, ok := w.FlushInternal(10 * time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 50*time.Second, internal.interval)
+}
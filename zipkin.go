@@ -0,0 +1,115 @@
+package veneur
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stripe/veneur/ssf"
+)
+
+// defaultZipkinBatchSize is how many spans are POSTed to Zipkin at once, if
+// zipkin_batch_size is not set.
+const defaultZipkinBatchSize = 1000
+
+// zipkinSpan is a span in the Zipkin v2 JSON format, as POSTed to a
+// collector's /api/v2/spans.
+type zipkinSpan struct {
+	TraceID       string             `json:"traceId"`
+	ID            string             `json:"id"`
+	ParentID      string             `json:"parentId,omitempty"`
+	Name          string             `json:"name,omitempty"`
+	Timestamp     int64              `json:"timestamp,omitempty"`
+	Duration      int64              `json:"duration,omitempty"`
+	LocalEndpoint *zipkinEndpoint    `json:"localEndpoint,omitempty"`
+	Annotations   []zipkinAnnotation `json:"annotations,omitempty"`
+	Tags          map[string]string  `json:"tags,omitempty"`
+}
+
+type zipkinAnnotation struct {
+	Timestamp int64  `json:"timestamp"`
+	Value     string `json:"value"`
+}
+
+type zipkinEndpoint struct {
+	ServiceName string `json:"serviceName,omitempty"`
+}
+
+// zipkinID renders a span or trace ID as Zipkin expects it, as 16 lower-case
+// hex digits.
+func zipkinID(id int64) string {
+	return fmt.Sprintf("%016x", uint64(id))
+}
+
+// zipkinSpanFromSSF converts an SSF span into a Zipkin one. The span is named
+// after its resource, as that is what identifies the operation, and its SSF
+// name is kept as the name tag. Its annotations become Zipkin annotations.
+// Zipkin times are in microseconds, while SSF's are in nanoseconds;
+// durations are rounded up, since Zipkin takes a duration of 0 to mean that
+// it is unknown.
+func zipkinSpanFromSSF(span ssf.SSFSample) zipkinSpan {
+	zs := zipkinSpan{
+		TraceID:   zipkinID(span.Trace.TraceId),
+		ID:        zipkinID(span.Trace.Id),
+		Name:      span.Trace.Resource,
+		Timestamp: span.Timestamp / 1000,
+		Duration:  (span.Trace.Duration + 999) / 1000,
+	}
+	// root spans have a parent ID of 0 (or -1), which Zipkin leaves out
+	if span.Trace.ParentId > 0 {
+		zs.ParentID = zipkinID(span.Trace.ParentId)
+	}
+	if zs.Name == "" {
+		zs.Name = span.Name
+	}
+	if span.Service != "" {
+		zs.LocalEndpoint = &zipkinEndpoint{ServiceName: span.Service}
+	}
+	for _, a := range span.Annotations {
+		zs.Annotations = append(zs.Annotations, zipkinAnnotation{Timestamp: a.Timestamp / 1000, Value: a.Name})
+	}
+
+	tags := make(map[string]string, len(span.Tags)+2)
+	for _, tag := range span.Tags {
+		tags[tag.Name] = tag.Value
+	}
+	if span.Name != "" {
+		tags["name"] = span.Name
+	}
+	// Zipkin marks a failed span with an error tag, whose value is the
+	// error message if there is one
+	if span.Status != ssf.SSFSample_OK {
+		if span.Message != "" {
+			tags["error"] = span.Message
+		} else {
+			tags["error"] = span.Status.String()
+		}
+	}
+	if len(tags) > 0 {
+		zs.Tags = tags
+	}
+	return zs
+}
+
+// flushZipkin POSTs the spans to the Zipkin collector in batches.
+func (s *Server) flushZipkin(ctx context.Context, spans []zipkinSpan) {
+	batchSize := s.zipkinBatchSize
+	if batchSize <= 0 {
+		batchSize = defaultZipkinBatchSize
+	}
+	for start := 0; start < len(spans); start += batchSize {
+		end := start + batchSize
+		if end > len(spans) {
+			end = len(spans)
+		}
+		err := s.postHelper(ctx, s.zipkinAddress, spans[start:end], "flush_zipkin", s.sinkEncoding(zipkinSinkName))
+		if err != nil {
+			log.WithFields(logrus.Fields{
+				"spans":         end - start,
+				logrus.ErrorKey: err,
+			}).Error("Error flushing spans to Zipkin")
+			continue
+		}
+		log.WithField("spans", end-start).Info("Completed flushing spans to Zipkin")
+	}
+}
@@ -0,0 +1,82 @@
+package veneur
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stripe/veneur/ssf"
+)
+
+func TestZipkinSpanFromSSF(t *testing.T) {
+	span := ssf.SSFSample{
+		Name:      "veneur.http.request",
+		Timestamp: 1482182495032611732,
+		Status:    ssf.SSFSample_CRITICAL,
+		Tags:      []*ssf.SSFTag{{Name: "route", Value: "/users"}},
+		Service:   "veneur-test",
+		Annotations: []*ssf.SSFAnnotation{
+			{Name: "connected", Timestamp: 1482182495032611900},
+		},
+		Trace: &ssf.SSFTrace{
+			TraceId:  9195106660278187518,
+			Id:       255,
+			ParentId: 9195106660278187518,
+			Resource: "GET /users",
+			Duration: 330,
+		},
+	}
+	js, err := json.Marshal(zipkinSpanFromSSF(span))
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{
+		"traceId": "7f9b94ca2db5b5fe",
+		"id": "00000000000000ff",
+		"parentId": "7f9b94ca2db5b5fe",
+		"name": "GET /users",
+		"timestamp": 1482182495032611,
+		"duration": 1,
+		"localEndpoint": {"serviceName": "veneur-test"},
+		"annotations": [{"timestamp": 1482182495032611, "value": "connected"}],
+		"tags": {
+			"route": "/users",
+			"name": "veneur.http.request",
+			"error": "CRITICAL"
+		}
+	}`, string(js))
+
+	// roots have no parent, and a failed span's message is its error
+	span.Trace.ParentId = -1
+	span.Trace.Duration = 2000000
+	span.Message = "connection refused"
+	zs := zipkinSpanFromSSF(span)
+	assert.Equal(t, "", zs.ParentID)
+	assert.Equal(t, int64(2000), zs.Duration)
+	assert.Equal(t, "connection refused", zs.Tags["error"])
+
+	span.Status = ssf.SSFSample_OK
+	_, ok := zipkinSpanFromSSF(span).Tags["error"]
+	assert.False(t, ok, "successful spans aren't errors")
+}
+
+func TestFlushZipkinBatches(t *testing.T) {
+	var batches [][]zipkinSpan
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch []zipkinSpan
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&batch))
+		batches = append(batches, batch)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer collector.Close()
+
+	s := &Server{
+		HTTPClient:      &http.Client{},
+		zipkinAddress:   collector.URL + "/api/v2/spans",
+		zipkinBatchSize: 2,
+	}
+	spans := []zipkinSpan{{ID: "1"}, {ID: "2"}, {ID: "3"}}
+	s.flushZipkin(context.Background(), spans)
+	assert.Equal(t, [][]zipkinSpan{spans[:2], spans[2:]}, batches)
+}